@@ -0,0 +1,409 @@
+// Package appinsights provides a MetricSink which sends custom metrics to
+// Azure Monitor Application Insights.
+package appinsights
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	// DefaultEndpoint is the Application Insights ingestion endpoint
+	DefaultEndpoint = "https://dc.services.visualstudio.com/v2/track"
+
+	// DefaultFlushInterval is how often aggregated metrics are sent
+	DefaultFlushInterval = 10 * time.Second
+
+	// DefaultMaxBatchSize is the maximum number of metrics sent per request
+	DefaultMaxBatchSize = 1000
+
+	// DefaultMaxRetries is the number of times a failed request is retried
+	DefaultMaxRetries = 3
+
+	// DefaultRetryBackoff is the wait before the first retry. It doubles
+	// with every following retry.
+	DefaultRetryBackoff = time.Second
+)
+
+// Data point kinds of the Application Insights MetricData schema
+const (
+	kindMeasurement = 0
+	kindAggregation = 1
+)
+
+// AppInsightsOpts is used to configure the AppInsightsSink
+type AppInsightsOpts struct {
+	// InstrumentationKey identifies the Application Insights resource.
+	// Required.
+	InstrumentationKey string
+
+	// Endpoint is the URL metrics are posted to. Defaults to
+	// DefaultEndpoint.
+	Endpoint string
+
+	// FlushInterval is how often aggregated metrics are sent. Defaults to
+	// DefaultFlushInterval.
+	FlushInterval time.Duration
+
+	// MaxBatchSize bounds the number of metrics sent in a single request.
+	// Defaults to DefaultMaxBatchSize.
+	MaxBatchSize int
+
+	// MaxRetries is the number of times a request is retried after a
+	// network error, a 408, a 429 or a 5xx response. Defaults to
+	// DefaultMaxRetries, a negative value disables retries.
+	MaxRetries int
+
+	// RetryBackoff is the wait before the first retry, doubling with every
+	// following retry. Defaults to DefaultRetryBackoff.
+	RetryBackoff time.Duration
+
+	// Client is the HTTP client used to send requests. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	// ErrorLog is used to log failed flushes. Defaults to a FailureLogger
+	// from metrics.NewFailureLogger.
+	ErrorLog *metrics.FailureLogger
+}
+
+// AppInsightsSink provides a MetricSink that aggregates metrics in memory
+// and periodically posts them to Application Insights as custom metrics.
+// Labels are sent as custom dimensions. Within a flush interval, gauges keep
+// their last value, counters are summed and samples are sent as a single
+// aggregated metric with count, min, max and standard deviation.
+type AppInsightsSink struct {
+	// dropped and errors are accessed atomically and kept first to
+	// guarantee 64-bit alignment
+	dropped uint64
+	errors  uint64
+
+	opts AppInsightsOpts
+
+	lock       sync.Mutex
+	aggregates map[string]*aggregate
+
+	stopChan chan struct{}
+	doneChan chan struct{}
+	stopOnce sync.Once
+}
+
+// aggregate holds the values of one metric for the current flush interval
+type aggregate struct {
+	name       string
+	properties map[string]string
+	kind       int
+	value      float64
+	count      int
+	min        float64
+	max        float64
+	sumSq      float64
+}
+
+// envelope is the Application Insights telemetry envelope
+type envelope struct {
+	Name string       `json:"name"`
+	Time string       `json:"time"`
+	IKey string       `json:"iKey"`
+	Data envelopeData `json:"data"`
+}
+
+type envelopeData struct {
+	BaseType string     `json:"baseType"`
+	BaseData metricData `json:"baseData"`
+}
+
+type metricData struct {
+	Ver        int               `json:"ver"`
+	Metrics    []dataPoint       `json:"metrics"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type dataPoint struct {
+	Name   string   `json:"name"`
+	Kind   int      `json:"kind"`
+	Value  float64  `json:"value"`
+	Count  *int     `json:"count,omitempty"`
+	Min    *float64 `json:"min,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+	StdDev *float64 `json:"stdDev,omitempty"`
+}
+
+// NewAppInsightsSink creates an AppInsightsSink and starts flushing it
+// every opts.FlushInterval. Call Shutdown to flush the remaining metrics
+// and stop.
+func NewAppInsightsSink(opts AppInsightsOpts) (*AppInsightsSink, error) {
+	if opts.InstrumentationKey == "" {
+		return nil, fmt.Errorf("instrumentation key is required")
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = DefaultEndpoint
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = DefaultMaxBatchSize
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultMaxRetries
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = DefaultRetryBackoff
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.ErrorLog == nil {
+		opts.ErrorLog = metrics.NewFailureLogger()
+	}
+
+	s := &AppInsightsSink{
+		opts:       opts,
+		aggregates: make(map[string]*aggregate),
+		stopChan:   make(chan struct{}),
+		doneChan:   make(chan struct{}),
+	}
+	if err := metrics.GoSink(s.flushMetrics); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Shutdown stops the periodic flush and sends the remaining metrics. It is
+// safe to call more than once.
+func (s *AppInsightsSink) Shutdown() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	<-s.doneChan
+	if err := s.Flush(); err != nil {
+		s.opts.ErrorLog.Printf("[ERR] Error flushing to Application Insights! Err: %s", err)
+	}
+}
+
+// Flush sends the metrics aggregated since the last flush. Metrics of a
+// batch which could not be sent after all retries are dropped.
+func (s *AppInsightsSink) Flush() error {
+	s.lock.Lock()
+	aggregates := s.aggregates
+	s.aggregates = make(map[string]*aggregate)
+	s.lock.Unlock()
+
+	if len(aggregates) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	name := "Microsoft.ApplicationInsights." +
+		strings.Replace(s.opts.InstrumentationKey, "-", "", -1) + ".Metric"
+
+	batch := make([]envelope, 0, len(aggregates))
+	var firstErr error
+	for _, agg := range aggregates {
+		batch = append(batch, envelope{
+			Name: name,
+			Time: now,
+			IKey: s.opts.InstrumentationKey,
+			Data: envelopeData{
+				BaseType: "MetricData",
+				BaseData: metricData{
+					Ver:        2,
+					Metrics:    []dataPoint{agg.dataPoint()},
+					Properties: agg.properties,
+				},
+			},
+		})
+		if len(batch) == s.opts.MaxBatchSize {
+			if err := s.send(batch); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := s.send(batch); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// SinkStats returns the number of metrics dropped because their batch could
+// not be sent, and the number of failed requests.
+func (s *AppInsightsSink) SinkStats() metrics.SinkStats {
+	return metrics.SinkStats{
+		Dropped: atomic.LoadUint64(&s.dropped),
+		Errors:  atomic.LoadUint64(&s.errors),
+	}
+}
+
+func (s *AppInsightsSink) flushMetrics() {
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+	defer close(s.doneChan)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				s.opts.ErrorLog.Printf("[ERR] Error flushing to Application Insights! Err: %s", err)
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// send posts a batch of envelopes, retrying transient failures
+func (s *AppInsightsSink) send(batch []envelope) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		atomic.AddUint64(&s.dropped, uint64(len(batch)))
+		return err
+	}
+
+	backoff := s.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil {
+			return nil
+		}
+		atomic.AddUint64(&s.errors, 1)
+		if !retry || attempt >= s.opts.MaxRetries {
+			atomic.AddUint64(&s.dropped, uint64(len(batch)))
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.stopChan:
+			// Shutting down, retry without waiting
+		}
+		backoff *= 2
+	}
+}
+
+// post makes a single request, returning whether a failure is transient
+func (s *AppInsightsSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", s.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// dataPoint converts the aggregate to an Application Insights data point
+func (a *aggregate) dataPoint() dataPoint {
+	dp := dataPoint{Name: a.name, Kind: a.kind, Value: a.value}
+	if a.kind == kindAggregation {
+		count, min, max := a.count, a.min, a.max
+		stdDev := 0.0
+		if a.count > 1 {
+			mean := a.value / float64(a.count)
+			if v := a.sumSq/float64(a.count) - mean*mean; v > 0 {
+				stdDev = math.Sqrt(v)
+			}
+		}
+		dp.Count, dp.Min, dp.Max, dp.StdDev = &count, &min, &max, &stdDev
+	}
+	return dp
+}
+
+// getAggregate returns the aggregate for a metric, creating it if needed.
+// The caller must hold lock.
+func (s *AppInsightsSink) getAggregate(key []string, labels []metrics.Label, kind int) *aggregate {
+	name := strings.Join(key, ".")
+	hash := name
+	for _, label := range labels {
+		hash += fmt.Sprintf(";%s=%s", label.Name, label.Value)
+	}
+	agg, ok := s.aggregates[hash]
+	if !ok {
+		var properties map[string]string
+		if len(labels) > 0 {
+			properties = make(map[string]string, len(labels))
+			for _, label := range labels {
+				properties[label.Name] = label.Value
+			}
+		}
+		agg = &aggregate{name: name, properties: properties, kind: kind}
+		s.aggregates[hash] = agg
+	}
+	return agg
+}
+
+// Implementation of methods in the MetricSink interface
+
+func (s *AppInsightsSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *AppInsightsSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	agg := s.getAggregate(key, labels, kindMeasurement)
+	agg.value = float64(val)
+}
+
+// EmitKey is not implemented since Application Insights does not provide a
+// metric type for arbitrary key/value pairs
+func (s *AppInsightsSink) EmitKey(key []string, val float32) {
+}
+
+func (s *AppInsightsSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *AppInsightsSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	agg := s.getAggregate(key, labels, kindMeasurement)
+	agg.value += float64(val)
+}
+
+func (s *AppInsightsSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *AppInsightsSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	agg := s.getAggregate(key, labels, kindAggregation)
+	v := float64(val)
+	agg.count++
+	agg.value += v
+	agg.sumSq += v * v
+	if v < agg.min || agg.count == 1 {
+		agg.min = v
+	}
+	if v > agg.max || agg.count == 1 {
+		agg.max = v
+	}
+}
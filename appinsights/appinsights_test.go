@@ -0,0 +1,272 @@
+package appinsights
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// fakeEndpoint is an ingestion endpoint recording the envelopes it receives.
+// The first failures requests are answered with status.
+type fakeEndpoint struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	requests  int
+	failures  int
+	status    int
+	envelopes []envelope
+}
+
+func newFakeEndpoint(t *testing.T) *fakeEndpoint {
+	f := &fakeEndpoint{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		f.requests++
+		if f.failures > 0 {
+			f.failures--
+			w.WriteHeader(f.status)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("err: %v", err)
+		}
+		var batch []envelope
+		if err := json.Unmarshal(body, &batch); err != nil {
+			t.Errorf("bad body %q: %v", body, err)
+		}
+		f.envelopes = append(f.envelopes, batch...)
+	}))
+	return f
+}
+
+func (f *fakeEndpoint) received() (int, []envelope) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	envelopes := append([]envelope(nil), f.envelopes...)
+	sort.Slice(envelopes, func(i, j int) bool {
+		return envelopes[i].Data.BaseData.Metrics[0].Name < envelopes[j].Data.BaseData.Metrics[0].Name
+	})
+	return f.requests, envelopes
+}
+
+func testSink(t *testing.T, endpoint string) *AppInsightsSink {
+	sink, err := NewAppInsightsSink(AppInsightsOpts{
+		InstrumentationKey: "0000-1111",
+		Endpoint:           endpoint,
+		FlushInterval:      time.Hour,
+		RetryBackoff:       time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return sink
+}
+
+func TestNewAppInsightsSink_RequiresKey(t *testing.T) {
+	if _, err := NewAppInsightsSink(AppInsightsOpts{}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestAppInsightsSink_Flush(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, f.URL)
+	defer sink.Shutdown()
+
+	labels := []metrics.Label{{Name: "region", Value: "west"}}
+	sink.SetGauge([]string{"a", "gauge"}, 1)
+	sink.SetGauge([]string{"a", "gauge"}, 2)
+	sink.IncrCounterWithLabels([]string{"b", "counter"}, 3, labels)
+	sink.IncrCounterWithLabels([]string{"b", "counter"}, 4, labels)
+	sink.AddSample([]string{"c", "sample"}, 1)
+	sink.AddSample([]string{"c", "sample"}, 3)
+	sink.EmitKey([]string{"d", "kv"}, 1)
+
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	requests, envelopes := f.received()
+	if requests != 1 {
+		t.Fatalf("bad requests: %d", requests)
+	}
+	if len(envelopes) != 3 {
+		t.Fatalf("bad envelopes: %v", envelopes)
+	}
+
+	for _, e := range envelopes {
+		if e.Name != "Microsoft.ApplicationInsights.00001111.Metric" || e.IKey != "0000-1111" {
+			t.Fatalf("bad envelope: %+v", e)
+		}
+		if e.Data.BaseType != "MetricData" {
+			t.Fatalf("bad base type: %s", e.Data.BaseType)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, e.Time); err != nil {
+			t.Fatalf("bad time: %v", err)
+		}
+	}
+
+	gauge := envelopes[0].Data.BaseData.Metrics[0]
+	if gauge.Name != "a.gauge" || gauge.Kind != kindMeasurement || gauge.Value != 2 || gauge.Count != nil {
+		t.Fatalf("bad gauge: %+v", gauge)
+	}
+
+	counter := envelopes[1].Data.BaseData
+	if counter.Metrics[0].Name != "b.counter" || counter.Metrics[0].Value != 7 {
+		t.Fatalf("bad counter: %+v", counter.Metrics[0])
+	}
+	if counter.Properties["region"] != "west" {
+		t.Fatalf("bad properties: %v", counter.Properties)
+	}
+
+	sample := envelopes[2].Data.BaseData.Metrics[0]
+	if sample.Name != "c.sample" || sample.Kind != kindAggregation || sample.Value != 4 {
+		t.Fatalf("bad sample: %+v", sample)
+	}
+	if *sample.Count != 2 || *sample.Min != 1 || *sample.Max != 3 || *sample.StdDev != 1 {
+		t.Fatalf("bad sample: count=%d min=%v max=%v stddev=%v",
+			*sample.Count, *sample.Min, *sample.Max, *sample.StdDev)
+	}
+
+	// Nothing is sent when there is nothing new
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if requests, _ := f.received(); requests != 1 {
+		t.Fatalf("bad requests: %d", requests)
+	}
+}
+
+func TestAppInsightsSink_Batches(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink, err := NewAppInsightsSink(AppInsightsOpts{
+		InstrumentationKey: "key",
+		Endpoint:           f.URL,
+		FlushInterval:      time.Hour,
+		MaxBatchSize:       2,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sink.Shutdown()
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		sink.IncrCounter([]string{k}, 1)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	requests, envelopes := f.received()
+	if requests != 3 || len(envelopes) != 5 {
+		t.Fatalf("bad requests: %d envelopes: %d", requests, len(envelopes))
+	}
+}
+
+func TestAppInsightsSink_Retry(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	f.failures, f.status = 2, http.StatusServiceUnavailable
+	sink := testSink(t, f.URL)
+	defer sink.Shutdown()
+
+	sink.IncrCounter([]string{"a"}, 1)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	requests, envelopes := f.received()
+	if requests != 3 || len(envelopes) != 1 {
+		t.Fatalf("bad requests: %d envelopes: %d", requests, len(envelopes))
+	}
+}
+
+func TestAppInsightsSink_NoRetryOnClientError(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	f.failures, f.status = 1, http.StatusBadRequest
+	sink := testSink(t, f.URL)
+	defer sink.Shutdown()
+
+	sink.IncrCounter([]string{"a"}, 1)
+	if err := sink.Flush(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if requests, _ := f.received(); requests != 1 {
+		t.Fatalf("bad requests: %d", requests)
+	}
+}
+
+func TestAppInsightsSink_RetriesExhausted(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	f.failures, f.status = 10, http.StatusTooManyRequests
+	sink := testSink(t, f.URL)
+	defer sink.Shutdown()
+
+	sink.IncrCounter([]string{"a"}, 1)
+	if err := sink.Flush(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if requests, _ := f.received(); requests != DefaultMaxRetries+1 {
+		t.Fatalf("bad requests: %d", requests)
+	}
+	stats := sink.SinkStats()
+	if stats.Dropped != 1 || stats.Errors != DefaultMaxRetries+1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+}
+
+func TestAppInsightsSink_ShutdownFlushes(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, f.URL)
+
+	sink.IncrCounter([]string{"a"}, 1)
+	sink.Shutdown()
+	if _, envelopes := f.received(); len(envelopes) != 1 {
+		t.Fatalf("bad envelopes: %d", len(envelopes))
+	}
+
+	// Shutting down again sends nothing more
+	sink.Shutdown()
+	if _, envelopes := f.received(); len(envelopes) != 1 {
+		t.Fatalf("bad envelopes: %d", len(envelopes))
+	}
+}
+
+func TestAppInsightsSink_Interval(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink, err := NewAppInsightsSink(AppInsightsOpts{
+		InstrumentationKey: "key",
+		Endpoint:           f.URL,
+		FlushInterval:      10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sink.Shutdown()
+
+	sink.IncrCounter([]string{"a"}, 1)
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, envelopes := f.received(); len(envelopes) == 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
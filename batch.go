@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// RequestBatch accumulates the metrics of a single request or trace and
+// emits them all at once, labelled with its ID, when it is closed. This keeps
+// the metrics of a request together for per-request analysis without passing
+// the ID to every call. Like with a Scope, labels given to a call take
+// precedence over the ID label.
+//
+// Metrics emitted after Close are emitted right away. A RequestBatch is safe
+// for concurrent use.
+type RequestBatch struct {
+	scope *Scope
+
+	lock    sync.Mutex
+	pending []batchedMetric
+	closed  bool
+}
+
+// batchedMetric is a single emission held by a RequestBatch
+type batchedMetric struct {
+	kind    string // "gauge", "counter", "sample" or "timer"
+	key     []string
+	val     float32
+	elapsed time.Duration
+	labels  []Label
+}
+
+// NewRequestBatch returns a RequestBatch emitting to m with the id label,
+// e.g. Label{"request_id", id}.
+func (m *Metrics) NewRequestBatch(id Label) *RequestBatch {
+	return &RequestBatch{scope: m.Scoped([]Label{id})}
+}
+
+func (b *RequestBatch) SetGauge(key []string, val float32) {
+	b.SetGaugeWithLabels(key, val, nil)
+}
+
+func (b *RequestBatch) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	b.add(batchedMetric{kind: "gauge", key: key, val: val, labels: labels})
+}
+
+func (b *RequestBatch) IncrCounter(key []string, val float32) {
+	b.IncrCounterWithLabels(key, val, nil)
+}
+
+func (b *RequestBatch) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	b.add(batchedMetric{kind: "counter", key: key, val: val, labels: labels})
+}
+
+func (b *RequestBatch) AddSample(key []string, val float32) {
+	b.AddSampleWithLabels(key, val, nil)
+}
+
+func (b *RequestBatch) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	b.add(batchedMetric{kind: "sample", key: key, val: val, labels: labels})
+}
+
+func (b *RequestBatch) MeasureSince(key []string, start time.Time) {
+	b.MeasureSinceWithLabels(key, start, nil)
+}
+
+// MeasureSinceWithLabels measures the time since start when called, not when
+// the batch is closed.
+func (b *RequestBatch) MeasureSinceWithLabels(key []string, start time.Time, labels []Label) {
+	elapsed := b.scope.m.now().Sub(start)
+	b.add(batchedMetric{kind: "timer", key: key, elapsed: elapsed, labels: labels})
+}
+
+// Len returns the number of metrics waiting for Close
+func (b *RequestBatch) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.pending)
+}
+
+// Close emits the accumulated metrics in the order they were recorded.
+// Closing a batch again does nothing.
+func (b *RequestBatch) Close() {
+	b.lock.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.closed = true
+	b.lock.Unlock()
+
+	for _, metric := range pending {
+		b.emit(metric)
+	}
+}
+
+// add holds an emission until Close, or emits it if already closed
+func (b *RequestBatch) add(metric batchedMetric) {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		b.emit(metric)
+		return
+	}
+	// Copy as the caller may reuse its slices before Close
+	metric.key = append([]string(nil), metric.key...)
+	if metric.labels != nil {
+		metric.labels = append([]Label(nil), metric.labels...)
+	}
+	b.pending = append(b.pending, metric)
+	b.lock.Unlock()
+}
+
+// emit passes a single emission on to the scope of the batch
+func (b *RequestBatch) emit(metric batchedMetric) {
+	switch metric.kind {
+	case "gauge":
+		b.scope.SetGaugeWithLabels(metric.key, metric.val, metric.labels)
+	case "counter":
+		b.scope.IncrCounterWithLabels(metric.key, metric.val, metric.labels)
+	case "sample":
+		b.scope.AddSampleWithLabels(metric.key, metric.val, metric.labels)
+	case "timer":
+		// Shift the start so the recorded duration is kept
+		start := b.scope.m.now().Add(-metric.elapsed)
+		b.scope.MeasureSinceWithLabels(metric.key, start, metric.labels)
+	}
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRequestBatch(t *testing.T) {
+	m, met := mockMetric()
+	start := time.Now()
+	met.clock = fixedClock{start.Add(5 * time.Millisecond)}
+	met.TimerGranularity = time.Millisecond
+
+	b := met.NewRequestBatch(Label{"request_id", "abc"})
+	key := []string{"db", "queries"}
+	b.IncrCounter(key, 1)
+	b.SetGaugeWithLabels([]string{"rows"}, 20, []Label{{"table", "users"}})
+	b.AddSample([]string{"payload"}, 512)
+	b.MeasureSince([]string{"handler"}, start)
+
+	// Modifying the caller's slices doesn't affect the batch
+	key[1] = "changed"
+
+	// Nothing is emitted before Close
+	if len(m.keys) != 0 || b.Len() != 4 {
+		t.Fatalf("unexpected emissions: %v, pending %d", m.keys, b.Len())
+	}
+
+	// The duration is measured when recorded, not at Close
+	met.clock = fixedClock{start.Add(time.Hour)}
+	b.Close()
+
+	expectKeys := [][]string{{"db", "queries"}, {"rows"}, {"payload"}, {"handler"}}
+	if keys := m.getKeys(); !reflect.DeepEqual(keys, expectKeys) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	if !reflect.DeepEqual(m.vals, []float32{1, 20, 512, 5}) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+	expectLabels := [][]Label{
+		{{"request_id", "abc"}},
+		{{"request_id", "abc"}, {"table", "users"}},
+		{{"request_id", "abc"}},
+		{{"request_id", "abc"}},
+	}
+	if !reflect.DeepEqual(m.labels, expectLabels) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("expected nothing pending, got %d", b.Len())
+	}
+}
+
+func TestRequestBatch_AfterClose(t *testing.T) {
+	m, met := mockMetric()
+	b := met.NewRequestBatch(Label{"request_id", "abc"})
+	b.IncrCounter([]string{"early"}, 1)
+	b.Close()
+
+	// Closing again emits nothing more
+	b.Close()
+	if len(m.keys) != 1 {
+		t.Fatalf("bad keys: %v", m.keys)
+	}
+
+	// Late emissions go out right away with the ID label
+	b.IncrCounterWithLabels([]string{"late"}, 2, []Label{{"a", "b"}})
+	if len(m.keys) != 2 || b.Len() != 0 {
+		t.Fatalf("bad keys: %v", m.keys)
+	}
+	if !reflect.DeepEqual(m.labels[1], []Label{{"a", "b"}, {"request_id", "abc"}}) {
+		t.Fatalf("bad labels: %v", m.labels[1])
+	}
+}
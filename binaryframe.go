@@ -0,0 +1,271 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A binary frame is a single emission, with its key and labels replaced by
+// the integer IDs of a FrameDictionary:
+//
+//	length   uvarint byte count of the rest of the frame
+//	type     1 byte, the MetricType: 0 gauge, 1 counter, 2 sample, 3 key
+//	metric   uvarint metric ID
+//	value    4 bytes, little endian IEEE 754 float32 bits
+//	labels   uvarint label count, then each label ID as a uvarint
+//
+// Labels are in the order of the emission. Every multi-byte field has a
+// fixed byte order or is a varint, so frames decode the same on any target.
+
+// FrameDictionary maps the keys and labels of emissions to the integer IDs
+// of binary frames. It is shared with the collector decoding the frames, so
+// the IDs of a key or label must never change once in use.
+type FrameDictionary struct {
+	// Metrics maps keys, joined with '.', to their IDs
+	Metrics map[string]uint32
+
+	// Labels maps name and value pairs to their IDs
+	Labels map[Label]uint32
+}
+
+// ParseFrameDictionary reads a FrameDictionary in its text format, one entry
+// per line:
+//
+//	metric <id> <key>
+//	label <id> <name>=<value>
+//
+// with the key joined with '.'. Blank lines and lines starting with '#' are
+// ignored.
+func ParseFrameDictionary(r io.Reader) (FrameDictionary, error) {
+	dict := FrameDictionary{Metrics: make(map[string]uint32), Labels: make(map[Label]uint32)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 3)
+		if len(fields) != 3 {
+			return FrameDictionary{}, fmt.Errorf("line %d: expected a kind, an ID and a name", line)
+		}
+		id, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return FrameDictionary{}, fmt.Errorf("line %d: invalid ID %q", line, fields[1])
+		}
+		switch fields[0] {
+		case "metric":
+			dict.Metrics[fields[2]] = uint32(id)
+		case "label":
+			eq := strings.IndexByte(fields[2], '=')
+			if eq <= 0 {
+				return FrameDictionary{}, fmt.Errorf("line %d: expected a label as name=value", line)
+			}
+			dict.Labels[Label{Name: fields[2][:eq], Value: fields[2][eq+1:]}] = uint32(id)
+		default:
+			return FrameDictionary{}, fmt.Errorf("line %d: unknown kind %q", line, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return FrameDictionary{}, err
+	}
+	return dict, dict.validate()
+}
+
+// validate checks that no ID is used twice, so every frame decodes to a
+// single key and labels
+func (d FrameDictionary) validate() error {
+	metrics := make(map[uint32]string, len(d.Metrics))
+	for key, id := range d.Metrics {
+		if other, ok := metrics[id]; ok {
+			return fmt.Errorf("metric ID %d is used by both %q and %q", id, key, other)
+		}
+		metrics[id] = key
+	}
+	labels := make(map[uint32]Label, len(d.Labels))
+	for label, id := range d.Labels {
+		if other, ok := labels[id]; ok {
+			return fmt.Errorf("label ID %d is used by both %s=%s and %s=%s", id, label.Name, label.Value, other.Name, other.Value)
+		}
+		labels[id] = label
+	}
+	return nil
+}
+
+// BinaryFrame is a decoded binary frame
+type BinaryFrame struct {
+	Type   MetricType
+	Metric uint32
+	Value  float32
+	Labels []uint32
+}
+
+// BinaryFrameSink is a MetricSink writing every emission as a binary frame,
+// for resource-constrained collectors ingesting integer IDs rather than
+// string keys. Emissions whose key or one of whose labels is missing from
+// the dictionary are dropped, and counted as dropped in SinkStats.
+//
+// Each frame is written by a single Write call, so a UDP connection sends
+// one datagram per frame.
+type BinaryFrameSink struct {
+	// dropped and errors are accessed atomically and kept first to
+	// guarantee alignment
+	dropped uint64
+	errors  uint64
+
+	dict FrameDictionary
+
+	lock sync.Mutex
+	w    io.Writer
+	buf  []byte
+}
+
+// NewBinaryFrameSink creates a BinaryFrameSink writing the frames of the
+// emissions in dict to w
+func NewBinaryFrameSink(w io.Writer, dict FrameDictionary) (*BinaryFrameSink, error) {
+	if err := dict.validate(); err != nil {
+		return nil, err
+	}
+	return &BinaryFrameSink{dict: dict, w: w}, nil
+}
+
+// SinkStats returns the number of emissions dropped for missing from the
+// dictionary, and the number of failed writes
+func (b *BinaryFrameSink) SinkStats() SinkStats {
+	return SinkStats{
+		Dropped: atomic.LoadUint64(&b.dropped),
+		Errors:  atomic.LoadUint64(&b.errors),
+	}
+}
+
+// write writes the frame of an emission
+func (b *BinaryFrameSink) write(typ MetricType, key []string, val float32, labels []Label) {
+	metric, ok := b.dict.Metrics[strings.Join(key, ".")]
+	if !ok {
+		atomic.AddUint64(&b.dropped, 1)
+		notifyDrop(key, labels, DropUnknownID)
+		return
+	}
+	var ids [8]uint32
+	labelIDs := ids[:0]
+	for _, label := range labels {
+		id, ok := b.dict.Labels[label]
+		if !ok {
+			atomic.AddUint64(&b.dropped, 1)
+			notifyDrop(key, labels, DropUnknownID)
+			return
+		}
+		labelIDs = append(labelIDs, id)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.buf = appendBinaryFrame(b.buf[:0], BinaryFrame{Type: typ, Metric: metric, Value: val, Labels: labelIDs})
+	if _, err := b.w.Write(b.buf); err != nil {
+		atomic.AddUint64(&b.errors, 1)
+	}
+}
+
+// appendBinaryFrame appends the length-prefixed encoding of f to buf
+func appendBinaryFrame(buf []byte, f BinaryFrame) []byte {
+	size := 1 + uvarintLen(uint64(f.Metric)) + 4 + uvarintLen(uint64(len(f.Labels)))
+	for _, id := range f.Labels {
+		size += uvarintLen(uint64(id))
+	}
+
+	buf = appendUvarint(buf, uint64(size))
+	buf = append(buf, byte(f.Type))
+	buf = appendUvarint(buf, uint64(f.Metric))
+	var bits [4]byte
+	binary.LittleEndian.PutUint32(bits[:], math.Float32bits(f.Value))
+	buf = append(buf, bits[:]...)
+	buf = appendUvarint(buf, uint64(len(f.Labels)))
+	for _, id := range f.Labels {
+		buf = appendUvarint(buf, uint64(id))
+	}
+	return buf
+}
+
+// DecodeBinaryFrames decodes the consecutive binary frames of buf, e.g. as
+// received by a collector
+func DecodeBinaryFrames(buf []byte) ([]BinaryFrame, error) {
+	var frames []BinaryFrame
+	for len(buf) > 0 {
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || size > uint64(len(buf)-n) {
+			return frames, fmt.Errorf("truncated frame length")
+		}
+		frame, err := decodeBinaryFrame(buf[n : n+int(size)])
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, frame)
+		buf = buf[n+int(size):]
+	}
+	return frames, nil
+}
+
+// decodeBinaryFrame decodes the body of a binary frame
+func decodeBinaryFrame(body []byte) (BinaryFrame, error) {
+	d := walDecoder{buf: body}
+	f := BinaryFrame{Type: MetricType(d.readByte())}
+	f.Metric = d.readID()
+	f.Value = math.Float32frombits(d.readUint32())
+	if n := d.readCount(); n > 0 {
+		f.Labels = make([]uint32, n)
+		for i := range f.Labels {
+			f.Labels[i] = d.readID()
+		}
+	}
+	if d.err || len(d.buf) != 0 {
+		return BinaryFrame{}, fmt.Errorf("malformed frame")
+	}
+	if f.Type >= numMetricTypes {
+		return BinaryFrame{}, fmt.Errorf("unknown frame type %d", f.Type)
+	}
+	return f, nil
+}
+
+// readID reads a uvarint metric or label ID, which must fit in 32 bits
+func (d *walDecoder) readID() uint32 {
+	v := d.readUvarint()
+	if v > math.MaxUint32 {
+		d.err = true
+		return 0
+	}
+	return uint32(v)
+}
+
+func (b *BinaryFrameSink) SetGauge(key []string, val float32) {
+	b.write(MetricTypeGauge, key, val, nil)
+}
+
+func (b *BinaryFrameSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	b.write(MetricTypeGauge, key, val, labels)
+}
+
+func (b *BinaryFrameSink) EmitKey(key []string, val float32) {
+	b.write(MetricTypeKey, key, val, nil)
+}
+
+func (b *BinaryFrameSink) IncrCounter(key []string, val float32) {
+	b.write(MetricTypeCounter, key, val, nil)
+}
+
+func (b *BinaryFrameSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	b.write(MetricTypeCounter, key, val, labels)
+}
+
+func (b *BinaryFrameSink) AddSample(key []string, val float32) {
+	b.write(MetricTypeSample, key, val, nil)
+}
+
+func (b *BinaryFrameSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	b.write(MetricTypeSample, key, val, labels)
+}
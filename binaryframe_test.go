@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testFrameDictionary = `
+# Metrics
+metric 1 api.requests
+metric 2 api.latency
+metric 300 queue.depth
+
+# Labels
+label 1 route=/users
+label 2 code=200
+label 1000 path=a=b
+`
+
+func testFrameSink(t *testing.T) (*BinaryFrameSink, *bytes.Buffer) {
+	dict, err := ParseFrameDictionary(strings.NewReader(testFrameDictionary))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	b, err := NewBinaryFrameSink(buf, dict)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return b, buf
+}
+
+func TestParseFrameDictionary(t *testing.T) {
+	dict, err := ParseFrameDictionary(strings.NewReader(testFrameDictionary))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if dict.Metrics["queue.depth"] != 300 || dict.Labels[Label{"path", "a=b"}] != 1000 {
+		t.Fatalf("bad dictionary: %+v", dict)
+	}
+
+	for _, bad := range []string{
+		"metric 1",
+		"metric x api.requests",
+		"metric 4294967296 api.requests",
+		"label 1 route",
+		"series 1 api.requests",
+		"metric 1 a\nmetric 1 b",
+		"label 1 a=b\nlabel 1 c=d",
+	} {
+		if _, err := ParseFrameDictionary(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestBinaryFrameSink_RoundTrip(t *testing.T) {
+	b, buf := testFrameSink(t)
+	b.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"route", "/users"}, {"code", "200"}})
+	b.AddSampleWithLabels([]string{"api", "latency"}, 12.5, []Label{{"path", "a=b"}})
+	b.SetGauge([]string{"queue", "depth"}, -3)
+	b.EmitKey([]string{"api", "requests"}, 7)
+
+	// Emissions missing from the dictionary are dropped
+	b.IncrCounter([]string{"api", "errors"}, 1)
+	b.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"code", "500"}})
+	if stats := b.SinkStats(); stats.Dropped != 2 || stats.Errors != 0 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+
+	frames, err := DecodeBinaryFrames(buf.Bytes())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := []BinaryFrame{
+		{Type: MetricTypeCounter, Metric: 1, Value: 1, Labels: []uint32{1, 2}},
+		{Type: MetricTypeSample, Metric: 2, Value: 12.5, Labels: []uint32{1000}},
+		{Type: MetricTypeGauge, Metric: 300, Value: -3},
+		{Type: MetricTypeKey, Metric: 1, Value: 7},
+	}
+	if !reflect.DeepEqual(frames, expect) {
+		t.Fatalf("bad frames:\n%+v\nexpected:\n%+v", frames, expect)
+	}
+}
+
+func TestBinaryFrameSink_Format(t *testing.T) {
+	b, buf := testFrameSink(t)
+	b.SetGaugeWithLabels([]string{"queue", "depth"}, 1, []Label{{"route", "/users"}})
+
+	// Length, type, metric ID 300 as a uvarint, 1.0 in little endian, one
+	// label with ID 1
+	expect := []byte{9, 0, 0xac, 0x02, 0x00, 0x00, 0x80, 0x3f, 1, 1}
+	if !bytes.Equal(buf.Bytes(), expect) {
+		t.Fatalf("bad frame: %x", buf.Bytes())
+	}
+}
+
+func TestDecodeBinaryFrames_Malformed(t *testing.T) {
+	b, buf := testFrameSink(t)
+	b.SetGauge([]string{"queue", "depth"}, 1)
+	frame := buf.Bytes()
+
+	for _, bad := range [][]byte{
+		frame[:len(frame)-1],
+		{1, 0},
+		{8, 9, 1, 0, 0, 0, 0, 0, 0},
+		append(append([]byte{}, frame...), 0x80),
+	} {
+		if _, err := DecodeBinaryFrames(bad); err == nil {
+			t.Fatalf("expected error for %x", bad)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestBinaryFrameSink_WriteErrors(t *testing.T) {
+	b, err := NewBinaryFrameSink(failingWriter{}, FrameDictionary{Metrics: map[string]uint32{"a": 1}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	b.IncrCounter([]string{"a"}, 1)
+	if stats := b.SinkStats(); stats.Errors != 1 || stats.Dropped != 0 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+}
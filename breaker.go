@@ -0,0 +1,269 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultBreakerThreshold is the default number of consecutive failures
+	// which trips a CircuitBreakerSink
+	DefaultBreakerThreshold = 5
+
+	// DefaultBreakerCoolDown is the default time a tripped
+	// CircuitBreakerSink drops emissions before probing the sink again
+	DefaultBreakerCoolDown = 30 * time.Second
+)
+
+// CircuitBreakerOpts is used to configure a CircuitBreakerSink
+type CircuitBreakerOpts struct {
+	// Threshold is the number of consecutive failures which trips the
+	// breaker. Defaults to DefaultBreakerThreshold.
+	Threshold int
+
+	// CoolDown is how long a tripped breaker drops emissions before letting
+	// a single probe through. Defaults to DefaultBreakerCoolDown.
+	CoolDown time.Duration
+
+	// Clock is the source of the current time, mostly for testing. Defaults
+	// to the system clock.
+	Clock Clock
+}
+
+// breakerState is the state of a CircuitBreakerSink
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitBreakerSink wraps a MetricSink which reports its errors with
+// SinkStats, and stops passing emissions on to it while it is persistently
+// failing, so a dead backend doesn't cost every emission a doomed attempt.
+//
+// An emission fails if the error count of the sink went up while it was
+// passed on, and succeeds otherwise. After Threshold consecutive failures
+// the breaker trips open, and emissions are dropped and counted for
+// CoolDown. Then a single emission is let through as a probe: if it succeeds
+// the breaker closes again, otherwise it stays open for another CoolDown.
+//
+// Failures are detected most precisely for sinks which fail within the
+// emitting call. For sinks delivering in the background, such as the statsd
+// sink, errors count against the emissions during which they happen.
+type CircuitBreakerSink struct {
+	// dropped and trips are accessed atomically and kept first to guarantee
+	// 64-bit alignment
+	dropped uint64
+	trips   uint64
+
+	sink      MetricSink
+	stats     SinkStatsReporter
+	threshold int
+	coolDown  time.Duration
+	clock     Clock
+
+	lock       sync.Mutex
+	state      breakerState
+	failures   int
+	openedAt   time.Time
+	lastErrors uint64
+}
+
+// NewCircuitBreakerSink creates a CircuitBreakerSink passing emissions to
+// sink, which must implement SinkStatsReporter.
+func NewCircuitBreakerSink(sink MetricSink, opts CircuitBreakerOpts) (*CircuitBreakerSink, error) {
+	stats, ok := sink.(SinkStatsReporter)
+	if !ok {
+		return nil, fmt.Errorf("sink %T does not report its errors with SinkStats", sink)
+	}
+	if opts.Threshold < 0 {
+		return nil, fmt.Errorf("invalid threshold %d", opts.Threshold)
+	}
+	if opts.CoolDown < 0 {
+		return nil, fmt.Errorf("invalid cool-down %v", opts.CoolDown)
+	}
+	if opts.Threshold == 0 {
+		opts.Threshold = DefaultBreakerThreshold
+	}
+	if opts.CoolDown == 0 {
+		opts.CoolDown = DefaultBreakerCoolDown
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	return &CircuitBreakerSink{
+		sink:       sink,
+		stats:      stats,
+		threshold:  opts.Threshold,
+		coolDown:   opts.CoolDown,
+		clock:      opts.Clock,
+		lastErrors: stats.SinkStats().Errors,
+	}, nil
+}
+
+func (c *CircuitBreakerSink) SetGauge(key []string, val float32) {
+	c.SetGaugeWithLabels(key, val, nil)
+}
+
+func (c *CircuitBreakerSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	c.emit(key, labels, func() { c.sink.SetGaugeWithLabels(key, val, labels) })
+}
+
+func (c *CircuitBreakerSink) EmitKey(key []string, val float32) {
+	c.emit(key, nil, func() { c.sink.EmitKey(key, val) })
+}
+
+func (c *CircuitBreakerSink) IncrCounter(key []string, val float32) {
+	c.IncrCounterWithLabels(key, val, nil)
+}
+
+func (c *CircuitBreakerSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	c.emit(key, labels, func() { c.sink.IncrCounterWithLabels(key, val, labels) })
+}
+
+func (c *CircuitBreakerSink) AddSample(key []string, val float32) {
+	c.AddSampleWithLabels(key, val, nil)
+}
+
+func (c *CircuitBreakerSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	c.emit(key, labels, func() { c.sink.AddSampleWithLabels(key, val, labels) })
+}
+
+func (c *CircuitBreakerSink) AddTimingSample(key []string, val float32, unit time.Duration, labels []Label) {
+	c.emit(key, labels, func() { addTiming(c.sink, key, val, unit, labels) })
+}
+
+func (c *CircuitBreakerSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	c.emit(key, labels, func() { observeBuckets(c.sink, key, counts, labels) })
+}
+
+func (c *CircuitBreakerSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	c.emit(key, labels, func() { setGaugeInt(c.sink, key, val, labels) })
+}
+
+func (c *CircuitBreakerSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	c.emit(key, labels, func() { incrCounterInt(c.sink, key, val, labels) })
+}
+
+func (c *CircuitBreakerSink) ResetCounter(key []string, labels []Label) {
+	c.emit(key, labels, func() { resetCounter(c.sink, key, labels) })
+}
+
+// SetCounterTemporality passes the temporality to the wrapped sink, even
+// while the breaker is open
+func (c *CircuitBreakerSink) SetCounterTemporality(key []string, temporality Temporality) {
+	setCounterTemporality(c.sink, key, temporality)
+}
+
+// SetResourceLabels passes the names to the wrapped sink, even while the
+// breaker is open, as they configure it rather than emit to it
+func (c *CircuitBreakerSink) SetResourceLabels(names []string) {
+	setResourceLabels(c.sink, names)
+}
+
+// SetTimestampOffset passes the offset to the wrapped sink, even while the
+// breaker is open
+func (c *CircuitBreakerSink) SetTimestampOffset(offset time.Duration) {
+	setTimestampOffset(c.sink, offset)
+}
+
+// SinkStats returns the stats of the wrapped sink, with the emissions dropped
+// by the breaker added to its dropped metrics.
+func (c *CircuitBreakerSink) SinkStats() SinkStats {
+	stats := c.stats.SinkStats()
+	stats.Dropped += atomic.LoadUint64(&c.dropped)
+	return stats
+}
+
+// IsOpen returns whether the breaker is tripped, so emissions are dropped
+// until the next probe succeeds
+func (c *CircuitBreakerSink) IsOpen() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state != breakerClosed
+}
+
+// Trips returns the number of times the breaker tripped open
+func (c *CircuitBreakerSink) Trips() uint64 {
+	return atomic.LoadUint64(&c.trips)
+}
+
+// emit passes an emission on unless the breaker is open
+func (c *CircuitBreakerSink) emit(key []string, labels []Label, pass func()) {
+	ok, probe := c.allow()
+	if !ok {
+		atomic.AddUint64(&c.dropped, 1)
+		notifyDrop(key, labels, DropCircuitOpen)
+		return
+	}
+	pass()
+	c.record(probe)
+}
+
+// allow returns whether an emission may be passed on, and whether it is the
+// probe of a breaker which finished its cool-down
+func (c *CircuitBreakerSink) allow() (bool, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch c.state {
+	case breakerClosed:
+		return true, false
+	case breakerOpen:
+		if c.clock.Now().Sub(c.openedAt) >= c.coolDown {
+			c.state = breakerHalfOpen
+			return true, true
+		}
+	}
+	// Open, or a probe is in flight
+	return false, false
+}
+
+// record updates the breaker with the outcome of a passed on emission
+func (c *CircuitBreakerSink) record(probe bool) {
+	errors := c.stats.SinkStats().Errors
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var failures int
+	if errors > c.lastErrors {
+		failures = int(errors - c.lastErrors)
+		c.lastErrors = errors
+	}
+
+	if probe {
+		if failures > 0 {
+			c.trip()
+		} else {
+			c.state = breakerClosed
+			c.failures = 0
+		}
+		return
+	}
+
+	// The breaker may have been tripped by a concurrent emission
+	if c.state != breakerClosed {
+		return
+	}
+	if failures == 0 {
+		c.failures = 0
+		return
+	}
+	c.failures += failures
+	if c.failures >= c.threshold {
+		c.trip()
+	}
+}
+
+// trip opens the breaker. The caller must hold lock.
+func (c *CircuitBreakerSink) trip() {
+	c.state = breakerOpen
+	c.openedAt = c.clock.Now()
+	c.failures = 0
+	atomic.AddUint64(&c.trips, 1)
+}
@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+// failingSink is a MockSink that counts an error for every emission while
+// failing is set
+type failingSink struct {
+	MockSink
+	failing bool
+	errors  uint64
+}
+
+func (f *failingSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	f.MockSink.IncrCounterWithLabels(key, val, labels)
+	if f.failing {
+		f.errors++
+	}
+}
+
+func (f *failingSink) SinkStats() SinkStats {
+	return SinkStats{Errors: f.errors}
+}
+
+func TestCircuitBreakerSink(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	f := &failingSink{}
+	c, err := NewCircuitBreakerSink(f, CircuitBreakerOpts{
+		Threshold: 3,
+		CoolDown:  time.Minute,
+		Clock:     clock,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	emit := func() { c.IncrCounter([]string{"c"}, 1) }
+
+	// Failures must be consecutive to trip the breaker
+	f.failing = true
+	emit()
+	emit()
+	f.failing = false
+	emit()
+	f.failing = true
+	emit()
+	emit()
+	if c.IsOpen() || len(f.keys) != 5 {
+		t.Fatalf("should not trip yet, passed %d", len(f.keys))
+	}
+
+	// Trip
+	emit()
+	if !c.IsOpen() || c.Trips() != 1 {
+		t.Fatalf("expected breaker to trip")
+	}
+
+	// Emissions are dropped and counted during the cool-down
+	clock.Advance(59 * time.Second)
+	emit()
+	emit()
+	if len(f.keys) != 6 {
+		t.Fatalf("expected emissions to be dropped, passed %d", len(f.keys))
+	}
+	if stats := c.SinkStats(); stats.Dropped != 2 || stats.Errors != 5 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+
+	// A failing probe opens the breaker for another cool-down
+	clock.Advance(time.Second)
+	emit()
+	if !c.IsOpen() || c.Trips() != 2 || len(f.keys) != 7 {
+		t.Fatalf("expected failed probe to reopen, passed %d", len(f.keys))
+	}
+	emit()
+	if len(f.keys) != 7 {
+		t.Fatalf("expected emission to be dropped")
+	}
+
+	// A successful probe recovers
+	f.failing = false
+	clock.Advance(time.Minute)
+	emit()
+	if c.IsOpen() || len(f.keys) != 8 {
+		t.Fatalf("expected breaker to close")
+	}
+	emit()
+	if len(f.keys) != 9 {
+		t.Fatalf("expected emissions to pass")
+	}
+
+	// The failure count starts over after recovering
+	f.failing = true
+	emit()
+	emit()
+	if c.IsOpen() {
+		t.Fatalf("should not trip yet")
+	}
+	emit()
+	if !c.IsOpen() || c.Trips() != 3 {
+		t.Fatalf("expected breaker to trip")
+	}
+}
+
+func TestNewCircuitBreakerSink(t *testing.T) {
+	if _, err := NewCircuitBreakerSink(&MockSink{}, CircuitBreakerOpts{}); err == nil {
+		t.Fatalf("expected error for sink without stats")
+	}
+	for _, opts := range []CircuitBreakerOpts{
+		{Threshold: -1},
+		{CoolDown: -time.Second},
+	} {
+		if _, err := NewCircuitBreakerSink(&failingSink{}, opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+
+	f := &failingSink{errors: 10}
+	c, err := NewCircuitBreakerSink(f, CircuitBreakerOpts{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if c.threshold != DefaultBreakerThreshold || c.coolDown != DefaultBreakerCoolDown {
+		t.Fatalf("bad defaults: %d %v", c.threshold, c.coolDown)
+	}
+
+	// Errors from before the breaker was created don't count
+	c.IncrCounter([]string{"c"}, 1)
+	if c.IsOpen() || c.failures != 0 {
+		t.Fatalf("bad failures: %d", c.failures)
+	}
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Names of the default bucket schemes returned by BucketScheme
+const (
+	// BucketsLatencyMs covers latencies in milliseconds, from 0.5ms to 10s
+	BucketsLatencyMs = "latency-ms"
+
+	// BucketsLatencyUs covers latencies in microseconds, from 10µs to 1s
+	BucketsLatencyUs = "latency-us"
+
+	// BucketsSizesBytes covers sizes in bytes, from 64B to 64MiB in powers
+	// of 4
+	BucketsSizesBytes = "sizes-bytes"
+)
+
+// bucketSchemes maps the names of the default bucket schemes to their upper
+// bounds, which follow the usual 1, 2.5, 5 steps per decade for latencies
+var bucketSchemes = map[string][]float64{
+	BucketsLatencyMs: {0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000},
+	BucketsLatencyUs: {10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 25000, 50000, 100000, 250000, 500000, 1000000},
+	BucketsSizesBytes: {
+		64, 256, 1024, 4096, 16384, 65536, 262144,
+		1 << 20, 4 << 20, 16 << 20, 64 << 20,
+	},
+}
+
+// BucketScheme returns the upper bounds of the named default bucket scheme,
+// e.g. BucketsLatencyMs, for the histograms of sinks supporting them, such as
+// InmemSink.EnableBucketHistograms. They are a reasonable start for metrics
+// of unknown distribution. The returned slice is a copy the caller may
+// modify.
+func BucketScheme(name string) ([]float64, error) {
+	bounds, ok := bucketSchemes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown bucket scheme %q", name)
+	}
+	return append([]float64(nil), bounds...), nil
+}
+
+// BucketSchemeNames returns the names of the default bucket schemes, sorted
+func BucketSchemeNames() []string {
+	names := make([]string, 0, len(bucketSchemes))
+	for name := range bucketSchemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateBuckets returns an error unless bounds are finite and strictly
+// increasing
+func validateBuckets(bounds []float64) error {
+	if len(bounds) == 0 {
+		return fmt.Errorf("no bucket bounds")
+	}
+	for i, bound := range bounds {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return fmt.Errorf("invalid bucket bound %v", bound)
+		}
+		if i > 0 && bound <= bounds[i-1] {
+			return fmt.Errorf("bucket bounds are not increasing: %v after %v", bound, bounds[i-1])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBucketScheme(t *testing.T) {
+	expect := map[string][]float64{
+		BucketsLatencyMs:  {0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000},
+		BucketsLatencyUs:  {10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 25000, 50000, 100000, 250000, 500000, 1000000},
+		BucketsSizesBytes: {64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216, 67108864},
+	}
+	if names := BucketSchemeNames(); !reflect.DeepEqual(names, []string{BucketsLatencyMs, BucketsLatencyUs, BucketsSizesBytes}) {
+		t.Fatalf("bad names: %v", names)
+	}
+	for name, bounds := range expect {
+		got, err := BucketScheme(name)
+		if err != nil {
+			t.Fatalf("%s: err: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, bounds) {
+			t.Fatalf("%s: bad bounds: %v", name, got)
+		}
+		if err := validateBuckets(got); err != nil {
+			t.Fatalf("%s: err: %v", name, err)
+		}
+
+		// The bounds are copied
+		got[0] = -1
+		if again, _ := BucketScheme(name); again[0] != bounds[0] {
+			t.Fatalf("%s: scheme was modified: %v", name, again)
+		}
+	}
+
+	if _, err := BucketScheme("latency-days"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestValidateBuckets(t *testing.T) {
+	for _, bounds := range [][]float64{nil, {1, 1}, {2, 1}, {1, math.NaN()}, {1, math.Inf(1)}} {
+		if err := validateBuckets(bounds); err == nil {
+			t.Fatalf("%v: expected error", bounds)
+		}
+	}
+}
+
+func TestInmemSink_BucketHistograms(t *testing.T) {
+	inm := NewInmemSink(10*time.Second, time.Minute)
+	if err := inm.EnableBucketHistograms([]float64{10, 5}); err == nil {
+		t.Fatalf("expected error")
+	}
+	bounds, _ := BucketScheme(BucketsLatencyMs)
+	if err := inm.EnableBucketHistograms(bounds); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, v := range []float32{0.2, 1, 3, 4, 20000} {
+		inm.AddSample([]string{"latency"}, v)
+	}
+
+	sample := inm.Data()[0].Samples["latency"]
+	expect := map[float64]uint64{0.5: 1, 1: 1, 5: 2, math.Inf(1): 1}
+	if !reflect.DeepEqual(sample.Buckets, expect) {
+		t.Fatalf("bad buckets: %v", sample.Buckets)
+	}
+	if sample.Count != 5 {
+		t.Fatalf("bad count: %d", sample.Count)
+	}
+}
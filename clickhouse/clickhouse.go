@@ -0,0 +1,394 @@
+// Package clickhouse provides a MetricSink which inserts every emission as a
+// row of a ClickHouse table, for ad-hoc queries over the raw metrics. Rows
+// are inserted in batches by an Inserter, which can wrap any ClickHouse
+// client. HTTPInserter inserts over the HTTP interface into a table like:
+//
+//	CREATE TABLE metrics (
+//	    timestamp DateTime64(3),
+//	    name      String,
+//	    labels    Map(String, String),
+//	    value     Float64,
+//	    type      LowCardinality(String)
+//	) ENGINE = MergeTree ORDER BY (name, timestamp)
+package clickhouse
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	// DefaultBatchSize is the number of pending rows which triggers a flush
+	DefaultBatchSize = 1000
+
+	// DefaultFlushInterval is how often pending rows are flushed
+	DefaultFlushInterval = 10 * time.Second
+
+	// DefaultInsertTimeout bounds the duration of each insert
+	DefaultInsertTimeout = 10 * time.Second
+)
+
+// Row types, as stored in the type column
+const (
+	TypeGauge   = "gauge"
+	TypeCounter = "counter"
+	TypeSample  = "sample"
+	TypeKey     = "key"
+)
+
+// Row is a single emission
+type Row struct {
+	Timestamp time.Time
+	Name      string
+	// Labels maps label names to values, for a Map(String, String) column.
+	// It is nil for emissions without labels.
+	Labels map[string]string
+	Value  float64
+	Type   string
+}
+
+// Inserter inserts a batch of rows into the metrics table, e.g. with a single
+// batched INSERT of a ClickHouse client. It must return once ctx is done.
+type Inserter interface {
+	Insert(ctx context.Context, rows []Row) error
+}
+
+// ClickHouseOpts is used to configure the ClickHouseSink
+type ClickHouseOpts struct {
+	// Inserter inserts the batches of rows. Required.
+	Inserter Inserter
+
+	// BatchSize is the number of pending rows which triggers a flush, and
+	// the maximum number of rows per insert. Defaults to DefaultBatchSize.
+	BatchSize int
+
+	// FlushInterval is how often pending rows are flushed, so rows are
+	// inserted timely even when few are emitted. Defaults to
+	// DefaultFlushInterval.
+	FlushInterval time.Duration
+
+	// InsertTimeout bounds each insert. Defaults to DefaultInsertTimeout.
+	InsertTimeout time.Duration
+
+	// MaxPending is the number of rows buffered while inserts are slow or
+	// failing. Rows emitted while the buffer is full are dropped. Defaults
+	// to ten times BatchSize.
+	MaxPending int
+
+	// ErrorLog is used to log failed inserts. Defaults to a FailureLogger
+	// from metrics.NewFailureLogger.
+	ErrorLog *metrics.FailureLogger
+}
+
+// ClickHouseSink provides a MetricSink that buffers every emission as a Row
+// and inserts the rows in batches, once BatchSize rows are pending or every
+// FlushInterval. Emissions are not aggregated. Rows of a failed insert are
+// dropped.
+type ClickHouseSink struct {
+	// dropped, errors and offset are accessed atomically and kept first to
+	// guarantee 64-bit alignment
+	dropped uint64
+	errors  uint64
+	offset  int64 // time.Duration added to timestamps
+
+	opts ClickHouseOpts
+
+	lock    sync.Mutex
+	pending []Row
+
+	// flushLock serializes flushes, so batches are inserted in order
+	flushLock sync.Mutex
+
+	flushChan chan struct{}
+	stopChan  chan struct{}
+	doneChan  chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewClickHouseSink creates a ClickHouseSink and starts flushing it. Call
+// Shutdown to insert the remaining rows and stop.
+func NewClickHouseSink(opts ClickHouseOpts) (*ClickHouseSink, error) {
+	if opts.Inserter == nil {
+		return nil, fmt.Errorf("inserter is required")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.InsertTimeout <= 0 {
+		opts.InsertTimeout = DefaultInsertTimeout
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = 10 * opts.BatchSize
+	}
+	if opts.MaxPending < opts.BatchSize {
+		return nil, fmt.Errorf("max pending %d is below the batch size %d", opts.MaxPending, opts.BatchSize)
+	}
+	if opts.ErrorLog == nil {
+		opts.ErrorLog = metrics.NewFailureLogger()
+	}
+
+	s := &ClickHouseSink{
+		opts:      opts,
+		flushChan: make(chan struct{}, 1),
+		stopChan:  make(chan struct{}),
+		doneChan:  make(chan struct{}),
+	}
+	if err := metrics.GoSink(s.flushMetrics); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Shutdown stops the periodic flush and inserts the remaining rows. It is
+// safe to call more than once.
+func (s *ClickHouseSink) Shutdown() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	<-s.doneChan
+	if err := s.Flush(); err != nil {
+		s.opts.ErrorLog.Printf("[ERR] Error inserting into ClickHouse! Err: %s", err)
+	}
+}
+
+// Flush inserts the pending rows, in batches of at most BatchSize rows.
+func (s *ClickHouseSink) Flush() error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	s.lock.Lock()
+	rows := s.pending
+	s.pending = nil
+	s.lock.Unlock()
+
+	var firstErr error
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > s.opts.BatchSize {
+			n = s.opts.BatchSize
+		}
+		if err := s.insert(rows[:n]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		rows = rows[n:]
+	}
+	return firstErr
+}
+
+// SetTimestampOffset adds offset to the timestamps of later rows, as
+// described by metrics.TimestampSink
+func (s *ClickHouseSink) SetTimestampOffset(offset time.Duration) {
+	atomic.StoreInt64(&s.offset, int64(offset))
+}
+
+// SinkStats returns the number of rows dropped because the buffer was full
+// or their insert failed, and the number of failed inserts.
+func (s *ClickHouseSink) SinkStats() metrics.SinkStats {
+	return metrics.SinkStats{
+		Dropped: atomic.LoadUint64(&s.dropped),
+		Errors:  atomic.LoadUint64(&s.errors),
+	}
+}
+
+func (s *ClickHouseSink) flushMetrics() {
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+	defer close(s.doneChan)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.flushChan:
+		case <-s.stopChan:
+			return
+		}
+		if err := s.Flush(); err != nil {
+			s.opts.ErrorLog.Printf("[ERR] Error inserting into ClickHouse! Err: %s", err)
+		}
+	}
+}
+
+// insert inserts a single batch
+func (s *ClickHouseSink) insert(rows []Row) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.InsertTimeout)
+	defer cancel()
+
+	if err := s.opts.Inserter.Insert(ctx, rows); err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		atomic.AddUint64(&s.dropped, uint64(len(rows)))
+		return err
+	}
+	return nil
+}
+
+// add buffers a row, waking up the flush loop once a batch is pending
+func (s *ClickHouseSink) add(key []string, val float32, labels []metrics.Label, typ string) {
+	row := Row{
+		Timestamp: time.Now().Add(time.Duration(atomic.LoadInt64(&s.offset))),
+		Name:      strings.Join(key, "."),
+		Value:     float64(val),
+		Type:      typ,
+	}
+	if len(labels) > 0 {
+		row.Labels = make(map[string]string, len(labels))
+		for _, label := range labels {
+			row.Labels[label.Name] = label.Value
+		}
+	}
+
+	s.lock.Lock()
+	if len(s.pending) >= s.opts.MaxPending {
+		s.lock.Unlock()
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+	s.pending = append(s.pending, row)
+	full := len(s.pending) >= s.opts.BatchSize
+	s.lock.Unlock()
+
+	if full {
+		select {
+		case s.flushChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Implementation of methods in the MetricSink interface
+
+func (s *ClickHouseSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *ClickHouseSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.add(key, val, labels, TypeGauge)
+}
+
+func (s *ClickHouseSink) EmitKey(key []string, val float32) {
+	s.add(key, val, nil, TypeKey)
+}
+
+func (s *ClickHouseSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *ClickHouseSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.add(key, val, labels, TypeCounter)
+}
+
+func (s *ClickHouseSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *ClickHouseSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.add(key, val, labels, TypeSample)
+}
+
+// HTTPInserter is an Inserter using the HTTP interface of ClickHouse. It
+// inserts each batch with a single INSERT in the JSONEachRow format, into
+// a table with the columns timestamp, name, labels, value and type. Rows
+// with a NaN or infinite value can't be encoded and are skipped.
+type HTTPInserter struct {
+	endpoint string
+	query    string
+	client   *http.Client
+}
+
+// NewHTTPInserter creates an HTTPInserter inserting into table through the
+// HTTP interface at endpoint, e.g. http://localhost:8123/. Credentials and
+// settings can be given as query params of endpoint, such as
+// ?user=metrics&database=monitoring. A nil client uses http.DefaultClient.
+func NewHTTPInserter(endpoint, table string, client *http.Client) (*HTTPInserter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if table == "" {
+		return nil, fmt.Errorf("table is required")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPInserter{
+		endpoint: u.String(),
+		query:    fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", table),
+		client:   client,
+	}, nil
+}
+
+// httpRow is a Row as encoded for JSONEachRow
+type httpRow struct {
+	Timestamp string            `json:"timestamp"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Value     float64           `json:"value"`
+	Type      string            `json:"type"`
+}
+
+// Insert posts rows as a single INSERT
+func (h *HTTPInserter) Insert(ctx context.Context, rows []Row) error {
+	body := &bytes.Buffer{}
+	enc := json.NewEncoder(body)
+	for _, row := range rows {
+		if math.IsNaN(row.Value) || math.IsInf(row.Value, 0) {
+			continue
+		}
+		labels := row.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		err := enc.Encode(httpRow{
+			Timestamp: row.Timestamp.UTC().Format("2006-01-02 15:04:05.000"),
+			Name:      row.Name,
+			Labels:    labels,
+			Value:     row.Value,
+			Type:      row.Type,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if body.Len() == 0 {
+		return nil
+	}
+
+	u, err := url.Parse(h.endpoint)
+	if err != nil {
+		return err
+	}
+	params := u.Query()
+	params.Set("query", h.query)
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,290 @@
+package clickhouse
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// fakeInserter records the batches it is given. The first failures inserts
+// fail.
+type fakeInserter struct {
+	lock     sync.Mutex
+	batches  [][]Row
+	failures int
+	inserted chan struct{}
+}
+
+func newFakeInserter() *fakeInserter {
+	return &fakeInserter{inserted: make(chan struct{}, 100)}
+}
+
+func (f *fakeInserter) Insert(ctx context.Context, rows []Row) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	defer func() { f.inserted <- struct{}{} }()
+
+	if f.failures > 0 {
+		f.failures--
+		return fmt.Errorf("insert failed")
+	}
+	f.batches = append(f.batches, append([]Row(nil), rows...))
+	return nil
+}
+
+func (f *fakeInserter) received() [][]Row {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([][]Row(nil), f.batches...)
+}
+
+func testSink(t *testing.T, opts ClickHouseOpts) *ClickHouseSink {
+	if opts.FlushInterval == 0 {
+		opts.FlushInterval = time.Hour
+	}
+	sink, err := NewClickHouseSink(opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return sink
+}
+
+func TestNewClickHouseSink_Invalid(t *testing.T) {
+	if _, err := NewClickHouseSink(ClickHouseOpts{}); err == nil {
+		t.Fatalf("expected error without inserter")
+	}
+	opts := ClickHouseOpts{Inserter: newFakeInserter(), BatchSize: 10, MaxPending: 5}
+	if _, err := NewClickHouseSink(opts); err == nil {
+		t.Fatalf("expected error for small max pending")
+	}
+}
+
+func TestClickHouseSink_Flush(t *testing.T) {
+	f := newFakeInserter()
+	sink := testSink(t, ClickHouseOpts{Inserter: f})
+	defer sink.Shutdown()
+
+	start := time.Now()
+	labels := []metrics.Label{{Name: "region", Value: "west"}, {Name: "host", Value: "a"}}
+	sink.SetGauge([]string{"a", "gauge"}, 1)
+	sink.IncrCounterWithLabels([]string{"b", "counter"}, 2, labels)
+	sink.IncrCounterWithLabels([]string{"b", "counter"}, 3, labels)
+	sink.AddSample([]string{"c", "sample"}, 4)
+	sink.EmitKey([]string{"d", "kv"}, 5)
+
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	batches := f.received()
+	if len(batches) != 1 {
+		t.Fatalf("bad batches: %v", batches)
+	}
+
+	// Rows are inserted as emitted, without aggregation
+	rows := batches[0]
+	expect := []Row{
+		{Name: "a.gauge", Value: 1, Type: TypeGauge},
+		{Name: "b.counter", Labels: map[string]string{"region": "west", "host": "a"}, Value: 2, Type: TypeCounter},
+		{Name: "b.counter", Labels: map[string]string{"region": "west", "host": "a"}, Value: 3, Type: TypeCounter},
+		{Name: "c.sample", Value: 4, Type: TypeSample},
+		{Name: "d.kv", Value: 5, Type: TypeKey},
+	}
+	for i, row := range rows {
+		if row.Timestamp.Before(start) || row.Timestamp.After(time.Now()) {
+			t.Fatalf("bad timestamp: %v", row.Timestamp)
+		}
+		row.Timestamp = time.Time{}
+		rows[i] = row
+	}
+	if !reflect.DeepEqual(rows, expect) {
+		t.Fatalf("bad rows: %+v", rows)
+	}
+
+	// Nothing is inserted when there is nothing new
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if batches := f.received(); len(batches) != 1 {
+		t.Fatalf("bad batches: %d", len(batches))
+	}
+}
+
+func TestClickHouseSink_TimestampOffset(t *testing.T) {
+	f := newFakeInserter()
+	sink := testSink(t, ClickHouseOpts{Inserter: f})
+	defer sink.Shutdown()
+
+	var _ metrics.TimestampSink = sink
+	sink.SetTimestampOffset(time.Hour)
+	before := time.Now()
+	sink.SetGauge([]string{"a", "gauge"}, 1)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	row := f.received()[0][0]
+	if row.Timestamp.Before(before.Add(time.Hour)) || row.Timestamp.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("bad timestamp: %v", row.Timestamp)
+	}
+}
+
+func TestClickHouseSink_BatchSize(t *testing.T) {
+	f := newFakeInserter()
+	sink := testSink(t, ClickHouseOpts{Inserter: f, BatchSize: 2})
+	defer sink.Shutdown()
+
+	// Reaching the batch size triggers a flush
+	sink.IncrCounter([]string{"a"}, 1)
+	sink.IncrCounter([]string{"b"}, 1)
+	select {
+	case <-f.inserted:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout waiting for insert")
+	}
+	if batches := f.received(); len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("bad batches: %v", batches)
+	}
+
+	// Flushing a backlog inserts batches of at most the batch size
+	sink.lock.Lock()
+	for i := 0; i < 5; i++ {
+		sink.pending = append(sink.pending, Row{Name: "c"})
+	}
+	sink.lock.Unlock()
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var sizes []int
+	for _, batch := range f.received() {
+		sizes = append(sizes, len(batch))
+	}
+	if !reflect.DeepEqual(sizes, []int{2, 2, 2, 1}) {
+		t.Fatalf("bad batch sizes: %v", sizes)
+	}
+}
+
+func TestClickHouseSink_Interval(t *testing.T) {
+	f := newFakeInserter()
+	sink := testSink(t, ClickHouseOpts{Inserter: f, FlushInterval: 10 * time.Millisecond})
+	defer sink.Shutdown()
+
+	sink.IncrCounter([]string{"a"}, 1)
+	select {
+	case <-f.inserted:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout waiting for insert")
+	}
+	if batches := f.received(); len(batches) != 1 {
+		t.Fatalf("bad batches: %v", batches)
+	}
+}
+
+func TestClickHouseSink_Failures(t *testing.T) {
+	f := newFakeInserter()
+	f.failures = 1
+	sink := testSink(t, ClickHouseOpts{Inserter: f, BatchSize: 2, MaxPending: 2})
+	defer sink.Shutdown()
+
+	// Rows beyond the buffer are dropped
+	sink.lock.Lock()
+	sink.pending = append(sink.pending, Row{Name: "a"}, Row{Name: "b"})
+	sink.lock.Unlock()
+	sink.IncrCounter([]string{"c"}, 1)
+	if stats := sink.SinkStats(); stats.Dropped != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+
+	// Rows of a failed insert are dropped
+	if err := sink.Flush(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if stats := sink.SinkStats(); stats.Dropped != 3 || stats.Errors != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+	sink.IncrCounter([]string{"d"}, 1)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if batches := f.received(); len(batches) != 1 || batches[0][0].Name != "d" {
+		t.Fatalf("bad batches: %v", batches)
+	}
+}
+
+func TestClickHouseSink_ShutdownFlushes(t *testing.T) {
+	f := newFakeInserter()
+	sink := testSink(t, ClickHouseOpts{Inserter: f})
+
+	sink.IncrCounter([]string{"a"}, 1)
+	sink.Shutdown()
+	if batches := f.received(); len(batches) != 1 {
+		t.Fatalf("bad batches: %v", batches)
+	}
+
+	// Shutting down again inserts nothing more
+	sink.Shutdown()
+	if batches := f.received(); len(batches) != 1 {
+		t.Fatalf("bad batches: %v", batches)
+	}
+}
+
+func TestHTTPInserter(t *testing.T) {
+	var query, user string
+	var lines []map[string]interface{}
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		user = r.URL.Query().Get("user")
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var line map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Errorf("bad line %q: %v", scanner.Text(), err)
+			}
+			lines = append(lines, line)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	inserter, err := NewHTTPInserter(srv.URL+"/?user=metrics", "monitoring.metrics", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	err = inserter.Insert(context.Background(), []Row{
+		{Timestamp: ts, Name: "a.gauge", Value: 1.5, Type: TypeGauge},
+		{Timestamp: ts, Name: "b", Labels: map[string]string{"k": "v"}, Value: 2, Type: TypeCounter},
+		{Timestamp: ts, Name: "nan", Value: math.NaN(), Type: TypeGauge},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if query != "INSERT INTO monitoring.metrics FORMAT JSONEachRow" || user != "metrics" {
+		t.Fatalf("bad query %q, user %q", query, user)
+	}
+	expect := []map[string]interface{}{
+		{"timestamp": "2020-01-02 03:04:05.006", "name": "a.gauge", "labels": map[string]interface{}{}, "value": 1.5, "type": "gauge"},
+		{"timestamp": "2020-01-02 03:04:05.006", "name": "b", "labels": map[string]interface{}{"k": "v"}, "value": 2.0, "type": "counter"},
+	}
+	if !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("bad lines: %v", lines)
+	}
+
+	status = http.StatusInternalServerError
+	if err := inserter.Insert(context.Background(), []Row{{Name: "a"}}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if _, err := NewHTTPInserter(srv.URL, "", nil); err == nil {
+		t.Fatalf("expected error without table")
+	}
+}
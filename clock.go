@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of the current time for Metrics. Times returned by
+// the default clock carry a monotonic clock reading, so durations measured
+// against them are not affected by wall clock adjustments.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the default Clock, backed by time.Now
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// FakeClock is a Clock which only moves when told to, for testing time
+// dependent behaviour, such as interval rollovers of an InmemSink, without
+// sleeping. It is meant for tests only. A FakeClock is safe for concurrent
+// use.
+type FakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+// NewFakeClock returns a FakeClock set to start
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t, which may be in the past
+func (c *FakeClock) Set(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = t
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSystemClock_Monotonic(t *testing.T) {
+	now := systemClock{}.Now()
+	if !strings.Contains(now.String(), " m=") {
+		t.Fatalf("missing monotonic reading: %s", now)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+	if !c.Now().Equal(start) {
+		t.Fatalf("bad now: %v", c.Now())
+	}
+	c.Advance(time.Minute)
+	if !c.Now().Equal(start.Add(time.Minute)) {
+		t.Fatalf("bad now: %v", c.Now())
+	}
+	c.Set(start.Add(-time.Hour))
+	if !c.Now().Equal(start.Add(-time.Hour)) {
+		t.Fatalf("bad now: %v", c.Now())
+	}
+}
@@ -0,0 +1,665 @@
+// Package cloudmonitoring provides a MetricSink which writes metrics as
+// custom metrics to Google Cloud Monitoring, formerly Stackdriver. Time
+// series are written by a Client, which can wrap the official client
+// library, or be an HTTPClient calling the REST API with an authorized
+// http.Client.
+package cloudmonitoring
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	// DefaultMetricPrefix is prepended to the metric types of all metrics
+	DefaultMetricPrefix = "custom.googleapis.com/"
+
+	// DefaultResourceType is the monitored resource type of all time series
+	DefaultResourceType = "global"
+
+	// DefaultFlushInterval is how often aggregated metrics are written.
+	// Cloud Monitoring accepts at most one point per time series every five
+	// seconds.
+	DefaultFlushInterval = time.Minute
+
+	// DefaultBatchSize is the number of time series written per request,
+	// the maximum the API accepts
+	DefaultBatchSize = 200
+
+	// DefaultRequestTimeout bounds the duration of each request
+	DefaultRequestTimeout = 30 * time.Second
+
+	// DefaultEndpoint is the Cloud Monitoring API endpoint used by
+	// HTTPClient
+	DefaultEndpoint = "https://monitoring.googleapis.com/v3"
+)
+
+// DefaultBuckets are the upper bounds of the distribution buckets of
+// samples, suited to timings in milliseconds
+var DefaultBuckets = []float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// Metric kinds and value types of time series
+const (
+	KindGauge      = "GAUGE"
+	KindCumulative = "CUMULATIVE"
+
+	ValueDouble       = "DOUBLE"
+	ValueDistribution = "DISTRIBUTION"
+)
+
+// TimeSeries is a time series as written by the timeSeries.create method of
+// the Cloud Monitoring API, with a single point
+type TimeSeries struct {
+	Metric     Metric            `json:"metric"`
+	Resource   MonitoredResource `json:"resource"`
+	MetricKind string            `json:"metricKind"`
+	ValueType  string            `json:"valueType"`
+	Points     []Point           `json:"points"`
+}
+
+// Metric identifies the metric of a time series
+type Metric struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// MonitoredResource identifies the resource a time series is about
+type MonitoredResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Point is a value of a time series over an interval. Gauge points have the
+// same start and end time.
+type Point struct {
+	Interval TimeInterval `json:"interval"`
+	Value    TypedValue   `json:"value"`
+}
+
+// TimeInterval is the interval of a point
+type TimeInterval struct {
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+}
+
+// TypedValue holds the value of a point, of which exactly one field is set
+type TypedValue struct {
+	DoubleValue       *float64      `json:"doubleValue,omitempty"`
+	DistributionValue *Distribution `json:"distributionValue,omitempty"`
+}
+
+// Distribution is the value of a sample point
+type Distribution struct {
+	Count                 int64         `json:"count"`
+	Mean                  float64       `json:"mean"`
+	SumOfSquaredDeviation float64       `json:"sumOfSquaredDeviation"`
+	BucketOptions         BucketOptions `json:"bucketOptions"`
+	// BucketCounts holds a count per bucket, starting with the underflow
+	// bucket below the first bound and ending with the overflow bucket
+	BucketCounts []int64 `json:"bucketCounts"`
+}
+
+// BucketOptions describes the buckets of a distribution
+type BucketOptions struct {
+	ExplicitBuckets ExplicitBuckets `json:"explicitBuckets"`
+}
+
+// ExplicitBuckets holds the bounds between the buckets of a distribution
+type ExplicitBuckets struct {
+	Bounds []float64 `json:"bounds"`
+}
+
+// Client writes time series to a project, e.g. with a single
+// timeSeries.create request. It must return once ctx is done.
+type Client interface {
+	CreateTimeSeries(ctx context.Context, projectID string, series []TimeSeries) error
+}
+
+// CloudMonitoringOpts is used to configure the CloudMonitoringSink
+type CloudMonitoringOpts struct {
+	// ProjectID is the ID of the project metrics are written to. Required.
+	ProjectID string
+
+	// Client writes the time series. Required.
+	Client Client
+
+	// MetricPrefix is prepended to the metric types, which are the metric
+	// keys joined by '/'. Defaults to DefaultMetricPrefix.
+	MetricPrefix string
+
+	// ResourceType is the monitored resource type of all time series, e.g.
+	// "gce_instance" or "k8s_container". Defaults to DefaultResourceType.
+	ResourceType string
+
+	// ResourceLabels are the labels of the monitored resource, e.g. the
+	// instance_id and zone of a gce_instance. The project_id label of the
+	// global resource type defaults to ProjectID.
+	ResourceLabels map[string]string
+
+	// ResourceLabelNames lists the metric labels which are sent as
+	// resource labels instead, taking precedence over ResourceLabels, for
+	// resource labels which vary between metrics. Names passed to
+	// SetResourceLabels, such as the ResourceLabels of a metrics.Config,
+	// are added to them.
+	ResourceLabelNames []string
+
+	// FlushInterval is how often aggregated metrics are written. Defaults
+	// to DefaultFlushInterval.
+	FlushInterval time.Duration
+
+	// BatchSize is the number of time series written per request, at most
+	// 200. Defaults to DefaultBatchSize.
+	BatchSize int
+
+	// RequestTimeout bounds each request. Defaults to
+	// DefaultRequestTimeout.
+	RequestTimeout time.Duration
+
+	// Buckets are the upper bounds of the distribution buckets of samples,
+	// in increasing order. Defaults to DefaultBuckets.
+	Buckets []float64
+
+	// Clock is the source of the point times, mostly for testing. Defaults
+	// to the system clock.
+	Clock metrics.Clock
+
+	// ErrorLog is used to log failed flushes. Defaults to a FailureLogger
+	// from metrics.NewFailureLogger.
+	ErrorLog *metrics.FailureLogger
+}
+
+// CloudMonitoringSink provides a MetricSink that aggregates metrics in
+// memory and periodically writes them to Cloud Monitoring as custom metrics.
+//
+// Gauges and keys are written as GAUGE DOUBLE metrics with their last value
+// of the interval. Counters are written as CUMULATIVE DOUBLE metrics with
+// their running total since the series was first incremented or reset, on
+// every flush. Samples are written as GAUGE DISTRIBUTION metrics of the
+// values of the interval. Time series of a failed request are dropped.
+type CloudMonitoringSink struct {
+	// dropped, errors and offset are accessed atomically and kept first to
+	// guarantee 64-bit alignment
+	dropped uint64
+	errors  uint64
+	offset  int64 // time.Duration added to timestamps
+
+	opts CloudMonitoringOpts
+
+	// resourceNames holds the names of the labels sent as resource labels
+	resourceNames map[string]bool
+	resourceLock  sync.RWMutex
+
+	lock     sync.Mutex
+	gauges   map[string]*gauge
+	counters map[string]*counter
+	samples  map[string]*sample
+
+	stopChan chan struct{}
+	doneChan chan struct{}
+	stopOnce sync.Once
+}
+
+// series holds the metric type and labels of a time series
+type series struct {
+	metric   Metric
+	resource MonitoredResource
+}
+
+type gauge struct {
+	series
+	value float64
+}
+
+type counter struct {
+	series
+	start time.Time
+	total float64
+}
+
+type sample struct {
+	series
+	count  int64
+	mean   float64
+	m2     float64
+	counts []int64
+}
+
+// NewCloudMonitoringSink creates a CloudMonitoringSink and starts flushing
+// it every opts.FlushInterval. Call Shutdown to write the remaining metrics
+// and stop.
+func NewCloudMonitoringSink(opts CloudMonitoringOpts) (*CloudMonitoringSink, error) {
+	if opts.ProjectID == "" {
+		return nil, fmt.Errorf("project ID is required")
+	}
+	if opts.Client == nil {
+		return nil, fmt.Errorf("client is required")
+	}
+	if opts.BatchSize > DefaultBatchSize {
+		return nil, fmt.Errorf("batch size %d exceeds the API limit of %d", opts.BatchSize, DefaultBatchSize)
+	}
+	if opts.MetricPrefix == "" {
+		opts.MetricPrefix = DefaultMetricPrefix
+	}
+	if opts.ResourceType == "" {
+		opts.ResourceType = DefaultResourceType
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = DefaultRequestTimeout
+	}
+	if opts.Buckets == nil {
+		opts.Buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(opts.Buckets) {
+		return nil, fmt.Errorf("buckets must be in increasing order")
+	}
+	if opts.ErrorLog == nil {
+		opts.ErrorLog = metrics.NewFailureLogger()
+	}
+
+	resourceLabels := make(map[string]string, len(opts.ResourceLabels)+1)
+	for name, value := range opts.ResourceLabels {
+		resourceLabels[name] = value
+	}
+	if _, ok := resourceLabels["project_id"]; !ok && opts.ResourceType == DefaultResourceType {
+		resourceLabels["project_id"] = opts.ProjectID
+	}
+	opts.ResourceLabels = resourceLabels
+
+	s := &CloudMonitoringSink{
+		opts:          opts,
+		resourceNames: make(map[string]bool, len(opts.ResourceLabelNames)),
+		gauges:        make(map[string]*gauge),
+		counters:      make(map[string]*counter),
+		samples:       make(map[string]*sample),
+		stopChan:      make(chan struct{}),
+		doneChan:      make(chan struct{}),
+	}
+	for _, name := range opts.ResourceLabelNames {
+		s.resourceNames[name] = true
+	}
+	if err := metrics.GoSink(s.flushMetrics); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Shutdown stops the periodic flush and writes the remaining metrics. It is
+// safe to call more than once: later calls do nothing, as another flush would
+// write the cumulative counters again.
+func (s *CloudMonitoringSink) Shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+		<-s.doneChan
+		if err := s.Flush(); err != nil {
+			s.opts.ErrorLog.Printf("[ERR] Error writing to Cloud Monitoring! Err: %s", err)
+		}
+	})
+}
+
+// Flush writes the gauges and samples of the current interval along with
+// the totals of all counters, in batches of at most BatchSize time series.
+func (s *CloudMonitoringSink) Flush() error {
+	now := s.now()
+
+	s.lock.Lock()
+	gauges, samples := s.gauges, s.samples
+	s.gauges = make(map[string]*gauge, len(gauges))
+	s.samples = make(map[string]*sample, len(samples))
+	batch := make([]TimeSeries, 0, len(gauges)+len(s.counters)+len(samples))
+	for _, c := range s.counters {
+		batch = append(batch, c.timeSeries(now))
+	}
+	s.lock.Unlock()
+
+	for _, g := range gauges {
+		batch = append(batch, g.timeSeries(now))
+	}
+	for _, smp := range samples {
+		batch = append(batch, smp.timeSeries(now, s.opts.Buckets))
+	}
+	sort.Slice(batch, func(i, j int) bool {
+		return batch[i].Metric.Type < batch[j].Metric.Type
+	})
+
+	var firstErr error
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > s.opts.BatchSize {
+			n = s.opts.BatchSize
+		}
+		if err := s.write(batch[:n]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		batch = batch[n:]
+	}
+	return firstErr
+}
+
+// SinkStats returns the number of time series dropped because their request
+// failed, and the number of failed requests.
+func (s *CloudMonitoringSink) SinkStats() metrics.SinkStats {
+	return metrics.SinkStats{
+		Dropped: atomic.LoadUint64(&s.dropped),
+		Errors:  atomic.LoadUint64(&s.errors),
+	}
+}
+
+func (s *CloudMonitoringSink) flushMetrics() {
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+	defer close(s.doneChan)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				s.opts.ErrorLog.Printf("[ERR] Error writing to Cloud Monitoring! Err: %s", err)
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// write writes a single batch
+func (s *CloudMonitoringSink) write(batch []TimeSeries) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.RequestTimeout)
+	defer cancel()
+
+	if err := s.opts.Client.CreateTimeSeries(ctx, s.opts.ProjectID, batch); err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		atomic.AddUint64(&s.dropped, uint64(len(batch)))
+		return err
+	}
+	return nil
+}
+
+// now returns the current time from the configured clock, corrected by the
+// timestamp offset
+func (s *CloudMonitoringSink) now() time.Time {
+	offset := time.Duration(atomic.LoadInt64(&s.offset))
+	if s.opts.Clock == nil {
+		return time.Now().Add(offset)
+	}
+	return s.opts.Clock.Now().Add(offset)
+}
+
+// SetTimestampOffset adds offset to the times of later points, as described
+// by metrics.TimestampSink
+func (s *CloudMonitoringSink) SetTimestampOffset(offset time.Duration) {
+	atomic.StoreInt64(&s.offset, int64(offset))
+}
+
+// series returns the hash and series of a metric
+func (s *CloudMonitoringSink) series(key []string, labels []metrics.Label) (string, series) {
+	ser := series{
+		metric:   Metric{Type: s.opts.MetricPrefix + sanitize(strings.Join(key, "/"), true)},
+		resource: MonitoredResource{Type: s.opts.ResourceType, Labels: s.opts.ResourceLabels},
+	}
+
+	sorted := make([]metrics.Label, len(labels))
+	copy(sorted, labels)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	s.resourceLock.RLock()
+	defer s.resourceLock.RUnlock()
+
+	hash := ser.metric.Type
+	resourceCopied := false
+	for _, label := range sorted {
+		name := sanitize(label.Name, false)
+		hash += fmt.Sprintf(";%q=%q", name, label.Value)
+		if s.resourceNames[label.Name] {
+			if !resourceCopied {
+				ser.resource.Labels = copyLabels(s.opts.ResourceLabels)
+				resourceCopied = true
+			}
+			ser.resource.Labels[name] = label.Value
+			continue
+		}
+		if ser.metric.Labels == nil {
+			ser.metric.Labels = make(map[string]string, len(labels))
+		}
+		ser.metric.Labels[name] = label.Value
+	}
+	return hash, ser
+}
+
+func (g *gauge) timeSeries(now time.Time) TimeSeries {
+	value := g.value
+	return TimeSeries{
+		Metric:     g.metric,
+		Resource:   g.resource,
+		MetricKind: KindGauge,
+		ValueType:  ValueDouble,
+		Points: []Point{{
+			Interval: TimeInterval{StartTime: now, EndTime: now},
+			Value:    TypedValue{DoubleValue: &value},
+		}},
+	}
+}
+
+func (c *counter) timeSeries(now time.Time) TimeSeries {
+	total := c.total
+	start := c.start
+	if !start.Before(now) {
+		// The end of a cumulative interval must be after its start
+		start = now.Add(-time.Millisecond)
+	}
+	return TimeSeries{
+		Metric:     c.metric,
+		Resource:   c.resource,
+		MetricKind: KindCumulative,
+		ValueType:  ValueDouble,
+		Points: []Point{{
+			Interval: TimeInterval{StartTime: start, EndTime: now},
+			Value:    TypedValue{DoubleValue: &total},
+		}},
+	}
+}
+
+func (smp *sample) timeSeries(now time.Time, bounds []float64) TimeSeries {
+	return TimeSeries{
+		Metric:     smp.metric,
+		Resource:   smp.resource,
+		MetricKind: KindGauge,
+		ValueType:  ValueDistribution,
+		Points: []Point{{
+			Interval: TimeInterval{StartTime: now, EndTime: now},
+			Value: TypedValue{DistributionValue: &Distribution{
+				Count:                 smp.count,
+				Mean:                  smp.mean,
+				SumOfSquaredDeviation: smp.m2,
+				BucketOptions:         BucketOptions{ExplicitBuckets: ExplicitBuckets{Bounds: bounds}},
+				BucketCounts:          smp.counts,
+			}},
+		}},
+	}
+}
+
+// add adds v to the sample, updating its mean and squared deviation with
+// Welford's algorithm
+func (smp *sample) add(v float64, bounds []float64) {
+	smp.count++
+	delta := v - smp.mean
+	smp.mean += delta / float64(smp.count)
+	smp.m2 += delta * (v - smp.mean)
+
+	// Bucket i holds the values from bound i-1, inclusive, up to bound i
+	idx := sort.Search(len(bounds), func(i int) bool { return bounds[i] > v })
+	smp.counts[idx]++
+}
+
+// SetResourceLabels adds names to the labels sent as resource labels, as
+// described by metrics.ResourceLabelSink
+func (s *CloudMonitoringSink) SetResourceLabels(names []string) {
+	s.resourceLock.Lock()
+	defer s.resourceLock.Unlock()
+	for _, name := range names {
+		s.resourceNames[name] = true
+	}
+}
+
+// Implementation of methods in the MetricSink interface
+
+func (s *CloudMonitoringSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *CloudMonitoringSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	hash, ser := s.series(key, labels)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	g, ok := s.gauges[hash]
+	if !ok {
+		g = &gauge{series: ser}
+		s.gauges[hash] = g
+	}
+	g.value = float64(val)
+}
+
+func (s *CloudMonitoringSink) EmitKey(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *CloudMonitoringSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *CloudMonitoringSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	hash, ser := s.series(key, labels)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, ok := s.counters[hash]
+	if !ok {
+		c = &counter{series: ser, start: s.now()}
+		s.counters[hash] = c
+	}
+	c.total += float64(val)
+}
+
+// ResetCounter restarts the cumulative total of a counter from zero, with a
+// new start time, as described by metrics.CounterResetSink
+func (s *CloudMonitoringSink) ResetCounter(key []string, labels []metrics.Label) {
+	hash, _ := s.series(key, labels)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if c, ok := s.counters[hash]; ok {
+		c.total = 0
+		c.start = s.now()
+	}
+}
+
+func (s *CloudMonitoringSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *CloudMonitoringSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	hash, ser := s.series(key, labels)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	smp, ok := s.samples[hash]
+	if !ok {
+		smp = &sample{series: ser, counts: make([]int64, len(s.opts.Buckets)+1)}
+		s.samples[hash] = smp
+	}
+	smp.add(float64(val), s.opts.Buckets)
+}
+
+// sanitize replaces the characters not allowed in metric types, or in label
+// names unless path is set, with '_'
+func sanitize(name string, path bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case path && r == '/':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels))
+	for name, value := range labels {
+		c[name] = value
+	}
+	return c
+}
+
+// HTTPClient is a Client calling the timeSeries.create method of the Cloud
+// Monitoring REST API
+type HTTPClient struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewHTTPClient creates an HTTPClient sending requests with client, which
+// must authorize them, e.g. a client from google.DefaultClient of
+// golang.org/x/oauth2/google with the monitoring.write scope. An empty
+// endpoint uses DefaultEndpoint.
+func NewHTTPClient(endpoint string, client *http.Client) (*HTTPClient, error) {
+	if client == nil {
+		return nil, fmt.Errorf("an authorized HTTP client is required")
+	}
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	return &HTTPClient{endpoint: strings.TrimSuffix(endpoint, "/"), client: client}, nil
+}
+
+// createRequest is the body of a timeSeries.create request
+type createRequest struct {
+	TimeSeries []TimeSeries `json:"timeSeries"`
+}
+
+// CreateTimeSeries writes series with a single request
+func (h *HTTPClient) CreateTimeSeries(ctx context.Context, projectID string, series []TimeSeries) error {
+	body, err := json.Marshal(createRequest{TimeSeries: series})
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/projects/%s/timeSeries", h.endpoint, projectID)
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,392 @@
+package cloudmonitoring
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// fakeClient is a Client recording the time series it receives. The first
+// failures requests fail.
+type fakeClient struct {
+	lock     sync.Mutex
+	requests int
+	failures int
+	projects []string
+	series   []TimeSeries
+}
+
+func (f *fakeClient) CreateTimeSeries(ctx context.Context, projectID string, series []TimeSeries) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.requests++
+	f.projects = append(f.projects, projectID)
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("unavailable")
+	}
+	f.series = append(f.series, series...)
+	return nil
+}
+
+// take returns and forgets the time series received
+func (f *fakeClient) take() []TimeSeries {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	series := f.series
+	f.series = nil
+	return series
+}
+
+func newTestSink(t *testing.T, opts CloudMonitoringOpts) (*CloudMonitoringSink, *fakeClient, *metrics.FakeClock) {
+	client := &fakeClient{}
+	clock := metrics.NewFakeClock(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	if opts.ProjectID == "" {
+		opts.ProjectID = "my-project"
+	}
+	opts.Client = client
+	opts.Clock = clock
+	opts.FlushInterval = time.Hour
+	s, err := NewCloudMonitoringSink(opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return s, client, clock
+}
+
+func TestNewCloudMonitoringSink_Validation(t *testing.T) {
+	client := &fakeClient{}
+	for _, opts := range []CloudMonitoringOpts{
+		{Client: client},
+		{ProjectID: "p"},
+		{ProjectID: "p", Client: client, BatchSize: 201},
+		{ProjectID: "p", Client: client, Buckets: []float64{10, 1}},
+	} {
+		if _, err := NewCloudMonitoringSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
+
+func TestCloudMonitoringSink_Gauges(t *testing.T) {
+	s, client, clock := newTestSink(t, CloudMonitoringOpts{})
+	defer s.Shutdown()
+
+	s.SetGauge([]string{"memory", "heap"}, 1)
+	s.SetGauge([]string{"memory", "heap"}, 2)
+	s.SetGaugeWithLabels([]string{"queue-depth"}, 5, []metrics.Label{{Name: "queue.name", Value: "jobs"}})
+	s.EmitKey([]string{"key"}, 3)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	now := clock.Now()
+	series := client.take()
+	if len(series) != 3 {
+		t.Fatalf("bad series: %+v", series)
+	}
+	heap := series[1]
+	global := MonitoredResource{Type: "global", Labels: map[string]string{"project_id": "my-project"}}
+	if heap.Metric.Type != "custom.googleapis.com/memory/heap" || heap.MetricKind != KindGauge ||
+		heap.ValueType != ValueDouble || !reflect.DeepEqual(heap.Resource, global) {
+		t.Fatalf("bad series: %+v", heap)
+	}
+	point := heap.Points[0]
+	if *point.Value.DoubleValue != 2 || !point.Interval.StartTime.Equal(now) || !point.Interval.EndTime.Equal(now) {
+		t.Fatalf("bad point: %+v", point)
+	}
+
+	queue := series[2]
+	if queue.Metric.Type != "custom.googleapis.com/queue_depth" ||
+		!reflect.DeepEqual(queue.Metric.Labels, map[string]string{"queue_name": "jobs"}) {
+		t.Fatalf("bad series: %+v", queue)
+	}
+	if series[0].Metric.Type != "custom.googleapis.com/key" || *series[0].Points[0].Value.DoubleValue != 3 {
+		t.Fatalf("bad series: %+v", series[0])
+	}
+
+	// Gauges are only written for the interval they're set in
+	if err := s.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if series := client.take(); len(series) != 0 {
+		t.Fatalf("unexpected series: %+v", series)
+	}
+}
+
+func TestCloudMonitoringSink_TimestampOffset(t *testing.T) {
+	s, client, clock := newTestSink(t, CloudMonitoringOpts{})
+	defer s.Shutdown()
+
+	var _ metrics.TimestampSink = s
+	s.SetTimestampOffset(-time.Minute)
+	s.SetGauge([]string{"memory", "heap"}, 1)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	series := client.take()
+	if len(series) != 1 {
+		t.Fatalf("bad series: %+v", series)
+	}
+	expect := clock.Now().Add(-time.Minute)
+	if point := series[0].Points[0]; !point.Interval.EndTime.Equal(expect) {
+		t.Fatalf("bad point: %+v", point)
+	}
+}
+
+func TestCloudMonitoringSink_Counters(t *testing.T) {
+	s, client, clock := newTestSink(t, CloudMonitoringOpts{})
+	defer s.Shutdown()
+
+	start := clock.Now()
+	labels := []metrics.Label{{Name: "code", Value: "200"}, {Name: "method", Value: "GET"}}
+	reversed := []metrics.Label{labels[1], labels[0]}
+	s.IncrCounterWithLabels([]string{"requests"}, 1, labels)
+	s.IncrCounterWithLabels([]string{"requests"}, 2, reversed)
+	clock.Advance(time.Minute)
+	s.Flush()
+
+	series := client.take()
+	if len(series) != 1 {
+		t.Fatalf("bad series: %+v", series)
+	}
+	if series[0].MetricKind != KindCumulative || series[0].ValueType != ValueDouble {
+		t.Fatalf("bad series: %+v", series[0])
+	}
+	point := series[0].Points[0]
+	if *point.Value.DoubleValue != 3 || !point.Interval.StartTime.Equal(start) || !point.Interval.EndTime.Equal(clock.Now()) {
+		t.Fatalf("bad point: %+v", point)
+	}
+
+	// Totals are cumulative across flushes
+	s.IncrCounterWithLabels([]string{"requests"}, 4, labels)
+	clock.Advance(time.Minute)
+	s.Flush()
+	point = client.take()[0].Points[0]
+	if *point.Value.DoubleValue != 7 || !point.Interval.StartTime.Equal(start) {
+		t.Fatalf("bad point: %+v", point)
+	}
+
+	// A reset restarts the total with a new start time
+	s.ResetCounter([]string{"requests"}, reversed)
+	reset := clock.Now()
+	s.Flush()
+	point = client.take()[0].Points[0]
+	if *point.Value.DoubleValue != 0 || !point.Interval.StartTime.Before(point.Interval.EndTime) ||
+		point.Interval.StartTime.Before(reset.Add(-time.Second)) {
+		t.Fatalf("bad point: %+v", point)
+	}
+}
+
+func TestCloudMonitoringSink_Samples(t *testing.T) {
+	s, client, _ := newTestSink(t, CloudMonitoringOpts{Buckets: []float64{10, 100}})
+	defer s.Shutdown()
+
+	for _, v := range []float32{1, 2, 10, 50, 500, 1000} {
+		s.AddSample([]string{"latency"}, v)
+	}
+	s.Flush()
+
+	series := client.take()
+	if len(series) != 1 || series[0].MetricKind != KindGauge || series[0].ValueType != ValueDistribution {
+		t.Fatalf("bad series: %+v", series)
+	}
+	dist := series[0].Points[0].Value.DistributionValue
+	if dist.Count != 6 || dist.Mean != 260.5 {
+		t.Fatalf("bad distribution: %+v", dist)
+	}
+
+	// The squared deviations from the mean of 260.5
+	var expect float64
+	for _, v := range []float64{1, 2, 10, 50, 500, 1000} {
+		expect += (v - 260.5) * (v - 260.5)
+	}
+	if diff := dist.SumOfSquaredDeviation - expect; diff > 1e-6 || diff < -1e-6 {
+		t.Fatalf("bad squared deviation: %v", dist.SumOfSquaredDeviation)
+	}
+	if !reflect.DeepEqual(dist.BucketOptions.ExplicitBuckets.Bounds, []float64{10, 100}) ||
+		!reflect.DeepEqual(dist.BucketCounts, []int64{2, 2, 2}) {
+		t.Fatalf("bad buckets: %+v", dist)
+	}
+}
+
+func TestCloudMonitoringSink_ResourceLabels(t *testing.T) {
+	s, client, _ := newTestSink(t, CloudMonitoringOpts{
+		MetricPrefix:       "custom.googleapis.com/myapp/",
+		ResourceType:       "gce_instance",
+		ResourceLabels:     map[string]string{"instance_id": "1234", "zone": "us-east1-b"},
+		ResourceLabelNames: []string{"zone"},
+	})
+	defer s.Shutdown()
+
+	s.SetGaugeWithLabels([]string{"a"}, 1, []metrics.Label{{Name: "zone", Value: "us-west1-a"}, {Name: "tier", Value: "web"}})
+	s.SetGauge([]string{"b"}, 1)
+	s.Flush()
+
+	series := client.take()
+	a, b := series[0], series[1]
+	if a.Metric.Type != "custom.googleapis.com/myapp/a" ||
+		!reflect.DeepEqual(a.Metric.Labels, map[string]string{"tier": "web"}) {
+		t.Fatalf("bad series: %+v", a)
+	}
+	expect := MonitoredResource{Type: "gce_instance", Labels: map[string]string{"instance_id": "1234", "zone": "us-west1-a"}}
+	if !reflect.DeepEqual(a.Resource, expect) {
+		t.Fatalf("bad resource: %+v", a.Resource)
+	}
+
+	// The static resource labels are left untouched
+	expect.Labels["zone"] = "us-east1-b"
+	if !reflect.DeepEqual(b.Resource, expect) || b.Metric.Labels != nil {
+		t.Fatalf("bad series: %+v", b)
+	}
+
+	// Names set through metrics.Config are added
+	var _ metrics.ResourceLabelSink = s
+	s.SetResourceLabels([]string{"tier"})
+	s.SetGaugeWithLabels([]string{"a"}, 1, []metrics.Label{{Name: "tier", Value: "web"}, {Name: "path", Value: "/"}})
+	s.Flush()
+	a = client.take()[0]
+	if a.Resource.Labels["tier"] != "web" || !reflect.DeepEqual(a.Metric.Labels, map[string]string{"path": "/"}) {
+		t.Fatalf("bad series: %+v", a)
+	}
+}
+
+func TestCloudMonitoringSink_Batches(t *testing.T) {
+	s, client, _ := newTestSink(t, CloudMonitoringOpts{BatchSize: 2})
+	defer s.Shutdown()
+
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		s.SetGauge([]string{name}, 1)
+	}
+	client.failures = 1
+	if err := s.Flush(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if client.requests != 3 || !reflect.DeepEqual(client.projects, []string{"my-project", "my-project", "my-project"}) {
+		t.Fatalf("bad requests: %d %v", client.requests, client.projects)
+	}
+
+	// The failed batch is dropped
+	if series := client.take(); len(series) != 3 || series[0].Metric.Type != "custom.googleapis.com/c" {
+		t.Fatalf("bad series: %+v", series)
+	}
+	if stats := s.SinkStats(); stats.Dropped != 2 || stats.Errors != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+}
+
+func TestCloudMonitoringSink_Shutdown(t *testing.T) {
+	s, client, _ := newTestSink(t, CloudMonitoringOpts{})
+	s.IncrCounter([]string{"shutdown"}, 1)
+	s.Shutdown()
+	if series := client.take(); len(series) != 1 {
+		t.Fatalf("bad series: %+v", series)
+	}
+
+	// Shutting down again writes nothing more
+	s.Shutdown()
+	if series := client.take(); len(series) != 0 {
+		t.Fatalf("bad series: %+v", series)
+	}
+}
+
+func TestCloudMonitoringSink_PeriodicFlush(t *testing.T) {
+	client := &fakeClient{}
+	s, err := NewCloudMonitoringSink(CloudMonitoringOpts{
+		ProjectID:     "p",
+		Client:        client,
+		FlushInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s.Shutdown()
+
+	s.SetGauge([]string{"periodic"}, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		client.lock.Lock()
+		n := len(client.series)
+		client.lock.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics were not flushed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	if got := sanitize("a.b-c/d", true); got != "a_b_c/d" {
+		t.Fatalf("bad metric type: %q", got)
+	}
+	if got := sanitize("a.b-c/d", false); got != "a_b_c_d" {
+		t.Fatalf("bad label name: %q", got)
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	var (
+		path   string
+		status = http.StatusOK
+		body   map[string][]map[string]interface{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		data, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("bad body %q: %v", data, err)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error": {"message": "bad point"}}`))
+	}))
+	defer server.Close()
+
+	if _, err := NewHTTPClient("", nil); err == nil {
+		t.Fatalf("expected error")
+	}
+	client, err := NewHTTPClient(server.URL+"/v3/", server.Client())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	value := 1.5
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	series := []TimeSeries{{
+		Metric:     Metric{Type: "custom.googleapis.com/gauge"},
+		Resource:   MonitoredResource{Type: "global"},
+		MetricKind: KindGauge,
+		ValueType:  ValueDouble,
+		Points:     []Point{{Interval: TimeInterval{StartTime: now, EndTime: now}, Value: TypedValue{DoubleValue: &value}}},
+	}}
+	if err := client.CreateTimeSeries(context.Background(), "my-project", series); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if path != "/v3/projects/my-project/timeSeries" {
+		t.Fatalf("bad path: %q", path)
+	}
+	ts := body["timeSeries"][0]
+	point := ts["points"].([]interface{})[0].(map[string]interface{})
+	if ts["metricKind"] != "GAUGE" || ts["valueType"] != "DOUBLE" ||
+		point["value"].(map[string]interface{})["doubleValue"] != 1.5 ||
+		point["interval"].(map[string]interface{})["endTime"] != "2026-01-02T03:04:05Z" {
+		t.Fatalf("bad body: %v", body)
+	}
+
+	status = http.StatusBadRequest
+	if err := client.CreateTimeSeries(context.Background(), "my-project", series); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,246 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SampleCoalescingOpts is used to configure a SampleCoalescingSink
+type SampleCoalescingOpts struct {
+	// Window is the longest a run of identical samples is held before it
+	// is passed on. Required.
+	Window time.Duration
+
+	// Clock is the source of the current time, mostly for testing. Defaults
+	// to the system clock.
+	Clock Clock
+}
+
+// SampleCoalescingSink wraps a MetricSink and coalesces runs of identical
+// consecutive samples of the same key and labels into a single weighted
+// sample, e.g. for sensors reporting a slow-changing measurement many times
+// a second. A run ends when a sample of a different value arrives, or once
+// it is Window old, and is then passed on as one bucketed observation of its
+// value with the run length as the count, as described by BucketSink. Runs
+// of a single sample are passed on as a plain sample. Sinks which do not
+// implement BucketSink receive the run as that many samples again, so the
+// wrapped sink should implement it for the volume to go down.
+//
+// Samples are held until their run ends, which delays them by up to twice
+// Window. Other emissions are passed on right away. Call Shutdown to pass on
+// the held runs and stop the background flush.
+type SampleCoalescingSink struct {
+	sink   MetricSink
+	window time.Duration
+	clock  Clock
+
+	lock sync.Mutex
+	runs map[string]*sampleRun
+
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// sampleRun is a run of identical samples held by a SampleCoalescingSink
+type sampleRun struct {
+	key    []string
+	labels []Label
+	val    float32
+	count  uint64
+	start  time.Time
+}
+
+// NewSampleCoalescingSink creates a SampleCoalescingSink passing emissions
+// to sink, and starts passing on the runs older than the window in the
+// background
+func NewSampleCoalescingSink(sink MetricSink, opts SampleCoalescingOpts) (*SampleCoalescingSink, error) {
+	if opts.Window <= 0 {
+		return nil, fmt.Errorf("invalid window %v", opts.Window)
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	c := &SampleCoalescingSink{
+		sink:   sink,
+		window: opts.Window,
+		clock:  opts.Clock,
+		runs:   make(map[string]*sampleRun),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	if err := GoSink(c.flushLoop); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Shutdown stops the background flush and passes on the held runs. It is
+// safe to call more than once.
+func (c *SampleCoalescingSink) Shutdown() {
+	c.stopOnce.Do(func() { close(c.stopCh) })
+	<-c.doneCh
+	c.Flush()
+}
+
+// Flush passes on every held run, regardless of its age
+func (c *SampleCoalescingSink) Flush() {
+	c.flushRuns(func(*sampleRun) bool { return true })
+}
+
+// flushExpired passes on the runs which are at least a window old at now
+func (c *SampleCoalescingSink) flushExpired(now time.Time) {
+	c.flushRuns(func(run *sampleRun) bool { return now.Sub(run.start) >= c.window })
+}
+
+// flushRuns passes on and forgets the held runs matching expired
+func (c *SampleCoalescingSink) flushRuns(expired func(*sampleRun) bool) {
+	var runs []*sampleRun
+	c.lock.Lock()
+	for k, run := range c.runs {
+		if expired(run) {
+			runs = append(runs, run)
+			delete(c.runs, k)
+		}
+	}
+	c.lock.Unlock()
+
+	for _, run := range runs {
+		c.emitRun(run)
+	}
+}
+
+func (c *SampleCoalescingSink) flushLoop() {
+	ticker := time.NewTicker(c.window)
+	defer ticker.Stop()
+	defer close(c.doneCh)
+
+	for {
+		select {
+		case <-ticker.C:
+			c.flushExpired(c.clock.Now())
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+// emitRun passes a run on as a weighted sample
+func (c *SampleCoalescingSink) emitRun(run *sampleRun) {
+	if run.count == 1 {
+		c.sink.AddSampleWithLabels(run.key, run.val, run.labels)
+		return
+	}
+	observeBuckets(c.sink, run.key, map[float64]uint64{float64(run.val): run.count}, run.labels)
+}
+
+// runKey returns the string identifying the run of a key and labels
+func runKey(key []string, labels []Label) string {
+	var b strings.Builder
+	for _, part := range key {
+		b.WriteString(part)
+		b.WriteByte(0)
+	}
+	for _, label := range labels {
+		b.WriteByte(1)
+		b.WriteString(label.Name)
+		b.WriteByte(0)
+		b.WriteString(label.Value)
+	}
+	return b.String()
+}
+
+func (c *SampleCoalescingSink) SetGauge(key []string, val float32) {
+	c.sink.SetGauge(key, val)
+}
+
+func (c *SampleCoalescingSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	c.sink.SetGaugeWithLabels(key, val, labels)
+}
+
+func (c *SampleCoalescingSink) EmitKey(key []string, val float32) {
+	c.sink.EmitKey(key, val)
+}
+
+func (c *SampleCoalescingSink) IncrCounter(key []string, val float32) {
+	c.sink.IncrCounter(key, val)
+}
+
+func (c *SampleCoalescingSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	c.sink.IncrCounterWithLabels(key, val, labels)
+}
+
+func (c *SampleCoalescingSink) AddSample(key []string, val float32) {
+	c.AddSampleWithLabels(key, val, nil)
+}
+
+// AddSampleWithLabels adds the sample to the run of its key and labels, or
+// passes the run on and starts a new one if the value differs or the run is
+// a window old. NaN values are never identical, so they are passed on right
+// away.
+func (c *SampleCoalescingSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	if math.IsNaN(float64(val)) {
+		c.sink.AddSampleWithLabels(key, val, labels)
+		return
+	}
+	k := runKey(key, labels)
+	now := c.clock.Now()
+
+	c.lock.Lock()
+	run, ok := c.runs[k]
+	if ok && run.val == val && now.Sub(run.start) < c.window {
+		run.count++
+		c.lock.Unlock()
+		return
+	}
+	// Copy as the caller may reuse its slices while the run is held
+	c.runs[k] = &sampleRun{
+		key:    append([]string(nil), key...),
+		labels: append([]Label(nil), labels...),
+		val:    val,
+		count:  1,
+		start:  now,
+	}
+	c.lock.Unlock()
+
+	if ok {
+		c.emitRun(run)
+	}
+}
+
+// AddTimingSample passes timings on without coalescing them, so sinks
+// implementing TimingSink keep them apart from other samples
+func (c *SampleCoalescingSink) AddTimingSample(key []string, val float32, unit time.Duration, labels []Label) {
+	addTiming(c.sink, key, val, unit, labels)
+}
+
+func (c *SampleCoalescingSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	observeBuckets(c.sink, key, counts, labels)
+}
+
+func (c *SampleCoalescingSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	setGaugeInt(c.sink, key, val, labels)
+}
+
+func (c *SampleCoalescingSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	incrCounterInt(c.sink, key, val, labels)
+}
+
+func (c *SampleCoalescingSink) ResetCounter(key []string, labels []Label) {
+	resetCounter(c.sink, key, labels)
+}
+
+func (c *SampleCoalescingSink) SetCounterTemporality(key []string, temporality Temporality) {
+	setCounterTemporality(c.sink, key, temporality)
+}
+
+func (c *SampleCoalescingSink) SetResourceLabels(names []string) {
+	setResourceLabels(c.sink, names)
+}
+
+func (c *SampleCoalescingSink) SetTimestampOffset(offset time.Duration) {
+	setTimestampOffset(c.sink, offset)
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testCoalescingSink(t *testing.T, sink MetricSink, clock Clock) *SampleCoalescingSink {
+	c, err := NewSampleCoalescingSink(sink, SampleCoalescingOpts{Window: time.Hour, Clock: clock})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return c
+}
+
+func TestSampleCoalescingSink_Weights(t *testing.T) {
+	if _, err := NewSampleCoalescingSink(&MockSink{}, SampleCoalescingOpts{}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	clock := NewFakeClock(time.Unix(1000, 0))
+	inm := NewInmemSinkWithClock(10*time.Hour, 10*time.Hour, clock)
+	c := testCoalescingSink(t, inm, clock)
+	defer c.Shutdown()
+	labels := []Label{{"sensor", "a"}}
+
+	// Identical samples are held as a run
+	for i := 0; i < 5; i++ {
+		c.AddSampleWithLabels([]string{"temp"}, 21.5, labels)
+	}
+	c.AddSampleWithLabels([]string{"temp"}, 21.5, []Label{{"sensor", "b"}})
+	if len(inm.Data()[0].Samples) != 0 {
+		t.Fatalf("unexpected samples: %v", inm.Data()[0].Samples)
+	}
+
+	// A different value passes the run on as one weighted sample
+	c.AddSampleWithLabels([]string{"temp"}, 22, labels)
+	sample := inm.Data()[0].Samples["temp;sensor=a"]
+	if sample.AggregateSample == nil || !reflect.DeepEqual(sample.Buckets, map[float64]uint64{21.5: 5}) {
+		t.Fatalf("bad sample: %+v", sample)
+	}
+
+	// Flushing passes on the rest, a run of a single sample as a plain one
+	c.Flush()
+	sample = inm.Data()[0].Samples["temp;sensor=a"]
+	if sample.Count != 1 || sample.Sum != 22 || len(sample.Buckets) != 1 {
+		t.Fatalf("bad sample: %+v", sample)
+	}
+	if other := inm.Data()[0].Samples["temp;sensor=b"]; other.AggregateSample == nil || other.Count != 1 {
+		t.Fatalf("bad sample: %+v", other)
+	}
+}
+
+func TestSampleCoalescingSink_Window(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	m := &MockSink{}
+	c := testCoalescingSink(t, m, clock)
+	defer c.Shutdown()
+
+	c.AddSample([]string{"temp"}, 3)
+	c.AddSample([]string{"temp"}, 3)
+	c.flushExpired(clock.Now().Add(time.Minute))
+	if len(m.keys) != 0 {
+		t.Fatalf("unexpected samples: %v", m.vals)
+	}
+
+	// A run a window old ends, and the next sample starts a new one
+	clock.Advance(time.Hour)
+	c.AddSample([]string{"temp"}, 3)
+	if !reflect.DeepEqual(m.vals, []float32{3, 3}) {
+		t.Fatalf("bad samples: %v", m.vals)
+	}
+	clock.Advance(time.Hour)
+	c.flushExpired(clock.Now())
+	if !reflect.DeepEqual(m.vals, []float32{3, 3, 3}) {
+		t.Fatalf("bad samples: %v", m.vals)
+	}
+
+	// Other emissions are passed on right away
+	c.IncrCounter([]string{"counter"}, 1)
+	if len(m.keys) != 4 {
+		t.Fatalf("bad emissions: %v", m.keys)
+	}
+}
+
+func TestSampleCoalescingSink_Shutdown(t *testing.T) {
+	m := &MockSink{}
+	c := testCoalescingSink(t, m, NewFakeClock(time.Unix(1000, 0)))
+	c.AddSample([]string{"temp"}, 3)
+	c.AddSample([]string{"temp"}, 3)
+
+	// Shutdown passes on the held runs, and shutting down again does nothing
+	c.Shutdown()
+	c.Shutdown()
+	if !reflect.DeepEqual(m.vals, []float32{3, 3}) {
+		t.Fatalf("bad samples: %v", m.vals)
+	}
+}
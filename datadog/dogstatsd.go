@@ -14,11 +14,24 @@ type DogStatsdSink struct {
 	client            *statsd.Client
 	hostName          string
 	propagateHostname bool
+	errLog            *metrics.FailureLogger
+	sanitizer         *metrics.LabelSanitizer
 }
 
 // NewDogStatsdSink is used to create a new DogStatsdSink with sane defaults
 func NewDogStatsdSink(addr string, hostName string) (*DogStatsdSink, error) {
-	client, err := statsd.New(addr)
+	return NewDogStatsdSinkWithRetry(addr, hostName, metrics.ConnectRetry{})
+}
+
+// NewDogStatsdSinkWithRetry creates a DogStatsdSink like NewDogStatsdSink,
+// retrying the creation of the client within the retry budget, e.g. while
+// the address of the agent can't be resolved yet.
+func NewDogStatsdSinkWithRetry(addr string, hostName string, retry metrics.ConnectRetry) (*DogStatsdSink, error) {
+	var client *statsd.Client
+	err := retry.Do(func() (err error) {
+		client, err = statsd.New(addr)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -26,10 +39,26 @@ func NewDogStatsdSink(addr string, hostName string) (*DogStatsdSink, error) {
 		client:            client,
 		hostName:          hostName,
 		propagateHostname: false,
+		errLog:            metrics.NewFailureLogger(),
 	}
 	return sink, nil
 }
 
+// SetErrorLogger sets the logger used to report errors from the Dogstatsd
+// client. By default errors are logged at most once per
+// metrics.DefaultFailureLogInterval.
+func (s *DogStatsdSink) SetErrorLogger(l *metrics.FailureLogger) {
+	s.errLog = l
+}
+
+// SetLabelSanitizer sets a sanitizer applied to tag values in place of the
+// default sanitization, detecting distinct values sanitized to the same tag.
+// Its mapping should replace at least ':' and ' ', as metrics.StatsdSanitize
+// does. It must be set before the sink is used.
+func (s *DogStatsdSink) SetLabelSanitizer(sanitizer *metrics.LabelSanitizer) {
+	s.sanitizer = sanitizer
+}
+
 // SetTags sets common tags on the Dogstatsd Client that will be sent
 // along with all dogstatsd packets.
 // Ref: http://docs.datadoghq.com/guides/dogstatsd/#tags
@@ -105,19 +134,26 @@ func (s *DogStatsdSink) AddSample(key []string, val float32) {
 func (s *DogStatsdSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
 	flatKey, tags := s.getFlatkeyAndCombinedLabels(key, labels)
 	rate := 1.0
-	s.client.Gauge(flatKey, float64(val), tags, rate)
+	s.logError(s.client.Gauge(flatKey, float64(val), tags, rate))
 }
 
 func (s *DogStatsdSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
 	flatKey, tags := s.getFlatkeyAndCombinedLabels(key, labels)
 	rate := 1.0
-	s.client.Count(flatKey, int64(val), tags, rate)
+	s.logError(s.client.Count(flatKey, int64(val), tags, rate))
 }
 
 func (s *DogStatsdSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
 	flatKey, tags := s.getFlatkeyAndCombinedLabels(key, labels)
 	rate := 1.0
-	s.client.TimeInMilliseconds(flatKey, float64(val), tags, rate)
+	s.logError(s.client.TimeInMilliseconds(flatKey, float64(val), tags, rate))
+}
+
+// logError reports an error returned by the Dogstatsd client, if any
+func (s *DogStatsdSink) logError(err error) {
+	if err != nil {
+		s.errLog.Printf("[ERR] Error sending to dogstatsd! Err: %s", err)
+	}
 }
 
 func (s *DogStatsdSink) getFlatkeyAndCombinedLabels(key []string, labels []metrics.Label) (string, []string) {
@@ -128,7 +164,11 @@ func (s *DogStatsdSink) getFlatkeyAndCombinedLabels(key []string, labels []metri
 	var tags []string
 	for _, label := range labels {
 		label.Name = strings.Map(sanitize, label.Name)
-		label.Value = strings.Map(sanitize, label.Value)
+		if s.sanitizer != nil {
+			label.Value = s.sanitizer.Sanitize(label.Value)
+		} else {
+			label.Value = strings.Map(sanitize, label.Value)
+		}
 		if label.Value != "" {
 			tags = append(tags, fmt.Sprintf("%s:%s", label.Name, label.Value))
 		} else {
@@ -3,7 +3,9 @@ package datadog
 import (
 	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/armon/go-metrics"
 )
@@ -151,3 +153,37 @@ func assertServerMatchesExpected(t *testing.T, server *net.UDPConn, buf []byte,
 		t.Fatalf("Line %s does not match expected: %s", string(msg), expected)
 	}
 }
+
+func TestNewDogStatsdSinkWithRetry(t *testing.T) {
+	retry := metrics.ConnectRetry{Attempts: 2, Delay: time.Millisecond}
+	sink, err := NewDogStatsdSinkWithRetry(DogStatsdAddr, TestHostname, retry)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sink.client.Close()
+
+	if _, err := NewDogStatsdSinkWithRetry("127.0.0.1:-1", TestHostname, retry); err == nil || !strings.Contains(err.Error(), "after 2 attempts") {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
+
+func TestLabelSanitizer(t *testing.T) {
+	sanitizer, err := metrics.NewLabelSanitizer(metrics.StatsdSanitize, metrics.CollisionSuffix, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dog := mockNewDogStatsdSink(DogStatsdAddr, EmptyTags, HostnameDisabled)
+	dog.SetLabelSanitizer(sanitizer)
+
+	_, first := dog.getFlatkeyAndCombinedLabels([]string{"req"}, []metrics.Label{{Name: "path", Value: "a b"}})
+	_, second := dog.getFlatkeyAndCombinedLabels([]string{"req"}, []metrics.Label{{Name: "path", Value: "a:b"}})
+	if !reflect.DeepEqual(first, []string{"path:a_b"}) {
+		t.Fatalf("bad tags: %v", first)
+	}
+	if len(second) != 1 || second[0] == first[0] || !strings.HasPrefix(second[0], "path:a_b_") {
+		t.Fatalf("bad tags: %v", second)
+	}
+	if c := sanitizer.Collisions(); c != 1 {
+		t.Fatalf("bad collisions: %d", c)
+	}
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import "math"
+
+// DerivedOp is the operation used to combine the sources of a DerivedRule
+type DerivedOp int
+
+const (
+	// DerivedRatio divides A by B. While B is zero, the OnZero policy of the
+	// rule applies.
+	DerivedRatio DerivedOp = iota
+
+	// DerivedSum adds A and B
+	DerivedSum
+
+	// DerivedDiff subtracts B from A
+	DerivedDiff
+)
+
+// DerivedZeroPolicy selects what a DerivedRatio emits while its denominator
+// is zero
+type DerivedZeroPolicy int
+
+const (
+	// DerivedZeroSkip emits nothing for the interval
+	DerivedZeroSkip DerivedZeroPolicy = iota
+
+	// DerivedZeroEmitZero emits zero
+	DerivedZeroEmitZero
+
+	// DerivedZeroEmitNaN emits NaN. Note NaN can't be encoded as JSON, so
+	// DisplayMetrics results holding one fail to encode with encoding/json.
+	DerivedZeroEmitNaN
+)
+
+// DerivedRule describes a gauge that an InmemSink computes from two other
+// metrics at the end of every interval, e.g. an error ratio from an error
+// and a request counter. The value of a source is the sum of a counter, the
+// value of a gauge or the mean of a sample with the source key and Labels,
+// looked up in that order. A source missing from an interval counts as
+// zero, and nothing is emitted for an interval missing both sources.
+type DerivedRule struct {
+	Key    []string // Key of the derived gauge
+	A      []string // Key of the first source
+	B      []string // Key of the second source
+	Op     DerivedOp
+	Labels []Label // Labels of both sources and of the derived gauge
+
+	// OnZero selects what a DerivedRatio emits while B is zero
+	OnZero DerivedZeroPolicy
+}
+
+// AddDerivedRule registers a rule evaluated for every interval that ends
+// after the call. The derived gauge is added to the interval it was
+// computed from, so it shows up along with its sources.
+func (i *InmemSink) AddDerivedRule(rule DerivedRule) {
+	i.intervalLock.Lock()
+	i.derivedRules = append(i.derivedRules, rule)
+	i.intervalLock.Unlock()
+
+	for _, g := range i.granularitySinks() {
+		g.AddDerivedRule(rule)
+	}
+}
+
+// AddCounterRatio registers a DerivedRatio rule emitting the ratio of the
+// numerator and denominator counters as the key gauge, e.g. an error rate
+// from error and request counters. While the denominator is zero, onZero
+// applies.
+func (i *InmemSink) AddCounterRatio(key, numerator, denominator []string, labels []Label, onZero DerivedZeroPolicy) {
+	i.AddDerivedRule(DerivedRule{
+		Key:    key,
+		A:      numerator,
+		B:      denominator,
+		Op:     DerivedRatio,
+		Labels: labels,
+		OnZero: onZero,
+	})
+}
+
+// deriveMetrics evaluates the derived rules for a finished interval. The
+// caller must hold intervalLock.
+func (i *InmemSink) deriveMetrics(intv *IntervalMetrics) {
+	intv.Lock()
+	defer intv.Unlock()
+
+	for _, rule := range i.derivedRules {
+		a, okA := i.derivedSource(intv, rule.A, rule.Labels)
+		b, okB := i.derivedSource(intv, rule.B, rule.Labels)
+		if !okA && !okB {
+			continue
+		}
+
+		var val float64
+		switch rule.Op {
+		case DerivedRatio:
+			if b != 0 {
+				val = a / b
+				break
+			}
+			switch rule.OnZero {
+			case DerivedZeroEmitZero:
+				val = 0
+			case DerivedZeroEmitNaN:
+				val = math.NaN()
+			default:
+				continue
+			}
+		case DerivedSum:
+			val = a + b
+		case DerivedDiff:
+			val = a - b
+		default:
+			continue
+		}
+
+		k, name := i.flattenKeyLabels(rule.Key, rule.Labels)
+		intv.Gauges[k] = GaugeValue{Name: name, Value: float32(val), Labels: rule.Labels}
+	}
+}
+
+// derivedSource returns the value of a derived rule source in intv, and
+// whether it was found. The caller must hold the interval lock.
+func (i *InmemSink) derivedSource(intv *IntervalMetrics, key []string, labels []Label) (float64, bool) {
+	k, _ := i.flattenKeyLabels(key, labels)
+	if c, ok := intv.Counters[k]; ok {
+		return c.Sum, true
+	}
+	if g, ok := intv.Gauges[k]; ok {
+		return float64(g.Value), true
+	}
+	if s, ok := intv.Samples[k]; ok {
+		return s.AggregateSample.Mean(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// finishedInterval returns an interval of inm which ended an hour ago
+func finishedInterval(inm *InmemSink) *IntervalMetrics {
+	intv := NewIntervalMetrics(time.Now().Truncate(time.Hour).Add(-time.Hour))
+	intv.rateDenom = inm.rateDenom
+	inm.intervals = append(inm.intervals, intv)
+	return intv
+}
+
+func ingestCounter(intv *IntervalMetrics, name string, labels []Label, vals ...float64) {
+	agg := &AggregateSample{}
+	for _, v := range vals {
+		agg.Ingest(v, intv.rateDenom)
+	}
+	intv.Counters[name] = SampledValue{Name: name, AggregateSample: agg, Labels: labels}
+}
+
+func TestInmemSink_DerivedRatio(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 24*time.Hour)
+	inm.AddDerivedRule(DerivedRule{
+		Key: []string{"http", "error_ratio"},
+		A:   []string{"http", "errors"},
+		B:   []string{"http", "requests"},
+		Op:  DerivedRatio,
+	})
+	intv := finishedInterval(inm)
+	ingestCounter(intv, "http.errors", nil, 1, 2)
+	ingestCounter(intv, "http.requests", nil, 10, 20)
+
+	// Getting the data starts a new interval, which ends the old one
+	data := inm.Data()
+	if len(data) != 2 {
+		t.Fatalf("bad: %v", data)
+	}
+	g, ok := data[0].Gauges["http.error_ratio"]
+	if !ok || g.Name != "http.error_ratio" || g.Value != 0.1 {
+		t.Fatalf("bad gauge: %v", g)
+	}
+	if _, ok := data[1].Gauges["http.error_ratio"]; ok {
+		t.Fatalf("unexpected gauge in the current interval")
+	}
+}
+
+func TestInmemSink_DerivedRatio_DivideByZero(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 24*time.Hour)
+	inm.AddDerivedRule(DerivedRule{
+		Key: []string{"ratio"},
+		A:   []string{"a"},
+		B:   []string{"b"},
+		Op:  DerivedRatio,
+	})
+	intv := finishedInterval(inm)
+	ingestCounter(intv, "a", nil, 3)
+	ingestCounter(intv, "b", nil, 1, -1)
+
+	data := inm.Data()
+	if g, ok := data[0].Gauges["ratio"]; ok {
+		t.Fatalf("unexpected gauge: %v", g)
+	}
+}
+
+func TestInmemSink_CounterRatio(t *testing.T) {
+	labels := []Label{{"method", "GET"}}
+	inm := NewInmemSink(time.Hour, 24*time.Hour)
+	inm.AddCounterRatio([]string{"error_rate"}, []string{"errors"}, []string{"requests"}, labels, DerivedZeroSkip)
+	intv := finishedInterval(inm)
+	ingestCounter(intv, "errors;method=GET", labels, 1, 1, 1)
+	ingestCounter(intv, "requests;method=GET", labels, 4, 8)
+
+	data := inm.Data()
+	g, ok := data[0].Gauges["error_rate;method=GET"]
+	if !ok || g.Name != "error_rate" || g.Value != 0.25 {
+		t.Fatalf("bad gauge: %v", g)
+	}
+}
+
+func TestInmemSink_CounterRatio_ZeroDenominator(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		onZero DerivedZeroPolicy
+		expect func(GaugeValue, bool) bool
+	}{
+		{
+			desc:   "nothing is emitted by default",
+			onZero: DerivedZeroSkip,
+			expect: func(g GaugeValue, ok bool) bool { return !ok },
+		},
+		{
+			desc:   "zero is emitted",
+			onZero: DerivedZeroEmitZero,
+			expect: func(g GaugeValue, ok bool) bool { return ok && g.Value == 0 },
+		},
+		{
+			desc:   "NaN is emitted",
+			onZero: DerivedZeroEmitNaN,
+			expect: func(g GaugeValue, ok bool) bool { return ok && math.IsNaN(float64(g.Value)) },
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			inm := NewInmemSink(time.Hour, 24*time.Hour)
+			inm.AddCounterRatio([]string{"error_rate"}, []string{"errors"}, []string{"requests"}, nil, tc.onZero)
+
+			// The denominator is missing, which counts as zero
+			intv := finishedInterval(inm)
+			ingestCounter(intv, "errors", nil, 2)
+
+			data := inm.Data()
+			g, ok := data[0].Gauges["error_rate"]
+			if !tc.expect(g, ok) {
+				t.Fatalf("bad gauge: %v, found: %v", g, ok)
+			}
+		})
+	}
+}
+
+func TestInmemSink_DerivedDiff(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 24*time.Hour)
+	labels := []Label{{"pool", "main"}}
+	inm.AddDerivedRule(DerivedRule{
+		Key:    []string{"conns", "idle"},
+		A:      []string{"conns", "open"},
+		B:      []string{"conns", "busy"},
+		Op:     DerivedDiff,
+		Labels: labels,
+	})
+	inm.AddDerivedRule(DerivedRule{
+		Key: []string{"missing"},
+		A:   []string{"nope"},
+		B:   []string{"nada"},
+		Op:  DerivedSum,
+	})
+	intv := finishedInterval(inm)
+	intv.Gauges["conns.open;pool=main"] = GaugeValue{Name: "conns.open", Value: 10, Labels: labels}
+	intv.Samples["conns.busy;pool=main"] = SampledValue{
+		Name:            "conns.busy",
+		AggregateSample: &AggregateSample{Count: 2, Sum: 6},
+		Labels:          labels,
+	}
+
+	data := inm.Data()
+	g, ok := data[0].Gauges["conns.idle;pool=main"]
+	if !ok || g.Name != "conns.idle" || g.Value != 7 || len(g.Labels) != 1 {
+		t.Fatalf("bad gauge: %v", g)
+	}
+	if g, ok := data[0].Gauges["missing"]; ok {
+		t.Fatalf("unexpected gauge: %v", g)
+	}
+}
+
+func TestInmemSink_DerivedSum_MissingSource(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 24*time.Hour)
+	inm.AddDerivedRule(DerivedRule{
+		Key: []string{"total"},
+		A:   []string{"a"},
+		B:   []string{"b"},
+		Op:  DerivedSum,
+	})
+	intv := finishedInterval(inm)
+	ingestCounter(intv, "a", nil, 4)
+
+	data := inm.Data()
+	if g := data[0].Gauges["total"]; g.Value != 4 {
+		t.Fatalf("bad gauge: %v", g)
+	}
+}
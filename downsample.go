@@ -0,0 +1,267 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GaugeDownsampleRule downsamples the gauges whose key, with '.' as the
+// separator, starts with Prefix
+type GaugeDownsampleRule struct {
+	Prefix string
+
+	// Interval is the shortest time between two emissions of a gauge of
+	// the same key and labels
+	Interval time.Duration
+}
+
+// GaugeDownsamplingOpts is used to configure a GaugeDownsamplingSink
+type GaugeDownsamplingOpts struct {
+	// Rules select the downsampled gauges. A gauge follows the rule with
+	// the longest matching prefix. Required.
+	Rules []GaugeDownsampleRule
+
+	// Clock is the source of the current time, mostly for testing. Defaults
+	// to the system clock.
+	Clock Clock
+}
+
+// GaugeDownsamplingSink wraps a MetricSink and passes on each high frequency
+// gauge selected by its rules at most once per Interval, e.g. a queue depth
+// set thousands of times a second of which the latest value every 100ms is
+// enough. The first value of a gauge is passed on right away. The values set
+// within Interval after it only replace the held value of the gauge, which
+// is passed on once Interval has elapsed, so the latest value always reaches
+// the wrapped sink, delayed by up to Interval.
+//
+// Gauges matching no rule and other emissions are passed on right away. Call
+// Shutdown to pass on the held values and stop the background flush.
+type GaugeDownsamplingSink struct {
+	sink  MetricSink
+	rules []GaugeDownsampleRule
+	clock Clock
+
+	lock   sync.Mutex
+	gauges map[string]*downsampledGauge
+
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// downsampledGauge is a gauge of a GaugeDownsamplingSink, along with its
+// held value if pending is set
+type downsampledGauge struct {
+	key      []string
+	labels   []Label
+	interval time.Duration
+	emitted  time.Time
+
+	pending bool
+	isInt   bool
+	val     float32
+	intVal  int64
+}
+
+// NewGaugeDownsamplingSink creates a GaugeDownsamplingSink passing emissions
+// to sink, and starts passing on the held values in the background
+func NewGaugeDownsamplingSink(sink MetricSink, opts GaugeDownsamplingOpts) (*GaugeDownsamplingSink, error) {
+	if len(opts.Rules) == 0 {
+		return nil, fmt.Errorf("no downsampling rules")
+	}
+	rules := append([]GaugeDownsampleRule(nil), opts.Rules...)
+	tick := rules[0].Interval
+	for _, rule := range rules {
+		if rule.Interval <= 0 {
+			return nil, fmt.Errorf("invalid interval %v for prefix %q", rule.Interval, rule.Prefix)
+		}
+		if rule.Interval < tick {
+			tick = rule.Interval
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].Prefix) > len(rules[j].Prefix) })
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+
+	d := &GaugeDownsamplingSink{
+		sink:   sink,
+		rules:  rules,
+		clock:  opts.Clock,
+		gauges: make(map[string]*downsampledGauge),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	if err := GoSink(func() { d.flushLoop(tick) }); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Shutdown stops the background flush and passes on the held values. It is
+// safe to call more than once.
+func (d *GaugeDownsamplingSink) Shutdown() {
+	d.stopOnce.Do(func() { close(d.stopCh) })
+	<-d.doneCh
+	d.Flush()
+}
+
+// Flush passes on every held value, regardless of its age
+func (d *GaugeDownsamplingSink) Flush() {
+	d.flush(d.clock.Now(), true)
+}
+
+// flush passes on the held values whose interval has elapsed at now, or
+// all of them if force is set, and forgets the gauges idle for an interval
+func (d *GaugeDownsamplingSink) flush(now time.Time, force bool) {
+	var due []downsampledGauge
+	d.lock.Lock()
+	for k, g := range d.gauges {
+		elapsed := now.Sub(g.emitted) >= g.interval
+		switch {
+		case g.pending && (force || elapsed):
+			due = append(due, *g)
+			g.pending = false
+			g.emitted = now
+		case !g.pending && elapsed:
+			// The next value is passed on right away anyway
+			delete(d.gauges, k)
+		}
+	}
+	d.lock.Unlock()
+
+	for _, g := range due {
+		d.emit(&g)
+	}
+}
+
+func (d *GaugeDownsamplingSink) flushLoop(tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	defer close(d.doneCh)
+
+	for {
+		select {
+		case <-ticker.C:
+			d.flush(d.clock.Now(), false)
+		case <-d.stopCh:
+			return
+		}
+	}
+}
+
+// rule returns the interval of the rule matching key, if any
+func (d *GaugeDownsamplingSink) rule(key []string) (time.Duration, bool) {
+	flat := strings.Join(key, ".")
+	for _, rule := range d.rules {
+		if strings.HasPrefix(flat, rule.Prefix) {
+			return rule.Interval, true
+		}
+	}
+	return 0, false
+}
+
+// set passes the gauge on if it matches no rule or its interval has elapsed,
+// and holds it otherwise
+func (d *GaugeDownsamplingSink) set(key []string, labels []Label, val float32, intVal int64, isInt bool) {
+	interval, ok := d.rule(key)
+	if !ok {
+		d.emit(&downsampledGauge{key: key, labels: labels, val: val, intVal: intVal, isInt: isInt})
+		return
+	}
+	k := runKey(key, labels)
+	now := d.clock.Now()
+
+	d.lock.Lock()
+	g, ok := d.gauges[k]
+	if ok && now.Sub(g.emitted) < interval {
+		g.pending, g.val, g.intVal, g.isInt = true, val, intVal, isInt
+		d.lock.Unlock()
+		return
+	}
+	if !ok {
+		// Copy as the caller may reuse its slices while the value is held
+		g = &downsampledGauge{
+			key:      append([]string(nil), key...),
+			labels:   append([]Label(nil), labels...),
+			interval: interval,
+		}
+		d.gauges[k] = g
+	}
+	g.emitted, g.pending = now, false
+	d.lock.Unlock()
+
+	d.emit(&downsampledGauge{key: key, labels: labels, val: val, intVal: intVal, isInt: isInt})
+}
+
+// emit passes the value of g on
+func (d *GaugeDownsamplingSink) emit(g *downsampledGauge) {
+	if g.isInt {
+		setGaugeInt(d.sink, g.key, g.intVal, g.labels)
+		return
+	}
+	d.sink.SetGaugeWithLabels(g.key, g.val, g.labels)
+}
+
+func (d *GaugeDownsamplingSink) SetGauge(key []string, val float32) {
+	d.SetGaugeWithLabels(key, val, nil)
+}
+
+func (d *GaugeDownsamplingSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	d.set(key, labels, val, 0, false)
+}
+
+func (d *GaugeDownsamplingSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	d.set(key, labels, 0, val, true)
+}
+
+func (d *GaugeDownsamplingSink) EmitKey(key []string, val float32) {
+	d.sink.EmitKey(key, val)
+}
+
+func (d *GaugeDownsamplingSink) IncrCounter(key []string, val float32) {
+	d.sink.IncrCounter(key, val)
+}
+
+func (d *GaugeDownsamplingSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	d.sink.IncrCounterWithLabels(key, val, labels)
+}
+
+func (d *GaugeDownsamplingSink) AddSample(key []string, val float32) {
+	d.sink.AddSample(key, val)
+}
+
+func (d *GaugeDownsamplingSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	d.sink.AddSampleWithLabels(key, val, labels)
+}
+
+func (d *GaugeDownsamplingSink) AddTimingSample(key []string, val float32, unit time.Duration, labels []Label) {
+	addTiming(d.sink, key, val, unit, labels)
+}
+
+func (d *GaugeDownsamplingSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	observeBuckets(d.sink, key, counts, labels)
+}
+
+func (d *GaugeDownsamplingSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	incrCounterInt(d.sink, key, val, labels)
+}
+
+func (d *GaugeDownsamplingSink) ResetCounter(key []string, labels []Label) {
+	resetCounter(d.sink, key, labels)
+}
+
+func (d *GaugeDownsamplingSink) SetCounterTemporality(key []string, temporality Temporality) {
+	setCounterTemporality(d.sink, key, temporality)
+}
+
+func (d *GaugeDownsamplingSink) SetResourceLabels(names []string) {
+	setResourceLabels(d.sink, names)
+}
+
+func (d *GaugeDownsamplingSink) SetTimestampOffset(offset time.Duration) {
+	setTimestampOffset(d.sink, offset)
+}
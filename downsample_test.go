@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGaugeDownsamplingSink_Opts(t *testing.T) {
+	if _, err := NewGaugeDownsamplingSink(&MockSink{}, GaugeDownsamplingOpts{}); err == nil {
+		t.Fatalf("expected error")
+	}
+	rules := []GaugeDownsampleRule{{Prefix: "queue", Interval: 0}}
+	if _, err := NewGaugeDownsamplingSink(&MockSink{}, GaugeDownsamplingOpts{Rules: rules}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestGaugeDownsamplingSink_Rate(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	m := &MockSink{}
+	d, err := NewGaugeDownsamplingSink(m, GaugeDownsamplingOpts{
+		Rules: []GaugeDownsampleRule{{Prefix: "queue", Interval: time.Hour}},
+		Clock: clock,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer d.Shutdown()
+
+	// The first value is passed on, the next ones within the interval held
+	for i := 0; i < 100; i++ {
+		d.SetGauge([]string{"queue", "depth"}, float32(i))
+	}
+	d.SetGauge([]string{"other"}, 1)
+	d.SetGauge([]string{"other"}, 2)
+	if !reflect.DeepEqual(m.vals, []float32{0, 1, 2}) {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+
+	// Nothing is due before the interval has elapsed
+	clock.Advance(30 * time.Minute)
+	d.flush(clock.Now(), false)
+	if len(m.vals) != 3 {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+
+	// The latest value is passed on once the interval has elapsed
+	clock.Advance(30 * time.Minute)
+	d.flush(clock.Now(), false)
+	if !reflect.DeepEqual(m.vals, []float32{0, 1, 2, 99}) {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+
+	// A value right after an emission is held, and passed on by Flush
+	d.SetGauge([]string{"queue", "depth"}, 7)
+	if len(m.vals) != 4 {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+	d.Flush()
+	if !reflect.DeepEqual(m.vals, []float32{0, 1, 2, 99, 7}) {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+
+	// A gauge idle for an interval is forgotten and passed on right away
+	clock.Advance(time.Hour)
+	d.flush(clock.Now(), false)
+	d.SetGauge([]string{"queue", "depth"}, 8)
+	if !reflect.DeepEqual(m.vals, []float32{0, 1, 2, 99, 7, 8}) {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+}
+
+func TestGaugeDownsamplingSink_Rules(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	m := &MockSink{}
+	d, err := NewGaugeDownsamplingSink(m, GaugeDownsamplingOpts{
+		Rules: []GaugeDownsampleRule{
+			{Prefix: "queue", Interval: time.Hour},
+			{Prefix: "queue.fast", Interval: time.Minute},
+		},
+		Clock: clock,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer d.Shutdown()
+
+	// The longest prefix wins, and labels make separate gauges
+	labels := []Label{{"shard", "a"}}
+	d.SetGaugeWithLabels([]string{"queue", "fast"}, 1, labels)
+	d.SetGaugeWithLabels([]string{"queue", "fast"}, 2, labels)
+	d.SetGaugeWithLabels([]string{"queue", "fast"}, 3, []Label{{"shard", "b"}})
+	d.SetGaugeWithLabels([]string{"queue", "slow"}, 4, labels)
+	d.SetGaugeWithLabels([]string{"queue", "slow"}, 5, labels)
+	if !reflect.DeepEqual(m.vals, []float32{1, 3, 4}) {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+
+	// Held gauges keep their labels when the caller reuses its slice
+	labels[0].Value = "reused"
+	clock.Advance(time.Minute)
+	d.flush(clock.Now(), false)
+	if !reflect.DeepEqual(m.vals, []float32{1, 3, 4, 2}) {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+	if last := m.labels[len(m.labels)-1]; !reflect.DeepEqual(last, []Label{{"shard", "a"}}) {
+		t.Fatalf("bad labels: %v", last)
+	}
+}
+
+func TestGaugeDownsamplingSink_Integers(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	im := &intMockSink{}
+	d, err := NewGaugeDownsamplingSink(im, GaugeDownsamplingOpts{
+		Rules: []GaugeDownsampleRule{{Prefix: "queue", Interval: time.Hour}},
+		Clock: clock,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Held integers are passed on as integers by Shutdown
+	d.SetGaugeIntWithLabels([]string{"queue"}, 1, nil)
+	d.SetGaugeIntWithLabels([]string{"queue"}, 2, nil)
+	d.Shutdown()
+	if !reflect.DeepEqual(im.intVals, []int64{1, 2}) || len(im.vals) != 0 {
+		t.Fatalf("bad values: %v %v", im.intVals, im.vals)
+	}
+
+	// Shutting down again does nothing
+	d.Shutdown()
+	if !reflect.DeepEqual(im.intVals, []int64{1, 2}) || len(im.vals) != 0 {
+		t.Fatalf("bad values: %v %v", im.intVals, im.vals)
+	}
+}
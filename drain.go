@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// queueDrain bounds how long Shutdown waits for the flush loop of a buffered
+// sink to write its queued metrics. Past the timeout, the write in progress
+// is interrupted, so the loop discards the rest of the queue and exits. A
+// nil queueDrain doesn't wait at all.
+type queueDrain struct {
+	timeout time.Duration
+
+	// done is closed when the flush loop exits
+	done chan struct{}
+
+	// lock guards conn, the connection the flush loop writes to, and
+	// aborted, set once the timeout has passed
+	lock    sync.Mutex
+	conn    net.Conn
+	aborted bool
+}
+
+// newQueueDrain returns the queueDrain waiting up to timeout, or not at all
+// if zero
+func newQueueDrain(timeout time.Duration) (*queueDrain, error) {
+	if timeout < 0 {
+		return nil, fmt.Errorf("invalid drain timeout %s", timeout)
+	}
+	return &queueDrain{timeout: timeout, done: make(chan struct{})}, nil
+}
+
+// enabled returns whether Shutdown drains the queue
+func (d *queueDrain) enabled() bool {
+	return d != nil && d.timeout > 0
+}
+
+// setConn records the connection the flush loop writes to, or nil while
+// disconnected. A connection made after the timeout fails its writes.
+func (d *queueDrain) setConn(conn net.Conn) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.conn = conn
+	if d.aborted && conn != nil {
+		conn.SetWriteDeadline(time.Now())
+	}
+}
+
+// exit marks the flush loop as exited
+func (d *queueDrain) exit() {
+	if d != nil {
+		close(d.done)
+	}
+}
+
+// wait waits for the flush loop to exit, up to the timeout after which it
+// interrupts the write in progress and returns
+func (d *queueDrain) wait() {
+	if !d.enabled() {
+		return
+	}
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+	select {
+	case <-d.done:
+		return
+	case <-timer.C:
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.aborted = true
+	if d.conn != nil {
+		d.conn.SetWriteDeadline(time.Now())
+	}
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQueueDrain_Wait(t *testing.T) {
+	if _, err := newQueueDrain(-time.Second); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Without a timeout, or without a drain, wait returns right away
+	var nilDrain *queueDrain
+	nilDrain.setConn(nil)
+	nilDrain.wait()
+	nilDrain.exit()
+	d, err := newQueueDrain(0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d.wait()
+
+	// wait returns once the flush loop exits
+	d, err = newQueueDrain(time.Minute)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go d.exit()
+	d.wait()
+}
+
+func TestQueueDrain_Timeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	d, err := newQueueDrain(50 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d.setConn(client)
+
+	// Nobody reads the pipe, so the write blocks until the timeout
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.Write([]byte("blocked"))
+		errCh <- err
+		d.exit()
+	}()
+	start := time.Now()
+	d.wait()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("wait took %s", elapsed)
+	}
+	if err := <-errCh; err == nil {
+		t.Fatalf("expected the write to be interrupted")
+	}
+
+	// A connection made after the timeout fails its writes right away
+	other, otherServer := net.Pipe()
+	defer otherServer.Close()
+	d.setConn(other)
+	if _, err := other.Write([]byte("late")); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// Reasons passed to the DropFunc set with SetOnDrop
+const (
+	// DropFiltered is for metrics rejected by the prefix filters of Metrics
+	DropFiltered = "filtered"
+
+	// DropMiddleware is for metrics dropped by one of Config.Middlewares
+	DropMiddleware = "middleware"
+
+	// DropEmptyKey is for metrics whose key segments were all empty, or had
+	// an empty one with EmptySegmentsDrop
+	DropEmptyKey = "empty_key"
+
+	// DropTypeConflict is for metrics dropped by TypeConflictsDrop
+	DropTypeConflict = "type_conflict"
+
+	// DropKeyDepth is for metrics whose key exceeded Config.MaxKeyDepth,
+	// with KeyDepthDrop
+	DropKeyDepth = "key_depth"
+
+	// DropQueueFull is for metrics lost by the OverflowPolicy of a full
+	// queue, or dropped by its QueuePriority
+	DropQueueFull = "queue_full"
+
+	// DropShutdown is for metrics emitted to a sink after its Shutdown
+	DropShutdown = "shutdown"
+
+	// DropDisconnected is for metrics discarded while a sink waits to
+	// reconnect to its backend
+	DropDisconnected = "disconnected"
+
+	// DropNonFinite is for NaN and infinite values dropped by a
+	// NonFiniteSink
+	DropNonFinite = "non_finite"
+
+	// DropUnknownID is for metrics of a BinaryFrameSink whose key or labels
+	// aren't in its dictionary
+	DropUnknownID = "unknown_id"
+
+	// DropCircuitOpen is for metrics dropped by an open CircuitBreakerSink
+	DropCircuitOpen = "circuit_open"
+)
+
+// DropFunc is called with every metric dropped by Metrics or the sinks of the
+// package, along with one of the Drop reasons. The metrics lost from the
+// queue of formatted lines of StatsdSink and StatsiteSink are passed with the
+// flattened name of the line as the only key segment and no labels, and those
+// lost by a NetworkSink after encoding with a nil key. It runs on the goroutine of the drop, which may be
+// the caller of the metric while locks of the package are held, so it must
+// return quickly, must not block and must not emit metrics.
+type DropFunc func(key []string, labels []Label, reason string)
+
+// dropHook wraps the DropFunc of SetOnDrop, as atomic.Value can't hold nil
+type dropHook struct {
+	f DropFunc
+}
+
+// onDrop holds the dropHook set with SetOnDrop
+var onDrop atomic.Value
+
+// SetOnDrop sets the function called on every drop, to log or investigate
+// exactly which metrics are lost and why. Drops are only counted, as before,
+// when it is nil, the default.
+func SetOnDrop(f DropFunc) {
+	onDrop.Store(dropHook{f})
+}
+
+// notifyDrop calls the DropFunc set with SetOnDrop, if any
+func notifyDrop(key []string, labels []Label, reason string) {
+	if hook, _ := onDrop.Load().(dropHook); hook.f != nil {
+		hook.f(key, labels, reason)
+	}
+}
+
+// notifyDropLine calls the DropFunc set with SetOnDrop, if any, for a
+// dropped statsd line
+func notifyDropLine(line, reason string) {
+	if hook, _ := onDrop.Load().(dropHook); hook.f != nil {
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		hook.f([]string{line}, nil, reason)
+	}
+}
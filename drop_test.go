@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// drop is a call of the DropFunc set with SetOnDrop
+type drop struct {
+	key    []string
+	labels []Label
+	reason string
+}
+
+// recordDrops sets a DropFunc recording its calls, returning them and a
+// function removing it
+func recordDrops() (func() []drop, func()) {
+	var lock sync.Mutex
+	var drops []drop
+	SetOnDrop(func(key []string, labels []Label, reason string) {
+		lock.Lock()
+		defer lock.Unlock()
+		drops = append(drops, drop{key, labels, reason})
+	})
+	get := func() []drop {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]drop(nil), drops...)
+	}
+	return get, func() { SetOnDrop(nil) }
+}
+
+func TestSetOnDrop_Metrics(t *testing.T) {
+	drops, reset := recordDrops()
+	defer reset()
+	labels := []Label{{"a", "b"}}
+
+	m, met := mockMetric()
+	met.FilterDefault = false
+	met.SetGaugeWithLabels([]string{"filtered"}, 1, labels)
+
+	_, met = mockMetric()
+	met.Middlewares = []Middleware{DropKeys("dropped")}
+	met.IncrCounterWithLabels([]string{"dropped"}, 1, labels)
+
+	_, met = mockMetric()
+	met.EmptyKeySegments = EmptySegmentsDrop
+	met.AddSample([]string{"empty", ""}, 1)
+
+	_, met = mockMetric()
+	met.MixedTypeKeys = TypeConflictsDrop
+	met.SetGauge([]string{"conflict"}, 1)
+	met.IncrCounter([]string{"conflict"}, 1)
+
+	_, met = mockMetric()
+	met.MaxKeyDepth = 1
+	met.SetGaugeWithLabels([]string{"too", "deep"}, 1, labels)
+
+	expect := []drop{
+		{[]string{"filtered"}, labels, DropFiltered},
+		{[]string{"dropped"}, labels, DropMiddleware},
+		{[]string{"empty", ""}, nil, DropEmptyKey},
+		{[]string{"conflict"}, nil, DropTypeConflict},
+		{[]string{"too", "deep"}, nil, DropKeyDepth},
+	}
+	if got := drops(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad drops %v", got)
+	}
+	if len(m.keys) != 0 {
+		t.Fatalf("unexpected emissions %v", m.keys)
+	}
+}
+
+func TestSetOnDrop_Sinks(t *testing.T) {
+	drops, reset := recordDrops()
+	defer reset()
+	labels := []Label{{"a", "b"}}
+
+	n := NewNonFiniteSink(&MockSink{}, NonFiniteOpts{NaN: NonFiniteDrop})
+	n.SetGaugeWithLabels([]string{"nan"}, float32(math.NaN()), labels)
+
+	b, err := NewBinaryFrameSink(&bytes.Buffer{}, FrameDictionary{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	b.IncrCounterWithLabels([]string{"unknown"}, 1, labels)
+
+	f := &failingSink{failing: true}
+	c, err := NewCircuitBreakerSink(f, CircuitBreakerOpts{Threshold: 1, CoolDown: time.Minute})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c.IncrCounter([]string{"trip"}, 1)
+	c.IncrCounterWithLabels([]string{"open"}, 1, labels)
+
+	expect := []drop{
+		{[]string{"nan"}, labels, DropNonFinite},
+		{[]string{"unknown"}, labels, DropUnknownID},
+		{[]string{"open"}, labels, DropCircuitOpen},
+	}
+	if got := drops(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad drops %v", got)
+	}
+}
+
+func TestSetOnDrop_Queues(t *testing.T) {
+	drops, reset := recordDrops()
+	defer reset()
+
+	// Both the newest and the oldest emissions of a full queue are reported
+	queue := make(chan string, 1)
+	queue <- "old:1|c\n"
+	newest := queueOverflow{policy: OverflowDropNewest}
+	if n := newest.push(queue, "new:1|c\n"); n != 1 {
+		t.Fatalf("bad drops %d", n)
+	}
+	oldest := queueOverflow{policy: OverflowDropOldest}
+	if n := oldest.push(queue, "new:2|c\n"); n != 1 {
+		t.Fatalf("bad drops %d", n)
+	}
+
+	// Emissions after Shutdown
+	s, err := NewStatsdSink("127.0.0.1:7524")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.Shutdown()
+	s.SetGauge([]string{"late"}, 1)
+
+	expect := []drop{
+		{[]string{"new"}, nil, DropQueueFull},
+		{[]string{"old"}, nil, DropQueueFull},
+		{[]string{"late"}, nil, DropShutdown},
+	}
+	if got := drops(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad drops %v", got)
+	}
+}
+
+func TestSetOnDrop_Priority(t *testing.T) {
+	drops, reset := recordDrops()
+	defer reset()
+
+	// Samples are dropped from the first queued emission
+	limits, err := newQueueLimits(QueuePriority{DropOrder: []MetricType{MetricTypeSample}, Pressure: 0.5}, 2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s := &StatsiteSink{metricQueue: make(chan string, 2), limits: limits}
+	s.metricQueue <- "full:1|c\n"
+	labels := []Label{{"a", "b"}}
+	s.AddSampleWithLabels([]string{"sample"}, 1, labels)
+
+	expect := []drop{{[]string{"sample"}, labels, DropQueueFull}}
+	if got := drops(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad drops %v", got)
+	}
+}
+
+func TestSetOnDrop_Disconnected(t *testing.T) {
+	drops, reset := recordDrops()
+	defer reset()
+
+	// Nothing listens on the port, so the sink is waiting to reconnect
+	n, err := NewNetworkSink("tcp", "127.0.0.1:1", NetworkSinkOpts{Serializer: lineSerializer})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer n.Shutdown()
+	n.IncrCounter([]string{"lost"}, 1)
+
+	deadline := time.Now().Add(time.Second)
+	for len(drops()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect := []drop{{nil, nil, DropDisconnected}}
+	if got := drops(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad drops %v", got)
+	}
+}
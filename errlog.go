@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultFailureLogInterval is the minimum time between two messages logged
+// by a FailureLogger created with NewFailureLogger.
+const DefaultFailureLogInterval = time.Minute
+
+// Logger is the interface sinks use to log errors. It is satisfied by
+// *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// FailureLogger logs repeated sink failures without flooding the log. The
+// first failure is always logged. After that a failure is only logged once
+// Every failures have been suppressed, or Interval has passed since the last
+// message, whichever comes first. Logged messages mention how many failures
+// were suppressed before them. If neither Every nor Interval is set, every
+// failure is logged.
+type FailureLogger struct {
+	// Logger receives the messages. Defaults to the standard logger.
+	Logger Logger
+
+	// Every logs a failure after this many have been suppressed
+	Every int
+
+	// Interval logs a failure when this long has passed since the last
+	// logged failure
+	Interval time.Duration
+
+	lock       sync.Mutex
+	logged     bool
+	lastLogged time.Time
+	suppressed int
+}
+
+// NewFailureLogger returns a FailureLogger writing to the standard logger at
+// most once per DefaultFailureLogInterval.
+func NewFailureLogger() *FailureLogger {
+	return &FailureLogger{Interval: DefaultFailureLogInterval}
+}
+
+// Printf logs a failure, unless it is suppressed by the rate limit
+func (l *FailureLogger) Printf(format string, v ...interface{}) {
+	now := time.Now()
+
+	l.lock.Lock()
+	if l.logged && !l.due(now) {
+		l.suppressed++
+		l.lock.Unlock()
+		return
+	}
+	suppressed := l.suppressed
+	l.logged = true
+	l.lastLogged = now
+	l.suppressed = 0
+	l.lock.Unlock()
+
+	msg := fmt.Sprintf(format, v...)
+	if suppressed > 0 {
+		msg = fmt.Sprintf("%s (%d more errors suppressed)", msg, suppressed)
+	}
+	if l.Logger == nil {
+		log.Print(msg)
+	} else {
+		l.Logger.Printf("%s", msg)
+	}
+}
+
+// due returns whether the next failure should be logged. The caller must
+// hold lock.
+func (l *FailureLogger) due(now time.Time) bool {
+	if l.Every <= 0 && l.Interval <= 0 {
+		return true
+	}
+	if l.Every > 0 && l.suppressed+1 >= l.Every {
+		return true
+	}
+	return l.Interval > 0 && now.Sub(l.lastLogged) >= l.Interval
+}
@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type captureLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (c *captureLogger) Printf(format string, v ...interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lines = append(c.lines, fmt.Sprintf(format, v...))
+}
+
+func (c *captureLogger) getLines() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.lines...)
+}
+
+func TestFailureLogger_Interval(t *testing.T) {
+	capture := &captureLogger{}
+	l := &FailureLogger{Logger: capture, Interval: 50 * time.Millisecond}
+
+	for j := 0; j < 100; j++ {
+		l.Printf("failure %d", j)
+	}
+	if lines := capture.getLines(); len(lines) != 1 || lines[0] != "failure 0" {
+		t.Fatalf("expected only the first failure to be logged, got: %v", lines)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	l.Printf("failure %d", 100)
+	lines := capture.getLines()
+	if len(lines) != 2 || lines[1] != "failure 100 (99 more errors suppressed)" {
+		t.Fatalf("bad lines: %v", lines)
+	}
+}
+
+func TestFailureLogger_Every(t *testing.T) {
+	capture := &captureLogger{}
+	l := &FailureLogger{Logger: capture, Every: 10}
+
+	for j := 0; j < 100; j++ {
+		l.Printf("failure %d", j)
+	}
+	lines := capture.getLines()
+	if len(lines) != 10 {
+		t.Fatalf("expected every 10th failure to be logged, got: %v", lines)
+	}
+	if lines[1] != "failure 10 (9 more errors suppressed)" {
+		t.Fatalf("bad line: %v", lines[1])
+	}
+}
+
+func TestFailureLogger_Unlimited(t *testing.T) {
+	capture := &captureLogger{}
+	l := &FailureLogger{Logger: capture}
+
+	for j := 0; j < 5; j++ {
+		l.Printf("failure")
+	}
+	if lines := capture.getLines(); len(lines) != 5 {
+		t.Fatalf("expected every failure to be logged, got: %v", lines)
+	}
+}
+
+func TestFailureLogger_Sinks(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		new  func(l *FailureLogger) (func(), error)
+	}{
+		{
+			desc: "statsd",
+			new: func(l *FailureLogger) (func(), error) {
+				s, err := NewStatsdSinkFrom("no-port", StatsdOpts{ErrorLog: l})
+				return s.Shutdown, err
+			},
+		},
+		{
+			desc: "statsite",
+			new: func(l *FailureLogger) (func(), error) {
+				s, err := NewStatsiteSinkFrom("no-port", StatsiteOpts{ErrorLog: l})
+				return s.Shutdown, err
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			capture := &captureLogger{}
+			shutdown, err := tc.new(&FailureLogger{Logger: capture, Interval: time.Hour})
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer shutdown()
+
+			deadline := time.Now().Add(time.Second)
+			for len(capture.getLines()) == 0 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			lines := capture.getLines()
+			if len(lines) != 1 || !strings.Contains(lines[0], "Error connecting to "+tc.desc) {
+				t.Fatalf("bad lines: %v", lines)
+			}
+		})
+	}
+}
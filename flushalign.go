@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// flushSchedule aligns the flushes of a buffered sink to the multiples of
+// align since the Unix epoch, delayed by a fixed offset, so every instance
+// of a fleet flushes at the same wall-clock moments. A nil flushSchedule
+// flushes every flushInterval from the start of the sink.
+type flushSchedule struct {
+	align  time.Duration
+	offset time.Duration
+}
+
+// newFlushSchedule returns the flushSchedule aligned to align, with an
+// offset chosen at random below jitter, or nil if align is zero
+func newFlushSchedule(align, jitter time.Duration) (*flushSchedule, error) {
+	if align < 0 {
+		return nil, fmt.Errorf("invalid flush alignment %s", align)
+	}
+	if jitter < 0 || (jitter > 0 && jitter >= align) {
+		return nil, fmt.Errorf("invalid flush jitter %s, must be below the alignment", jitter)
+	}
+	if align == 0 {
+		return nil, nil
+	}
+	f := &flushSchedule{align: align}
+	if jitter > 0 {
+		f.offset = time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return f, nil
+}
+
+// next returns the time of the first flush after now
+func (f *flushSchedule) next(now time.Time) time.Time {
+	ns := now.UnixNano()
+	boundary := ns - ns%int64(f.align) + int64(f.offset)
+	if boundary <= ns {
+		boundary += int64(f.align)
+	}
+	return time.Unix(0, boundary)
+}
+
+// flushTicker delivers the flushes of a flushSchedule on C
+type flushTicker struct {
+	C <-chan time.Time
+
+	schedule *flushSchedule
+	ticker   *time.Ticker
+	timer    *time.Timer
+}
+
+// ticker starts the flushes of the schedule
+func (f *flushSchedule) ticker() *flushTicker {
+	if f == nil {
+		ticker := time.NewTicker(flushInterval)
+		return &flushTicker{C: ticker.C, ticker: ticker}
+	}
+	now := time.Now()
+	timer := time.NewTimer(f.next(now).Sub(now))
+	return &flushTicker{C: timer.C, schedule: f, timer: timer}
+}
+
+// fired schedules the next flush, and must be called on every receive from C
+func (t *flushTicker) fired() {
+	if t.timer != nil {
+		now := time.Now()
+		t.timer.Reset(t.schedule.next(now).Sub(now))
+	}
+}
+
+// Stop stops the flushes
+func (t *flushTicker) Stop() {
+	if t.ticker != nil {
+		t.ticker.Stop()
+	} else {
+		t.timer.Stop()
+	}
+}
@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFlushSchedule_Next(t *testing.T) {
+	for _, bad := range [][2]time.Duration{
+		{-time.Second, 0},
+		{time.Second, -time.Millisecond},
+		{time.Second, time.Second},
+		{0, time.Millisecond},
+	} {
+		if _, err := newFlushSchedule(bad[0], bad[1]); err == nil {
+			t.Fatalf("expected error for %v", bad)
+		}
+	}
+	f, err := newFlushSchedule(0, 0)
+	if err != nil || f != nil {
+		t.Fatalf("expected no schedule, got %v %v", f, err)
+	}
+
+	f = &flushSchedule{align: 10 * time.Second}
+	base := time.Unix(1700000000, 0)
+	cases := []struct {
+		now, next time.Time
+	}{
+		{base, base.Add(10 * time.Second)},
+		{base.Add(time.Nanosecond), base.Add(10 * time.Second)},
+		{base.Add(9999 * time.Millisecond), base.Add(10 * time.Second)},
+		{base.Add(10 * time.Second), base.Add(20 * time.Second)},
+	}
+	for _, c := range cases {
+		if got := f.next(c.now); !got.Equal(c.next) {
+			t.Fatalf("next(%v) = %v, want %v", c.now, got, c.next)
+		}
+	}
+
+	// Boundaries are those of the Unix epoch, not of the local time zone
+	zoned := base.Add(3 * time.Second).In(time.FixedZone("", 90*60+7))
+	if got := f.next(zoned); !got.Equal(base.Add(10 * time.Second)) {
+		t.Fatalf("bad next %v", got)
+	}
+
+	// The offset delays every boundary
+	f.offset = 2 * time.Second
+	if got := f.next(base.Add(time.Second)); !got.Equal(base.Add(2 * time.Second)) {
+		t.Fatalf("bad next %v", got)
+	}
+	if got := f.next(base.Add(2 * time.Second)); !got.Equal(base.Add(12 * time.Second)) {
+		t.Fatalf("bad next %v", got)
+	}
+}
+
+func TestFlushSchedule_Jitter(t *testing.T) {
+	for n := 0; n < 100; n++ {
+		f, err := newFlushSchedule(time.Second, 100*time.Millisecond)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if f.offset < 0 || f.offset >= 100*time.Millisecond {
+			t.Fatalf("bad offset %v", f.offset)
+		}
+	}
+}
+
+// offBoundary returns how long after the last multiple of align since the
+// Unix epoch t is
+func offBoundary(t time.Time, align time.Duration) time.Duration {
+	return time.Duration(t.UnixNano() % int64(align))
+}
+
+func TestStatsd_FlushAlignment(t *testing.T) {
+	list, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+
+	const align = 250 * time.Millisecond
+	s, err := NewStatsdSinkFrom(list.LocalAddr().String(), StatsdOpts{FlushAlignment: align})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s.Shutdown()
+
+	buf := make([]byte, statsdMaxLen)
+	for n := 0; n < 2; n++ {
+		s.SetGauge([]string{"gauge"}, float32(n))
+		list.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := list.ReadFrom(buf); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		// Allow for scheduling delays
+		if off := offBoundary(time.Now(), align); off > 50*time.Millisecond {
+			t.Fatalf("flush %v after the boundary", off)
+		}
+	}
+
+	if _, err := NewStatsdSinkFrom(list.LocalAddr().String(), StatsdOpts{FlushJitter: time.Second}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestStatsite_FlushAlignment(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer listener.Close()
+
+	const align = 250 * time.Millisecond
+	s, err := NewStatsiteSinkFrom(listener.Addr().String(), StatsiteOpts{FlushAlignment: align})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s.Shutdown()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for n := 0; n < 2; n++ {
+		s.SetGauge([]string{"gauge"}, float32(n))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if off := offBoundary(time.Now(), align); off > 50*time.Millisecond {
+			t.Fatalf("flush %v after the boundary", off)
+		}
+	}
+
+	if _, err := NewStatsiteSinkFrom(listener.Addr().String(), StatsiteOpts{FlushAlignment: -time.Second}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrGoroutineLimit is returned by sink constructors when starting the
+// goroutine of the sink would exceed the limit set with SetGoroutineLimit
+var ErrGoroutineLimit = errors.New("metrics: goroutine limit reached")
+
+// goroutines counts the running goroutines started by the package and its
+// sinks, and goroutineLimit bounds those started by sinks if positive. Both
+// are accessed atomically.
+var goroutines, goroutineLimit int64
+
+// Goroutines returns the number of goroutines started by the package and its
+// sinks which are still running, such as flush loops and metric collectors
+func Goroutines() int {
+	return int(atomic.LoadInt64(&goroutines))
+}
+
+// SetGoroutineLimit bounds the goroutines counted by Goroutines. Once the
+// limit is reached, constructors of sinks which start a goroutine fail with
+// ErrGoroutineLimit, while running goroutines are unaffected. The collectors
+// of New and the goroutine of an InmemSignal are counted, but always
+// started. A limit of zero, the default, removes the bound.
+func SetGoroutineLimit(limit int) {
+	atomic.StoreInt64(&goroutineLimit, int64(limit))
+}
+
+// GoSink runs f in a new goroutine counted by Goroutines, or returns
+// ErrGoroutineLimit if the limit set with SetGoroutineLimit is reached. It
+// is meant for the goroutines of sinks, including those outside of this
+// package.
+func GoSink(f func()) error {
+	for {
+		n := atomic.LoadInt64(&goroutines)
+		if limit := atomic.LoadInt64(&goroutineLimit); limit > 0 && n >= limit {
+			return ErrGoroutineLimit
+		}
+		if atomic.CompareAndSwapInt64(&goroutines, n, n+1) {
+			break
+		}
+	}
+	go runCounted(f)
+	return nil
+}
+
+// goCounted runs f in a new goroutine counted by Goroutines, regardless of
+// the limit
+func goCounted(f func()) {
+	atomic.AddInt64(&goroutines, 1)
+	go runCounted(f)
+}
+
+func runCounted(f func()) {
+	defer atomic.AddInt64(&goroutines, -1)
+	f()
+}
+
+// Periodically emits the goroutine gauge
+func (m *Metrics) collectGoroutines() {
+	for {
+		time.Sleep(m.ProfileInterval)
+		m.EmitGoroutines()
+	}
+}
+
+// EmitGoroutines sets the metrics.goroutines gauge to the number of
+// goroutines started by the package and its sinks, see Goroutines
+func (m *Metrics) EmitGoroutines() {
+	m.SetGaugeInt([]string{"metrics", "goroutines"}, int64(Goroutines()))
+}
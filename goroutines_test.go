@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+// waitGoroutines polls until Goroutines returns at most n
+func waitGoroutines(t *testing.T, n int) {
+	deadline := time.Now().Add(time.Second)
+	for Goroutines() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines: %d, expected at most %d", Goroutines(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGoSink(t *testing.T) {
+	before := Goroutines()
+	release := make(chan struct{})
+	for j := 0; j < 3; j++ {
+		if err := GoSink(func() { <-release }); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if n := Goroutines(); n < before+3 {
+		t.Fatalf("bad goroutines: %d, started with %d", n, before)
+	}
+	close(release)
+	waitGoroutines(t, before)
+}
+
+func TestGoroutines_Sinks(t *testing.T) {
+	before := Goroutines()
+	statsd, err := NewStatsdSinkFrom("127.0.0.1:7524", StatsdOpts{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	statsite, err := NewStatsiteSinkFrom("127.0.0.1:7525", StatsiteOpts{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := Goroutines(); n < before+2 {
+		t.Fatalf("bad goroutines: %d, started with %d", n, before)
+	}
+
+	statsd.Shutdown()
+	statsite.Shutdown()
+	waitGoroutines(t, before)
+}
+
+func TestSetGoroutineLimit(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	if err := GoSink(func() { <-release }); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	SetGoroutineLimit(1)
+	defer SetGoroutineLimit(0)
+	if err := GoSink(func() {}); err != ErrGoroutineLimit {
+		t.Fatalf("expected limit error, got %v", err)
+	}
+	if _, err := NewStatsdSinkFrom("127.0.0.1:7524", StatsdOpts{}); err != ErrGoroutineLimit {
+		t.Fatalf("expected limit error, got %v", err)
+	}
+	if _, err := NewStatsiteSinkFrom("127.0.0.1:7525", StatsiteOpts{}); err != ErrGoroutineLimit {
+		t.Fatalf("expected limit error, got %v", err)
+	}
+
+	SetGoroutineLimit(0)
+	sink, err := NewStatsdSinkFrom("127.0.0.1:7524", StatsdOpts{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sink.Shutdown()
+}
+
+func TestMetrics_EmitGoroutines(t *testing.T) {
+	m, met := mockMetric()
+	release := make(chan struct{})
+	defer close(release)
+	if err := GoSink(func() { <-release }); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	met.EmitGoroutines()
+	if keys := m.getKeys(); len(keys) != 1 || keys[0][0] != "metrics" || keys[0][1] != "goroutines" {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	if m.vals[0] < 1 {
+		t.Fatalf("bad val: %v", m.vals[0])
+	}
+}
@@ -0,0 +1,418 @@
+package metrics
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/bits"
+)
+
+const (
+	// DefaultHDRSignificantDigits is the default number of significant
+	// decimal digits HDR histograms keep for every value
+	DefaultHDRSignificantDigits = 3
+
+	// DefaultHDRMaxValue is the default highest value HDR histograms track,
+	// an hour in milliseconds
+	DefaultHDRMaxValue = 3600000
+
+	// Cookies of the V2 encoding of HdrHistogram, with the word size bits
+	// used by the reference implementations
+	hdrEncodingCookie           = 0x1c849303 | 0x10
+	hdrCompressedEncodingCookie = 0x1c849304 | 0x10
+
+	// hdrHeaderSize is the size of the header of an uncompressed encoding
+	hdrHeaderSize = 40
+)
+
+// HDROpts configures the HDR histograms of an InmemSink
+type HDROpts struct {
+	// SignificantDigits is the number of significant decimal digits kept
+	// for every value, from 1 to 5. Each digit costs about ten times the
+	// memory. Defaults to DefaultHDRSignificantDigits.
+	SignificantDigits int
+
+	// MaxValue is the highest value tracked, after scaling. Higher values
+	// are recorded as MaxValue. Defaults to DefaultHDRMaxValue.
+	MaxValue int64
+
+	// Scale multiplies sample values before they are rounded to the integers
+	// HDR histograms record, e.g. 1000 to record millisecond samples with
+	// microsecond resolution. Defaults to 1.
+	Scale float64
+}
+
+// withDefaults returns o with its zero fields set to the defaults, or an
+// error if a field is invalid
+func (o HDROpts) withDefaults() (HDROpts, error) {
+	if o.SignificantDigits == 0 {
+		o.SignificantDigits = DefaultHDRSignificantDigits
+	}
+	if o.MaxValue == 0 {
+		o.MaxValue = DefaultHDRMaxValue
+	}
+	if o.Scale == 0 {
+		o.Scale = 1
+	}
+	if o.SignificantDigits < 1 || o.SignificantDigits > 5 {
+		return o, fmt.Errorf("significant digits must be from 1 to 5, got %d", o.SignificantDigits)
+	}
+	if o.MaxValue < 2 {
+		return o, fmt.Errorf("max value must be at least 2, got %d", o.MaxValue)
+	}
+	if !(o.Scale > 0) || math.IsInf(o.Scale, 0) {
+		return o, fmt.Errorf("invalid scale %v", o.Scale)
+	}
+	return o, nil
+}
+
+// HDRHistogram is a high dynamic range histogram of integer values, which
+// records every value with a fixed number of significant digits at a memory
+// cost that grows with the logarithm of the values. It follows the bucket
+// layout of HdrHistogram, so histograms are mergeable and their encoded form
+// can be imported into HdrHistogram tooling. Use NewHDRHistogram to create
+// one. It is not safe for concurrent use.
+type HDRHistogram struct {
+	lowest            int64
+	highest           int64
+	significantDigits int
+
+	unitMagnitude               uint
+	subBucketHalfCountMagnitude uint
+	subBucketHalfCount          int
+	subBucketMask               int64
+
+	// counts grows as higher values are recorded, up to the index of highest
+	counts     []int64
+	totalCount int64
+}
+
+// NewHDRHistogram creates an HDRHistogram tracking values from 1 to highest
+// with significantDigits significant decimal digits, from 1 to 5
+func NewHDRHistogram(highest int64, significantDigits int) (*HDRHistogram, error) {
+	return newHDRHistogram(1, highest, significantDigits)
+}
+
+func newHDRHistogram(lowest, highest int64, significantDigits int) (*HDRHistogram, error) {
+	if lowest < 1 {
+		return nil, fmt.Errorf("lowest value must be at least 1, got %d", lowest)
+	}
+	if highest < 2*lowest {
+		return nil, fmt.Errorf("highest value must be at least twice the lowest, got %d", highest)
+	}
+	if significantDigits < 1 || significantDigits > 5 {
+		return nil, fmt.Errorf("significant digits must be from 1 to 5, got %d", significantDigits)
+	}
+
+	largestSingleUnit := 2 * math.Pow10(significantDigits)
+	subBucketCountMagnitude := uint(math.Ceil(math.Log2(largestSingleUnit)))
+	h := &HDRHistogram{
+		lowest:                      lowest,
+		highest:                     highest,
+		significantDigits:           significantDigits,
+		unitMagnitude:               uint(math.Floor(math.Log2(float64(lowest)))),
+		subBucketHalfCountMagnitude: subBucketCountMagnitude - 1,
+	}
+	h.subBucketHalfCount = 1 << h.subBucketHalfCountMagnitude
+	h.subBucketMask = int64(2*h.subBucketHalfCount-1) << h.unitMagnitude
+	return h, nil
+}
+
+// RecordValue records v, which must be from zero to the highest value
+func (h *HDRHistogram) RecordValue(v int64) error {
+	return h.RecordValues(v, 1)
+}
+
+// RecordValues records n occurrences of v
+func (h *HDRHistogram) RecordValues(v, n int64) error {
+	if v < 0 || v > h.highest {
+		return fmt.Errorf("value %d is out of the range 0 to %d", v, h.highest)
+	}
+	idx := h.countsIndex(v)
+	if idx >= len(h.counts) {
+		h.grow(idx + 1)
+	}
+	h.counts[idx] += n
+	h.totalCount += n
+	return nil
+}
+
+// recordScaled records a sample value multiplied by scale, rounded and
+// clamped to the tracked range
+func (h *HDRHistogram) recordScaled(v, scale float64) {
+	scaled := math.Round(v * scale)
+	switch {
+	case math.IsNaN(scaled):
+		return
+	case scaled < 0:
+		scaled = 0
+	case scaled > float64(h.highest):
+		scaled = float64(h.highest)
+	}
+	h.RecordValue(int64(scaled))
+}
+
+// TotalCount returns the number of recorded values
+func (h *HDRHistogram) TotalCount() int64 {
+	return h.totalCount
+}
+
+// ValueAtQuantile returns the highest value equivalent to the q-th quantile
+// of the recorded values, where q is in the range [0, 1]. It returns zero if
+// no values were recorded.
+func (h *HDRHistogram) ValueAtQuantile(q float64) int64 {
+	if q > 1 {
+		q = 1
+	}
+	target := int64(q*float64(h.totalCount) + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	var total int64
+	for idx, count := range h.counts {
+		total += count
+		if total >= target {
+			return h.highestEquivalentValue(h.valueFromIndex(idx))
+		}
+	}
+	return 0
+}
+
+// Merge adds the values recorded by other, which must have the same lowest
+// value and significant digits. Values above the highest value of h are
+// recorded as the highest value.
+func (h *HDRHistogram) Merge(other *HDRHistogram) error {
+	if other.lowest != h.lowest || other.significantDigits != h.significantDigits {
+		return fmt.Errorf("histograms have different layouts")
+	}
+	for idx, count := range other.counts {
+		if count == 0 {
+			continue
+		}
+		v := other.valueFromIndex(idx)
+		if v > h.highest {
+			v = h.highest
+		}
+		h.RecordValues(v, count)
+	}
+	return nil
+}
+
+// Copy returns a copy of h
+func (h *HDRHistogram) Copy() *HDRHistogram {
+	c := *h
+	c.counts = append([]int64(nil), h.counts...)
+	return &c
+}
+
+// Encode returns the compressed V2 encoding of HdrHistogram in base64, as
+// used by HdrHistogram logs and decoded by e.g. Histogram.fromString of
+// HdrHistogram.js or decodeFromCompressedByteBuffer of the Java library.
+func (h *HDRHistogram) Encode() (string, error) {
+	payload := &bytes.Buffer{}
+	var varint [9]byte
+	limit := len(h.counts)
+	for limit > 0 && h.counts[limit-1] == 0 {
+		limit--
+	}
+	for idx := 0; idx < limit; {
+		count := h.counts[idx]
+		idx++
+		if count == 0 {
+			// Runs of zeros are encoded as their negated length
+			zeros := int64(1)
+			for idx < limit && h.counts[idx] == 0 {
+				zeros++
+				idx++
+			}
+			if zeros > 1 {
+				count = -zeros
+			}
+		}
+		payload.Write(varint[:putZigZag(varint[:], count)])
+	}
+
+	raw := &bytes.Buffer{}
+	header := []interface{}{
+		int32(hdrEncodingCookie),
+		int32(payload.Len()),
+		int32(0), // normalizing index offset
+		int32(h.significantDigits),
+		h.lowest,
+		h.highest,
+		float64(1), // integer to double conversion ratio
+	}
+	for _, field := range header {
+		binary.Write(raw, binary.BigEndian, field)
+	}
+	raw.Write(payload.Bytes())
+
+	compressed := &bytes.Buffer{}
+	w := zlib.NewWriter(compressed)
+	if _, err := w.Write(raw.Bytes()); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	out := &bytes.Buffer{}
+	binary.Write(out, binary.BigEndian, int32(hdrCompressedEncodingCookie))
+	binary.Write(out, binary.BigEndian, int32(compressed.Len()))
+	out.Write(compressed.Bytes())
+	return base64.StdEncoding.EncodeToString(out.Bytes()), nil
+}
+
+// DecodeHDRHistogram decodes a histogram from the base64 compressed V2
+// encoding of HdrHistogram, as returned by Encode
+func DecodeHDRHistogram(encoded string) (*HDRHistogram, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 {
+		return nil, fmt.Errorf("encoded histogram is too short")
+	}
+	if cookie := binary.BigEndian.Uint32(data); cookie&^0xf0 != hdrCompressedEncodingCookie&^0xf0 {
+		return nil, fmt.Errorf("unknown compressed encoding cookie %#x", cookie)
+	}
+	length := int(binary.BigEndian.Uint32(data[4:]))
+	if length < 0 || length > len(data)-8 {
+		return nil, fmt.Errorf("bad compressed length %d", length)
+	}
+	r, err := zlib.NewReader(bytes.NewReader(data[8 : 8+length]))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) < hdrHeaderSize {
+		return nil, fmt.Errorf("encoded histogram is too short")
+	}
+	if cookie := binary.BigEndian.Uint32(raw); cookie&^0xf0 != hdrEncodingCookie&^0xf0 {
+		return nil, fmt.Errorf("unknown encoding cookie %#x", cookie)
+	}
+	payloadLen := int(binary.BigEndian.Uint32(raw[4:]))
+	if offset := binary.BigEndian.Uint32(raw[8:]); offset != 0 {
+		return nil, fmt.Errorf("normalizing index offsets are not supported")
+	}
+	digits := int(binary.BigEndian.Uint32(raw[12:]))
+	lowest := int64(binary.BigEndian.Uint64(raw[16:]))
+	highest := int64(binary.BigEndian.Uint64(raw[24:]))
+	if payloadLen < 0 || payloadLen > len(raw)-hdrHeaderSize {
+		return nil, fmt.Errorf("bad payload length %d", payloadLen)
+	}
+
+	h, err := newHDRHistogram(lowest, highest, digits)
+	if err != nil {
+		return nil, err
+	}
+	payload := raw[hdrHeaderSize : hdrHeaderSize+payloadLen]
+	maxLen := h.countsIndex(highest) + 1
+	for idx := 0; len(payload) > 0; {
+		count, n := zigZag(payload)
+		if n == 0 {
+			return nil, fmt.Errorf("truncated payload")
+		}
+		payload = payload[n:]
+		if count < 0 {
+			idx += int(-count)
+			continue
+		}
+		if idx >= maxLen {
+			return nil, fmt.Errorf("payload exceeds the highest value")
+		}
+		if idx >= len(h.counts) {
+			h.grow(idx + 1)
+		}
+		h.counts[idx] = count
+		h.totalCount += count
+		idx++
+	}
+	return h, nil
+}
+
+// grow extends counts to n entries
+func (h *HDRHistogram) grow(n int) {
+	if n <= cap(h.counts) {
+		h.counts = h.counts[:n]
+		return
+	}
+	// Grow by whole buckets, as values tend to cluster
+	size := ((n >> h.subBucketHalfCountMagnitude) + 1) << h.subBucketHalfCountMagnitude
+	counts := make([]int64, n, size)
+	copy(counts, h.counts)
+	h.counts = counts
+}
+
+// countsIndex returns the index of the count of v
+func (h *HDRHistogram) countsIndex(v int64) int {
+	pow2Ceiling := 64 - bits.LeadingZeros64(uint64(v|h.subBucketMask))
+	bucket := pow2Ceiling - int(h.unitMagnitude) - int(h.subBucketHalfCountMagnitude+1)
+	subBucket := int(v >> (uint(bucket) + h.unitMagnitude))
+	return ((bucket + 1) << h.subBucketHalfCountMagnitude) + subBucket - h.subBucketHalfCount
+}
+
+// valueFromIndex returns the lowest value counted at idx
+func (h *HDRHistogram) valueFromIndex(idx int) int64 {
+	bucket := (idx >> h.subBucketHalfCountMagnitude) - 1
+	subBucket := (idx & (h.subBucketHalfCount - 1)) + h.subBucketHalfCount
+	if bucket < 0 {
+		subBucket -= h.subBucketHalfCount
+		bucket = 0
+	}
+	return int64(subBucket) << (uint(bucket) + h.unitMagnitude)
+}
+
+// highestEquivalentValue returns the highest value counted together with v
+func (h *HDRHistogram) highestEquivalentValue(v int64) int64 {
+	pow2Ceiling := 64 - bits.LeadingZeros64(uint64(v|h.subBucketMask))
+	bucket := pow2Ceiling - int(h.unitMagnitude) - int(h.subBucketHalfCountMagnitude+1)
+	lowest := h.valueFromIndex(h.countsIndex(v))
+	return lowest + (int64(1) << (uint(bucket) + h.unitMagnitude)) - 1
+}
+
+// putZigZag writes v in the ZigZag LEB128 format of HdrHistogram, which
+// uses at most 9 bytes with all 8 bits of the last one, and returns the
+// number of bytes written
+func putZigZag(buf []byte, v int64) int {
+	u := uint64(v<<1) ^ uint64(v>>63)
+	for n := 0; n < 8; n++ {
+		if u>>7 == 0 {
+			buf[n] = byte(u)
+			return n + 1
+		}
+		buf[n] = byte(u&0x7f) | 0x80
+		u >>= 7
+	}
+	buf[8] = byte(u)
+	return 9
+}
+
+// zigZag reads a value written by putZigZag and returns it with the number
+// of bytes read, which is zero if buf is truncated
+func zigZag(buf []byte) (int64, int) {
+	var u uint64
+	for n := 0; n < 9; n++ {
+		if n >= len(buf) {
+			return 0, 0
+		}
+		b := buf[n]
+		if n == 8 {
+			u |= uint64(b) << 56
+			return int64(u>>1) ^ -int64(u&1), 9
+		}
+		u |= uint64(b&0x7f) << (7 * uint(n))
+		if b&0x80 == 0 {
+			return int64(u>>1) ^ -int64(u&1), n + 1
+		}
+	}
+	return 0, 0
+}
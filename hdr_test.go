@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHDRHistogram_Record(t *testing.T) {
+	h, err := NewHDRHistogram(3600000, 3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for v := int64(1); v <= 10000; v++ {
+		if err := h.RecordValue(v); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := h.RecordValue(3600001); err == nil {
+		t.Fatalf("expected error above the highest value")
+	}
+	if err := h.RecordValue(-1); err == nil {
+		t.Fatalf("expected error for a negative value")
+	}
+	if h.TotalCount() != 10000 {
+		t.Fatalf("bad count: %d", h.TotalCount())
+	}
+
+	// Quantiles are accurate to three significant digits
+	for q, expect := range map[float64]float64{0.5: 5000, 0.9: 9000, 0.99: 9900, 1: 10000} {
+		got := float64(h.ValueAtQuantile(q))
+		if math.Abs(got-expect)/expect > 0.001 {
+			t.Fatalf("bad p%v: %v", q*100, got)
+		}
+	}
+
+	// Values below 2048 are recorded exactly
+	exact, _ := NewHDRHistogram(100000, 3)
+	exact.RecordValue(0)
+	exact.RecordValue(1234)
+	exact.RecordValue(1234)
+	if got := exact.ValueAtQuantile(0.9); got != 1234 {
+		t.Fatalf("bad quantile: %d", got)
+	}
+	if got := exact.ValueAtQuantile(0.1); got != 0 {
+		t.Fatalf("bad quantile: %d", got)
+	}
+
+	for _, args := range [][2]int64{{1, 3}, {100, 0}, {100, 6}} {
+		if _, err := NewHDRHistogram(args[0], int(args[1])); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+func TestHDRHistogram_Merge(t *testing.T) {
+	a, _ := NewHDRHistogram(100000, 2)
+	b, _ := NewHDRHistogram(1000, 2)
+	a.RecordValue(10)
+	b.RecordValue(20)
+	b.RecordValue(900)
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// Quantiles report the highest value equivalent at two digits
+	if max := a.ValueAtQuantile(1); a.TotalCount() != 3 || max < 900 || max > 909 {
+		t.Fatalf("bad merge: %d %d", a.TotalCount(), a.ValueAtQuantile(1))
+	}
+
+	// Higher values are clamped to the highest value
+	small, _ := NewHDRHistogram(100, 2)
+	if err := small.Merge(a); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if small.TotalCount() != 3 || small.ValueAtQuantile(1) != 100 {
+		t.Fatalf("bad merge: %d %d", small.TotalCount(), small.ValueAtQuantile(1))
+	}
+
+	other, _ := NewHDRHistogram(100000, 3)
+	if err := a.Merge(other); err == nil {
+		t.Fatalf("expected error for different significant digits")
+	}
+}
+
+func TestHDRHistogram_EncodeRoundTrip(t *testing.T) {
+	h, _ := NewHDRHistogram(3600000, 3)
+	for _, v := range []int64{0, 1, 1, 7, 2047, 2048, 100000, 3599999} {
+		h.RecordValue(v)
+	}
+	h.RecordValues(42, 1<<40)
+
+	encoded, err := h.Encode()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	decoded, err := DecodeHDRHistogram(encoded)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if decoded.TotalCount() != h.TotalCount() || decoded.highest != h.highest || decoded.significantDigits != 3 {
+		t.Fatalf("bad histogram: %+v", decoded)
+	}
+	if !reflect.DeepEqual(decoded.counts, h.counts[:len(decoded.counts)]) {
+		t.Fatalf("bad counts")
+	}
+	for _, q := range []float64{0, 0.5, 0.9, 0.999, 1} {
+		if decoded.ValueAtQuantile(q) != h.ValueAtQuantile(q) {
+			t.Fatalf("bad quantile %v", q)
+		}
+	}
+
+	// The encoding has the layout of HdrHistogram
+	data, _ := base64.StdEncoding.DecodeString(encoded)
+	if cookie := binary.BigEndian.Uint32(data); cookie != 0x1c849314 {
+		t.Fatalf("bad compressed cookie %#x", cookie)
+	}
+	r, err := zlib.NewReader(bytes.NewReader(data[8:]))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	raw, _ := ioutil.ReadAll(r)
+	if cookie := binary.BigEndian.Uint32(raw); cookie != 0x1c849313 {
+		t.Fatalf("bad cookie %#x", cookie)
+	}
+	if got := binary.BigEndian.Uint32(raw[4:]); int(got) != len(raw)-hdrHeaderSize {
+		t.Fatalf("bad payload length %d", got)
+	}
+	if lowest := binary.BigEndian.Uint64(raw[16:]); lowest != 1 {
+		t.Fatalf("bad lowest value %d", lowest)
+	}
+	if ratio := math.Float64frombits(binary.BigEndian.Uint64(raw[32:])); ratio != 1 {
+		t.Fatalf("bad conversion ratio %v", ratio)
+	}
+
+	// An empty histogram round-trips too
+	empty, _ := NewHDRHistogram(1000, 1)
+	encoded, _ = empty.Encode()
+	if decoded, err := DecodeHDRHistogram(encoded); err != nil || decoded.TotalCount() != 0 {
+		t.Fatalf("bad empty histogram: %v", err)
+	}
+
+	for _, bad := range []string{"not base64!", "AAAA", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if _, err := DecodeHDRHistogram(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestZigZag(t *testing.T) {
+	buf := make([]byte, 9)
+	for _, v := range []int64{0, 1, -1, 63, -64, 64, 1 << 20, -(1 << 40), math.MaxInt64, math.MinInt64} {
+		n := putZigZag(buf, v)
+		got, read := zigZag(buf[:n])
+		if got != v || read != n {
+			t.Fatalf("bad round trip of %d: %d (%d of %d bytes)", v, got, read, n)
+		}
+	}
+
+	// Small values take a byte, with the sign in the lowest bit
+	if n := putZigZag(buf, -2); n != 1 || buf[0] != 3 {
+		t.Fatalf("bad encoding: %v", buf[:n])
+	}
+	if _, n := zigZag([]byte{0x80}); n != 0 {
+		t.Fatalf("expected truncated value")
+	}
+}
+
+func TestInmemSink_HDRHistograms(t *testing.T) {
+	inm := NewInmemSink(time.Hour, time.Hour)
+	if err := inm.EnableHDRHistograms(HDROpts{SignificantDigits: 6}); err == nil {
+		t.Fatalf("expected error for significant digits")
+	}
+	if err := inm.EnableHDRHistograms(HDROpts{Scale: -1}); err == nil {
+		t.Fatalf("expected error for scale")
+	}
+	if err := inm.EnableHDRHistograms(HDROpts{Scale: 1000}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for v := 1; v <= 100; v++ {
+		inm.AddSample([]string{"latency"}, float32(v)/10)
+	}
+	inm.AddSample([]string{"latency"}, -1)
+	inm.IncrCounter([]string{"counter"}, 1)
+
+	raw, err := inm.DisplayMetrics(nil, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	summary := raw.(MetricsSummary)
+	if len(summary.Counters) != 1 || summary.Counters[0].HDRHistogram != "" {
+		t.Fatalf("counters should not have histograms: %v", summary.Counters)
+	}
+	h, err := DecodeHDRHistogram(summary.Samples[0].HDRHistogram)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Values are scaled, and negative values clamped to zero
+	if h.TotalCount() != 101 || h.ValueAtQuantile(0) != 0 {
+		t.Fatalf("bad histogram: %d %d", h.TotalCount(), h.ValueAtQuantile(0))
+	}
+	if p99 := h.ValueAtQuantile(0.99); p99 < 9895 || p99 > 9905 {
+		t.Fatalf("bad p99: %d", p99)
+	}
+
+	// Histograms merge across windows
+	data := inm.Data()
+	merged := mergeIntervals(data)
+	if got := merged.Samples["latency"].HDR().TotalCount(); got != 101 {
+		t.Fatalf("bad merged count: %d", got)
+	}
+}
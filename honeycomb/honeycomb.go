@@ -0,0 +1,375 @@
+// Package honeycomb provides a MetricSink which sends every emission as an
+// event to a Honeycomb dataset through the batch events API, so metrics can
+// be queried and correlated with the traces of the same dataset.
+package honeycomb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	// DefaultAPIHost is the Honeycomb API host for US teams
+	DefaultAPIHost = "https://api.honeycomb.io"
+
+	// DefaultBatchSize is the number of pending events which triggers a
+	// flush
+	DefaultBatchSize = 500
+
+	// DefaultFlushInterval is how often pending events are flushed
+	DefaultFlushInterval = 10 * time.Second
+
+	// DefaultSendTimeout bounds the duration of each request
+	DefaultSendTimeout = 10 * time.Second
+)
+
+// Event types, as sent in the type field
+const (
+	TypeGauge   = "gauge"
+	TypeCounter = "counter"
+	TypeSample  = "sample"
+	TypeKey     = "key"
+)
+
+// HoneycombOpts is used to configure the HoneycombSink
+type HoneycombOpts struct {
+	// WriteKey is the API key sent with every request. Required.
+	WriteKey string
+
+	// Dataset is the dataset events are sent to. Required.
+	Dataset string
+
+	// APIHost is the URL of the Honeycomb API. Defaults to DefaultAPIHost,
+	// EU teams must use https://api.eu1.honeycomb.io instead.
+	APIHost string
+
+	// BatchSize is the number of pending events which triggers a flush, and
+	// the maximum number of events per request. Defaults to
+	// DefaultBatchSize.
+	BatchSize int
+
+	// FlushInterval is how often pending events are flushed, so events are
+	// sent timely even when few are emitted. Defaults to
+	// DefaultFlushInterval.
+	FlushInterval time.Duration
+
+	// SendTimeout bounds each request. Defaults to DefaultSendTimeout.
+	SendTimeout time.Duration
+
+	// MaxPending is the number of events buffered while requests are slow
+	// or failing. Events emitted while the buffer is full are dropped.
+	// Defaults to ten times BatchSize.
+	MaxPending int
+
+	// Client is the HTTP client used to send requests. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	// ErrorLog is used to log failed flushes. Defaults to a FailureLogger
+	// from metrics.NewFailureLogger.
+	ErrorLog *metrics.FailureLogger
+}
+
+// HoneycombSink provides a MetricSink that buffers every emission as an
+// event and sends the events in batches, once BatchSize events are pending
+// or every FlushInterval. Each event carries the fields "name", "value" and
+// "type", one of the Type constants, and a field per label. Labels named
+// like one of the fields are overridden by it. Emissions are not
+// aggregated. Events of a failed request, and events Honeycomb rejects, are
+// dropped.
+type HoneycombSink struct {
+	// dropped, errors and offset are accessed atomically and kept first to
+	// guarantee 64-bit alignment
+	dropped uint64
+	errors  uint64
+	offset  int64 // time.Duration added to timestamps
+
+	opts     HoneycombOpts
+	endpoint string
+
+	lock    sync.Mutex
+	pending []event
+
+	// flushLock serializes flushes, so batches are sent in order
+	flushLock sync.Mutex
+
+	flushChan chan struct{}
+	stopChan  chan struct{}
+	doneChan  chan struct{}
+	stopOnce  sync.Once
+}
+
+// event is an event of the batch events API
+type event struct {
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// eventStatus is the response of the batch events API for an event
+type eventStatus struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// NewHoneycombSink creates a HoneycombSink and starts flushing it. Call
+// Shutdown to send the remaining events and stop.
+func NewHoneycombSink(opts HoneycombOpts) (*HoneycombSink, error) {
+	if opts.WriteKey == "" {
+		return nil, fmt.Errorf("write key is required")
+	}
+	if opts.Dataset == "" {
+		return nil, fmt.Errorf("dataset is required")
+	}
+	if opts.APIHost == "" {
+		opts.APIHost = DefaultAPIHost
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.SendTimeout <= 0 {
+		opts.SendTimeout = DefaultSendTimeout
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = 10 * opts.BatchSize
+	}
+	if opts.MaxPending < opts.BatchSize {
+		return nil, fmt.Errorf("max pending %d is below the batch size %d", opts.MaxPending, opts.BatchSize)
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.ErrorLog == nil {
+		opts.ErrorLog = metrics.NewFailureLogger()
+	}
+
+	host, err := url.Parse(opts.APIHost)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := host.ResolveReference(&url.URL{Path: "/1/batch/" + opts.Dataset})
+
+	s := &HoneycombSink{
+		opts:      opts,
+		endpoint:  endpoint.String(),
+		flushChan: make(chan struct{}, 1),
+		stopChan:  make(chan struct{}),
+		doneChan:  make(chan struct{}),
+	}
+	if err := metrics.GoSink(s.flushMetrics); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Shutdown stops the periodic flush and sends the remaining events. It is
+// safe to call more than once.
+func (s *HoneycombSink) Shutdown() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	<-s.doneChan
+	if err := s.Flush(); err != nil {
+		s.opts.ErrorLog.Printf("[ERR] Error sending to Honeycomb! Err: %s", err)
+	}
+}
+
+// Flush sends the pending events, in batches of at most BatchSize events.
+func (s *HoneycombSink) Flush() error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	s.lock.Lock()
+	events := s.pending
+	s.pending = nil
+	s.lock.Unlock()
+
+	var firstErr error
+	for len(events) > 0 {
+		n := len(events)
+		if n > s.opts.BatchSize {
+			n = s.opts.BatchSize
+		}
+		if err := s.send(events[:n]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		events = events[n:]
+	}
+	return firstErr
+}
+
+// SetTimestampOffset adds offset to the times of later events, as described
+// by metrics.TimestampSink
+func (s *HoneycombSink) SetTimestampOffset(offset time.Duration) {
+	atomic.StoreInt64(&s.offset, int64(offset))
+}
+
+// SinkStats returns the number of events dropped because the buffer was
+// full, their request failed or they were rejected, and the number of failed
+// requests.
+func (s *HoneycombSink) SinkStats() metrics.SinkStats {
+	return metrics.SinkStats{
+		Dropped: atomic.LoadUint64(&s.dropped),
+		Errors:  atomic.LoadUint64(&s.errors),
+	}
+}
+
+func (s *HoneycombSink) flushMetrics() {
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+	defer close(s.doneChan)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.flushChan:
+		case <-s.stopChan:
+			return
+		}
+		if err := s.Flush(); err != nil {
+			s.opts.ErrorLog.Printf("[ERR] Error sending to Honeycomb! Err: %s", err)
+		}
+	}
+}
+
+// send posts a single batch, counting the events Honeycomb rejects as
+// dropped
+func (s *HoneycombSink) send(events []event) error {
+	statuses, err := s.post(events)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		atomic.AddUint64(&s.dropped, uint64(len(events)))
+		return err
+	}
+
+	var rejected uint64
+	var firstErr string
+	for _, status := range statuses {
+		if status.Status < 200 || status.Status >= 300 {
+			rejected++
+			if firstErr == "" {
+				firstErr = status.Error
+			}
+		}
+	}
+	if rejected > 0 {
+		atomic.AddUint64(&s.dropped, rejected)
+		return fmt.Errorf("%d of %d events rejected: %s", rejected, len(events), firstErr)
+	}
+	return nil
+}
+
+func (s *HoneycombSink) post(events []event) ([]eventStatus, error) {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.SendTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Honeycomb-Team", s.opts.WriteKey)
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var statuses []eventStatus
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		return nil, fmt.Errorf("bad response: %v", err)
+	}
+	return statuses, nil
+}
+
+// add buffers an event, waking up the flush loop once a batch is pending.
+// Events with a NaN or infinite value can't be encoded and are dropped.
+func (s *HoneycombSink) add(key []string, val float32, labels []metrics.Label, typ string) {
+	if math.IsNaN(float64(val)) || math.IsInf(float64(val), 0) {
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+
+	data := make(map[string]interface{}, len(labels)+3)
+	for _, label := range labels {
+		data[label.Name] = label.Value
+	}
+	data["name"] = strings.Join(key, ".")
+	data["value"] = float64(val)
+	data["type"] = typ
+	ev := event{
+		Time: time.Now().Add(time.Duration(atomic.LoadInt64(&s.offset))),
+		Data: data,
+	}
+
+	s.lock.Lock()
+	if len(s.pending) >= s.opts.MaxPending {
+		s.lock.Unlock()
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+	s.pending = append(s.pending, ev)
+	full := len(s.pending) >= s.opts.BatchSize
+	s.lock.Unlock()
+
+	if full {
+		select {
+		case s.flushChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Implementation of methods in the MetricSink interface
+
+func (s *HoneycombSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *HoneycombSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.add(key, val, labels, TypeGauge)
+}
+
+func (s *HoneycombSink) EmitKey(key []string, val float32) {
+	s.add(key, val, nil, TypeKey)
+}
+
+func (s *HoneycombSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *HoneycombSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.add(key, val, labels, TypeCounter)
+}
+
+func (s *HoneycombSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *HoneycombSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.add(key, val, labels, TypeSample)
+}
@@ -0,0 +1,253 @@
+package honeycomb
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// receivedEvent is an event as decoded by the fake endpoint
+type receivedEvent struct {
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// fakeEndpoint is a batch events API recording the events it receives. The
+// first failures requests are answered with status, and events with the
+// name reject are rejected.
+type fakeEndpoint struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	requests  int
+	failures  int
+	status    int
+	paths     []string
+	writeKeys []string
+	received  []receivedEvent
+}
+
+func newFakeEndpoint(t *testing.T) *fakeEndpoint {
+	f := &fakeEndpoint{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		f.requests++
+		f.paths = append(f.paths, r.URL.Path)
+		f.writeKeys = append(f.writeKeys, r.Header.Get("X-Honeycomb-Team"))
+		if f.failures > 0 {
+			f.failures--
+			w.WriteHeader(f.status)
+			return
+		}
+		var events []receivedEvent
+		if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+			t.Errorf("bad body: %v", err)
+		}
+		statuses := make([]eventStatus, len(events))
+		for i, ev := range events {
+			if ev.Data["name"] == "reject" {
+				statuses[i] = eventStatus{Status: http.StatusBadRequest, Error: "rejected"}
+				continue
+			}
+			statuses[i] = eventStatus{Status: http.StatusAccepted}
+			f.received = append(f.received, ev)
+		}
+		json.NewEncoder(w).Encode(statuses)
+	}))
+	return f
+}
+
+func (f *fakeEndpoint) take() []receivedEvent {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	events := f.received
+	f.received = nil
+	return events
+}
+
+func (f *fakeEndpoint) getRequests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+func testSink(t *testing.T, opts HoneycombOpts) *HoneycombSink {
+	if opts.WriteKey == "" {
+		opts.WriteKey = "secret"
+	}
+	if opts.Dataset == "" {
+		opts.Dataset = "my metrics"
+	}
+	opts.FlushInterval = time.Hour
+	sink, err := NewHoneycombSink(opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return sink
+}
+
+func TestNewHoneycombSink_Invalid(t *testing.T) {
+	for _, opts := range []HoneycombOpts{
+		{Dataset: "d"},
+		{WriteKey: "k"},
+		{WriteKey: "k", Dataset: "d", BatchSize: 10, MaxPending: 5},
+	} {
+		if _, err := NewHoneycombSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
+
+func TestHoneycombSink_Events(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, HoneycombOpts{APIHost: f.URL})
+	defer sink.Shutdown()
+
+	start := time.Now()
+	labels := []metrics.Label{{Name: "region", Value: "west"}, {Name: "type", Value: "ignored"}}
+	sink.SetGauge([]string{"a", "gauge"}, 1)
+	sink.IncrCounterWithLabels([]string{"b", "counter"}, 2, labels)
+	sink.IncrCounterWithLabels([]string{"b", "counter"}, 3, labels)
+	sink.AddSample([]string{"c", "sample"}, 4)
+	sink.EmitKey([]string{"d", "kv"}, 5)
+
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if f.getRequests() != 1 || f.paths[0] != "/1/batch/my metrics" || f.writeKeys[0] != "secret" {
+		t.Fatalf("bad requests: %d %v %v", f.requests, f.paths, f.writeKeys)
+	}
+
+	// Events are sent as emitted, without aggregation
+	events := f.take()
+	expect := []map[string]interface{}{
+		{"name": "a.gauge", "value": 1.0, "type": "gauge"},
+		{"name": "b.counter", "value": 2.0, "type": "counter", "region": "west"},
+		{"name": "b.counter", "value": 3.0, "type": "counter", "region": "west"},
+		{"name": "c.sample", "value": 4.0, "type": "sample"},
+		{"name": "d.kv", "value": 5.0, "type": "key"},
+	}
+	var data []map[string]interface{}
+	for _, ev := range events {
+		if ev.Time.Before(start.Truncate(time.Millisecond)) || ev.Time.After(time.Now()) {
+			t.Fatalf("bad time: %v", ev.Time)
+		}
+		data = append(data, ev.Data)
+	}
+	if !reflect.DeepEqual(data, expect) {
+		t.Fatalf("bad events:\n%v\nexpected:\n%v", data, expect)
+	}
+
+	// Nothing is sent when there is nothing new
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if f.getRequests() != 1 {
+		t.Fatalf("bad requests: %d", f.getRequests())
+	}
+}
+
+func TestHoneycombSink_BatchSize(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, HoneycombOpts{APIHost: f.URL, BatchSize: 2})
+	defer sink.Shutdown()
+
+	// A full batch wakes up the flush loop
+	sink.IncrCounter([]string{"a"}, 1)
+	sink.IncrCounter([]string{"a"}, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for f.getRequests() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch was not flushed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		sink.AddSample([]string{"b"}, 1)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := len(f.take()); n != 5 {
+		t.Fatalf("bad events: %d", n)
+	}
+}
+
+func TestHoneycombSink_Failures(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	f.failures, f.status = 1, http.StatusUnauthorized
+	sink := testSink(t, HoneycombOpts{APIHost: f.URL, BatchSize: 10, MaxPending: 10})
+	defer sink.Shutdown()
+
+	sink.IncrCounter([]string{"a"}, 1)
+	if err := sink.Flush(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if stats := sink.SinkStats(); stats.Errors != 1 || stats.Dropped != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+
+	// Rejected events and values which can't be encoded are dropped,
+	// without failing the request
+	sink.IncrCounter([]string{"reject"}, 1)
+	sink.IncrCounter([]string{"a"}, float32(math.Inf(1)))
+	sink.IncrCounter([]string{"a"}, 1)
+	if err := sink.Flush(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if stats := sink.SinkStats(); stats.Errors != 1 || stats.Dropped != 3 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+	if n := len(f.take()); n != 1 {
+		t.Fatalf("bad events: %d", n)
+	}
+}
+
+func TestHoneycombSink_TimestampOffset(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, HoneycombOpts{APIHost: f.URL})
+	defer sink.Shutdown()
+
+	var _ metrics.TimestampSink = sink
+	sink.SetTimestampOffset(time.Hour)
+	before := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	sink.SetGauge([]string{"a"}, 1)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if events := f.take(); len(events) != 1 || events[0].Time.Before(before) {
+		t.Fatalf("bad events: %+v", events)
+	}
+}
+
+func TestHoneycombSink_ShutdownFlushes(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, HoneycombOpts{APIHost: f.URL})
+
+	sink.IncrCounter([]string{"a"}, 1)
+	sink.Shutdown()
+	if n := len(f.take()); n != 1 {
+		t.Fatalf("bad events: %d", n)
+	}
+
+	// Shutting down again sends nothing more
+	sink.Shutdown()
+	if n := len(f.take()); n != 0 {
+		t.Fatalf("bad events: %d", n)
+	}
+}
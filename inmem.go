@@ -4,14 +4,21 @@ import (
 	"bytes"
 	"fmt"
 	"math"
+	"math/rand"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var spaceReplacer = strings.NewReplacer(" ", "_")
 
+// DefaultMaxRetainedSamples is the number of raw sample values retained per
+// key and interval when sample retention is enabled without an explicit cap.
+const DefaultMaxRetainedSamples = 1028
+
 // InmemSink provides a MetricSink that does in-memory aggregation
 // without sending metrics over a network. It can be embedded within
 // an application to provide profiling information.
@@ -26,11 +33,74 @@ type InmemSink struct {
 	// It is retain / interval.
 	maxIntervals int
 
-	// intervals is a slice of the retained intervals
+	// grace is how long intervals stay queryable after rolling off the
+	// retain window, before they are freed. Zero frees them right away.
+	grace time.Duration
+
+	// intervals is a slice of the retained intervals, followed by those
+	// still within grace
 	intervals    []*IntervalMetrics
 	intervalLock sync.RWMutex
 
 	rateDenom float64
+
+	// maxSamples is the number of raw values retained per sample key and
+	// interval for computing quantiles. Zero disables retention.
+	maxSamples int
+
+	// hdr configures HDR histograms of samples, which are disabled if nil
+	hdr *HDROpts
+
+	// bucketBounds are the upper bounds of the bucket histograms of samples,
+	// which are disabled if nil
+	bucketBounds []float64
+
+	// counterTTL is how long a counter keeps appearing in new intervals,
+	// with a zero value, after it was last incremented. Zero disables it.
+	counterTTL time.Duration
+
+	// compactMax is the number of metrics up to which an ended interval is
+	// compacted, if compact is set
+	compact    bool
+	compactMax int
+
+	// derivedRules are evaluated for every interval when it ends
+	derivedRules []DerivedRule
+
+	// counterAlerts are checked for every interval when it ends
+	counterAlerts []CounterAlert
+
+	// topNRules limit the label sets of metrics when an interval ends
+	topNRules []TopNRule
+
+	// displayCache holds the last DisplayMetrics result, which is served
+	// again while it is younger than displayCacheTTL. A zero TTL disables
+	// the cache. displayCacheLock serializes the cached computations, and is
+	// taken before displayLock, which guards the display settings.
+	displayCacheTTL  time.Duration
+	displayCache     *displayCacheEntry
+	displayCacheLock sync.Mutex
+	displayLock      sync.RWMutex
+
+	// decimateAfter is the age after which displayed intervals lose the
+	// quantiles and HDR histograms of their samples. Zero disables it.
+	decimateAfter time.Duration
+
+	// displayPrefix is stripped from the names of displayed metrics
+	displayPrefix string
+
+	// checkpoints holds the *counterCheckpoints of the sink once enabled by
+	// EnableCounterCheckpoints
+	checkpoints atomic.Value
+
+	// clock is the source of the current time, time.Now if nil
+	clock Clock
+
+	// granularities are additional aggregations of the same emissions at
+	// other intervals, see AddGranularity
+	granularityNames []string
+	granularities    []*InmemSink
+	granularityLock  sync.RWMutex
 }
 
 // IntervalMetrics stores the aggregated metrics
@@ -59,6 +129,19 @@ type IntervalMetrics struct {
 	// done is closed when this interval has ended, and a new IntervalMetrics
 	// has been created to receive any future metrics.
 	done chan struct{}
+
+	// maxSamples is the number of raw sample values retained per key
+	maxSamples int
+
+	// hdr configures HDR histograms of samples, which are disabled if nil
+	hdr *HDROpts
+
+	// bucketBounds are the upper bounds samples are bucketed by, if set
+	bucketBounds []float64
+
+	// rateDenom is the interval length in rate time units, used to compute
+	// the Rate of counters and samples
+	rateDenom float64
 }
 
 // NewIntervalMetrics creates a new IntervalMetrics for a given interval
@@ -83,6 +166,22 @@ type AggregateSample struct {
 	Min         float64   // Minimum value
 	Max         float64   // Maximum value
 	LastUpdated time.Time `json:"-"` // When value was last updated
+
+	// Buckets holds histogram bucket counts added with ObserveBuckets, or
+	// for every value if bucket histograms are enabled on the InmemSink,
+	// keyed by bucket upper bound. Those added with ObserveBuckets are kept
+	// apart from the aggregates above, which only reflect individually
+	// ingested values.
+	Buckets map[float64]uint64 `json:"-"`
+
+	// samples holds up to maxSamples raw values, chosen by reservoir
+	// sampling, when sample retention is enabled on the InmemSink.
+	samples    []float64
+	maxSamples int
+
+	// histogram records every value when HDR histograms are enabled on the
+	// InmemSink
+	histogram *HDRHistogram
 }
 
 // Computes a Stddev of the values
@@ -105,6 +204,11 @@ func (a *AggregateSample) Mean() float64 {
 
 // Ingest is used to update a sample
 func (a *AggregateSample) Ingest(v float64, rateDenom float64) {
+	a.ingestAt(v, rateDenom, time.Now())
+}
+
+// ingestAt updates the sample with v, which was ingested at now
+func (a *AggregateSample) ingestAt(v float64, rateDenom float64, now time.Time) {
 	a.Count++
 	a.Sum += v
 	a.SumSq += (v * v)
@@ -115,7 +219,120 @@ func (a *AggregateSample) Ingest(v float64, rateDenom float64) {
 		a.Max = v
 	}
 	a.Rate = float64(a.Sum) / rateDenom
-	a.LastUpdated = time.Now()
+	a.LastUpdated = now
+
+	if a.maxSamples > 0 {
+		a.retain(v)
+	}
+}
+
+// recordHDR records v in the HDR histogram configured by opts
+func (a *AggregateSample) recordHDR(v float64, opts *HDROpts) {
+	if a.histogram == nil {
+		a.histogram, _ = NewHDRHistogram(opts.MaxValue, opts.SignificantDigits)
+	}
+	a.histogram.recordScaled(v, opts.Scale)
+}
+
+// recordBucket counts v in the bucket of the lowest of bounds at or above v,
+// or of math.Inf(1) above every bound
+func (a *AggregateSample) recordBucket(v float64, bounds []float64) {
+	bound := math.Inf(1)
+	if j := sort.SearchFloat64s(bounds, v); j < len(bounds) {
+		bound = bounds[j]
+	}
+	if a.Buckets == nil {
+		a.Buckets = make(map[float64]uint64, len(bounds)+1)
+	}
+	a.Buckets[bound]++
+}
+
+// HDR returns the HDR histogram of the values, or nil unless HDR histograms
+// are enabled on the InmemSink
+func (a *AggregateSample) HDR() *HDRHistogram {
+	return a.histogram
+}
+
+// AddBuckets adds bucketed observations to the bucket counts
+func (a *AggregateSample) AddBuckets(counts map[float64]uint64) {
+	a.addBucketsAt(counts, time.Now())
+}
+
+// addBucketsAt adds bucketed observations which were added at now
+func (a *AggregateSample) addBucketsAt(counts map[float64]uint64, now time.Time) {
+	if a.Buckets == nil {
+		a.Buckets = make(map[float64]uint64, len(counts))
+	}
+	for bound, count := range counts {
+		a.Buckets[bound] += count
+	}
+	a.LastUpdated = now
+}
+
+// merge adds the values aggregated by b. Retained raw samples of both are
+// kept, so the result may hold more than maxSamples of them.
+func (a *AggregateSample) merge(b *AggregateSample) {
+	if b.Count > 0 {
+		if b.Min < a.Min || a.Count == 0 {
+			a.Min = b.Min
+		}
+		if b.Max > a.Max || a.Count == 0 {
+			a.Max = b.Max
+		}
+	}
+	a.Count += b.Count
+	a.Sum += b.Sum
+	a.SumSq += b.SumSq
+	if b.LastUpdated.After(a.LastUpdated) {
+		a.LastUpdated = b.LastUpdated
+	}
+	a.samples = append(a.samples, b.samples...)
+	if len(b.Buckets) > 0 && a.Buckets == nil {
+		a.Buckets = make(map[float64]uint64, len(b.Buckets))
+	}
+	for bound, count := range b.Buckets {
+		a.Buckets[bound] += count
+	}
+	if b.histogram != nil {
+		if a.histogram == nil {
+			a.histogram = b.histogram.Copy()
+		} else {
+			a.histogram.Merge(b.histogram)
+		}
+	}
+}
+
+// retain keeps v as a raw sample. Once maxSamples values are held, later
+// values replace a random held value with probability maxSamples/Count, so
+// the retained set stays a uniform sample of everything ingested.
+func (a *AggregateSample) retain(v float64) {
+	if len(a.samples) < a.maxSamples {
+		a.samples = append(a.samples, v)
+		return
+	}
+	if j := rand.Int63n(int64(a.Count)); j < int64(a.maxSamples) {
+		a.samples[j] = v
+	}
+}
+
+// Quantile returns the q-th quantile of the retained raw samples, where q is
+// in the range [0, 1]. It returns NaN if no raw samples are retained.
+func (a *AggregateSample) Quantile(q float64) float64 {
+	if len(a.samples) == 0 {
+		return math.NaN()
+	}
+	sorted := make([]float64, len(a.samples))
+	copy(sorted, a.samples)
+	sort.Float64s(sorted)
+
+	idx := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
 }
 
 func (a *AggregateSample) String() string {
@@ -144,29 +361,203 @@ func NewInmemSinkFromURL(u *url.URL) (MetricSink, error) {
 		return nil, fmt.Errorf("Bad 'retain' param: %s", err)
 	}
 
-	return NewInmemSink(interval, retain), nil
+	sink := NewInmemSink(interval, retain)
+	if g := params.Get("grace"); g != "" {
+		grace, err := time.ParseDuration(g)
+		if err != nil {
+			return nil, fmt.Errorf("Bad 'grace' param: %s", err)
+		}
+		sink.SetRetainGrace(grace)
+	}
+	if name := params.Get("buckets"); name != "" {
+		bounds, err := BucketScheme(name)
+		if err != nil {
+			return nil, fmt.Errorf("Bad 'buckets' param: %s", err)
+		}
+		sink.EnableBucketHistograms(bounds)
+	}
+	return sink, nil
 }
 
 // NewInmemSink is used to construct a new in-memory sink.
 // Uses an aggregation interval and maximum retention period.
 func NewInmemSink(interval, retain time.Duration) *InmemSink {
-	rateTimeUnit := time.Second
-	i := &InmemSink{
-		interval:     interval,
-		retain:       retain,
-		maxIntervals: int(retain / interval),
-		rateDenom:    float64(interval.Nanoseconds()) / float64(rateTimeUnit.Nanoseconds()),
-	}
+	i := &InmemSink{}
+	i.setWindow(interval, retain)
 	i.intervals = make([]*IntervalMetrics, 0, i.maxIntervals)
 	return i
 }
 
+// NewInmemSinkWithClock constructs an in-memory sink reading the current time
+// from clock rather than time.Now. It is meant for tests only: with a
+// FakeClock, tests can step through intervals and counter expiry
+// deterministically, see ForceRollover.
+func NewInmemSinkWithClock(interval, retain time.Duration, clock Clock) *InmemSink {
+	i := NewInmemSink(interval, retain)
+	i.clock = clock
+	return i
+}
+
+// ForceRollover advances the FakeClock of the sink to the start of the next
+// interval and starts that interval, finishing the current one as if a
+// metric had been emitted after the boundary. It is meant for tests only,
+// and panics if the sink was not created with NewInmemSinkWithClock and a
+// FakeClock.
+func (i *InmemSink) ForceRollover() {
+	clock, ok := i.clock.(*FakeClock)
+	if !ok {
+		panic("metrics: ForceRollover requires an InmemSink with a FakeClock")
+	}
+	interval := i.intervalLength()
+	now := clock.Now()
+	clock.Advance(now.Truncate(interval).Add(interval).Sub(now))
+	i.getInterval()
+	for _, g := range i.granularitySinks() {
+		g.getInterval()
+	}
+}
+
+// Reconfigure changes the aggregation interval and retention period of a
+// running sink. Retained intervals are kept, oldest first being dropped if
+// they exceed the number of intervals the new retain allows.
+//
+// The interval in progress is not split: it keeps receiving metrics until
+// the first boundary of the new interval length after its start, so it may
+// end up shorter or longer than either length. Its Rate values are
+// computed against the old interval length. Intervals created afterwards
+// follow the new configuration.
+func (i *InmemSink) Reconfigure(interval, retain time.Duration) {
+	i.intervalLock.Lock()
+	defer i.intervalLock.Unlock()
+
+	i.setWindow(interval, retain)
+	i.prune(i.now())
+}
+
+// SetRetainGrace keeps intervals queryable through Data and the endpoints
+// built on it for grace after they roll off the retain window, so a scraper
+// running slightly late still finds the interval it asks for. Intervals are
+// freed once grace has passed. A grace of zero, the default, frees them as
+// soon as they roll off.
+func (i *InmemSink) SetRetainGrace(grace time.Duration) {
+	if grace < 0 {
+		grace = 0
+	}
+	i.intervalLock.Lock()
+	i.grace = grace
+	i.prune(i.now())
+	i.intervalLock.Unlock()
+
+	for _, g := range i.granularitySinks() {
+		g.SetRetainGrace(grace)
+	}
+}
+
+// intervalLength returns the current aggregation interval, which Reconfigure
+// may change at any time
+func (i *InmemSink) intervalLength() time.Duration {
+	i.intervalLock.RLock()
+	defer i.intervalLock.RUnlock()
+	return i.interval
+}
+
+// setWindow sets the interval and retention period along with their derived
+// values. The caller must hold intervalLock if the sink is in use.
+func (i *InmemSink) setWindow(interval, retain time.Duration) {
+	rateTimeUnit := time.Second
+	i.interval = interval
+	i.retain = retain
+	i.maxIntervals = int(retain / interval)
+	i.rateDenom = float64(interval.Nanoseconds()) / float64(rateTimeUnit.Nanoseconds())
+}
+
+// EnableSampleRetention makes the sink retain raw values for samples so
+// quantiles can be computed. At most max values are kept per key and
+// interval; beyond that reservoir sampling keeps a representative subset.
+// A max of zero uses DefaultMaxRetainedSamples. It only affects intervals
+// created after the call.
+func (i *InmemSink) EnableSampleRetention(max int) {
+	if max <= 0 {
+		max = DefaultMaxRetainedSamples
+	}
+	i.intervalLock.Lock()
+	i.maxSamples = max
+	i.intervalLock.Unlock()
+
+	for _, g := range i.granularitySinks() {
+		g.EnableSampleRetention(max)
+	}
+}
+
+// EnableHDRHistograms makes the sink record samples in HDR histograms, which
+// keep their distribution with a fixed relative precision and are exposed in
+// the HDRHistogram field of DisplayMetrics in the encoding of HdrHistogram
+// tooling. Each histogram costs kilobytes per key and interval, more with
+// more significant digits and a higher max value, so it is opt-in. It only
+// affects intervals created after the call.
+func (i *InmemSink) EnableHDRHistograms(opts HDROpts) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+	i.intervalLock.Lock()
+	i.hdr = &opts
+	i.intervalLock.Unlock()
+
+	for _, g := range i.granularitySinks() {
+		g.EnableHDRHistograms(opts)
+	}
+	return nil
+}
+
+// EnableBucketHistograms makes the sink count samples in the buckets of
+// bounds, which must be increasing, into the Buckets of their aggregate like
+// bucketed observations, e.g. with the bounds of a BucketScheme. A value
+// counts in the bucket of the lowest bound at or above it, and values above
+// every bound in the bucket of math.Inf(1). It only affects intervals created
+// after the call.
+func (i *InmemSink) EnableBucketHistograms(bounds []float64) error {
+	if err := validateBuckets(bounds); err != nil {
+		return err
+	}
+	bounds = append([]float64(nil), bounds...)
+	i.intervalLock.Lock()
+	i.bucketBounds = bounds
+	i.intervalLock.Unlock()
+
+	for _, g := range i.granularitySinks() {
+		g.EnableBucketHistograms(bounds)
+	}
+	return nil
+}
+
+// EnableCounterKeepAlive keeps counters present in every interval for ttl
+// after they were last incremented. Intervals in which such a counter was
+// not incremented hold it with a Count and Sum of zero, so pull-based
+// consumers see a continuous series instead of gaps.
+func (i *InmemSink) EnableCounterKeepAlive(ttl time.Duration) {
+	i.intervalLock.Lock()
+	i.counterTTL = ttl
+	i.intervalLock.Unlock()
+
+	for _, g := range i.granularitySinks() {
+		g.EnableCounterKeepAlive(ttl)
+	}
+}
+
 func (i *InmemSink) SetGauge(key []string, val float32) {
 	i.SetGaugeWithLabels(key, val, nil)
 }
 
 func (i *InmemSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
 	k, name := i.flattenKeyLabels(key, labels)
+	i.setGauge(k, name, val, labels)
+	for _, g := range i.granularitySinks() {
+		g.setGauge(k, name, val, labels)
+	}
+}
+
+func (i *InmemSink) setGauge(k, name string, val float32, labels []Label) {
 	intv := i.getInterval()
 
 	intv.Lock()
@@ -174,8 +565,115 @@ func (i *InmemSink) SetGaugeWithLabels(key []string, val float32, labels []Label
 	intv.Gauges[k] = GaugeValue{Name: name, Value: val, Labels: labels}
 }
 
+// VerifyCanary returns an error unless the gauge key, with any labels, holds
+// val in the current interval, for the self-test of Metrics
+func (i *InmemSink) VerifyCanary(key []string, val float32) error {
+	name := i.flattenKey(key)
+	intv := i.getInterval()
+
+	intv.RLock()
+	defer intv.RUnlock()
+	found := false
+	for _, g := range intv.Gauges {
+		if g.Name != name {
+			continue
+		}
+		if g.Value == val {
+			return nil
+		}
+		found = true
+	}
+	if found {
+		return fmt.Errorf("canary %s holds a stale value", name)
+	}
+	return fmt.Errorf("canary %s not found", name)
+}
+
+// SetGaugeOnce sets a gauge which only appears in the current interval, such
+// as a deploy marker. Unlike gauges set with SetGauge, its value is never
+// carried forward: AdjustGauge on the same key in a later interval starts
+// from the last value set otherwise, or zero.
+func (i *InmemSink) SetGaugeOnce(key []string, val float32, labels []Label) {
+	k, name := i.flattenKeyLabels(key, labels)
+	i.setGaugeOnce(k, name, val, labels)
+	for _, g := range i.granularitySinks() {
+		g.setGaugeOnce(k, name, val, labels)
+	}
+}
+
+func (i *InmemSink) setGaugeOnce(k, name string, val float32, labels []Label) {
+	intv := i.getInterval()
+
+	intv.Lock()
+	defer intv.Unlock()
+	intv.Gauges[k] = GaugeValue{Name: name, Value: val, Labels: labels, once: true}
+}
+
+// AdjustGauge applies a relative change to a gauge
+func (i *InmemSink) AdjustGauge(key []string, delta float32) {
+	i.AdjustGaugeWithLabels(key, delta, nil)
+}
+
+// AdjustGaugeWithLabels applies a relative change to a gauge. The running
+// value is carried forward from the most recent interval that holds the
+// gauge, so deltas accumulate across intervals. A later SetGauge on the
+// same key replaces the running value.
+func (i *InmemSink) AdjustGaugeWithLabels(key []string, delta float32, labels []Label) {
+	k, name := i.flattenKeyLabels(key, labels)
+	i.adjustGauge(k, name, delta, labels)
+	for _, g := range i.granularitySinks() {
+		g.adjustGauge(k, name, delta, labels)
+	}
+}
+
+func (i *InmemSink) adjustGauge(k, name string, delta float32, labels []Label) {
+	intv := i.getInterval()
+
+	// Look up the carried value before locking the interval, to keep the
+	// same intervalLock -> interval lock ordering as Data.
+	last := i.lastGaugeValue(k, intv)
+
+	intv.Lock()
+	defer intv.Unlock()
+
+	current, ok := intv.Gauges[k]
+	if !ok {
+		current.Value = last
+	}
+	intv.Gauges[k] = GaugeValue{Name: name, Value: current.Value + delta, Labels: labels}
+}
+
+// lastGaugeValue returns the value of the gauge in the most recent interval
+// before current that holds it, or zero if no retained interval does. Gauges
+// set with SetGaugeOnce are skipped.
+func (i *InmemSink) lastGaugeValue(k string, current *IntervalMetrics) float32 {
+	i.intervalLock.RLock()
+	defer i.intervalLock.RUnlock()
+
+	for j := len(i.intervals) - 1; j >= 0; j-- {
+		intv := i.intervals[j]
+		if intv == current {
+			continue
+		}
+		intv.RLock()
+		gauge, ok := intv.Gauges[k]
+		intv.RUnlock()
+		if ok && !gauge.once {
+			return gauge.Value
+		}
+	}
+	return 0
+}
+
 func (i *InmemSink) EmitKey(key []string, val float32) {
 	k := i.flattenKey(key)
+	i.emitKey(k, val)
+	for _, g := range i.granularitySinks() {
+		g.emitKey(k, val)
+	}
+}
+
+func (i *InmemSink) emitKey(k string, val float32) {
 	intv := i.getInterval()
 
 	intv.Lock()
@@ -190,6 +688,16 @@ func (i *InmemSink) IncrCounter(key []string, val float32) {
 
 func (i *InmemSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
 	k, name := i.flattenKeyLabels(key, labels)
+	i.incrCounter(k, name, val, labels)
+	if c := i.counterCheckpoints(); c != nil {
+		c.add(k, name, val, labels)
+	}
+	for _, g := range i.granularitySinks() {
+		g.incrCounter(k, name, val, labels)
+	}
+}
+
+func (i *InmemSink) incrCounter(k, name string, val float32, labels []Label) {
 	intv := i.getInterval()
 
 	intv.Lock()
@@ -204,7 +712,71 @@ func (i *InmemSink) IncrCounterWithLabels(key []string, val float32, labels []La
 		}
 		intv.Counters[k] = agg
 	}
-	agg.Ingest(float64(val), i.rateDenom)
+	agg.ingestAt(float64(val), intv.rateDenom, i.now())
+}
+
+// ResetCounter marks the counter as reset at its source. The intervals only
+// hold the increments received in them, so they are left as they are,
+// including the increments of the current interval from before the reset.
+// The counter is listed in the current interval, and kept alive like an
+// updated counter. With EnableCounterCheckpoints, its running total restarts
+// from zero, including in the checkpoints taken, so the next deltas count
+// the increments after the reset.
+func (i *InmemSink) ResetCounter(key []string, labels []Label) {
+	k, name := i.flattenKeyLabels(key, labels)
+	i.touchCounter(k, name, labels)
+	if c := i.counterCheckpoints(); c != nil {
+		c.reset(k)
+	}
+	for _, g := range i.granularitySinks() {
+		g.touchCounter(k, name, labels)
+	}
+}
+
+// touchCounter lists the counter in the current interval without an
+// increment, and marks it as updated
+func (i *InmemSink) touchCounter(k, name string, labels []Label) {
+	intv := i.getInterval()
+
+	intv.Lock()
+	defer intv.Unlock()
+
+	if agg, ok := intv.Counters[k]; ok {
+		agg.LastUpdated = i.now()
+		return
+	}
+	intv.Counters[k] = SampledValue{
+		Name:            name,
+		AggregateSample: &AggregateSample{LastUpdated: i.now()},
+		Labels:          labels,
+	}
+}
+
+// ObserveBuckets adds bucketed observations to the Buckets of the sample
+func (i *InmemSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	k, name := i.flattenKeyLabels(key, labels)
+	i.addBuckets(k, name, counts, labels)
+	for _, g := range i.granularitySinks() {
+		g.addBuckets(k, name, counts, labels)
+	}
+}
+
+func (i *InmemSink) addBuckets(k, name string, counts map[float64]uint64, labels []Label) {
+	intv := i.getInterval()
+
+	intv.Lock()
+	defer intv.Unlock()
+
+	agg, ok := intv.Samples[k]
+	if !ok {
+		agg = SampledValue{
+			Name:            name,
+			AggregateSample: &AggregateSample{maxSamples: intv.maxSamples},
+			Labels:          labels,
+		}
+		intv.Samples[k] = agg
+	}
+	agg.addBucketsAt(counts, i.now())
 }
 
 func (i *InmemSink) AddSample(key []string, val float32) {
@@ -213,6 +785,13 @@ func (i *InmemSink) AddSample(key []string, val float32) {
 
 func (i *InmemSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
 	k, name := i.flattenKeyLabels(key, labels)
+	i.addSample(k, name, val, labels)
+	for _, g := range i.granularitySinks() {
+		g.addSample(k, name, val, labels)
+	}
+}
+
+func (i *InmemSink) addSample(k, name string, val float32, labels []Label) {
 	intv := i.getInterval()
 
 	intv.Lock()
@@ -222,12 +801,62 @@ func (i *InmemSink) AddSampleWithLabels(key []string, val float32, labels []Labe
 	if !ok {
 		agg = SampledValue{
 			Name:            name,
-			AggregateSample: &AggregateSample{},
+			AggregateSample: &AggregateSample{maxSamples: intv.maxSamples},
 			Labels:          labels,
 		}
 		intv.Samples[k] = agg
 	}
-	agg.Ingest(float64(val), i.rateDenom)
+	agg.ingestAt(float64(val), intv.rateDenom, i.now())
+	if intv.hdr != nil {
+		agg.recordHDR(float64(val), intv.hdr)
+	}
+	if intv.bucketBounds != nil {
+		agg.recordBucket(float64(val), intv.bucketBounds)
+	}
+}
+
+// mergeIntervals combines intervals, oldest first, into a single interval
+// spanning all of them. Gauges keep their latest value, points are
+// concatenated, and counters and samples are merged with their rates
+// computed over the combined length.
+func mergeIntervals(intervals []*IntervalMetrics) *IntervalMetrics {
+	merged := NewIntervalMetrics(intervals[0].Interval)
+	for _, intv := range intervals {
+		intv.RLock()
+		merged.rateDenom += intv.rateDenom
+		for k, v := range intv.Gauges {
+			merged.Gauges[k] = v
+		}
+		for k, v := range intv.Points {
+			merged.Points[k] = append(merged.Points[k], v...)
+		}
+		mergeSampledValues(merged.Counters, intv.Counters)
+		mergeSampledValues(merged.Samples, intv.Samples)
+		intv.RUnlock()
+	}
+
+	if merged.rateDenom > 0 {
+		for _, v := range merged.Counters {
+			v.Rate = v.Sum / merged.rateDenom
+		}
+		for _, v := range merged.Samples {
+			v.Rate = v.Sum / merged.rateDenom
+		}
+	}
+	return merged
+}
+
+// mergeSampledValues merges the values of src into dst, copying them on
+// first use so src is never modified
+func mergeSampledValues(dst, src map[string]SampledValue) {
+	for k, v := range src {
+		agg, ok := dst[k]
+		if !ok {
+			dst[k] = v.deepCopy()
+			continue
+		}
+		agg.merge(v.AggregateSample)
+	}
 }
 
 // Data is used to retrieve all the aggregated metrics
@@ -239,11 +868,13 @@ func (i *InmemSink) Data() []*IntervalMetrics {
 	i.intervalLock.RLock()
 	defer i.intervalLock.RUnlock()
 
-	n := len(i.intervals)
+	// Skip the intervals whose grace has passed but that are not freed yet
+	expired := i.expired(i.now())
+	n := len(i.intervals) - expired
 	intervals := make([]*IntervalMetrics, n)
 
-	copy(intervals[:n-1], i.intervals[:n-1])
-	current := i.intervals[n-1]
+	copy(intervals[:n-1], i.intervals[expired:expired+n-1])
+	current := i.intervals[expired+n-1]
 
 	// make its own copy for current interval
 	intervals[n-1] = &IntervalMetrics{}
@@ -275,44 +906,134 @@ func (i *InmemSink) Data() []*IntervalMetrics {
 	return intervals
 }
 
+// now returns the current time from the configured clock
+func (i *InmemSink) now() time.Time {
+	if i.clock == nil {
+		return systemClock{}.Now()
+	}
+	return i.clock.Now()
+}
+
 // getInterval returns the current interval. A new interval is created if no
 // previous interval exists, or if the current time is beyond the window for the
 // current interval.
+//
+// The latest interval also remains current while the truncated time is
+// before its start, which happens after Reconfigure lengthens the interval.
 func (i *InmemSink) getInterval() *IntervalMetrics {
-	intv := time.Now().Truncate(i.interval)
+	now := i.now()
 
 	// Attempt to return the existing interval first, because it only requires
 	// a read lock.
 	i.intervalLock.RLock()
+	intv := now.Truncate(i.interval)
 	n := len(i.intervals)
-	if n > 0 && i.intervals[n-1].Interval == intv {
+	if n > 0 && !intv.After(i.intervals[n-1].Interval) {
 		defer i.intervalLock.RUnlock()
 		return i.intervals[n-1]
 	}
 	i.intervalLock.RUnlock()
 
 	i.intervalLock.Lock()
-	defer i.intervalLock.Unlock()
+	current, alerts := i.rollover(now)
+	i.intervalLock.Unlock()
+
+	// Alert callbacks may emit to the sink, so they run without the lock
+	for _, alert := range alerts {
+		alert()
+	}
+	return current
+}
 
+// rollover returns the current interval, creating it and finishing the
+// previous one if needed, along with the callbacks of the counter alerts
+// fired by the previous one. The caller must hold intervalLock for writing.
+func (i *InmemSink) rollover(now time.Time) (*IntervalMetrics, []func()) {
 	// Re-check for an existing interval now that the lock is re-acquired.
-	n = len(i.intervals)
-	if n > 0 && i.intervals[n-1].Interval == intv {
-		return i.intervals[n-1]
+	intv := now.Truncate(i.interval)
+	n := len(i.intervals)
+	if n > 0 && !intv.After(i.intervals[n-1].Interval) {
+		return i.intervals[n-1], nil
 	}
 
 	current := NewIntervalMetrics(intv)
+	current.maxSamples = i.maxSamples
+	current.hdr = i.hdr
+	current.bucketBounds = i.bucketBounds
+	current.rateDenom = i.rateDenom
 	i.intervals = append(i.intervals, current)
+	var alerts []func()
 	if n > 0 {
+		if len(i.derivedRules) > 0 {
+			i.deriveMetrics(i.intervals[n-1])
+		}
+		if len(i.counterAlerts) > 0 {
+			alerts = i.checkCounterAlerts(i.intervals[n-1], now)
+		}
+		if len(i.topNRules) > 0 {
+			i.limitTopN(i.intervals[n-1])
+		}
 		close(i.intervals[n-1].done)
+		if i.counterTTL > 0 {
+			i.keepAliveCounters(i.intervals[n-1], current, now)
+		}
+		if i.compact && n > 1 {
+			i.intervals[n-2] = i.compactInterval(i.intervals[n-2])
+		}
 	}
 
-	n++
-	// Prune old intervals if the count exceeds the max.
-	if n >= i.maxIntervals {
-		copy(i.intervals[0:], i.intervals[n-i.maxIntervals:])
-		i.intervals = i.intervals[:i.maxIntervals]
+	i.prune(now)
+	return current, alerts
+}
+
+// expired returns the number of oldest intervals that are beyond
+// maxIntervals and rolled off the retain window more than grace before now.
+// An interval rolls off when the interval maxIntervals after it starts. The
+// caller must hold intervalLock.
+func (i *InmemSink) expired(now time.Time) int {
+	excess := len(i.intervals) - i.maxIntervals
+	for j := 0; j < excess; j++ {
+		rolledOff := i.intervals[j+i.maxIntervals].Interval
+		if i.grace > 0 && now.Sub(rolledOff) < i.grace {
+			return j
+		}
+	}
+	if excess < 0 {
+		return 0
+	}
+	return excess
+}
+
+// prune drops the expired intervals. The caller must hold intervalLock for
+// writing.
+func (i *InmemSink) prune(now time.Time) {
+	if n := i.expired(now); n > 0 {
+		copy(i.intervals[0:], i.intervals[n:])
+		for j := len(i.intervals) - n; j < len(i.intervals); j++ {
+			i.intervals[j] = nil
+		}
+		i.intervals = i.intervals[:len(i.intervals)-n]
+	}
+}
+
+// keepAliveCounters copies counters of prev that were incremented within
+// counterTTL of now into current with a zero value. The copies keep the
+// LastUpdated time of the original, so they expire once the TTL has passed.
+// The caller must hold intervalLock.
+func (i *InmemSink) keepAliveCounters(prev, current *IntervalMetrics, now time.Time) {
+	prev.RLock()
+	defer prev.RUnlock()
+
+	for k, agg := range prev.Counters {
+		if now.Sub(agg.LastUpdated) >= i.counterTTL {
+			continue
+		}
+		current.Counters[k] = SampledValue{
+			Name:            agg.Name,
+			AggregateSample: &AggregateSample{LastUpdated: agg.LastUpdated},
+			Labels:          agg.Labels,
+		}
 	}
-	return current
 }
 
 // Flattens the key for formatting, removes spaces
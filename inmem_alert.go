@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+)
+
+// CounterAlert fires when the sum of a counter within an interval exceeds a
+// threshold, checked by an InmemSink when the interval ends. It brings basic
+// threshold detection into the sink for services without a rules engine.
+type CounterAlert struct {
+	// Counter and Labels are the key and labels of the checked counter
+	Counter []string
+	Labels  []Label
+
+	// Threshold is the sum above which the alert fires
+	Threshold float64
+
+	// Key is the key of a counter incremented by one, with Labels, in the
+	// interval the alert fired for, so it shows up along with its source.
+	// Nothing is emitted if nil.
+	Key []string
+
+	// OnAlert is called with the start of the interval the alert fired for
+	// and the sum of the counter, if set. It is called from the goroutine
+	// whose emission started the next interval, after the sink has rolled
+	// over, so it may emit to the sink but should not block.
+	OnAlert func(interval time.Time, sum float64)
+}
+
+// AddCounterAlert registers an alert checked for every interval that ends
+// after the call. The intervals of granularities added with AddGranularity
+// are not checked, so an alert fires once per interval of the sink.
+func (i *InmemSink) AddCounterAlert(alert CounterAlert) error {
+	if len(alert.Counter) == 0 {
+		return fmt.Errorf("counter alert must have a counter key")
+	}
+	if alert.Key == nil && alert.OnAlert == nil {
+		return fmt.Errorf("counter alert %v must have a key or a callback", alert.Counter)
+	}
+	i.intervalLock.Lock()
+	i.counterAlerts = append(i.counterAlerts, alert)
+	i.intervalLock.Unlock()
+	return nil
+}
+
+// checkCounterAlerts checks the counter alerts for a finished interval,
+// emitting the alert counters and returning the callbacks of the fired
+// alerts. The caller must hold intervalLock.
+func (i *InmemSink) checkCounterAlerts(intv *IntervalMetrics, now time.Time) []func() {
+	intv.Lock()
+	defer intv.Unlock()
+
+	var callbacks []func()
+	for _, alert := range i.counterAlerts {
+		k, _ := i.flattenKeyLabels(alert.Counter, alert.Labels)
+		c, ok := intv.Counters[k]
+		if !ok || c.Sum <= alert.Threshold {
+			continue
+		}
+
+		if alert.Key != nil {
+			k, name := i.flattenKeyLabels(alert.Key, alert.Labels)
+			agg, ok := intv.Counters[k]
+			if !ok {
+				agg = SampledValue{
+					Name:            name,
+					AggregateSample: &AggregateSample{},
+					Labels:          alert.Labels,
+				}
+				intv.Counters[k] = agg
+			}
+			agg.ingestAt(1, intv.rateDenom, now)
+		}
+		if alert.OnAlert != nil {
+			onAlert, start, sum := alert.OnAlert, intv.Interval, c.Sum
+			callbacks = append(callbacks, func() { onAlert(start, sum) })
+		}
+	}
+	return callbacks
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInmemSink_AddCounterAlert(t *testing.T) {
+	inm := NewInmemSink(time.Second, time.Minute)
+	if err := inm.AddCounterAlert(CounterAlert{Key: []string{"alert"}}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := inm.AddCounterAlert(CounterAlert{Counter: []string{"errors"}}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestInmemSink_CounterAlert(t *testing.T) {
+	start := time.Unix(1000, 0)
+	inm := NewInmemSinkWithClock(time.Second, time.Minute, NewFakeClock(start))
+	type fired struct {
+		interval time.Time
+		sum      float64
+	}
+	var calls []fired
+	labels := []Label{{"route", "/users"}}
+	err := inm.AddCounterAlert(CounterAlert{
+		Counter:   []string{"errors"},
+		Labels:    labels,
+		Threshold: 10,
+		Key:       []string{"errors", "alert"},
+		OnAlert: func(interval time.Time, sum float64) {
+			calls = append(calls, fired{interval, sum})
+
+			// The callback may emit to the sink
+			inm.IncrCounter([]string{"alert", "handled"}, 1)
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A counter at the threshold doesn't fire, nor does another label set
+	inm.IncrCounterWithLabels([]string{"errors"}, 10, labels)
+	inm.IncrCounterWithLabels([]string{"errors"}, 50, []Label{{"route", "/"}})
+	inm.ForceRollover()
+	if len(calls) != 0 {
+		t.Fatalf("unexpected alerts: %v", calls)
+	}
+	if _, ok := inm.Data()[0].Counters["errors.alert;route=/users"]; ok {
+		t.Fatalf("unexpected alert counter")
+	}
+
+	// Crossing it fires once the interval ends
+	inm.IncrCounterWithLabels([]string{"errors"}, 6, labels)
+	inm.IncrCounterWithLabels([]string{"errors"}, 6, labels)
+	if len(calls) != 0 {
+		t.Fatalf("unexpected alerts: %v", calls)
+	}
+	inm.ForceRollover()
+	if len(calls) != 1 || !calls[0].interval.Equal(start.Add(time.Second)) || calls[0].sum != 12 {
+		t.Fatalf("bad alerts: %v", calls)
+	}
+	data := inm.Data()
+	alert, ok := data[1].Counters["errors.alert;route=/users"]
+	if !ok || alert.Sum != 1 || alert.Name != "errors.alert" {
+		t.Fatalf("bad alert counter: %+v", alert)
+	}
+	if _, ok := data[2].Counters["alert.handled"]; !ok {
+		t.Fatalf("missing counter emitted by the callback")
+	}
+
+	// An interval without the counter doesn't fire
+	inm.ForceRollover()
+	if len(calls) != 1 {
+		t.Fatalf("bad alerts: %v", calls)
+	}
+}
@@ -0,0 +1,222 @@
+package metrics
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxCounterCheckpoints is the number of checkpoints kept by
+// EnableCounterCheckpoints if its max is zero
+const DefaultMaxCounterCheckpoints = 16
+
+// CounterDelta is the change of a counter between a checkpoint and a later
+// request, with its per second rate over the time between them
+type CounterDelta struct {
+	Name   string
+	Labels map[string]string `json:",omitempty"`
+	Delta  float64
+	Rate   float64
+}
+
+// CounterCheckpointResult is the result of the 'checkpoint' param of
+// DisplayMetrics. Token identifies the checkpoint taken by the request, to
+// pass in the next request. Since, Elapsed and Counters are only set when
+// diffing against a previous checkpoint.
+type CounterCheckpointResult struct {
+	Token    string
+	Since    string         `json:",omitempty"`
+	Elapsed  float64        `json:",omitempty"` // Seconds since the previous checkpoint
+	Counters []CounterDelta `json:",omitempty"`
+}
+
+// counterCheckpoints holds the running totals of the counters of a sink and
+// the last checkpoints of them
+type counterCheckpoints struct {
+	// nonce starts every token, so the tokens of another sink or process
+	// are rejected rather than diffed against the wrong checkpoint
+	nonce string
+	max   int
+
+	lock   sync.Mutex
+	totals map[string]*counterTotal
+	seq    uint64
+	taken  []*counterCheckpoint
+}
+
+// counterTotal is the sum of the increments of a counter since checkpoints
+// were enabled
+type counterTotal struct {
+	name   string
+	labels []Label
+	total  float64
+}
+
+// counterCheckpoint holds the counter totals at the time it was taken
+type counterCheckpoint struct {
+	token  string
+	time   time.Time
+	totals map[string]float64
+}
+
+// EnableCounterCheckpoints makes the sink keep the running totals of its
+// counters, so pollers can get the change of every counter between two
+// requests to DisplayMetrics with the 'checkpoint' query param, without
+// storing history themselves. A request with ?checkpoint=new takes a
+// checkpoint and returns its token; a request with ?checkpoint=<token>
+// returns the deltas and rates of the counters since that checkpoint, along
+// with the token of a new one. Only the last max checkpoints are kept,
+// DefaultMaxCounterCheckpoints if max is zero, and older tokens are
+// rejected. Totals count the increments received after the call and are
+// never dropped, so they cost memory for every label set ever seen.
+func (i *InmemSink) EnableCounterCheckpoints(max int) {
+	if max <= 0 {
+		max = DefaultMaxCounterCheckpoints
+	}
+	i.checkpoints.Store(&counterCheckpoints{
+		nonce:  strconv.FormatUint(uint64(rand.Uint32()), 36),
+		max:    max,
+		totals: make(map[string]*counterTotal),
+	})
+}
+
+// counterCheckpoints returns the checkpoints of the sink, or nil if they are
+// not enabled
+func (i *InmemSink) counterCheckpoints() *counterCheckpoints {
+	c, _ := i.checkpoints.Load().(*counterCheckpoints)
+	return c
+}
+
+// add adds an increment to the total of the counter k
+func (c *counterCheckpoints) add(k, name string, val float32, labels []Label) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	total, ok := c.totals[k]
+	if !ok {
+		total = &counterTotal{name: name, labels: labels}
+		c.totals[k] = total
+	}
+	total.total += float64(val)
+}
+
+// reset zeroes the total of the counter k, and its total in the checkpoints
+// taken, so the deltas since them only count the increments after the reset
+func (c *counterCheckpoints) reset(k string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if total, ok := c.totals[k]; ok {
+		total.total = 0
+	}
+	for _, cp := range c.taken {
+		if _, ok := cp.totals[k]; ok {
+			cp.totals[k] = 0
+		}
+	}
+}
+
+// checkpoint takes a checkpoint at now, returning it along with a copy of
+// the checkpoint of token, nil if token is "new", and copies of the totals
+func (c *counterCheckpoints) checkpoint(token string, now time.Time) (*counterCheckpoint, *counterCheckpoint, map[string]*counterTotal, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var base *counterCheckpoint
+	if token != "new" {
+		for _, cp := range c.taken {
+			if cp.token == token {
+				base = cp
+				break
+			}
+		}
+		if base == nil {
+			return nil, nil, nil, fmt.Errorf("Bad 'checkpoint' param: unknown or expired token %q", token)
+		}
+		// Copy, as a reset may change the totals once the lock is released
+		copied := *base
+		copied.totals = make(map[string]float64, len(base.totals))
+		for k, total := range base.totals {
+			copied.totals[k] = total
+		}
+		base = &copied
+	}
+
+	c.seq++
+	cp := &counterCheckpoint{
+		token:  c.nonce + "-" + strconv.FormatUint(c.seq, 36),
+		time:   now,
+		totals: make(map[string]float64, len(c.totals)),
+	}
+	counters := make(map[string]*counterTotal, len(c.totals))
+	for k, total := range c.totals {
+		cp.totals[k] = total.total
+		copied := *total
+		counters[k] = &copied
+	}
+	if len(c.taken) == c.max {
+		copy(c.taken, c.taken[1:])
+		c.taken = c.taken[:len(c.taken)-1]
+	}
+	c.taken = append(c.taken, cp)
+	return cp, base, counters, nil
+}
+
+// displayCheckpoint returns the CounterCheckpointResult of the request with
+// the 'checkpoint' param token, with prefix stripped from the counter names
+func (i *InmemSink) displayCheckpoint(token, prefix string) (interface{}, error) {
+	c := i.counterCheckpoints()
+	if c == nil {
+		return nil, fmt.Errorf("Bad 'checkpoint' param: counter checkpoints are not enabled")
+	}
+	length := i.intervalLength()
+	cp, base, counters, err := c.checkpoint(token, i.now())
+	if err != nil {
+		return nil, err
+	}
+	result := CounterCheckpointResult{Token: cp.token}
+	if base == nil {
+		return result, nil
+	}
+
+	elapsed := cp.time.Sub(base.time).Seconds()
+	result.Since = formatIntervalTimestamp(base.time, length)
+	result.Elapsed = elapsed
+	keys := make([]string, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result.Counters = make([]CounterDelta, 0, len(keys))
+	for _, k := range keys {
+		total := counters[k]
+		delta := CounterDelta{
+			Name:  stripNamePrefix(total.name, prefix),
+			Delta: total.total - base.totals[k],
+		}
+		if elapsed > 0 {
+			delta.Rate = delta.Delta / elapsed
+		}
+		if len(total.labels) > 0 {
+			delta.Labels = make(map[string]string, len(total.labels))
+			for _, label := range total.labels {
+				delta.Labels[label.Name] = label.Value
+			}
+		}
+		result.Counters = append(result.Counters, delta)
+	}
+	return result, nil
+}
+
+// checkpointParam returns the 'checkpoint' query param of req
+func checkpointParam(req *http.Request) string {
+	if req == nil || req.URL == nil {
+		return ""
+	}
+	return strings.TrimSpace(req.URL.Query().Get("checkpoint"))
+}
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkpoint requests a checkpoint of inm against token
+func checkpoint(t *testing.T, inm *InmemSink, token string) CounterCheckpointResult {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/v1/metrics?checkpoint="+token, nil)
+	obj, err := inm.DisplayMetrics(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return obj.(CounterCheckpointResult)
+}
+
+func TestInmemSink_CounterCheckpoints(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	inm := NewInmemSinkWithClock(10*time.Second, time.Minute, clock)
+	inm.SetDisplayPrefix("service")
+	inm.EnableCounterCheckpoints(0)
+	inm.IncrCounter([]string{"service", "requests"}, 5)
+
+	first := checkpoint(t, inm, "new")
+	if first.Token == "" || first.Counters != nil || first.Since != "" {
+		t.Fatalf("bad result: %+v", first)
+	}
+
+	// Deltas span intervals and count counters new since the checkpoint
+	inm.IncrCounter([]string{"service", "requests"}, 3)
+	clock.Advance(15 * time.Second)
+	inm.IncrCounter([]string{"service", "requests"}, 2)
+	inm.IncrCounterWithLabels([]string{"service", "errors"}, 10, []Label{{"code", "500"}})
+	clock.Advance(5 * time.Second)
+
+	second := checkpoint(t, inm, first.Token)
+	if second.Token == "" || second.Token == first.Token || second.Elapsed != 20 {
+		t.Fatalf("bad result: %+v", second)
+	}
+	expect := []CounterDelta{
+		{Name: "errors", Labels: map[string]string{"code": "500"}, Delta: 10, Rate: 0.5},
+		{Name: "requests", Delta: 5, Rate: 0.25},
+	}
+	if !reflect.DeepEqual(second.Counters, expect) {
+		t.Fatalf("bad deltas:\n%+v\nexpected:\n%+v", second.Counters, expect)
+	}
+
+	// The next request diffs against the checkpoint of the previous one, and
+	// earlier tokens stay usable
+	clock.Advance(10 * time.Second)
+	inm.IncrCounter([]string{"service", "requests"}, 1)
+	third := checkpoint(t, inm, second.Token)
+	expect = []CounterDelta{
+		{Name: "errors", Labels: map[string]string{"code": "500"}, Delta: 0, Rate: 0},
+		{Name: "requests", Delta: 1, Rate: 0.1},
+	}
+	if !reflect.DeepEqual(third.Counters, expect) {
+		t.Fatalf("bad deltas: %+v", third.Counters)
+	}
+	if again := checkpoint(t, inm, first.Token); again.Counters[1].Delta != 6 || again.Elapsed != 30 {
+		t.Fatalf("bad deltas: %+v", again)
+	}
+}
+
+func TestInmemSink_CounterCheckpointReset(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	inm := NewInmemSinkWithClock(10*time.Second, time.Minute, clock)
+	inm.EnableCounterCheckpoints(0)
+	inm.IncrCounter([]string{"requests"}, 5)
+	inm.IncrCounter([]string{"errors"}, 2)
+	first := checkpoint(t, inm, "new")
+
+	// The deltas since a reset only count the later increments
+	inm.IncrCounter([]string{"requests"}, 3)
+	inm.ResetCounter([]string{"requests"}, nil)
+	inm.IncrCounter([]string{"requests"}, 4)
+	inm.IncrCounter([]string{"errors"}, 1)
+	clock.Advance(10 * time.Second)
+	second := checkpoint(t, inm, first.Token)
+	expect := []CounterDelta{
+		{Name: "errors", Delta: 1, Rate: 0.1},
+		{Name: "requests", Delta: 4, Rate: 0.4},
+	}
+	if !reflect.DeepEqual(second.Counters, expect) {
+		t.Fatalf("bad deltas: %+v", second.Counters)
+	}
+
+	// A reset without later increments gives a zero delta
+	inm.ResetCounter([]string{"requests"}, nil)
+	third := checkpoint(t, inm, second.Token)
+	if third.Counters[1].Delta != 0 {
+		t.Fatalf("bad deltas: %+v", third.Counters)
+	}
+}
+
+func TestInmemSink_CounterCheckpointReconfigure(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour)
+	inm.EnableCounterCheckpoints(0)
+	inm.IncrCounter([]string{"requests"}, 1)
+	token := checkpoint(t, inm, "new").Token
+
+	// Reconfiguring a sink while checkpoints are taken is safe, which the
+	// race detector checks
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for j := 0; j < 100; j++ {
+			inm.Reconfigure(time.Duration(j%2+1)*time.Minute, time.Hour)
+		}
+	}()
+	for j := 0; j < 100; j++ {
+		token = checkpoint(t, inm, token).Token
+	}
+	<-done
+}
+
+func TestInmemSink_CounterCheckpointErrors(t *testing.T) {
+	inm := NewInmemSink(10*time.Second, time.Minute)
+	req := httptest.NewRequest("GET", "/v1/metrics?checkpoint=new", nil)
+	if _, err := inm.DisplayMetrics(httptest.NewRecorder(), req); err == nil || !strings.Contains(err.Error(), "not enabled") {
+		t.Fatalf("bad err: %v", err)
+	}
+
+	// Only the last checkpoints are kept
+	inm.EnableCounterCheckpoints(2)
+	inm.SetDisplayCacheTTL(time.Minute)
+	first := checkpoint(t, inm, "new")
+	second := checkpoint(t, inm, first.Token)
+	checkpoint(t, inm, second.Token)
+	for _, token := range []string{first.Token, "bogus"} {
+		req := httptest.NewRequest("GET", "/v1/metrics?checkpoint="+token, nil)
+		if _, err := inm.DisplayMetrics(httptest.NewRecorder(), req); err == nil || !strings.Contains(err.Error(), "unknown or expired") {
+			t.Fatalf("%s: bad err: %v", token, err)
+		}
+	}
+	checkpoint(t, inm, second.Token)
+
+	// Tokens of another sink are rejected
+	other := NewInmemSink(10*time.Second, time.Minute)
+	other.EnableCounterCheckpoints(2)
+	req = httptest.NewRequest("GET", "/v1/metrics?checkpoint="+second.Token, nil)
+	if _, err := other.DisplayMetrics(httptest.NewRecorder(), req); err == nil {
+		t.Fatalf("expected error")
+	}
+}
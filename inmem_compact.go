@@ -0,0 +1,87 @@
+package metrics
+
+// closedDone is the done channel shared by compacted intervals, which have
+// all ended
+var closedDone = func() chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}()
+
+// EnableSparseCompaction makes the sink compact the ended intervals holding
+// at most maxMetrics gauges, points, counters and samples in total, or only
+// the empty ones if maxMetrics is zero. This saves memory for services with
+// many rarely emitted metrics and a long retain window, most of whose
+// intervals are nearly empty. A compacted interval holds the same metrics,
+// so Data and DisplayMetrics return the same results, but has no allocated
+// maps for the kinds of metrics it doesn't hold, and its maps and slices of
+// points are sized to their contents.
+//
+// An interval is compacted when the interval after it ends, leaving a full
+// interval for emissions racing with the rollover to complete. It only
+// affects intervals ending after the call.
+func (i *InmemSink) EnableSparseCompaction(maxMetrics int) {
+	if maxMetrics < 0 {
+		maxMetrics = 0
+	}
+	i.intervalLock.Lock()
+	i.compact = true
+	i.compactMax = maxMetrics
+	i.intervalLock.Unlock()
+
+	for _, g := range i.granularitySinks() {
+		g.EnableSparseCompaction(maxMetrics)
+	}
+}
+
+// compactInterval returns a compacted copy of intv if it is sparse, and intv
+// itself otherwise. The maps of a compacted interval are nil when empty, so
+// it must never be written to. The caller must hold intervalLock.
+func (i *InmemSink) compactInterval(intv *IntervalMetrics) *IntervalMetrics {
+	intv.RLock()
+	defer intv.RUnlock()
+
+	if intv.done == closedDone {
+		return intv
+	}
+	if len(intv.Gauges)+len(intv.Points)+len(intv.Counters)+len(intv.Samples) > i.compactMax {
+		return intv
+	}
+
+	compacted := &IntervalMetrics{
+		Interval:     intv.Interval,
+		done:         closedDone,
+		maxSamples:   intv.maxSamples,
+		hdr:          intv.hdr,
+		bucketBounds: intv.bucketBounds,
+		rateDenom:    intv.rateDenom,
+	}
+	if len(intv.Gauges) > 0 {
+		compacted.Gauges = make(map[string]GaugeValue, len(intv.Gauges))
+		for k, v := range intv.Gauges {
+			compacted.Gauges[k] = v
+		}
+	}
+	if len(intv.Points) > 0 {
+		compacted.Points = make(map[string][]float32, len(intv.Points))
+		for k, v := range intv.Points {
+			compacted.Points[k] = append([]float32(nil), v...)
+		}
+	}
+	compacted.Counters = compactSampledValues(intv.Counters)
+	compacted.Samples = compactSampledValues(intv.Samples)
+	return compacted
+}
+
+// compactSampledValues returns a copy of values sized to its contents, or nil
+// if empty. The aggregates are shared with values.
+func compactSampledValues(values map[string]SampledValue) map[string]SampledValue {
+	if len(values) == 0 {
+		return nil
+	}
+	compacted := make(map[string]SampledValue, len(values))
+	for k, v := range values {
+		compacted[k] = v
+	}
+	return compacted
+}
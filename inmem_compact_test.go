@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// emitSparse emits a gauge every tenth interval and a counter every
+// interval, with a burst of sample keys in the fifth one
+func emitSparse(inm *InmemSink, intervals int) {
+	for j := 0; j < intervals; j++ {
+		if j%10 == 0 {
+			inm.SetGaugeWithLabels([]string{"rare"}, float32(j), []Label{{"a", "b"}})
+			inm.EmitKey([]string{"point"}, float32(j))
+		}
+		if j == 5 {
+			for k := 0; k < 20; k++ {
+				inm.AddSample([]string{"burst", string(rune('a' + k))}, float32(k))
+			}
+		}
+		inm.IncrCounter([]string{"ticks"}, 1)
+		inm.ForceRollover()
+	}
+}
+
+func TestInmemSink_SparseCompaction(t *testing.T) {
+	start := time.Unix(1000, 0)
+	plain := NewInmemSinkWithClock(time.Second, time.Hour, NewFakeClock(start))
+	compacted := NewInmemSinkWithClock(time.Second, time.Hour, NewFakeClock(start))
+	compacted.EnableSparseCompaction(3)
+	emitSparse(plain, 20)
+	emitSparse(compacted, 20)
+
+	// DisplayMetrics shows the same metrics over any window
+	for _, query := range []string{"", "window=3s", "window=1h"} {
+		req := &http.Request{URL: &url.URL{RawQuery: query}}
+		expect, err := plain.DisplayMetrics(nil, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		got, err := compacted.DisplayMetrics(nil, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("bad summary for %q:\n%+v\nexpected:\n%+v", query, got, expect)
+		}
+	}
+
+	// Sparse intervals are compacted once the interval after them ended,
+	// and the interval with the burst of sample keys is left as it was
+	data := compacted.Data()
+	if len(data) != 21 {
+		t.Fatalf("bad intervals: %d", len(data))
+	}
+	for j, intv := range data[:19] {
+		if j == 5 {
+			if intv.done == closedDone || intv.Gauges == nil {
+				t.Fatalf("interval %d was compacted", j)
+			}
+			continue
+		}
+		if intv.done != closedDone {
+			t.Fatalf("interval %d was not compacted", j)
+		}
+		if (j%10 == 0) != (intv.Gauges != nil) || intv.Samples != nil || len(intv.Counters) != 1 {
+			t.Fatalf("bad interval %d: %+v", j, intv)
+		}
+	}
+	if data[19].done == closedDone || data[19].Gauges == nil {
+		t.Fatalf("last ended interval was compacted")
+	}
+
+	// The current interval is still written to
+	compacted.SetGauge([]string{"rare"}, 1)
+	if len(compacted.Data()[20].Gauges) != 1 {
+		t.Fatalf("bad current interval")
+	}
+}
+
+func TestInmemSink_SparseCompactionGranularity(t *testing.T) {
+	inm := NewInmemSinkWithClock(time.Second, time.Hour, NewFakeClock(time.Unix(1000, 0)))
+	inm.EnableSparseCompaction(0)
+	if err := inm.AddGranularity("minute", time.Minute, time.Hour); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if g := inm.granularity("minute"); !g.compact || g.compactMax != 0 {
+		t.Fatalf("granularity does not compact")
+	}
+
+	// Without any metrics, every ended interval but the last is compacted
+	for j := 0; j < 4; j++ {
+		inm.ForceRollover()
+	}
+	data := inm.Data()
+	if data[0].Gauges != nil || data[1].Counters != nil || data[2].Gauges == nil {
+		t.Fatalf("bad intervals: %+v", data)
+	}
+}
+
+func BenchmarkInmemSink_SparseIntervals(b *testing.B) {
+	// Memory retained by a day of 10s intervals with rare emissions
+	for _, compact := range []bool{false, true} {
+		name := "plain"
+		if compact {
+			name = "compacted"
+		}
+		b.Run(name, func(b *testing.B) {
+			var retained uint64
+			for n := 0; n < b.N; n++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				inm := NewInmemSinkWithClock(10*time.Second, 24*time.Hour, NewFakeClock(time.Unix(0, 0)))
+				if compact {
+					inm.EnableSparseCompaction(4)
+				}
+				for j := 0; j < 8640; j++ {
+					if j%60 == 0 {
+						inm.SetGauge([]string{"rare"}, float32(j))
+					}
+					inm.ForceRollover()
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				retained += after.HeapAlloc - before.HeapAlloc
+				runtime.KeepAlive(inm)
+			}
+			b.ReportMetric(float64(retained)/float64(b.N), "retained-bytes/op")
+		})
+	}
+}
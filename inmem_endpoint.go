@@ -5,16 +5,25 @@ import (
 	"fmt"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // MetricsSummary holds a roll-up of metrics info for a given interval
 type MetricsSummary struct {
+	// Timestamp is the start of the interval, to the second. For sinks with
+	// sub-second intervals it has millisecond resolution.
 	Timestamp string
 	Gauges    []GaugeValue
 	Points    []PointValue
 	Counters  []SampledValue
 	Samples   []SampledValue
+
+	// Decimated is set when the quantiles and HDR histograms were dropped
+	// from an interval older than the recency threshold set with
+	// SetSampleDecimation
+	Decimated bool `json:",omitempty"`
 }
 
 type GaugeValue struct {
@@ -24,6 +33,10 @@ type GaugeValue struct {
 
 	Labels        []Label           `json:"-"`
 	DisplayLabels map[string]string `json:"Labels"`
+
+	// once is set for gauges set with SetGaugeOnce, which are not carried
+	// into later intervals
+	once bool
 }
 
 type PointValue struct {
@@ -38,6 +51,18 @@ type SampledValue struct {
 	Mean   float64
 	Stddev float64
 
+	// Quantiles holds the p50, p90 and p99 of the retained raw samples. It
+	// is only set when sample retention is enabled on the InmemSink.
+	Quantiles map[string]float64 `json:",omitempty"`
+
+	// DisplayBuckets holds the bucket counts keyed by formatted upper bound
+	DisplayBuckets map[string]uint64 `json:"Buckets,omitempty"`
+
+	// HDRHistogram holds the HDR histogram of the values in the base64
+	// compressed encoding of HdrHistogram. It is only set when HDR
+	// histograms are enabled on the InmemSink.
+	HDRHistogram string `json:",omitempty"`
+
 	Labels        []Label           `json:"-"`
 	DisplayLabels map[string]string `json:"Labels"`
 }
@@ -48,19 +73,182 @@ func (source *SampledValue) deepCopy() SampledValue {
 	if source.AggregateSample != nil {
 		dest.AggregateSample = &AggregateSample{}
 		*dest.AggregateSample = *source.AggregateSample
+		if source.samples != nil {
+			dest.samples = make([]float64, len(source.samples))
+			copy(dest.samples, source.samples)
+		}
+		if source.Buckets != nil {
+			dest.Buckets = make(map[float64]uint64, len(source.Buckets))
+			for bound, count := range source.Buckets {
+				dest.Buckets[bound] = count
+			}
+		}
+		if source.histogram != nil {
+			dest.histogram = source.histogram.Copy()
+		}
 	}
 	return dest
 }
 
+// displayCacheEntry is a DisplayMetrics result computed for a given query.
+type displayCacheEntry struct {
+	query     string
+	createdAt time.Time
+	result    interface{}
+}
+
+// SetDisplayCacheTTL sets the minimum interval between full computations of
+// DisplayMetrics. Requests arriving within ttl of the last computation with
+// the same query are served the cached result. A zero ttl, the default,
+// disables caching.
+func (i *InmemSink) SetDisplayCacheTTL(ttl time.Duration) {
+	i.displayCacheLock.Lock()
+	defer i.displayCacheLock.Unlock()
+	i.displayLock.Lock()
+	defer i.displayLock.Unlock()
+
+	i.displayCacheTTL = ttl
+	i.displayCache = nil
+}
+
+// SetDisplayPrefix sets a leading prefix, e.g. "myservice.", to strip from
+// metric names in the output of DisplayMetrics and Stream, which is handy
+// when every key carries the same redundant prefix. A prefix without a
+// trailing dot only matches whole key segments. Names without the prefix are
+// shown unchanged, as are the stored metrics. An empty prefix, the default,
+// disables stripping.
+func (i *InmemSink) SetDisplayPrefix(prefix string) {
+	i.displayCacheLock.Lock()
+	defer i.displayCacheLock.Unlock()
+	i.displayLock.Lock()
+	defer i.displayLock.Unlock()
+
+	i.displayPrefix = prefix
+	i.displayCache = nil
+}
+
+// SetSampleDecimation makes DisplayMetrics summarize the intervals which
+// started more than recent before the current one: their samples and
+// counters keep their aggregates and buckets, but lose their quantiles and
+// HDR histograms, and the summary has Decimated set. A window reaching
+// beyond recent is decimated as a whole, as its quantiles would only
+// describe its recent part. This keeps the responses for long windows small
+// while recent ones stay detailed. The stored metrics are unchanged. A zero
+// recent, the default, disables decimation.
+func (i *InmemSink) SetSampleDecimation(recent time.Duration) {
+	i.displayCacheLock.Lock()
+	defer i.displayCacheLock.Unlock()
+	i.displayLock.Lock()
+	defer i.displayLock.Unlock()
+
+	i.decimateAfter = recent
+	i.displayCache = nil
+}
+
 // DisplayMetrics returns a summary of the metrics from the most recent finished interval.
+// With a 'window' query param, e.g. ?window=60s, it instead returns a single
+// summary merging all finished intervals which started within the window
+// before the current one. With a 'granularity' query param it summarizes
+// the intervals of the granularity of that name, see AddGranularity. With a
+// 'query' param, e.g. ?query=sum(rate(http.requests)), it returns the
+// QueryResult of the expression over the summarized interval instead, see
+// Query. With a 'checkpoint' param it returns the CounterCheckpointResult of a
+// checkpoint of the counters, see EnableCounterCheckpoints.
 func (i *InmemSink) DisplayMetrics(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
-	data := i.Data()
+	// Every checkpoint request takes a new checkpoint, so it is never cached
+	if i.displayTTL() == 0 || checkpointParam(req) != "" {
+		return i.displayMetrics(resp, req)
+	}
+
+	i.displayCacheLock.Lock()
+	defer i.displayCacheLock.Unlock()
+
+	var query string
+	if req != nil && req.URL != nil {
+		query = req.URL.RawQuery
+	}
+
+	// Concurrent requests are serialized here, so a burst of scrapes
+	// results in a single computation.
+	now := i.now()
+	if c := i.displayCache; c != nil && c.query == query && now.Sub(c.createdAt) < i.displayTTL() {
+		return c.result, nil
+	}
+
+	result, err := i.displayMetrics(resp, req)
+	if err != nil {
+		return nil, err
+	}
+	i.displayCache = &displayCacheEntry{query: query, createdAt: now, result: result}
+	return result, nil
+}
+
+// displayTTL returns the TTL set with SetDisplayCacheTTL
+func (i *InmemSink) displayTTL() time.Duration {
+	i.displayLock.RLock()
+	defer i.displayLock.RUnlock()
+	return i.displayCacheTTL
+}
+
+// displaySettings returns the prefix set with SetDisplayPrefix and the age
+// set with SetSampleDecimation
+func (i *InmemSink) displaySettings() (prefix string, decimateAfter time.Duration) {
+	i.displayLock.RLock()
+	defer i.displayLock.RUnlock()
+	return i.displayPrefix, i.decimateAfter
+}
+
+// displayMetrics computes the DisplayMetrics result without any caching.
+func (i *InmemSink) displayMetrics(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	prefix, decimateAfter := i.displaySettings()
+	if token := checkpointParam(req); token != "" {
+		return i.displayCheckpoint(token, prefix)
+	}
+
+	interval, current, length, err := i.displayInterval(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if req != nil && req.URL != nil {
+		if param := req.URL.Query().Get("query"); param != "" {
+			query, err := ParseQuery(param)
+			if err != nil {
+				return nil, fmt.Errorf("Bad 'query' param: %s", err)
+			}
+			return newQueryResult(query, interval, length, prefix), nil
+		}
+	}
+
+	summary := newMetricSummaryFromInterval(interval, length)
+	summary.stripPrefix(prefix)
+	if decimateAfter > 0 && interval.Interval.Before(current.Add(-decimateAfter)) {
+		summary.decimate()
+	}
+	return summary, nil
+}
+
+// displayInterval returns the interval summarized for req, following its
+// 'granularity' and 'window' query params as described on DisplayMetrics,
+// along with the start of the current interval of its source and the
+// interval length of that source
+func (i *InmemSink) displayInterval(req *http.Request) (*IntervalMetrics, time.Time, time.Duration, error) {
+	source := i
+	if req != nil && req.URL != nil {
+		if name := req.URL.Query().Get("granularity"); name != "" {
+			if source = i.granularity(name); source == nil {
+				return nil, time.Time{}, 0, fmt.Errorf("Bad 'granularity' param: no granularity %q", name)
+			}
+		}
+	}
+	length := source.intervalLength()
+	data := source.Data()
 
 	var interval *IntervalMetrics
 	n := len(data)
 	switch {
 	case n == 0:
-		return nil, fmt.Errorf("no metric intervals have been initialized yet")
+		return nil, time.Time{}, 0, fmt.Errorf("no metric intervals have been initialized yet")
 	case n == 1:
 		// Show the current interval if it's all we have
 		interval = data[0]
@@ -69,15 +257,68 @@ func (i *InmemSink) DisplayMetrics(resp http.ResponseWriter, req *http.Request)
 		interval = data[n-2]
 	}
 
-	return newMetricSummaryFromInterval(interval), nil
+	if req != nil && req.URL != nil {
+		if param := req.URL.Query().Get("window"); param != "" {
+			window, err := time.ParseDuration(param)
+			if err != nil || window <= 0 {
+				return nil, time.Time{}, 0, fmt.Errorf("Bad 'window' param: %q is not a positive duration", param)
+			}
+			interval = windowIntervals(data, window)
+		}
+	}
+	return interval, data[n-1].Interval, length, nil
+}
+
+// newQueryResult evaluates query over interval
+func newQueryResult(query *Query, interval *IntervalMetrics, length time.Duration, prefix string) QueryResult {
+	result := QueryResult{
+		Timestamp: formatIntervalTimestamp(interval.Interval, length),
+		Query:     query.String(),
+		Series:    query.eval(interval, prefix),
+	}
+	if len(result.Series) > maxQuerySeries {
+		result.Series = result.Series[:maxQuerySeries]
+		result.Truncated = true
+	}
+	return result
+}
+
+// windowIntervals merges the finished intervals of data which started within
+// window before the start of the current interval. If data only holds the
+// current interval, it is used instead.
+func windowIntervals(data []*IntervalMetrics, window time.Duration) *IntervalMetrics {
+	n := len(data)
+	if n == 1 {
+		return mergeIntervals(data)
+	}
+
+	cutoff := data[n-1].Interval.Add(-window)
+	start := n - 2
+	for start > 0 && !data[start-1].Interval.Before(cutoff) {
+		start--
+	}
+	return mergeIntervals(data[start : n-1])
 }
 
-func newMetricSummaryFromInterval(interval *IntervalMetrics) MetricsSummary {
+// millisTimestampFormat is the layout of time.Time.String with milliseconds
+const millisTimestampFormat = "2006-01-02 15:04:05.000 -0700 MST"
+
+// formatIntervalTimestamp formats the start of an interval of length
+// interval, to the millisecond if the interval is shorter than a second so
+// consecutive intervals can be told apart
+func formatIntervalTimestamp(start time.Time, interval time.Duration) string {
+	if interval > 0 && interval < time.Second {
+		return start.Round(time.Millisecond).UTC().Format(millisTimestampFormat)
+	}
+	return start.Round(time.Second).UTC().String()
+}
+
+func newMetricSummaryFromInterval(interval *IntervalMetrics, length time.Duration) MetricsSummary {
 	interval.RLock()
 	defer interval.RUnlock()
 
 	summary := MetricsSummary{
-		Timestamp: interval.Interval.Round(time.Second).UTC().String(),
+		Timestamp: formatIntervalTimestamp(interval.Interval, length),
 		Gauges:    make([]GaugeValue, 0, len(interval.Gauges)),
 		Points:    make([]PointValue, 0, len(interval.Points)),
 	}
@@ -111,6 +352,49 @@ func newMetricSummaryFromInterval(interval *IntervalMetrics) MetricsSummary {
 	return summary
 }
 
+// stripPrefix removes prefix from the start of the metric names
+func (s *MetricsSummary) stripPrefix(prefix string) {
+	if prefix == "" {
+		return
+	}
+	for idx := range s.Gauges {
+		s.Gauges[idx].Name = stripNamePrefix(s.Gauges[idx].Name, prefix)
+	}
+	for idx := range s.Points {
+		s.Points[idx].Name = stripNamePrefix(s.Points[idx].Name, prefix)
+	}
+	for idx := range s.Counters {
+		s.Counters[idx].Name = stripNamePrefix(s.Counters[idx].Name, prefix)
+	}
+	for idx := range s.Samples {
+		s.Samples[idx].Name = stripNamePrefix(s.Samples[idx].Name, prefix)
+	}
+}
+
+// decimate drops the quantiles and HDR histograms of the samples and
+// counters of the summary
+func (s *MetricsSummary) decimate() {
+	for _, values := range [][]SampledValue{s.Counters, s.Samples} {
+		for idx := range values {
+			values[idx].Quantiles = nil
+			values[idx].HDRHistogram = ""
+		}
+	}
+	s.Decimated = true
+}
+
+// stripNamePrefix returns name without prefix, or name itself if it doesn't
+// have the prefix or is nothing but the prefix
+func stripNamePrefix(name, prefix string) string {
+	if !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	if len(name) <= len(prefix) || !strings.HasPrefix(name, prefix) {
+		return name
+	}
+	return name[len(prefix):]
+}
+
 func formatSamples(source map[string]SampledValue) []SampledValue {
 	output := make([]SampledValue, 0, len(source))
 	for hash, sample := range source {
@@ -119,12 +403,37 @@ func formatSamples(source map[string]SampledValue) []SampledValue {
 			displayLabels[label.Name] = label.Value
 		}
 
+		var quantiles map[string]float64
+		if len(sample.samples) > 0 {
+			quantiles = map[string]float64{
+				"p50": sample.Quantile(0.5),
+				"p90": sample.Quantile(0.9),
+				"p99": sample.Quantile(0.99),
+			}
+		}
+
+		var buckets map[string]uint64
+		if len(sample.Buckets) > 0 {
+			buckets = make(map[string]uint64, len(sample.Buckets))
+			for bound, count := range sample.Buckets {
+				buckets[strconv.FormatFloat(bound, 'g', -1, 64)] = count
+			}
+		}
+
+		var hdr string
+		if sample.histogram != nil {
+			hdr, _ = sample.histogram.Encode()
+		}
+
 		output = append(output, SampledValue{
 			Name:            sample.Name,
 			Hash:            hash,
 			AggregateSample: sample.AggregateSample,
 			Mean:            sample.AggregateSample.Mean(),
 			Stddev:          sample.AggregateSample.Stddev(),
+			Quantiles:       quantiles,
+			DisplayBuckets:  buckets,
+			HDRHistogram:    hdr,
 			DisplayLabels:   displayLabels,
 		})
 	}
@@ -148,7 +457,9 @@ func (i *InmemSink) Stream(ctx context.Context, encoder Encoder) {
 	for {
 		select {
 		case <-interval.done:
-			summary := newMetricSummaryFromInterval(interval)
+			summary := newMetricSummaryFromInterval(interval, i.intervalLength())
+			prefix, _ := i.displaySettings()
+			summary.stripPrefix(prefix)
 			if err := encoder.Encode(summary); err != nil {
 				return
 			}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
 	"time"
 
@@ -35,7 +36,7 @@ func TestDisplayMetrics(t *testing.T) {
 	}
 
 	expected := MetricsSummary{
-		Timestamp: data[0].Interval.Round(time.Second).UTC().String(),
+		Timestamp: data[0].Interval.Round(time.Millisecond).UTC().Format(millisTimestampFormat),
 		Gauges: []GaugeValue{
 			{
 				Name:          "foo.bar",
@@ -347,3 +348,297 @@ func (e encoder) Encode(metrics interface{}) error {
 	e.flusher.Flush()
 	return nil
 }
+
+func TestDisplayMetrics_CacheTTL(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour)
+	inm.SetGauge([]string{"foo"}, 1)
+
+	get := func() float32 {
+		req := httptest.NewRequest("GET", "/v1/metrics", nil)
+		raw, err := inm.DisplayMetrics(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return raw.(MetricsSummary).Gauges[0].Value
+	}
+
+	// Without a TTL every request is computed fresh
+	if v := get(); v != 1 {
+		t.Fatalf("bad val: %v", v)
+	}
+	inm.SetGauge([]string{"foo"}, 2)
+	if v := get(); v != 2 {
+		t.Fatalf("bad val: %v", v)
+	}
+
+	// Rapid requests are served the cached snapshot
+	inm.SetDisplayCacheTTL(50 * time.Millisecond)
+	if v := get(); v != 2 {
+		t.Fatalf("bad val: %v", v)
+	}
+	inm.SetGauge([]string{"foo"}, 3)
+	for j := 0; j < 10; j++ {
+		if v := get(); v != 2 {
+			t.Fatalf("expected cached val, got: %v", v)
+		}
+	}
+
+	// Once the TTL has passed the result is recomputed
+	time.Sleep(60 * time.Millisecond)
+	if v := get(); v != 3 {
+		t.Fatalf("bad val: %v", v)
+	}
+}
+
+func TestDisplayMetrics_UncachedConcurrent(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour)
+	inm.SetGauge([]string{"foo"}, 1)
+
+	// Without a TTL, requests don't wait on a cached computation in flight
+	inm.displayCacheLock.Lock()
+	defer inm.displayCacheLock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		inm.DisplayMetrics(nil, httptest.NewRequest("GET", "/v1/metrics", nil))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("uncached request was serialized")
+	}
+}
+
+func TestDisplayMetrics_Reconfigure(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour)
+	inm.IncrCounter([]string{"foo"}, 1)
+
+	// Reconfiguring a sink while it is displayed is safe, which the race
+	// detector checks
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for j := 0; j < 100; j++ {
+			inm.Reconfigure(time.Duration(j%2+1)*time.Minute, time.Hour)
+		}
+	}()
+	for j := 0; j < 100; j++ {
+		req := httptest.NewRequest("GET", "/?query=foo", nil)
+		if j%2 == 0 {
+			req = httptest.NewRequest("GET", "/", nil)
+		}
+		if _, err := inm.DisplayMetrics(nil, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	<-done
+}
+
+func TestDisplayMetrics_Window(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 24*time.Hour)
+	current := time.Now().Truncate(time.Hour)
+
+	// Three finished intervals and the current one, oldest first
+	for age := 3; age >= 0; age-- {
+		intv := NewIntervalMetrics(current.Add(-time.Duration(age) * time.Hour))
+		intv.rateDenom = inm.rateDenom
+		v := float64(age + 1)
+		intv.Gauges["g"] = GaugeValue{Name: "g", Value: float32(v)}
+		intv.Points["p"] = []float32{float32(v)}
+		for _, m := range []map[string]SampledValue{intv.Counters, intv.Samples} {
+			agg := &AggregateSample{}
+			agg.Ingest(v, intv.rateDenom)
+			agg.Ingest(10*v, intv.rateDenom)
+			m["s"] = SampledValue{Name: "s", AggregateSample: agg}
+		}
+		inm.intervals = append(inm.intervals, intv)
+	}
+
+	req := httptest.NewRequest("GET", "/?window=2h", nil)
+	raw, err := inm.DisplayMetrics(nil, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	summary := raw.(MetricsSummary)
+
+	// The two most recent finished intervals are merged
+	want := current.Add(-2 * time.Hour).Round(time.Second).UTC().String()
+	if summary.Timestamp != want {
+		t.Fatalf("bad timestamp: %s", summary.Timestamp)
+	}
+	if len(summary.Gauges) != 1 || summary.Gauges[0].Value != 2 {
+		t.Fatalf("bad gauges: %v", summary.Gauges)
+	}
+	verify.Values(t, "points", summary.Points, []PointValue{{Name: "p", Points: []float32{3, 2}}})
+
+	for _, s := range [][]SampledValue{summary.Counters, summary.Samples} {
+		agg := s[0].AggregateSample
+		if agg.Count != 4 || agg.Sum != 55 || agg.Min != 2 || agg.Max != 30 {
+			t.Fatalf("bad aggregate: %v", agg)
+		}
+		if agg.SumSq != 4+400+9+900 {
+			t.Fatalf("bad sum of squares: %v", agg.SumSq)
+		}
+		if rate := 55 / (2 * inm.rateDenom); agg.Rate != rate {
+			t.Fatalf("bad rate: %v, want %v", agg.Rate, rate)
+		}
+		if s[0].Mean != 55.0/4 {
+			t.Fatalf("bad mean: %v", s[0].Mean)
+		}
+	}
+
+	// The merged view must not change the retained intervals
+	if c := inm.intervals[1].Counters["s"]; c.Count != 2 || c.Sum != 33 {
+		t.Fatalf("interval modified: %v", c.AggregateSample)
+	}
+
+	// A window shorter than an interval shows the last finished one
+	req = httptest.NewRequest("GET", "/?window=1s", nil)
+	raw, err = inm.DisplayMetrics(nil, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if c := raw.(MetricsSummary).Counters[0]; c.Count != 2 || c.Sum != 22 {
+		t.Fatalf("bad counter: %v", c.AggregateSample)
+	}
+}
+
+func TestDisplayMetrics_BadWindow(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 24*time.Hour)
+	for _, param := range []string{"soon", "0s", "-1m"} {
+		req := httptest.NewRequest("GET", "/?window="+param, nil)
+		if _, err := inm.DisplayMetrics(nil, req); err == nil {
+			t.Fatalf("expected error for %q", param)
+		}
+	}
+}
+
+func TestDisplayMetrics_Prefix(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 24*time.Hour)
+	inm.SetDisplayPrefix("myservice")
+	inm.SetGauge([]string{"myservice", "queue", "depth"}, 1)
+	inm.EmitKey([]string{"myservice", "event"}, 2)
+	inm.IncrCounter([]string{"myservice", "requests"}, 3)
+	inm.AddSample([]string{"myservice", "latency"}, 4)
+	inm.SetGauge([]string{"myservicex", "other"}, 5)
+	inm.SetGauge([]string{"runtime", "goroutines"}, 6)
+	inm.SetGauge([]string{"myservice"}, 7)
+
+	result, err := inm.DisplayMetrics(nil, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	summary := result.(MetricsSummary)
+
+	var gauges []string
+	for _, g := range summary.Gauges {
+		gauges = append(gauges, g.Name)
+	}
+	// Only whole leading segments are stripped, and never the whole name
+	expect := []string{"myservice", "queue.depth", "myservicex.other", "runtime.goroutines"}
+	if !reflect.DeepEqual(gauges, expect) {
+		t.Fatalf("bad gauges: %v", gauges)
+	}
+	if summary.Points[0].Name != "event" || summary.Counters[0].Name != "requests" || summary.Samples[0].Name != "latency" {
+		t.Fatalf("bad summary: %v", summary)
+	}
+
+	// The stored metrics keep their names
+	if _, ok := inm.Data()[0].Gauges["myservice.queue.depth"]; !ok {
+		t.Fatalf("stored gauge should be unchanged")
+	}
+
+	// Without a prefix names are shown in full
+	inm.SetDisplayPrefix("")
+	result, _ = inm.DisplayMetrics(nil, nil)
+	if name := result.(MetricsSummary).Counters[0].Name; name != "myservice.requests" {
+		t.Fatalf("bad name: %v", name)
+	}
+}
+
+func TestDisplayMetrics_SampleDecimation(t *testing.T) {
+	inm := NewInmemSinkWithClock(time.Minute, time.Hour, NewFakeClock(time.Unix(6000, 0)))
+	inm.EnableSampleRetention(0)
+	if err := inm.EnableHDRHistograms(HDROpts{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := inm.EnableBucketHistograms([]float64{10}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	inm.SetSampleDecimation(3 * time.Minute)
+	for j := 0; j < 6; j++ {
+		inm.AddSample([]string{"latency"}, float32(j))
+		inm.ForceRollover()
+	}
+
+	display := func(query string) MetricsSummary {
+		t.Helper()
+		raw, err := inm.DisplayMetrics(nil, httptest.NewRequest("GET", "/"+query, nil))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return raw.(MetricsSummary)
+	}
+
+	// Recent intervals keep their detail
+	for _, query := range []string{"", "?window=3m"} {
+		summary := display(query)
+		sample := summary.Samples[0]
+		if summary.Decimated || sample.Quantiles == nil || sample.HDRHistogram == "" {
+			t.Fatalf("bad summary for %q: %+v", query, summary)
+		}
+	}
+
+	// Older ones keep their aggregates and buckets only
+	summary := display("?window=10m")
+	sample := summary.Samples[0]
+	if !summary.Decimated || sample.Quantiles != nil || sample.HDRHistogram != "" {
+		t.Fatalf("bad summary: %+v", summary)
+	}
+	if sample.Count != 6 || sample.Sum != 15 || sample.Max != 5 || sample.DisplayBuckets["10"] != 6 {
+		t.Fatalf("bad sample: %+v", sample)
+	}
+
+	// The stored metrics are unchanged, and decimation can be disabled
+	if len(inm.Data()[0].Samples["latency"].samples) != 1 {
+		t.Fatalf("stored samples were decimated")
+	}
+	inm.SetSampleDecimation(0)
+	if summary := display("?window=10m"); summary.Decimated || summary.Samples[0].Quantiles == nil {
+		t.Fatalf("bad summary: %+v", summary)
+	}
+}
+
+func TestDisplayMetrics_SubSecondTimestamp(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	inm := NewInmemSinkWithClock(100*time.Millisecond, time.Second, clock)
+
+	// Consecutive sub-second intervals are told apart
+	var stamps []string
+	for n := 0; n < 3; n++ {
+		inm.IncrCounter([]string{"c"}, 1)
+		inm.ForceRollover()
+		raw, err := inm.DisplayMetrics(nil, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		stamps = append(stamps, raw.(MetricsSummary).Timestamp)
+	}
+	expect := []string{
+		"2020-01-01 00:00:00.000 +0000 UTC",
+		"2020-01-01 00:00:00.100 +0000 UTC",
+		"2020-01-01 00:00:00.200 +0000 UTC",
+	}
+	if !reflect.DeepEqual(stamps, expect) {
+		t.Fatalf("bad timestamps: %v", stamps)
+	}
+
+	// Intervals of a second or longer keep second resolution
+	start := time.Date(2020, 1, 1, 0, 0, 1, 400*int(time.Millisecond), time.UTC)
+	if got := formatIntervalTimestamp(start, time.Second); got != "2020-01-01 00:00:01 +0000 UTC" {
+		t.Fatalf("bad timestamp: %s", got)
+	}
+	if got := formatIntervalTimestamp(start, 10*time.Millisecond); got != "2020-01-01 00:00:01.400 +0000 UTC" {
+		t.Fatalf("bad timestamp: %s", got)
+	}
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+)
+
+// AddGranularity makes the sink aggregate every emission a second time, in
+// intervals of the given length which are retained for retain, e.g. 1m
+// intervals for an hour next to the 10s intervals of the sink itself. The
+// key of an emission is only flattened once for all granularities, which is
+// cheaper than fanning out to several sinks.
+//
+// A granularity is displayed by DisplayMetrics with its name as the
+// 'granularity' query param, e.g. ?granularity=1m. It shares the clock,
+// sample retention, HDR histograms, counter keep-alive and derived rules of
+// the sink. Other readers of the sink, such as Data and Stream, only see the
+// intervals of the sink itself.
+func (i *InmemSink) AddGranularity(name string, interval, retain time.Duration) error {
+	if name == "" {
+		return fmt.Errorf("granularity name must not be empty")
+	}
+	if interval <= 0 || retain < interval {
+		return fmt.Errorf("granularity %q: interval must be positive and no longer than retain", name)
+	}
+
+	g := NewInmemSink(interval, retain)
+	g.clock = i.clock
+	i.intervalLock.RLock()
+	g.maxSamples = i.maxSamples
+	g.hdr = i.hdr
+	g.bucketBounds = i.bucketBounds
+	g.counterTTL = i.counterTTL
+	g.compact, g.compactMax = i.compact, i.compactMax
+	g.grace = i.grace
+	g.derivedRules = append([]DerivedRule(nil), i.derivedRules...)
+	g.topNRules = append([]TopNRule(nil), i.topNRules...)
+	i.intervalLock.RUnlock()
+
+	i.granularityLock.Lock()
+	defer i.granularityLock.Unlock()
+
+	for _, existing := range i.granularityNames {
+		if existing == name {
+			return fmt.Errorf("granularity %q already exists", name)
+		}
+	}
+	// Emitters iterate over the slices without holding the lock, so they
+	// are replaced rather than appended to in place.
+	i.granularityNames = append(i.granularityNames[:len(i.granularityNames):len(i.granularityNames)], name)
+	i.granularities = append(i.granularities[:len(i.granularities):len(i.granularities)], g)
+	return nil
+}
+
+// Granularities returns the names of the granularities added with
+// AddGranularity, in the order they were added.
+func (i *InmemSink) Granularities() []string {
+	i.granularityLock.RLock()
+	defer i.granularityLock.RUnlock()
+	return append([]string(nil), i.granularityNames...)
+}
+
+// granularitySinks returns the sinks aggregating the added granularities
+func (i *InmemSink) granularitySinks() []*InmemSink {
+	i.granularityLock.RLock()
+	defer i.granularityLock.RUnlock()
+	return i.granularities
+}
+
+// granularity returns the sink aggregating the named granularity, or nil if
+// there is none
+func (i *InmemSink) granularity(name string) *InmemSink {
+	i.granularityLock.RLock()
+	defer i.granularityLock.RUnlock()
+	for j, existing := range i.granularityNames {
+		if existing == name {
+			return i.granularities[j]
+		}
+	}
+	return nil
+}
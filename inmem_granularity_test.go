@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInmemSink_Granularity(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	inm := NewInmemSinkWithClock(10*time.Second, time.Minute, clock)
+	if err := inm.AddGranularity("1m", time.Minute, time.Hour); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// One sample, counter increment and key per 10s interval for a minute
+	for j := 1; j <= 6; j++ {
+		inm.AddSample([]string{"latency"}, float32(j))
+		inm.IncrCounter([]string{"requests"}, 1)
+		inm.EmitKey([]string{"event"}, float32(j))
+		inm.AdjustGauge([]string{"inflight"}, 1)
+		clock.Advance(10 * time.Second)
+	}
+	// Finish the minute for both granularities
+	inm.ForceRollover()
+
+	display := func(query string) MetricsSummary {
+		req := httptest.NewRequest("GET", "/"+query, nil)
+		result, err := inm.DisplayMetrics(nil, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return result.(MetricsSummary)
+	}
+
+	// The sink itself shows the last 10s
+	short := display("")
+	if s := short.Samples[0]; s.Count != 1 || s.Sum != 6 || s.Rate != 0.6 {
+		t.Fatalf("bad short sample: %v", s.AggregateSample)
+	}
+	if c := short.Counters[0]; c.Count != 1 || c.Rate != 0.1 {
+		t.Fatalf("bad short counter: %v", c.AggregateSample)
+	}
+	if p := short.Points[0].Points; !reflect.DeepEqual(p, []float32{6}) {
+		t.Fatalf("bad short points: %v", p)
+	}
+
+	// The granularity aggregates the whole minute
+	long := display("?granularity=1m")
+	if s := long.Samples[0]; s.Count != 6 || s.Sum != 21 || s.Min != 1 || s.Max != 6 || s.Mean != 3.5 {
+		t.Fatalf("bad long sample: %v", s.AggregateSample)
+	}
+	if c := long.Counters[0]; c.Count != 6 || c.Sum != 6 || c.Rate != 0.1 {
+		t.Fatalf("bad long counter: %v", c.AggregateSample)
+	}
+	if p := long.Points[0].Points; !reflect.DeepEqual(p, []float32{1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("bad long points: %v", p)
+	}
+	// Gauge adjustments accumulate within each granularity
+	if short.Gauges[0].Value != 6 || long.Gauges[0].Value != 6 {
+		t.Fatalf("bad gauges: %v %v", short.Gauges, long.Gauges)
+	}
+
+	// Windows apply to the intervals of the granularity
+	if s := display("?granularity=1m&window=1h").Samples[0]; s.Count != 6 {
+		t.Fatalf("bad windowed sample: %v", s.AggregateSample)
+	}
+
+	req := httptest.NewRequest("GET", "/?granularity=5m", nil)
+	if _, err := inm.DisplayMetrics(nil, req); err == nil {
+		t.Fatalf("expected error for unknown granularity")
+	}
+}
+
+func TestInmemSink_AddGranularity(t *testing.T) {
+	inm := NewInmemSink(time.Second, time.Minute)
+	inm.EnableSampleRetention(10)
+	if err := inm.AddGranularity("1m", time.Minute, time.Hour); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := inm.AddGranularity("10s", 10*time.Second, time.Hour); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if names := inm.Granularities(); !reflect.DeepEqual(names, []string{"1m", "10s"}) {
+		t.Fatalf("bad names: %v", names)
+	}
+
+	for _, tc := range []struct {
+		name             string
+		interval, retain time.Duration
+	}{
+		{"", time.Minute, time.Hour},
+		{"1m", time.Minute, time.Hour},
+		{"zero", 0, time.Hour},
+		{"short", time.Minute, time.Second},
+	} {
+		if err := inm.AddGranularity(tc.name, tc.interval, tc.retain); err == nil {
+			t.Fatalf("expected error for %q", tc.name)
+		}
+	}
+
+	// Settings of the sink apply to its granularities
+	inm.EnableCounterKeepAlive(time.Hour)
+	inm.AddSample([]string{"latency"}, 1)
+	g := inm.granularity("1m")
+	if g.counterTTL != time.Hour {
+		t.Fatalf("bad ttl: %v", g.counterTTL)
+	}
+	if agg := g.Data()[0].Samples["latency"]; len(agg.samples) != 1 {
+		t.Fatalf("expected retained sample: %v", agg)
+	}
+}
+
+func TestInmemSink_GranularityWindow(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	inm := NewInmemSinkWithClock(100*time.Millisecond, time.Minute, clock)
+	if err := inm.AddGranularity("1m", time.Minute, time.Hour); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for j := 0; j < 6; j++ {
+		inm.IncrCounter([]string{"requests"}, 1)
+		clock.Advance(10 * time.Second)
+	}
+
+	// The summary and query of a granularity follow its own interval
+	// length, not the one of the sink
+	expect := start.UTC().String()
+	req := httptest.NewRequest("GET", "/?granularity=1m", nil)
+	raw, err := inm.DisplayMetrics(nil, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	summary := raw.(MetricsSummary)
+	if summary.Timestamp != expect || summary.Counters[0].Rate != 0.1 {
+		t.Fatalf("bad summary %q %v", summary.Timestamp, summary.Counters[0].AggregateSample)
+	}
+	req = httptest.NewRequest("GET", "/?granularity=1m&query=sum(rate(requests))", nil)
+	raw, err = inm.DisplayMetrics(nil, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	result := raw.(QueryResult)
+	if result.Timestamp != expect || len(result.Series) != 1 || result.Series[0].Value != 0.1 {
+		t.Fatalf("bad result %+v", result)
+	}
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// InmemMux serves several named InmemSinks on sub-paths of a prefix, e.g.
+// sinks with 1s and 60s intervals fed from the same FanoutSink as
+// /metrics/fast and /metrics/slow. The prefix itself lists the names.
+type InmemMux struct {
+	prefix string
+	sinks  map[string]*InmemSink
+}
+
+// NewInmemMux creates an InmemMux serving sinks by name under prefix. The
+// names must not contain '/'.
+func NewInmemMux(prefix string, sinks map[string]*InmemSink) *InmemMux {
+	m := &InmemMux{
+		prefix: strings.TrimSuffix(prefix, "/"),
+		sinks:  make(map[string]*InmemSink, len(sinks)),
+	}
+	for name, sink := range sinks {
+		m.sinks[name] = sink
+	}
+	return m
+}
+
+// DisplayMetrics routes the request by path to the DisplayMetrics of the
+// named sink, passing on its query params, e.g. ?window=. At the prefix it
+// returns the sorted sink names instead. It has the signature of
+// InmemSink.DisplayMetrics so it can be served the same way.
+func (m *InmemMux) DisplayMetrics(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	name, ok := m.route(req)
+	if !ok {
+		return nil, errInmemMuxNotFound
+	}
+	if name == "" {
+		names := make([]string, 0, len(m.sinks))
+		for name := range m.sinks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+
+	sink, ok := m.sinks[name]
+	if !ok {
+		return nil, errInmemMuxNotFound
+	}
+	return sink.DisplayMetrics(resp, req)
+}
+
+// ServeHTTP serves DisplayMetrics results encoded as JSON. Unknown paths get
+// a 404, and other errors, such as a bad 'window' param, a 400.
+func (m *InmemMux) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	result, err := m.DisplayMetrics(resp, req)
+	if err == errInmemMuxNotFound {
+		http.NotFound(resp, req)
+		return
+	}
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(result); err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// errInmemMuxNotFound is returned for paths not matching a sink
+var errInmemMuxNotFound = fmt.Errorf("no metrics sink at this path")
+
+// route returns the sink name the request path is for, which is empty for
+// the prefix itself, and whether the path is under the prefix at all
+func (m *InmemMux) route(req *http.Request) (string, bool) {
+	if req == nil || req.URL == nil {
+		return "", false
+	}
+	path := req.URL.Path
+	if path == m.prefix || path == m.prefix+"/" {
+		return "", true
+	}
+	if !strings.HasPrefix(path, m.prefix+"/") {
+		return "", false
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(path, m.prefix+"/"), "/")
+	if name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInmemMux(t *testing.T) {
+	fast := NewInmemSink(time.Hour, 2*time.Hour)
+	slow := NewInmemSink(2*time.Hour, 4*time.Hour)
+	fast.SetGauge([]string{"fast"}, 1)
+	slow.SetGauge([]string{"slow"}, 2)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics/", NewInmemMux("/metrics", map[string]*InmemSink{
+		"fast": fast,
+		"slow": slow,
+	}))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	get := func(path string) (int, []byte) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer resp.Body.Close()
+		var raw json.RawMessage
+		json.NewDecoder(resp.Body).Decode(&raw)
+		return resp.StatusCode, raw
+	}
+
+	for path, expect := range map[string]string{
+		"/metrics/fast":  "fast",
+		"/metrics/slow/": "slow",
+	} {
+		code, raw := get(path)
+		if code != http.StatusOK {
+			t.Fatalf("%s: bad status %d", path, code)
+		}
+		var summary MetricsSummary
+		if err := json.Unmarshal(raw, &summary); err != nil {
+			t.Fatalf("%s: err: %v", path, err)
+		}
+		if len(summary.Gauges) != 1 || summary.Gauges[0].Name != expect {
+			t.Fatalf("%s: bad gauges: %v", path, summary.Gauges)
+		}
+	}
+
+	// The prefix lists the sinks
+	code, raw := get("/metrics/")
+	var names []string
+	json.Unmarshal(raw, &names)
+	if code != http.StatusOK || !reflect.DeepEqual(names, []string{"fast", "slow"}) {
+		t.Fatalf("bad listing %d: %s", code, raw)
+	}
+
+	for path, expect := range map[string]int{
+		"/metrics/missing":       http.StatusNotFound,
+		"/metrics/fast/extra":    http.StatusNotFound,
+		"/metrics/fast?window=":  http.StatusOK,
+		"/metrics/fast?window=x": http.StatusBadRequest,
+	} {
+		if code, _ := get(path); code != expect {
+			t.Fatalf("%s: expected status %d, got %d", path, expect, code)
+		}
+	}
+}
+
+func TestInmemMux_DisplayMetrics(t *testing.T) {
+	sink := NewInmemSink(time.Hour, 2*time.Hour)
+	sink.IncrCounter([]string{"c"}, 1)
+	m := NewInmemMux("/debug/metrics/", map[string]*InmemSink{"main": sink})
+
+	req := httptest.NewRequest("GET", "/debug/metrics/main", nil)
+	result, err := m.DisplayMetrics(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if summary := result.(MetricsSummary); len(summary.Counters) != 1 {
+		t.Fatalf("bad summary: %v", summary)
+	}
+
+	req = httptest.NewRequest("GET", "/other/main", nil)
+	if _, err := m.DisplayMetrics(httptest.NewRecorder(), req); err != errInmemMuxNotFound {
+		t.Fatalf("expected not found, got: %v", err)
+	}
+}
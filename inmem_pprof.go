@@ -0,0 +1,208 @@
+package metrics
+
+import (
+	"compress/gzip"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DisplayProfile writes the counters of the interval DisplayMetrics would
+// summarize as a gzipped pprof profile, which `go tool pprof` and other pprof
+// tooling can open, e.g. to view the counters as a flame graph. Each metric
+// is a sample whose stack holds the segments of its key, outermost first, so
+// the tooling aggregates every key prefix. The samples have two values, the
+// count of the emissions and their sum rounded to an integer, and the labels
+// of the metric as string labels. With a 'type=samples' query param it
+// writes the samples instead of the counters. The 'granularity' and 'window'
+// query params are the same as on DisplayMetrics.
+func (i *InmemSink) DisplayProfile(resp http.ResponseWriter, req *http.Request) {
+	values := func(intv *IntervalMetrics) map[string]SampledValue { return intv.Counters }
+	switch typ := req.URL.Query().Get("type"); typ {
+	case "", "counters":
+	case "samples":
+		values = func(intv *IntervalMetrics) map[string]SampledValue { return intv.Samples }
+	default:
+		http.Error(resp, fmt.Sprintf("Bad 'type' param: %q is neither counters nor samples", typ), http.StatusBadRequest)
+		return
+	}
+
+	interval, _, _, err := i.displayInterval(req)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prefix, _ := i.displaySettings()
+	interval.RLock()
+	profile := newProfileBuilder(interval.Interval, time.Duration(interval.rateDenom*float64(time.Second)))
+	source := values(interval)
+	keys := make([]string, 0, len(source))
+	for k := range source {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := source[k]
+		profile.addSample(stripNamePrefix(v.Name, prefix), v.AggregateSample, v.Labels)
+	}
+	interval.RUnlock()
+
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.Header().Set("Content-Disposition", `attachment; filename="metrics.pb.gz"`)
+	zw := gzip.NewWriter(resp)
+	if _, err := zw.Write(profile.encode()); err != nil {
+		return
+	}
+	zw.Close()
+}
+
+// Field numbers of the messages of the pprof profile.proto
+const (
+	pprofProfileSampleType    = 1
+	pprofProfileSample        = 2
+	pprofProfileLocation      = 4
+	pprofProfileFunction      = 5
+	pprofProfileStringTable   = 6
+	pprofProfileTimeNanos     = 9
+	pprofProfileDurationNanos = 10
+
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	pprofSampleLocationID = 1
+	pprofSampleValue      = 2
+	pprofSampleLabel      = 3
+
+	pprofLabelKey = 1
+	pprofLabelStr = 2
+
+	pprofLocationID   = 1
+	pprofLocationLine = 4
+
+	pprofLineFunctionID = 1
+
+	pprofFunctionID   = 1
+	pprofFunctionName = 2
+)
+
+// profileBuilder accumulates the messages of a pprof profile. Every key
+// prefix gets a function and a location of the same id.
+type profileBuilder struct {
+	start    time.Time
+	duration time.Duration
+
+	strings   []string
+	stringIDs map[string]int64
+	prefixIDs map[string]uint64
+	prefixes  []string
+	samples   [][]byte
+}
+
+func newProfileBuilder(start time.Time, duration time.Duration) *profileBuilder {
+	p := &profileBuilder{
+		start:     start,
+		duration:  duration,
+		stringIDs: make(map[string]int64),
+		prefixIDs: make(map[string]uint64),
+	}
+	// The string table starts with the empty string
+	p.stringID("")
+	return p
+}
+
+// stringID returns the index of s in the string table, adding it if needed
+func (p *profileBuilder) stringID(s string) int64 {
+	id, ok := p.stringIDs[s]
+	if !ok {
+		id = int64(len(p.strings))
+		p.strings = append(p.strings, s)
+		p.stringIDs[s] = id
+	}
+	return id
+}
+
+// addSample adds a sample for the metric name, with labels
+func (p *profileBuilder) addSample(name string, agg *AggregateSample, labels []Label) {
+	// The stack is listed from the leaf, which is the full name
+	segments := strings.Split(name, ".")
+	var locations []byte
+	for j := len(segments); j > 0; j-- {
+		prefix := strings.Join(segments[:j], ".")
+		id, ok := p.prefixIDs[prefix]
+		if !ok {
+			id = uint64(len(p.prefixes) + 1)
+			p.prefixes = append(p.prefixes, prefix)
+			p.prefixIDs[prefix] = id
+		}
+		locations = appendUvarint(locations, id)
+	}
+
+	var values []byte
+	values = appendUvarint(values, uint64(agg.Count))
+	values = appendUvarint(values, uint64(int64(math.Round(agg.Sum))))
+
+	var sample []byte
+	sample = appendProtoBytes(sample, pprofSampleLocationID, locations)
+	sample = appendProtoBytes(sample, pprofSampleValue, values)
+
+	for _, l := range labels {
+		var label []byte
+		label = appendProtoVarint(label, pprofLabelKey, uint64(p.stringID(l.Name)))
+		label = appendProtoVarint(label, pprofLabelStr, uint64(p.stringID(l.Value)))
+		sample = appendProtoBytes(sample, pprofSampleLabel, label)
+	}
+	p.samples = append(p.samples, sample)
+}
+
+// encode returns the encoded Profile message
+func (p *profileBuilder) encode() []byte {
+	var buf []byte
+	for _, typ := range [][2]string{{"count", "count"}, {"sum", ""}} {
+		var valueType []byte
+		valueType = appendProtoVarint(valueType, pprofValueTypeType, uint64(p.stringID(typ[0])))
+		valueType = appendProtoVarint(valueType, pprofValueTypeUnit, uint64(p.stringID(typ[1])))
+		buf = appendProtoBytes(buf, pprofProfileSampleType, valueType)
+	}
+	for _, sample := range p.samples {
+		buf = appendProtoBytes(buf, pprofProfileSample, sample)
+	}
+
+	for j, prefix := range p.prefixes {
+		id := uint64(j + 1)
+		var line, location, function []byte
+		line = appendProtoVarint(line, pprofLineFunctionID, id)
+		location = appendProtoVarint(location, pprofLocationID, id)
+		location = appendProtoBytes(location, pprofLocationLine, line)
+		buf = appendProtoBytes(buf, pprofProfileLocation, location)
+
+		function = appendProtoVarint(function, pprofFunctionID, id)
+		function = appendProtoVarint(function, pprofFunctionName, uint64(p.stringID(prefix)))
+		buf = appendProtoBytes(buf, pprofProfileFunction, function)
+	}
+
+	buf = appendProtoVarint(buf, pprofProfileTimeNanos, uint64(p.start.UnixNano()))
+	buf = appendProtoVarint(buf, pprofProfileDurationNanos, uint64(p.duration))
+
+	// Strings are added by the messages above, so the table comes last
+	for _, s := range p.strings {
+		buf = appendProtoBytes(buf, pprofProfileStringTable, []byte(s))
+	}
+	return buf
+}
+
+// appendProtoVarint appends a varint field to a protobuf message
+func appendProtoVarint(buf []byte, field int, v uint64) []byte {
+	buf = appendUvarint(buf, uint64(field)<<3)
+	return appendUvarint(buf, v)
+}
+
+// appendProtoBytes appends a length-delimited field to a protobuf message
+func appendProtoBytes(buf []byte, field int, b []byte) []byte {
+	buf = appendUvarint(buf, uint64(field)<<3|2)
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
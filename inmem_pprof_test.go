@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// The messages of the pprof profile.proto used by DisplayProfile, decoded
+// with the reflection based unmarshaling of the protobuf package
+
+type pprofProfile struct {
+	SampleType    []*pprofValueType `protobuf:"bytes,1,rep,name=sample_type"`
+	Sample        []*pprofSample    `protobuf:"bytes,2,rep,name=sample"`
+	Location      []*pprofLocation  `protobuf:"bytes,4,rep,name=location"`
+	Function      []*pprofFunction  `protobuf:"bytes,5,rep,name=function"`
+	StringTable   []string          `protobuf:"bytes,6,rep,name=string_table"`
+	TimeNanos     int64             `protobuf:"varint,9,opt,name=time_nanos"`
+	DurationNanos int64             `protobuf:"varint,10,opt,name=duration_nanos"`
+}
+
+type pprofValueType struct {
+	Type int64 `protobuf:"varint,1,opt,name=type"`
+	Unit int64 `protobuf:"varint,2,opt,name=unit"`
+}
+
+type pprofSample struct {
+	LocationID []uint64      `protobuf:"varint,1,rep,packed,name=location_id"`
+	Value      []int64       `protobuf:"varint,2,rep,packed,name=value"`
+	Label      []*pprofLabel `protobuf:"bytes,3,rep,name=label"`
+}
+
+type pprofLabel struct {
+	Key int64 `protobuf:"varint,1,opt,name=key"`
+	Str int64 `protobuf:"varint,2,opt,name=str"`
+}
+
+type pprofLocation struct {
+	ID   uint64       `protobuf:"varint,1,opt,name=id"`
+	Line []*pprofLine `protobuf:"bytes,4,rep,name=line"`
+}
+
+type pprofLine struct {
+	FunctionID uint64 `protobuf:"varint,1,opt,name=function_id"`
+}
+
+type pprofFunction struct {
+	ID   uint64 `protobuf:"varint,1,opt,name=id"`
+	Name int64  `protobuf:"varint,2,opt,name=name"`
+}
+
+func (p *pprofProfile) Reset()         { *p = pprofProfile{} }
+func (p *pprofProfile) String() string { return proto.CompactTextString(p) }
+func (*pprofProfile) ProtoMessage()    {}
+
+func (v *pprofValueType) Reset()         { *v = pprofValueType{} }
+func (v *pprofValueType) String() string { return proto.CompactTextString(v) }
+func (*pprofValueType) ProtoMessage()    {}
+
+func (s *pprofSample) Reset()         { *s = pprofSample{} }
+func (s *pprofSample) String() string { return proto.CompactTextString(s) }
+func (*pprofSample) ProtoMessage()    {}
+
+func (l *pprofLabel) Reset()         { *l = pprofLabel{} }
+func (l *pprofLabel) String() string { return proto.CompactTextString(l) }
+func (*pprofLabel) ProtoMessage()    {}
+
+func (l *pprofLocation) Reset()         { *l = pprofLocation{} }
+func (l *pprofLocation) String() string { return proto.CompactTextString(l) }
+func (*pprofLocation) ProtoMessage()    {}
+
+func (l *pprofLine) Reset()         { *l = pprofLine{} }
+func (l *pprofLine) String() string { return proto.CompactTextString(l) }
+func (*pprofLine) ProtoMessage()    {}
+
+func (f *pprofFunction) Reset()         { *f = pprofFunction{} }
+func (f *pprofFunction) String() string { return proto.CompactTextString(f) }
+func (*pprofFunction) ProtoMessage()    {}
+
+// fetchProfile requests the profile of inm at url and decodes it
+func fetchProfile(t *testing.T, inm *InmemSink, url string) *pprofProfile {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	inm.DisplayProfile(recorder, httptest.NewRequest("GET", url, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("bad status: %d %s", recorder.Code, recorder.Body.String())
+	}
+	zr, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	profile := &pprofProfile{}
+	if err := proto.Unmarshal(data, profile); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return profile
+}
+
+// resolvedSample is a sample of a decoded profile with its ids resolved
+type resolvedSample struct {
+	Stack  []string
+	Values []int64
+	Labels map[string]string
+}
+
+// resolveSamples resolves the locations and strings of the samples of p
+func resolveSamples(t *testing.T, p *pprofProfile) []resolvedSample {
+	t.Helper()
+	if len(p.StringTable) == 0 || p.StringTable[0] != "" {
+		t.Fatalf("bad string table: %q", p.StringTable)
+	}
+	functions := make(map[uint64]string)
+	for _, f := range p.Function {
+		functions[f.ID] = p.StringTable[f.Name]
+	}
+	locations := make(map[uint64]string)
+	for _, l := range p.Location {
+		locations[l.ID] = functions[l.Line[0].FunctionID]
+	}
+
+	var samples []resolvedSample
+	for _, s := range p.Sample {
+		sample := resolvedSample{Values: s.Value}
+		for _, id := range s.LocationID {
+			sample.Stack = append(sample.Stack, locations[id])
+		}
+		for _, l := range s.Label {
+			if sample.Labels == nil {
+				sample.Labels = make(map[string]string)
+			}
+			sample.Labels[p.StringTable[l.Key]] = p.StringTable[l.Str]
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+func TestInmemSink_DisplayProfile(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	inm := NewInmemSinkWithClock(10*time.Second, time.Minute, clock)
+	inm.IncrCounterWithLabels([]string{"api", "http", "requests"}, 1, []Label{{"method", "GET"}})
+	inm.IncrCounterWithLabels([]string{"api", "http", "requests"}, 2.4, []Label{{"method", "GET"}})
+	inm.IncrCounter([]string{"api", "errors"}, 5)
+	inm.AddSample([]string{"api", "latency"}, 12)
+
+	profile := fetchProfile(t, inm, "/v1/metrics/profile")
+	if len(profile.SampleType) != 2 || profile.StringTable[profile.SampleType[0].Type] != "count" ||
+		profile.StringTable[profile.SampleType[1].Type] != "sum" {
+		t.Fatalf("bad sample types: %v", profile.SampleType)
+	}
+	if profile.TimeNanos != time.Unix(1000, 0).UnixNano() || profile.DurationNanos != int64(10*time.Second) {
+		t.Fatalf("bad time: %d %d", profile.TimeNanos, profile.DurationNanos)
+	}
+
+	samples := resolveSamples(t, profile)
+	expect := []resolvedSample{
+		{Stack: []string{"api.errors", "api"}, Values: []int64{1, 5}},
+		{Stack: []string{"api.http.requests", "api.http", "api"}, Values: []int64{2, 3}, Labels: map[string]string{"method": "GET"}},
+	}
+	if !reflect.DeepEqual(samples, expect) {
+		t.Fatalf("bad samples:\n%+v\nexpected:\n%+v", samples, expect)
+	}
+
+	// Samples are rendered on request
+	samples = resolveSamples(t, fetchProfile(t, inm, "/v1/metrics/profile?type=samples"))
+	expect = []resolvedSample{{Stack: []string{"api.latency", "api"}, Values: []int64{1, 12}}}
+	if !reflect.DeepEqual(samples, expect) {
+		t.Fatalf("bad samples:\n%+v\nexpected:\n%+v", samples, expect)
+	}
+}
+
+func TestInmemSink_DisplayProfileParams(t *testing.T) {
+	inm := NewInmemSink(10*time.Second, time.Minute)
+	inm.SetDisplayPrefix("service")
+	inm.IncrCounter([]string{"service", "requests"}, 1)
+
+	// The display prefix is stripped
+	samples := resolveSamples(t, fetchProfile(t, inm, "/?window=30s"))
+	if len(samples) != 1 || !reflect.DeepEqual(samples[0].Stack, []string{"requests"}) {
+		t.Fatalf("bad samples: %+v", samples)
+	}
+
+	for _, url := range []string{"/?type=gauges", "/?window=-1s", "/?granularity=1m"} {
+		recorder := httptest.NewRecorder()
+		inm.DisplayProfile(recorder, httptest.NewRequest("GET", url, nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s: bad status: %d", url, recorder.Code)
+		}
+	}
+}
@@ -35,7 +35,7 @@ func NewInmemSignal(inmem *InmemSink, sig syscall.Signal, w io.Writer) *InmemSig
 		stopCh: make(chan struct{}),
 	}
 	signal.Notify(i.sigCh, sig)
-	go i.run()
+	goCounted(i.run)
 	return i
 }
 
@@ -0,0 +1,327 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// inmemSnapshotMagic starts every snapshot, followed by the version byte
+const inmemSnapshotMagic = "\x00MINM"
+
+// inmemSnapshotVersion is the version of the snapshots written by Snapshot.
+// It is bumped whenever the encoding changes, and Restore rejects versions
+// it doesn't know.
+const inmemSnapshotVersion byte = 1
+
+// A snapshot is inmemSnapshotMagic and the version byte, followed by a
+// uvarint interval count and the intervals, oldest first. Each interval is:
+//
+//	start     8 bytes, little endian Unix time in nanoseconds
+//	gauges    uvarint count, then each key, name, value, once flag, labels
+//	points    uvarint count, then each key and its uvarint value count and values
+//	counters  uvarint count, then each key, name, labels and aggregate
+//	samples   as counters
+//
+// with values as 4 byte float32 bits, labels and strings encoded as in WAL
+// records, and the once flag a single byte. An aggregate is:
+//
+//	count         uvarint
+//	rate, sum, sum of squares, min, max
+//	              8 bytes each, little endian IEEE 754 float64 bits
+//	last updated  8 bytes, Unix time in nanoseconds, zero if unset
+//	buckets       uvarint count, then each bound as float64 bits and count
+//	              as uvarint
+//	samples       uvarint count of retained raw values, then each as float64
+//	              bits
+//	histogram     HDR histogram as returned by Encode, empty if none
+
+// Snapshot returns the intervals retained by the sink in a binary encoding,
+// which Restore loads back, e.g. to keep the aggregated metrics of a process
+// across a restart. Intervals of granularities added with AddGranularity
+// are not included.
+func (i *InmemSink) Snapshot() ([]byte, error) {
+	data := i.Data()
+
+	buf := append([]byte(inmemSnapshotMagic), inmemSnapshotVersion)
+	buf = appendUvarint(buf, uint64(len(data)))
+	for _, intv := range data {
+		var err error
+		intv.RLock()
+		buf, err = appendSnapshotInterval(buf, intv)
+		intv.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// Restore replaces the intervals of the sink with those of a snapshot
+// returned by Snapshot, possibly by another process. Intervals beyond the
+// retain window of the sink are dropped, and the rates of restored counters
+// and samples are kept as they were when the snapshot was taken. The sink is
+// left untouched if the snapshot is malformed or of an unknown version.
+func (i *InmemSink) Restore(snapshot []byte) error {
+	if len(snapshot) < len(inmemSnapshotMagic)+1 || string(snapshot[:len(inmemSnapshotMagic)]) != inmemSnapshotMagic {
+		return fmt.Errorf("not an inmem sink snapshot")
+	}
+	if version := snapshot[len(inmemSnapshotMagic)]; version != inmemSnapshotVersion {
+		return fmt.Errorf("unsupported inmem sink snapshot version %d, expected %d", version, inmemSnapshotVersion)
+	}
+
+	i.intervalLock.RLock()
+	maxSamples, hdr, bucketBounds, rateDenom := i.maxSamples, i.hdr, i.bucketBounds, i.rateDenom
+	i.intervalLock.RUnlock()
+
+	d := walDecoder{buf: snapshot[len(inmemSnapshotMagic)+1:]}
+	intervals := make([]*IntervalMetrics, d.readCount())
+	for j := range intervals {
+		intv, err := readSnapshotInterval(&d, maxSamples)
+		if err != nil {
+			return err
+		}
+		if j > 0 && !intv.Interval.After(intervals[j-1].Interval) {
+			return fmt.Errorf("malformed inmem sink snapshot: intervals out of order")
+		}
+		intv.hdr = hdr
+		intv.bucketBounds = bucketBounds
+		intv.rateDenom = rateDenom
+		intervals[j] = intv
+	}
+	if d.err || len(d.buf) != 0 {
+		return fmt.Errorf("malformed inmem sink snapshot")
+	}
+
+	// Only the latest interval may still be current
+	for j := 0; j < len(intervals)-1; j++ {
+		close(intervals[j].done)
+	}
+
+	i.intervalLock.Lock()
+	defer i.intervalLock.Unlock()
+	i.intervals = intervals
+	i.prune(i.now())
+	return nil
+}
+
+// appendSnapshotInterval appends the encoding of intv to buf. The caller
+// must hold the lock of intv.
+func appendSnapshotInterval(buf []byte, intv *IntervalMetrics) ([]byte, error) {
+	buf = appendSnapshotTime(buf, intv.Interval)
+
+	keys := make([]string, 0, len(intv.Gauges))
+	for k := range intv.Gauges {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf = appendUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		gauge := intv.Gauges[k]
+		buf = appendWALString(buf, k)
+		buf = appendWALString(buf, gauge.Name)
+		buf = appendSnapshotFloat32(buf, gauge.Value)
+		if gauge.once {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		buf = appendSnapshotLabels(buf, gauge.Labels)
+	}
+
+	keys = make([]string, 0, len(intv.Points))
+	for k := range intv.Points {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf = appendUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		buf = appendWALString(buf, k)
+		buf = appendUvarint(buf, uint64(len(intv.Points[k])))
+		for _, v := range intv.Points[k] {
+			buf = appendSnapshotFloat32(buf, v)
+		}
+	}
+
+	var err error
+	if buf, err = appendSnapshotSampledValues(buf, intv.Counters); err != nil {
+		return nil, err
+	}
+	return appendSnapshotSampledValues(buf, intv.Samples)
+}
+
+// appendSnapshotSampledValues appends the encoding of the counters or
+// samples in values to buf
+func appendSnapshotSampledValues(buf []byte, values map[string]SampledValue) ([]byte, error) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf = appendUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		v := values[k]
+		buf = appendWALString(buf, k)
+		buf = appendWALString(buf, v.Name)
+		buf = appendSnapshotLabels(buf, v.Labels)
+
+		agg := v.AggregateSample
+		buf = appendUvarint(buf, uint64(agg.Count))
+		for _, f := range []float64{agg.Rate, agg.Sum, agg.SumSq, agg.Min, agg.Max} {
+			buf = appendSnapshotFloat64(buf, f)
+		}
+		buf = appendSnapshotTime(buf, agg.LastUpdated)
+
+		bounds := make([]float64, 0, len(agg.Buckets))
+		for bound := range agg.Buckets {
+			bounds = append(bounds, bound)
+		}
+		sort.Float64s(bounds)
+		buf = appendUvarint(buf, uint64(len(bounds)))
+		for _, bound := range bounds {
+			buf = appendSnapshotFloat64(buf, bound)
+			buf = appendUvarint(buf, agg.Buckets[bound])
+		}
+
+		buf = appendUvarint(buf, uint64(len(agg.samples)))
+		for _, s := range agg.samples {
+			buf = appendSnapshotFloat64(buf, s)
+		}
+
+		var histogram string
+		if agg.histogram != nil {
+			var err error
+			if histogram, err = agg.histogram.Encode(); err != nil {
+				return nil, fmt.Errorf("failed to encode histogram of %q: %s", k, err)
+			}
+		}
+		buf = appendWALString(buf, histogram)
+	}
+	return buf, nil
+}
+
+// readSnapshotInterval decodes an interval written by
+// appendSnapshotInterval, retaining up to maxSamples raw values of samples
+func readSnapshotInterval(d *walDecoder, maxSamples int) (*IntervalMetrics, error) {
+	intv := NewIntervalMetrics(readSnapshotTime(d))
+	intv.maxSamples = maxSamples
+
+	for n := d.readCount(); n > 0; n-- {
+		k := d.readString()
+		gauge := GaugeValue{Name: d.readString()}
+		gauge.Value = math.Float32frombits(d.readUint32())
+		gauge.once = d.readByte() == 1
+		gauge.Labels = readSnapshotLabels(d)
+		intv.Gauges[k] = gauge
+	}
+
+	for n := d.readCount(); n > 0; n-- {
+		k := d.readString()
+		points := make([]float32, d.readCount())
+		for j := range points {
+			points[j] = math.Float32frombits(d.readUint32())
+		}
+		intv.Points[k] = points
+	}
+
+	for _, values := range []map[string]SampledValue{intv.Counters, intv.Samples} {
+		for n := d.readCount(); n > 0; n-- {
+			k := d.readString()
+			v := SampledValue{Name: d.readString(), AggregateSample: &AggregateSample{maxSamples: maxSamples}}
+			v.Labels = readSnapshotLabels(d)
+
+			agg := v.AggregateSample
+			agg.Count = int(d.readUvarint())
+			for _, f := range []*float64{&agg.Rate, &agg.Sum, &agg.SumSq, &agg.Min, &agg.Max} {
+				*f = math.Float64frombits(d.readUint64())
+			}
+			agg.LastUpdated = readSnapshotTime(d)
+
+			if n := d.readCount(); n > 0 {
+				agg.Buckets = make(map[float64]uint64, n)
+				for ; n > 0; n-- {
+					bound := math.Float64frombits(d.readUint64())
+					agg.Buckets[bound] = d.readUvarint()
+				}
+			}
+
+			if n := d.readCount(); n > 0 {
+				agg.samples = make([]float64, n)
+				for j := range agg.samples {
+					agg.samples[j] = math.Float64frombits(d.readUint64())
+				}
+				if maxSamples > 0 && len(agg.samples) > maxSamples {
+					agg.samples = agg.samples[:maxSamples]
+				}
+			}
+
+			if histogram := d.readString(); histogram != "" {
+				h, err := DecodeHDRHistogram(histogram)
+				if err != nil {
+					return nil, fmt.Errorf("malformed inmem sink snapshot: histogram of %q: %s", k, err)
+				}
+				agg.histogram = h
+			}
+			values[k] = v
+		}
+	}
+
+	if d.err {
+		return nil, fmt.Errorf("malformed inmem sink snapshot")
+	}
+	return intv, nil
+}
+
+func appendSnapshotLabels(buf []byte, labels []Label) []byte {
+	buf = appendUvarint(buf, uint64(len(labels)))
+	for _, label := range labels {
+		buf = appendWALString(buf, label.Name)
+		buf = appendWALString(buf, label.Value)
+	}
+	return buf
+}
+
+func readSnapshotLabels(d *walDecoder) []Label {
+	n := d.readCount()
+	if n == 0 {
+		return nil
+	}
+	labels := make([]Label, n)
+	for j := range labels {
+		labels[j].Name = d.readString()
+		labels[j].Value = d.readString()
+	}
+	return labels
+}
+
+func appendSnapshotFloat32(buf []byte, v float32) []byte {
+	var bits [4]byte
+	binary.LittleEndian.PutUint32(bits[:], math.Float32bits(v))
+	return append(buf, bits[:]...)
+}
+
+func appendSnapshotFloat64(buf []byte, v float64) []byte {
+	var bits [8]byte
+	binary.LittleEndian.PutUint64(bits[:], math.Float64bits(v))
+	return append(buf, bits[:]...)
+}
+
+// appendSnapshotTime appends t as Unix nanoseconds, or zero for the zero time
+func appendSnapshotTime(buf []byte, t time.Time) []byte {
+	var bits [8]byte
+	if !t.IsZero() {
+		binary.LittleEndian.PutUint64(bits[:], uint64(t.UnixNano()))
+	}
+	return append(buf, bits[:]...)
+}
+
+func readSnapshotTime(d *walDecoder) time.Time {
+	nanos := int64(d.readUint64())
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInmemSink_SnapshotRestore(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	inm := NewInmemSinkWithClock(10*time.Second, time.Minute, clock)
+	inm.EnableSampleRetention(10)
+	if err := inm.EnableHDRHistograms(HDROpts{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	labels := []Label{{"a", "b"}}
+	inm.SetGauge([]string{"gauge"}, 1)
+	inm.IncrCounterWithLabels([]string{"counter"}, 2, labels)
+	inm.ForceRollover()
+	inm.SetGaugeOnce([]string{"marker"}, 3, nil)
+	inm.EmitKey([]string{"kv"}, 4)
+	inm.IncrCounterWithLabels([]string{"counter"}, 5, labels)
+	inm.AddSample([]string{"sample"}, 6)
+	inm.AddSample([]string{"sample"}, 8)
+	inm.ObserveBuckets([]string{"sample"}, map[float64]uint64{1: 2, 10: 3}, nil)
+
+	snapshot, err := inm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	restored := NewInmemSinkWithClock(10*time.Second, time.Minute, clock)
+	restored.EnableSampleRetention(10)
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expect, got := inm.Data(), restored.Data()
+	if len(got) != 2 {
+		t.Fatalf("bad intervals: %d", len(got))
+	}
+	for j := range expect {
+		if !got[j].Interval.Equal(expect[j].Interval) {
+			t.Fatalf("bad interval: %v", got[j].Interval)
+		}
+		if !reflect.DeepEqual(got[j].Gauges, expect[j].Gauges) {
+			t.Fatalf("bad gauges: %v", got[j].Gauges)
+		}
+		if !reflect.DeepEqual(got[j].Points, expect[j].Points) {
+			t.Fatalf("bad points: %v", got[j].Points)
+		}
+		for _, values := range [][2]map[string]SampledValue{
+			{got[j].Counters, expect[j].Counters},
+			{got[j].Samples, expect[j].Samples},
+		} {
+			if len(values[0]) != len(values[1]) {
+				t.Fatalf("bad values: %v", values[0])
+			}
+			for k, e := range values[1] {
+				g := values[0][k]
+				if g.Name != e.Name || !reflect.DeepEqual(g.Labels, e.Labels) {
+					t.Fatalf("bad value %q: %+v", k, g)
+				}
+				if g.Count != e.Count || g.Rate != e.Rate || g.Sum != e.Sum || g.SumSq != e.SumSq ||
+					g.Min != e.Min || g.Max != e.Max || !g.LastUpdated.Equal(e.LastUpdated) {
+					t.Fatalf("bad aggregate %q: %v, expected %v", k, g.AggregateSample, e.AggregateSample)
+				}
+				if !reflect.DeepEqual(g.Buckets, e.Buckets) || !reflect.DeepEqual(g.samples, e.samples) {
+					t.Fatalf("bad buckets or samples %q: %v %v", k, g.Buckets, g.samples)
+				}
+				if (g.histogram == nil) != (e.histogram == nil) ||
+					(g.histogram != nil && g.histogram.TotalCount() != e.histogram.TotalCount()) {
+					t.Fatalf("bad histogram %q", k)
+				}
+			}
+		}
+	}
+
+	// The restored sink keeps aggregating into the current interval, and
+	// gauges set once are not carried forward
+	restored.IncrCounterWithLabels([]string{"counter"}, 1, labels)
+	if c := restored.Data()[1].Counters["counter;a=b"]; c.Count != 2 || c.Sum != 6 {
+		t.Fatalf("bad counter: %v", c.AggregateSample)
+	}
+	restored.ForceRollover()
+	restored.AdjustGauge([]string{"marker"}, 1)
+	if g := restored.Data()[2].Gauges["marker"]; g.Value != 1 {
+		t.Fatalf("bad gauge: %v", g.Value)
+	}
+}
+
+func TestInmemSink_RestoreRetain(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	inm := NewInmemSinkWithClock(10*time.Second, time.Minute, clock)
+	for j := 0; j < 6; j++ {
+		inm.IncrCounter([]string{"counter"}, 1)
+		inm.ForceRollover()
+	}
+	snapshot, err := inm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Intervals beyond the retain window of the restoring sink are dropped
+	restored := NewInmemSinkWithClock(10*time.Second, 30*time.Second, clock)
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data := restored.Data()
+	if len(data) != 3 || !data[2].Interval.Equal(clock.Now().Truncate(10*time.Second)) {
+		t.Fatalf("bad intervals: %d", len(data))
+	}
+}
+
+func TestInmemSink_RestoreInvalid(t *testing.T) {
+	inm := NewInmemSink(10*time.Second, time.Minute)
+	inm.IncrCounter([]string{"counter"}, 1)
+	snapshot, err := inm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	newer := append([]byte(nil), snapshot...)
+	newer[len(inmemSnapshotMagic)] = inmemSnapshotVersion + 1
+
+	cases := map[string][]byte{
+		"empty":     nil,
+		"not":       []byte(`{"Counters":{}}`),
+		"version":   newer,
+		"truncated": snapshot[:len(snapshot)-1],
+		"trailing":  append(append([]byte(nil), snapshot...), 0),
+	}
+	for name, data := range cases {
+		restored := NewInmemSink(10*time.Second, time.Minute)
+		restored.IncrCounter([]string{"existing"}, 1)
+		err := restored.Restore(data)
+		if err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+		if name == "version" && !strings.Contains(err.Error(), "version") {
+			t.Fatalf("%s: bad error: %v", name, err)
+		}
+		// The sink is left untouched
+		if _, ok := restored.Data()[0].Counters["existing"]; !ok {
+			t.Fatalf("%s: sink was modified", name)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package metrics
 import (
 	"math"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -147,6 +148,28 @@ func TestNewInmemSinkFromURL(t *testing.T) {
 			input:     "inmem://?interval=30s&retain=HELLO",
 			expectErr: "Bad 'retain' param",
 		},
+		{
+			desc:           "grace is optional",
+			input:          "inmem://?interval=11s&retain=22s&grace=5s",
+			expectInterval: duration(t, "11s"),
+			expectRetain:   duration(t, "22s"),
+		},
+		{
+			desc:      "grace must be a valid duration",
+			input:     "inmem://?interval=30s&retain=1m&grace=SOON",
+			expectErr: "Bad 'grace' param",
+		},
+		{
+			desc:           "buckets selects a bucket scheme",
+			input:          "inmem://?interval=11s&retain=22s&buckets=latency-ms",
+			expectInterval: duration(t, "11s"),
+			expectRetain:   duration(t, "22s"),
+		},
+		{
+			desc:      "buckets must name a bucket scheme",
+			input:     "inmem://?interval=30s&retain=1m&buckets=latency-days",
+			expectErr: "Bad 'buckets' param",
+		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
 			u, err := url.Parse(tc.input)
@@ -188,3 +211,418 @@ func duration(t *testing.T, s string) time.Duration {
 	}
 	return dur
 }
+
+func TestInmemSink_AdjustGauge(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	inm := NewInmemSinkWithClock(10*time.Millisecond, 50*time.Millisecond, clock)
+
+	// Deltas on an unknown gauge start from zero
+	inm.AdjustGauge([]string{"foo"}, 5)
+	inm.AdjustGauge([]string{"foo"}, -2)
+	inm.AdjustGaugeWithLabels([]string{"foo"}, 7, []Label{{"a", "b"}})
+
+	data := inm.Data()
+	intvM := data[len(data)-1]
+	if v := intvM.Gauges["foo"].Value; v != 3 {
+		t.Fatalf("bad val: %v", v)
+	}
+	if v := intvM.Gauges["foo;a=b"].Value; v != 7 {
+		t.Fatalf("bad val: %v", v)
+	}
+
+	// An absolute set overrides the running value
+	inm.SetGauge([]string{"foo"}, 10)
+	inm.AdjustGauge([]string{"foo"}, 1)
+	data = inm.Data()
+	intvM = data[len(data)-1]
+	if v := intvM.Gauges["foo"].Value; v != 11 {
+		t.Fatalf("bad val: %v", v)
+	}
+
+	// The running value is carried into the next interval
+	inm.ForceRollover()
+	inm.AdjustGauge([]string{"foo"}, 4)
+	data = inm.Data()
+	if len(data) != 2 {
+		t.Fatalf("bad: %v", data)
+	}
+	intvM = data[len(data)-1]
+	if v := intvM.Gauges["foo"].Value; v != 15 {
+		t.Fatalf("bad val: %v", v)
+	}
+	if _, ok := intvM.Gauges["foo;a=b"]; ok {
+		t.Fatalf("untouched gauge should not be carried: %v", intvM.Gauges)
+	}
+
+	raw, err := inm.DisplayMetrics(nil, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	summary := raw.(MetricsSummary)
+	found := false
+	for _, g := range summary.Gauges {
+		if g.Hash == "foo" {
+			found = true
+			if g.Value != 11 {
+				t.Fatalf("bad val: %v", g.Value)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("missing gauge: %v", summary.Gauges)
+	}
+}
+
+func TestInmemSink_SetGaugeOnce(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	inm := NewInmemSinkWithClock(10*time.Millisecond, time.Second, clock)
+
+	inm.SetGauge([]string{"version"}, 1)
+	inm.SetGaugeOnce([]string{"deploy"}, 2, []Label{{"app", "web"}})
+
+	data := inm.Data()
+	g, ok := data[0].Gauges["deploy;app=web"]
+	if !ok || g.Value != 2 || g.Name != "deploy" || len(g.Labels) != 1 {
+		t.Fatalf("bad gauge: %v", data[0].Gauges)
+	}
+
+	// The marker is gone from the next interval, and isn't carried by
+	// AdjustGauge, while a normal gauge is
+	inm.ForceRollover()
+	data = inm.Data()
+	if _, ok := data[1].Gauges["deploy;app=web"]; ok {
+		t.Fatalf("unexpected gauge: %v", data[1].Gauges)
+	}
+	inm.AdjustGaugeWithLabels([]string{"deploy"}, 1, []Label{{"app", "web"}})
+	inm.AdjustGauge([]string{"version"}, 1)
+	data = inm.Data()
+	if len(data) != 2 {
+		t.Fatalf("bad: %v", len(data))
+	}
+	if g := data[1].Gauges["deploy;app=web"]; g.Value != 1 {
+		t.Fatalf("bad val: %v", g.Value)
+	}
+	if g := data[1].Gauges["version"]; g.Value != 2 {
+		t.Fatalf("bad val: %v", g.Value)
+	}
+}
+
+func TestInmemSink_SampleRetention(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour)
+	inm.EnableSampleRetention(100)
+
+	for v := 0; v < 10000; v++ {
+		inm.AddSample([]string{"hot"}, float32(v))
+	}
+
+	data := inm.Data()
+	agg := data[len(data)-1].Samples["hot"]
+	if agg.Count != 10000 {
+		t.Fatalf("bad count: %v", agg.Count)
+	}
+	if n := len(agg.samples); n != 100 {
+		t.Fatalf("expected retained samples to be capped at 100, got: %d", n)
+	}
+
+	// A uniform reservoir over 0..9999 should put the median near 5000
+	if p50 := agg.Quantile(0.5); p50 < 3500 || p50 > 6500 {
+		t.Fatalf("unrepresentative median: %v", p50)
+	}
+	if agg.Quantile(0) > agg.Quantile(0.99) {
+		t.Fatalf("quantiles out of order")
+	}
+
+	raw, err := inm.DisplayMetrics(nil, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	summary := raw.(MetricsSummary)
+	if len(summary.Samples[0].Quantiles) != 3 {
+		t.Fatalf("bad quantiles: %v", summary.Samples[0].Quantiles)
+	}
+}
+
+func TestInmemSink_SampleRetentionDisabled(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour)
+	inm.AddSample([]string{"foo"}, 1)
+
+	data := inm.Data()
+	agg := data[len(data)-1].Samples["foo"]
+	if agg.samples != nil {
+		t.Fatalf("samples should not be retained: %v", agg.samples)
+	}
+	if !math.IsNaN(agg.Quantile(0.5)) {
+		t.Fatalf("expected NaN quantile")
+	}
+}
+
+func TestInmemSink_Reconfigure(t *testing.T) {
+	inm := NewInmemSink(10*time.Millisecond, 50*time.Millisecond)
+
+	for j := 0; j < 5; j++ {
+		inm.IncrCounter([]string{"foo"}, 1)
+		time.Sleep(10 * time.Millisecond)
+	}
+	inm.IncrCounter([]string{"foo"}, 1)
+	if data := inm.Data(); len(data) != 5 {
+		t.Fatalf("bad: %v", len(data))
+	}
+
+	// Shrinking retain drops the oldest intervals but keeps the newest
+	last := inm.Data()[4].Interval
+	inm.Reconfigure(20*time.Millisecond, 60*time.Millisecond)
+	data := inm.Data()
+	if len(data) != 3 {
+		t.Fatalf("bad: %v", len(data))
+	}
+	if data[2].Interval != last {
+		t.Fatalf("expected newest interval to be preserved")
+	}
+
+	// New intervals follow the new length
+	for j := 0; j < 6; j++ {
+		time.Sleep(20 * time.Millisecond)
+		inm.IncrCounter([]string{"foo"}, 1)
+	}
+	data = inm.Data()
+	if len(data) != 3 {
+		t.Fatalf("bad: %v", len(data))
+	}
+	for j := 1; j < len(data); j++ {
+		if gap := data[j].Interval.Sub(data[j-1].Interval); gap%(20*time.Millisecond) != 0 {
+			t.Fatalf("interval not aligned to new length: %v", gap)
+		}
+		if data[j].rateDenom != 0.02 {
+			t.Fatalf("bad rate denominator: %v", data[j].rateDenom)
+		}
+	}
+}
+
+func TestInmemSink_ReconfigureLonger(t *testing.T) {
+	inm := NewInmemSink(10*time.Millisecond, time.Second)
+	inm.IncrCounter([]string{"foo"}, 1)
+	inm.Reconfigure(time.Hour, 10*time.Hour)
+
+	time.Sleep(20 * time.Millisecond)
+	inm.IncrCounter([]string{"foo"}, 1)
+
+	// The interval in progress stays current until the new, longer
+	// interval boundary passes
+	data := inm.Data()
+	if len(data) != 1 {
+		t.Fatalf("bad: %v", len(data))
+	}
+	if data[0].Counters["foo"].Count != 2 {
+		t.Fatalf("bad val: %v", data[0].Counters["foo"])
+	}
+}
+
+func TestInmemSink_CounterKeepAlive(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	inm := NewInmemSinkWithClock(10*time.Millisecond, time.Second, clock)
+	inm.EnableCounterKeepAlive(40 * time.Millisecond)
+
+	inm.IncrCounterWithLabels([]string{"foo"}, 5, []Label{{"a", "b"}})
+
+	// The counter appears with a zero value in the next interval
+	inm.ForceRollover()
+	data := inm.Data()
+	if len(data) != 2 {
+		t.Fatalf("bad: %v", len(data))
+	}
+	agg, ok := data[1].Counters["foo;a=b"]
+	if !ok {
+		t.Fatalf("expected counter to be kept alive: %v", data[1].Counters)
+	}
+	if agg.Count != 0 || agg.Sum != 0 || agg.Name != "foo" || len(agg.Labels) != 1 {
+		t.Fatalf("bad val: %v", agg)
+	}
+
+	// Incrementing a kept alive counter aggregates normally
+	inm.IncrCounterWithLabels([]string{"foo"}, 3, []Label{{"a", "b"}})
+	data = inm.Data()
+	agg = data[len(data)-1].Counters["foo;a=b"]
+	if agg.Count != 1 || agg.Sum != 3 || agg.Min != 3 {
+		t.Fatalf("bad val: %v", agg)
+	}
+
+	// The counter is kept alive until the TTL passes without increments
+	for j := 0; j < 3; j++ {
+		inm.ForceRollover()
+	}
+	data = inm.Data()
+	if _, ok := data[len(data)-1].Counters["foo;a=b"]; !ok {
+		t.Fatalf("expected counter to be kept alive")
+	}
+	inm.ForceRollover()
+	data = inm.Data()
+	if _, ok := data[len(data)-1].Counters["foo;a=b"]; ok {
+		t.Fatalf("expected counter to expire")
+	}
+}
+
+func TestInmemSink_RetainGrace(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	inm := NewInmemSinkWithClock(10*time.Millisecond, 30*time.Millisecond, clock)
+	inm.SetRetainGrace(5 * time.Millisecond)
+
+	inm.IncrCounter([]string{"first"}, 1)
+	first := clock.Now()
+	for j := 0; j < 3; j++ {
+		inm.ForceRollover()
+	}
+
+	// The first interval rolled off, but is still queryable within grace
+	data := inm.Data()
+	if len(data) != 4 || !data[0].Interval.Equal(first) {
+		t.Fatalf("expected the first interval within grace: %d", len(data))
+	}
+	if _, ok := data[0].Counters["first"]; !ok {
+		t.Fatalf("missing counter: %v", data[0].Counters)
+	}
+	clock.Advance(4 * time.Millisecond)
+	if data := inm.Data(); len(data) != 4 {
+		t.Fatalf("expected the first interval within grace: %d", len(data))
+	}
+
+	// It is gone once grace has passed, before the next interval starts
+	clock.Advance(time.Millisecond)
+	data = inm.Data()
+	if len(data) != 3 || data[0].Interval.Equal(first) {
+		t.Fatalf("expected the first interval to be gone: %d", len(data))
+	}
+
+	// And freed when the next interval starts
+	inm.ForceRollover()
+	inm.intervalLock.RLock()
+	n := len(inm.intervals)
+	inm.intervalLock.RUnlock()
+	if n != 4 {
+		t.Fatalf("bad retained intervals: %d", n)
+	}
+	if data := inm.Data(); len(data) != 4 || !data[0].Interval.Equal(first.Add(10*time.Millisecond)) {
+		t.Fatalf("bad intervals: %d", len(data))
+	}
+
+	// Without grace, intervals are freed as they roll off
+	inm.SetRetainGrace(0)
+	if data := inm.Data(); len(data) != 3 {
+		t.Fatalf("bad intervals: %d", len(data))
+	}
+}
+
+func TestInmemSink_CounterKeepAliveDisabled(t *testing.T) {
+	inm := NewInmemSink(10*time.Millisecond, time.Second)
+	inm.IncrCounter([]string{"foo"}, 5)
+
+	time.Sleep(12 * time.Millisecond)
+	data := inm.Data()
+	if _, ok := data[len(data)-1].Counters["foo"]; ok {
+		t.Fatalf("counter should not be carried forward")
+	}
+}
+
+func TestInmemSink_ResetCounter(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 2*time.Hour)
+	labels := []Label{{"a", "b"}}
+	inm.IncrCounterWithLabels([]string{"foo"}, 5, labels)
+	inm.IncrCounterWithLabels([]string{"foo"}, 3, labels)
+	inm.IncrCounter([]string{"bar"}, 1)
+
+	// The increments from before the reset are kept
+	inm.ResetCounter([]string{"foo"}, labels)
+	data := inm.Data()
+	agg := data[0].Counters["foo;a=b"]
+	if agg.Count != 2 || agg.Sum != 8 || agg.Name != "foo" || len(agg.Labels) != 1 {
+		t.Fatalf("bad val: %v", agg)
+	}
+
+	// Other counters are unaffected
+	if agg := data[0].Counters["bar"]; agg.Count != 1 || agg.Sum != 1 {
+		t.Fatalf("bad val: %v", agg)
+	}
+
+	// Later increments add up with the earlier ones
+	inm.IncrCounterWithLabels([]string{"foo"}, 2, labels)
+	agg = inm.Data()[0].Counters["foo;a=b"]
+	if agg.Count != 3 || agg.Sum != 10 || agg.Min != 2 || agg.Max != 5 {
+		t.Fatalf("bad val: %v", agg)
+	}
+
+	// A counter reset before any increment is listed
+	inm.ResetCounter([]string{"baz"}, nil)
+	if agg, ok := inm.Data()[0].Counters["baz"]; !ok || agg.Count != 0 {
+		t.Fatalf("bad val: %v", agg)
+	}
+}
+
+func TestInmemSink_FakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 30, 0, time.UTC)
+	clock := NewFakeClock(start)
+	inm := NewInmemSinkWithClock(time.Minute, time.Hour, clock)
+
+	inm.IncrCounter([]string{"foo"}, 1)
+	data := inm.Data()
+	if len(data) != 1 || !data[0].Interval.Equal(start.Truncate(time.Minute)) {
+		t.Fatalf("bad intervals: %v", data)
+	}
+	if agg := data[0].Counters["foo"]; !agg.LastUpdated.Equal(start) {
+		t.Fatalf("bad last updated: %v", agg.LastUpdated)
+	}
+
+	// Advancing within the interval doesn't start a new one
+	clock.Advance(20 * time.Second)
+	inm.IncrCounter([]string{"foo"}, 1)
+	if data := inm.Data(); len(data) != 1 || data[0].Counters["foo"].Count != 2 {
+		t.Fatalf("bad intervals: %v", data)
+	}
+
+	// A rollover moves to the start of the next interval
+	inm.ForceRollover()
+	if now := clock.Now(); !now.Equal(start.Truncate(time.Minute).Add(time.Minute)) {
+		t.Fatalf("bad now: %v", now)
+	}
+	data = inm.Data()
+	if len(data) != 2 || !data[1].Interval.Equal(clock.Now()) {
+		t.Fatalf("bad intervals: %v", data)
+	}
+	select {
+	case <-data[0].done:
+	default:
+		t.Fatalf("expected the previous interval to be finished")
+	}
+}
+
+func TestInmemSink_ForceRolloverRealClock(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic")
+		}
+	}()
+	NewInmemSink(time.Minute, time.Hour).ForceRollover()
+}
+
+func TestInmemSink_ObserveBuckets(t *testing.T) {
+	inm := NewInmemSink(time.Hour, time.Hour)
+
+	inm.AddSample([]string{"foo"}, 3)
+	inm.ObserveBuckets([]string{"foo"}, map[float64]uint64{1: 2, 10: 3}, nil)
+	inm.ObserveBuckets([]string{"foo"}, map[float64]uint64{10: 1, math.Inf(1): 4}, nil)
+
+	agg := inm.Data()[0].Samples["foo"]
+	want := map[float64]uint64{1: 2, 10: 4, math.Inf(1): 4}
+	if !reflect.DeepEqual(agg.Buckets, want) {
+		t.Fatalf("bad buckets: %v", agg.Buckets)
+	}
+
+	// Bucketed observations do not affect the sample aggregates
+	if agg.Count != 1 || agg.Sum != 3 {
+		t.Fatalf("bad aggregate: %v", agg.AggregateSample)
+	}
+
+	out := formatSamples(inm.Data()[0].Samples)
+	wantDisplay := map[string]uint64{"1": 2, "10": 4, "+Inf": 4}
+	if !reflect.DeepEqual(out[0].DisplayBuckets, wantDisplay) {
+		t.Fatalf("bad display buckets: %v", out[0].DisplayBuckets)
+	}
+}
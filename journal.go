@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// JournalSink provides a MetricSink that writes every emission to the
+// systemd journal as a structured entry, using the native journal protocol.
+// Entries can then be filtered with journalctl, e.g.
+//
+//	journalctl METRIC_NAME=service.requests LABEL_METHOD=GET
+//
+// Each entry has the fields METRIC_TYPE (gauge, kv, counter or sample),
+// METRIC_NAME, METRIC_VALUE and a readable MESSAGE. Labels become LABEL_
+// fields, with the name upper-cased and characters not allowed in journal
+// field names replaced by '_'.
+//
+// When the journal socket is not available, e.g. when not running under
+// systemd or on platforms other than Linux, the sink does nothing.
+type JournalSink struct {
+	conn       net.Conn
+	identifier string
+	errLog     *FailureLogger
+}
+
+// NewJournalSink creates a JournalSink writing to the journal of the local
+// systemd. The identifier, if set, is the SYSLOG_IDENTIFIER of the entries.
+func NewJournalSink(identifier string) *JournalSink {
+	return newJournalSink(journalSocket, identifier)
+}
+
+func newJournalSink(path, identifier string) *JournalSink {
+	j := &JournalSink{
+		identifier: identifier,
+		errLog:     NewFailureLogger(),
+	}
+	if conn, err := dialJournal(path); err == nil {
+		j.conn = conn
+	}
+	return j
+}
+
+// Enabled returns whether the sink is connected to the journal. If not,
+// emissions are discarded.
+func (j *JournalSink) Enabled() bool {
+	return j.conn != nil
+}
+
+// Close closes the connection to the journal
+func (j *JournalSink) Close() error {
+	if j.conn == nil {
+		return nil
+	}
+	return j.conn.Close()
+}
+
+func (j *JournalSink) SetGauge(key []string, val float32) {
+	j.SetGaugeWithLabels(key, val, nil)
+}
+
+func (j *JournalSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	j.send("gauge", key, val, labels)
+}
+
+func (j *JournalSink) EmitKey(key []string, val float32) {
+	j.send("kv", key, val, nil)
+}
+
+func (j *JournalSink) IncrCounter(key []string, val float32) {
+	j.IncrCounterWithLabels(key, val, nil)
+}
+
+func (j *JournalSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	j.send("counter", key, val, labels)
+}
+
+func (j *JournalSink) AddSample(key []string, val float32) {
+	j.AddSampleWithLabels(key, val, nil)
+}
+
+func (j *JournalSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	j.send("sample", key, val, labels)
+}
+
+// send writes a single emission to the journal as one datagram
+func (j *JournalSink) send(typ string, key []string, val float32, labels []Label) {
+	if j.conn == nil {
+		return
+	}
+	if _, err := j.conn.Write(j.entry(typ, key, val, labels)); err != nil {
+		j.errLog.Printf("[ERR] Error writing to the journal! Err: %s", err)
+	}
+}
+
+// entry encodes an emission in the native journal protocol
+func (j *JournalSink) entry(typ string, key []string, val float32, labels []Label) []byte {
+	name := strings.Join(key, ".")
+	value := strconv.FormatFloat(float64(val), 'g', -1, 32)
+
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", fmt.Sprintf("%s %s %s", typ, name, value))
+	writeJournalField(&buf, "PRIORITY", "6")
+	if j.identifier != "" {
+		writeJournalField(&buf, "SYSLOG_IDENTIFIER", j.identifier)
+	}
+	writeJournalField(&buf, "METRIC_TYPE", typ)
+	writeJournalField(&buf, "METRIC_NAME", name)
+	writeJournalField(&buf, "METRIC_VALUE", value)
+	for _, label := range labels {
+		writeJournalField(&buf, journalFieldName("LABEL_"+label.Name), label.Value)
+	}
+	return buf.Bytes()
+}
+
+// writeJournalField appends a field to an entry. Values holding a newline
+// must be sent length-prefixed rather than as NAME=value lines.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name)
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	buf.Write(size[:])
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName maps name to a valid journal field name, which holds only
+// upper case letters, digits and '_', and is at most 64 characters long
+func journalFieldName(name string) string {
+	field := []byte(strings.ToUpper(name))
+	for i, c := range field {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '_' {
+			field[i] = '_'
+		}
+	}
+	if len(field) > 64 {
+		field = field[:64]
+	}
+	return string(field)
+}
@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package metrics
+
+import "net"
+
+// journalSocket is the socket of the native journal protocol
+const journalSocket = "/run/systemd/journal/socket"
+
+// dialJournal connects to the journal socket at path
+func dialJournal(path string) (net.Conn, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
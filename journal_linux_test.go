@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournalSink_Linux(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics-journal")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "socket")
+	list, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+
+	j := newJournalSink(path, "myapp")
+	defer j.Close()
+	if !j.Enabled() {
+		t.Fatalf("should be enabled")
+	}
+
+	j.SetGaugeWithLabels([]string{"queue", "depth"}, 3, []Label{{"name", "jobs"}})
+	j.EmitKey([]string{"kv"}, 4)
+
+	list.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 4096)
+	for _, expect := range []string{
+		"MESSAGE=gauge queue.depth 3\nPRIORITY=6\nSYSLOG_IDENTIFIER=myapp\nMETRIC_TYPE=gauge\nMETRIC_NAME=queue.depth\nMETRIC_VALUE=3\nLABEL_NAME=jobs\n",
+		"MESSAGE=kv kv 4\nPRIORITY=6\nSYSLOG_IDENTIFIER=myapp\nMETRIC_TYPE=kv\nMETRIC_NAME=kv\nMETRIC_VALUE=4\n",
+	} {
+		n, err := list.Read(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out := string(buf[:n]); out != expect {
+			t.Fatalf("bad entry %q", out)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package metrics
+
+import (
+	"fmt"
+	"net"
+)
+
+// journalSocket is unused, the journal only exists on Linux
+const journalSocket = ""
+
+// dialJournal always fails, making JournalSink a no-op
+func dialJournal(path string) (net.Conn, error) {
+	return nil, fmt.Errorf("the systemd journal is only available on Linux")
+}
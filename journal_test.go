@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJournalSink_Entry(t *testing.T) {
+	j := &JournalSink{identifier: "myapp"}
+	entry := j.entry("counter", []string{"http", "requests"}, 1.5, []Label{{"method", "GET"}, {"status-code", "200"}})
+	expect := "MESSAGE=counter http.requests 1.5\n" +
+		"PRIORITY=6\n" +
+		"SYSLOG_IDENTIFIER=myapp\n" +
+		"METRIC_TYPE=counter\n" +
+		"METRIC_NAME=http.requests\n" +
+		"METRIC_VALUE=1.5\n" +
+		"LABEL_METHOD=GET\n" +
+		"LABEL_STATUS_CODE=200\n"
+	if string(entry) != expect {
+		t.Fatalf("bad entry %q", entry)
+	}
+}
+
+func TestJournalSink_MultilineValue(t *testing.T) {
+	j := &JournalSink{}
+	entry := j.entry("gauge", []string{"g"}, 2, []Label{{"note", "a\nb"}})
+	expect := "MESSAGE=gauge g 2\n" +
+		"PRIORITY=6\n" +
+		"METRIC_TYPE=gauge\n" +
+		"METRIC_NAME=g\n" +
+		"METRIC_VALUE=2\n" +
+		"LABEL_NOTE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"
+	if string(entry) != expect {
+		t.Fatalf("bad entry %q", entry)
+	}
+}
+
+func TestJournalFieldName(t *testing.T) {
+	for in, expect := range map[string]string{
+		"LABEL_method":                     "LABEL_METHOD",
+		"LABEL_a.b-c/d":                    "LABEL_A_B_C_D",
+		"LABEL_ünicode":                    "LABEL___NICODE",
+		"LABEL_" + strings.Repeat("X", 64): "LABEL_" + strings.Repeat("X", 58),
+	} {
+		if out := journalFieldName(in); out != expect {
+			t.Fatalf("bad field name for %q: %q, expected %q", in, out, expect)
+		}
+	}
+}
+
+func TestJournalSink_NoJournal(t *testing.T) {
+	j := newJournalSink("/nonexistent/journal.socket", "myapp")
+	if j.Enabled() {
+		t.Fatalf("should not be enabled")
+	}
+
+	// Emissions are discarded
+	j.SetGauge([]string{"g"}, 1)
+	j.IncrCounterWithLabels([]string{"c"}, 1, []Label{{"a", "b"}})
+	j.AddSample([]string{"s"}, 1)
+	if err := j.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
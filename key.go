@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+)
+
+// maxSplitKeys bounds the number of keys cached by SplitKey, so keys built
+// at runtime can't grow the cache without limit
+const maxSplitKeys = 4096
+
+// Key is a metric key with its parts joined by '.', such as
+// "http.server.requests". It lets keys be declared as constants, spelled out
+// in a single place, and still be passed to the []string based API:
+//
+//	const HTTPRequests metrics.Key = "http.server.requests"
+//
+//	metrics.IncrCounterWithLabels(HTTPRequests.Parts(), 1, labels)
+type Key string
+
+// Parts returns the parts of the key, see SplitKey
+func (k Key) Parts() []string {
+	return SplitKey(string(k))
+}
+
+var (
+	splitKeys     = make(map[string][]string)
+	splitKeysLock sync.RWMutex
+)
+
+// SplitKey splits a key joined by '.' into its parts. The split of the first
+// few thousand distinct keys is cached, so splitting a constant key again is
+// a lookup that doesn't allocate. The returned slice is shared between
+// callers and must not be modified; appending to it is fine as it has no
+// spare capacity.
+func SplitKey(key string) []string {
+	splitKeysLock.RLock()
+	parts, ok := splitKeys[key]
+	splitKeysLock.RUnlock()
+	if ok {
+		return parts
+	}
+
+	parts = strings.Split(key, ".")
+	parts = parts[:len(parts):len(parts)]
+
+	splitKeysLock.Lock()
+	if len(splitKeys) < maxSplitKeys {
+		splitKeys[key] = parts
+	}
+	splitKeysLock.Unlock()
+	return parts
+}
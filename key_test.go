@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSplitKey(t *testing.T) {
+	for key, expect := range map[string][]string{
+		"http.server.requests": {"http", "server", "requests"},
+		"single":               {"single"},
+		"trailing.":            {"trailing", ""},
+	} {
+		if parts := SplitKey(key); !reflect.DeepEqual(parts, expect) {
+			t.Fatalf("bad parts of %q: %q", key, parts)
+		}
+	}
+
+	// Splits are cached and shared
+	a := SplitKey("cached.key")
+	b := Key("cached.key").Parts()
+	if &a[0] != &b[0] {
+		t.Fatalf("expected a cached split")
+	}
+	if allocs := testing.AllocsPerRun(100, func() { SplitKey("cached.key") }); allocs != 0 {
+		t.Fatalf("expected no allocations, got %v", allocs)
+	}
+
+	// Appending doesn't modify the cached split
+	_ = append(a, "more")
+	if c := append(SplitKey("cached.key"), "other"); len(c) != 3 || c[2] != "other" {
+		t.Fatalf("bad append: %q", c)
+	}
+	if !reflect.DeepEqual(SplitKey("cached.key"), []string{"cached", "key"}) || cap(a) != 2 {
+		t.Fatalf("cached split was modified")
+	}
+}
+
+func TestSplitKey_Bounded(t *testing.T) {
+	for n := 0; n < maxSplitKeys+10; n++ {
+		SplitKey(fmt.Sprintf("dynamic.%d", n))
+	}
+	splitKeysLock.RLock()
+	size := len(splitKeys)
+	splitKeysLock.RUnlock()
+	if size > maxSplitKeys {
+		t.Fatalf("cache grew to %d keys", size)
+	}
+
+	// Keys beyond the bound are still split
+	key := fmt.Sprintf("dynamic.%d", maxSplitKeys+20)
+	if parts := SplitKey(key); len(parts) != 2 || parts[0] != "dynamic" {
+		t.Fatalf("bad parts: %q", parts)
+	}
+}
+
+func TestKey_Metrics(t *testing.T) {
+	const requests Key = "http.server.requests"
+
+	m, met := mockMetric()
+	met.IncrCounterWithLabels(requests.Parts(), 1, []Label{{"code", "200"}})
+	met.EnableTypePrefix = true
+	met.IncrCounter(requests.Parts(), 1)
+	expect := [][]string{
+		{"http", "server", "requests"},
+		{"counter", "http", "server", "requests"},
+	}
+	if !reflect.DeepEqual(m.keys, expect) {
+		t.Fatalf("bad keys: %q", m.keys)
+	}
+	if !reflect.DeepEqual(requests.Parts(), []string{"http", "server", "requests"}) {
+		t.Fatalf("key was modified: %q", requests.Parts())
+	}
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+)
+
+// KeySegmentRule moves segments of the keys starting with Prefix into
+// labels, e.g. the rule {"http", {1: "method", 2: "status"}} emits
+// http.GET.200 as http with the labels method=GET and status=200.
+type KeySegmentRule struct {
+	// Prefix is matched against whole segments of the key, including the
+	// prefixes added by Metrics, with '.' as the separator
+	Prefix string
+
+	// Segments maps the 0-based positions of the segments to extract in the
+	// key to the names of their labels
+	Segments map[int]string
+}
+
+// keySegmentRule is a KeySegmentRule with its prefix split and its
+// segments sorted
+type keySegmentRule struct {
+	prefix    []string
+	positions []int
+	names     []string
+	last      int
+}
+
+// ExtractKeySegments returns a Middleware moving the segments of legacy
+// dotted keys which embed varying values into labels, following the rule of
+// the longest prefix matching the key. Keys too short to hold every segment
+// of their rule are left unchanged. The extracted labels are added after
+// the labels of the emission, ordered by position.
+func ExtractKeySegments(rules ...KeySegmentRule) Middleware {
+	compiled := make([]keySegmentRule, 0, len(rules))
+	for _, rule := range rules {
+		c := keySegmentRule{last: -1}
+		if rule.Prefix != "" {
+			c.prefix = strings.Split(rule.Prefix, ".")
+		}
+		for pos := range rule.Segments {
+			if pos >= 0 {
+				c.positions = append(c.positions, pos)
+			}
+		}
+		sort.Ints(c.positions)
+		for _, pos := range c.positions {
+			c.names = append(c.names, rule.Segments[pos])
+			c.last = pos
+		}
+		compiled = append(compiled, c)
+	}
+	sort.SliceStable(compiled, func(i, j int) bool { return len(compiled[i].prefix) > len(compiled[j].prefix) })
+
+	return func(e *Emission) bool {
+		for _, rule := range compiled {
+			if !hasKeyPrefix(e.Key, rule.prefix) {
+				continue
+			}
+			if rule.last < 0 || rule.last >= len(e.Key) {
+				return true
+			}
+			key := make([]string, 0, len(e.Key)-len(rule.positions))
+			labels := make([]Label, len(e.Labels), len(e.Labels)+len(rule.positions))
+			copy(labels, e.Labels)
+			next := 0
+			for i, segment := range e.Key {
+				if next < len(rule.positions) && rule.positions[next] == i {
+					labels = append(labels, Label{Name: rule.names[next], Value: segment})
+					next++
+					continue
+				}
+				key = append(key, segment)
+			}
+			e.Key, e.Labels = key, labels
+			return true
+		}
+		return true
+	}
+}
+
+// hasKeyPrefix returns whether the first segments of key are prefix
+func hasKeyPrefix(key, prefix []string) bool {
+	if len(prefix) > len(key) {
+		return false
+	}
+	for i, segment := range prefix {
+		if key[i] != segment {
+			return false
+		}
+	}
+	return true
+}
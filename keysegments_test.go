@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractKeySegments(t *testing.T) {
+	m, met := mockMetric()
+	met.Middlewares = []Middleware{ExtractKeySegments(
+		KeySegmentRule{Prefix: "http", Segments: map[int]string{1: "method", 2: "status"}},
+		KeySegmentRule{Prefix: "http.admin", Segments: map[int]string{2: "page"}},
+		KeySegmentRule{Prefix: "db", Segments: map[int]string{1: "table"}},
+	)}
+
+	met.IncrCounterWithLabels([]string{"http", "GET", "200"}, 1, []Label{{"region", "west"}})
+	met.AddSample([]string{"http", "admin", "users", "latency"}, 2)
+	met.SetGauge([]string{"http", "GET"}, 3)
+	met.IncrCounter([]string{"https", "GET", "200"}, 4)
+	met.SetGauge([]string{"db", "users", "rows"}, 5)
+
+	expectKeys := [][]string{
+		{"http"},
+		{"http", "admin", "latency"},
+		{"http", "GET"},
+		{"https", "GET", "200"},
+		{"db", "rows"},
+	}
+	if !reflect.DeepEqual(m.keys, expectKeys) {
+		t.Fatalf("bad keys: %v", m.keys)
+	}
+	expectLabels := [][]Label{
+		{{"method", "GET"}, {"region", "west"}, {"status", "200"}},
+		{{"page", "users"}},
+		nil,
+		nil,
+		{{"table", "users"}},
+	}
+	if !reflect.DeepEqual(m.labels, expectLabels) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+}
+
+func TestExtractKeySegments_Prefixes(t *testing.T) {
+	m, met := mockMetric()
+	met.ServiceName = "service"
+	met.Middlewares = []Middleware{ExtractKeySegments(
+		KeySegmentRule{Prefix: "service.jobs", Segments: map[int]string{2: "queue"}},
+	)}
+
+	// The positions count the prefixes added by Metrics
+	key := []string{"jobs", "email", "processed"}
+	met.IncrCounter(key, 1)
+	if !reflect.DeepEqual(m.keys, [][]string{{"service", "jobs", "processed"}}) {
+		t.Fatalf("bad keys: %v", m.keys)
+	}
+	if !reflect.DeepEqual(m.labels, [][]Label{{{"queue", "email"}}}) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+	if !reflect.DeepEqual(key, []string{"jobs", "email", "processed"}) {
+		t.Fatalf("key was modified: %v", key)
+	}
+}
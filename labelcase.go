@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"strings"
+	"unicode"
+)
+
+// LabelKeyCase selects how the names of labels are normalized before they
+// are filtered and emitted. Code paths drifting apart in their conventions,
+// e.g. "RequestID" in one place and "requestid" in another, otherwise create
+// distinct series for the same label. The names of AllowedLabels,
+// BlockedLabels and ResourceLabels are normalized too, so they match either
+// spelling. Label values are left as they are, unless TrimLabelValues or
+// LowercaseLabelValues is set.
+type LabelKeyCase int
+
+const (
+	// LabelKeyCaseKeep emits the label names as they are
+	LabelKeyCaseKeep LabelKeyCase = iota
+
+	// LabelKeyCaseLower lowercases the label names, e.g. "RequestID" to
+	// "requestid"
+	LabelKeyCaseLower
+
+	// LabelKeyCaseSnake converts the label names to snake case, e.g.
+	// "RequestID" and "requestId" to "request_id"
+	LabelKeyCaseSnake
+)
+
+// normalizeLabelName returns name in the case selected by c
+func (c LabelKeyCase) normalizeLabelName(name string) string {
+	switch c {
+	case LabelKeyCaseLower:
+		return strings.ToLower(name)
+	case LabelKeyCaseSnake:
+		return snakeCase(name)
+	}
+	return name
+}
+
+// snakeCase lowercases s, starting a new word at every uppercase letter
+// following a lowercase letter or digit, and at the last letter of a
+// run of uppercase letters followed by a lowercase one, e.g. "HTTPStatus" to
+// "http_status". Names without uppercase letters are returned as they are.
+func snakeCase(s string) string {
+	if strings.IndexFunc(s, unicode.IsUpper) < 0 {
+		return s
+	}
+	runes := []rune(s)
+	var b strings.Builder
+	b.Grow(len(s) + 4)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			next := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && next) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// normalizeLabels returns labels with their names normalized by the
+// LabelKeyCase of m, and their values by TrimLabelValues and
+// LowercaseLabelValues. Of the labels whose names collide once normalized,
+// the last one is kept, at the position of the first, as NormalizeLabels
+// keeps the last of duplicate names. labels itself is left untouched.
+func (m *Metrics) normalizeLabels(labels []Label) []Label {
+	values := m.TrimLabelValues || m.LowercaseLabelValues
+	if (m.LabelKeyCase == LabelKeyCaseKeep && !values) || len(labels) == 0 {
+		return labels
+	}
+	normalized := make([]Label, 0, len(labels))
+	for _, label := range labels {
+		if values {
+			label.Value = m.normalizeLabelValue(label.Value)
+		}
+		if m.LabelKeyCase == LabelKeyCaseKeep {
+			normalized = append(normalized, label)
+			continue
+		}
+		label.Name = m.LabelKeyCase.normalizeLabelName(label.Name)
+		if i := labelIndex(normalized, label.Name); i >= 0 {
+			normalized[i] = label
+		} else {
+			normalized = append(normalized, label)
+		}
+	}
+	return normalized
+}
+
+// labelIndex returns the index of the label named name in labels, or -1
+func labelIndex(labels []Label, name string) int {
+	for i, label := range labels {
+		if label.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// normalizeLabelValue returns value trimmed and lowercased as configured, so
+// e.g. "GET " and "get" are emitted as the same series
+func (m *Metrics) normalizeLabelValue(value string) string {
+	if m.TrimLabelValues {
+		value = strings.TrimSpace(value)
+	}
+	if m.LowercaseLabelValues {
+		value = strings.ToLower(value)
+	}
+	return value
+}
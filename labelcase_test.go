@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLabelKeyCase_Normalize(t *testing.T) {
+	cases := []struct {
+		name, lower, snake string
+	}{
+		{"requestid", "requestid", "requestid"},
+		{"RequestID", "requestid", "request_id"},
+		{"requestId", "requestid", "request_id"},
+		{"request_id", "request_id", "request_id"},
+		{"HTTPStatus", "httpstatus", "http_status"},
+		{"Shard2Owner", "shard2owner", "shard2_owner"},
+	}
+	for _, c := range cases {
+		if got := LabelKeyCaseKeep.normalizeLabelName(c.name); got != c.name {
+			t.Fatalf("%s: bad kept name: %s", c.name, got)
+		}
+		if got := LabelKeyCaseLower.normalizeLabelName(c.name); got != c.lower {
+			t.Fatalf("%s: bad lower name: %s", c.name, got)
+		}
+		if got := LabelKeyCaseSnake.normalizeLabelName(c.name); got != c.snake {
+			t.Fatalf("%s: bad snake name: %s", c.name, got)
+		}
+	}
+}
+
+func TestMetrics_LabelKeyCase(t *testing.T) {
+	m, met := mockMetric()
+	met.LabelKeyCase = LabelKeyCaseLower
+	met.UpdateFilterAndLabels(nil, nil, nil, []string{"Secret"})
+
+	// Both spellings collapse into the same label
+	labels := []Label{{"RequestID", "1"}}
+	met.IncrCounterWithLabels([]string{"requests"}, 1, labels)
+	met.IncrCounterWithLabels([]string{"requests"}, 1, []Label{{"requestid", "2"}})
+	met.AddSampleWithLabels([]string{"latency"}, 1, []Label{{"RequestId", "3"}, {"REQUESTID", "4"}, {"secret", "x"}})
+	expect := [][]Label{
+		{{"requestid", "1"}},
+		{{"requestid", "2"}},
+		{{"requestid", "4"}},
+	}
+	if !reflect.DeepEqual(m.labels, expect) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+	if labels[0].Name != "RequestID" {
+		t.Fatalf("labels were modified: %v", labels)
+	}
+}
+
+func TestMetrics_LabelKeyCaseCollision(t *testing.T) {
+	m, met := mockMetric()
+	met.LabelKeyCase = LabelKeyCaseSnake
+
+	// Names colliding once normalized keep the last value, like duplicate
+	// names do
+	met.IncrCounterWithLabels([]string{"requests"}, 1, []Label{{"HTTPMethod", "a"}, {"http_method", "b"}})
+	met.IncrCounterWithLabels([]string{"requests"}, 1, []Label{{"x", "a"}, {"x", "b"}})
+	expect := [][]Label{
+		{{"http_method", "b"}},
+		{{"x", "b"}},
+	}
+	if !reflect.DeepEqual(m.labels, expect) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+}
+
+func TestMetrics_NormalizeLabelValues(t *testing.T) {
+	emit := func(met *Metrics, inm *InmemSink) map[string]int {
+		for _, method := range []string{"GET ", "get", " Get\t", "POST"} {
+			met.IncrCounterWithLabels([]string{"requests"}, 1, []Label{{"method", method}})
+		}
+		counts := make(map[string]int)
+		for k, v := range inm.Data()[0].Counters {
+			counts[k] = v.Count
+		}
+		return counts
+	}
+
+	// Trimming alone keeps the case apart
+	inm := NewInmemSink(time.Minute, time.Minute)
+	met := &Metrics{Config: Config{FilterDefault: true, TrimLabelValues: true}, sink: inm}
+	expect := map[string]int{"requests;method=GET": 1, "requests;method=get": 1, "requests;method=Get": 1, "requests;method=POST": 1}
+	if counts := emit(met, inm); !reflect.DeepEqual(counts, expect) {
+		t.Fatalf("bad series: %v", counts)
+	}
+
+	// Both collapse the variants into a single series
+	inm = NewInmemSink(time.Minute, time.Minute)
+	met = &Metrics{Config: Config{FilterDefault: true, TrimLabelValues: true, LowercaseLabelValues: true}, sink: inm}
+	expect = map[string]int{"requests;method=get": 3, "requests;method=post": 1}
+	if counts := emit(met, inm); !reflect.DeepEqual(counts, expect) {
+		t.Fatalf("bad series: %v", counts)
+	}
+
+	// Values are left as they are by default, and the labels of the caller
+	// are untouched
+	m, met := mockMetric()
+	labels := []Label{{"method", " GET"}}
+	met.AddSampleWithLabels([]string{"latency"}, 1, labels)
+	met.LowercaseLabelValues = true
+	met.AddSampleWithLabels([]string{"latency"}, 1, labels)
+	if m.labels[0][0].Value != " GET" || m.labels[1][0].Value != " get" || labels[0].Value != " GET" {
+		t.Fatalf("bad labels: %v %v", m.labels, labels)
+	}
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import "time"
+
+// LabelFilterSink wraps a MetricSink and removes labels according to its own
+// allow and block lists before passing emissions on. It lets each backend
+// apply its own cardinality policy, independently of the AllowedLabels and
+// BlockedLabels of the Config, which apply to every sink.
+type LabelFilterSink struct {
+	sink    MetricSink
+	allowed map[string]bool
+	blocked map[string]bool
+}
+
+// NewLabelFilterSink creates a LabelFilterSink passing emissions to sink.
+// The lists behave like the ones of Config: a blocked label is always
+// removed, and if allowed is not nil only labels in it are kept.
+func NewLabelFilterSink(sink MetricSink, allowed, blocked []string) *LabelFilterSink {
+	f := &LabelFilterSink{
+		sink:    sink,
+		blocked: make(map[string]bool, len(blocked)),
+	}
+	if allowed != nil {
+		f.allowed = make(map[string]bool, len(allowed))
+		for _, name := range allowed {
+			f.allowed[name] = true
+		}
+	}
+	for _, name := range blocked {
+		f.blocked[name] = true
+	}
+	return f
+}
+
+func (f *LabelFilterSink) SetGauge(key []string, val float32) {
+	f.sink.SetGauge(key, val)
+}
+
+func (f *LabelFilterSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	f.sink.SetGaugeWithLabels(key, val, f.filterLabels(labels))
+}
+
+func (f *LabelFilterSink) EmitKey(key []string, val float32) {
+	f.sink.EmitKey(key, val)
+}
+
+func (f *LabelFilterSink) IncrCounter(key []string, val float32) {
+	f.sink.IncrCounter(key, val)
+}
+
+func (f *LabelFilterSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	f.sink.IncrCounterWithLabels(key, val, f.filterLabels(labels))
+}
+
+func (f *LabelFilterSink) AddSample(key []string, val float32) {
+	f.sink.AddSample(key, val)
+}
+
+func (f *LabelFilterSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	f.sink.AddSampleWithLabels(key, val, f.filterLabels(labels))
+}
+
+func (f *LabelFilterSink) AddTimingSample(key []string, val float32, unit time.Duration, labels []Label) {
+	addTiming(f.sink, key, val, unit, f.filterLabels(labels))
+}
+
+func (f *LabelFilterSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	observeBuckets(f.sink, key, counts, f.filterLabels(labels))
+}
+
+func (f *LabelFilterSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	setGaugeInt(f.sink, key, val, f.filterLabels(labels))
+}
+
+func (f *LabelFilterSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	incrCounterInt(f.sink, key, val, f.filterLabels(labels))
+}
+
+func (f *LabelFilterSink) ResetCounter(key []string, labels []Label) {
+	resetCounter(f.sink, key, f.filterLabels(labels))
+}
+
+func (f *LabelFilterSink) SetCounterTemporality(key []string, temporality Temporality) {
+	setCounterTemporality(f.sink, key, temporality)
+}
+
+func (f *LabelFilterSink) SetResourceLabels(names []string) {
+	setResourceLabels(f.sink, names)
+}
+
+func (f *LabelFilterSink) SetTimestampOffset(offset time.Duration) {
+	setTimestampOffset(f.sink, offset)
+}
+
+// filterLabels returns a new slice holding only the allowed labels
+func (f *LabelFilterSink) filterLabels(labels []Label) []Label {
+	if labels == nil {
+		return nil
+	}
+	filtered := make([]Label, 0, len(labels))
+	for _, label := range labels {
+		if f.blocked[label.Name] {
+			continue
+		}
+		if f.allowed != nil && !f.allowed[label.Name] {
+			continue
+		}
+		filtered = append(filtered, label)
+	}
+	return filtered
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLabelFilterSink(t *testing.T) {
+	statsd, prom := &MockSink{}, &MockSink{}
+	fh := FanoutSink{
+		NewLabelFilterSink(statsd, nil, []string{"user", "path"}),
+		prom,
+	}
+	met := &Metrics{Config: Config{FilterDefault: true}, sink: fh}
+
+	labels := []Label{{"user", "42"}, {"path", "/a"}, {"method", "GET"}}
+	met.SetGaugeWithLabels([]string{"g"}, 1, labels)
+	met.IncrCounterWithLabels([]string{"c"}, 1, labels)
+	met.AddSampleWithLabels([]string{"s"}, 1, labels)
+
+	for i := 0; i < 3; i++ {
+		if !reflect.DeepEqual(statsd.labels[i], []Label{{"method", "GET"}}) {
+			t.Fatalf("bad statsd labels: %v", statsd.labels[i])
+		}
+		if !reflect.DeepEqual(prom.labels[i], NormalizeLabels(labels)) {
+			t.Fatalf("bad prometheus labels: %v", prom.labels[i])
+		}
+	}
+}
+
+func TestLabelFilterSink_Allowed(t *testing.T) {
+	m := &MockSink{}
+	f := NewLabelFilterSink(m, []string{"a", "b"}, []string{"b"})
+
+	labels := []Label{{"a", "1"}, {"b", "2"}, {"c", "3"}}
+	f.IncrCounterWithLabels([]string{"c"}, 1, labels)
+	if !reflect.DeepEqual(m.labels[0], []Label{{"a", "1"}}) {
+		t.Fatalf("bad labels: %v", m.labels[0])
+	}
+
+	// The labels of the caller are left untouched
+	if len(labels) != 3 || labels[1].Name != "b" {
+		t.Fatalf("labels modified: %v", labels)
+	}
+
+	f.AddSampleWithLabels([]string{"s"}, 1, nil)
+	if m.labels[1] != nil {
+		t.Fatalf("bad labels: %v", m.labels[1])
+	}
+
+	f.ObserveBuckets([]string{"b"}, map[float64]uint64{1: 1}, labels)
+	if !reflect.DeepEqual(m.labels[2], []Label{{"a", "1"}}) {
+		t.Fatalf("bad labels: %v", m.labels[2])
+	}
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import "sort"
+
+// LabelOrder selects how Metrics orders labels before sinks flatten them into
+// the names and hashes of series. Emitting the same labels in a different
+// order, e.g. from two code paths, otherwise creates distinct series in the
+// sinks which flatten labels in the order given, and the sinks sorting them
+// disagree with those which don't.
+type LabelOrder int
+
+const (
+	// LabelOrderSorted sorts the labels by name, keeping the last of the
+	// labels sharing a name. This is the default.
+	LabelOrderSorted LabelOrder = iota
+
+	// LabelOrderPreserved flattens the labels in the order given, including
+	// duplicates, as earlier versions did. Use it to keep the names of
+	// existing series byte for byte.
+	LabelOrderPreserved
+)
+
+// orderLabels returns labels in the order selected by Config.LabelOrder
+func (m *Metrics) orderLabels(labels []Label) []Label {
+	if m.LabelOrder == LabelOrderPreserved {
+		return labels
+	}
+	return NormalizeLabels(labels)
+}
+
+// NormalizeLabels returns labels sorted by name, keeping only the last of the
+// labels sharing a name, so the same labels in any order flatten to the same
+// series. The slice given is never modified, and is returned as it is if
+// already normalized. Metrics normalizes the labels of every emission with
+// it before they reach the sinks, following Config.LabelOrder; sinks fed
+// directly can call it before flattening labels.
+func NormalizeLabels(labels []Label) []Label {
+	if len(labels) < 2 {
+		return labels
+	}
+	normalized := true
+	for i := 1; i < len(labels); i++ {
+		if labels[i-1].Name >= labels[i].Name {
+			normalized = false
+			break
+		}
+	}
+	if normalized {
+		return labels
+	}
+
+	sorted := make([]Label, len(labels))
+	copy(sorted, labels)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	// Keep the last label of each name, which the stable sort left last
+	out := sorted[:0]
+	for i, label := range sorted {
+		if i+1 < len(sorted) && sorted[i+1].Name == label.Name {
+			continue
+		}
+		out = append(out, label)
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeLabels(t *testing.T) {
+	labels := []Label{{"method", "POST"}, {"code", "200"}, {"method", "GET"}, {"a", "1"}}
+	expect := []Label{{"a", "1"}, {"code", "200"}, {"method", "GET"}}
+	if got := NormalizeLabels(labels); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad labels %v", got)
+	}
+	if labels[0] != (Label{"method", "POST"}) {
+		t.Fatalf("modified labels %v", labels)
+	}
+
+	// Normalized labels are returned as they are
+	if got := NormalizeLabels(expect); &got[0] != &expect[0] {
+		t.Fatalf("expected the same slice")
+	}
+	if got := NormalizeLabels(nil); got != nil {
+		t.Fatalf("bad labels %v", got)
+	}
+}
+
+// flattenedNames returns the names of key and labels flattened by statsd,
+// statsite and inmem when emitted through a Metrics with order
+func flattenedNames(t *testing.T, order LabelOrder, key []string, labels []Label) []string {
+	statsdQueue := make(chan string, 1)
+	statsiteQueue := make(chan string, 1)
+	inm := NewInmemSink(time.Minute, time.Minute)
+	conf := DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	conf.LabelOrder = order
+	m, err := New(conf, FanoutSink{
+		&StatsdSink{metricQueue: statsdQueue},
+		&StatsiteSink{metricQueue: statsiteQueue},
+		inm,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.SetGaugeWithLabels(key, 1, labels)
+
+	var inmemName string
+	for k := range inm.Data()[0].Gauges {
+		inmemName = k
+	}
+	return []string{
+		strings.TrimSuffix(<-statsdQueue, ":1.000000|g\n"),
+		strings.TrimSuffix(<-statsiteQueue, ":1.000000|g\n"),
+		inmemName,
+	}
+}
+
+func TestLabelOrder_Sinks(t *testing.T) {
+	key := []string{"api", "requests"}
+	emissions := [][]Label{
+		{{"code", "200"}, {"method", "GET"}},
+		{{"method", "GET"}, {"code", "200"}},
+		{{"method", "POST"}, {"code", "200"}, {"method", "GET"}},
+	}
+
+	// The same labels in any order flatten to the same names in every sink
+	expect := []string{"api.requests.200.GET", "api.requests.200.GET", "api.requests;code=200;method=GET"}
+	for _, labels := range emissions {
+		if got := flattenedNames(t, LabelOrderSorted, key, labels); !reflect.DeepEqual(got, expect) {
+			t.Fatalf("bad names for %v: %q", labels, got)
+		}
+	}
+
+	// Preserving the order flattens the labels as given
+	expect = []string{"api.requests.GET.200", "api.requests.GET.200", "api.requests;method=GET;code=200"}
+	if got := flattenedNames(t, LabelOrderPreserved, key, emissions[1]); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad names: %q", got)
+	}
+}
+
+func TestLabelOrder_Metrics(t *testing.T) {
+	m, met := mockMetric()
+	met.Middlewares = []Middleware{func(e *Emission) bool {
+		e.Labels = append(e.Labels, Label{"added", "1"})
+		return true
+	}}
+
+	// Every sink receives the labels normalized, including those added by
+	// middlewares
+	met.IncrCounterWithLabels([]string{"c"}, 1, []Label{{"method", "GET"}, {"code", "200"}})
+	expect := []Label{{"added", "1"}, {"code", "200"}, {"method", "GET"}}
+	if !reflect.DeepEqual(m.labels[0], expect) {
+		t.Fatalf("bad labels %v", m.labels[0])
+	}
+}
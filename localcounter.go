@@ -0,0 +1,76 @@
+package metrics
+
+import "time"
+
+// LocalCounter accumulates the increments of a hot counter in a single
+// goroutine, and emits their sum as one increment per flush interval, e.g.
+// for a worker loop counting millions of items a second. It trades
+// exactness for throughput: a sink only sees the increments of the last
+// flush, so it lags behind by up to the interval, and counts one increment
+// per flush rather than per call, which changes the Count of sinks
+// aggregating them, like the InmemSink. The total still converges once
+// every handle is flushed or closed.
+//
+// The interval is checked on every increment only, so an idle handle holds
+// its increments until the next one, Flush or Close. A LocalCounter is not
+// safe for concurrent use; each goroutine should acquire its own.
+type LocalCounter struct {
+	m        *Metrics
+	key      []string
+	labels   []Label
+	interval time.Duration
+
+	pending   float64
+	lastFlush time.Time
+	closed    bool
+}
+
+// AcquireLocalCounter returns a LocalCounter incrementing the counter key,
+// with labels, which flushes at most every interval, or on every increment if
+// interval is zero.
+func (m *Metrics) AcquireLocalCounter(key []string, labels []Label, interval time.Duration) *LocalCounter {
+	return &LocalCounter{
+		m: m,
+		// Copy as the caller may reuse its slices while the handle is held
+		key:       append([]string(nil), key...),
+		labels:    append([]Label(nil), labels...),
+		interval:  interval,
+		lastFlush: m.now(),
+	}
+}
+
+// Incr adds val to the counter, flushing it if the interval has passed since
+// the last flush. Once the handle is closed, the increment is emitted right
+// away.
+func (c *LocalCounter) Incr(val float32) {
+	c.pending += float64(val)
+	if c.closed {
+		c.Flush()
+		return
+	}
+	if now := c.m.now(); now.Sub(c.lastFlush) >= c.interval {
+		c.flush(now)
+	}
+}
+
+// Flush emits the increments accumulated since the last flush, if any
+func (c *LocalCounter) Flush() {
+	c.flush(c.m.now())
+}
+
+// Close flushes the counter, after which the handle emits every increment
+// right away. Closing it again does nothing.
+func (c *LocalCounter) Close() {
+	c.Flush()
+	c.closed = true
+}
+
+// flush emits the pending increments at now
+func (c *LocalCounter) flush(now time.Time) {
+	c.lastFlush = now
+	if c.pending == 0 {
+		return
+	}
+	c.m.IncrCounterWithLabels(c.key, float32(c.pending), c.labels)
+	c.pending = 0
+}
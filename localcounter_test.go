@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalCounter_Flush(t *testing.T) {
+	m, met := mockMetric()
+	clock := NewFakeClock(time.Unix(1000, 0))
+	met.clock = clock
+	labels := []Label{{"worker", "1"}}
+	c := met.AcquireLocalCounter([]string{"items"}, labels, time.Second)
+
+	// Increments are held until the interval has passed
+	c.Incr(1)
+	c.Incr(2)
+	if len(m.vals) != 0 {
+		t.Fatalf("unexpected emissions: %v", m.vals)
+	}
+	clock.Advance(time.Second)
+	c.Incr(3)
+	if !reflect.DeepEqual(m.vals, []float32{6}) || !reflect.DeepEqual(m.labels[0], labels) {
+		t.Fatalf("bad emissions: %v %v", m.vals, m.labels)
+	}
+
+	// Closing flushes the rest, and increments after it are emitted right
+	// away
+	c.Incr(4)
+	c.Close()
+	c.Close()
+	c.Incr(5)
+	if !reflect.DeepEqual(m.vals, []float32{6, 4, 5}) {
+		t.Fatalf("bad emissions: %v", m.vals)
+	}
+}
+
+func TestLocalCounter_Converges(t *testing.T) {
+	inm := NewInmemSink(10*time.Second, time.Minute)
+	met := &Metrics{Config: Config{FilterDefault: true}, sink: inm}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := met.AcquireLocalCounter([]string{"items"}, nil, time.Millisecond)
+			defer c.Close()
+			for i := 0; i < 10000; i++ {
+				c.Incr(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	counter := inm.Data()[0].Counters["items"]
+	if counter.Sum != 40000 {
+		t.Fatalf("bad total: %v", counter.Sum)
+	}
+	// Far fewer increments reached the sink than were made
+	if counter.Count >= 40000 {
+		t.Fatalf("bad count: %d", counter.Count)
+	}
+}
+
+func BenchmarkLocalCounter(b *testing.B) {
+	met := &Metrics{Config: Config{FilterDefault: true}, sink: NewInmemSink(10*time.Second, time.Minute)}
+	key := []string{"worker", "items"}
+
+	b.Run("direct", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				met.IncrCounter(key, 1)
+			}
+		})
+	})
+	b.Run("local", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			c := met.AcquireLocalCounter(key, nil, 100*time.Millisecond)
+			defer c.Close()
+			for pb.Next() {
+				c.Incr(1)
+			}
+		})
+	})
+}
@@ -0,0 +1,425 @@
+// Package loki provides a MetricSink which sends every emission as a log
+// line to Grafana Loki through its push API, so metrics can be queried with
+// LogQL alongside the logs of the same streams.
+package loki
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	// DefaultBatchSize is the number of pending entries which triggers a
+	// flush
+	DefaultBatchSize = 1000
+
+	// DefaultFlushInterval is how often pending entries are flushed
+	DefaultFlushInterval = 10 * time.Second
+
+	// DefaultSendTimeout bounds the duration of each request
+	DefaultSendTimeout = 10 * time.Second
+)
+
+// Metric types, as sent in the type field of the log lines
+const (
+	TypeGauge   = "gauge"
+	TypeCounter = "counter"
+	TypeSample  = "sample"
+	TypeKey     = "key"
+)
+
+// LokiOpts is used to configure the LokiSink
+type LokiOpts struct {
+	// Endpoint is the URL of the push API entries are posted to, e.g.
+	// http://localhost:3100/loki/api/v1/push. Required.
+	Endpoint string
+
+	// TenantID, if set, is sent as the X-Scope-OrgID header, for Loki
+	// running in multi-tenant mode
+	TenantID string
+
+	// StreamLabels are added to the labels of every stream, e.g.
+	// job="metrics" to tell the metrics apart from the logs. A label of a
+	// metric with the same name takes precedence.
+	StreamLabels []metrics.Label
+
+	// StructuredMetadata sends the labels of metrics as the structured
+	// metadata of their entries rather than as stream labels, so their
+	// values don't create streams, e.g. for labels of high cardinality. It
+	// requires Loki 3.0 or later, or 2.9 with structured metadata enabled.
+	StructuredMetadata bool
+
+	// BatchSize is the number of pending entries which triggers a flush,
+	// and the maximum number of entries per request. Defaults to
+	// DefaultBatchSize.
+	BatchSize int
+
+	// FlushInterval is how often pending entries are flushed, so entries
+	// are sent timely even when few are emitted. Defaults to
+	// DefaultFlushInterval.
+	FlushInterval time.Duration
+
+	// SendTimeout bounds each request. Defaults to DefaultSendTimeout.
+	SendTimeout time.Duration
+
+	// MaxPending is the number of entries buffered while requests are slow
+	// or failing. Entries emitted while the buffer is full are dropped.
+	// Defaults to ten times BatchSize.
+	MaxPending int
+
+	// Client is the HTTP client used to send requests. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	// ErrorLog is used to log failed flushes. Defaults to a FailureLogger
+	// from metrics.NewFailureLogger.
+	ErrorLog *metrics.FailureLogger
+}
+
+// LokiSink provides a MetricSink that buffers every emission as a log entry
+// and pushes the entries in batches, once BatchSize entries are pending or
+// every FlushInterval. Each line is in logfmt, with the fields "name",
+// "type", one of the Type constants, and "value", e.g.
+//
+//	name=http.requests type=counter value=1
+//
+// so LogQL can extract them with the logfmt parser. Entries are grouped into
+// streams by their labels, which are the StreamLabels and the labels of the
+// metric, unless StructuredMetadata is set. Label names are sanitized to the
+// characters Loki allows. Emissions are not aggregated. Entries of a failed
+// request are dropped.
+type LokiSink struct {
+	// dropped, errors and offset are accessed atomically and kept first to
+	// guarantee 64-bit alignment
+	dropped uint64
+	errors  uint64
+	offset  int64 // time.Duration added to timestamps
+
+	opts LokiOpts
+
+	lock    sync.Mutex
+	pending []entry
+
+	// flushLock serializes flushes, so batches are sent in order
+	flushLock sync.Mutex
+
+	flushChan chan struct{}
+	stopChan  chan struct{}
+	doneChan  chan struct{}
+	stopOnce  sync.Once
+}
+
+// entry is a log entry waiting to be pushed
+type entry struct {
+	stream   map[string]string
+	ts       int64
+	line     string
+	metadata map[string]string
+}
+
+// pushRequest is the body of the push API
+type pushRequest struct {
+	Streams []pushStream `json:"streams"`
+}
+
+// pushStream holds the entries of a stream. Each value holds the timestamp
+// in nanoseconds and the line, both as strings, followed by the structured
+// metadata if any.
+type pushStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][]interface{}   `json:"values"`
+}
+
+// NewLokiSink creates a LokiSink and starts flushing it. Call Shutdown to
+// send the remaining entries and stop.
+func NewLokiSink(opts LokiOpts) (*LokiSink, error) {
+	if opts.Endpoint == "" {
+		return nil, fmt.Errorf("endpoint is required")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.SendTimeout <= 0 {
+		opts.SendTimeout = DefaultSendTimeout
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = 10 * opts.BatchSize
+	}
+	if opts.MaxPending < opts.BatchSize {
+		return nil, fmt.Errorf("max pending %d is below the batch size %d", opts.MaxPending, opts.BatchSize)
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.ErrorLog == nil {
+		opts.ErrorLog = metrics.NewFailureLogger()
+	}
+
+	s := &LokiSink{
+		opts:      opts,
+		flushChan: make(chan struct{}, 1),
+		stopChan:  make(chan struct{}),
+		doneChan:  make(chan struct{}),
+	}
+	if err := metrics.GoSink(s.flushMetrics); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Shutdown stops the periodic flush and sends the remaining entries. It is
+// safe to call more than once.
+func (s *LokiSink) Shutdown() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	<-s.doneChan
+	if err := s.Flush(); err != nil {
+		s.opts.ErrorLog.Printf("[ERR] Error pushing to Loki! Err: %s", err)
+	}
+}
+
+// Flush sends the pending entries, in batches of at most BatchSize entries.
+func (s *LokiSink) Flush() error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	s.lock.Lock()
+	entries := s.pending
+	s.pending = nil
+	s.lock.Unlock()
+
+	var firstErr error
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > s.opts.BatchSize {
+			n = s.opts.BatchSize
+		}
+		if err := s.send(entries[:n]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		entries = entries[n:]
+	}
+	return firstErr
+}
+
+// SetTimestampOffset adds offset to the timestamps of later entries, as
+// described by metrics.TimestampSink
+func (s *LokiSink) SetTimestampOffset(offset time.Duration) {
+	atomic.StoreInt64(&s.offset, int64(offset))
+}
+
+// SinkStats returns the number of entries dropped because the buffer was
+// full or their request failed, and the number of failed requests.
+func (s *LokiSink) SinkStats() metrics.SinkStats {
+	return metrics.SinkStats{
+		Dropped: atomic.LoadUint64(&s.dropped),
+		Errors:  atomic.LoadUint64(&s.errors),
+	}
+}
+
+func (s *LokiSink) flushMetrics() {
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+	defer close(s.doneChan)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.flushChan:
+		case <-s.stopChan:
+			return
+		}
+		if err := s.Flush(); err != nil {
+			s.opts.ErrorLog.Printf("[ERR] Error pushing to Loki! Err: %s", err)
+		}
+	}
+}
+
+// send pushes a single batch
+func (s *LokiSink) send(entries []entry) error {
+	if err := s.post(newPushRequest(entries)); err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		atomic.AddUint64(&s.dropped, uint64(len(entries)))
+		return err
+	}
+	return nil
+}
+
+func (s *LokiSink) post(push pushRequest) error {
+	body, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.SendTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", s.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if s.opts.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", s.opts.TenantID)
+	}
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// newPushRequest groups entries into streams by their labels, keeping the
+// order of the entries within every stream
+func newPushRequest(entries []entry) pushRequest {
+	var push pushRequest
+	index := make(map[string]int)
+	for _, e := range entries {
+		hash := streamHash(e.stream)
+		i, ok := index[hash]
+		if !ok {
+			i = len(push.Streams)
+			index[hash] = i
+			push.Streams = append(push.Streams, pushStream{Stream: e.stream})
+		}
+		value := []interface{}{strconv.FormatInt(e.ts, 10), e.line}
+		if len(e.metadata) > 0 {
+			value = append(value, e.metadata)
+		}
+		push.Streams[i].Values = append(push.Streams[i].Values, value)
+	}
+	return push
+}
+
+// streamHash returns a string identifying the labels of a stream
+func streamHash(stream map[string]string) string {
+	names := make([]string, 0, len(stream))
+	for name := range stream {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%q;", name, stream[name])
+	}
+	return b.String()
+}
+
+// forbiddenChars are replaced in label names by underscores
+var forbiddenChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// labelName returns name with the characters Loki doesn't allow in label
+// names replaced
+func labelName(name string) string {
+	name = forbiddenChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// logfmtValue returns v quoted if logfmt requires it
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\\\t\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// add buffers an entry, waking up the flush loop once a batch is pending
+func (s *LokiSink) add(key []string, val float32, labels []metrics.Label, typ string) {
+	stream := make(map[string]string, len(s.opts.StreamLabels)+len(labels))
+	for _, label := range s.opts.StreamLabels {
+		stream[labelName(label.Name)] = label.Value
+	}
+	var metadata map[string]string
+	if s.opts.StructuredMetadata && len(labels) > 0 {
+		metadata = make(map[string]string, len(labels))
+	}
+	for _, label := range labels {
+		if metadata != nil {
+			metadata[labelName(label.Name)] = label.Value
+		} else {
+			stream[labelName(label.Name)] = label.Value
+		}
+	}
+
+	value := strconv.FormatFloat(float64(val), 'g', -1, 32)
+	e := entry{
+		stream:   stream,
+		ts:       time.Now().Add(time.Duration(atomic.LoadInt64(&s.offset))).UnixNano(),
+		line:     fmt.Sprintf("name=%s type=%s value=%s", logfmtValue(strings.Join(key, ".")), typ, value),
+		metadata: metadata,
+	}
+
+	s.lock.Lock()
+	if len(s.pending) >= s.opts.MaxPending {
+		s.lock.Unlock()
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+	s.pending = append(s.pending, e)
+	full := len(s.pending) >= s.opts.BatchSize
+	s.lock.Unlock()
+
+	if full {
+		select {
+		case s.flushChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Implementation of methods in the MetricSink interface
+
+func (s *LokiSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *LokiSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.add(key, val, labels, TypeGauge)
+}
+
+func (s *LokiSink) EmitKey(key []string, val float32) {
+	s.add(key, val, nil, TypeKey)
+}
+
+func (s *LokiSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *LokiSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.add(key, val, labels, TypeCounter)
+}
+
+func (s *LokiSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *LokiSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.add(key, val, labels, TypeSample)
+}
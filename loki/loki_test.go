@@ -0,0 +1,255 @@
+package loki
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// receivedStream is a stream as decoded by the fake endpoint
+type receivedStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][]interface{}   `json:"values"`
+}
+
+// fakeEndpoint is a push API recording the streams it receives. The first
+// failures requests are answered with status.
+type fakeEndpoint struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests int
+	failures int
+	status   int
+	tenants  []string
+	received []receivedStream
+}
+
+func newFakeEndpoint(t *testing.T) *fakeEndpoint {
+	f := &fakeEndpoint{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		f.requests++
+		f.tenants = append(f.tenants, r.Header.Get("X-Scope-OrgID"))
+		if r.URL.Path != "/loki/api/v1/push" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("bad request: %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		if f.failures > 0 {
+			f.failures--
+			w.WriteHeader(f.status)
+			return
+		}
+		var push struct {
+			Streams []receivedStream `json:"streams"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			t.Errorf("bad body: %v", err)
+		}
+		f.received = append(f.received, push.Streams...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return f
+}
+
+func (f *fakeEndpoint) take() []receivedStream {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	streams := f.received
+	f.received = nil
+	return streams
+}
+
+func (f *fakeEndpoint) getRequests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+func testSink(t *testing.T, f *fakeEndpoint, opts LokiOpts) *LokiSink {
+	opts.Endpoint = f.URL + "/loki/api/v1/push"
+	opts.FlushInterval = time.Hour
+	sink, err := NewLokiSink(opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return sink
+}
+
+// lines returns the lines of the values of a stream
+func lines(t *testing.T, s receivedStream) []string {
+	var lines []string
+	for _, v := range s.Values {
+		if len(v) < 2 {
+			t.Fatalf("bad value: %v", v)
+		}
+		lines = append(lines, v[1].(string))
+	}
+	return lines
+}
+
+func TestNewLokiSink_Invalid(t *testing.T) {
+	for _, opts := range []LokiOpts{
+		{},
+		{Endpoint: "http://localhost:3100/loki/api/v1/push", BatchSize: 10, MaxPending: 5},
+	} {
+		if _, err := NewLokiSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
+
+func TestLokiSink_Streams(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, f, LokiOpts{
+		TenantID:     "team-a",
+		StreamLabels: []metrics.Label{{Name: "job", Value: "metrics"}, {Name: "region", Value: "default"}},
+	})
+	defer sink.Shutdown()
+
+	start := time.Now()
+	labels := []metrics.Label{{Name: "region", Value: "west"}, {Name: "http.method", Value: "GET"}}
+	sink.SetGauge([]string{"queue", "depth"}, 3)
+	sink.IncrCounterWithLabels([]string{"http", "requests"}, 1, labels)
+	sink.AddSampleWithLabels([]string{"http", "latency"}, 12.5, labels)
+	sink.EmitKey([]string{"build id"}, 7)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	streams := f.take()
+	if len(streams) != 2 {
+		t.Fatalf("bad streams: %+v", streams)
+	}
+	if !reflect.DeepEqual(streams[0].Stream, map[string]string{"job": "metrics", "region": "default"}) {
+		t.Fatalf("bad stream labels: %v", streams[0].Stream)
+	}
+	expect := []string{"name=queue.depth type=gauge value=3", `name="build id" type=key value=7`}
+	if got := lines(t, streams[0]); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad lines: %q", got)
+	}
+
+	// Labels of metrics are stream labels, taking precedence over the
+	// stream labels of the sink
+	if !reflect.DeepEqual(streams[1].Stream, map[string]string{"job": "metrics", "region": "west", "http_method": "GET"}) {
+		t.Fatalf("bad stream labels: %v", streams[1].Stream)
+	}
+	expect = []string{"name=http.requests type=counter value=1", "name=http.latency type=sample value=12.5"}
+	if got := lines(t, streams[1]); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad lines: %q", got)
+	}
+
+	ts, err := strconv.ParseInt(streams[1].Values[0][0].(string), 10, 64)
+	if err != nil {
+		t.Fatalf("bad timestamp: %v", err)
+	}
+	if at := time.Unix(0, ts); at.Before(start.Add(-time.Second)) || at.After(time.Now().Add(time.Second)) {
+		t.Fatalf("bad timestamp: %s", at)
+	}
+	if f.tenants[0] != "team-a" {
+		t.Fatalf("bad tenant: %q", f.tenants[0])
+	}
+}
+
+func TestLokiSink_StructuredMetadata(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, f, LokiOpts{
+		StreamLabels:       []metrics.Label{{Name: "job", Value: "metrics"}},
+		StructuredMetadata: true,
+	})
+	defer sink.Shutdown()
+
+	sink.IncrCounterWithLabels([]string{"requests"}, 1, []metrics.Label{{Name: "user", Value: "1"}})
+	sink.IncrCounterWithLabels([]string{"requests"}, 1, []metrics.Label{{Name: "user", Value: "2"}})
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The labels don't split the stream
+	streams := f.take()
+	if len(streams) != 1 || !reflect.DeepEqual(streams[0].Stream, map[string]string{"job": "metrics"}) {
+		t.Fatalf("bad streams: %+v", streams)
+	}
+	for i, v := range streams[0].Values {
+		if len(v) != 3 || !reflect.DeepEqual(v[2], map[string]interface{}{"user": strconv.Itoa(i + 1)}) {
+			t.Fatalf("bad value: %v", v)
+		}
+	}
+}
+
+func TestLokiSink_Batches(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, f, LokiOpts{BatchSize: 2, MaxPending: 3})
+	defer sink.Shutdown()
+
+	// Every entry is either sent, in batches of at most BatchSize, or
+	// dropped while the buffer is full
+	for i := 0; i < 10; i++ {
+		sink.IncrCounter([]string{"requests"}, 1)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var total int
+	for _, s := range f.take() {
+		if len(s.Values) > 2 {
+			t.Fatalf("bad batch: %d", len(s.Values))
+		}
+		total += len(s.Values)
+	}
+	dropped := sink.SinkStats().Dropped
+	if total == 0 || total+int(dropped) != 10 {
+		t.Fatalf("bad entries: %d sent, %d dropped", total, dropped)
+	}
+
+	// Entries of a failed request are dropped
+	f.lock.Lock()
+	f.failures, f.status = 1, http.StatusBadRequest
+	f.lock.Unlock()
+	requests := f.getRequests()
+	sink.IncrCounter([]string{"requests"}, 1)
+	if err := sink.Flush(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if f.getRequests() != requests+1 || len(f.take()) != 0 {
+		t.Fatalf("unexpected entries")
+	}
+	if stats := sink.SinkStats(); stats.Errors != 1 || stats.Dropped != dropped+1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+}
+
+func TestLokiSink_Shutdown(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, f, LokiOpts{})
+	sink.SetTimestampOffset(-time.Hour)
+	sink.SetGauge([]string{"gauge"}, 1)
+	sink.Shutdown()
+
+	streams := f.take()
+	if len(streams) != 1 || len(streams[0].Values) != 1 {
+		t.Fatalf("bad streams: %+v", streams)
+	}
+	ts, _ := strconv.ParseInt(streams[0].Values[0][0].(string), 10, 64)
+	if at := time.Unix(0, ts); at.After(time.Now().Add(-50 * time.Minute)) {
+		t.Fatalf("offset not applied: %s", at)
+	}
+
+	// Shutting down again sends nothing more
+	sink.Shutdown()
+	if streams := f.take(); len(streams) != 0 {
+		t.Fatalf("bad streams: %+v", streams)
+	}
+}
@@ -1,8 +1,13 @@
 package metrics
 
 import (
+	"fmt"
+	"log"
+	"math"
 	"runtime"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/go-immutable-radix"
@@ -18,41 +23,182 @@ func (m *Metrics) SetGauge(key []string, val float32) {
 }
 
 func (m *Metrics) SetGaugeWithLabels(key []string, val float32, labels []Label) {
-	if m.HostName != "" {
-		if m.EnableHostnameLabel {
-			labels = append(labels, Label{"host", m.HostName})
-		} else if m.EnableHostname {
-			key = insert(0, m.HostName, key)
-		}
+	m.setGaugeFor(key, val, labels, m.ServiceName)
+}
+
+func (m *Metrics) setGaugeFor(key []string, val float32, labels []Label, service string) {
+	defer m.recordSelfLatency(MetricTypeGauge, m.startSelfLatency())
+	labels = m.thresholdLabels(key, val, labels)
+	key, labels, ok := m.gaugeKey(key, labels, service)
+	if !ok {
+		return
+	}
+	allowed, labelsFiltered := m.allowMetric(key, labels)
+	if !allowed {
+		return
+	}
+	key, val, labelsFiltered, ok = m.middleware(MetricTypeGauge, key, val, labelsFiltered)
+	if !ok {
+		return
+	}
+	m.sink.SetGaugeWithLabels(key, val, labelsFiltered)
+}
+
+// SetGaugeGroup sets a group of related gauges measured together, e.g. the
+// cpu, memory and disk usage of a resource. Each entry is emitted as a gauge
+// under key with its name appended, all sharing labels. The filters are
+// evaluated and the gauges emitted under a single acquisition of the filter
+// lock, so an UpdateFilter can't apply to part of the group only. Entries
+// are emitted in name order.
+func (m *Metrics) SetGaugeGroup(key []string, gauges map[string]float32, labels []Label) {
+	defer m.recordSelfLatency(MetricTypeGauge, m.startSelfLatency())
+	names := make([]string, 0, len(gauges))
+	for name := range gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m.filterLock.RLock()
+	defer m.filterLock.RUnlock()
+	for _, name := range names {
+		// Cap the slices so each entry gets its own key and label backing
+		// arrays when they are appended to
+		m.setGaugeLocked(append(key[:len(key):len(key)], name), gauges[name], labels[:len(labels):len(labels)])
+	}
+}
+
+// setGaugeLocked sets a gauge of a group. The caller must hold filterLock.
+func (m *Metrics) setGaugeLocked(key []string, val float32, labels []Label) {
+	labels = m.thresholdLabels(key, val, labels)
+	key, labels, ok := m.gaugeKey(key, labels, m.ServiceName)
+	if !ok {
+		return
+	}
+	allowed, labelsFiltered := m.allowMetricLocked(key, labels)
+	if !allowed {
+		return
+	}
+	key, val, labelsFiltered, ok = m.middleware(MetricTypeGauge, key, val, labelsFiltered)
+	if !ok {
+		return
+	}
+	m.sink.SetGaugeWithLabels(key, val, labelsFiltered)
+}
+
+// gaugeKey applies the key policies and prefixes to a gauge, returning the
+// key and labels to emit and whether to emit it at all
+func (m *Metrics) gaugeKey(key []string, labels []Label, service string) ([]string, []Label, bool) {
+	return m.metricKey(MetricTypeGauge, "gauge", key, labels, service)
+}
+
+// metricKey checks key and adds the hostname, the typePrefix segment and the
+// service to the key or labels of an emission of typ, returning false if it
+// is dropped. Keys emitted with EmitKey get no hostname, and always get the
+// service as a key segment.
+func (m *Metrics) metricKey(typ MetricType, typePrefix string, key []string, labels []Label, service string) ([]string, []Label, bool) {
+	key, ok := m.checkKey(key)
+	if !ok {
+		return nil, nil, false
+	}
+	if typ != MetricTypeKey {
+		key, labels = m.addHostname(typ, key, labels)
 	}
 	if m.EnableTypePrefix {
-		key = insert(0, "gauge", key)
+		key = insert(0, typePrefix, key)
 	}
-	if m.ServiceName != "" {
-		if m.EnableServiceLabel {
-			labels = append(labels, Label{"service", m.ServiceName})
+	if service != "" {
+		if m.EnableServiceLabel && typ != MetricTypeKey {
+			labels = append(labels, Label{"service", service})
 		} else {
-			key = insert(0, m.ServiceName, key)
+			key = insert(0, service, key)
+		}
+	}
+	if key, ok = m.checkDepth(key); !ok {
+		return nil, nil, false
+	}
+	if !m.checkType(key, typ) {
+		return nil, nil, false
+	}
+	return key, labels, true
+}
+
+// addHostname adds HostName to the key or the labels of a metric of typ, as
+// selected by HostnamePlacement
+func (m *Metrics) addHostname(typ MetricType, key []string, labels []Label) ([]string, []Label) {
+	if m.HostName == "" {
+		return key, labels
+	}
+	switch m.HostnamePlacement {
+	case HostnameKeySegment:
+		if m.EnableHostname || m.EnableHostnameLabel {
+			key = insert(0, m.HostName, key)
+		}
+	case HostnameLabel:
+		if m.EnableHostname || m.EnableHostnameLabel {
+			labels = append(labels, Label{"host", m.HostName})
 		}
+	default:
+		if m.EnableHostnameLabel {
+			labels = append(labels, Label{"host", m.HostName})
+		} else if m.EnableHostname && typ == MetricTypeGauge {
+			key = insert(0, m.HostName, key)
+		}
+	}
+	return key, labels
+}
+
+// SetGaugeInt sets a gauge to an integer value. Sinks implementing
+// IntegerSink emit it without a fractional part, others receive it as a
+// float32 through SetGaugeWithLabels.
+func (m *Metrics) SetGaugeInt(key []string, val int64) {
+	m.SetGaugeIntWithLabels(key, val, nil)
+}
+
+func (m *Metrics) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	m.setGaugeIntFor(key, val, labels, m.ServiceName)
+}
+
+func (m *Metrics) setGaugeIntFor(key []string, val int64, labels []Label, service string) {
+	defer m.recordSelfLatency(MetricTypeGauge, m.startSelfLatency())
+	labels = m.thresholdLabels(key, float32(val), labels)
+	key, labels, ok := m.gaugeKey(key, labels, service)
+	if !ok {
+		return
 	}
 	allowed, labelsFiltered := m.allowMetric(key, labels)
 	if !allowed {
 		return
 	}
-	m.sink.SetGaugeWithLabels(key, val, labelsFiltered)
+	key, fval, labelsFiltered, ok := m.middleware(MetricTypeGauge, key, float32(val), labelsFiltered)
+	if !ok {
+		return
+	}
+	if fval != float32(val) {
+		// Changed by a middleware
+		m.sink.SetGaugeWithLabels(key, fval, labelsFiltered)
+		return
+	}
+	setGaugeInt(m.sink, key, val, labelsFiltered)
 }
 
 func (m *Metrics) EmitKey(key []string, val float32) {
-	if m.EnableTypePrefix {
-		key = insert(0, "kv", key)
-	}
-	if m.ServiceName != "" {
-		key = insert(0, m.ServiceName, key)
+	m.emitKeyFor(key, val, m.ServiceName)
+}
+
+func (m *Metrics) emitKeyFor(key []string, val float32, service string) {
+	defer m.recordSelfLatency(MetricTypeKey, m.startSelfLatency())
+	key, _, ok := m.metricKey(MetricTypeKey, "kv", key, nil, service)
+	if !ok {
+		return
 	}
 	allowed, _ := m.allowMetric(key, nil)
 	if !allowed {
 		return
 	}
+	key, val, _, ok = m.middleware(MetricTypeKey, key, val, nil)
+	if !ok {
+		return
+	}
 	m.sink.EmitKey(key, val)
 }
 
@@ -61,24 +207,112 @@ func (m *Metrics) IncrCounter(key []string, val float32) {
 }
 
 func (m *Metrics) IncrCounterWithLabels(key []string, val float32, labels []Label) {
-	if m.HostName != "" && m.EnableHostnameLabel {
-		labels = append(labels, Label{"host", m.HostName})
+	m.incrCounterFor(key, val, labels, m.ServiceName)
+}
+
+func (m *Metrics) incrCounterFor(key []string, val float32, labels []Label, service string) {
+	defer m.recordSelfLatency(MetricTypeCounter, m.startSelfLatency())
+	key, labels, ok := m.counterKey(key, labels, service)
+	if !ok {
+		return
 	}
-	if m.EnableTypePrefix {
-		key = insert(0, "counter", key)
+	allowed, labelsFiltered := m.allowMetric(key, labels)
+	if !allowed {
+		return
 	}
-	if m.ServiceName != "" {
-		if m.EnableServiceLabel {
-			labels = append(labels, Label{"service", m.ServiceName})
-		} else {
-			key = insert(0, m.ServiceName, key)
+	key, val, labelsFiltered, ok = m.middleware(MetricTypeCounter, key, m.scale(val), labelsFiltered)
+	if !ok {
+		return
+	}
+	m.sink.IncrCounterWithLabels(key, val, labelsFiltered)
+}
+
+// counterKey checks key and adds the hostname, type and service to the key
+// or labels of a counter, returning false if it is dropped
+func (m *Metrics) counterKey(key []string, labels []Label, service string) ([]string, []Label, bool) {
+	return m.metricKey(MetricTypeCounter, "counter", key, labels, service)
+}
+
+// sampleKey checks key and adds the hostname, typePrefix and service to the
+// key or labels of a sample, returning false if it is dropped. typePrefix is
+// "sample", or "timer" for timings.
+func (m *Metrics) sampleKey(key []string, labels []Label, service, typePrefix string) ([]string, []Label, bool) {
+	return m.metricKey(MetricTypeSample, typePrefix, key, labels, service)
+}
+
+// SetCounterTemporality tells sinks exporting the aggregation temporality of
+// counters, such as OTLP exporters, to export the counter key with
+// temporality. Counters are TemporalityDelta by default. Sinks which don't
+// export it ignore it.
+func (m *Metrics) SetCounterTemporality(key []string, temporality Temporality) {
+	key, _, ok := m.counterKey(key, nil, m.ServiceName)
+	if !ok {
+		return
+	}
+	setCounterTemporality(m.sink, key, temporality)
+}
+
+// ResetCounter tells sinks tracking the cumulative value of the counter key,
+// such as the Prometheus sink, that it was reset at its source, so it counts
+// up from zero again. Sinks only seeing deltas ignore it.
+func (m *Metrics) ResetCounter(key []string, labels []Label) {
+	m.resetCounterFor(key, labels, m.ServiceName)
+}
+
+func (m *Metrics) resetCounterFor(key []string, labels []Label, service string) {
+	defer m.recordSelfLatency(MetricTypeCounter, m.startSelfLatency())
+	key, labels, ok := m.counterKey(key, labels, service)
+	if !ok {
+		return
+	}
+	allowed, labelsFiltered := m.allowMetric(key, labels)
+	if !allowed {
+		return
+	}
+	if len(m.Middlewares) > 0 {
+		e := &Emission{Type: MetricTypeCounter, Key: key, Labels: labelsFiltered, Reset: true}
+		if !m.runMiddlewares(e) {
+			return
 		}
+		key, labelsFiltered = e.Key, e.Labels
+	}
+	resetCounter(m.sink, key, labelsFiltered)
+}
+
+// IncrCounterInt increments a counter by an integer value. Sinks
+// implementing IntegerSink emit it without a fractional part, others
+// receive it as a float32 through IncrCounterWithLabels.
+func (m *Metrics) IncrCounterInt(key []string, val int64) {
+	m.IncrCounterIntWithLabels(key, val, nil)
+}
+
+func (m *Metrics) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	m.incrCounterIntFor(key, val, labels, m.ServiceName)
+}
+
+func (m *Metrics) incrCounterIntFor(key []string, val int64, labels []Label, service string) {
+	defer m.recordSelfLatency(MetricTypeCounter, m.startSelfLatency())
+	key, labels, ok := m.counterKey(key, labels, service)
+	if !ok {
+		return
 	}
 	allowed, labelsFiltered := m.allowMetric(key, labels)
 	if !allowed {
 		return
 	}
-	m.sink.IncrCounterWithLabels(key, val, labelsFiltered)
+	if m.ValueMultiplier != 0 {
+		val = int64(math.Round(float64(val) * m.ValueMultiplier))
+	}
+	key, fval, labelsFiltered, ok := m.middleware(MetricTypeCounter, key, float32(val), labelsFiltered)
+	if !ok {
+		return
+	}
+	if fval != float32(val) {
+		// Changed by a middleware
+		m.sink.IncrCounterWithLabels(key, fval, labelsFiltered)
+		return
+	}
+	incrCounterInt(m.sink, key, val, labelsFiltered)
 }
 
 func (m *Metrics) AddSample(key []string, val float32) {
@@ -86,24 +320,73 @@ func (m *Metrics) AddSample(key []string, val float32) {
 }
 
 func (m *Metrics) AddSampleWithLabels(key []string, val float32, labels []Label) {
-	if m.HostName != "" && m.EnableHostnameLabel {
-		labels = append(labels, Label{"host", m.HostName})
+	m.addSampleFor(key, val, labels, m.ServiceName)
+}
+
+func (m *Metrics) addSampleFor(key []string, val float32, labels []Label, service string) {
+	defer m.recordSelfLatency(MetricTypeSample, m.startSelfLatency())
+	labels = m.thresholdLabels(key, val, labels)
+	key, labels, ok := m.sampleKey(key, labels, service, "sample")
+	if !ok {
+		return
 	}
-	if m.EnableTypePrefix {
-		key = insert(0, "sample", key)
+	labels = m.tagStack(labels)
+	allowed, labelsFiltered := m.allowMetric(key, labels)
+	if !allowed {
+		return
 	}
-	if m.ServiceName != "" {
-		if m.EnableServiceLabel {
-			labels = append(labels, Label{"service", m.ServiceName})
-		} else {
-			key = insert(0, m.ServiceName, key)
-		}
+	key, val, labelsFiltered, ok = m.middleware(MetricTypeSample, key, m.scale(val), labelsFiltered)
+	if !ok {
+		return
+	}
+	m.sink.AddSampleWithLabels(key, val, labelsFiltered)
+}
+
+// AddSampleFields records a group of related samples as one observation. Each
+// field is emitted as a sample under key with the field name appended, e.g.
+// fields "duration" and "bytes" under "http.request" give the samples
+// "http.request.duration" and "http.request.bytes", all sharing labels.
+// Fields are emitted in name order.
+func (m *Metrics) AddSampleFields(key []string, fields map[string]float32, labels []Label) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// Cap the slices so each field gets its own key and label backing
+		// arrays when they are appended to
+		fieldKey := append(key[:len(key):len(key)], name)
+		m.AddSampleWithLabels(fieldKey, fields[name], labels[:len(labels):len(labels)])
+	}
+}
+
+// ObserveBuckets records histogram observations which were already bucketed,
+// as described by BucketSink. Sinks that do not implement BucketSink receive
+// an approximate stream of samples instead.
+func (m *Metrics) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	m.observeBucketsFor(key, counts, labels, m.ServiceName)
+}
+
+func (m *Metrics) observeBucketsFor(key []string, counts map[float64]uint64, labels []Label, service string) {
+	defer m.recordSelfLatency(MetricTypeSample, m.startSelfLatency())
+	key, labels, ok := m.sampleKey(key, labels, service, "sample")
+	if !ok {
+		return
 	}
 	allowed, labelsFiltered := m.allowMetric(key, labels)
 	if !allowed {
 		return
 	}
-	m.sink.AddSampleWithLabels(key, val, labelsFiltered)
+	if len(m.Middlewares) > 0 {
+		e := &Emission{Type: MetricTypeSample, Key: key, Labels: labelsFiltered, Buckets: counts}
+		if !m.runMiddlewares(e) {
+			return
+		}
+		key, counts, labelsFiltered = e.Key, e.Buckets, e.Labels
+	}
+	observeBuckets(m.sink, key, counts, labelsFiltered)
 }
 
 func (m *Metrics) MeasureSince(key []string, start time.Time) {
@@ -111,27 +394,108 @@ func (m *Metrics) MeasureSince(key []string, start time.Time) {
 }
 
 func (m *Metrics) MeasureSinceWithLabels(key []string, start time.Time, labels []Label) {
-	if m.HostName != "" && m.EnableHostnameLabel {
-		labels = append(labels, Label{"host", m.HostName})
-	}
-	if m.EnableTypePrefix {
-		key = insert(0, "timer", key)
+	m.measureSinceFor(key, start, labels, m.ServiceName)
+}
+
+func (m *Metrics) measureSinceFor(key []string, start time.Time, labels []Label, service string) {
+	defer m.recordSelfLatency(MetricTypeSample, m.startSelfLatency())
+	elapsed := m.now().Sub(start)
+	if elapsed < 0 {
+		// Only possible when start carries no monotonic clock reading and the
+		// wall clock was set back. Record zero rather than a bogus value.
+		atomic.AddUint64(&m.timerAnomalies, 1)
+		elapsed = 0
 	}
-	if m.ServiceName != "" {
-		if m.EnableServiceLabel {
-			labels = append(labels, Label{"service", m.ServiceName})
-		} else {
-			key = insert(0, m.ServiceName, key)
-		}
+	val := m.timerValue(elapsed)
+	labels = m.thresholdLabels(key, val, labels)
+
+	key, labels, ok := m.sampleKey(key, labels, service, "timer")
+	if !ok {
+		return
 	}
+	labels = m.tagStack(labels)
 	allowed, labelsFiltered := m.allowMetric(key, labels)
 	if !allowed {
 		return
 	}
-	now := time.Now()
-	elapsed := now.Sub(start)
-	msec := float32(elapsed.Nanoseconds()) / float32(m.TimerGranularity)
-	m.sink.AddSampleWithLabels(key, msec, labelsFiltered)
+	key, val, labelsFiltered, ok = m.middleware(MetricTypeSample, key, val, labelsFiltered)
+	if !ok {
+		return
+	}
+	addTiming(m.sink, key, val, m.TimerGranularity, labelsFiltered)
+}
+
+// timerValue returns elapsed in units of TimerGranularity, of the configured
+// TimerPrecision. The division is done in float64, so the fraction is not
+// lost to the float32 precision of long nanosecond durations.
+func (m *Metrics) timerValue(elapsed time.Duration) float32 {
+	if m.TimerPrecision == TimerPrecisionTruncate {
+		return float32(elapsed / m.TimerGranularity)
+	}
+	return float32(float64(elapsed) / float64(m.TimerGranularity))
+}
+
+// defaultTimerCountSuffix is the suffix of the MeasureSinceWithCount counters
+// used when Config.TimerCountSuffix is empty
+const defaultTimerCountSuffix = "count"
+
+// MeasureSinceWithCount records the time since start like
+// MeasureSinceWithLabels, and increments a companion counter under key with
+// TimerCountSuffix appended, e.g. "api.request.count" for "api.request".
+// Both share labels.
+func (m *Metrics) MeasureSinceWithCount(key []string, start time.Time, labels []Label) {
+	suffix := m.TimerCountSuffix
+	if suffix == "" {
+		suffix = defaultTimerCountSuffix
+	}
+	// Cap the slices so the appends of either emission don't share backing
+	// arrays with the other
+	key = key[:len(key):len(key)]
+	labels = labels[:len(labels):len(labels)]
+
+	m.MeasureSinceWithLabels(key, start, labels)
+	m.IncrCounterWithLabels(append(key, suffix), 1, labels)
+}
+
+// scale applies the ValueMultiplier to a counter increment or sample value
+func (m *Metrics) scale(val float32) float32 {
+	if m.ValueMultiplier == 0 {
+		return val
+	}
+	return float32(float64(val) * m.ValueMultiplier)
+}
+
+// EmptyKeyDrops returns the number of metrics dropped by the
+// EmptyKeySegments policy.
+func (m *Metrics) EmptyKeyDrops() uint64 {
+	return atomic.LoadUint64(&m.emptyKeyDrops)
+}
+
+// TypeConflicts returns the number of emissions of a different type than
+// the first one emitted under their key, as detected by the MixedTypeKeys
+// policy.
+func (m *Metrics) TypeConflicts() uint64 {
+	return atomic.LoadUint64(&m.typeConflicts)
+}
+
+// DeepKeys returns the number of metrics whose key had more segments than
+// MaxKeyDepth, dropped or truncated by the KeyDepth policy.
+func (m *Metrics) DeepKeys() uint64 {
+	return atomic.LoadUint64(&m.deepKeys)
+}
+
+// TimerAnomalies returns the number of timings that measured a negative
+// duration and were recorded as zero instead.
+func (m *Metrics) TimerAnomalies() uint64 {
+	return atomic.LoadUint64(&m.timerAnomalies)
+}
+
+// now returns the current time from the configured clock
+func (m *Metrics) now() time.Time {
+	if m.clock == nil {
+		return systemClock{}.Now()
+	}
+	return m.clock.Now()
 }
 
 // UpdateFilter overwrites the existing filter with the given rules.
@@ -153,12 +517,12 @@ func (m *Metrics) UpdateFilterAndLabels(allow, block, allowedLabels, blockedLabe
 	} else {
 		m.allowedLabels = make(map[string]bool)
 		for _, v := range allowedLabels {
-			m.allowedLabels[v] = true
+			m.allowedLabels[m.LabelKeyCase.normalizeLabelName(v)] = true
 		}
 	}
 	m.blockedLabels = make(map[string]bool)
 	for _, v := range blockedLabels {
-		m.blockedLabels[v] = true
+		m.blockedLabels[m.LabelKeyCase.normalizeLabelName(v)] = true
 	}
 	m.AllowedLabels = allowedLabels
 	m.BlockedLabels = blockedLabels
@@ -191,19 +555,92 @@ func (m *Metrics) labelIsAllowed(label *Label) bool {
 	return true
 }
 
-// filterLabels return only allowed labels
+// filterLabels return only allowed labels, with their names normalized and
+// in the order of LabelOrder
 // the caller should lock m.filterLock while calling this method
 func (m *Metrics) filterLabels(labels []Label) []Label {
 	if labels == nil {
 		return nil
 	}
+	labels = m.normalizeLabels(labels)
 	toReturn := []Label{}
 	for _, label := range labels {
 		if m.labelIsAllowed(&label) {
 			toReturn = append(toReturn, label)
 		}
 	}
-	return toReturn
+	return m.orderLabels(toReturn)
+}
+
+// checkKey applies the EmptyKeySegments policy, returning the key to emit and
+// whether to emit it at all
+func (m *Metrics) checkKey(key []string) ([]string, bool) {
+	if m.EmptyKeySegments == EmptySegmentsKeep {
+		return key, true
+	}
+	empty := 0
+	for _, part := range key {
+		if part == "" {
+			empty++
+		}
+	}
+	if empty == 0 {
+		return key, true
+	}
+	if m.EmptyKeySegments == EmptySegmentsDrop || empty == len(key) {
+		atomic.AddUint64(&m.emptyKeyDrops, 1)
+		notifyDrop(key, nil, DropEmptyKey)
+		return nil, false
+	}
+
+	// Collapse into a new slice, leaving the caller's key untouched
+	collapsed := make([]string, 0, len(key)-empty)
+	for _, part := range key {
+		if part != "" {
+			collapsed = append(collapsed, part)
+		}
+	}
+	return collapsed, true
+}
+
+// checkDepth applies the KeyDepth policy to the prefixed key, returning the
+// key to emit and whether to emit it at all
+func (m *Metrics) checkDepth(key []string) ([]string, bool) {
+	if m.MaxKeyDepth <= 0 || len(key) <= m.MaxKeyDepth {
+		return key, true
+	}
+	atomic.AddUint64(&m.deepKeys, 1)
+	if m.KeyDepth == KeyDepthTruncate {
+		// Reslice with the capacity capped, so appending to the key never
+		// overwrites the caller's segments
+		return key[:m.MaxKeyDepth:m.MaxKeyDepth], true
+	}
+	notifyDrop(key, nil, DropKeyDepth)
+	return nil, false
+}
+
+// checkType applies the MixedTypeKeys policy to an emission of typ under
+// the prefixed key, returning whether to emit it
+func (m *Metrics) checkType(key []string, typ MetricType) bool {
+	if m.MixedTypeKeys == TypeConflictsIgnore {
+		return true
+	}
+	name := strings.Join(key, ".")
+	first, loaded := m.keyTypes.LoadOrStore(name, typ)
+	if !loaded || first.(MetricType) == typ {
+		return true
+	}
+
+	atomic.AddUint64(&m.typeConflicts, 1)
+	if m.MixedTypeKeys == TypeConflictsDrop {
+		notifyDrop(key, nil, DropTypeConflict)
+		return false
+	}
+	conflict := fmt.Sprintf("%s;%d", name, typ)
+	if _, warned := m.warnedTypes.LoadOrStore(conflict, true); !warned {
+		log.Printf("[WARN] metrics: %q emitted as a %s, but it was first emitted as a %s", name, typ, first.(MetricType))
+	}
+	return true
 }
 
 // Returns whether the metric should be allowed based on configured prefix filters
@@ -211,43 +648,101 @@ func (m *Metrics) filterLabels(labels []Label) []Label {
 func (m *Metrics) allowMetric(key []string, labels []Label) (bool, []Label) {
 	m.filterLock.RLock()
 	defer m.filterLock.RUnlock()
+	return m.allowMetricLocked(key, labels)
+}
 
-	if m.filter == nil || m.filter.Len() == 0 {
-		return m.Config.FilterDefault, m.filterLabels(labels)
+// allowMetricLocked is allowMetric for callers holding m.filterLock
+func (m *Metrics) allowMetricLocked(key []string, labels []Label) (bool, []Label) {
+	allowed := m.Config.FilterDefault
+	if m.filter != nil && m.filter.Len() > 0 {
+		if _, v, ok := m.filter.Root().LongestPrefix([]byte(strings.Join(key, "."))); ok {
+			allowed = v.(bool)
+		}
+	}
+	if !allowed {
+		notifyDrop(key, labels, DropFiltered)
 	}
+	return allowed, m.filterLabels(labels)
+}
 
-	_, allowed, ok := m.filter.Root().LongestPrefix([]byte(strings.Join(key, ".")))
-	if !ok {
-		return m.Config.FilterDefault, m.filterLabels(labels)
+// processStartTime is when the package was initialized, as close to the
+// start of the process as it can tell
+var processStartTime = time.Now()
+
+// defaultStartTimeGaugeName is the key of the start time gauge
+const defaultStartTimeGaugeName = "process.start_time_seconds"
+
+// Periodically emits the start time gauge, so sinks expiring idle gauges,
+// like the Prometheus sink, keep it
+func (m *Metrics) collectStartTime() {
+	for {
+		time.Sleep(m.ProfileInterval)
+		m.EmitStartTime()
 	}
+}
 
-	return allowed.(bool), m.filterLabels(labels)
+// EmitStartTime emits the start time of the process in Unix seconds as the
+// gauge named by Config.StartTimeGaugeName, from which dashboards can compute
+// the uptime as now - start. It is an integer gauge, so sinks supporting
+// them, such as the Prometheus sink, receive it exactly.
+func (m *Metrics) EmitStartTime() {
+	name := m.StartTimeGaugeName
+	if name == "" {
+		name = defaultStartTimeGaugeName
+	}
+	m.SetGaugeInt(strings.Split(name, "."), processStartTime.Unix())
 }
 
 // Periodically collects runtime stats to publish
 func (m *Metrics) collectStats() {
+	var backoff *runtimeBackoff
+	if m.RuntimeBackoff != nil {
+		backoff = newRuntimeBackoff(*m.RuntimeBackoff, m.ProfileInterval)
+	}
+	wait := m.ProfileInterval
 	for {
-		time.Sleep(m.ProfileInterval)
+		time.Sleep(wait)
 		m.EmitRuntimeStats()
+		if backoff != nil {
+			m.runtimeLock.Lock()
+			pauses := m.lastPauses
+			m.runtimeLock.Unlock()
+			wait = backoff.next(pauses, wait)
+		}
 	}
 }
 
 // Emits various runtime statsitics
 func (m *Metrics) EmitRuntimeStats() {
+	m.emitRuntimeStats()
+}
+
+// emitRuntimeStats emits the runtime statistics and returns the emitted
+// gauges, keyed by the name following "runtime."
+func (m *Metrics) emitRuntimeStats() map[string]float32 {
+	// Serialize periodic and on demand collections, which share lastNumGC
+	m.runtimeLock.Lock()
+	defer m.runtimeLock.Unlock()
+
+	gauges := make(map[string]float32)
+
 	// Export number of Goroutines
-	numRoutines := runtime.NumGoroutine()
-	m.SetGauge([]string{"runtime", "num_goroutines"}, float32(numRoutines))
+	gauges["num_goroutines"] = float32(runtime.NumGoroutine())
 
 	// Export memory stats
 	var stats runtime.MemStats
 	runtime.ReadMemStats(&stats)
-	m.SetGauge([]string{"runtime", "alloc_bytes"}, float32(stats.Alloc))
-	m.SetGauge([]string{"runtime", "sys_bytes"}, float32(stats.Sys))
-	m.SetGauge([]string{"runtime", "malloc_count"}, float32(stats.Mallocs))
-	m.SetGauge([]string{"runtime", "free_count"}, float32(stats.Frees))
-	m.SetGauge([]string{"runtime", "heap_objects"}, float32(stats.HeapObjects))
-	m.SetGauge([]string{"runtime", "total_gc_pause_ns"}, float32(stats.PauseTotalNs))
-	m.SetGauge([]string{"runtime", "total_gc_runs"}, float32(stats.NumGC))
+	gauges["alloc_bytes"] = float32(stats.Alloc)
+	gauges["sys_bytes"] = float32(stats.Sys)
+	gauges["malloc_count"] = float32(stats.Mallocs)
+	gauges["free_count"] = float32(stats.Frees)
+	gauges["heap_objects"] = float32(stats.HeapObjects)
+	gauges["total_gc_pause_ns"] = float32(stats.PauseTotalNs)
+	gauges["total_gc_runs"] = float32(stats.NumGC)
+
+	for _, name := range runtimeGaugeNames {
+		m.SetGauge(m.runtimeKey(name), gauges[name])
+	}
 
 	// Export info about the last few GC runs
 	num := stats.NumGC
@@ -262,11 +757,44 @@ func (m *Metrics) EmitRuntimeStats() {
 		m.lastNumGC = num - 255
 	}
 
+	var maxPause uint64
+	pauseKey := m.runtimeKey("gc_pause_ns")
 	for i := m.lastNumGC; i < num; i++ {
 		pause := stats.PauseNs[i%256]
-		m.AddSample([]string{"runtime", "gc_pause_ns"}, float32(pause))
+		m.AddSample(pauseKey, float32(pause))
+		if pause > maxPause {
+			maxPause = pause
+		}
 	}
 	m.lastNumGC = num
+
+	m.lastPauses = gcPauses{max: time.Duration(maxPause)}
+	if m.lastPauseTotal > 0 && stats.PauseTotalNs >= m.lastPauseTotal {
+		m.lastPauses.total = time.Duration(stats.PauseTotalNs - m.lastPauseTotal)
+	}
+	m.lastPauseTotal = stats.PauseTotalNs
+	return gauges
+}
+
+// runtimeKey returns the key of the runtime metric with the name following
+// "runtime.", as renamed by RuntimeMetricNames
+func (m *Metrics) runtimeKey(name string) []string {
+	if renamed, ok := m.RuntimeMetricNames["runtime."+name]; ok && renamed != "" {
+		return strings.Split(renamed, ".")
+	}
+	return []string{"runtime", name}
+}
+
+// runtimeGaugeNames lists the runtime gauges in the order they are emitted
+var runtimeGaugeNames = []string{
+	"num_goroutines",
+	"alloc_bytes",
+	"sys_bytes",
+	"malloc_count",
+	"free_count",
+	"heap_objects",
+	"total_gc_pause_ns",
+	"total_gc_runs",
 }
 
 // Creates a new slice with the provided string value as the first element
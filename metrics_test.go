@@ -1,8 +1,12 @@
 package metrics
 
 import (
+	"bytes"
+	"log"
+	"os"
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -143,6 +147,186 @@ func TestMetrics_IncrCounter(t *testing.T) {
 	}
 }
 
+// resetMockSink is a MockSink recording counter resets
+type resetMockSink struct {
+	MockSink
+	resets      [][]string
+	resetLabels [][]Label
+}
+
+func (m *resetMockSink) ResetCounter(key []string, labels []Label) {
+	m.resets = append(m.resets, key)
+	m.resetLabels = append(m.resetLabels, labels)
+}
+
+func TestMetrics_ResetCounter(t *testing.T) {
+	m := &resetMockSink{}
+	met := &Metrics{Config: Config{FilterDefault: true}, sink: m}
+	met.EnableTypePrefix = true
+	met.ServiceName = "svc"
+	met.ResetCounter([]string{"key"}, []Label{{"a", "b"}})
+	if !reflect.DeepEqual(m.resets, [][]string{{"svc", "counter", "key"}}) {
+		t.Fatalf("bad resets: %v", m.resets)
+	}
+	if !reflect.DeepEqual(m.resetLabels[0], []Label{{"a", "b"}}) {
+		t.Fatalf("bad labels: %v", m.resetLabels)
+	}
+
+	// Blocked counters aren't reset
+	met.FilterDefault = false
+	met.ResetCounter([]string{"key"}, nil)
+	if len(m.resets) != 1 {
+		t.Fatalf("bad resets: %v", m.resets)
+	}
+
+	// Sinks that only see deltas ignore resets
+	plain, met := mockMetric()
+	met.ResetCounter([]string{"key"}, nil)
+	if len(plain.keys) != 0 {
+		t.Fatalf("bad keys: %v", plain.keys)
+	}
+}
+
+// intMockSink is a MockSink recording integer emissions separately
+type intMockSink struct {
+	MockSink
+	intKeys [][]string
+	intVals []int64
+}
+
+func (m *intMockSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	m.intKeys = append(m.intKeys, key)
+	m.intVals = append(m.intVals, val)
+}
+
+func (m *intMockSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	m.intKeys = append(m.intKeys, key)
+	m.intVals = append(m.intVals, val)
+}
+
+func TestMetrics_EmitStartTime(t *testing.T) {
+	im := &intMockSink{}
+	met := &Metrics{Config: Config{FilterDefault: true}, sink: im}
+	met.EmitStartTime()
+	met.StartTimeGaugeName = "app.started"
+	met.EmitStartTime()
+
+	expect := [][]string{{"process", "start_time_seconds"}, {"app", "started"}}
+	if !reflect.DeepEqual(im.intKeys, expect) {
+		t.Fatalf("bad keys: %v", im.intKeys)
+	}
+	start := processStartTime.Unix()
+	if !reflect.DeepEqual(im.intVals, []int64{start, start}) {
+		t.Fatalf("bad vals: %v", im.intVals)
+	}
+	if start > time.Now().Unix() {
+		t.Fatalf("bad start time: %d", start)
+	}
+}
+
+func TestNew_StartTimeGauge(t *testing.T) {
+	im := &intMockSink{}
+	conf := DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	conf.EnableStartTimeGauge = true
+	conf.ProfileInterval = time.Hour
+	if _, err := New(conf, im); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The gauge is emitted right away
+	if !reflect.DeepEqual(im.intKeys, [][]string{{"process", "start_time_seconds"}}) {
+		t.Fatalf("bad keys: %v", im.intKeys)
+	}
+}
+
+func TestNew_ResourceLabels(t *testing.T) {
+	m := &MockSink{}
+	rm := &resourceMockSink{}
+	conf := DefaultConfig("api")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	conf.EnableHostnameLabel = true
+	conf.HostName = "host1"
+	conf.ResourceLabels = []string{"host", "region"}
+
+	// The names reach capable sinks through wrappers
+	sink := FanoutSink{m, NewLabelFilterSink(rm, nil, []string{"user"})}
+	met, err := New(conf, sink)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	met.SetGaugeWithLabels([]string{"queue"}, 1, []Label{{"region", "eu"}, {"endpoint", "/"}, {"user", "u1"}})
+
+	if !reflect.DeepEqual(rm.resources, [][]Label{{{"host", "host1"}, {"region", "eu"}}}) {
+		t.Fatalf("bad resource labels: %v", rm.resources)
+	}
+	if !reflect.DeepEqual(rm.dimensions, [][]Label{{{"endpoint", "/"}}}) {
+		t.Fatalf("bad dimensions: %v", rm.dimensions)
+	}
+
+	// Other sinks get every label
+	if len(m.labels) != 1 || len(m.labels[0]) != 4 {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+}
+
+func TestNew_TimestampOffset(t *testing.T) {
+	om := &offsetMockSink{}
+	conf := DefaultConfig("api")
+	conf.EnableRuntimeMetrics = false
+	if _, err := New(conf, om); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if om.offset != 0 {
+		t.Fatalf("bad offset: %v", om.offset)
+	}
+
+	conf.TimestampOffset = 1500 * time.Millisecond
+	if _, err := New(conf, FanoutSink{om}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if om.offset != 1500*time.Millisecond {
+		t.Fatalf("bad offset: %v", om.offset)
+	}
+}
+
+func TestMetrics_IntegerTyping(t *testing.T) {
+	// Sinks without integer support get float values
+	m, met := mockMetric()
+	met.IncrCounterInt([]string{"key"}, 4)
+	met.SetGaugeIntWithLabels([]string{"key"}, 7, []Label{{"a", "b"}})
+	if len(m.vals) != 2 || m.vals[0] != 4 || m.vals[1] != 7 {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+	if !reflect.DeepEqual(m.labels[1], []Label{{"a", "b"}}) {
+		t.Fatalf("bad labels: %v", m.labels[1])
+	}
+
+	im := &intMockSink{}
+	met = &Metrics{Config: Config{FilterDefault: true}, sink: im}
+	met.EnableTypePrefix = true
+	met.IncrCounterIntWithLabels([]string{"key"}, 4, nil)
+	met.SetGaugeInt([]string{"key"}, 1<<40)
+	if len(im.vals) != 0 {
+		t.Fatalf("unexpected float vals: %v", im.vals)
+	}
+	if !reflect.DeepEqual(im.intVals, []int64{4, 1 << 40}) {
+		t.Fatalf("bad int vals: %v", im.intVals)
+	}
+	if im.intKeys[0][0] != "counter" || im.intKeys[1][0] != "gauge" {
+		t.Fatalf("bad keys: %v", im.intKeys)
+	}
+
+	// Filtered metrics are not emitted
+	met.UpdateFilter(nil, []string{"counter"})
+	met.IncrCounterInt([]string{"key"}, 1)
+	if len(im.intVals) != 2 {
+		t.Fatalf("bad int vals: %v", im.intVals)
+	}
+}
+
 func TestMetrics_AddSample(t *testing.T) {
 	m, met := mockMetric()
 	met.AddSample([]string{"key"}, float32(1))
@@ -187,6 +371,336 @@ func TestMetrics_AddSample(t *testing.T) {
 	}
 }
 
+func TestMetrics_AddSampleFields(t *testing.T) {
+	m, met := mockMetric()
+	labels := []Label{{"a", "b"}}
+	met.AddSampleFields([]string{"http", "request"}, map[string]float32{
+		"retries":  2,
+		"duration": 15,
+		"bytes":    512,
+	}, labels)
+
+	expectKeys := [][]string{
+		{"http", "request", "bytes"},
+		{"http", "request", "duration"},
+		{"http", "request", "retries"},
+	}
+	if keys := m.getKeys(); !reflect.DeepEqual(keys, expectKeys) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	if !reflect.DeepEqual(m.vals, []float32{512, 15, 2}) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+	for _, l := range m.labels {
+		if !reflect.DeepEqual(l, labels) {
+			t.Fatalf("bad labels: %v", l)
+		}
+	}
+
+	// The base key and labels are not modified, even with spare capacity
+	m, met = mockMetric()
+	met.ServiceName = "service"
+	met.EnableHostnameLabel = true
+	met.HostName = "host1"
+	key := make([]string, 1, 4)
+	key[0] = "req"
+	labels = make([]Label, 1, 4)
+	labels[0] = Label{"a", "b"}
+	met.AddSampleFields(key, map[string]float32{"duration": 1, "bytes": 2}, labels)
+
+	expectKeys = [][]string{
+		{"service", "req", "bytes"},
+		{"service", "req", "duration"},
+	}
+	if keys := m.getKeys(); !reflect.DeepEqual(keys, expectKeys) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	expectLabels := []Label{{"a", "b"}, {"host", "host1"}}
+	for _, l := range m.labels {
+		if !reflect.DeepEqual(l, expectLabels) {
+			t.Fatalf("bad labels: %v", l)
+		}
+	}
+	if !reflect.DeepEqual(key, []string{"req"}) || !reflect.DeepEqual(labels, []Label{{"a", "b"}}) {
+		t.Fatalf("arguments were modified: %v %v", key, labels)
+	}
+}
+
+func TestMetrics_SetGaugeGroup(t *testing.T) {
+	m, met := mockMetric()
+	met.ServiceName = "service"
+	met.EnableHostnameLabel = true
+	met.HostName = "host1"
+	key := make([]string, 1, 4)
+	key[0] = "node"
+	labels := make([]Label, 1, 4)
+	labels[0] = Label{"pool", "a"}
+	met.UpdateFilter(nil, []string{"service.node.swap"})
+	met.SetGaugeGroup(key, map[string]float32{
+		"mem":  2,
+		"cpu":  1,
+		"disk": 3,
+		"swap": 4,
+	}, labels)
+
+	// Each entry gets its own key and the shared labels, and filters apply
+	// per entry
+	expectKeys := [][]string{
+		{"service", "node", "cpu"},
+		{"service", "node", "disk"},
+		{"service", "node", "mem"},
+	}
+	if keys := m.getKeys(); !reflect.DeepEqual(keys, expectKeys) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	if !reflect.DeepEqual(m.vals, []float32{1, 3, 2}) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+	expectLabels := []Label{{"host", "host1"}, {"pool", "a"}}
+	for _, l := range m.labels {
+		if !reflect.DeepEqual(l, expectLabels) {
+			t.Fatalf("bad labels: %v", l)
+		}
+	}
+	if !reflect.DeepEqual(key, []string{"node"}) || !reflect.DeepEqual(labels, []Label{{"pool", "a"}}) {
+		t.Fatalf("arguments were modified: %v %v", key, labels)
+	}
+}
+
+func TestMetrics_MaxKeyDepth(t *testing.T) {
+	// Keys aren't checked by default
+	m, met := mockMetric()
+	met.SetGauge([]string{"a", "b", "c", "d"}, 1)
+	if len(m.keys) != 1 || met.DeepKeys() != 0 {
+		t.Fatalf("expected no checks, got %d keys", len(m.keys))
+	}
+
+	// Deep keys are dropped, counting the prefixes added by Metrics
+	m, met = mockMetric()
+	met.MaxKeyDepth = 3
+	met.ServiceName = "svc"
+	met.SetGauge([]string{"a", "b"}, 1)
+	met.SetGauge([]string{"a", "b", "c"}, 1)
+	met.IncrCounter([]string{"a", "b", "c"}, 1)
+	met.AddSample([]string{"a", "b", "c"}, 1)
+	met.EmitKey([]string{"a", "b", "c"}, 1)
+	met.MeasureSince([]string{"a", "b", "c"}, time.Now())
+	if !reflect.DeepEqual(m.keys, [][]string{{"svc", "a", "b"}}) {
+		t.Fatalf("bad keys: %v", m.keys)
+	}
+	if met.DeepKeys() != 5 {
+		t.Fatalf("bad deep keys: %d", met.DeepKeys())
+	}
+
+	// Or truncated to the depth, leaving the caller's key untouched
+	m, met = mockMetric()
+	met.MaxKeyDepth = 2
+	met.KeyDepth = KeyDepthTruncate
+	key := []string{"a", "b", "c", "d"}
+	met.IncrCounterWithLabels(key, 1, []Label{{"x", "y"}})
+	met.SetGaugeInt(key, 1)
+	met.IncrCounter([]string{"a", "b"}, 1)
+	expect := [][]string{{"a", "b"}, {"a", "b"}, {"a", "b"}}
+	if !reflect.DeepEqual(m.keys, expect) {
+		t.Fatalf("bad keys: %v", m.keys)
+	}
+	if met.DeepKeys() != 2 || !reflect.DeepEqual(key, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("bad deep keys %d, key %v", met.DeepKeys(), key)
+	}
+}
+
+func TestMetrics_MixedTypeKeys(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// Conflicts aren't checked by default
+	m, met := mockMetric()
+	met.SetGauge([]string{"jobs"}, 1)
+	met.IncrCounter([]string{"jobs"}, 1)
+	if len(m.keys) != 2 || met.TypeConflicts() != 0 {
+		t.Fatalf("expected no checks, got %d keys", len(m.keys))
+	}
+
+	// Warnings are logged once per key and type, and metrics still emitted
+	m, met = mockMetric()
+	met.MixedTypeKeys = TypeConflictsWarn
+	met.SetGauge([]string{"jobs"}, 1)
+	met.IncrCounter([]string{"jobs"}, 1)
+	met.IncrCounterWithLabels([]string{"jobs"}, 1, []Label{{"a", "b"}})
+	met.MeasureSince([]string{"jobs"}, time.Now())
+	met.SetGaugeInt([]string{"jobs"}, 2)
+	if len(m.keys) != 5 || met.TypeConflicts() != 3 {
+		t.Fatalf("bad emissions: %d keys, %d conflicts", len(m.keys), met.TypeConflicts())
+	}
+	expect := []string{
+		`"jobs" emitted as a counter, but it was first emitted as a gauge`,
+		`"jobs" emitted as a sample, but it was first emitted as a gauge`,
+	}
+	lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	if len(lines) != len(expect) {
+		t.Fatalf("bad log: %q", lines)
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, expect[i]) {
+			t.Fatalf("bad log line: %q", line)
+		}
+	}
+
+	// Conflicting emissions are dropped
+	m, met = mockMetric()
+	met.MixedTypeKeys = TypeConflictsDrop
+	met.IncrCounter([]string{"jobs"}, 1)
+	met.AddSample([]string{"jobs"}, 1)
+	met.EmitKey([]string{"jobs"}, 1)
+	met.ResetCounter([]string{"jobs"}, nil)
+	met.IncrCounterInt([]string{"jobs"}, 1)
+	met.AddSample([]string{"other"}, 1)
+	if !reflect.DeepEqual(m.keys, [][]string{{"jobs"}, {"jobs"}, {"other"}}) {
+		t.Fatalf("bad keys: %v", m.keys)
+	}
+	if met.TypeConflicts() != 2 {
+		t.Fatalf("bad conflicts: %d", met.TypeConflicts())
+	}
+
+	// Type prefixes keep the keys of different types apart
+	m, met = mockMetric()
+	met.MixedTypeKeys = TypeConflictsDrop
+	met.EnableTypePrefix = true
+	met.SetGauge([]string{"jobs"}, 1)
+	met.IncrCounter([]string{"jobs"}, 1)
+	if len(m.keys) != 2 || met.TypeConflicts() != 0 {
+		t.Fatalf("expected no conflicts, got %d", met.TypeConflicts())
+	}
+}
+
+func TestMetrics_EmptyKeySegments(t *testing.T) {
+	keys := [][]string{
+		{"", "foo"},
+		{"foo", ""},
+		{"foo", "", "bar"},
+		{"", ""},
+		{"foo", "bar"},
+	}
+
+	for _, tc := range []struct {
+		desc       string
+		policy     EmptySegmentPolicy
+		expectKeys [][]string
+		expectDrop uint64
+	}{
+		{
+			desc:       "keys are kept as-is by default",
+			policy:     EmptySegmentsKeep,
+			expectKeys: keys,
+		},
+		{
+			desc:       "keys with empty segments are dropped",
+			policy:     EmptySegmentsDrop,
+			expectKeys: [][]string{{"foo", "bar"}},
+			expectDrop: 4,
+		},
+		{
+			desc:       "empty segments are collapsed",
+			policy:     EmptySegmentsCollapse,
+			expectKeys: [][]string{{"foo"}, {"foo"}, {"foo", "bar"}, {"foo", "bar"}},
+			expectDrop: 1,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			m, met := mockMetric()
+			met.EmptyKeySegments = tc.policy
+			for _, key := range keys {
+				met.IncrCounter(key, 1)
+			}
+			if got := m.getKeys(); !reflect.DeepEqual(got, tc.expectKeys) {
+				t.Fatalf("bad keys: %q", got)
+			}
+			if drops := met.EmptyKeyDrops(); drops != tc.expectDrop {
+				t.Fatalf("expected %d drops, got %d", tc.expectDrop, drops)
+			}
+		})
+	}
+
+	// Prefixes are added after collapsing, and the caller's key is untouched
+	m, met := mockMetric()
+	met.EmptyKeySegments = EmptySegmentsCollapse
+	met.ServiceName = "service"
+	met.EnableTypePrefix = true
+	key := []string{"", "foo", ""}
+	met.AddSample(key, 1)
+	met.SetGauge(key, 1)
+	met.EmitKey(key, 1)
+	met.MeasureSince(key, time.Now())
+	expectKeys := [][]string{
+		{"service", "sample", "foo"},
+		{"service", "gauge", "foo"},
+		{"service", "kv", "foo"},
+		{"service", "timer", "foo"},
+	}
+	if got := m.getKeys(); !reflect.DeepEqual(got, expectKeys) {
+		t.Fatalf("bad keys: %q", got)
+	}
+	if !reflect.DeepEqual(key, []string{"", "foo", ""}) {
+		t.Fatalf("key was modified: %q", key)
+	}
+}
+
+func TestMetrics_ObserveBuckets(t *testing.T) {
+	m, met := mockMetric()
+	met.ObserveBuckets([]string{"key"}, map[float64]uint64{2: 1}, nil)
+	if m.getKeys()[0][0] != "key" {
+		t.Fatalf("")
+	}
+	if m.vals[0] != 2 {
+		t.Fatalf("")
+	}
+
+	m, met = mockMetric()
+	met.EnableTypePrefix = true
+	met.ServiceName = "service"
+	labels := []Label{{"a", "b"}}
+	met.ObserveBuckets([]string{"key"}, map[float64]uint64{2: 1}, labels)
+	if !reflect.DeepEqual(m.getKeys()[0], []string{"service", "sample", "key"}) {
+		t.Fatalf("bad key: %v", m.getKeys()[0])
+	}
+	if !reflect.DeepEqual(m.labels[0], labels) {
+		t.Fatalf("")
+	}
+
+	inm := NewInmemSink(time.Hour, time.Hour)
+	met = &Metrics{Config: Config{FilterDefault: true}, sink: inm}
+	met.ObserveBuckets([]string{"key"}, map[float64]uint64{2: 1}, nil)
+	if n := inm.Data()[0].Samples["key"].Buckets[2]; n != 1 {
+		t.Fatalf("bad bucket count: %d", n)
+	}
+}
+
+func TestMetrics_ValueMultiplier(t *testing.T) {
+	m, met := mockMetric()
+	met.ValueMultiplier = 0.1
+	met.TimerGranularity = time.Millisecond
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	met.clock = clock
+
+	met.IncrCounter([]string{"counter"}, 50)
+	met.AddSampleWithLabels([]string{"sample"}, 20, []Label{{"a", "b"}})
+	met.SetGauge([]string{"gauge"}, 30)
+	met.MeasureSince([]string{"timer"}, clock.Now().Add(-40*time.Millisecond))
+	if !reflect.DeepEqual(m.vals, []float32{5, 2, 30, 40}) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+
+	// Integer counters are rounded
+	im := &intMockSink{}
+	met = &Metrics{Config: Config{FilterDefault: true, ValueMultiplier: 0.1}, sink: im}
+	met.IncrCounterInt([]string{"counter"}, 46)
+	met.SetGaugeInt([]string{"gauge"}, 46)
+	if !reflect.DeepEqual(im.intVals, []int64{5, 46}) {
+		t.Fatalf("bad int vals: %v", im.intVals)
+	}
+}
+
 func TestMetrics_MeasureSince(t *testing.T) {
 	m, met := mockMetric()
 	met.TimerGranularity = time.Millisecond
@@ -236,6 +750,125 @@ func TestMetrics_MeasureSince(t *testing.T) {
 	}
 }
 
+// fixedClock is a Clock that always returns the same time
+type fixedClock struct {
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
+func TestMetrics_MeasureSinceWithCount(t *testing.T) {
+	m, met := mockMetric()
+	met.TimerGranularity = time.Millisecond
+	labels := []Label{{"a", "b"}}
+	met.MeasureSinceWithCount([]string{"api", "request"}, time.Now(), labels)
+
+	expectKeys := [][]string{{"api", "request"}, {"api", "request", "count"}}
+	if keys := m.getKeys(); !reflect.DeepEqual(keys, expectKeys) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	if m.vals[0] > 0.1 {
+		t.Fatalf("bad duration: %v", m.vals[0])
+	}
+	if m.vals[1] != 1 {
+		t.Fatalf("bad count: %v", m.vals[1])
+	}
+	for _, l := range m.labels {
+		if !reflect.DeepEqual(l, labels) {
+			t.Fatalf("bad labels: %v", l)
+		}
+	}
+
+	// The suffix is configurable, and type prefixes apply to each emission
+	m, met = mockMetric()
+	met.TimerGranularity = time.Millisecond
+	met.TimerCountSuffix = "total"
+	met.EnableTypePrefix = true
+	met.EnableHostnameLabel = true
+	met.HostName = "host1"
+	labels = make([]Label, 1, 4)
+	labels[0] = Label{"a", "b"}
+	met.MeasureSinceWithCount([]string{"api", "request"}, time.Now(), labels)
+
+	expectKeys = [][]string{{"timer", "api", "request"}, {"counter", "api", "request", "total"}}
+	if keys := m.getKeys(); !reflect.DeepEqual(keys, expectKeys) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	expectLabels := []Label{{"a", "b"}, {"host", "host1"}}
+	for _, l := range m.labels {
+		if !reflect.DeepEqual(l, expectLabels) {
+			t.Fatalf("bad labels: %v", l)
+		}
+	}
+}
+
+func TestMetrics_MeasureSince_ClockJump(t *testing.T) {
+	m, met := mockMetric()
+	met.TimerGranularity = time.Millisecond
+
+	// A start time without a monotonic reading, followed by the wall clock
+	// being set back by an hour.
+	start := time.Now().Round(0)
+	met.clock = fixedClock{start.Add(-time.Hour)}
+	met.MeasureSince([]string{"key"}, start)
+	if m.vals[0] != 0 {
+		t.Fatalf("bad val: %v", m.vals[0])
+	}
+	if n := met.TimerAnomalies(); n != 1 {
+		t.Fatalf("bad anomalies: %d", n)
+	}
+
+	met.clock = fixedClock{start.Add(5 * time.Millisecond)}
+	met.MeasureSince([]string{"key"}, start)
+	if m.vals[1] != 5 {
+		t.Fatalf("bad val: %v", m.vals[1])
+	}
+	if n := met.TimerAnomalies(); n != 1 {
+		t.Fatalf("bad anomalies: %d", n)
+	}
+}
+
+func TestMetrics_TimerPrecision(t *testing.T) {
+	start := time.Now()
+	for _, c := range []struct {
+		precision TimerPrecision
+		elapsed   time.Duration
+		expect    float32
+	}{
+		{TimerPrecisionFull, 1500 * time.Microsecond, 1.5},
+		{TimerPrecisionFull, 250 * time.Microsecond, 0.25},
+		{TimerPrecisionFull, 20*time.Millisecond + time.Nanosecond, 20.000001},
+		{TimerPrecisionTruncate, 1500 * time.Microsecond, 1},
+		{TimerPrecisionTruncate, 250 * time.Microsecond, 0},
+		{TimerPrecisionTruncate, 20*time.Millisecond + time.Nanosecond, 20},
+	} {
+		m, met := mockMetric()
+		met.TimerGranularity = time.Millisecond
+		met.TimerPrecision = c.precision
+		met.clock = fixedClock{start.Add(c.elapsed)}
+		met.MeasureSince([]string{"key"}, start)
+		if m.vals[0] != c.expect {
+			t.Fatalf("bad val for %s at precision %d: %v", c.elapsed, c.precision, m.vals[0])
+		}
+	}
+
+	// The fraction makes it through the formatting of statsite
+	for precision, expect := range map[TimerPrecision]string{
+		TimerPrecisionFull:     "key:0.250000|ms\n",
+		TimerPrecisionTruncate: "key:0.000000|ms\n",
+	} {
+		sink := &StatsiteSink{metricQueue: make(chan string, 1)}
+		met := &Metrics{Config: Config{FilterDefault: true, TimerGranularity: time.Millisecond, TimerPrecision: precision}, sink: sink}
+		met.clock = fixedClock{start.Add(250 * time.Microsecond)}
+		met.MeasureSince([]string{"key"}, start)
+		if line := <-sink.metricQueue; line != expect {
+			t.Fatalf("bad line at precision %d: %q", precision, line)
+		}
+	}
+}
+
 func TestMetrics_EmitRuntimeStats(t *testing.T) {
 	runtime.GC()
 	m, met := mockMetric()
@@ -305,6 +938,38 @@ func TestMetrics_EmitRuntimeStats(t *testing.T) {
 	}
 }
 
+func TestMetrics_RuntimeMetricNames(t *testing.T) {
+	runtime.GC()
+	m, met := mockMetric()
+	met.ServiceName = "service"
+	met.RuntimeMetricNames = map[string]string{
+		"runtime.alloc_bytes":    "process.memory.allocated_bytes",
+		"runtime.num_goroutines": "goroutines",
+		"runtime.gc_pause_ns":    "process.gc.pause_ns",
+		"runtime.unknown":        "ignored",
+	}
+	met.EmitRuntimeStats()
+
+	// Renamed keys still get the prefixes, the others keep their names
+	keys := m.getKeys()
+	expect := map[int][]string{
+		0: {"service", "goroutines"},
+		1: {"service", "process", "memory", "allocated_bytes"},
+		2: {"service", "runtime", "sys_bytes"},
+		8: {"service", "process", "gc", "pause_ns"},
+	}
+	for i, key := range expect {
+		if !reflect.DeepEqual(keys[i], key) {
+			t.Fatalf("bad key %d: %v", i, keys[i])
+		}
+	}
+	for _, key := range keys[8:] {
+		if !reflect.DeepEqual(key, expect[8]) {
+			t.Fatalf("bad key: %v", key)
+		}
+	}
+}
+
 func TestInsert(t *testing.T) {
 	k := []string{"hi", "bob"}
 	exp := []string{"hi", "there", "bob"}
@@ -517,3 +1182,80 @@ func TestMetrics_Filter_Labels_ModifyArgs(t *testing.T) {
 		t.Fatalf("SetGaugeWithLabels modified the input argument")
 	}
 }
+
+func TestMetrics_HostnamePlacement(t *testing.T) {
+	emit := func(placement HostnamePlacement) map[string]bool {
+		inm := NewInmemSink(time.Minute, time.Minute)
+		conf := DefaultConfig("api")
+		conf.EnableRuntimeMetrics = false
+		conf.HostName = "host1"
+		conf.HostnamePlacement = placement
+		met, err := New(conf, inm)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		met.SetGauge([]string{"queue"}, 1)
+		met.IncrCounter([]string{"requests"}, 1)
+		met.AddSample([]string{"latency"}, 1)
+
+		keys := make(map[string]bool)
+		intv := inm.Data()[0]
+		for k := range intv.Gauges {
+			keys[k] = true
+		}
+		for k := range intv.Counters {
+			keys[k] = true
+		}
+		for k := range intv.Samples {
+			keys[k] = true
+		}
+		return keys
+	}
+
+	// By default only gauges get the hostname
+	expect := map[string]bool{"api.host1.queue": true, "api.requests": true, "api.latency": true}
+	if keys := emit(HostnameByFlag); !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	expect = map[string]bool{"api.host1.queue": true, "api.host1.requests": true, "api.host1.latency": true}
+	if keys := emit(HostnameKeySegment); !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	expect = map[string]bool{"api.queue;host=host1": true, "api.requests;host=host1": true, "api.latency;host=host1": true}
+	if keys := emit(HostnameLabel); !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+
+	// Without either flag, the hostname is never added
+	m, met := mockMetric()
+	met.HostName = "host1"
+	met.HostnamePlacement = HostnameKeySegment
+	met.IncrCounter([]string{"requests"}, 1)
+	if !reflect.DeepEqual(m.keys, [][]string{{"requests"}}) || m.labels[0] != nil {
+		t.Fatalf("bad emission: %v %v", m.keys, m.labels)
+	}
+}
+
+func TestMetrics_SetCounterTemporality(t *testing.T) {
+	tm := &temporalityMockSink{}
+	met := &Metrics{Config: Config{ServiceName: "api", EnableTypePrefix: true, FilterDefault: true}, sink: tm}
+
+	// The hint reaches the sink under the key the counter is emitted with
+	met.SetCounterTemporality([]string{"requests"}, TemporalityCumulative)
+	met.SetCounterTemporality([]string{"errors"}, TemporalityDelta)
+	met.IncrCounter([]string{"requests"}, 1)
+	expect := map[string]Temporality{"api.counter.requests": TemporalityCumulative, "api.counter.errors": TemporalityDelta}
+	if !reflect.DeepEqual(tm.temporalities, expect) {
+		t.Fatalf("bad temporalities: %v", tm.temporalities)
+	}
+	if !reflect.DeepEqual(tm.keys, [][]string{{"api", "counter", "requests"}}) {
+		t.Fatalf("bad keys: %v", tm.keys)
+	}
+
+	// Sinks which don't export the temporality ignore it
+	m, met := mockMetric()
+	met.SetCounterTemporality([]string{"requests"}, TemporalityCumulative)
+	if len(m.keys) != 0 {
+		t.Fatalf("unexpected emissions: %v", m.keys)
+	}
+}
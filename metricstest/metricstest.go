@@ -0,0 +1,245 @@
+// Package metricstest provides a MetricSink checking emissions against a
+// declared schema, to catch instrumentation regressions in tests. It is
+// meant for tests only, and is not used by the metrics package itself.
+package metricstest
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/armon/go-metrics"
+)
+
+// Schema declares the metrics a test may emit. Keys are the full keys
+// reaching the sink, including the prefixes added by Metrics such as the
+// service name or hostname, with '.' as the separator.
+type Schema []Metric
+
+// Metric declares a metric of a Schema
+type Metric struct {
+	Key  string
+	Type metrics.MetricType
+
+	// Labels are the names of the labels every emission must have. Other
+	// labels are allowed.
+	Labels []string
+
+	// Range bounds the values of the emissions, if set
+	Range *Range
+
+	// Required makes Finish report the metric if it was never emitted
+	Required bool
+}
+
+// Range is the inclusive range of the values of a metric
+type Range struct {
+	Min, Max float64
+}
+
+// ViolationKind is the kind of a Violation
+type ViolationKind int
+
+const (
+	UnexpectedKey ViolationKind = iota
+	WrongType
+	MissingLabel
+	OutOfRange
+	NotEmitted
+)
+
+func (k ViolationKind) String() string {
+	switch k {
+	case UnexpectedKey:
+		return "unexpected key"
+	case WrongType:
+		return "wrong type"
+	case MissingLabel:
+		return "missing label"
+	case OutOfRange:
+		return "value out of range"
+	case NotEmitted:
+		return "not emitted"
+	}
+	return fmt.Sprintf("ViolationKind(%d)", int(k))
+}
+
+// Violation is an emission breaking the schema, or a required metric never
+// emitted
+type Violation struct {
+	Kind    ViolationKind
+	Key     string
+	Labels  []metrics.Label
+	Value   float64
+	Message string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s %s: %s", v.Kind, v.Key, v.Message)
+}
+
+// TB is the part of testing.TB used by the Sink to fail a test
+type TB interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// Sink is a MetricSink failing the test on every emission breaking its
+// schema, with a message naming the key, labels and value of the emission
+type Sink struct {
+	t       TB
+	metrics map[string]*Metric
+
+	lock       sync.Mutex
+	emitted    map[string]bool
+	violations []Violation
+}
+
+// NewSink creates a Sink checking emissions against schema and reporting
+// violations to t, typically the *testing.T of the test. It panics if
+// schema declares a key twice.
+func NewSink(t TB, schema Schema) *Sink {
+	s := &Sink{
+		t:       t,
+		metrics: make(map[string]*Metric, len(schema)),
+		emitted: make(map[string]bool),
+	}
+	for i := range schema {
+		metric := &schema[i]
+		if _, ok := s.metrics[metric.Key]; ok {
+			panic(fmt.Sprintf("metricstest: duplicate key %q in schema", metric.Key))
+		}
+		s.metrics[metric.Key] = metric
+	}
+	return s
+}
+
+// Violations returns the violations reported so far
+func (s *Sink) Violations() []Violation {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Violation(nil), s.violations...)
+}
+
+// Finish reports the required metrics of the schema which were never
+// emitted. Call it once the code under test has emitted its metrics.
+func (s *Sink) Finish() {
+	s.t.Helper()
+	var missing []string
+	s.lock.Lock()
+	for key, metric := range s.metrics {
+		if metric.Required && !s.emitted[key] {
+			missing = append(missing, key)
+		}
+	}
+	s.lock.Unlock()
+
+	sort.Strings(missing)
+	for _, key := range missing {
+		s.report(Violation{Kind: NotEmitted, Key: key, Message: "required metric was never emitted"})
+	}
+}
+
+// check checks an emission against the schema
+func (s *Sink) check(typ metrics.MetricType, parts []string, val float64, labels []metrics.Label) {
+	s.t.Helper()
+	key := strings.Join(parts, ".")
+	metric, ok := s.metrics[key]
+	if !ok {
+		s.report(Violation{Kind: UnexpectedKey, Key: key, Labels: labels, Value: val,
+			Message: fmt.Sprintf("%s %s = %v is not declared in the schema", typ, formatLabels(labels), val)})
+		return
+	}
+	s.lock.Lock()
+	s.emitted[key] = true
+	s.lock.Unlock()
+
+	if metric.Type != typ {
+		s.report(Violation{Kind: WrongType, Key: key, Labels: labels, Value: val,
+			Message: fmt.Sprintf("emitted as a %s, declared as a %s", typ, metric.Type)})
+	}
+	for _, name := range metric.Labels {
+		if !hasLabel(labels, name) {
+			s.report(Violation{Kind: MissingLabel, Key: key, Labels: labels, Value: val,
+				Message: fmt.Sprintf("label %q is missing from %s", name, formatLabels(labels))})
+		}
+	}
+	if r := metric.Range; r != nil && (val < r.Min || val > r.Max || math.IsNaN(val)) {
+		s.report(Violation{Kind: OutOfRange, Key: key, Labels: labels, Value: val,
+			Message: fmt.Sprintf("value %v of %s is outside [%v, %v]", val, formatLabels(labels), r.Min, r.Max)})
+	}
+}
+
+// report records v and fails the test with it
+func (s *Sink) report(v Violation) {
+	s.t.Helper()
+	s.lock.Lock()
+	s.violations = append(s.violations, v)
+	s.lock.Unlock()
+	s.t.Errorf("metricstest: %s", v)
+}
+
+func hasLabel(labels []metrics.Label, name string) bool {
+	for _, label := range labels {
+		if label.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// formatLabels formats labels as {name=value,...}
+func formatLabels(labels []metrics.Label) string {
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = label.Name + "=" + label.Value
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (s *Sink) SetGauge(key []string, val float32) {
+	s.t.Helper()
+	s.check(metrics.MetricTypeGauge, key, float64(val), nil)
+}
+
+func (s *Sink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.t.Helper()
+	s.check(metrics.MetricTypeGauge, key, float64(val), labels)
+}
+
+func (s *Sink) SetGaugeIntWithLabels(key []string, val int64, labels []metrics.Label) {
+	s.t.Helper()
+	s.check(metrics.MetricTypeGauge, key, float64(val), labels)
+}
+
+func (s *Sink) EmitKey(key []string, val float32) {
+	s.t.Helper()
+	s.check(metrics.MetricTypeKey, key, float64(val), nil)
+}
+
+func (s *Sink) IncrCounter(key []string, val float32) {
+	s.t.Helper()
+	s.check(metrics.MetricTypeCounter, key, float64(val), nil)
+}
+
+func (s *Sink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.t.Helper()
+	s.check(metrics.MetricTypeCounter, key, float64(val), labels)
+}
+
+func (s *Sink) IncrCounterIntWithLabels(key []string, val int64, labels []metrics.Label) {
+	s.t.Helper()
+	s.check(metrics.MetricTypeCounter, key, float64(val), labels)
+}
+
+func (s *Sink) AddSample(key []string, val float32) {
+	s.t.Helper()
+	s.check(metrics.MetricTypeSample, key, float64(val), nil)
+}
+
+func (s *Sink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.t.Helper()
+	s.check(metrics.MetricTypeSample, key, float64(val), labels)
+}
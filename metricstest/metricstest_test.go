@@ -0,0 +1,131 @@
+package metricstest
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// fakeTB records the failures of a Sink instead of failing the test
+type fakeTB struct {
+	errors []string
+}
+
+func (f *fakeTB) Helper() {}
+
+func (f *fakeTB) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+var testSchema = Schema{
+	{Key: "api.requests", Type: metrics.MetricTypeCounter, Labels: []string{"route"}, Required: true},
+	{Key: "api.latency", Type: metrics.MetricTypeSample, Range: &Range{Min: 0, Max: 1000}},
+	{Key: "queue.depth", Type: metrics.MetricTypeGauge, Required: true},
+}
+
+func testSink() (*Sink, *fakeTB) {
+	tb := &fakeTB{}
+	return NewSink(tb, testSchema), tb
+}
+
+func checkViolations(t *testing.T, s *Sink, tb *fakeTB, kinds ...ViolationKind) {
+	t.Helper()
+	var got []ViolationKind
+	for _, v := range s.Violations() {
+		got = append(got, v.Kind)
+	}
+	if !reflect.DeepEqual(got, kinds) {
+		t.Fatalf("bad violations: %v", s.Violations())
+	}
+	if len(tb.errors) != len(kinds) {
+		t.Fatalf("bad errors: %v", tb.errors)
+	}
+}
+
+func TestSink_Valid(t *testing.T) {
+	s, tb := testSink()
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 1, []metrics.Label{{Name: "route", Value: "/"}, {Name: "code", Value: "200"}})
+	s.AddSample([]string{"api", "latency"}, 12)
+	s.SetGaugeIntWithLabels([]string{"queue", "depth"}, 3, nil)
+	s.Finish()
+	checkViolations(t, s, tb)
+}
+
+func TestSink_UnexpectedKey(t *testing.T) {
+	s, tb := testSink()
+	s.IncrCounterWithLabels([]string{"api", "errors"}, 1, []metrics.Label{{Name: "route", Value: "/"}})
+	checkViolations(t, s, tb, UnexpectedKey)
+	if !strings.Contains(tb.errors[0], "api.errors: counter {route=/} = 1") {
+		t.Fatalf("bad error: %s", tb.errors[0])
+	}
+}
+
+func TestSink_WrongType(t *testing.T) {
+	s, tb := testSink()
+	s.SetGauge([]string{"api", "requests"}, 1)
+	checkViolations(t, s, tb, WrongType, MissingLabel)
+	if !strings.Contains(tb.errors[0], "emitted as a gauge, declared as a counter") {
+		t.Fatalf("bad error: %s", tb.errors[0])
+	}
+}
+
+func TestSink_MissingLabel(t *testing.T) {
+	s, tb := testSink()
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 1, []metrics.Label{{Name: "code", Value: "200"}})
+	checkViolations(t, s, tb, MissingLabel)
+	if !strings.Contains(tb.errors[0], `label "route" is missing from {code=200}`) {
+		t.Fatalf("bad error: %s", tb.errors[0])
+	}
+}
+
+func TestSink_OutOfRange(t *testing.T) {
+	s, tb := testSink()
+	s.AddSample([]string{"api", "latency"}, 1000)
+	s.AddSample([]string{"api", "latency"}, -1)
+	s.AddSample([]string{"api", "latency"}, 5000)
+	s.AddSample([]string{"api", "latency"}, float32(math.NaN()))
+	checkViolations(t, s, tb, OutOfRange, OutOfRange, OutOfRange)
+	if !strings.Contains(tb.errors[0], "value -1 of {} is outside [0, 1000]") {
+		t.Fatalf("bad error: %s", tb.errors[0])
+	}
+}
+
+func TestSink_NotEmitted(t *testing.T) {
+	s, tb := testSink()
+	s.SetGauge([]string{"queue", "depth"}, 1)
+	s.Finish()
+	checkViolations(t, s, tb, NotEmitted)
+	if !strings.Contains(tb.errors[0], "not emitted api.requests") {
+		t.Fatalf("bad error: %s", tb.errors[0])
+	}
+}
+
+func TestSink_Metrics(t *testing.T) {
+	// Keys include the prefixes added by Metrics
+	tb := &fakeTB{}
+	s := NewSink(tb, Schema{{Key: "service.runtime.num_goroutines", Type: metrics.MetricTypeGauge}})
+	conf := metrics.DefaultConfig("service")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	m, err := metrics.New(conf, s)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.SetGauge([]string{"runtime", "num_goroutines"}, 4)
+	m.MeasureSince([]string{"handler"}, time.Now())
+	checkViolations(t, s, tb, UnexpectedKey)
+}
+
+func TestNewSink_Duplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic")
+		}
+	}()
+	NewSink(&fakeTB{}, Schema{{Key: "a"}, {Key: "a"}})
+}
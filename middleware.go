@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"math"
+	"strings"
+)
+
+// Emission is a metric on its way from Metrics to the sink, as seen by a
+// Middleware. Key and Labels include the prefixes and labels added by
+// Metrics, and Labels are already filtered.
+type Emission struct {
+	Type   MetricType
+	Key    []string
+	Value  float32
+	Labels []Label
+
+	// Reset is set for a counter reset, and Buckets for bucket observations,
+	// whose Value is zero and ignored
+	Reset   bool
+	Buckets map[float64]uint64
+}
+
+// Middleware transforms an emission before it reaches the sink, returning
+// false to drop it, which skips the middlewares after it. Key and Labels
+// may be shared with the caller, so a middleware changing them must replace
+// them rather than modify them in place. Middlewares are called from many
+// goroutines at once.
+type Middleware func(e *Emission) bool
+
+// middleware runs the emission through the Middlewares of m, returning the
+// key, value and labels to emit and whether to emit it at all
+func (m *Metrics) middleware(typ MetricType, key []string, val float32, labels []Label) ([]string, float32, []Label, bool) {
+	if len(m.Middlewares) == 0 {
+		return key, val, labels, true
+	}
+	e := &Emission{Type: typ, Key: key, Value: val, Labels: labels}
+	if !m.runMiddlewares(e) {
+		return nil, 0, nil, false
+	}
+	return e.Key, e.Value, e.Labels, true
+}
+
+// runMiddlewares runs e through the Middlewares of m in order, stopping at
+// the first one dropping it. The labels they add are ordered like the others.
+func (m *Metrics) runMiddlewares(e *Emission) bool {
+	for _, mw := range m.Middlewares {
+		if !mw(e) {
+			notifyDrop(e.Key, e.Labels, DropMiddleware)
+			return false
+		}
+	}
+	e.Labels = m.orderLabels(e.Labels)
+	return true
+}
+
+// ClampValues returns a Middleware limiting the values of gauges, counters
+// and samples to the range [min, max], e.g. to keep a buggy negative
+// duration out of a histogram. NaN values are dropped.
+func ClampValues(min, max float32) Middleware {
+	return func(e *Emission) bool {
+		if e.Reset || e.Buckets != nil {
+			return true
+		}
+		if math.IsNaN(float64(e.Value)) {
+			return false
+		}
+		if e.Value < min {
+			e.Value = min
+		} else if e.Value > max {
+			e.Value = max
+		}
+		return true
+	}
+}
+
+// RenameLabel returns a Middleware renaming the labels named from to to,
+// e.g. to align the label names of a library with the rest of a service
+func RenameLabel(from, to string) Middleware {
+	return func(e *Emission) bool {
+		for i, label := range e.Labels {
+			if label.Name != from {
+				continue
+			}
+			renamed := make([]Label, len(e.Labels))
+			copy(renamed, e.Labels)
+			for j := i; j < len(renamed); j++ {
+				if renamed[j].Name == from {
+					renamed[j].Name = to
+				}
+			}
+			e.Labels = renamed
+			break
+		}
+		return true
+	}
+}
+
+// RedactedValue replaces the values of the labels redacted by RedactLabels
+const RedactedValue = "redacted"
+
+// RedactLabels returns a Middleware replacing the values of the labels with
+// the given names by RedactedValue, e.g. for labels which may carry personal
+// data. Unlike blocking the labels, the series keep their shape.
+func RedactLabels(names ...string) Middleware {
+	redact := make(map[string]bool, len(names))
+	for _, name := range names {
+		redact[name] = true
+	}
+	return func(e *Emission) bool {
+		for i, label := range e.Labels {
+			if !redact[label.Name] {
+				continue
+			}
+			redacted := make([]Label, len(e.Labels))
+			copy(redacted, e.Labels)
+			for j := i; j < len(redacted); j++ {
+				if redact[redacted[j].Name] {
+					redacted[j].Value = RedactedValue
+				}
+			}
+			e.Labels = redacted
+			break
+		}
+		return true
+	}
+}
+
+// DropKeys returns a Middleware dropping the metrics whose key, including
+// the prefixes added by Metrics, is one of keys, with '.' as the separator
+func DropKeys(keys ...string) Middleware {
+	drop := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		drop[key] = true
+	}
+	return func(e *Emission) bool {
+		return !drop[strings.Join(e.Key, ".")]
+	}
+}
@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetrics_MiddlewareOrder(t *testing.T) {
+	m, met := mockMetric()
+	var calls []string
+	record := func(name string, keep bool) Middleware {
+		return func(e *Emission) bool {
+			calls = append(calls, name)
+			return keep
+		}
+	}
+	appendKey := func(e *Emission) bool {
+		e.Key = append(e.Key[:len(e.Key):len(e.Key)], "suffix")
+		return true
+	}
+	double := func(e *Emission) bool {
+		e.Value *= 2
+		return true
+	}
+	met.Middlewares = []Middleware{record("first", true), appendKey, double, record("second", true)}
+
+	met.SetGauge([]string{"gauge"}, 1)
+	met.IncrCounter([]string{"counter"}, 2)
+	met.AddSample([]string{"sample"}, 3)
+	met.EmitKey([]string{"kv"}, 4)
+	if !reflect.DeepEqual(calls, []string{"first", "second", "first", "second", "first", "second", "first", "second"}) {
+		t.Fatalf("bad calls: %v", calls)
+	}
+	expect := [][]string{{"gauge", "suffix"}, {"counter", "suffix"}, {"sample", "suffix"}, {"kv", "suffix"}}
+	if !reflect.DeepEqual(m.keys, expect) || !reflect.DeepEqual(m.vals, []float32{2, 4, 6, 8}) {
+		t.Fatalf("bad emissions: %v %v", m.keys, m.vals)
+	}
+
+	// A middleware dropping an emission short-circuits the chain
+	m, met = mockMetric()
+	calls = nil
+	met.Middlewares = []Middleware{record("first", true), record("drop", false), record("never", true)}
+	met.IncrCounter([]string{"counter"}, 1)
+	met.ResetCounter([]string{"counter"}, nil)
+	met.ObserveBuckets([]string{"buckets"}, map[float64]uint64{1: 1}, nil)
+	met.SetGaugeInt([]string{"gauge"}, 1)
+	if len(m.keys) != 0 {
+		t.Fatalf("unexpected emissions: %v", m.keys)
+	}
+	if len(calls) != 8 || calls[2] != "first" || calls[3] != "drop" {
+		t.Fatalf("bad calls: %v", calls)
+	}
+}
+
+func TestMetrics_MiddlewareEmission(t *testing.T) {
+	m, met := mockMetric()
+	met.EnableTypePrefix = true
+	met.ServiceName = "service"
+	met.UpdateFilterAndLabels(nil, nil, nil, []string{"blocked"})
+	var seen []Emission
+	met.Middlewares = []Middleware{func(e *Emission) bool {
+		seen = append(seen, *e)
+		return true
+	}}
+
+	// Middlewares see the emissions as they are sent to the sink
+	met.IncrCounterWithLabels([]string{"requests"}, 1, []Label{{"a", "b"}, {"blocked", "x"}})
+	met.ResetCounter([]string{"requests"}, nil)
+	met.ObserveBuckets([]string{"latency"}, map[float64]uint64{10: 2}, nil)
+	expect := []Emission{
+		{Type: MetricTypeCounter, Key: []string{"service", "counter", "requests"}, Value: 1, Labels: []Label{{"a", "b"}}},
+		{Type: MetricTypeCounter, Key: []string{"service", "counter", "requests"}, Reset: true},
+		{Type: MetricTypeSample, Key: []string{"service", "sample", "latency"}, Buckets: map[float64]uint64{10: 2}},
+	}
+	if !reflect.DeepEqual(seen, expect) {
+		t.Fatalf("bad emissions:\n%+v\nexpected:\n%+v", seen, expect)
+	}
+	if !reflect.DeepEqual(m.labels[0], []Label{{"a", "b"}}) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+}
+
+func TestMetrics_MiddlewareIntegers(t *testing.T) {
+	im := &intMockSink{}
+	met := &Metrics{Config: Config{FilterDefault: true}, sink: im}
+
+	// Integers unchanged by the middlewares are still sent as integers
+	met.Middlewares = []Middleware{ClampValues(0, 10)}
+	met.SetGaugeInt([]string{"gauge"}, 5)
+	met.IncrCounterInt([]string{"counter"}, 20)
+	if !reflect.DeepEqual(im.intVals, []int64{5}) || !reflect.DeepEqual(im.vals, []float32{10}) {
+		t.Fatalf("bad values: %v %v", im.intVals, im.vals)
+	}
+}
+
+func TestClampValues(t *testing.T) {
+	m, met := mockMetric()
+	met.TimerGranularity = time.Millisecond
+	met.Middlewares = []Middleware{ClampValues(0, 100)}
+	met.AddSample([]string{"a"}, -1)
+	met.AddSample([]string{"a"}, 50)
+	met.AddSample([]string{"a"}, 1000)
+	met.AddSample([]string{"a"}, float32(math.NaN()))
+	met.MeasureSince([]string{"timer"}, time.Now().Add(-time.Second))
+	if !reflect.DeepEqual(m.vals, []float32{0, 50, 100, 100}) {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+}
+
+func TestRenameAndRedactLabels(t *testing.T) {
+	m, met := mockMetric()
+	met.Middlewares = []Middleware{RenameLabel("user", "user_id"), RedactLabels("user_id", "email")}
+	labels := []Label{{"user", "alice"}, {"region", "west"}, {"email", "a@example.com"}}
+	met.IncrCounterWithLabels([]string{"logins"}, 1, labels)
+	met.IncrCounterWithLabels([]string{"logins"}, 1, []Label{{"region", "east"}})
+
+	expect := [][]Label{
+		{{"email", RedactedValue}, {"region", "west"}, {"user_id", RedactedValue}},
+		{{"region", "east"}},
+	}
+	if !reflect.DeepEqual(m.labels, expect) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+	// The labels of the caller are left untouched
+	if labels[0] != (Label{"user", "alice"}) || labels[2].Value != "a@example.com" {
+		t.Fatalf("labels were modified: %v", labels)
+	}
+}
+
+func TestDropKeys(t *testing.T) {
+	m, met := mockMetric()
+	met.ServiceName = "service"
+	met.Middlewares = []Middleware{DropKeys("service.noisy")}
+	met.IncrCounter([]string{"noisy"}, 1)
+	met.IncrCounter([]string{"quiet"}, 1)
+	if !reflect.DeepEqual(m.keys, [][]string{{"service", "quiet"}}) {
+		t.Fatalf("bad keys: %v", m.keys)
+	}
+}
+
+func TestConfig_MergeMiddlewares(t *testing.T) {
+	base := Config{Middlewares: []Middleware{ClampValues(0, 1)}}
+	override := Config{Middlewares: []Middleware{RedactLabels("user")}}
+	if merged := base.Merge(override); len(merged.Middlewares) != 2 {
+		t.Fatalf("bad middlewares: %d", len(merged.Middlewares))
+	}
+	if merged := base.Merge(Config{}); len(merged.Middlewares) != 1 {
+		t.Fatalf("bad middlewares: %d", len(merged.Middlewares))
+	}
+}
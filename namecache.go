@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"container/list"
+	"sync"
+)
+
+// NameCacheStats holds the lookup counts of a sink's metric name cache
+type NameCacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// HitRate returns the fraction of lookups served from the cache, or zero if
+// there were no lookups
+func (s NameCacheStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// nameCache is a bounded LRU cache of flattened metric names, keyed by the
+// key and labels they were flattened from. Lookups hash the key and labels
+// in place, so a hit does not allocate.
+type nameCache struct {
+	size int
+
+	lock  sync.Mutex
+	lru   *list.List // of *nameCacheEntry, most recently used first
+	items map[uint64]*list.Element
+	stats NameCacheStats
+}
+
+// nameCacheEntry is a cached name along with copies of the key and labels
+// it was flattened from, used to tell hash collisions from hits
+type nameCacheEntry struct {
+	hash   uint64
+	key    []string
+	labels []Label
+	name   string
+}
+
+func newNameCache(size int) *nameCache {
+	return &nameCache{
+		size:  size,
+		lru:   list.New(),
+		items: make(map[uint64]*list.Element, size),
+	}
+}
+
+// get returns the flattened name of key and labels, calling flatten and
+// caching its result on a miss
+func (c *nameCache) get(key []string, labels []Label, flatten func([]string, []Label) string) string {
+	hash := hashKeyLabels(key, labels)
+
+	c.lock.Lock()
+	if elem, ok := c.items[hash]; ok {
+		entry := elem.Value.(*nameCacheEntry)
+		if entry.matches(key, labels) {
+			c.lru.MoveToFront(elem)
+			c.stats.Hits++
+			c.lock.Unlock()
+			return entry.name
+		}
+	}
+	c.stats.Misses++
+	c.lock.Unlock()
+
+	// Flatten outside the lock, and copy the key and labels since callers
+	// are free to reuse their slices
+	entry := &nameCacheEntry{
+		hash:   hash,
+		key:    append([]string(nil), key...),
+		labels: append([]Label(nil), labels...),
+		name:   flatten(key, labels),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.items[hash]; ok {
+		c.lru.Remove(elem)
+	}
+	c.items[hash] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*nameCacheEntry).hash)
+	}
+	return entry.name
+}
+
+// getStats returns the lookup counts
+func (c *nameCache) getStats() NameCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// matches returns whether the entry was flattened from key and labels
+func (e *nameCacheEntry) matches(key []string, labels []Label) bool {
+	if len(e.key) != len(key) || len(e.labels) != len(labels) {
+		return false
+	}
+	for i := range key {
+		if e.key[i] != key[i] {
+			return false
+		}
+	}
+	for i := range labels {
+		if e.labels[i] != labels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// FNV-1a parameters
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// hashKeyLabels returns the FNV-1a hash of key and labels. Every string is
+// followed by a separator byte, so moving text between parts changes the
+// hash.
+func hashKeyLabels(key []string, labels []Label) uint64 {
+	h := uint64(fnvOffset64)
+	add := func(s string, sep byte) {
+		for i := 0; i < len(s); i++ {
+			h ^= uint64(s[i])
+			h *= fnvPrime64
+		}
+		h ^= uint64(sep)
+		h *= fnvPrime64
+	}
+	for _, part := range key {
+		add(part, 0)
+	}
+	for _, label := range labels {
+		add(label.Name, 1)
+		add(label.Value, 2)
+	}
+	return h
+}
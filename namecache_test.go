@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countingFlatten joins key and label values with '.', counting its calls
+type countingFlatten struct {
+	lock  sync.Mutex
+	calls int
+}
+
+func (f *countingFlatten) flatten(key []string, labels []Label) string {
+	f.lock.Lock()
+	f.calls++
+	f.lock.Unlock()
+
+	parts := append([]string(nil), key...)
+	for _, label := range labels {
+		parts = append(parts, label.Value)
+	}
+	return strings.Join(parts, ".")
+}
+
+func TestNameCache(t *testing.T) {
+	f := &countingFlatten{}
+	c := newNameCache(2)
+
+	labels := []Label{{"a", "b"}}
+	for i := 0; i < 3; i++ {
+		if name := c.get([]string{"foo", "bar"}, labels, f.flatten); name != "foo.bar.b" {
+			t.Fatalf("bad name: %s", name)
+		}
+	}
+	if f.calls != 1 {
+		t.Fatalf("bad calls: %d", f.calls)
+	}
+	if stats := c.getStats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+
+	// Keys and labels are told apart even when their joined text matches
+	for _, tc := range []struct {
+		key    []string
+		labels []Label
+		name   string
+	}{
+		{[]string{"foo.bar"}, labels, "foo.bar.b"},
+		{[]string{"foo", "bar"}, []Label{{"c", "b"}}, "foo.bar.b"},
+		{[]string{"foo", "bar"}, nil, "foo.bar"},
+	} {
+		before := f.calls
+		if name := c.get(tc.key, tc.labels, f.flatten); name != tc.name {
+			t.Fatalf("bad name: %s", name)
+		}
+		if f.calls != before+1 {
+			t.Fatalf("expected a miss for %v %v", tc.key, tc.labels)
+		}
+	}
+}
+
+func TestNameCache_Eviction(t *testing.T) {
+	f := &countingFlatten{}
+	c := newNameCache(2)
+
+	c.get([]string{"a"}, nil, f.flatten)
+	c.get([]string{"b"}, nil, f.flatten)
+	c.get([]string{"a"}, nil, f.flatten) // a is now the most recently used
+	c.get([]string{"c"}, nil, f.flatten) // evicts b
+
+	if c.lru.Len() != 2 || len(c.items) != 2 {
+		t.Fatalf("bad size: %d %d", c.lru.Len(), len(c.items))
+	}
+	f.calls = 0
+	c.get([]string{"a"}, nil, f.flatten)
+	c.get([]string{"c"}, nil, f.flatten)
+	if f.calls != 0 {
+		t.Fatalf("expected hits, got %d misses", f.calls)
+	}
+	c.get([]string{"b"}, nil, f.flatten)
+	if f.calls != 1 {
+		t.Fatalf("expected b to be evicted")
+	}
+}
+
+func TestNameCache_CopiesKey(t *testing.T) {
+	f := &countingFlatten{}
+	c := newNameCache(2)
+
+	key := []string{"foo", "bar"}
+	c.get(key, nil, f.flatten)
+	key[1] = "baz"
+	if name := c.get(key, nil, f.flatten); name != "foo.baz" {
+		t.Fatalf("bad name: %s", name)
+	}
+}
+
+func TestNameCache_Concurrent(t *testing.T) {
+	f := &countingFlatten{}
+	c := newNameCache(8)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := []string{"key", fmt.Sprint(i % 16)}
+				if name := c.get(key, nil, f.flatten); name != strings.Join(key, ".") {
+					t.Errorf("bad name: %s", name)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	stats := c.getStats()
+	if stats.Hits+stats.Misses != 4000 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+}
+
+func TestNameCacheStats_HitRate(t *testing.T) {
+	if r := (NameCacheStats{}).HitRate(); r != 0 {
+		t.Fatalf("bad rate: %v", r)
+	}
+	if r := (NameCacheStats{Hits: 3, Misses: 1}).HitRate(); r != 0.75 {
+		t.Fatalf("bad rate: %v", r)
+	}
+}
+
+func BenchmarkStatsd_MetricName(b *testing.B) {
+	key := []string{"service", "http", "request", "duration"}
+	labels := []Label{{"method", "GET"}, {"code", "200"}}
+
+	b.Run("uncached", func(b *testing.B) {
+		s := &StatsdSink{}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s.metricName(key, labels)
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		s := &StatsdSink{names: newNameCache(128)}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s.metricName(key, labels)
+		}
+		b.ReportMetric(s.NameCacheStats().HitRate(), "hit-rate")
+	})
+}
@@ -0,0 +1,292 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultNetworkQueueSize is the number of encoded emissions buffered by a
+// NetworkSink before new ones are dropped
+const DefaultNetworkQueueSize = 4096
+
+// NetworkSinkOpts is used to configure a NetworkSink
+type NetworkSinkOpts struct {
+	// Serializer encodes the emissions. Required.
+	Serializer Serializer
+
+	// QueueSize is the number of encoded emissions buffered while waiting to
+	// be sent. Emissions made while the queue is full are dropped. Defaults
+	// to DefaultNetworkQueueSize.
+	QueueSize int
+
+	// MaxPacketSize is the largest datagram sent over a datagram network,
+	// holding as many whole encodings as fit. An encoding larger than it is
+	// sent alone. Defaults to 1400 bytes, as for statsd. Streams are written
+	// through a buffer regardless.
+	MaxPacketSize int
+
+	// ErrorLog is used to log connection and write errors. Defaults to a
+	// FailureLogger from NewFailureLogger.
+	ErrorLog *FailureLogger
+}
+
+// NetworkSink is a MetricSink sending the emissions encoded by a Serializer
+// over a network connection, so custom formats don't need a transport of
+// their own. Over a datagram network such as "udp" or "unixgram", encodings
+// are batched into packets; over a stream such as "tcp" they are written
+// through a buffer flushed every 100ms. It reconnects after errors, and
+// emissions made while disconnected are dropped.
+type NetworkSink struct {
+	// dropped and errors are accessed atomically and kept first to
+	// guarantee 64-bit alignment
+	dropped uint64
+	errors  uint64
+
+	network    string
+	addr       string
+	serializer Serializer
+	maxPacket  int
+	errLog     *FailureLogger
+	queue      chan []byte
+
+	// closeLock guards closed against concurrent pushes, so Shutdown never
+	// closes queue while an emission is being pushed to it
+	closeLock sync.RWMutex
+	closed    bool
+
+	// reconnectWait is the wait before reconnecting after an error
+	reconnectWait time.Duration
+}
+
+// NewNetworkSink creates a NetworkSink sending the emissions encoded by the
+// Serializer of opts to addr over network, with the networks and addresses
+// of net.Dial. It connects in the background.
+func NewNetworkSink(network, addr string, opts NetworkSinkOpts) (*NetworkSink, error) {
+	if opts.Serializer == nil {
+		return nil, fmt.Errorf("network sink requires a serializer")
+	}
+	if opts.QueueSize < 0 {
+		return nil, fmt.Errorf("invalid queue size %d", opts.QueueSize)
+	}
+	if opts.MaxPacketSize < 0 {
+		return nil, fmt.Errorf("invalid max packet size %d", opts.MaxPacketSize)
+	}
+	if opts.QueueSize == 0 {
+		opts.QueueSize = DefaultNetworkQueueSize
+	}
+	if opts.MaxPacketSize == 0 {
+		opts.MaxPacketSize = statsdMaxLen
+	}
+	n := &NetworkSink{
+		network:       network,
+		addr:          addr,
+		serializer:    opts.Serializer,
+		maxPacket:     opts.MaxPacketSize,
+		errLog:        opts.ErrorLog,
+		queue:         make(chan []byte, opts.QueueSize),
+		reconnectWait: reconnectInterval,
+	}
+	if n.errLog == nil {
+		n.errLog = NewFailureLogger()
+	}
+	if err := GoSink(n.flushMetrics); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Shutdown stops the sink. The queued emissions are still sent in the
+// background if connected, and dropped otherwise. Emissions made
+// concurrently with or after Shutdown are dropped, and calling it again has
+// no effect.
+func (n *NetworkSink) Shutdown() {
+	n.closeLock.Lock()
+	defer n.closeLock.Unlock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+}
+
+// SinkStats returns the number of emissions dropped because the queue was
+// full or the sink disconnected, and the number of connection and write
+// errors
+func (n *NetworkSink) SinkStats() SinkStats {
+	return SinkStats{
+		Dropped: atomic.LoadUint64(&n.dropped),
+		Errors:  atomic.LoadUint64(&n.errors),
+	}
+}
+
+// emit encodes an emission and queues it, dropping it if the queue is full
+func (n *NetworkSink) emit(e *Emission) {
+	buf := n.serializer.AppendEmission(nil, e)
+	if len(buf) == 0 {
+		return
+	}
+
+	n.closeLock.RLock()
+	defer n.closeLock.RUnlock()
+	if n.closed {
+		atomic.AddUint64(&n.dropped, 1)
+		notifyDrop(e.Key, e.Labels, DropShutdown)
+		return
+	}
+	select {
+	case n.queue <- buf:
+	default:
+		atomic.AddUint64(&n.dropped, 1)
+		notifyDrop(e.Key, e.Labels, DropQueueFull)
+	}
+}
+
+// logError counts and logs a connection or write error
+func (n *NetworkSink) logError(format string, err error) {
+	atomic.AddUint64(&n.errors, 1)
+	n.errLog.Printf(format, err)
+}
+
+// datagram returns whether the network of the sink sends datagrams
+func (n *NetworkSink) datagram() bool {
+	switch n.network {
+	case "udp", "udp4", "udp6", "unixgram", "ip", "ip4", "ip6":
+		return true
+	}
+	return false
+}
+
+// Flushes the queued emissions
+func (n *NetworkSink) flushMetrics() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		sock, err := net.Dial(n.network, n.addr)
+		if err != nil {
+			n.logError("[ERR] Error connecting to network sink! Err: %s", err)
+		} else {
+			if n.datagram() {
+				err = n.sendPackets(sock, ticker.C)
+			} else {
+				err = n.sendStream(sock, ticker.C)
+			}
+			sock.Close()
+			if err == nil {
+				return
+			}
+			n.logError("[ERR] Error writing to network sink! Err: %s", err)
+		}
+
+		// Drop the emissions made until it is time to reconnect
+		wait := time.After(n.reconnectWait)
+	WAIT:
+		for {
+			select {
+			case _, ok := <-n.queue:
+				if !ok {
+					return
+				}
+				atomic.AddUint64(&n.dropped, 1)
+				notifyDrop(nil, nil, DropDisconnected)
+			case <-wait:
+				break WAIT
+			}
+		}
+	}
+}
+
+// sendPackets sends the queued encodings to sock in packets of up to
+// maxPacket bytes, until the queue is closed or a write fails
+func (n *NetworkSink) sendPackets(sock net.Conn, tick <-chan time.Time) error {
+	packet := make([]byte, 0, n.maxPacket)
+	send := func() error {
+		if len(packet) == 0 {
+			return nil
+		}
+		_, err := sock.Write(packet)
+		packet = packet[:0]
+		return err
+	}
+	for {
+		select {
+		case buf, ok := <-n.queue:
+			if !ok {
+				return send()
+			}
+			if len(packet)+len(buf) > n.maxPacket {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+			packet = append(packet, buf...)
+		case <-tick:
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendStream writes the queued encodings to sock through a buffer, until
+// the queue is closed or a write fails
+func (n *NetworkSink) sendStream(sock net.Conn, tick <-chan time.Time) error {
+	buffered := bufio.NewWriter(sock)
+	for {
+		select {
+		case buf, ok := <-n.queue:
+			if !ok {
+				return buffered.Flush()
+			}
+			if _, err := buffered.Write(buf); err != nil {
+				return err
+			}
+		case <-tick:
+			if err := buffered.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (n *NetworkSink) SetGauge(key []string, val float32) {
+	n.SetGaugeWithLabels(key, val, nil)
+}
+
+func (n *NetworkSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	n.emit(&Emission{Type: MetricTypeGauge, Key: key, Value: val, Labels: labels})
+}
+
+func (n *NetworkSink) EmitKey(key []string, val float32) {
+	n.emit(&Emission{Type: MetricTypeKey, Key: key, Value: val})
+}
+
+func (n *NetworkSink) IncrCounter(key []string, val float32) {
+	n.IncrCounterWithLabels(key, val, nil)
+}
+
+func (n *NetworkSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	n.emit(&Emission{Type: MetricTypeCounter, Key: key, Value: val, Labels: labels})
+}
+
+func (n *NetworkSink) AddSample(key []string, val float32) {
+	n.AddSampleWithLabels(key, val, nil)
+}
+
+func (n *NetworkSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	n.emit(&Emission{Type: MetricTypeSample, Key: key, Value: val, Labels: labels})
+}
+
+// ResetCounter passes the reset to the Serializer as an emission with Reset
+// set, skipped by formats without resets
+func (n *NetworkSink) ResetCounter(key []string, labels []Label) {
+	n.emit(&Emission{Type: MetricTypeCounter, Key: key, Labels: labels, Reset: true})
+}
+
+// ObserveBuckets passes the observations to the Serializer as an emission
+// with Buckets set, skipped by formats without buckets
+func (n *NetworkSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	n.emit(&Emission{Type: MetricTypeSample, Key: key, Labels: labels, Buckets: counts})
+}
@@ -0,0 +1,161 @@
+package metrics
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lineSerializer is a custom format encoding emissions as
+// "type key value labels" lines, skipping resets
+var lineSerializer = SerializerFunc(func(buf []byte, e *Emission) []byte {
+	if e.Reset {
+		return buf
+	}
+	buf = append(buf, e.Type.String()...)
+	buf = append(buf, ' ')
+	buf = append(buf, strings.Join(e.Key, "/")...)
+	buf = append(buf, ' ')
+	buf = strconv.AppendFloat(buf, float64(e.Value), 'g', -1, 32)
+	for _, label := range e.Labels {
+		buf = append(buf, ' ')
+		buf = append(buf, label.Name+"="+label.Value...)
+	}
+	if e.Buckets != nil {
+		buf = append(buf, " buckets="...)
+		buf = strconv.AppendInt(buf, int64(len(e.Buckets)), 10)
+	}
+	return append(buf, '\n')
+})
+
+func emitNetworkTest(n *NetworkSink) {
+	n.SetGaugeWithLabels([]string{"queue", "depth"}, 3, []Label{{"shard", "a"}})
+	n.IncrCounter([]string{"requests"}, 1)
+	n.ResetCounter([]string{"requests"}, nil)
+	n.AddSample([]string{"latency"}, 1.5)
+	n.ObserveBuckets([]string{"latency"}, map[float64]uint64{1: 2}, nil)
+	n.EmitKey([]string{"kv"}, 7)
+}
+
+var expectNetworkLines = []string{
+	"gauge queue/depth 3 shard=a",
+	"counter requests 1",
+	"sample latency 1.5",
+	"sample latency 0 buckets=1",
+	"key kv 7",
+}
+
+func TestNewNetworkSink_Opts(t *testing.T) {
+	if _, err := NewNetworkSink("udp", "127.0.0.1:1", NetworkSinkOpts{}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := NewNetworkSink("udp", "127.0.0.1:1", NetworkSinkOpts{Serializer: lineSerializer, QueueSize: -1}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestNetworkSink_UDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// The packets hold whole lines, at most two of them here
+	n, err := NewNetworkSink("udp", conn.LocalAddr().String(), NetworkSinkOpts{Serializer: lineSerializer, MaxPacketSize: 50})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer n.Shutdown()
+	emitNetworkTest(n)
+
+	var lines []string
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(lines) < len(expectNetworkLines) {
+		size, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if size > 50 || buf[size-1] != '\n' {
+			t.Fatalf("bad packet: %q", buf[:size])
+		}
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(buf[:size]), "\n"), "\n")...)
+	}
+	if strings.Join(lines, "|") != strings.Join(expectNetworkLines, "|") {
+		t.Fatalf("bad lines: %q", lines)
+	}
+}
+
+func TestNetworkSink_TCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ln.Close()
+
+	n, err := NewNetworkSink("tcp", ln.Addr().String(), NetworkSinkOpts{Serializer: lineSerializer})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Shutdown flushes the buffer
+	emitNetworkTest(n)
+	n.Shutdown()
+	n.IncrCounter([]string{"late"}, 1)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, expect := range expectNetworkLines {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if line != expect+"\n" {
+			t.Fatalf("expected %q, got %q", expect, line)
+		}
+	}
+	if stats := n.SinkStats(); stats.Dropped != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+}
+
+func TestNetworkSink_Statsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// The statsd format plugs into the generic transport
+	z, err := NewStatsdSerializer(DefaultStatsdOpts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	n, err := NewNetworkSink("udp", conn.LocalAddr().String(), NetworkSinkOpts{Serializer: z})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer n.Shutdown()
+	n.IncrCounterWithLabels([]string{"requests"}, 1, []Label{{"code", "200"}})
+	n.ResetCounter([]string{"requests"}, nil)
+	n.SetGauge([]string{"queue"}, 2)
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	size, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := string(buf[:size]); out != "requests.200:1.000000|c\nqueue:2.000000|g\n" {
+		t.Fatalf("bad packet: %q", out)
+	}
+}
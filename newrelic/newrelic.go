@@ -0,0 +1,388 @@
+// Package newrelic provides a MetricSink which sends metrics to the New
+// Relic Metric API.
+package newrelic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	// DefaultEndpoint is the New Relic Metric API endpoint for US accounts
+	DefaultEndpoint = "https://metric-api.newrelic.com/metric/v1"
+
+	// DefaultFlushInterval is how often aggregated metrics are sent
+	DefaultFlushInterval = 10 * time.Second
+
+	// DefaultMaxBatchSize is the maximum number of metrics sent per request
+	DefaultMaxBatchSize = 1000
+
+	// DefaultMaxRetries is the number of times a failed request is retried
+	DefaultMaxRetries = 3
+
+	// DefaultRetryBackoff is the wait before the first retry. It doubles
+	// with every following retry.
+	DefaultRetryBackoff = time.Second
+)
+
+// NewRelicOpts is used to configure the NewRelicSink
+type NewRelicOpts struct {
+	// APIKey is the insert or license key sent with every request. Required.
+	APIKey string
+
+	// Endpoint is the URL metrics are posted to. Defaults to
+	// DefaultEndpoint, EU accounts must use
+	// https://metric-api.eu.newrelic.com/metric/v1 instead.
+	Endpoint string
+
+	// FlushInterval is how often aggregated metrics are sent. Defaults to
+	// DefaultFlushInterval.
+	FlushInterval time.Duration
+
+	// MaxBatchSize bounds the number of metrics sent in a single request.
+	// Defaults to DefaultMaxBatchSize.
+	MaxBatchSize int
+
+	// MaxRetries is the number of times a request is retried after a
+	// network error, a 408, a 429 or a 5xx response. Defaults to
+	// DefaultMaxRetries, a negative value disables retries.
+	MaxRetries int
+
+	// RetryBackoff is the wait before the first retry, doubling with every
+	// following retry. Defaults to DefaultRetryBackoff.
+	RetryBackoff time.Duration
+
+	// Client is the HTTP client used to send requests. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	// ErrorLog is used to log failed flushes. Defaults to a FailureLogger
+	// from metrics.NewFailureLogger.
+	ErrorLog *metrics.FailureLogger
+}
+
+// NewRelicSink provides a MetricSink that aggregates metrics in memory and
+// periodically posts them to the New Relic Metric API. Labels are sent as
+// attributes. Within a flush interval, gauges keep their last value and are
+// sent as "gauge" metrics, counters are summed and sent as "count" metrics
+// and samples are sent as "summary" metrics.
+type NewRelicSink struct {
+	// dropped, errors and offset are accessed atomically and kept first to
+	// guarantee 64-bit alignment
+	dropped uint64
+	errors  uint64
+	offset  int64 // time.Duration added to timestamps
+
+	opts NewRelicOpts
+
+	lock       sync.Mutex
+	aggregates map[string]*aggregate
+	start      time.Time
+
+	stopChan chan struct{}
+	doneChan chan struct{}
+	stopOnce sync.Once
+}
+
+// aggregate holds the values of one metric for the current flush interval
+type aggregate struct {
+	name       string
+	typ        string
+	attributes map[string]string
+	value      float64
+	count      int
+	min        float64
+	max        float64
+}
+
+// metricBatch is the payload of the Metric API, a list of which is posted
+type metricBatch struct {
+	Common  commonBlock `json:"common"`
+	Metrics []metric    `json:"metrics"`
+}
+
+type commonBlock struct {
+	Timestamp  int64 `json:"timestamp"`
+	IntervalMS int64 `json:"interval.ms"`
+}
+
+type metric struct {
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	Value      interface{}       `json:"value"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+type summaryValue struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+// NewNewRelicSink creates a NewRelicSink and starts flushing it every
+// opts.FlushInterval. Call Shutdown to flush the remaining metrics and stop.
+func NewNewRelicSink(opts NewRelicOpts) (*NewRelicSink, error) {
+	if opts.APIKey == "" {
+		return nil, fmt.Errorf("API key is required")
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = DefaultEndpoint
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = DefaultMaxBatchSize
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultMaxRetries
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = DefaultRetryBackoff
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.ErrorLog == nil {
+		opts.ErrorLog = metrics.NewFailureLogger()
+	}
+
+	s := &NewRelicSink{
+		opts:       opts,
+		aggregates: make(map[string]*aggregate),
+		start:      time.Now(),
+		stopChan:   make(chan struct{}),
+		doneChan:   make(chan struct{}),
+	}
+	if err := metrics.GoSink(s.flushMetrics); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Shutdown stops the periodic flush and sends the remaining metrics. It is
+// safe to call more than once.
+func (s *NewRelicSink) Shutdown() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	<-s.doneChan
+	if err := s.Flush(); err != nil {
+		s.opts.ErrorLog.Printf("[ERR] Error flushing to New Relic! Err: %s", err)
+	}
+}
+
+// Flush sends the metrics aggregated since the last flush. Metrics of a
+// batch which could not be sent after all retries are dropped.
+func (s *NewRelicSink) Flush() error {
+	now := time.Now()
+	s.lock.Lock()
+	aggregates := s.aggregates
+	start := s.start
+	s.aggregates = make(map[string]*aggregate)
+	s.start = now
+	s.lock.Unlock()
+
+	if len(aggregates) == 0 {
+		return nil
+	}
+
+	common := commonBlock{
+		Timestamp:  start.Add(time.Duration(atomic.LoadInt64(&s.offset))).UnixNano() / int64(time.Millisecond),
+		IntervalMS: int64(now.Sub(start) / time.Millisecond),
+	}
+	batch := make([]metric, 0, len(aggregates))
+	var firstErr error
+	for _, agg := range aggregates {
+		batch = append(batch, agg.metric())
+		if len(batch) == s.opts.MaxBatchSize {
+			if err := s.send(common, batch); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := s.send(common, batch); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// SetTimestampOffset adds offset to the timestamps of later flushes, as
+// described by metrics.TimestampSink
+func (s *NewRelicSink) SetTimestampOffset(offset time.Duration) {
+	atomic.StoreInt64(&s.offset, int64(offset))
+}
+
+// SinkStats returns the number of metrics dropped because their batch could
+// not be sent, and the number of failed requests.
+func (s *NewRelicSink) SinkStats() metrics.SinkStats {
+	return metrics.SinkStats{
+		Dropped: atomic.LoadUint64(&s.dropped),
+		Errors:  atomic.LoadUint64(&s.errors),
+	}
+}
+
+func (s *NewRelicSink) flushMetrics() {
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+	defer close(s.doneChan)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				s.opts.ErrorLog.Printf("[ERR] Error flushing to New Relic! Err: %s", err)
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// send posts a batch of metrics, retrying transient failures
+func (s *NewRelicSink) send(common commonBlock, batch []metric) error {
+	body, err := json.Marshal([]metricBatch{{Common: common, Metrics: batch}})
+	if err != nil {
+		atomic.AddUint64(&s.dropped, uint64(len(batch)))
+		return err
+	}
+
+	backoff := s.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil {
+			return nil
+		}
+		atomic.AddUint64(&s.errors, 1)
+		if !retry || attempt >= s.opts.MaxRetries {
+			atomic.AddUint64(&s.dropped, uint64(len(batch)))
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.stopChan:
+			// Shutting down, retry without waiting
+		}
+		backoff *= 2
+	}
+}
+
+// post makes a single request, returning whether a failure is transient
+func (s *NewRelicSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", s.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Api-Key", s.opts.APIKey)
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// metric converts the aggregate to a Metric API metric
+func (a *aggregate) metric() metric {
+	m := metric{Name: a.name, Type: a.typ, Value: a.value, Attributes: a.attributes}
+	if a.typ == "summary" {
+		m.Value = summaryValue{Count: a.count, Sum: a.value, Min: a.min, Max: a.max}
+	}
+	return m
+}
+
+// getAggregate returns the aggregate for a metric, creating it if needed.
+// The caller must hold lock.
+func (s *NewRelicSink) getAggregate(key []string, labels []metrics.Label, typ string) *aggregate {
+	name := strings.Join(key, ".")
+	hash := typ + ":" + name
+	for _, label := range labels {
+		hash += fmt.Sprintf(";%s=%s", label.Name, label.Value)
+	}
+	agg, ok := s.aggregates[hash]
+	if !ok {
+		var attributes map[string]string
+		if len(labels) > 0 {
+			attributes = make(map[string]string, len(labels))
+			for _, label := range labels {
+				attributes[label.Name] = label.Value
+			}
+		}
+		agg = &aggregate{name: name, typ: typ, attributes: attributes}
+		s.aggregates[hash] = agg
+	}
+	return agg
+}
+
+// Implementation of methods in the MetricSink interface
+
+func (s *NewRelicSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *NewRelicSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	agg := s.getAggregate(key, labels, "gauge")
+	agg.value = float64(val)
+}
+
+// EmitKey is not implemented since the Metric API does not provide a metric
+// type for arbitrary key/value pairs
+func (s *NewRelicSink) EmitKey(key []string, val float32) {
+}
+
+func (s *NewRelicSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *NewRelicSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	agg := s.getAggregate(key, labels, "count")
+	agg.value += float64(val)
+}
+
+func (s *NewRelicSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *NewRelicSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	agg := s.getAggregate(key, labels, "summary")
+	v := float64(val)
+	agg.count++
+	agg.value += v
+	if v < agg.min || agg.count == 1 {
+		agg.min = v
+	}
+	if v > agg.max || agg.count == 1 {
+		agg.max = v
+	}
+}
@@ -0,0 +1,289 @@
+package newrelic
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// fakeEndpoint is a Metric API endpoint recording the payloads it receives
+// as generic JSON. The first failures requests are answered with status.
+type fakeEndpoint struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests int
+	failures int
+	status   int
+	apiKeys  []string
+	payloads [][]map[string]interface{}
+}
+
+func newFakeEndpoint(t *testing.T) *fakeEndpoint {
+	f := &fakeEndpoint{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		f.requests++
+		f.apiKeys = append(f.apiKeys, r.Header.Get("Api-Key"))
+		if f.failures > 0 {
+			f.failures--
+			w.WriteHeader(f.status)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("err: %v", err)
+		}
+		var payload []map[string]interface{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("bad body %q: %v", body, err)
+		}
+		f.payloads = append(f.payloads, payload)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return f
+}
+
+// metrics returns every metric received, sorted by name
+func (f *fakeEndpoint) metrics() []map[string]interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var out []map[string]interface{}
+	for _, payload := range f.payloads {
+		for _, batch := range payload {
+			for _, m := range batch["metrics"].([]interface{}) {
+				out = append(out, m.(map[string]interface{}))
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i]["name"].(string) < out[j]["name"].(string)
+	})
+	return out
+}
+
+func (f *fakeEndpoint) getRequests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+func testSink(t *testing.T, endpoint string) *NewRelicSink {
+	sink, err := NewNewRelicSink(NewRelicOpts{
+		APIKey:        "secret",
+		Endpoint:      endpoint,
+		FlushInterval: time.Hour,
+		RetryBackoff:  time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return sink
+}
+
+func TestNewNewRelicSink_RequiresKey(t *testing.T) {
+	if _, err := NewNewRelicSink(NewRelicOpts{}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestNewRelicSink_Payload(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, f.URL)
+	defer sink.Shutdown()
+
+	labels := []metrics.Label{{Name: "region", Value: "west"}}
+	sink.SetGauge([]string{"a", "gauge"}, 1)
+	sink.SetGauge([]string{"a", "gauge"}, 2)
+	sink.IncrCounterWithLabels([]string{"b", "count"}, 3, labels)
+	sink.IncrCounterWithLabels([]string{"b", "count"}, 4, labels)
+	sink.AddSample([]string{"c", "summary"}, 1)
+	sink.AddSample([]string{"c", "summary"}, 3)
+	sink.EmitKey([]string{"d", "kv"}, 1)
+
+	before := time.Now()
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if f.getRequests() != 1 || f.apiKeys[0] != "secret" {
+		t.Fatalf("bad requests: %d %v", f.requests, f.apiKeys)
+	}
+
+	// A single batch with a common block
+	payload := f.payloads[0]
+	if len(payload) != 1 {
+		t.Fatalf("bad payload: %v", payload)
+	}
+	common := payload[0]["common"].(map[string]interface{})
+	ts := int64(common["timestamp"].(float64))
+	if ts > before.UnixNano()/int64(time.Millisecond) || ts <= 0 {
+		t.Fatalf("bad timestamp: %v", ts)
+	}
+	if _, ok := common["interval.ms"].(float64); !ok {
+		t.Fatalf("missing interval: %v", common)
+	}
+
+	expected := []map[string]interface{}{
+		{"name": "a.gauge", "type": "gauge", "value": 2.0},
+		{
+			"name":       "b.count",
+			"type":       "count",
+			"value":      7.0,
+			"attributes": map[string]interface{}{"region": "west"},
+		},
+		{
+			"name": "c.summary",
+			"type": "summary",
+			"value": map[string]interface{}{
+				"count": 2.0, "sum": 4.0, "min": 1.0, "max": 3.0,
+			},
+		},
+	}
+	if got := f.metrics(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad metrics:\n%v\nexpected:\n%v", got, expected)
+	}
+
+	// Nothing is sent when there is nothing new
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if f.getRequests() != 1 {
+		t.Fatalf("bad requests: %d", f.getRequests())
+	}
+}
+
+func TestNewRelicSink_TimestampOffset(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, f.URL)
+	defer sink.Shutdown()
+
+	var _ metrics.TimestampSink = sink
+	sink.SetTimestampOffset(time.Hour)
+	sink.SetGauge([]string{"a", "gauge"}, 1)
+	before := time.Now()
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	common := f.payloads[0][0]["common"].(map[string]interface{})
+	ts := int64(common["timestamp"].(float64))
+	if ts <= before.UnixNano()/int64(time.Millisecond) {
+		t.Fatalf("timestamp not shifted: %v", ts)
+	}
+}
+
+func TestNewRelicSink_Batches(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink, err := NewNewRelicSink(NewRelicOpts{
+		APIKey:        "secret",
+		Endpoint:      f.URL,
+		FlushInterval: time.Hour,
+		MaxBatchSize:  2,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sink.Shutdown()
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		sink.IncrCounter([]string{k}, 1)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if f.getRequests() != 3 || len(f.metrics()) != 5 {
+		t.Fatalf("bad requests: %d metrics: %d", f.getRequests(), len(f.metrics()))
+	}
+}
+
+func TestNewRelicSink_Retry(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	f.failures, f.status = 2, http.StatusServiceUnavailable
+	sink := testSink(t, f.URL)
+	defer sink.Shutdown()
+
+	sink.IncrCounter([]string{"a"}, 1)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if f.getRequests() != 3 || len(f.metrics()) != 1 {
+		t.Fatalf("bad requests: %d metrics: %d", f.getRequests(), len(f.metrics()))
+	}
+	if stats := sink.SinkStats(); stats.Errors != 2 || stats.Dropped != 0 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+}
+
+func TestNewRelicSink_NoRetryOnClientError(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	f.failures, f.status = 1, http.StatusForbidden
+	sink := testSink(t, f.URL)
+	defer sink.Shutdown()
+
+	sink.IncrCounter([]string{"a"}, 1)
+	if err := sink.Flush(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if f.getRequests() != 1 {
+		t.Fatalf("bad requests: %d", f.getRequests())
+	}
+	if stats := sink.SinkStats(); stats.Errors != 1 || stats.Dropped != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+}
+
+func TestNewRelicSink_ShutdownFlushes(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, f.URL)
+
+	sink.IncrCounter([]string{"a"}, 1)
+	sink.Shutdown()
+	if len(f.metrics()) != 1 {
+		t.Fatalf("bad metrics: %v", f.metrics())
+	}
+
+	// Shutting down again sends nothing more
+	sink.Shutdown()
+	if len(f.metrics()) != 1 {
+		t.Fatalf("bad metrics: %v", f.metrics())
+	}
+}
+
+func TestNewRelicSink_Interval(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink, err := NewNewRelicSink(NewRelicOpts{
+		APIKey:        "secret",
+		Endpoint:      f.URL,
+		FlushInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sink.Shutdown()
+
+	sink.IncrCounter([]string{"a"}, 1)
+	deadline := time.Now().Add(3 * time.Second)
+	for len(f.metrics()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
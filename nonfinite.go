@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// NonFinitePolicy selects how a NonFiniteSink handles a NaN or infinite
+// value
+type NonFinitePolicy int
+
+const (
+	// NonFinitePass passes the value on as it is
+	NonFinitePass NonFinitePolicy = iota
+
+	// NonFiniteDrop drops the emission, counting it in
+	// NonFiniteSink.Dropped
+	NonFiniteDrop
+
+	// NonFiniteReplace passes the emission on with a finite value instead:
+	// NaNReplacement for NaN, and the largest float32 of the same sign for
+	// infinite values
+	NonFiniteReplace
+)
+
+// NonFiniteOpts is used to configure a NonFiniteSink
+type NonFiniteOpts struct {
+	NaN NonFinitePolicy // Handling of NaN values, passed by default
+	Inf NonFinitePolicy // Handling of infinite values, passed by default
+
+	// NaNReplacement replaces NaN values with NonFiniteReplace, zero by
+	// default
+	NaNReplacement float32
+}
+
+// NonFiniteSink wraps a MetricSink and handles the NaN and infinite values of
+// gauges, counters, samples and keys by its own policy before passing them
+// on. Backends tolerate such values differently, e.g. Prometheus exposes NaN
+// while statsd servers reject it, so wrapping each sink of a FanoutSink in a
+// NonFiniteSink lets every backend get the emissions it can ingest. Integer
+// values and bucket observations are passed on unchanged.
+type NonFiniteSink struct {
+	// dropped is accessed atomically and kept first to guarantee 64-bit
+	// alignment
+	dropped uint64
+
+	sink MetricSink
+	opts NonFiniteOpts
+}
+
+// NewNonFiniteSink creates a NonFiniteSink passing emissions to sink
+func NewNonFiniteSink(sink MetricSink, opts NonFiniteOpts) *NonFiniteSink {
+	return &NonFiniteSink{sink: sink, opts: opts}
+}
+
+// Dropped returns the number of emissions dropped for their value
+func (n *NonFiniteSink) Dropped() uint64 {
+	return atomic.LoadUint64(&n.dropped)
+}
+
+// check returns the value to pass on in place of val, and whether to pass it
+// on at all
+func (n *NonFiniteSink) check(key []string, labels []Label, val float32) (float32, bool) {
+	v := float64(val)
+	switch {
+	case math.IsNaN(v):
+		switch n.opts.NaN {
+		case NonFiniteDrop:
+			atomic.AddUint64(&n.dropped, 1)
+			notifyDrop(key, labels, DropNonFinite)
+			return 0, false
+		case NonFiniteReplace:
+			return n.opts.NaNReplacement, true
+		}
+	case math.IsInf(v, 0):
+		switch n.opts.Inf {
+		case NonFiniteDrop:
+			atomic.AddUint64(&n.dropped, 1)
+			notifyDrop(key, labels, DropNonFinite)
+			return 0, false
+		case NonFiniteReplace:
+			if v > 0 {
+				return math.MaxFloat32, true
+			}
+			return -math.MaxFloat32, true
+		}
+	}
+	return val, true
+}
+
+func (n *NonFiniteSink) SetGauge(key []string, val float32) {
+	if val, ok := n.check(key, nil, val); ok {
+		n.sink.SetGauge(key, val)
+	}
+}
+
+func (n *NonFiniteSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	if val, ok := n.check(key, labels, val); ok {
+		n.sink.SetGaugeWithLabels(key, val, labels)
+	}
+}
+
+func (n *NonFiniteSink) EmitKey(key []string, val float32) {
+	if val, ok := n.check(key, nil, val); ok {
+		n.sink.EmitKey(key, val)
+	}
+}
+
+func (n *NonFiniteSink) IncrCounter(key []string, val float32) {
+	if val, ok := n.check(key, nil, val); ok {
+		n.sink.IncrCounter(key, val)
+	}
+}
+
+func (n *NonFiniteSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	if val, ok := n.check(key, labels, val); ok {
+		n.sink.IncrCounterWithLabels(key, val, labels)
+	}
+}
+
+func (n *NonFiniteSink) AddSample(key []string, val float32) {
+	if val, ok := n.check(key, nil, val); ok {
+		n.sink.AddSample(key, val)
+	}
+}
+
+func (n *NonFiniteSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	if val, ok := n.check(key, labels, val); ok {
+		n.sink.AddSampleWithLabels(key, val, labels)
+	}
+}
+
+func (n *NonFiniteSink) AddTimingSample(key []string, val float32, unit time.Duration, labels []Label) {
+	if val, ok := n.check(key, labels, val); ok {
+		addTiming(n.sink, key, val, unit, labels)
+	}
+}
+
+func (n *NonFiniteSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	observeBuckets(n.sink, key, counts, labels)
+}
+
+func (n *NonFiniteSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	setGaugeInt(n.sink, key, val, labels)
+}
+
+func (n *NonFiniteSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	incrCounterInt(n.sink, key, val, labels)
+}
+
+func (n *NonFiniteSink) ResetCounter(key []string, labels []Label) {
+	resetCounter(n.sink, key, labels)
+}
+
+func (n *NonFiniteSink) SetCounterTemporality(key []string, temporality Temporality) {
+	setCounterTemporality(n.sink, key, temporality)
+}
+
+func (n *NonFiniteSink) SetResourceLabels(names []string) {
+	setResourceLabels(n.sink, names)
+}
+
+func (n *NonFiniteSink) SetTimestampOffset(offset time.Duration) {
+	setTimestampOffset(n.sink, offset)
+}
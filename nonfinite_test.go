@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNonFiniteSink_PerSink(t *testing.T) {
+	// The same emissions are handled differently for each backend
+	prom, statsd := &MockSink{}, &MockSink{}
+	fanout := FanoutSink{
+		NewNonFiniteSink(prom, NonFiniteOpts{Inf: NonFiniteReplace}),
+		NewNonFiniteSink(statsd, NonFiniteOpts{NaN: NonFiniteDrop, Inf: NonFiniteDrop}),
+	}
+	nan, inf := float32(math.NaN()), float32(math.Inf(1))
+	fanout.SetGauge([]string{"ratio"}, nan)
+	fanout.AddSampleWithLabels([]string{"latency"}, inf, []Label{{"a", "b"}})
+	fanout.IncrCounter([]string{"requests"}, float32(math.Inf(-1)))
+	fanout.EmitKey([]string{"kv"}, 1)
+
+	if len(prom.vals) != 4 || !math.IsNaN(float64(prom.vals[0])) {
+		t.Fatalf("bad values: %v", prom.vals)
+	}
+	if prom.vals[1] != math.MaxFloat32 || prom.vals[2] != -math.MaxFloat32 || prom.vals[3] != 1 {
+		t.Fatalf("bad values: %v", prom.vals)
+	}
+	if len(statsd.vals) != 1 || statsd.vals[0] != 1 || statsd.keys[0][0] != "kv" {
+		t.Fatalf("bad values: %v %v", statsd.keys, statsd.vals)
+	}
+	if dropped := fanout[1].(*NonFiniteSink).Dropped(); dropped != 3 {
+		t.Fatalf("bad dropped: %d", dropped)
+	}
+	if dropped := fanout[0].(*NonFiniteSink).Dropped(); dropped != 0 {
+		t.Fatalf("bad dropped: %d", dropped)
+	}
+}
+
+func TestNonFiniteSink_Replace(t *testing.T) {
+	m := &MockSink{}
+	s := NewNonFiniteSink(m, NonFiniteOpts{NaN: NonFiniteReplace, NaNReplacement: -1})
+	s.SetGaugeWithLabels([]string{"ratio"}, float32(math.NaN()), nil)
+	s.SetGaugeWithLabels([]string{"ratio"}, float32(math.Inf(1)), nil)
+	s.SetGaugeWithLabels([]string{"ratio"}, 0.5, nil)
+	if m.vals[0] != -1 || !math.IsInf(float64(m.vals[1]), 1) || m.vals[2] != 0.5 {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+}
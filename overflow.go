@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultQueueBlockTimeout is how long OverflowBlock waits for room in a
+// full queue by default
+const DefaultQueueBlockTimeout = 50 * time.Millisecond
+
+// OverflowPolicy selects what buffered sinks do with an emission while their
+// queue is full, e.g. while the backend is slow or unreachable. Every policy
+// counts the emissions it loses as dropped metrics.
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest drops the emission, keeping the queued ones
+	OverflowDropNewest OverflowPolicy = iota
+
+	// OverflowDropOldest drops the oldest queued emission to make room, so
+	// the queue holds the freshest metrics
+	OverflowDropOldest
+
+	// OverflowBlock waits for room in the queue, up to a timeout after
+	// which the emission is dropped. The caller is slowed down by the wait,
+	// and so is Shutdown.
+	OverflowBlock
+)
+
+// queueOverflow pushes to a queue following an OverflowPolicy
+type queueOverflow struct {
+	policy  OverflowPolicy
+	timeout time.Duration
+}
+
+// newQueueOverflow returns the queueOverflow of policy, waiting up to timeout
+// with OverflowBlock, or DefaultQueueBlockTimeout if zero
+func newQueueOverflow(policy OverflowPolicy, timeout time.Duration) (queueOverflow, error) {
+	switch policy {
+	case OverflowDropNewest, OverflowDropOldest, OverflowBlock:
+	default:
+		return queueOverflow{}, fmt.Errorf("unknown overflow policy %d", policy)
+	}
+	if timeout < 0 {
+		return queueOverflow{}, fmt.Errorf("invalid queue block timeout %s", timeout)
+	}
+	if timeout == 0 {
+		timeout = DefaultQueueBlockTimeout
+	}
+	return queueOverflow{policy: policy, timeout: timeout}, nil
+}
+
+// push pushes m to queue, returning the number of emissions dropped to do so
+// or dropped instead of m, which are passed to the DropFunc of SetOnDrop
+func (o queueOverflow) push(queue chan string, m string) uint64 {
+	select {
+	case queue <- m:
+		return 0
+	default:
+	}
+
+	switch o.policy {
+	case OverflowDropOldest:
+		var dropped uint64
+		for {
+			select {
+			case old := <-queue:
+				dropped++
+				notifyDropLine(old, DropQueueFull)
+			default:
+				// Drained by the flush loop in the meantime
+			}
+			select {
+			case queue <- m:
+				return dropped
+			default:
+			}
+		}
+	case OverflowBlock:
+		timer := time.NewTimer(o.timeout)
+		defer timer.Stop()
+		select {
+		case queue <- m:
+			return 0
+		case <-timer.C:
+		}
+	}
+	notifyDropLine(m, DropQueueFull)
+	return 1
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueOverflow_DropNewest(t *testing.T) {
+	o, err := newQueueOverflow(OverflowDropNewest, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	queue := make(chan string, 2)
+	for _, m := range []string{"a", "b", "c"} {
+		o.push(queue, m)
+	}
+	if dropped := o.push(queue, "d"); dropped != 1 {
+		t.Fatalf("bad dropped: %d", dropped)
+	}
+	if a, b := <-queue, <-queue; a != "a" || b != "b" {
+		t.Fatalf("bad queue: %s %s", a, b)
+	}
+}
+
+func TestQueueOverflow_DropOldest(t *testing.T) {
+	o, err := newQueueOverflow(OverflowDropOldest, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	queue := make(chan string, 2)
+	if dropped := o.push(queue, "a") + o.push(queue, "b"); dropped != 0 {
+		t.Fatalf("bad dropped: %d", dropped)
+	}
+	if dropped := o.push(queue, "c"); dropped != 1 {
+		t.Fatalf("bad dropped: %d", dropped)
+	}
+	if dropped := o.push(queue, "d"); dropped != 1 {
+		t.Fatalf("bad dropped: %d", dropped)
+	}
+	if a, b := <-queue, <-queue; a != "c" || b != "d" {
+		t.Fatalf("bad queue: %s %s", a, b)
+	}
+}
+
+func TestQueueOverflow_Block(t *testing.T) {
+	o, err := newQueueOverflow(OverflowBlock, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	queue := make(chan string, 1)
+	o.push(queue, "a")
+
+	// Times out while nothing is drained
+	start := time.Now()
+	if dropped := o.push(queue, "b"); dropped != 1 {
+		t.Fatalf("bad dropped: %d", dropped)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("returned too early: %s", elapsed)
+	}
+
+	// Waits for room otherwise
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		<-queue
+	}()
+	if dropped := o.push(queue, "c"); dropped != 0 {
+		t.Fatalf("bad dropped: %d", dropped)
+	}
+	if m := <-queue; m != "c" {
+		t.Fatalf("bad queue: %s", m)
+	}
+}
+
+func TestNewQueueOverflow_Invalid(t *testing.T) {
+	if _, err := newQueueOverflow(OverflowPolicy(7), 0); err == nil {
+		t.Fatalf("expected error for bad policy")
+	}
+	if _, err := newQueueOverflow(OverflowBlock, -time.Second); err == nil {
+		t.Fatalf("expected error for bad timeout")
+	}
+	o, err := newQueueOverflow(OverflowBlock, 0)
+	if err != nil || o.timeout != DefaultQueueBlockTimeout {
+		t.Fatalf("bad overflow: %+v %v", o, err)
+	}
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import "fmt"
+
+// MetricType is the type of an emission, as far as a sink treats types
+// differently
+type MetricType int
+
+const (
+	MetricTypeGauge MetricType = iota
+	MetricTypeCounter
+	MetricTypeSample
+	MetricTypeKey
+
+	numMetricTypes
+)
+
+func (t MetricType) String() string {
+	switch t {
+	case MetricTypeGauge:
+		return "gauge"
+	case MetricTypeCounter:
+		return "counter"
+	case MetricTypeSample:
+		return "sample"
+	case MetricTypeKey:
+		return "key"
+	}
+	return fmt.Sprintf("MetricType(%d)", int(t))
+}
+
+// DefaultQueuePressure is the default fill ratio of a queue from which
+// QueuePriority drops the first type of its DropOrder
+const DefaultQueuePressure = 0.75
+
+// QueuePriority configures buffered sinks to drop the emissions of less
+// important types first while their queue is filling up, e.g. during an
+// outage of the backend, to keep room for the more important ones.
+//
+// Once the queue is filled to the Pressure ratio, emissions of the first type
+// in DropOrder are dropped. Each following type in DropOrder is dropped from
+// an evenly higher fill ratio, and types which aren't listed only once the
+// queue is full. E.g. with the default Pressure and a DropOrder of samples
+// and keys, samples are dropped from 75% and keys from 87.5%.
+type QueuePriority struct {
+	// DropOrder lists the types to drop under pressure, the first to be
+	// dropped first
+	DropOrder []MetricType
+
+	// Pressure is the fill ratio of the queue, above zero and at most one,
+	// from which the first type of DropOrder is dropped. Defaults to
+	// DefaultQueuePressure.
+	Pressure float64
+}
+
+// DefaultQueuePriority keeps gauges, counters and keys while dropping samples
+// under pressure
+var DefaultQueuePriority = QueuePriority{
+	DropOrder: []MetricType{MetricTypeSample},
+}
+
+// queueLimits holds, by metric type, the queue length from which emissions
+// of the type are dropped
+type queueLimits [numMetricTypes]int
+
+// newQueueLimits returns the limits of p for a queue of capacity
+func newQueueLimits(p QueuePriority, capacity int) (*queueLimits, error) {
+	if p.Pressure == 0 {
+		p.Pressure = DefaultQueuePressure
+	}
+	if !(p.Pressure > 0 && p.Pressure <= 1) {
+		return nil, fmt.Errorf("invalid queue pressure %v", p.Pressure)
+	}
+
+	limits := &queueLimits{}
+	for typ := range limits {
+		limits[typ] = capacity
+	}
+	n := float64(len(p.DropOrder))
+	seen := make(map[MetricType]bool, len(p.DropOrder))
+	for i, typ := range p.DropOrder {
+		if typ < 0 || typ >= numMetricTypes {
+			return nil, fmt.Errorf("invalid metric type %d", typ)
+		}
+		if seen[typ] {
+			continue
+		}
+		seen[typ] = true
+		ratio := p.Pressure + (1-p.Pressure)*float64(i)/n
+		limits[typ] = int(ratio * float64(capacity))
+	}
+	return limits, nil
+}
+
+// admits returns whether an emission of typ fits a queue holding length
+// emissions
+func (l *queueLimits) admits(typ MetricType, length int) bool {
+	return l == nil || length < l[typ]
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import "testing"
+
+func TestNewQueueLimits(t *testing.T) {
+	limits, err := newQueueLimits(QueuePriority{
+		DropOrder: []MetricType{MetricTypeSample, MetricTypeKey, MetricTypeSample},
+		Pressure:  0.5,
+	}, 100)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := queueLimits{
+		MetricTypeGauge:   100,
+		MetricTypeCounter: 100,
+		MetricTypeSample:  50,
+		MetricTypeKey:     66,
+	}
+	if *limits != expect {
+		t.Fatalf("bad limits: %v", *limits)
+	}
+	if limits.admits(MetricTypeSample, 50) || !limits.admits(MetricTypeSample, 49) {
+		t.Fatalf("bad sample admission")
+	}
+	if limits.admits(MetricTypeGauge, 100) || !limits.admits(MetricTypeGauge, 99) {
+		t.Fatalf("bad gauge admission")
+	}
+
+	// Without a priority everything fits
+	var none *queueLimits
+	if !none.admits(MetricTypeSample, 1000) {
+		t.Fatalf("expected admission without limits")
+	}
+
+	// The default pressure applies
+	limits, err = newQueueLimits(DefaultQueuePriority, 100)
+	if err != nil || limits[MetricTypeSample] != 75 || limits[MetricTypeGauge] != 100 {
+		t.Fatalf("bad limits: %v, err: %v", limits, err)
+	}
+
+	for _, p := range []QueuePriority{
+		{Pressure: -0.5},
+		{Pressure: 1.5},
+		{DropOrder: []MetricType{numMetricTypes}},
+	} {
+		if _, err := newQueueLimits(p, 100); err == nil {
+			t.Fatalf("expected error for %+v", p)
+		}
+	}
+}
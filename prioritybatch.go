@@ -0,0 +1,301 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPriorityBatchSize is the number of held emissions from which a
+// PriorityBatchSink passes its batch on before the window ends by default
+const DefaultPriorityBatchSize = 4096
+
+// BatchPriority selects whether a PriorityBatchSink holds an emission for
+// its window or passes it on right away
+type BatchPriority int
+
+const (
+	// BatchNormal holds the emission until the end of the window
+	BatchNormal BatchPriority = iota
+
+	// BatchCritical passes the emission on right away, so the freshest
+	// value reaches the wrapped sink without waiting for the window
+	BatchCritical
+)
+
+// BatchPriorityRule assigns Priority to the emissions whose key, with '.' as
+// the separator, starts with Prefix. A Prefix without a trailing dot only
+// matches whole key segments, so "api" matches "api.requests" but not
+// "apiserver.cache.size". An empty Prefix matches every key.
+type BatchPriorityRule struct {
+	Prefix   string
+	Priority BatchPriority
+}
+
+// PriorityBatchOpts is used to configure a PriorityBatchSink
+type PriorityBatchOpts struct {
+	// Window is how long normal emissions are held before being passed on
+	// together. Required.
+	Window time.Duration
+
+	// Rules assign the priority of emissions. An emission follows the rule
+	// with the longest matching prefix, so e.g. "api" can be critical while
+	// "api.debug" is not. Emissions matching no rule are normal.
+	Rules []BatchPriorityRule
+
+	// MaxBatch is the number of held emissions from which the batch is
+	// passed on right away, bounding the memory held within a window.
+	// Defaults to DefaultPriorityBatchSize.
+	MaxBatch int
+}
+
+// PriorityBatchSink wraps a MetricSink and batches normal emissions into a
+// window, passing them on together once per Window, while the critical
+// emissions selected by its rules are passed on right away. This gets the
+// critical signals, e.g. error counters or health gauges, to the wrapped sink
+// fresh while the bulk of the metrics, such as samples, are delivered in
+// batches, which suits sinks sending a request per flush.
+//
+// Held emissions are passed on in the order they were made, but critical
+// emissions overtake them. Call Shutdown to pass on the held emissions and
+// stop the background flush.
+type PriorityBatchSink struct {
+	sink     MetricSink
+	rules    []BatchPriorityRule
+	maxBatch int
+
+	lock sync.Mutex
+	held []priorityBatched
+
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// priorityBatched is an emission held by a PriorityBatchSink, with the integer
+// value of integer gauges and counters if isInt is set, and the unit of
+// timings if timingUnit is set
+type priorityBatched struct {
+	Emission
+	isInt      bool
+	intVal     int64
+	timingUnit time.Duration
+}
+
+// NewPriorityBatchSink creates a PriorityBatchSink passing emissions to sink,
+// and starts passing on the held ones every opts.Window in the background
+func NewPriorityBatchSink(sink MetricSink, opts PriorityBatchOpts) (*PriorityBatchSink, error) {
+	if opts.Window <= 0 {
+		return nil, fmt.Errorf("invalid batch window %v", opts.Window)
+	}
+	if opts.MaxBatch < 0 {
+		return nil, fmt.Errorf("invalid max batch %d", opts.MaxBatch)
+	}
+	if opts.MaxBatch == 0 {
+		opts.MaxBatch = DefaultPriorityBatchSize
+	}
+	for _, rule := range opts.Rules {
+		if rule.Priority != BatchNormal && rule.Priority != BatchCritical {
+			return nil, fmt.Errorf("invalid priority %d for prefix %q", rule.Priority, rule.Prefix)
+		}
+	}
+	rules := append([]BatchPriorityRule(nil), opts.Rules...)
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].Prefix) > len(rules[j].Prefix) })
+
+	p := &PriorityBatchSink{
+		sink:     sink,
+		rules:    rules,
+		maxBatch: opts.MaxBatch,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	if err := GoSink(func() { p.flushLoop(opts.Window) }); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Shutdown stops the background flush and passes on the held emissions. It
+// is safe to call more than once.
+func (p *PriorityBatchSink) Shutdown() {
+	p.stopOnce.Do(func() { close(p.stopCh) })
+	<-p.doneCh
+	p.Flush()
+}
+
+// Flush passes on the held emissions right away
+func (p *PriorityBatchSink) Flush() {
+	p.lock.Lock()
+	held := p.held
+	p.held = nil
+	p.lock.Unlock()
+
+	for i := range held {
+		p.emit(&held[i])
+	}
+}
+
+// Len returns the number of emissions held for the window
+func (p *PriorityBatchSink) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.held)
+}
+
+func (p *PriorityBatchSink) flushLoop(window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	defer close(p.doneCh)
+
+	for {
+		select {
+		case <-ticker.C:
+			p.Flush()
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+// priority returns the priority of the emissions of key
+func (p *PriorityBatchSink) priority(key []string) BatchPriority {
+	if len(p.rules) == 0 {
+		return BatchNormal
+	}
+	flat := strings.Join(key, ".")
+	for _, rule := range p.rules {
+		if hasNamePrefix(flat, rule.Prefix) {
+			return rule.Priority
+		}
+	}
+	return BatchNormal
+}
+
+// hasNamePrefix returns whether name starts with prefix, which only matches
+// whole segments unless it ends with a '.', as SetDisplayPrefix does
+func hasNamePrefix(name, prefix string) bool {
+	if prefix == "" || strings.HasSuffix(prefix, ".") {
+		return strings.HasPrefix(name, prefix)
+	}
+	return name == prefix || strings.HasPrefix(name, prefix+".")
+}
+
+// add passes a critical emission on, and holds a normal one for the window,
+// passing the batch on if it reaches MaxBatch
+func (p *PriorityBatchSink) add(b priorityBatched) {
+	if p.priority(b.Key) == BatchCritical {
+		p.emit(&b)
+		return
+	}
+	// Copy as the caller may reuse its slices while the emission is held
+	b.Key = append([]string(nil), b.Key...)
+	if b.Labels != nil {
+		b.Labels = append([]Label(nil), b.Labels...)
+	}
+	if b.Buckets != nil {
+		counts := make(map[float64]uint64, len(b.Buckets))
+		for bound, count := range b.Buckets {
+			counts[bound] = count
+		}
+		b.Buckets = counts
+	}
+
+	p.lock.Lock()
+	p.held = append(p.held, b)
+	var full []priorityBatched
+	if len(p.held) >= p.maxBatch {
+		full = p.held
+		p.held = nil
+	}
+	p.lock.Unlock()
+
+	for i := range full {
+		p.emit(&full[i])
+	}
+}
+
+// emit passes an emission on to the wrapped sink
+func (p *PriorityBatchSink) emit(b *priorityBatched) {
+	switch {
+	case b.Reset:
+		resetCounter(p.sink, b.Key, b.Labels)
+	case b.Buckets != nil:
+		observeBuckets(p.sink, b.Key, b.Buckets, b.Labels)
+	case b.Type == MetricTypeGauge && b.isInt:
+		setGaugeInt(p.sink, b.Key, b.intVal, b.Labels)
+	case b.Type == MetricTypeGauge:
+		p.sink.SetGaugeWithLabels(b.Key, b.Value, b.Labels)
+	case b.Type == MetricTypeKey:
+		p.sink.EmitKey(b.Key, b.Value)
+	case b.Type == MetricTypeCounter && b.isInt:
+		incrCounterInt(p.sink, b.Key, b.intVal, b.Labels)
+	case b.Type == MetricTypeCounter:
+		p.sink.IncrCounterWithLabels(b.Key, b.Value, b.Labels)
+	case b.Type == MetricTypeSample && b.timingUnit != 0:
+		addTiming(p.sink, b.Key, b.Value, b.timingUnit, b.Labels)
+	case b.Type == MetricTypeSample:
+		p.sink.AddSampleWithLabels(b.Key, b.Value, b.Labels)
+	}
+}
+
+func (p *PriorityBatchSink) SetGauge(key []string, val float32) {
+	p.SetGaugeWithLabels(key, val, nil)
+}
+
+func (p *PriorityBatchSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	p.add(priorityBatched{Emission: Emission{Type: MetricTypeGauge, Key: key, Value: val, Labels: labels}})
+}
+
+func (p *PriorityBatchSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	p.add(priorityBatched{Emission: Emission{Type: MetricTypeGauge, Key: key, Labels: labels}, isInt: true, intVal: val})
+}
+
+func (p *PriorityBatchSink) EmitKey(key []string, val float32) {
+	p.add(priorityBatched{Emission: Emission{Type: MetricTypeKey, Key: key, Value: val}})
+}
+
+func (p *PriorityBatchSink) IncrCounter(key []string, val float32) {
+	p.IncrCounterWithLabels(key, val, nil)
+}
+
+func (p *PriorityBatchSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	p.add(priorityBatched{Emission: Emission{Type: MetricTypeCounter, Key: key, Value: val, Labels: labels}})
+}
+
+func (p *PriorityBatchSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	p.add(priorityBatched{Emission: Emission{Type: MetricTypeCounter, Key: key, Labels: labels}, isInt: true, intVal: val})
+}
+
+func (p *PriorityBatchSink) ResetCounter(key []string, labels []Label) {
+	p.add(priorityBatched{Emission: Emission{Type: MetricTypeCounter, Key: key, Labels: labels, Reset: true}})
+}
+
+func (p *PriorityBatchSink) AddSample(key []string, val float32) {
+	p.AddSampleWithLabels(key, val, nil)
+}
+
+func (p *PriorityBatchSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	p.add(priorityBatched{Emission: Emission{Type: MetricTypeSample, Key: key, Value: val, Labels: labels}})
+}
+
+func (p *PriorityBatchSink) AddTimingSample(key []string, val float32, unit time.Duration, labels []Label) {
+	p.add(priorityBatched{Emission: Emission{Type: MetricTypeSample, Key: key, Value: val, Labels: labels}, timingUnit: unit})
+}
+
+func (p *PriorityBatchSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	p.add(priorityBatched{Emission: Emission{Type: MetricTypeSample, Key: key, Labels: labels, Buckets: counts}})
+}
+
+func (p *PriorityBatchSink) SetCounterTemporality(key []string, temporality Temporality) {
+	setCounterTemporality(p.sink, key, temporality)
+}
+
+func (p *PriorityBatchSink) SetResourceLabels(names []string) {
+	setResourceLabels(p.sink, names)
+}
+
+func (p *PriorityBatchSink) SetTimestampOffset(offset time.Duration) {
+	setTimestampOffset(p.sink, offset)
+}
@@ -0,0 +1,191 @@
+package metrics
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPriorityBatchSink_Opts(t *testing.T) {
+	for _, opts := range []PriorityBatchOpts{
+		{},
+		{Window: time.Second, MaxBatch: -1},
+		{Window: time.Second, Rules: []BatchPriorityRule{{Prefix: "a", Priority: 7}}},
+	} {
+		if _, err := NewPriorityBatchSink(&MockSink{}, opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
+
+func TestPriorityBatchSink_Critical(t *testing.T) {
+	m := &MockSink{}
+	p, err := NewPriorityBatchSink(m, PriorityBatchOpts{
+		Window: time.Hour,
+		Rules: []BatchPriorityRule{
+			{Prefix: "health", Priority: BatchCritical},
+			{Prefix: "api.errors", Priority: BatchCritical},
+			{Prefix: "api.errors.debug", Priority: BatchNormal},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer p.Shutdown()
+
+	// Critical emissions are passed on right away, others held
+	labels := []Label{{"a", "b"}}
+	p.AddSample([]string{"api", "latency"}, 1)
+	p.SetGauge([]string{"health", "up"}, 1)
+	p.IncrCounterWithLabels([]string{"api", "errors"}, 2, labels)
+	p.IncrCounter([]string{"api", "errors", "debug"}, 3)
+	p.SetGauge([]string{"queue"}, 4)
+	if !reflect.DeepEqual(m.keys, [][]string{{"health", "up"}, {"api", "errors"}}) {
+		t.Fatalf("bad keys: %v", m.keys)
+	}
+	if !reflect.DeepEqual(m.labels[1], labels) || p.Len() != 3 {
+		t.Fatalf("bad labels %v or held %d", m.labels[1], p.Len())
+	}
+
+	// Held emissions are passed on in order, from copies of their keys
+	key := []string{"api", "latency"}
+	p.AddSample(key, 5)
+	key[1] = "changed"
+	p.Flush()
+	expect := [][]string{
+		{"health", "up"},
+		{"api", "errors"},
+		{"api", "latency"},
+		{"api", "errors", "debug"},
+		{"queue"},
+		{"api", "latency"},
+	}
+	if !reflect.DeepEqual(m.keys, expect) {
+		t.Fatalf("bad keys: %v", m.keys)
+	}
+	if !reflect.DeepEqual(m.vals, []float32{1, 2, 1, 3, 4, 5}) {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+}
+
+func TestPriorityBatchSink_MaxBatch(t *testing.T) {
+	m := &intMockSink{}
+	p, err := NewPriorityBatchSink(m, PriorityBatchOpts{Window: time.Hour, MaxBatch: 3})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	p.SetGaugeIntWithLabels([]string{"g"}, 1, nil)
+	p.IncrCounterIntWithLabels([]string{"c"}, 2, nil)
+	if len(m.intKeys) != 0 {
+		t.Fatalf("bad keys: %v", m.intKeys)
+	}
+	p.EmitKey([]string{"k"}, 3)
+	if !reflect.DeepEqual(m.intVals, []int64{1, 2}) || len(m.keys) != 1 || p.Len() != 0 {
+		t.Fatalf("expected a full batch, got %v %v", m.intVals, m.keys)
+	}
+
+	// Shutdown passes on the held emissions
+	p.AddSample([]string{"s"}, 4)
+	p.Shutdown()
+	if !reflect.DeepEqual(m.vals, []float32{3, 4}) {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+
+	// Shutting down again does nothing
+	p.Shutdown()
+	if !reflect.DeepEqual(m.vals, []float32{3, 4}) {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+}
+
+func TestPriorityBatchSink_PrefixSegments(t *testing.T) {
+	m := &MockSink{}
+	p, err := NewPriorityBatchSink(m, PriorityBatchOpts{
+		Window: time.Hour,
+		Rules: []BatchPriorityRule{
+			{Prefix: "api", Priority: BatchCritical},
+			{Prefix: "db.", Priority: BatchCritical},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer p.Shutdown()
+
+	// A prefix without a trailing dot only matches whole segments
+	p.IncrCounter([]string{"api"}, 1)
+	p.IncrCounter([]string{"api", "requests"}, 2)
+	p.SetGauge([]string{"apiserver", "cache", "size"}, 3)
+	p.IncrCounter([]string{"db", "queries"}, 4)
+	p.IncrCounter([]string{"db"}, 5)
+	if !reflect.DeepEqual(m.keys, [][]string{{"api"}, {"api", "requests"}, {"db", "queries"}}) {
+		t.Fatalf("bad keys: %v", m.keys)
+	}
+	if p.Len() != 2 {
+		t.Fatalf("bad held %d", p.Len())
+	}
+}
+
+// lockedSampleSink records samples under a lock, for emissions from the
+// flush goroutine
+type lockedSampleSink struct {
+	BlackholeSink
+	lock sync.Mutex
+	vals []float32
+	at   []time.Time
+}
+
+func (l *lockedSampleSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.vals = append(l.vals, val)
+	l.at = append(l.at, time.Now())
+}
+
+func (l *lockedSampleSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	l.AddSampleWithLabels(key, val, labels)
+}
+
+func TestPriorityBatchSink_Window(t *testing.T) {
+	l := &lockedSampleSink{}
+	const window = 100 * time.Millisecond
+	p, err := NewPriorityBatchSink(l, PriorityBatchOpts{
+		Window: window,
+		Rules:  []BatchPriorityRule{{Prefix: "critical", Priority: BatchCritical}},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer p.Shutdown()
+
+	start := time.Now()
+	p.AddSample([]string{"sample"}, 1)
+	p.AddSample([]string{"sample"}, 2)
+	p.IncrCounter([]string{"critical"}, 3)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		l.lock.Lock()
+		n := len(l.vals)
+		l.lock.Unlock()
+		if n == 3 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !reflect.DeepEqual(l.vals, []float32{3, 1, 2}) {
+		t.Fatalf("bad values: %v", l.vals)
+	}
+	// The critical counter didn't wait, the samples waited for the window
+	if l.at[0].Sub(start) >= window/2 {
+		t.Fatalf("critical emission delayed by %v", l.at[0].Sub(start))
+	}
+	if l.at[1].Sub(start) < window/2 {
+		t.Fatalf("samples flushed after %v", l.at[1].Sub(start))
+	}
+}
@@ -0,0 +1,215 @@
+//go:build go1.9
+// +build go1.9
+
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// OpenMetricsPushOpts is used to configure the OpenMetricsPushSink
+type OpenMetricsPushOpts struct {
+	// Endpoint is the URL the metrics are POSTed to
+	Endpoint string
+
+	// PushInterval is the interval between pushes
+	PushInterval time.Duration
+
+	// PushTimeout bounds each push, so a slow receiver can't stall the push
+	// loop. Defaults to DefaultPrometheusPushTimeout.
+	PushTimeout time.Duration
+
+	// BearerToken, if set, is sent in the Authorization header of every
+	// push. Otherwise Username and Password, if Username is set, are sent as
+	// basic authentication.
+	BearerToken string
+	Username    string
+	Password    string
+
+	// Headers are added to every push, e.g. a tenant ID
+	Headers map[string]string
+
+	// Client is used for the pushes, defaulting to http.DefaultClient
+	Client *http.Client
+
+	// Sink holds the options of the underlying PrometheusSink, such as the
+	// expiration and metric definitions. Its Registerer is ignored, since
+	// the sink only collects metrics for the pushes.
+	Sink PrometheusOpts
+
+	// ErrorLog is used to log push errors. Defaults to a FailureLogger from
+	// metrics.NewFailureLogger.
+	ErrorLog *metrics.FailureLogger
+}
+
+// OpenMetricsPushSink wraps a PrometheusSink and POSTs the current state of
+// its metrics in the OpenMetrics text format to an endpoint on an interval,
+// for OpenMetrics native push receivers. Every push carries all metrics, so
+// a failed push loses nothing and is made up for by the next one. As
+// OpenMetrics requires counter names to end in "_total", counters without
+// the suffix are typed unknown.
+type OpenMetricsPushSink struct {
+	// errors is accessed atomically and kept first to guarantee 64-bit
+	// alignment
+	errors uint64
+
+	*PrometheusSink
+	registry *prometheus.Registry
+	opts     OpenMetricsPushOpts
+	stopChan chan struct{}
+	doneChan chan struct{}
+	stopOnce sync.Once
+}
+
+// NewOpenMetricsPushSink creates an OpenMetricsPushSink using the passed
+// options
+func NewOpenMetricsPushSink(opts OpenMetricsPushOpts) (*OpenMetricsPushSink, error) {
+	if opts.Endpoint == "" {
+		return nil, fmt.Errorf("endpoint is required")
+	}
+	if opts.PushInterval <= 0 {
+		return nil, fmt.Errorf("invalid push interval %s", opts.PushInterval)
+	}
+	if opts.PushTimeout < 0 {
+		return nil, fmt.Errorf("invalid push timeout %s", opts.PushTimeout)
+	}
+	if opts.PushTimeout == 0 {
+		opts.PushTimeout = DefaultPrometheusPushTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.ErrorLog == nil {
+		opts.ErrorLog = metrics.NewFailureLogger()
+	}
+
+	registry := prometheus.NewRegistry()
+	sinkOpts := opts.Sink
+	sinkOpts.Registerer = registry
+	promSink, err := NewPrometheusSinkFrom(sinkOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &OpenMetricsPushSink{
+		PrometheusSink: promSink,
+		registry:       registry,
+		opts:           opts,
+		stopChan:       make(chan struct{}),
+		doneChan:       make(chan struct{}),
+	}
+	if err := metrics.GoSink(sink.flushMetrics); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// Push renders the current metrics and POSTs them to the endpoint
+func (s *OpenMetricsPushSink) Push() error {
+	body, err := s.render()
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.PushTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", s.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", string(expfmt.FmtOpenMetrics))
+	for name, value := range s.opts.Headers {
+		req.Header.Set(name, value)
+	}
+	switch {
+	case s.opts.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+s.opts.BearerToken)
+	case s.opts.Username != "":
+		req.SetBasicAuth(s.opts.Username, s.opts.Password)
+	}
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		atomic.AddUint64(&s.errors, 1)
+		return fmt.Errorf("unexpected status %s pushing to %s", resp.Status, s.opts.Endpoint)
+	}
+	return nil
+}
+
+// render returns the current metrics in the OpenMetrics text format
+func (s *OpenMetricsPushSink) render() ([]byte, error) {
+	families, err := s.registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	enc := expfmt.NewEncoder(buf, expfmt.FmtOpenMetrics)
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.(expfmt.Closer).Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SinkStats returns the number of failed pushes. No metrics are dropped,
+// since every push carries all of them.
+func (s *OpenMetricsPushSink) SinkStats() metrics.SinkStats {
+	return metrics.SinkStats{Errors: atomic.LoadUint64(&s.errors)}
+}
+
+// Shutdown stops the push loop and pushes the metrics a final time. It is
+// safe to call more than once: later calls push nothing.
+func (s *OpenMetricsPushSink) Shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+		<-s.doneChan
+		if err := s.Push(); err != nil {
+			s.opts.ErrorLog.Printf("[ERR] Error pushing OpenMetrics! Err: %s", err)
+		}
+	})
+}
+
+func (s *OpenMetricsPushSink) flushMetrics() {
+	ticker := time.NewTicker(s.opts.PushInterval)
+	defer ticker.Stop()
+	defer close(s.doneChan)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Push(); err != nil {
+				s.opts.ErrorLog.Printf("[ERR] Error pushing OpenMetrics! Err: %s", err)
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
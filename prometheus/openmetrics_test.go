@@ -0,0 +1,163 @@
+package prometheus
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// pushRequest is a push received by a fake OpenMetrics receiver
+type pushRequest struct {
+	contentType   string
+	authorization string
+	tenant        string
+	body          string
+}
+
+func fakeOpenMetricsReceiver(t *testing.T, status int) (*httptest.Server, chan pushRequest) {
+	pushes := make(chan pushRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("bad method %s", r.Method)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		pushes <- pushRequest{
+			contentType:   r.Header.Get("Content-Type"),
+			authorization: r.Header.Get("Authorization"),
+			tenant:        r.Header.Get("X-Tenant"),
+			body:          string(body),
+		}
+		w.WriteHeader(status)
+	}))
+	return server, pushes
+}
+
+func TestOpenMetricsPushSink(t *testing.T) {
+	server, pushes := fakeOpenMetricsReceiver(t, http.StatusNoContent)
+	defer server.Close()
+
+	sink, err := NewOpenMetricsPushSink(OpenMetricsPushOpts{
+		Endpoint:     server.URL,
+		PushInterval: time.Hour,
+		BearerToken:  "secret",
+		Headers:      map[string]string{"X-Tenant": "acme"},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sink.SetGaugeWithLabels([]string{"queue", "depth"}, 42, []metrics.Label{{Name: "queue", Value: "jobs"}})
+	sink.IncrCounter([]string{"requests", "total"}, 3)
+	sink.IncrCounter([]string{"retries"}, 1)
+
+	if err := sink.Push(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	push := <-pushes
+	if !strings.HasPrefix(push.contentType, "application/openmetrics-text") {
+		t.Fatalf("bad content type %q", push.contentType)
+	}
+	if push.authorization != "Bearer secret" || push.tenant != "acme" {
+		t.Fatalf("bad headers: %+v", push)
+	}
+	for _, line := range []string{
+		"# TYPE queue_depth gauge",
+		`queue_depth{queue="jobs"} 42.0`,
+		"# TYPE requests counter",
+		"requests_total 3.0",
+		"# TYPE retries unknown",
+		"retries 1.0",
+	} {
+		if !strings.Contains(push.body, line+"\n") {
+			t.Fatalf("missing %q in payload:\n%s", line, push.body)
+		}
+	}
+	if !strings.HasSuffix(push.body, "# EOF\n") {
+		t.Fatalf("payload not terminated:\n%s", push.body)
+	}
+
+	// Shutdown pushes a final time
+	sink.Shutdown()
+	select {
+	case <-pushes:
+	case <-time.After(time.Second):
+		t.Fatalf("no final push")
+	}
+
+	// Shutting down again pushes nothing more
+	sink.Shutdown()
+	select {
+	case <-pushes:
+		t.Fatalf("unexpected push")
+	default:
+	}
+	if stats := sink.SinkStats(); stats.Errors != 0 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+}
+
+func TestOpenMetricsPushSink_BasicAuthAndErrors(t *testing.T) {
+	server, pushes := fakeOpenMetricsReceiver(t, http.StatusUnauthorized)
+	defer server.Close()
+
+	sink, err := NewOpenMetricsPushSink(OpenMetricsPushOpts{
+		Endpoint:     server.URL,
+		PushInterval: time.Hour,
+		Username:     "user",
+		Password:     "pass",
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sink.Shutdown()
+
+	if err := sink.Push(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected status error, got %v", err)
+	}
+	if push := <-pushes; push.authorization != "Basic dXNlcjpwYXNz" {
+		t.Fatalf("bad authorization %q", push.authorization)
+	}
+	if stats := sink.SinkStats(); stats.Errors != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+}
+
+func TestOpenMetricsPushSink_Interval(t *testing.T) {
+	server, pushes := fakeOpenMetricsReceiver(t, http.StatusOK)
+	defer server.Close()
+
+	sink, err := NewOpenMetricsPushSink(OpenMetricsPushOpts{
+		Endpoint:     server.URL,
+		PushInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sink.Shutdown()
+	sink.SetGauge([]string{"up"}, 1)
+
+	select {
+	case push := <-pushes:
+		if !strings.HasSuffix(push.body, "# EOF\n") {
+			t.Fatalf("bad payload:\n%s", push.body)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no push within the interval")
+	}
+}
+
+func TestNewOpenMetricsPushSink_Invalid(t *testing.T) {
+	for _, opts := range []OpenMetricsPushOpts{
+		{PushInterval: time.Second},
+		{Endpoint: "http://localhost:1"},
+		{Endpoint: "http://localhost:1", PushInterval: time.Second, PushTimeout: -time.Second},
+	} {
+		if _, err := NewOpenMetricsPushSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
@@ -5,6 +5,7 @@ package prometheus
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"regexp"
 	"strings"
 	"sync"
@@ -48,15 +49,57 @@ type PrometheusOpts struct {
 	GaugeDefinitions   []GaugeDefinition
 	SummaryDefinitions []SummaryDefinition
 	CounterDefinitions []CounterDefinition
+
+	// ExternalCounters lists keys whose SetGauge values are cumulative totals
+	// computed elsewhere, e.g. read from another process. These are exposed
+	// as counters rather than gauges: each value increments the counter by
+	// its difference to the previous value of the same series, and a value
+	// lower than the previous one is treated as a reset of the source, so the
+	// counter is incremented by the whole value.
+	ExternalCounters [][]string
+
+	// HistogramBuckets, if set, exposes samples as histograms with these
+	// increasing upper bounds rather than as summaries, e.g. the bounds of
+	// metrics.BucketScheme(metrics.BucketsLatencyMs). Unlike the quantiles of
+	// summaries, histograms can be aggregated across instances. Samples
+	// declared in SummaryDefinitions stay summaries.
+	HistogramBuckets []float64
+
+	// UnitSuffixes appends to the names of metrics the suffix of their unit,
+	// e.g. _seconds or _bytes, and to the names of counters _total, following
+	// the Prometheus naming conventions. Units are those of the definitions
+	// above and of UnitDefinitions. Names already ending with their suffixes
+	// are left as they are. Off by default, so names don't change.
+	UnitSuffixes bool
+
+	// UnitDefinitions declare the units of metrics which aren't declared in
+	// the definitions above
+	UnitDefinitions []UnitDefinition
 }
 
 type PrometheusSink struct {
 	// If these will ever be copied, they should be converted to *sync.Map values and initialized appropriately
 	gauges     sync.Map
 	summaries  sync.Map
+	histograms sync.Map
 	counters   sync.Map
 	expiration time.Duration
 	help       map[string]string
+
+	// histogramBuckets are the bounds of the histograms samples are exposed
+	// as, or nil to expose them as summaries
+	histogramBuckets []float64
+
+	// unitSuffixes is set if names get the suffixes of units, held by the
+	// flattened key of their metric in units
+	unitSuffixes bool
+	units        map[string]string
+
+	// externalCounters holds the flattened ExternalCounters keys, and
+	// externalLock serializes their updates so deltas are computed against
+	// the right previous value
+	externalCounters map[string]struct{}
+	externalLock     sync.Mutex
 }
 
 // GaugeDefinition can be provided to PrometheusOpts to declare a constant gauge that is not deleted on expiry.
@@ -64,6 +107,7 @@ type GaugeDefinition struct {
 	Name        []string
 	ConstLabels []metrics.Label
 	Help        string
+	Unit        string
 }
 
 type gauge struct {
@@ -78,6 +122,7 @@ type SummaryDefinition struct {
 	Name        []string
 	ConstLabels []metrics.Label
 	Help        string
+	Unit        string
 }
 
 type summary struct {
@@ -86,17 +131,31 @@ type summary struct {
 	canDelete bool
 }
 
+type histogram struct {
+	prometheus.Histogram
+	updatedAt time.Time
+}
+
 // CounterDefinition can be provided to PrometheusOpts to declare a constant counter that is not deleted on expiry.
 type CounterDefinition struct {
 	Name        []string
 	ConstLabels []metrics.Label
 	Help        string
+	Unit        string
+}
+
+// UnitDefinition can be provided to PrometheusOpts to declare the unit of a metric, e.g. "seconds" or "bytes".
+type UnitDefinition struct {
+	Name []string
+	Unit string
 }
 
 type counter struct {
 	prometheus.Counter
 	updatedAt time.Time
 	canDelete bool
+	// last is the previous value of an external counter
+	last float64
 }
 
 // NewPrometheusSink creates a new PrometheusSink using the default options.
@@ -112,11 +171,41 @@ func NewPrometheusSinkFrom(opts PrometheusOpts) (*PrometheusSink, error) {
 		counters:   sync.Map{},
 		expiration: opts.Expiration,
 		help:       make(map[string]string),
+
+		externalCounters: make(map[string]struct{}),
+
+		unitSuffixes: opts.UnitSuffixes,
+		units:        make(map[string]string),
+	}
+	for i, bound := range opts.HistogramBuckets {
+		if i > 0 && !(bound > opts.HistogramBuckets[i-1]) {
+			return nil, fmt.Errorf("histogram buckets are not increasing: %v after %v", bound, opts.HistogramBuckets[i-1])
+		}
+	}
+	if len(opts.HistogramBuckets) > 0 {
+		sink.histogramBuckets = append([]float64(nil), opts.HistogramBuckets...)
+	}
+	for _, name := range opts.ExternalCounters {
+		key, _ := flattenKey(name, nil)
+		sink.externalCounters[key] = struct{}{}
 	}
 
-	initGauges(&sink.gauges, opts.GaugeDefinitions, sink.help)
-	initSummaries(&sink.summaries, opts.SummaryDefinitions, sink.help)
-	initCounters(&sink.counters, opts.CounterDefinitions, sink.help)
+	for _, u := range opts.UnitDefinitions {
+		sink.setUnit(u.Name, u.Unit)
+	}
+	for _, g := range opts.GaugeDefinitions {
+		sink.setUnit(g.Name, g.Unit)
+	}
+	for _, s := range opts.SummaryDefinitions {
+		sink.setUnit(s.Name, s.Unit)
+	}
+	for _, c := range opts.CounterDefinitions {
+		sink.setUnit(c.Name, c.Unit)
+	}
+
+	initGauges(&sink.gauges, opts.GaugeDefinitions, sink.help, sink.unitName)
+	initSummaries(&sink.summaries, opts.SummaryDefinitions, sink.help, sink.unitName)
+	initCounters(&sink.counters, opts.CounterDefinitions, sink.help, sink.counterName)
 
 	reg := opts.Registerer
 	if reg == nil {
@@ -174,6 +263,15 @@ func (p *PrometheusSink) collectAtTime(c chan<- prometheus.Metric, t time.Time)
 		s.Collect(c)
 		return true
 	})
+	p.histograms.Range(func(k, v interface{}) bool {
+		h := v.(*histogram)
+		if expire && h.updatedAt.Add(p.expiration).Before(t) {
+			p.histograms.Delete(k)
+			return true
+		}
+		h.Collect(c)
+		return true
+	})
 	p.counters.Range(func(k, v interface{}) bool {
 		if v == nil {
 			return true
@@ -191,12 +289,12 @@ func (p *PrometheusSink) collectAtTime(c chan<- prometheus.Metric, t time.Time)
 	})
 }
 
-func initGauges(m *sync.Map, gauges []GaugeDefinition, help map[string]string) {
+func initGauges(m *sync.Map, gauges []GaugeDefinition, help map[string]string, name func(string) string) {
 	for _, g := range gauges {
 		key, hash := flattenKey(g.Name, g.ConstLabels)
 		help[fmt.Sprintf("gauge.%s", key)] = g.Help
 		pG := prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        key,
+			Name:        name(key),
 			Help:        g.Help,
 			ConstLabels: prometheusLabels(g.ConstLabels),
 		})
@@ -205,12 +303,12 @@ func initGauges(m *sync.Map, gauges []GaugeDefinition, help map[string]string) {
 	return
 }
 
-func initSummaries(m *sync.Map, summaries []SummaryDefinition, help map[string]string) {
+func initSummaries(m *sync.Map, summaries []SummaryDefinition, help map[string]string, name func(string) string) {
 	for _, s := range summaries {
 		key, hash := flattenKey(s.Name, s.ConstLabels)
 		help[fmt.Sprintf("summary.%s", key)] = s.Help
 		pS := prometheus.NewSummary(prometheus.SummaryOpts{
-			Name:        key,
+			Name:        name(key),
 			Help:        s.Help,
 			MaxAge:      10 * time.Second,
 			ConstLabels: prometheusLabels(s.ConstLabels),
@@ -221,12 +319,12 @@ func initSummaries(m *sync.Map, summaries []SummaryDefinition, help map[string]s
 	return
 }
 
-func initCounters(m *sync.Map, counters []CounterDefinition, help map[string]string) {
+func initCounters(m *sync.Map, counters []CounterDefinition, help map[string]string, name func(string) string) {
 	for _, c := range counters {
 		key, hash := flattenKey(c.Name, c.ConstLabels)
 		help[fmt.Sprintf("counter.%s", key)] = c.Help
 		pC := prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        key,
+			Name:        name(key),
 			Help:        c.Help,
 			ConstLabels: prometheusLabels(c.ConstLabels),
 		})
@@ -235,6 +333,40 @@ func initCounters(m *sync.Map, counters []CounterDefinition, help map[string]str
 	return
 }
 
+// setUnit records unit as the unit of the metric name
+func (p *PrometheusSink) setUnit(name []string, unit string) {
+	if unit != "" {
+		key, _ := flattenKey(name, nil)
+		p.units[key] = unit
+	}
+}
+
+// unitName returns the name the metric of key is exposed under, with the
+// suffix of its unit if UnitSuffixes is set
+func (p *PrometheusSink) unitName(key string) string {
+	if !p.unitSuffixes {
+		return key
+	}
+	if unit := p.units[key]; unit != "" && !strings.HasSuffix(key, "_"+unit) {
+		key += "_" + unit
+	}
+	return key
+}
+
+// counterName returns the name the counter of key is exposed under, with the
+// suffix of its unit followed by _total if UnitSuffixes is set
+func (p *PrometheusSink) counterName(key string) string {
+	if !p.unitSuffixes {
+		return key
+	}
+	unit := p.units[key]
+	key = strings.TrimSuffix(key, "_total")
+	if unit != "" && !strings.HasSuffix(key, "_"+unit) {
+		key += "_" + unit
+	}
+	return key + "_total"
+}
+
 var forbiddenChars = regexp.MustCompile("[ .=\\-/]")
 
 func flattenKey(parts []string, labels []metrics.Label) (string, string) {
@@ -262,7 +394,21 @@ func (p *PrometheusSink) SetGauge(parts []string, val float32) {
 }
 
 func (p *PrometheusSink) SetGaugeWithLabels(parts []string, val float32, labels []metrics.Label) {
+	p.setGauge(parts, float64(val), labels)
+}
+
+// SetGaugeIntWithLabels sets a gauge to an integer, which is kept exact up to
+// 2^53 rather than rounded to a float32, e.g. for Unix timestamps.
+func (p *PrometheusSink) SetGaugeIntWithLabels(parts []string, val int64, labels []metrics.Label) {
+	p.setGauge(parts, float64(val), labels)
+}
+
+func (p *PrometheusSink) setGauge(parts []string, val float64, labels []metrics.Label) {
 	key, hash := flattenKey(parts, labels)
+	if _, ok := p.externalCounters[key]; ok {
+		p.setExternalCounter(key, hash, val, labels)
+		return
+	}
 	pg, ok := p.gauges.Load(hash)
 
 	// The sync.Map underlying gauges stores pointers to our structs. If we need to make updates,
@@ -273,7 +419,7 @@ func (p *PrometheusSink) SetGaugeWithLabels(parts []string, val float32, labels
 	// value, but since we're always setting it to time.Now(), it doesn't really matter.
 	if ok {
 		localGauge := *pg.(*gauge)
-		localGauge.Set(float64(val))
+		localGauge.Set(val)
 		localGauge.updatedAt = time.Now()
 		p.gauges.Store(hash, &localGauge)
 
@@ -285,11 +431,11 @@ func (p *PrometheusSink) SetGaugeWithLabels(parts []string, val float32, labels
 			help = existingHelp
 		}
 		g := prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        key,
+			Name:        p.unitName(key),
 			Help:        help,
 			ConstLabels: prometheusLabels(labels),
 		})
-		g.Set(float64(val))
+		g.Set(val)
 		pg = &gauge{
 			Gauge:     g,
 			updatedAt: time.Now(),
@@ -299,12 +445,62 @@ func (p *PrometheusSink) SetGaugeWithLabels(parts []string, val float32, labels
 	}
 }
 
+// setExternalCounter increments the counter of an external cumulative total by
+// its change since the previous value, treating a decrease as a reset.
+// Counters can't go down, so negative totals are ignored.
+func (p *PrometheusSink) setExternalCounter(key, hash string, total float64, labels []metrics.Label) {
+	if !(total >= 0) {
+		return
+	}
+
+	p.externalLock.Lock()
+	defer p.externalLock.Unlock()
+
+	pc, ok := p.counters.Load(hash)
+	if ok {
+		localCounter := *pc.(*counter)
+		delta := total - localCounter.last
+		if delta < 0 {
+			// The source was reset, so it counted up from zero again
+			delta = total
+		}
+		localCounter.Add(delta)
+		localCounter.last = total
+		localCounter.updatedAt = time.Now()
+		p.counters.Store(hash, &localCounter)
+
+		// The counter does not exist yet, create it and allow it to be deleted
+	} else {
+		help := key
+		existingHelp, ok := p.help[fmt.Sprintf("counter.%s", key)]
+		if ok {
+			help = existingHelp
+		}
+		c := prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        p.counterName(key),
+			Help:        help,
+			ConstLabels: prometheusLabels(labels),
+		})
+		c.Add(total)
+		pc = &counter{
+			Counter:   c,
+			updatedAt: time.Now(),
+			canDelete: true,
+			last:      total,
+		}
+		p.counters.Store(hash, pc)
+	}
+}
+
 func (p *PrometheusSink) AddSample(parts []string, val float32) {
 	p.AddSampleWithLabels(parts, val, nil)
 }
 
 func (p *PrometheusSink) AddSampleWithLabels(parts []string, val float32, labels []metrics.Label) {
 	key, hash := flattenKey(parts, labels)
+	if p.histogramBuckets != nil && p.observeHistogram(key, hash, float64(val), labels) {
+		return
+	}
 	ps, ok := p.summaries.Load(hash)
 
 	// Does the summary already exist for this sample type?
@@ -322,7 +518,7 @@ func (p *PrometheusSink) AddSampleWithLabels(parts []string, val float32, labels
 			help = existingHelp
 		}
 		s := prometheus.NewSummary(prometheus.SummaryOpts{
-			Name:        key,
+			Name:        p.unitName(key),
 			Help:        help,
 			MaxAge:      10 * time.Second,
 			ConstLabels: prometheusLabels(labels),
@@ -338,6 +534,31 @@ func (p *PrometheusSink) AddSampleWithLabels(parts []string, val float32, labels
 	}
 }
 
+// observeHistogram adds a sample to its histogram, creating it if needed,
+// unless the sample was declared as a summary, returning whether it did
+func (p *PrometheusSink) observeHistogram(key, hash string, val float64, labels []metrics.Label) bool {
+	if ph, ok := p.histograms.Load(hash); ok {
+		localHistogram := *ph.(*histogram)
+		localHistogram.Observe(val)
+		localHistogram.updatedAt = time.Now()
+		p.histograms.Store(hash, &localHistogram)
+		return true
+	}
+	if _, ok := p.summaries.Load(hash); ok {
+		return false
+	}
+
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:        p.unitName(key),
+		Help:        key,
+		ConstLabels: prometheusLabels(labels),
+		Buckets:     p.histogramBuckets,
+	})
+	h.Observe(val)
+	p.histograms.Store(hash, &histogram{Histogram: h, updatedAt: time.Now()})
+	return true
+}
+
 // EmitKey is not implemented. Prometheus doesn’t offer a type for which an
 // arbitrary number of values is retained, as Prometheus works with a pull
 // model, rather than a push model.
@@ -349,13 +570,22 @@ func (p *PrometheusSink) IncrCounter(parts []string, val float32) {
 }
 
 func (p *PrometheusSink) IncrCounterWithLabels(parts []string, val float32, labels []metrics.Label) {
+	p.incrCounter(parts, float64(val), labels)
+}
+
+// IncrCounterIntWithLabels increments a counter by an integer
+func (p *PrometheusSink) IncrCounterIntWithLabels(parts []string, val int64, labels []metrics.Label) {
+	p.incrCounter(parts, float64(val), labels)
+}
+
+func (p *PrometheusSink) incrCounter(parts []string, val float64, labels []metrics.Label) {
 	key, hash := flattenKey(parts, labels)
 	pc, ok := p.counters.Load(hash)
 
 	// Does the counter exist?
 	if ok {
 		localCounter := *pc.(*counter)
-		localCounter.Add(float64(val))
+		localCounter.Add(val)
 		localCounter.updatedAt = time.Now()
 		p.counters.Store(hash, &localCounter)
 
@@ -367,11 +597,11 @@ func (p *PrometheusSink) IncrCounterWithLabels(parts []string, val float32, labe
 			help = existingHelp
 		}
 		c := prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        key,
+			Name:        p.counterName(key),
 			Help:        help,
 			ConstLabels: prometheusLabels(labels),
 		})
-		c.Add(float64(val))
+		c.Add(val)
 		pc = &counter{
 			Counter:   c,
 			updatedAt: time.Now(),
@@ -381,6 +611,51 @@ func (p *PrometheusSink) IncrCounterWithLabels(parts []string, val float32, labe
 	}
 }
 
+// ResetCounter replaces the counter with a new one starting at zero, so
+// Prometheus sees its value drop and handles it as a counter reset. Unknown
+// counters are ignored.
+func (p *PrometheusSink) ResetCounter(parts []string, labels []metrics.Label) {
+	key, hash := flattenKey(parts, labels)
+
+	p.externalLock.Lock()
+	defer p.externalLock.Unlock()
+
+	pc, ok := p.counters.Load(hash)
+	if !ok {
+		return
+	}
+	help := key
+	existingHelp, ok := p.help[fmt.Sprintf("counter.%s", key)]
+	if ok {
+		help = existingHelp
+	}
+	p.counters.Store(hash, &counter{
+		Counter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        p.counterName(key),
+			Help:        help,
+			ConstLabels: prometheusLabels(labels),
+		}),
+		updatedAt: time.Now(),
+		canDelete: pc.(*counter).canDelete,
+	})
+}
+
+// DefaultPrometheusPushTimeout is the default bound of the duration of each push
+// of a PrometheusPushSink.
+const DefaultPrometheusPushTimeout = 10 * time.Second
+
+// PrometheusPushOpts is used to configure the PrometheusPushSink
+type PrometheusPushOpts struct {
+	// PushInterval is the interval between pushes to the gateway
+	PushInterval time.Duration
+
+	// PushTimeout bounds each push to the gateway, so a slow gateway can't
+	// stall the push loop. A push still running at the deadline is cancelled
+	// and the metrics are pushed again on the next interval. Defaults to
+	// DefaultPrometheusPushTimeout.
+	PushTimeout time.Duration
+}
+
 // PrometheusPushSink wraps a normal prometheus sink and provides an address and facilities to export it to an address
 // on an interval.
 type PrometheusPushSink struct {
@@ -393,6 +668,22 @@ type PrometheusPushSink struct {
 
 // NewPrometheusPushSink creates a PrometheusPushSink by taking an address, interval, and destination name.
 func NewPrometheusPushSink(address string, pushInterval time.Duration, name string) (*PrometheusPushSink, error) {
+	return NewPrometheusPushSinkFrom(address, name, PrometheusPushOpts{PushInterval: pushInterval})
+}
+
+// NewPrometheusPushSinkFrom creates a PrometheusPushSink pushing to the gateway at address under the destination name,
+// using the passed options.
+func NewPrometheusPushSinkFrom(address, name string, opts PrometheusPushOpts) (*PrometheusPushSink, error) {
+	if opts.PushInterval <= 0 {
+		return nil, fmt.Errorf("invalid push interval %s", opts.PushInterval)
+	}
+	if opts.PushTimeout < 0 {
+		return nil, fmt.Errorf("invalid push timeout %s", opts.PushTimeout)
+	}
+	if opts.PushTimeout == 0 {
+		opts.PushTimeout = DefaultPrometheusPushTimeout
+	}
+
 	promSink := &PrometheusSink{
 		gauges:     sync.Map{},
 		summaries:  sync.Map{},
@@ -400,37 +691,40 @@ func NewPrometheusPushSink(address string, pushInterval time.Duration, name stri
 		expiration: 60 * time.Second,
 	}
 
-	pusher := push.New(address, name).Collector(promSink)
+	// The client timeout cancels the request of a push at the deadline
+	pusher := push.New(address, name).
+		Collector(promSink).
+		Client(&http.Client{Timeout: opts.PushTimeout})
 
 	sink := &PrometheusPushSink{
 		promSink,
 		pusher,
 		address,
-		pushInterval,
+		opts.PushInterval,
 		make(chan struct{}),
 	}
 
-	sink.flushMetrics()
+	if err := metrics.GoSink(sink.flushMetrics); err != nil {
+		return nil, err
+	}
 	return sink, nil
 }
 
 func (s *PrometheusPushSink) flushMetrics() {
 	ticker := time.NewTicker(s.pushInterval)
-
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				err := s.pusher.Push()
-				if err != nil {
-					log.Printf("[ERR] Error pushing to Prometheus! Err: %s", err)
-				}
-			case <-s.stopChan:
-				ticker.Stop()
-				return
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := s.pusher.Push()
+			if err != nil {
+				log.Printf("[ERR] Error pushing to Prometheus! Err: %s", err)
 			}
+		case <-s.stopChan:
+			return
 		}
-	}()
+	}
 }
 
 func (s *PrometheusPushSink) Shutdown() {
@@ -242,6 +242,55 @@ func TestSetGauge(t *testing.T) {
 	}
 }
 
+func TestPushTimeout(t *testing.T) {
+	cancelled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A gateway which hangs until the push gives up
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewPrometheusPushSinkFrom(u.Host, "pushtest", PrometheusPushOpts{
+		PushInterval: time.Hour,
+		PushTimeout:  50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	defer sink.Shutdown()
+
+	start := time.Now()
+	if err := sink.pusher.Push(); err == nil {
+		t.Fatalf("expected the push to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("push was not cancelled at the deadline, took %s", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("gateway request was not cancelled")
+	}
+}
+
+func TestNewPrometheusPushSinkFrom_Invalid(t *testing.T) {
+	if _, err := NewPrometheusPushSinkFrom("localhost:9091", "pushtest", PrometheusPushOpts{}); err == nil {
+		t.Fatalf("expected error for a zero push interval")
+	}
+	opts := PrometheusPushOpts{PushInterval: time.Second, PushTimeout: -time.Second}
+	if _, err := NewPrometheusPushSinkFrom("localhost:9091", "pushtest", opts); err == nil {
+		t.Fatalf("expected error for a negative push timeout")
+	}
+}
+
 func TestDefinitionsWithLabels(t *testing.T) {
 	gaugeDef := GaugeDefinition{
 		Name: []string{"my", "test", "gauge"},
@@ -305,3 +354,282 @@ func TestDefinitionsWithLabels(t *testing.T) {
 		return true
 	})
 }
+
+func TestExternalCounters(t *testing.T) {
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer:       prometheus.NewRegistry(),
+		ExternalCounters: [][]string{{"upstream", "requests"}},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	counterValue := func(labels []metrics.Label) float64 {
+		_, hash := flattenKey([]string{"upstream", "requests"}, labels)
+		v, ok := sink.counters.Load(hash)
+		if !ok {
+			t.Fatalf("expected counter for %s", hash)
+		}
+		var pb dto.Metric
+		if err := v.(*counter).Write(&pb); err != nil {
+			t.Fatalf("unexpected error reading metric: %s", err)
+		}
+		return *pb.Counter.Value
+	}
+
+	for _, tc := range []struct {
+		desc   string
+		total  float32
+		expect float64
+	}{
+		{"first value counts from zero", 10, 10},
+		{"increase adds the difference", 25, 25},
+		{"same value adds nothing", 25, 25},
+		{"decrease is treated as a reset", 5, 30},
+		{"counts on after the reset", 8, 33},
+		{"negative values are ignored", -1, 33},
+		{"reset to zero adds nothing", 0, 33},
+		{"counts on from zero", 4, 37},
+	} {
+		sink.SetGauge([]string{"upstream", "requests"}, tc.total)
+		if v := counterValue(nil); v != tc.expect {
+			t.Fatalf("%s: expected counter %v, got %v", tc.desc, tc.expect, v)
+		}
+	}
+
+	// Series with different labels track their previous values separately
+	labels := []metrics.Label{{Name: "shard", Value: "a"}}
+	sink.SetGaugeWithLabels([]string{"upstream", "requests"}, 3, labels)
+	if v := counterValue(labels); v != 3 {
+		t.Fatalf("expected labelled counter 3, got %v", v)
+	}
+	if v := counterValue(nil); v != 37 {
+		t.Fatalf("expected counter 37, got %v", v)
+	}
+
+	// Keys which aren't external counters are still gauges
+	sink.SetGauge([]string{"upstream", "latency"}, 3)
+	if _, ok := sink.gauges.Load("upstream_latency"); !ok {
+		t.Fatalf("expected gauge for upstream_latency")
+	}
+	if _, ok := sink.gauges.Load("upstream_requests"); ok {
+		t.Fatalf("external counter should not be a gauge")
+	}
+}
+
+func TestResetCounter(t *testing.T) {
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer:       prometheus.NewRegistry(),
+		ExternalCounters: [][]string{{"upstream", "requests"}},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	counterValue := func(parts []string) (float64, *counter) {
+		_, hash := flattenKey(parts, nil)
+		v, ok := sink.counters.Load(hash)
+		if !ok {
+			t.Fatalf("expected counter for %s", hash)
+		}
+		var pb dto.Metric
+		if err := v.(*counter).Write(&pb); err != nil {
+			t.Fatalf("unexpected error reading metric: %s", err)
+		}
+		return *pb.Counter.Value, v.(*counter)
+	}
+
+	// Unknown counters aren't created by a reset
+	sink.ResetCounter([]string{"missing"}, nil)
+	if _, ok := sink.counters.Load("missing"); ok {
+		t.Fatalf("reset should not create a counter")
+	}
+
+	key := []string{"jobs", "done"}
+	sink.IncrCounter(key, 5)
+	sink.ResetCounter(key, nil)
+	if v, c := counterValue(key); v != 0 || !c.canDelete {
+		t.Fatalf("expected reset deletable counter, got %v %v", v, c.canDelete)
+	}
+	sink.IncrCounter(key, 2)
+	if v, _ := counterValue(key); v != 2 {
+		t.Fatalf("expected counter 2, got %v", v)
+	}
+
+	// External counters count the next total from zero
+	ext := []string{"upstream", "requests"}
+	sink.SetGauge(ext, 10)
+	sink.ResetCounter(ext, nil)
+	sink.SetGauge(ext, 12)
+	if v, _ := counterValue(ext); v != 12 {
+		t.Fatalf("expected external counter 12, got %v", v)
+	}
+}
+
+func TestIntegerValues(t *testing.T) {
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: prometheus.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	// Unix timestamps don't fit the precision of a float32
+	key := []string{"process", "start_time_seconds"}
+	sink.SetGaugeIntWithLabels(key, 1700000001, nil)
+	_, hash := flattenKey(key, nil)
+	v, ok := sink.gauges.Load(hash)
+	if !ok {
+		t.Fatalf("expected gauge for %s", hash)
+	}
+	var pb dto.Metric
+	if err := v.(*gauge).Write(&pb); err != nil {
+		t.Fatalf("unexpected error reading metric: %s", err)
+	}
+	if got := *pb.Gauge.Value; got != 1700000001 {
+		t.Fatalf("expected exact gauge, got %f", got)
+	}
+
+	key = []string{"bytes", "total"}
+	sink.IncrCounterIntWithLabels(key, 1<<40+1, nil)
+	_, hash = flattenKey(key, nil)
+	v, ok = sink.counters.Load(hash)
+	if !ok {
+		t.Fatalf("expected counter for %s", hash)
+	}
+	if err := v.(*counter).Write(&pb); err != nil {
+		t.Fatalf("unexpected error reading metric: %s", err)
+	}
+	if got := *pb.Counter.Value; got != 1<<40+1 {
+		t.Fatalf("expected exact counter, got %f", got)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	if _, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer:       prometheus.NewRegistry(),
+		HistogramBuckets: []float64{10, 5},
+	}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	bounds, err := metrics.BucketScheme(metrics.BucketsLatencyMs)
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer:         prometheus.NewRegistry(),
+		HistogramBuckets:   bounds,
+		SummaryDefinitions: []SummaryDefinition{{Name: []string{"declared"}, Help: "declared summary"}},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	for _, v := range []float32{0.2, 3, 4, 20000} {
+		sink.AddSample([]string{"latency"}, v)
+	}
+	sink.AddSample([]string{"declared"}, 1)
+
+	v, ok := sink.histograms.Load("latency")
+	if !ok {
+		t.Fatalf("expected histogram for latency")
+	}
+	var pb dto.Metric
+	if err := v.(*histogram).Write(&pb); err != nil {
+		t.Fatalf("unexpected error reading metric: %s", err)
+	}
+	if pb.Histogram.GetSampleCount() != 4 || len(pb.Histogram.Bucket) != len(bounds) {
+		t.Fatalf("bad histogram: %v", pb.Histogram)
+	}
+	cumulative := make(map[float64]uint64)
+	for _, b := range pb.Histogram.Bucket {
+		cumulative[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	if cumulative[0.5] != 1 || cumulative[2.5] != 1 || cumulative[5] != 3 || cumulative[10000] != 3 {
+		t.Fatalf("bad buckets: %v", cumulative)
+	}
+
+	// Declared summaries stay summaries
+	if _, ok := sink.histograms.Load("declared"); ok {
+		t.Fatalf("declared summary should not be a histogram")
+	}
+	if _, ok := sink.summaries.Load("latency"); ok {
+		t.Fatalf("histogram should not be a summary")
+	}
+}
+
+// gatheredNames returns the sorted names of the metric families of reg
+func gatheredNames(t *testing.T, reg *prometheus.Registry) []string {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	var names []string
+	for _, f := range families {
+		names = append(names, f.GetName())
+	}
+	return names
+}
+
+func TestUnitSuffixes(t *testing.T) {
+	opts := PrometheusOpts{
+		UnitDefinitions: []UnitDefinition{
+			{Name: []string{"request", "duration"}, Unit: "seconds"},
+			{Name: []string{"sent"}, Unit: "bytes"},
+			{Name: []string{"received_bytes_total"}, Unit: "bytes"},
+		},
+		GaugeDefinitions: []GaugeDefinition{{Name: []string{"heap"}, Help: "heap size", Unit: "bytes"}},
+	}
+	emit := func(sink *PrometheusSink) {
+		sink.AddSample([]string{"request", "duration"}, 0.5)
+		sink.IncrCounter([]string{"sent"}, 100)
+		sink.IncrCounter([]string{"received_bytes_total"}, 100)
+		sink.IncrCounter([]string{"requests"}, 1)
+		sink.SetGauge([]string{"queue", "length"}, 3)
+	}
+
+	// Names are unchanged by default
+	reg := prometheus.NewRegistry()
+	opts.Registerer = reg
+	sink, err := NewPrometheusSinkFrom(opts)
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	emit(sink)
+	expect := []string{"heap", "queue_length", "received_bytes_total", "request_duration", "requests", "sent"}
+	if names := gatheredNames(t, reg); !reflect.DeepEqual(names, expect) {
+		t.Fatalf("bad names: %v", names)
+	}
+
+	reg = prometheus.NewRegistry()
+	opts.Registerer = reg
+	opts.UnitSuffixes = true
+	sink, err = NewPrometheusSinkFrom(opts)
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	emit(sink)
+	expect = []string{"heap_bytes", "queue_length", "received_bytes_total", "request_duration_seconds", "requests_total", "sent_bytes_total"}
+	if names := gatheredNames(t, reg); !reflect.DeepEqual(names, expect) {
+		t.Fatalf("bad names: %v", names)
+	}
+
+	// Series are still found by their unsuffixed keys
+	sink.IncrCounter([]string{"sent"}, 50)
+	sink.ResetCounter([]string{"requests"}, nil)
+	v, ok := sink.counters.Load("sent")
+	if !ok {
+		t.Fatalf("expected counter for sent")
+	}
+	var pb dto.Metric
+	if err := v.(*counter).Write(&pb); err != nil {
+		t.Fatalf("unexpected error reading metric: %s", err)
+	}
+	if pb.Counter.GetValue() != 150 {
+		t.Fatalf("bad value: %v", pb.Counter.GetValue())
+	}
+	if names := gatheredNames(t, reg); !reflect.DeepEqual(names, expect) {
+		t.Fatalf("bad names: %v", names)
+	}
+}
@@ -0,0 +1,441 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxQueryLength is the longest query expression accepted
+	maxQueryLength = 1024
+
+	// maxQueryDepth is the deepest nesting of aggregations accepted
+	maxQueryDepth = 8
+
+	// maxQuerySeries is the largest number of series in a query result
+	maxQuerySeries = 1000
+)
+
+// QuerySeries is a series of a query result. Name is empty and Labels only
+// hold the grouping labels for the series of an aggregation.
+type QuerySeries struct {
+	Name   string            `json:",omitempty"`
+	Labels map[string]string `json:",omitempty"`
+	Value  float64
+}
+
+// QueryResult is the result of the 'query' param of DisplayMetrics
+type QueryResult struct {
+	Timestamp string
+	Query     string
+	Series    []QuerySeries
+
+	// Truncated is set when the series beyond maxQuerySeries were left out
+	Truncated bool `json:",omitempty"`
+}
+
+// Query is a parsed query expression over the metrics of an interval. The
+// expressions are:
+//
+//	http.requests                       every series named http.requests
+//	http.requests{code="500",method!=GET} series matching every label
+//	rate(http.requests)                 the rate of counters or samples
+//	sum(rate(http.requests))            sum, avg, min, max or count of series
+//	sum by (method) (http.requests)     the same, per value of the labels
+//
+// A selector yields gauges with their value, counters with their sum and
+// samples with their mean; rate yields the per second rate of counters and
+// samples and drops gauges. Queries only read metrics, and their length,
+// nesting and number of result series are bounded.
+type Query struct {
+	text string
+	root queryNode
+}
+
+// ParseQuery parses a query expression
+func ParseQuery(expr string) (*Query, error) {
+	if len(expr) > maxQueryLength {
+		return nil, fmt.Errorf("query is longer than %d characters", maxQueryLength)
+	}
+	p := &queryParser{input: expr}
+	root, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+	return &Query{text: expr, root: root}, nil
+}
+
+// String returns the query expression
+func (q *Query) String() string {
+	return q.text
+}
+
+// Eval evaluates the query over the metrics of intv, returning the series
+// sorted by name and labels
+func (q *Query) Eval(intv *IntervalMetrics) []QuerySeries {
+	return q.eval(intv, "")
+}
+
+// eval evaluates the query with names matched and shown without the display
+// prefix
+func (q *Query) eval(intv *IntervalMetrics, prefix string) []QuerySeries {
+	intv.RLock()
+	series := q.root.eval(intv, prefix)
+	intv.RUnlock()
+
+	sort.Slice(series, func(a, b int) bool {
+		if series[a].Name != series[b].Name {
+			return series[a].Name < series[b].Name
+		}
+		return queryLabelString(series[a].Labels) < queryLabelString(series[b].Labels)
+	})
+	return series
+}
+
+// queryNode is a node of a parsed query. The caller of eval must hold the
+// read lock of intv.
+type queryNode interface {
+	eval(intv *IntervalMetrics, prefix string) []QuerySeries
+}
+
+// queryMatcher matches the value of a label
+type queryMatcher struct {
+	name   string
+	value  string
+	negate bool
+}
+
+// querySelector selects the series with a name and matching labels
+type querySelector struct {
+	name     string
+	matchers []queryMatcher
+	rate     bool
+}
+
+func (s *querySelector) eval(intv *IntervalMetrics, prefix string) []QuerySeries {
+	var series []QuerySeries
+	add := func(name string, labels []Label, value float64) {
+		if prefix != "" {
+			name = stripNamePrefix(name, prefix)
+		}
+		if name != s.name {
+			return
+		}
+		labelMap := make(map[string]string, len(labels))
+		for _, label := range labels {
+			labelMap[label.Name] = label.Value
+		}
+		for _, m := range s.matchers {
+			if (labelMap[m.name] == m.value) == m.negate {
+				return
+			}
+		}
+		series = append(series, QuerySeries{Name: name, Labels: labelMap, Value: value})
+	}
+
+	if !s.rate {
+		for _, g := range intv.Gauges {
+			add(g.Name, g.Labels, float64(g.Value))
+		}
+	}
+	for _, c := range intv.Counters {
+		if s.rate {
+			add(c.Name, c.Labels, c.Rate)
+		} else {
+			add(c.Name, c.Labels, c.Sum)
+		}
+	}
+	for _, v := range intv.Samples {
+		if s.rate {
+			add(v.Name, v.Labels, v.Rate)
+		} else {
+			add(v.Name, v.Labels, v.AggregateSample.Mean())
+		}
+	}
+	return series
+}
+
+// queryAggregate aggregates the series of an expression, per value of the
+// by labels
+type queryAggregate struct {
+	op   string
+	by   []string
+	expr queryNode
+}
+
+// queryAggregateOps are the aggregation operators
+var queryAggregateOps = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+	"count": true,
+}
+
+func (a *queryAggregate) eval(intv *IntervalMetrics, prefix string) []QuerySeries {
+	type group struct {
+		labels map[string]string
+		values []float64
+	}
+	groups := make(map[string]*group)
+	var order []string
+	for _, s := range a.expr.eval(intv, prefix) {
+		var labels map[string]string
+		values := make([]string, len(a.by))
+		if len(a.by) > 0 {
+			labels = make(map[string]string, len(a.by))
+			for j, name := range a.by {
+				labels[name] = s.Labels[name]
+				values[j] = s.Labels[name]
+			}
+		}
+		k := strings.Join(values, "\x00")
+		g, ok := groups[k]
+		if !ok {
+			g = &group{labels: labels}
+			groups[k] = g
+			order = append(order, k)
+		}
+		g.values = append(g.values, s.Value)
+	}
+
+	series := make([]QuerySeries, 0, len(order))
+	for _, k := range order {
+		g := groups[k]
+		series = append(series, QuerySeries{Labels: g.labels, Value: aggregateQueryValues(a.op, g.values)})
+	}
+	return series
+}
+
+// aggregateQueryValues applies an aggregation operator to values, of which
+// there is at least one
+func aggregateQueryValues(op string, values []float64) float64 {
+	switch op {
+	case "count":
+		return float64(len(values))
+	case "min":
+		min := math.Inf(1)
+		for _, v := range values {
+			min = math.Min(min, v)
+		}
+		return min
+	case "max":
+		max := math.Inf(-1)
+		for _, v := range values {
+			max = math.Max(max, v)
+		}
+		return max
+	}
+
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	if op == "avg" {
+		return sum / float64(len(values))
+	}
+	return sum
+}
+
+// queryLabelString returns labels in a canonical form for sorting
+func queryLabelString(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// queryParser is a recursive descent parser of query expressions
+type queryParser struct {
+	input string
+	pos   int
+	depth int
+}
+
+// expr parses an aggregation, a rate or a selector
+func (p *queryParser) expr() (queryNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxQueryDepth {
+		return nil, p.errorf("query is nested deeper than %d levels", maxQueryDepth)
+	}
+
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+
+	// Operators are only keywords when applied, so metrics may still be
+	// named like them
+	if queryAggregateOps[name] {
+		agg := &queryAggregate{op: name}
+		if p.word("by") {
+			if agg.by, err = p.labelList(); err != nil {
+				return nil, err
+			}
+			if !p.consume("(") {
+				return nil, p.errorf("expected '(' after the labels of %s", name)
+			}
+		}
+		if agg.by != nil || p.consume("(") {
+			if agg.expr, err = p.expr(); err != nil {
+				return nil, err
+			}
+			if !p.consume(")") {
+				return nil, p.errorf("expected ')' closing %s", name)
+			}
+			return agg, nil
+		}
+	}
+	if name == "rate" && p.consume("(") {
+		inner, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		sel, err := p.selector(inner)
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, p.errorf("expected ')' closing rate")
+		}
+		sel.rate = true
+		return sel, nil
+	}
+	return p.selector(name)
+}
+
+// selector parses the optional label matchers of the selector of name
+func (p *queryParser) selector(name string) (*querySelector, error) {
+	sel := &querySelector{name: name}
+	if !p.consume("{") {
+		return sel, nil
+	}
+	for !p.consume("}") {
+		if len(sel.matchers) > 0 && !p.consume(",") {
+			return nil, p.errorf("expected ',' or '}' in the labels of %s", name)
+		}
+		label, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		m := queryMatcher{name: label}
+		switch {
+		case p.consume("!="):
+			m.negate = true
+		case p.consume("="):
+		default:
+			return nil, p.errorf("expected '=' or '!=' after label %s", label)
+		}
+		if m.value, err = p.value(); err != nil {
+			return nil, err
+		}
+		sel.matchers = append(sel.matchers, m)
+	}
+	return sel, nil
+}
+
+// labelList parses a parenthesized, comma separated list of label names
+func (p *queryParser) labelList() ([]string, error) {
+	if !p.consume("(") {
+		return nil, p.errorf("expected '(' after by")
+	}
+	labels := []string{}
+	for !p.consume(")") {
+		if len(labels) > 0 && !p.consume(",") {
+			return nil, p.errorf("expected ',' or ')' in the label list")
+		}
+		label, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// name parses a metric or label name
+func (p *queryParser) name() (string, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && isQueryNameByte(p.input[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start {
+		if p.pos == len(p.input) {
+			return "", p.errorf("unexpected end of query")
+		}
+		return "", p.errorf("expected a name, got %q", p.input[p.pos:])
+	}
+	return p.input[start:p.pos], nil
+}
+
+// value parses a label value, either quoted or a bare name
+func (p *queryParser) value() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) || p.input[p.pos] != '"' {
+		return p.name()
+	}
+	end := p.pos + 1
+	for ; end < len(p.input) && p.input[end] != '"'; end++ {
+		if p.input[end] == '\\' {
+			end++
+		}
+	}
+	if end >= len(p.input) {
+		return "", p.errorf("unterminated label value")
+	}
+	value, err := strconv.Unquote(p.input[p.pos : end+1])
+	if err != nil {
+		return "", p.errorf("bad label value %s", p.input[p.pos:end+1])
+	}
+	p.pos = end + 1
+	return value, nil
+}
+
+// word consumes the keyword w if it is next as a whole name
+func (p *queryParser) word(w string) bool {
+	start := p.pos
+	if name, err := p.name(); err == nil && name == w {
+		return true
+	}
+	p.pos = start
+	return false
+}
+
+// consume consumes tok if it is next
+func (p *queryParser) consume(tok string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.input[p.pos:], tok) {
+		p.pos += len(tok)
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) skipSpace() {
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("query column %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// isQueryNameByte returns whether b may be part of a metric or label name
+func isQueryNameByte(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("._-:/", b) >= 0
+}
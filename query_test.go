@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queryInterval returns a finished interval of 10s holding http.requests
+// counters, a latency sample and a gauge
+func queryInterval() *IntervalMetrics {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	inm := NewInmemSinkWithClock(10*time.Second, time.Minute, clock)
+
+	inm.IncrCounterWithLabels([]string{"http", "requests"}, 30, []Label{{"method", "GET"}, {"code", "200"}})
+	inm.IncrCounterWithLabels([]string{"http", "requests"}, 10, []Label{{"method", "GET"}, {"code", "500"}})
+	inm.IncrCounterWithLabels([]string{"http", "requests"}, 20, []Label{{"method", "POST"}, {"code", "200"}})
+	inm.AddSample([]string{"http", "latency"}, 2)
+	inm.AddSample([]string{"http", "latency"}, 4)
+	inm.SetGaugeWithLabels([]string{"http", "requests"}, 99, []Label{{"method", "PUT"}})
+
+	inm.ForceRollover()
+	return inm.Data()[0]
+}
+
+func TestQuery_Eval(t *testing.T) {
+	intv := queryInterval()
+
+	cases := []struct {
+		query  string
+		expect []QuerySeries
+	}{
+		{"http.latency", []QuerySeries{
+			{Name: "http.latency", Labels: map[string]string{}, Value: 3},
+		}},
+		{`http.requests{method="GET", code!=200}`, []QuerySeries{
+			{Name: "http.requests", Labels: map[string]string{"method": "GET", "code": "500"}, Value: 10},
+		}},
+		{"sum(rate(http.requests))", []QuerySeries{{Value: 6}}},
+		{"sum(http.requests)", []QuerySeries{{Value: 159}}},
+		{"avg(rate(http.requests{code=200}))", []QuerySeries{{Value: 2.5}}},
+		{"max by (method) (rate(http.requests))", []QuerySeries{
+			{Labels: map[string]string{"method": "GET"}, Value: 3},
+			{Labels: map[string]string{"method": "POST"}, Value: 2},
+		}},
+		{"count(http.requests)", []QuerySeries{{Value: 4}}},
+		{"min(http.requests)", []QuerySeries{{Value: 10}}},
+		{"sum(missing)", []QuerySeries{}},
+	}
+	for _, tc := range cases {
+		q, err := ParseQuery(tc.query)
+		if err != nil {
+			t.Fatalf("%s: err: %v", tc.query, err)
+		}
+		out := q.Eval(intv)
+		if len(out) == 0 && len(tc.expect) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(out, tc.expect) {
+			t.Fatalf("%s: bad series: %v, expected %v", tc.query, out, tc.expect)
+		}
+	}
+}
+
+func TestParseQuery_Invalid(t *testing.T) {
+	for _, query := range []string{
+		"",
+		"sum(",
+		"sum(http.requests",
+		"rate(sum(http.requests))",
+		"http.requests{method}",
+		`http.requests{method="GET}`,
+		"http.requests{a=b c=d}",
+		"sum by method (http.requests)",
+		"http.requests extra",
+		strings.Repeat("sum(", 9) + "x" + strings.Repeat(")", 9),
+		strings.Repeat("a", maxQueryLength+1),
+	} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Fatalf("expected error for %q", query)
+		}
+	}
+
+	// Operators are names where they aren't applied
+	if _, err := ParseQuery("sum{a=b}"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestDisplayMetrics_Query(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	inm := NewInmemSinkWithClock(10*time.Second, time.Minute, clock)
+	inm.SetDisplayPrefix("myservice")
+	inm.IncrCounterWithLabels([]string{"myservice", "http", "requests"}, 30, []Label{{"method", "GET"}})
+	inm.IncrCounterWithLabels([]string{"myservice", "http", "requests"}, 20, []Label{{"method", "POST"}})
+	inm.ForceRollover()
+
+	req := httptest.NewRequest("GET", "/?query="+url.QueryEscape("sum(rate(http.requests))"), nil)
+	raw, err := inm.DisplayMetrics(nil, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	result := raw.(QueryResult)
+	if result.Query != "sum(rate(http.requests))" || result.Truncated {
+		t.Fatalf("bad result: %+v", result)
+	}
+	if !reflect.DeepEqual(result.Series, []QuerySeries{{Value: 5}}) {
+		t.Fatalf("bad series: %v", result.Series)
+	}
+
+	req = httptest.NewRequest("GET", "/?query="+url.QueryEscape("sum("), nil)
+	if _, err := inm.DisplayMetrics(nil, req); err == nil || !strings.Contains(err.Error(), "Bad 'query' param") {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultConnectRetryDelay is the wait between connection attempts of a
+// ConnectRetry without a Delay
+const DefaultConnectRetryDelay = time.Second
+
+// ConnectRetry configures a bounded retry of the initial connection of a
+// network sink, for collectors which start slightly after the application.
+// The sink constructor blocks for up to Attempts connection attempts, Delay
+// apart, and fails if none of them succeeds. The zero value disables it, so
+// the constructor doesn't block.
+type ConnectRetry struct {
+	// Attempts is the number of connection attempts, including the first
+	Attempts int
+
+	// Delay is the wait between attempts, defaulting to
+	// DefaultConnectRetryDelay
+	Delay time.Duration
+}
+
+// Do calls connect until it succeeds or the attempts are used up, and
+// returns the last error in the latter case. It calls connect once if
+// retries are disabled.
+func (r ConnectRetry) Do(connect func() error) error {
+	attempts := r.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := r.Delay
+	if delay <= 0 {
+		delay = DefaultConnectRetryDelay
+	}
+
+	var err error
+	for n := 1; ; n++ {
+		if err = connect(); err == nil {
+			return nil
+		}
+		if n >= attempts {
+			break
+		}
+		time.Sleep(delay)
+	}
+	if attempts == 1 {
+		return err
+	}
+	return fmt.Errorf("failed to connect after %d attempts: %s", attempts, err)
+}
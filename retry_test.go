@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectRetry(t *testing.T) {
+	calls := 0
+	connect := func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("refused")
+		}
+		return nil
+	}
+
+	start := time.Now()
+	if err := (ConnectRetry{Attempts: 3, Delay: 10 * time.Millisecond}).Do(connect); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if calls != 3 || time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("bad retries: %d in %v", calls, time.Since(start))
+	}
+
+	// The budget is bounded
+	calls = 0
+	err := ConnectRetry{Attempts: 2, Delay: time.Millisecond}.Do(connect)
+	if err == nil || !strings.Contains(err.Error(), "after 2 attempts: refused") || calls != 2 {
+		t.Fatalf("bad err after %d calls: %v", calls, err)
+	}
+
+	// The zero value tries once
+	calls = 0
+	if err := (ConnectRetry{}).Do(connect); err == nil || err.Error() != "refused" || calls != 1 {
+		t.Fatalf("bad err after %d calls: %v", calls, err)
+	}
+}
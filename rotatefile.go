@@ -0,0 +1,351 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultRotatingFileSize is the size after which the file of a
+	// RotatingFileSink is rotated
+	defaultRotatingFileSize = 4 * 1024 * 1024
+
+	// rotatedFileTimeFormat is the layout of the timestamp suffix of
+	// rotated files, in UTC, so their names sort by rotation time
+	rotatedFileTimeFormat = "20060102T150405.000000000Z"
+)
+
+// RotatingFileOpts is used to configure a RotatingFileSink
+type RotatingFileOpts struct {
+	// Path is the file the lines are appended to. It is created if it does
+	// not exist, and appended to otherwise. Required.
+	Path string
+
+	// Statsd configures the format of the lines, as for NewStatsdSerializer
+	Statsd StatsdOpts
+
+	// MaxSize is the size in bytes after which the file is rotated.
+	// Defaults to 4MiB.
+	MaxSize int64
+
+	// RotateEvery, if set, also rotates the file once it has been written
+	// to for this long, so lines are shipped at least that often even at a
+	// low rate. The age is checked when writing, so an idle file is left
+	// in place.
+	RotateEvery time.Duration
+
+	// MaxFiles, if set, bounds the number of rotated files kept, deleting
+	// the oldest ones beyond it
+	MaxFiles int
+
+	// MaxAge, if set, deletes the rotated files older than this
+	MaxAge time.Duration
+
+	// ErrorLog is used to log file errors. Defaults to a FailureLogger from
+	// NewFailureLogger.
+	ErrorLog *FailureLogger
+
+	// Clock is the source of the current time, mostly for testing. Defaults
+	// to the system clock.
+	Clock Clock
+}
+
+// RotatingFileSink is a MetricSink appending statsd lines to a file, for
+// environments where metrics are collected into files shipped out-of-band
+// rather than sent over the network. The file is rotated by size and age:
+// it is renamed to its path with the UTC time of the rotation appended,
+// e.g. metrics.statsd.20200101T000000.000000000Z, and a new file is started
+// at the path. Rotated files are complete, as rotation happens between two
+// lines under the lock of the writes, and can be shipped and deleted by
+// another process. The sink deletes them itself beyond MaxFiles or MaxAge.
+//
+// Lines are written as they are emitted, without buffering and without
+// fsync, so they survive a crash of the process but not necessarily of the
+// host.
+type RotatingFileSink struct {
+	// dropped and errors are accessed atomically and kept first to
+	// guarantee 64-bit alignment
+	dropped uint64
+	errors  uint64
+
+	opts       RotatingFileOpts
+	serializer Serializer
+	errLog     *FailureLogger
+
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	buf    []byte
+	closed bool
+}
+
+// NewRotatingFileSink creates a RotatingFileSink appending to opts.Path
+func NewRotatingFileSink(opts RotatingFileOpts) (*RotatingFileSink, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("rotating file path is required")
+	}
+	if opts.MaxSize < 0 {
+		return nil, fmt.Errorf("invalid max size %d", opts.MaxSize)
+	}
+	if opts.RotateEvery < 0 {
+		return nil, fmt.Errorf("invalid rotation interval %v", opts.RotateEvery)
+	}
+	if opts.MaxFiles < 0 {
+		return nil, fmt.Errorf("invalid max files %d", opts.MaxFiles)
+	}
+	if opts.MaxAge < 0 {
+		return nil, fmt.Errorf("invalid max age %v", opts.MaxAge)
+	}
+	if opts.MaxSize == 0 {
+		opts.MaxSize = defaultRotatingFileSize
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	serializer, err := NewStatsdSerializer(opts.Statsd)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RotatingFileSink{
+		opts:       opts,
+		serializer: serializer,
+		errLog:     opts.ErrorLog,
+	}
+	if r.errLog == nil {
+		r.errLog = NewFailureLogger()
+	}
+	now := opts.Clock.Now()
+	if err := r.open(now); err != nil {
+		return nil, err
+	}
+	if err := r.prune(now); err != nil {
+		r.file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Rotate rotates the file right away, e.g. before shipping the rotated files
+func (r *RotatingFileSink) Rotate() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return fmt.Errorf("rotating file sink is shut down")
+	}
+	return r.rotate(r.opts.Clock.Now())
+}
+
+// Shutdown closes the file, leaving it at the path unrotated. Emissions made
+// after Shutdown are dropped.
+func (r *RotatingFileSink) Shutdown() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if r.file != nil {
+		if err := r.file.Close(); err != nil {
+			r.logError("[ERR] Error closing metrics file! Err: %s", err)
+		}
+		r.file = nil
+	}
+}
+
+// SinkStats returns the number of emissions dropped while the file could not
+// be opened or after Shutdown, and the number of file errors
+func (r *RotatingFileSink) SinkStats() SinkStats {
+	return SinkStats{
+		Dropped: atomic.LoadUint64(&r.dropped),
+		Errors:  atomic.LoadUint64(&r.errors),
+	}
+}
+
+func (r *RotatingFileSink) SetGauge(key []string, val float32) {
+	r.SetGaugeWithLabels(key, val, nil)
+}
+
+func (r *RotatingFileSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	r.write(&Emission{Type: MetricTypeGauge, Key: key, Value: val, Labels: labels})
+}
+
+func (r *RotatingFileSink) EmitKey(key []string, val float32) {
+	r.write(&Emission{Type: MetricTypeKey, Key: key, Value: val})
+}
+
+func (r *RotatingFileSink) IncrCounter(key []string, val float32) {
+	r.IncrCounterWithLabels(key, val, nil)
+}
+
+func (r *RotatingFileSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	r.write(&Emission{Type: MetricTypeCounter, Key: key, Value: val, Labels: labels})
+}
+
+func (r *RotatingFileSink) AddSample(key []string, val float32) {
+	r.AddSampleWithLabels(key, val, nil)
+}
+
+func (r *RotatingFileSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	r.write(&Emission{Type: MetricTypeSample, Key: key, Value: val, Labels: labels})
+}
+
+// write appends the line of an emission, rotating the file first if the line
+// would take it over MaxSize or it is older than RotateEvery
+func (r *RotatingFileSink) write(e *Emission) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		atomic.AddUint64(&r.dropped, 1)
+		notifyDrop(e.Key, e.Labels, DropShutdown)
+		return
+	}
+	r.buf = r.serializer.AppendEmission(r.buf[:0], e)
+	if len(r.buf) == 0 {
+		return
+	}
+
+	now := r.opts.Clock.Now()
+	switch {
+	case r.file == nil:
+		// Opening failed after the last rotation
+		if err := r.open(now); err != nil {
+			r.logError("[ERR] Error opening metrics file! Err: %s", err)
+		}
+	case r.size > 0 && r.size+int64(len(r.buf)) > r.opts.MaxSize,
+		r.opts.RotateEvery > 0 && now.Sub(r.opened) >= r.opts.RotateEvery:
+		if err := r.rotate(now); err != nil {
+			r.logError("[ERR] Error rotating metrics file! Err: %s", err)
+		}
+	}
+	if r.file == nil {
+		atomic.AddUint64(&r.dropped, 1)
+		return
+	}
+	n, err := r.file.Write(r.buf)
+	r.size += int64(n)
+	if err != nil {
+		r.logError("[ERR] Error writing to metrics file! Err: %s", err)
+	}
+}
+
+// open opens the file at the path for appending. The caller must hold lock,
+// or own the sink.
+func (r *RotatingFileSink) open(now time.Time) error {
+	f, err := os.OpenFile(r.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	r.opened = now
+	return nil
+}
+
+// rotate renames the file to its rotated name, opens a new one at the path
+// and applies the retention. If renaming fails, the lines keep being
+// appended to the file. The caller must hold lock.
+func (r *RotatingFileSink) rotate(now time.Time) error {
+	if r.file != nil {
+		if err := r.file.Close(); err != nil {
+			r.logError("[ERR] Error closing metrics file! Err: %s", err)
+		}
+		r.file = nil
+	}
+	renameErr := os.Rename(r.opts.Path, r.rotatedName(now))
+	if err := r.open(now); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	return r.prune(now)
+}
+
+// rotatedName returns an unused name for the file rotated at now
+func (r *RotatingFileSink) rotatedName(now time.Time) string {
+	base := r.opts.Path + "." + now.UTC().Format(rotatedFileTimeFormat)
+	name := base
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// prune deletes the rotated files beyond MaxFiles or older than MaxAge
+func (r *RotatingFileSink) prune(now time.Time) error {
+	if r.opts.MaxFiles == 0 && r.opts.MaxAge == 0 {
+		return nil
+	}
+	rotated, err := listRotatedFiles(r.opts.Path)
+	if err != nil {
+		return err
+	}
+	for n, file := range rotated {
+		expired := r.opts.MaxAge > 0 && now.Sub(file.rotated) > r.opts.MaxAge
+		excess := r.opts.MaxFiles > 0 && n < len(rotated)-r.opts.MaxFiles
+		if !expired && !excess {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// logError counts and logs a file error
+func (r *RotatingFileSink) logError(format string, err error) {
+	atomic.AddUint64(&r.errors, 1)
+	r.errLog.Printf(format, err)
+}
+
+// rotatedFile is a file rotated by a RotatingFileSink
+type rotatedFile struct {
+	path    string
+	rotated time.Time
+}
+
+// listRotatedFiles returns the files rotated from path, oldest first
+func listRotatedFiles(path string) ([]rotatedFile, error) {
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(path) + "."
+	var rotated []rotatedFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(name, prefix)
+		if i := strings.IndexByte(stamp, '-'); i >= 0 {
+			stamp = stamp[:i]
+		}
+		t, err := time.Parse(rotatedFileTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		rotated = append(rotated, rotatedFile{path: filepath.Join(filepath.Dir(path), name), rotated: t})
+	}
+	// Timestamps are in UTC and zero padded, so lexical order is rotation
+	// order, including the collision suffixes
+	sort.Slice(rotated, func(i, j int) bool { return rotated[i].path < rotated[j].path })
+	return rotated, nil
+}
@@ -0,0 +1,270 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tempRotatingFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "metrics-rotate")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return filepath.Join(dir, "metrics.statsd"), func() { os.RemoveAll(dir) }
+}
+
+// readRotatedLines returns the contents of the rotated files of path, oldest
+// first, followed by the file at path
+func readRotatedLines(t *testing.T, path string) []string {
+	rotated, err := listRotatedFiles(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var files []string
+	for _, file := range rotated {
+		files = append(files, file.path)
+	}
+	var contents []string
+	for _, file := range append(files, path) {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		contents = append(contents, string(raw))
+	}
+	return contents
+}
+
+func TestRotatingFileSink_Size(t *testing.T) {
+	path, cleanup := tempRotatingFile(t)
+	defer cleanup()
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	// Each line is 14 bytes, so two fit in a file
+	r, err := NewRotatingFileSink(RotatingFileOpts{Path: path, MaxSize: 30, Clock: clock})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Shutdown()
+	for n := 0; n < 5; n++ {
+		r.IncrCounter([]string{"c"}, float32(n))
+		clock.Advance(time.Second)
+	}
+
+	expect := []string{
+		"c:0.000000|c\nc:1.000000|c\n",
+		"c:2.000000|c\nc:3.000000|c\n",
+		"c:4.000000|c\n",
+	}
+	if got := readRotatedLines(t, path); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad files %q", got)
+	}
+	if _, err := os.Stat(path + ".20200101T000002.000000000Z"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Appending to an existing file counts its size
+	r.Shutdown()
+	r, err = NewRotatingFileSink(RotatingFileOpts{Path: path, MaxSize: 30, Clock: clock})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Shutdown()
+	r.IncrCounter([]string{"c"}, 5)
+	r.IncrCounter([]string{"c"}, 6)
+	expect = append(expect[:2], "c:4.000000|c\nc:5.000000|c\n", "c:6.000000|c\n")
+	if got := readRotatedLines(t, path); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad files %q", got)
+	}
+}
+
+func TestRotatingFileSink_Interval(t *testing.T) {
+	path, cleanup := tempRotatingFile(t)
+	defer cleanup()
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	r, err := NewRotatingFileSink(RotatingFileOpts{Path: path, RotateEvery: time.Minute, Clock: clock})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Shutdown()
+	r.SetGauge([]string{"g"}, 1)
+	clock.Advance(59 * time.Second)
+	r.SetGauge([]string{"g"}, 2)
+	clock.Advance(time.Second)
+	r.SetGauge([]string{"g"}, 3)
+
+	// Rotated on demand, even within the interval
+	if err := r.Rotate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r.SetGauge([]string{"g"}, 4)
+
+	expect := []string{
+		"g:1.000000|g\ng:2.000000|g\n",
+		"g:3.000000|g\n",
+		"g:4.000000|g\n",
+	}
+	if got := readRotatedLines(t, path); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad files %q", got)
+	}
+
+	// Rotating twice at the same time keeps both files
+	rotated, err := listRotatedFiles(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.HasSuffix(rotated[1].path, ".20200101T000100.000000000Z-1") {
+		t.Fatalf("bad name %s", rotated[1].path)
+	}
+}
+
+func TestRotatingFileSink_Retention(t *testing.T) {
+	path, cleanup := tempRotatingFile(t)
+	defer cleanup()
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	r, err := NewRotatingFileSink(RotatingFileOpts{
+		Path:     path,
+		MaxFiles: 3,
+		MaxAge:   time.Hour,
+		Clock:    clock,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Shutdown()
+	rotate := func(n int) {
+		r.IncrCounter([]string{"c"}, float32(n))
+		if err := r.Rotate(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Only the newest files are kept
+	for n := 0; n < 5; n++ {
+		rotate(n)
+		clock.Advance(time.Minute)
+	}
+	expect := []string{"c:2.000000|c\n", "c:3.000000|c\n", "c:4.000000|c\n", ""}
+	if got := readRotatedLines(t, path); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad files %q", got)
+	}
+
+	// Old files are deleted
+	clock.Advance(time.Hour - 2*time.Minute)
+	rotate(5)
+	expect = []string{"c:3.000000|c\n", "c:4.000000|c\n", "c:5.000000|c\n", ""}
+	if got := readRotatedLines(t, path); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad files %q", got)
+	}
+	clock.Advance(time.Hour + time.Minute)
+	rotate(6)
+	expect = []string{"c:6.000000|c\n", ""}
+	if got := readRotatedLines(t, path); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad files %q", got)
+	}
+
+	// Unrelated files are left alone
+	other := path + ".backup"
+	if err := ioutil.WriteFile(other, nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rotate(7)
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRotatingFileSink_Concurrent(t *testing.T) {
+	path, cleanup := tempRotatingFile(t)
+	defer cleanup()
+
+	r, err := NewRotatingFileSink(RotatingFileOpts{Path: path, MaxSize: 256})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	const writers, lines = 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; n < lines; n++ {
+				r.IncrCounterWithLabels([]string{"c"}, float32(n), []Label{{"w", fmt.Sprint(w)}})
+			}
+		}(w)
+	}
+	wg.Wait()
+	r.Shutdown()
+
+	// No line is lost or split at the rotations, and each writer's lines keep
+	// their order
+	next := make(map[string]int)
+	for _, contents := range readRotatedLines(t, path) {
+		if len(contents) > 256 {
+			t.Fatalf("file over max size: %d", len(contents))
+		}
+		if contents != "" && !strings.HasSuffix(contents, "\n") {
+			t.Fatalf("split line in %q", contents)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(contents, "\n"), "\n") {
+			if line == "" {
+				continue
+			}
+			var val float64
+			parts := strings.SplitN(line, ":", 2)
+			if _, err := fmt.Sscanf(parts[1], "%f|c", &val); err != nil {
+				t.Fatalf("bad line %q: %v", line, err)
+			}
+			if int(val) != next[parts[0]] {
+				t.Fatalf("line %q out of order, expected %d", line, next[parts[0]])
+			}
+			next[parts[0]]++
+		}
+	}
+	if len(next) != writers {
+		t.Fatalf("bad writers %v", next)
+	}
+	for name, n := range next {
+		if n != lines {
+			t.Fatalf("%s wrote %d lines", name, n)
+		}
+	}
+	if stats := r.SinkStats(); stats != (SinkStats{}) {
+		t.Fatalf("bad stats %+v", stats)
+	}
+
+	// Emissions after Shutdown are dropped
+	r.IncrCounter([]string{"c"}, 1)
+	if stats := r.SinkStats(); stats.Dropped != 1 {
+		t.Fatalf("bad stats %+v", stats)
+	}
+	if err := r.Rotate(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestNewRotatingFileSink_Errors(t *testing.T) {
+	path, cleanup := tempRotatingFile(t)
+	defer cleanup()
+	for _, opts := range []RotatingFileOpts{
+		{},
+		{Path: path, MaxSize: -1},
+		{Path: path, RotateEvery: -time.Second},
+		{Path: path, MaxFiles: -1},
+		{Path: path, MaxAge: -time.Second},
+		{Path: filepath.Join(path, "missing", "metrics")},
+	} {
+		if _, err := NewRotatingFileSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// GaugeRoundingSink wraps a MetricSink and rounds gauge values to a number of
+// significant digits before passing them on. Gauges wiggling in their last
+// digits create noisy series which defeat delta compression in storage;
+// rounding them keeps the series stable. Other metric types, and integer
+// gauges, are passed on unchanged.
+type GaugeRoundingSink struct {
+	sink   MetricSink
+	digits int
+}
+
+// NewGaugeRoundingSink creates a GaugeRoundingSink rounding gauges passed to
+// sink to digits significant digits. If digits is not positive, values are
+// not rounded.
+func NewGaugeRoundingSink(sink MetricSink, digits int) *GaugeRoundingSink {
+	return &GaugeRoundingSink{sink: sink, digits: digits}
+}
+
+func (r *GaugeRoundingSink) SetGauge(key []string, val float32) {
+	r.sink.SetGauge(key, r.round(val))
+}
+
+func (r *GaugeRoundingSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	r.sink.SetGaugeWithLabels(key, r.round(val), labels)
+}
+
+func (r *GaugeRoundingSink) EmitKey(key []string, val float32) {
+	r.sink.EmitKey(key, val)
+}
+
+func (r *GaugeRoundingSink) IncrCounter(key []string, val float32) {
+	r.sink.IncrCounter(key, val)
+}
+
+func (r *GaugeRoundingSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	r.sink.IncrCounterWithLabels(key, val, labels)
+}
+
+func (r *GaugeRoundingSink) AddSample(key []string, val float32) {
+	r.sink.AddSample(key, val)
+}
+
+func (r *GaugeRoundingSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	r.sink.AddSampleWithLabels(key, val, labels)
+}
+
+func (r *GaugeRoundingSink) AddTimingSample(key []string, val float32, unit time.Duration, labels []Label) {
+	addTiming(r.sink, key, val, unit, labels)
+}
+
+func (r *GaugeRoundingSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	observeBuckets(r.sink, key, counts, labels)
+}
+
+func (r *GaugeRoundingSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	setGaugeInt(r.sink, key, val, labels)
+}
+
+func (r *GaugeRoundingSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	incrCounterInt(r.sink, key, val, labels)
+}
+
+func (r *GaugeRoundingSink) ResetCounter(key []string, labels []Label) {
+	resetCounter(r.sink, key, labels)
+}
+
+func (r *GaugeRoundingSink) SetCounterTemporality(key []string, temporality Temporality) {
+	setCounterTemporality(r.sink, key, temporality)
+}
+
+func (r *GaugeRoundingSink) SetResourceLabels(names []string) {
+	setResourceLabels(r.sink, names)
+}
+
+func (r *GaugeRoundingSink) SetTimestampOffset(offset time.Duration) {
+	setTimestampOffset(r.sink, offset)
+}
+
+// round returns val rounded to the configured significant digits
+func (r *GaugeRoundingSink) round(val float32) float32 {
+	if r.digits <= 0 || val == 0 || math.IsNaN(float64(val)) || math.IsInf(float64(val), 0) {
+		return val
+	}
+	// Round in decimal, then take the float32 closest to the result
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(float64(val), 'g', r.digits, 64), 32)
+	if err != nil {
+		return val
+	}
+	return float32(rounded)
+}
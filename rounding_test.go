@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestGaugeRoundingSink(t *testing.T) {
+	for _, tc := range []struct {
+		digits int
+		in     float32
+		expect float32
+	}{
+		{3, 12.3456, 12.3},
+		{3, 12.3500001, 12.4},
+		{3, 0.000123456, 0.000123},
+		{3, 987654, 988000},
+		{3, -1.23456, -1.23},
+		{1, 0.96, 1},
+		{6, 1.0000001, 1},
+		{6, 3.1415926, 3.14159},
+		{3, 0, 0},
+		{0, 12.3456, 12.3456},
+		{-1, 12.3456, 12.3456},
+	} {
+		m := &MockSink{}
+		r := NewGaugeRoundingSink(m, tc.digits)
+		r.SetGauge([]string{"g"}, tc.in)
+		r.SetGaugeWithLabels([]string{"g"}, tc.in, []Label{{"a", "b"}})
+		if m.vals[0] != tc.expect || m.vals[1] != tc.expect {
+			t.Fatalf("%d digits of %v: expected %v, got %v", tc.digits, tc.in, tc.expect, m.vals)
+		}
+	}
+
+	// Special values are passed on as they are
+	m := &MockSink{}
+	r := NewGaugeRoundingSink(m, 3)
+	r.SetGauge([]string{"g"}, float32(math.Inf(1)))
+	r.SetGauge([]string{"g"}, float32(math.NaN()))
+	if !math.IsInf(float64(m.vals[0]), 1) || !math.IsNaN(float64(m.vals[1])) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+}
+
+func TestGaugeRoundingSink_OtherTypes(t *testing.T) {
+	m := &intMockSink{}
+	r := NewGaugeRoundingSink(m, 1)
+	r.IncrCounter([]string{"c"}, 1.234)
+	r.AddSampleWithLabels([]string{"s"}, 1.234, nil)
+	r.EmitKey([]string{"k"}, 1.234)
+	if !reflect.DeepEqual(m.vals, []float32{1.234, 1.234, 1.234}) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+
+	r.SetGaugeIntWithLabels([]string{"g"}, 1234, nil)
+	if !reflect.DeepEqual(m.intVals, []int64{1234}) {
+		t.Fatalf("bad int vals: %v", m.intVals)
+	}
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import "time"
+
+const (
+	// DefaultBackoffPauseThreshold is the GC pause above which a
+	// RuntimeBackoff without a PauseThreshold considers GC pressure high
+	DefaultBackoffPauseThreshold = 10 * time.Millisecond
+
+	// defaultBackoffMaxFactor bounds the interval of a RuntimeBackoff
+	// without a MaxInterval to this multiple of ProfileInterval
+	defaultBackoffMaxFactor = 8
+)
+
+// RuntimeBackoff configures adaptive collection of runtime metrics. Reading
+// the memory stats briefly stops the world, which adds to the trouble of a
+// process struggling with GC. While GC pressure is high, as detected from the
+// GC pauses since the previous collection, the wait between collections
+// doubles up to MaxInterval. It returns to ProfileInterval as soon as the
+// pressure subsides.
+type RuntimeBackoff struct {
+	// PauseThreshold is the longest GC pause since the previous collection
+	// above which pressure is high. Defaults to DefaultBackoffPauseThreshold.
+	PauseThreshold time.Duration
+
+	// PauseFraction, if set, also considers pressure high while the GC
+	// pauses since the previous collection add up to more than this
+	// fraction of the time elapsed, e.g. 0.05 for 5%.
+	PauseFraction float64
+
+	// MaxInterval caps the wait between collections. Defaults to 8 times
+	// ProfileInterval.
+	MaxInterval time.Duration
+}
+
+// gcPauses summarizes the GC pauses seen by a runtime stats collection
+type gcPauses struct {
+	max   time.Duration // Longest pause of the GC runs since the previous collection
+	total time.Duration // Pause time added since the previous collection
+}
+
+// runtimeBackoff tracks the wait between runtime stats collections
+type runtimeBackoff struct {
+	threshold time.Duration
+	fraction  float64
+	base      time.Duration
+	max       time.Duration
+	interval  time.Duration
+}
+
+func newRuntimeBackoff(conf RuntimeBackoff, base time.Duration) *runtimeBackoff {
+	b := &runtimeBackoff{
+		threshold: conf.PauseThreshold,
+		fraction:  conf.PauseFraction,
+		base:      base,
+		max:       conf.MaxInterval,
+		interval:  base,
+	}
+	if b.threshold <= 0 {
+		b.threshold = DefaultBackoffPauseThreshold
+	}
+	if b.max <= 0 {
+		b.max = defaultBackoffMaxFactor * base
+	}
+	if b.max < base {
+		b.max = base
+	}
+	return b
+}
+
+// next returns the wait before the next collection, given the pauses seen
+// by a collection elapsed after the one before it
+func (b *runtimeBackoff) next(p gcPauses, elapsed time.Duration) time.Duration {
+	if !b.pressured(p, elapsed) {
+		b.interval = b.base
+		return b.interval
+	}
+	b.interval *= 2
+	if b.interval > b.max {
+		b.interval = b.max
+	}
+	return b.interval
+}
+
+// pressured returns whether the pauses indicate high GC pressure
+func (b *runtimeBackoff) pressured(p gcPauses, elapsed time.Duration) bool {
+	if p.max > b.threshold {
+		return true
+	}
+	return b.fraction > 0 && elapsed > 0 && float64(p.total) > b.fraction*float64(elapsed)
+}
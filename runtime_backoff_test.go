@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRuntimeBackoff(t *testing.T) {
+	b := newRuntimeBackoff(RuntimeBackoff{MaxInterval: 5 * time.Second}, time.Second)
+	calm := gcPauses{max: time.Millisecond, total: 2 * time.Millisecond}
+	long := gcPauses{max: 50 * time.Millisecond, total: 50 * time.Millisecond}
+
+	if wait := b.next(calm, time.Second); wait != time.Second {
+		t.Fatalf("bad wait: %v", wait)
+	}
+
+	// Long pauses double the wait up to the max
+	for _, expect := range []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if wait := b.next(long, b.interval); wait != expect {
+			t.Fatalf("bad wait: %v, expected %v", wait, expect)
+		}
+	}
+
+	// The normal cadence resumes once pressure subsides
+	if wait := b.next(calm, 5*time.Second); wait != time.Second {
+		t.Fatalf("bad wait: %v", wait)
+	}
+}
+
+func TestRuntimeBackoff_PauseFraction(t *testing.T) {
+	b := newRuntimeBackoff(RuntimeBackoff{PauseThreshold: time.Second, PauseFraction: 0.05}, time.Second)
+	if b.max != 8*time.Second {
+		t.Fatalf("bad default max: %v", b.max)
+	}
+
+	// Many short pauses add up to 10% of the time
+	frequent := gcPauses{max: 5 * time.Millisecond, total: 100 * time.Millisecond}
+	if wait := b.next(frequent, time.Second); wait != 2*time.Second {
+		t.Fatalf("bad wait: %v", wait)
+	}
+	if wait := b.next(frequent, 2*time.Second); wait != time.Second {
+		t.Fatalf("bad wait: %v", wait)
+	}
+
+	// Without a fraction only the longest pause counts
+	b = newRuntimeBackoff(RuntimeBackoff{}, time.Second)
+	if b.threshold != DefaultBackoffPauseThreshold {
+		t.Fatalf("bad default threshold: %v", b.threshold)
+	}
+	if wait := b.next(frequent, time.Second); wait != time.Second {
+		t.Fatalf("bad wait: %v", wait)
+	}
+}
+
+func TestRuntimeBackoff_ReducedFrequency(t *testing.T) {
+	// Simulate ten minutes of collections, with long GC pauses from the
+	// second to the sixth minute
+	collections := func(conf *RuntimeBackoff) (during, after int) {
+		var b *runtimeBackoff
+		if conf != nil {
+			b = newRuntimeBackoff(*conf, time.Second)
+		}
+		wait := time.Second
+		for elapsed := wait; elapsed < 10*time.Minute; elapsed += wait {
+			pauses := gcPauses{max: time.Millisecond}
+			if elapsed >= 2*time.Minute && elapsed < 6*time.Minute {
+				pauses.max = 100 * time.Millisecond
+				during++
+			} else if elapsed >= 6*time.Minute {
+				after++
+			}
+			if b != nil {
+				wait = b.next(pauses, wait)
+			}
+		}
+		return during, after
+	}
+
+	during, after := collections(nil)
+	if during != 240 || after != 240 {
+		t.Fatalf("bad collections without backoff: %d %d", during, after)
+	}
+	during, after = collections(&RuntimeBackoff{})
+	if during > 35 {
+		t.Fatalf("expected fewer collections under pressure, got %d", during)
+	}
+	if after < 230 {
+		t.Fatalf("expected the normal cadence after pressure subsides, got %d", after)
+	}
+}
+
+func TestMetrics_RuntimePauses(t *testing.T) {
+	_, met := mockMetric()
+	runtime.GC()
+	met.emitRuntimeStats()
+	runtime.GC()
+	met.emitRuntimeStats()
+
+	met.runtimeLock.Lock()
+	pauses := met.lastPauses
+	met.runtimeLock.Unlock()
+	if pauses.max <= 0 || pauses.total < pauses.max {
+		t.Fatalf("bad pauses: %+v", pauses)
+	}
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RuntimeSummary holds the runtime gauges of an on demand collection
+type RuntimeSummary struct {
+	Timestamp string
+	Gauges    map[string]float32
+}
+
+// RuntimeSnapshot collects the runtime metrics right away instead of waiting
+// for the next ProfileInterval. They are emitted to the sink like periodic
+// collections, e.g. into an InmemSink, and the gauges are returned keyed by
+// their name after "runtime.". It has the signature of
+// InmemSink.DisplayMetrics so it can be served the same way, and returns an
+// error unless EnableRuntimeMetrics is set.
+func (m *Metrics) RuntimeSnapshot(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if !m.EnableRuntimeMetrics {
+		return nil, fmt.Errorf("runtime metrics are not enabled")
+	}
+	gauges := m.emitRuntimeStats()
+	return RuntimeSummary{
+		Timestamp: time.Now().Round(time.Second).UTC().String(),
+		Gauges:    gauges,
+	}, nil
+}
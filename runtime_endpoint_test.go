@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRuntimeSnapshot(t *testing.T) {
+	inm := NewInmemSink(time.Hour, time.Hour)
+	met := &Metrics{Config: Config{FilterDefault: true, EnableRuntimeMetrics: true}, sink: inm}
+
+	req := httptest.NewRequest("GET", "/debug/runtime", nil)
+	raw, err := met.RuntimeSnapshot(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	summary := raw.(RuntimeSummary)
+	if len(summary.Gauges) != len(runtimeGaugeNames) {
+		t.Fatalf("bad gauges: %v", summary.Gauges)
+	}
+	if summary.Gauges["num_goroutines"] < 1 || summary.Gauges["sys_bytes"] <= 0 {
+		t.Fatalf("bad gauges: %v", summary.Gauges)
+	}
+
+	// The collection is emitted to the sink as well
+	data := inm.Data()
+	g, ok := data[len(data)-1].Gauges["runtime.num_goroutines"]
+	if !ok || g.Value != summary.Gauges["num_goroutines"] {
+		t.Fatalf("bad gauge: %v", g)
+	}
+}
+
+func TestRuntimeSnapshot_Disabled(t *testing.T) {
+	_, met := mockMetric()
+	req := httptest.NewRequest("GET", "/debug/runtime", nil)
+	if _, err := met.RuntimeSnapshot(httptest.NewRecorder(), req); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRuntimeSnapshot_Concurrent(t *testing.T) {
+	_, met := mockMetric()
+	met.EnableRuntimeMetrics = true
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			met.EmitRuntimeStats()
+		}
+	}()
+	req := httptest.NewRequest("GET", "/debug/runtime", nil)
+	for i := 0; i < 10; i++ {
+		if _, err := met.RuntimeSnapshot(httptest.NewRecorder(), req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	<-done
+}
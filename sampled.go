@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"strings"
+	"time"
+)
+
+// SampledSink wraps a MetricSink and only passes on the detailed emissions of
+// sampled requests, so metric detail follows a head-based trace sampling
+// decision. The decision is carried in a flag label, e.g. sampled=true.
+// Emissions with a key under one of the detailed prefixes are dropped unless
+// they carry the flag label with its value, while all other emissions, such
+// as low-cardinality aggregates, are always passed on. The flag label is
+// removed before passing emissions on, so it never becomes a dimension.
+type SampledSink struct {
+	sink     MetricSink
+	flag     Label
+	detailed []string
+}
+
+// NewSampledSink creates a SampledSink passing emissions to sink. Keys are
+// matched against the detailed prefixes joined with '.', like the prefixes
+// of Config.
+func NewSampledSink(sink MetricSink, flag Label, detailed []string) *SampledSink {
+	return &SampledSink{
+		sink:     sink,
+		flag:     flag,
+		detailed: detailed,
+	}
+}
+
+func (s *SampledSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *SampledSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	if ok, labels := s.gate(key, labels); ok {
+		s.sink.SetGaugeWithLabels(key, val, labels)
+	}
+}
+
+func (s *SampledSink) EmitKey(key []string, val float32) {
+	if !s.isDetailed(key) {
+		s.sink.EmitKey(key, val)
+	}
+}
+
+func (s *SampledSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *SampledSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	if ok, labels := s.gate(key, labels); ok {
+		s.sink.IncrCounterWithLabels(key, val, labels)
+	}
+}
+
+func (s *SampledSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *SampledSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	if ok, labels := s.gate(key, labels); ok {
+		s.sink.AddSampleWithLabels(key, val, labels)
+	}
+}
+
+func (s *SampledSink) AddTimingSample(key []string, val float32, unit time.Duration, labels []Label) {
+	if ok, labels := s.gate(key, labels); ok {
+		addTiming(s.sink, key, val, unit, labels)
+	}
+}
+
+func (s *SampledSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	if ok, labels := s.gate(key, labels); ok {
+		observeBuckets(s.sink, key, counts, labels)
+	}
+}
+
+func (s *SampledSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	if ok, labels := s.gate(key, labels); ok {
+		setGaugeInt(s.sink, key, val, labels)
+	}
+}
+
+func (s *SampledSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	if ok, labels := s.gate(key, labels); ok {
+		incrCounterInt(s.sink, key, val, labels)
+	}
+}
+
+func (s *SampledSink) ResetCounter(key []string, labels []Label) {
+	if ok, labels := s.gate(key, labels); ok {
+		resetCounter(s.sink, key, labels)
+	}
+}
+
+func (s *SampledSink) SetCounterTemporality(key []string, temporality Temporality) {
+	setCounterTemporality(s.sink, key, temporality)
+}
+
+func (s *SampledSink) SetResourceLabels(names []string) {
+	setResourceLabels(s.sink, names)
+}
+
+func (s *SampledSink) SetTimestampOffset(offset time.Duration) {
+	setTimestampOffset(s.sink, offset)
+}
+
+// gate returns whether an emission is passed on, along with its labels
+// without the flag label
+func (s *SampledSink) gate(key []string, labels []Label) (bool, []Label) {
+	flagged := -1
+	for i, label := range labels {
+		if label.Name == s.flag.Name {
+			flagged = i
+			break
+		}
+	}
+	if flagged == -1 {
+		return !s.isDetailed(key), labels
+	}
+
+	if labels[flagged].Value != s.flag.Value && s.isDetailed(key) {
+		return false, nil
+	}
+	// Copy rather than modify the caller's labels
+	stripped := make([]Label, 0, len(labels)-1)
+	for _, label := range labels {
+		if label.Name != s.flag.Name {
+			stripped = append(stripped, label)
+		}
+	}
+	return true, stripped
+}
+
+// isDetailed returns whether key is under one of the detailed prefixes
+func (s *SampledSink) isDetailed(key []string) bool {
+	if len(s.detailed) == 0 {
+		return false
+	}
+	joined := strings.Join(key, ".")
+	for _, prefix := range s.detailed {
+		if strings.HasPrefix(joined, prefix) {
+			return true
+		}
+	}
+	return false
+}
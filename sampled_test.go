@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSampledSink(t *testing.T) {
+	m := &MockSink{}
+	met := &Metrics{Config: Config{FilterDefault: true}, sink: NewSampledSink(m, Label{"sampled", "true"}, []string{"http.request."})}
+
+	sampled := []Label{{"path", "/a"}, {"sampled", "true"}}
+	unsampled := []Label{{"path", "/b"}, {"sampled", "false"}}
+
+	// Detailed emissions pass only when sampled, without the flag label
+	met.AddSampleWithLabels([]string{"http", "request", "duration"}, 1, sampled)
+	met.AddSampleWithLabels([]string{"http", "request", "duration"}, 2, unsampled)
+	met.IncrCounterWithLabels([]string{"http", "request", "bytes"}, 3, []Label{{"path", "/c"}})
+	met.IncrCounter([]string{"http", "request", "count"}, 4)
+	met.EmitKey([]string{"http", "request", "kv"}, 5)
+
+	// Aggregates always pass
+	met.IncrCounterWithLabels([]string{"http", "requests"}, 6, unsampled)
+	met.IncrCounter([]string{"http", "requests"}, 7)
+	met.SetGaugeWithLabels([]string{"conns"}, 8, sampled)
+
+	expectKeys := [][]string{
+		{"http", "request", "duration"},
+		{"http", "requests"},
+		{"http", "requests"},
+		{"conns"},
+	}
+	if keys := m.getKeys(); !reflect.DeepEqual(keys, expectKeys) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	if !reflect.DeepEqual(m.vals, []float32{1, 6, 7, 8}) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+	expectLabels := [][]Label{
+		{{"path", "/a"}},
+		{{"path", "/b"}},
+		nil,
+		{{"path", "/a"}},
+	}
+	if !reflect.DeepEqual(m.labels, expectLabels) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+
+	// The caller's labels are left untouched
+	if !reflect.DeepEqual(sampled, []Label{{"path", "/a"}, {"sampled", "true"}}) {
+		t.Fatalf("labels were modified: %v", sampled)
+	}
+}
+
+func TestSampledSink_Optional(t *testing.T) {
+	m := &intMockSink{}
+	s := NewSampledSink(m, Label{"sampled", "true"}, []string{"detail"})
+
+	s.IncrCounterIntWithLabels([]string{"detail"}, 1, nil)
+	s.IncrCounterIntWithLabels([]string{"detail"}, 2, []Label{{"sampled", "true"}})
+	s.SetGaugeIntWithLabels([]string{"total"}, 3, nil)
+	if !reflect.DeepEqual(m.intVals, []int64{2, 3}) {
+		t.Fatalf("bad vals: %v", m.intVals)
+	}
+
+	// Buckets fall back to samples on the wrapped sink
+	b := &MockSink{}
+	s = NewSampledSink(b, Label{"sampled", "true"}, []string{"detail"})
+	s.ObserveBuckets([]string{"detail"}, map[float64]uint64{1: 1}, nil)
+	s.ObserveBuckets([]string{"detail"}, map[float64]uint64{5: 2}, []Label{{"sampled", "true"}})
+	if !reflect.DeepEqual(b.vals, []float32{5, 5}) {
+		t.Fatalf("bad vals: %v", b.vals)
+	}
+}
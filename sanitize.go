@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultSanitizerTracked is the default number of sanitized label values a
+// LabelSanitizer tracks to detect collisions
+const DefaultSanitizerTracked = 10000
+
+// CollisionPolicy selects what a LabelSanitizer does when two distinct label
+// values sanitize to the same string
+type CollisionPolicy int
+
+const (
+	// CollisionCount counts collisions and merges the colliding values, as
+	// sanitizing without a LabelSanitizer does
+	CollisionCount CollisionPolicy = iota
+
+	// CollisionSuffix counts collisions and keeps the colliding values
+	// distinct by appending a short hash of the original value to every
+	// value colliding with one seen before
+	CollisionSuffix
+)
+
+// LabelSanitizer sanitizes label values, detecting distinct values which
+// sanitize to the same string and would otherwise silently merge their
+// series. It remembers the first value each sanitized string came from, up
+// to a bound, beyond which new sanitized strings are no longer tracked and
+// their collisions go undetected. A LabelSanitizer is safe for concurrent
+// use, and may be shared by several sinks.
+type LabelSanitizer struct {
+	// collisions is accessed atomically and kept first to guarantee 64-bit
+	// alignment
+	collisions uint64
+
+	mapping func(rune) rune
+	policy  CollisionPolicy
+	tracked int
+
+	lock sync.Mutex
+	seen map[string]string // sanitized value -> first original value
+}
+
+// NewLabelSanitizer creates a LabelSanitizer replacing the runes of label
+// values with mapping, as strings.Map does, and tracking up to tracked
+// sanitized values, defaulting to DefaultSanitizerTracked.
+func NewLabelSanitizer(mapping func(rune) rune, policy CollisionPolicy, tracked int) (*LabelSanitizer, error) {
+	if mapping == nil {
+		return nil, fmt.Errorf("label sanitizer requires a mapping")
+	}
+	switch policy {
+	case CollisionCount, CollisionSuffix:
+	default:
+		return nil, fmt.Errorf("unknown collision policy %d", policy)
+	}
+	if tracked < 0 {
+		return nil, fmt.Errorf("invalid number of tracked values %d", tracked)
+	}
+	if tracked == 0 {
+		tracked = DefaultSanitizerTracked
+	}
+	return &LabelSanitizer{
+		mapping: mapping,
+		policy:  policy,
+		tracked: tracked,
+		seen:    make(map[string]string),
+	}, nil
+}
+
+// Sanitize returns the sanitized value. With CollisionSuffix, a value
+// colliding with one sanitized before is suffixed with "_" and the hash of
+// the original value, so the same value always ends up with the same name
+// once tracked.
+func (s *LabelSanitizer) Sanitize(value string) string {
+	sanitized := strings.Map(s.mapping, value)
+
+	s.lock.Lock()
+	first, ok := s.seen[sanitized]
+	if !ok && len(s.seen) < s.tracked {
+		s.seen[sanitized] = value
+	}
+	s.lock.Unlock()
+
+	if !ok || first == value {
+		return sanitized
+	}
+	atomic.AddUint64(&s.collisions, 1)
+	if s.policy == CollisionSuffix {
+		return sanitized + "_" + shortHash(value)
+	}
+	return sanitized
+}
+
+// Collisions returns the number of times a value was sanitized to the same
+// string as a distinct value sanitized before it
+func (s *LabelSanitizer) Collisions() uint64 {
+	return atomic.LoadUint64(&s.collisions)
+}
+
+// shortHash returns the hexadecimal FNV-1a hash of value
+func shortHash(value string) string {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
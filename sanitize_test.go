@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLabelSanitizer_Count(t *testing.T) {
+	s, err := NewLabelSanitizer(StatsdSanitize, CollisionCount, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, tc := range []struct {
+		value  string
+		expect string
+		count  uint64
+	}{
+		{"a b", "a_b", 0},
+		{"a b", "a_b", 0},
+		{"a:b", "a_b", 1},
+		{"a_b", "a_b", 2},
+		{"c", "c", 2},
+	} {
+		if out := s.Sanitize(tc.value); out != tc.expect {
+			t.Fatalf("bad sanitized %q: %q, expected %q", tc.value, out, tc.expect)
+		}
+		if c := s.Collisions(); c != tc.count {
+			t.Fatalf("bad collisions after %q: %d, expected %d", tc.value, c, tc.count)
+		}
+	}
+}
+
+func TestLabelSanitizer_Suffix(t *testing.T) {
+	s, err := NewLabelSanitizer(StatsdSanitize, CollisionSuffix, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	first := s.Sanitize("a b")
+	second := s.Sanitize("a:b")
+	if first != "a_b" {
+		t.Fatalf("bad first: %q", first)
+	}
+	if second == first || !strings.HasPrefix(second, "a_b_") || len(second) != len("a_b_")+8 {
+		t.Fatalf("bad second: %q", second)
+	}
+	if again := s.Sanitize("a:b"); again != second {
+		t.Fatalf("unstable suffix: %q != %q", again, second)
+	}
+	if again := s.Sanitize("a b"); again != first {
+		t.Fatalf("first value suffixed: %q", again)
+	}
+	if c := s.Collisions(); c != 2 {
+		t.Fatalf("bad collisions: %d", c)
+	}
+}
+
+func TestLabelSanitizer_Tracked(t *testing.T) {
+	s, err := NewLabelSanitizer(StatsdSanitize, CollisionSuffix, 1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	s.Sanitize("a b")
+	s.Sanitize("c d")
+	if out := s.Sanitize("c:d"); out != "c_d" {
+		t.Fatalf("untracked value suffixed: %q", out)
+	}
+	if out := s.Sanitize("a:b"); out == "a_b" {
+		t.Fatalf("tracked value not suffixed")
+	}
+	if c := s.Collisions(); c != 1 {
+		t.Fatalf("bad collisions: %d", c)
+	}
+}
+
+func TestNewLabelSanitizer_Invalid(t *testing.T) {
+	if _, err := NewLabelSanitizer(nil, CollisionCount, 0); err == nil {
+		t.Fatalf("expected error for missing mapping")
+	}
+	if _, err := NewLabelSanitizer(StatsdSanitize, CollisionPolicy(42), 0); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+	if _, err := NewLabelSanitizer(StatsdSanitize, CollisionCount, -1); err == nil {
+		t.Fatalf("expected error for negative bound")
+	}
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"time"
+)
+
+// Scope is a lightweight handle over a Metrics instance which adds a fixed
+// set of labels to every emission, and may override the service name. It is
+// useful for per-tenant or per-connection instrumentation where the same
+// labels are attached to many metrics.
+type Scope struct {
+	m *Metrics
+
+	// labels is the merged label set of this scope and all of its parents.
+	// It is computed once and shared by every emission made through the
+	// scope, so it must never be modified in place.
+	labels []Label
+
+	// service replaces the ServiceName of the config if overrideService is
+	// set
+	service         string
+	overrideService bool
+}
+
+// Scoped returns a Scope that adds labels to every metric emitted through it.
+func (m *Metrics) Scoped(labels []Label) *Scope {
+	return &Scope{m: m, labels: mergeLabels(nil, labels)}
+}
+
+// WithServiceName returns a Scope that emits metrics under service instead
+// of the ServiceName of the config, or without a service prefix or label if
+// service is empty. It is meant for cross-cutting metrics, such as those of
+// shared libraries, which shouldn't be namespaced under the service, e.g.
+// m.WithServiceName("").IncrCounter(key, 1).
+func (m *Metrics) WithServiceName(service string) *Scope {
+	return &Scope{m: m, service: service, overrideService: true}
+}
+
+// Scoped returns a child Scope with the given labels merged on top of the
+// labels of s. Labels of the child take precedence over parent labels with
+// the same name.
+func (s *Scope) Scoped(labels []Label) *Scope {
+	child := *s
+	child.labels = mergeLabels(s.labels, labels)
+	return &child
+}
+
+// WithServiceName returns a copy of s emitting metrics under service, as
+// Metrics.WithServiceName does.
+func (s *Scope) WithServiceName(service string) *Scope {
+	child := *s
+	child.service = service
+	child.overrideService = true
+	return &child
+}
+
+// Labels returns a copy of the labels added by the scope.
+func (s *Scope) Labels() []Label {
+	return append([]Label(nil), s.labels...)
+}
+
+func (s *Scope) SetGauge(key []string, val float32) {
+	s.m.setGaugeFor(key, val, s.withLabels(nil), s.serviceName())
+}
+
+func (s *Scope) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.m.setGaugeFor(key, val, s.withLabels(labels), s.serviceName())
+}
+
+func (s *Scope) IncrCounter(key []string, val float32) {
+	s.m.incrCounterFor(key, val, s.withLabels(nil), s.serviceName())
+}
+
+func (s *Scope) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.m.incrCounterFor(key, val, s.withLabels(labels), s.serviceName())
+}
+
+func (s *Scope) AddSample(key []string, val float32) {
+	s.m.addSampleFor(key, val, s.withLabels(nil), s.serviceName())
+}
+
+func (s *Scope) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.m.addSampleFor(key, val, s.withLabels(labels), s.serviceName())
+}
+
+func (s *Scope) MeasureSince(key []string, start time.Time) {
+	s.m.measureSinceFor(key, start, s.withLabels(nil), s.serviceName())
+}
+
+func (s *Scope) MeasureSinceWithLabels(key []string, start time.Time, labels []Label) {
+	s.m.measureSinceFor(key, start, s.withLabels(labels), s.serviceName())
+}
+
+// serviceName returns the service name metrics are emitted under
+func (s *Scope) serviceName() string {
+	if s.overrideService {
+		return s.service
+	}
+	return s.m.ServiceName
+}
+
+// withLabels returns the scope labels combined with the labels of a single
+// call. Labels given at the call site take precedence over scope labels with
+// the same name.
+func (s *Scope) withLabels(labels []Label) []Label {
+	if len(labels) == 0 {
+		return fixedLabels(s.labels)
+	}
+	return mergeLabels(s.labels, labels)
+}
+
+// fixedLabels limits the capacity of a shared label slice, so appends
+// further down the pipeline copy it instead of writing into it.
+func fixedLabels(labels []Label) []Label {
+	return labels[:len(labels):len(labels)]
+}
+
+// mergeLabels returns a new slice holding base followed by extra. Labels in
+// base are dropped when extra holds a label with the same name.
+func mergeLabels(base, extra []Label) []Label {
+	merged := make([]Label, 0, len(base)+len(extra))
+	for _, label := range base {
+		if !hasLabel(extra, label.Name) {
+			merged = append(merged, label)
+		}
+	}
+	return append(merged, extra...)
+}
+
+// hasLabel returns whether labels holds a label with the given name
+func hasLabel(labels []Label, name string) bool {
+	for _, label := range labels {
+		if label.Name == name {
+			return true
+		}
+	}
+	return false
+}
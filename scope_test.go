@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScope_Labels(t *testing.T) {
+	m, met := mockMetric()
+	tenant := met.Scoped([]Label{{"tenant", "acme"}})
+
+	tenant.SetGauge([]string{"gauge"}, 1)
+	tenant.IncrCounterWithLabels([]string{"counter"}, 2, []Label{{"code", "200"}})
+	tenant.AddSample([]string{"sample"}, 3)
+	tenant.MeasureSince([]string{"timer"}, time.Now())
+
+	expect := [][]Label{
+		{{"tenant", "acme"}},
+		{{"code", "200"}, {"tenant", "acme"}},
+		{{"tenant", "acme"}},
+		{{"tenant", "acme"}},
+	}
+	if !reflect.DeepEqual(m.labels, expect) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+	if m.vals[1] != 2 {
+		t.Fatalf("bad val: %v", m.vals)
+	}
+}
+
+func TestScope_Compose(t *testing.T) {
+	m, met := mockMetric()
+	tenant := met.Scoped([]Label{{"tenant", "acme"}, {"region", "eu"}})
+	conn := tenant.Scoped([]Label{{"conn", "42"}, {"region", "us"}})
+
+	conn.IncrCounter([]string{"counter"}, 1)
+	tenant.IncrCounter([]string{"counter"}, 1)
+
+	expect := [][]Label{
+		{{"conn", "42"}, {"region", "us"}, {"tenant", "acme"}},
+		{{"region", "eu"}, {"tenant", "acme"}},
+	}
+	if !reflect.DeepEqual(m.labels, expect) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+}
+
+func TestScope_CallLabelsTakePrecedence(t *testing.T) {
+	m, met := mockMetric()
+	s := met.Scoped([]Label{{"tenant", "acme"}, {"region", "eu"}})
+
+	s.SetGaugeWithLabels([]string{"gauge"}, 1, []Label{{"region", "us"}})
+	s.SetGauge([]string{"gauge"}, 1)
+
+	expect := [][]Label{
+		{{"region", "us"}, {"tenant", "acme"}},
+		{{"region", "eu"}, {"tenant", "acme"}},
+	}
+	if !reflect.DeepEqual(m.labels, expect) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+}
+
+func TestScope_SharedLabelsNotModified(t *testing.T) {
+	m, met := mockMetric()
+	met.HostName = "host1"
+	met.EnableHostnameLabel = true
+	s := met.Scoped([]Label{{"tenant", "acme"}})
+
+	s.IncrCounter([]string{"counter"}, 1)
+	s.IncrCounter([]string{"counter"}, 1)
+
+	expect := []Label{{"host", "host1"}, {"tenant", "acme"}}
+	for _, got := range m.labels {
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("bad labels: %v", got)
+		}
+	}
+	if !reflect.DeepEqual(s.Labels(), []Label{{"tenant", "acme"}}) {
+		t.Fatalf("scope labels modified: %v", s.Labels())
+	}
+}
+
+func TestScope_ServiceName(t *testing.T) {
+	m, met := mockMetric()
+	met.ServiceName = "api"
+
+	met.IncrCounter([]string{"requests"}, 1)
+	met.WithServiceName("").IncrCounter([]string{"pool", "conns"}, 1)
+	met.WithServiceName("lib").SetGauge([]string{"cache", "size"}, 2)
+	met.Scoped([]Label{{"a", "b"}}).WithServiceName("").AddSample([]string{"sample"}, 3)
+	met.WithServiceName("lib").Scoped([]Label{{"a", "b"}}).MeasureSince([]string{"timer"}, time.Now())
+
+	expect := [][]string{
+		{"api", "requests"},
+		{"pool", "conns"},
+		{"lib", "cache", "size"},
+		{"sample"},
+		{"lib", "timer"},
+	}
+	if keys := m.getKeys(); !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+
+	// With service labels the label is replaced or left out
+	m, met = mockMetric()
+	met.ServiceName = "api"
+	met.EnableServiceLabel = true
+	met.WithServiceName("lib").IncrCounter([]string{"a"}, 1)
+	met.WithServiceName("").IncrCounter([]string{"b"}, 1)
+	if !reflect.DeepEqual(m.labels, [][]Label{{{"service", "lib"}}, nil}) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+}
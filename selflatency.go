@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// selfLatencyKey is the key of the samples recorded to SelfLatencySink
+var selfLatencyKey = []string{"metrics", "emit", "latency"}
+
+// startSelfLatency returns the start time of an emit call measured for
+// SelfLatencySink, for the fraction of calls set by SelfLatencyRate, and
+// the zero time for the calls which are not measured
+func (m *Metrics) startSelfLatency() time.Time {
+	if m.SelfLatencySink == nil || m.SelfLatencyRate <= 0 || rand.Float64() >= m.SelfLatencyRate {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// recordSelfLatency records the time since start spent in an emit call of
+// typ to SelfLatencySink, unless start is zero. A sample is recorded at a
+// time: calls finishing while one is recorded, including those the
+// SelfLatencySink makes into m itself, are not recorded, so the samples can
+// not feed back into themselves.
+func (m *Metrics) recordSelfLatency(typ MetricType, start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	elapsed := time.Since(start)
+	if !atomic.CompareAndSwapInt32(&m.recordingSelfLatency, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&m.recordingSelfLatency, 0)
+
+	micros := float32(float64(elapsed) / float64(time.Microsecond))
+	m.SelfLatencySink.AddSampleWithLabels(selfLatencyKey, micros, []Label{{"type", typ.String()}})
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMetrics_SelfLatency(t *testing.T) {
+	m, met := mockMetric()
+	self := &MockSink{}
+	met.SelfLatencySink = self
+	met.SelfLatencyRate = 1
+
+	met.SetGauge([]string{"gauge"}, 1)
+	met.IncrCounter([]string{"counter"}, 1)
+	met.AddSample([]string{"sample"}, 1)
+	met.EmitKey([]string{"kv"}, 1)
+	if len(m.keys) != 4 {
+		t.Fatalf("bad emissions: %v", m.keys)
+	}
+	if len(self.keys) != 4 {
+		t.Fatalf("bad self samples: %v", self.keys)
+	}
+	var types []string
+	for i, key := range self.keys {
+		if !reflect.DeepEqual(key, selfLatencyKey) || self.vals[i] < 0 {
+			t.Fatalf("bad self sample: %v %v", key, self.vals[i])
+		}
+		types = append(types, self.labels[i][0].Value)
+	}
+	if !reflect.DeepEqual(types, []string{"gauge", "counter", "sample", "key"}) {
+		t.Fatalf("bad types: %v", types)
+	}
+
+	// Nothing is measured without a rate
+	self.keys = nil
+	met.SelfLatencyRate = 0
+	met.SetGauge([]string{"gauge"}, 1)
+	if len(self.keys) != 0 {
+		t.Fatalf("unexpected self samples: %v", self.keys)
+	}
+}
+
+// selfEmittingSink emits through the Metrics it measures for
+type selfEmittingSink struct {
+	MockSink
+	met *Metrics
+}
+
+func (s *selfEmittingSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.MockSink.AddSampleWithLabels(key, val, labels)
+	s.met.IncrCounter([]string{"recorded"}, 1)
+}
+
+func TestMetrics_SelfLatencyRecursion(t *testing.T) {
+	m, met := mockMetric()
+	self := &selfEmittingSink{met: met}
+	met.SelfLatencySink = self
+	met.SelfLatencyRate = 1
+
+	// The counter emitted by the sink is not measured in turn
+	met.SetGauge([]string{"gauge"}, 1)
+	if len(self.keys) != 1 {
+		t.Fatalf("bad self samples: %v", self.keys)
+	}
+	if !reflect.DeepEqual(m.keys, [][]string{{"gauge"}, {"recorded"}}) {
+		t.Fatalf("bad emissions: %v", m.keys)
+	}
+}
@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// defaultSelfTestCanaryName is the key of the canary gauge of the self-test
+// if SelfTestCanaryName is empty
+const defaultSelfTestCanaryName = "metrics.canary"
+
+// pipelineHealthyKey is the key of the gauge holding the outcome of the last
+// self-test
+var pipelineHealthyKey = []string{"metrics", "pipeline_healthy"}
+
+// CanaryVerifier is implemented by sinks whose metrics can be read back, such
+// as InmemSink, to verify that the canary of a self-test reached them
+type CanaryVerifier interface {
+	// VerifyCanary returns an error unless the gauge key holds val
+	VerifyCanary(key []string, val float32) error
+}
+
+// Periodically runs the self-test, logging when its outcome changes
+func (m *Metrics) collectSelfTest() {
+	interval := m.SelfTestInterval
+	if interval <= 0 {
+		interval = m.ProfileInterval
+	}
+	healthy := true
+	for {
+		time.Sleep(interval)
+		err := m.RunSelfTest()
+		if err != nil && healthy {
+			log.Printf("[WARN] metrics: self-test failed: %v", err)
+		} else if err == nil && !healthy {
+			log.Printf("[INFO] metrics: self-test passed again")
+		}
+		healthy = err == nil
+	}
+}
+
+// RunSelfTest emits the canary gauge SelfTestCanaryName, "metrics.canary" if
+// empty, with a new value, and checks that the pipeline delivered it. Sinks
+// implementing CanaryVerifier, including those of a FanoutSink, must hold the
+// new value, so the canary must not be filtered out. The sinks registered
+// with RegisterSinkStats must not have dropped metrics or seen errors since
+// the previous self-test, or since they were created for the first one. The
+// outcome is emitted as the gauge metrics.pipeline_healthy, 1 if healthy and
+// 0 otherwise, and the reason of a failure is returned.
+func (m *Metrics) RunSelfTest() error {
+	m.selfTestLock.Lock()
+	defer m.selfTestLock.Unlock()
+
+	name := m.SelfTestCanaryName
+	if name == "" {
+		name = defaultSelfTestCanaryName
+	}
+	canary := strings.Split(name, ".")
+
+	// Values stay below 2^24, so a float32 holds them exactly
+	m.canarySeq = (m.canarySeq + 1) % (1 << 24)
+	val := float32(m.canarySeq)
+	m.SetGauge(canary, val)
+
+	err := m.verifyCanary(canary, val)
+	if statsErr := m.checkSelfTestStats(); err == nil {
+		err = statsErr
+	}
+	healthy := float32(1)
+	if err != nil {
+		healthy = 0
+	}
+	m.SetGauge(pipelineHealthyKey, healthy)
+	return err
+}
+
+// verifyCanary checks that the verifiable sinks hold val as the canary
+func (m *Metrics) verifyCanary(canary []string, val float32) error {
+	key, _, ok := m.gaugeKey(canary, nil, m.ServiceName)
+	if !ok {
+		return fmt.Errorf("canary %s dropped for its key", strings.Join(canary, "."))
+	}
+	return verifyCanary(m.sink, key, val)
+}
+
+// verifyCanary checks that sink, or the sinks it fans out to, holds val as
+// the canary if it implements CanaryVerifier
+func verifyCanary(sink MetricSink, key []string, val float32) error {
+	switch s := sink.(type) {
+	case CanaryVerifier:
+		return s.VerifyCanary(key, val)
+	case FanoutSink:
+		for _, sub := range s {
+			if err := verifyCanary(sub, key, val); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSelfTestStats checks that the registered sinks didn't drop metrics or
+// see errors since the previous self-test. The caller must hold
+// selfTestLock.
+func (m *Metrics) checkSelfTestStats() error {
+	m.sinkStatsLock.Lock()
+	entries := append([]*sinkStatsEntry(nil), m.sinkStats...)
+	m.sinkStatsLock.Unlock()
+
+	var failures []string
+	stats := make(map[string]SinkStats, len(entries))
+	for _, e := range entries {
+		current := e.reporter.SinkStats()
+		stats[e.name] = current
+		last := m.selfTestStats[e.name]
+		if current.Dropped > last.Dropped || current.Errors > last.Errors {
+			failures = append(failures, fmt.Sprintf("sink %s dropped %d metrics and saw %d errors",
+				e.name, current.Dropped-last.Dropped, current.Errors-last.Errors))
+		}
+	}
+	m.selfTestStats = stats
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// lossySink loses the gauges it is sent, but can still be read back
+type lossySink struct {
+	*InmemSink
+}
+
+func (l *lossySink) SetGaugeWithLabels(key []string, val float32, labels []Label) {}
+
+// pipelineHealthy returns the value of the gauge metrics.pipeline_healthy of
+// inm, and whether it is set
+func pipelineHealthy(inm *InmemSink, name string) (float32, bool) {
+	data := inm.Data()
+	g, ok := data[len(data)-1].Gauges[name]
+	return g.Value, ok
+}
+
+func TestMetrics_RunSelfTest_Healthy(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Minute)
+	conf := DefaultConfig("service")
+	conf.EnableRuntimeMetrics = false
+	conf.EnableHostname = false
+	conf.SelfTestCanaryName = "app.canary"
+	met, err := New(conf, FanoutSink{&MockSink{}, inm})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reporter := &fakeStatsReporter{}
+	met.RegisterSinkStats("push", reporter)
+
+	for i := 0; i < 2; i++ {
+		if err := met.RunSelfTest(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if v, ok := pipelineHealthy(inm, "service.metrics.pipeline_healthy"); !ok || v != 1 {
+		t.Fatalf("bad health: %v %v", v, ok)
+	}
+	if g := inm.Data()[0].Gauges["service.app.canary"]; g.Value != 2 {
+		t.Fatalf("bad canary: %v", g.Value)
+	}
+}
+
+func TestMetrics_RunSelfTest_Broken(t *testing.T) {
+	// A sink losing the canary makes the pipeline unhealthy
+	inm := NewInmemSink(time.Minute, time.Minute)
+	lossy := &lossySink{NewInmemSink(time.Minute, time.Minute)}
+	met := &Metrics{Config: Config{FilterDefault: true}, sink: FanoutSink{inm, lossy}}
+	err := met.RunSelfTest()
+	if err == nil || !strings.Contains(err.Error(), "metrics.canary not found") {
+		t.Fatalf("bad err: %v", err)
+	}
+	if v, ok := pipelineHealthy(inm, "metrics.pipeline_healthy"); !ok || v != 0 {
+		t.Fatalf("bad health: %v %v", v, ok)
+	}
+
+	// So does a push sink failing to deliver
+	met = &Metrics{Config: Config{FilterDefault: true}, sink: inm}
+	reporter := &fakeStatsReporter{}
+	met.RegisterSinkStats("push", reporter)
+	if err := met.RunSelfTest(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reporter.add(1, 2)
+	err = met.RunSelfTest()
+	if err == nil || !strings.Contains(err.Error(), "sink push dropped 1 metrics and saw 2 errors") {
+		t.Fatalf("bad err: %v", err)
+	}
+	if v, _ := pipelineHealthy(inm, "metrics.pipeline_healthy"); v != 0 {
+		t.Fatalf("bad health: %v", v)
+	}
+
+	// The pipeline recovers once deliveries succeed again
+	if err := met.RunSelfTest(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if v, _ := pipelineHealthy(inm, "metrics.pipeline_healthy"); v != 1 {
+		t.Fatalf("bad health: %v", v)
+	}
+}
+
+func TestMetrics_RunSelfTest_Filtered(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Minute)
+	met := &Metrics{Config: Config{FilterDefault: true}, sink: inm}
+	met.UpdateFilter(nil, []string{"metrics.canary"})
+	if err := met.RunSelfTest(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestMetrics_EnableSelfTest(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Minute)
+	conf := DefaultConfig("")
+	conf.EnableRuntimeMetrics = false
+	conf.EnableHostname = false
+	conf.EnableSelfTest = true
+	conf.SelfTestInterval = 10 * time.Millisecond
+	if _, err := New(conf, inm); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if v, ok := pipelineHealthy(inm, "metrics.pipeline_healthy"); ok && v == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("self-test did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
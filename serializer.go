@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Serializer encodes emissions in the wire format of a NetworkSink, so any
+// format can be sent through the same transport
+type Serializer interface {
+	// AppendEmission appends the encoding of e to buf and returns the
+	// extended buffer. Encodings sent over a stream must delimit themselves,
+	// e.g. with a trailing newline. Returning buf unchanged skips the
+	// emission, e.g. for a type the format has no encoding for.
+	AppendEmission(buf []byte, e *Emission) []byte
+}
+
+// SerializerFunc adapts a function to a Serializer
+type SerializerFunc func(buf []byte, e *Emission) []byte
+
+func (f SerializerFunc) AppendEmission(buf []byte, e *Emission) []byte {
+	return f(buf, e)
+}
+
+// NewStatsdSerializer returns a Serializer encoding emissions as the lines
+// of a StatsdSink configured with opts, e.g. "requests:1.000000|c\n" for a
+// counter. Only the options affecting the lines apply: HistogramSamples,
+// ZeroGaugeEpsilon, TypeSuffixes, NameCacheSize and LabelSanitizer. Counter
+// resets and bucket observations have no statsd encoding and are skipped.
+func NewStatsdSerializer(opts StatsdOpts) (Serializer, error) {
+	if opts.NameCacheSize < 0 {
+		return nil, fmt.Errorf("invalid name cache size %d", opts.NameCacheSize)
+	}
+	s := &StatsdSink{}
+	s.applyFormat(opts)
+	return statsdSerializer{s}, nil
+}
+
+// statsdSerializer encodes emissions as the lines of its StatsdSink
+type statsdSerializer struct {
+	sink *StatsdSink
+}
+
+func (z statsdSerializer) AppendEmission(buf []byte, e *Emission) []byte {
+	if e.Reset || e.Buckets != nil {
+		return buf
+	}
+	s := z.sink
+	val := e.Value
+	var suffix string
+	switch e.Type {
+	case MetricTypeGauge:
+		val = s.gaugeValue(val)
+		suffix = s.typeSuffixes().Gauge
+	case MetricTypeCounter:
+		suffix = s.typeSuffixes().Counter
+	case MetricTypeSample:
+		suffix = s.sampleType
+	case MetricTypeKey:
+		suffix = s.typeSuffixes().KeyValue
+	default:
+		return buf
+	}
+
+	buf = append(buf, s.metricName(e.Key, e.Labels)...)
+	buf = append(buf, ':')
+	buf = strconv.AppendFloat(buf, float64(val), 'f', 6, 32)
+	buf = append(buf, statsdSuffix(suffix)...)
+	return append(buf, '\n')
+}
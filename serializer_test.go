@@ -0,0 +1,60 @@
+package metrics
+
+import "testing"
+
+func TestStatsdSerializer(t *testing.T) {
+	if _, err := NewStatsdSerializer(StatsdOpts{NameCacheSize: -1}); err == nil {
+		t.Fatalf("expected error")
+	}
+	opts := StatsdOpts{
+		HistogramSamples: true,
+		ZeroGaugeEpsilon: 0.000001,
+		TypeSuffixes:     &StatsdTypeSuffixes{Gauge: "G", Counter: "C", KeyValue: "KV"},
+	}
+	z, err := NewStatsdSerializer(opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sink, err := NewStatsdSinkFrom("127.0.0.1:7524", opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sink.Shutdown()
+
+	// The serializer encodes the lines of the sink
+	q := make(chan string, 4)
+	s := &StatsdSink{metricQueue: q, sampleType: sink.sampleType, suffixes: sink.suffixes, zeroGauge: sink.zeroGauge}
+	labels := []Label{{"a", "label"}}
+	s.SetGaugeWithLabels([]string{"gauge"}, 0, labels)
+	s.IncrCounter([]string{"counter"}, 1.5)
+	s.AddSample([]string{"sample"}, 2)
+	s.EmitKey([]string{"key"}, 3)
+	emissions := []Emission{
+		{Type: MetricTypeGauge, Key: []string{"gauge"}, Labels: labels},
+		{Type: MetricTypeCounter, Key: []string{"counter"}, Value: 1.5},
+		{Type: MetricTypeSample, Key: []string{"sample"}, Value: 2},
+		{Type: MetricTypeKey, Key: []string{"key"}, Value: 3},
+	}
+	for _, e := range emissions {
+		if line, expect := string(z.AppendEmission(nil, &e)), <-q; line != expect {
+			t.Fatalf("expected %q, got %q", expect, line)
+		}
+	}
+
+	// Resets and buckets have no statsd encoding
+	buf := []byte("prefix")
+	reset := Emission{Type: MetricTypeCounter, Key: []string{"counter"}, Reset: true}
+	buckets := Emission{Type: MetricTypeSample, Key: []string{"sample"}, Buckets: map[float64]uint64{1: 1}}
+	if out := z.AppendEmission(z.AppendEmission(buf, &reset), &buckets); string(out) != "prefix" {
+		t.Fatalf("bad encoding: %q", out)
+	}
+}
+
+func TestSerializerFunc(t *testing.T) {
+	var z Serializer = SerializerFunc(func(buf []byte, e *Emission) []byte {
+		return append(buf, e.Type.String()...)
+	})
+	if out := z.AppendEmission([]byte("a "), &Emission{Type: MetricTypeSample}); string(out) != "a sample" {
+		t.Fatalf("bad encoding: %q", out)
+	}
+}
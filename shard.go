@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// ShardOpts is used to configure a ShardedSink
+type ShardOpts struct {
+	// Labels are the names of the labels the shard of an emission is
+	// computed from, e.g. "tenant". If empty, every label of the emission is
+	// used.
+	Labels []string
+
+	// Global, if set, receives every emission besides its shard, e.g. for a
+	// collector computing aggregates across shards
+	Global MetricSink
+
+	// Hash hashes the label values into a shard, e.g. crc32.ChecksumIEEE.
+	// Defaults to the 32-bit FNV-1a hash.
+	Hash func(data []byte) uint32
+}
+
+// ShardedSink routes every emission to one of several sinks, chosen by
+// hashing the values of its shard labels, so a horizontally scaled collector
+// tier receives each series on a single shard. Emissions with the same
+// values of the shard labels always go to the same shard, whatever the order
+// of their labels. A label missing from an emission hashes like an empty
+// value, and EmitKey routes like an emission without labels.
+type ShardedSink struct {
+	shards []MetricSink
+	labels []string
+	global MetricSink
+	hash   func(data []byte) uint32
+}
+
+// NewShardedSink creates a ShardedSink routing emissions to shards
+func NewShardedSink(shards []MetricSink, opts ShardOpts) (*ShardedSink, error) {
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("sharded sink requires at least one shard")
+	}
+	s := &ShardedSink{
+		shards: shards,
+		labels: opts.Labels,
+		global: opts.Global,
+		hash:   opts.Hash,
+	}
+	if s.hash == nil {
+		s.hash = fnv32a
+	}
+	return s, nil
+}
+
+// Shard returns the index of the shard emissions with labels are routed to
+func (s *ShardedSink) Shard(labels []Label) int {
+	var data []byte
+	if len(s.labels) > 0 {
+		for _, name := range s.labels {
+			value := ""
+			for _, label := range labels {
+				if label.Name == name {
+					value = label.Value
+					break
+				}
+			}
+			data = append(data, value...)
+			data = append(data, 0)
+		}
+	} else {
+		sorted := make([]Label, len(labels))
+		copy(sorted, labels)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+		for _, label := range sorted {
+			data = append(data, label.Name...)
+			data = append(data, '=')
+			data = append(data, label.Value...)
+			data = append(data, 0)
+		}
+	}
+	return int(s.hash(data) % uint32(len(s.shards)))
+}
+
+func (s *ShardedSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *ShardedSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.route(labels, func(sink MetricSink) { sink.SetGaugeWithLabels(key, val, labels) })
+}
+
+func (s *ShardedSink) EmitKey(key []string, val float32) {
+	s.route(nil, func(sink MetricSink) { sink.EmitKey(key, val) })
+}
+
+func (s *ShardedSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *ShardedSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.route(labels, func(sink MetricSink) { sink.IncrCounterWithLabels(key, val, labels) })
+}
+
+func (s *ShardedSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *ShardedSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.route(labels, func(sink MetricSink) { sink.AddSampleWithLabels(key, val, labels) })
+}
+
+func (s *ShardedSink) AddTimingSample(key []string, val float32, unit time.Duration, labels []Label) {
+	s.route(labels, func(sink MetricSink) { addTiming(sink, key, val, unit, labels) })
+}
+
+func (s *ShardedSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	s.route(labels, func(sink MetricSink) { observeBuckets(sink, key, counts, labels) })
+}
+
+func (s *ShardedSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	s.route(labels, func(sink MetricSink) { setGaugeInt(sink, key, val, labels) })
+}
+
+func (s *ShardedSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	s.route(labels, func(sink MetricSink) { incrCounterInt(sink, key, val, labels) })
+}
+
+func (s *ShardedSink) ResetCounter(key []string, labels []Label) {
+	s.route(labels, func(sink MetricSink) { resetCounter(sink, key, labels) })
+}
+
+// SetCounterTemporality passes the temporality to every shard and the global
+// sink, as the counter may carry any labels
+func (s *ShardedSink) SetCounterTemporality(key []string, temporality Temporality) {
+	s.all(func(sink MetricSink) { setCounterTemporality(sink, key, temporality) })
+}
+
+// SetResourceLabels passes the names to every shard and the global sink
+func (s *ShardedSink) SetResourceLabels(names []string) {
+	s.all(func(sink MetricSink) { setResourceLabels(sink, names) })
+}
+
+// SetTimestampOffset passes the offset to every shard and the global sink
+func (s *ShardedSink) SetTimestampOffset(offset time.Duration) {
+	s.all(func(sink MetricSink) { setTimestampOffset(sink, offset) })
+}
+
+// route calls emit for the shard of labels and the global sink
+func (s *ShardedSink) route(labels []Label, emit func(MetricSink)) {
+	emit(s.shards[s.Shard(labels)])
+	if s.global != nil {
+		emit(s.global)
+	}
+}
+
+// all calls f for every shard and the global sink
+func (s *ShardedSink) all(f func(MetricSink)) {
+	for _, sink := range s.shards {
+		f(sink)
+	}
+	if s.global != nil {
+		f(s.global)
+	}
+}
+
+// fnv32a returns the 32-bit FNV-1a hash of data
+func fnv32a(data []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(data)
+	return h.Sum32()
+}
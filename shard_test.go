@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewShardedSink_Invalid(t *testing.T) {
+	if _, err := NewShardedSink(nil, ShardOpts{}); err == nil {
+		t.Fatalf("expected error without shards")
+	}
+}
+
+func TestShardedSink_Routing(t *testing.T) {
+	shards := []*MockSink{{}, {}, {}, {}}
+	global := &MockSink{}
+	s, err := NewShardedSink([]MetricSink{shards[0], shards[1], shards[2], shards[3]}, ShardOpts{
+		Labels: []string{"tenant"},
+		Global: global,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Every emission of a tenant goes to the same shard, regardless of its
+	// other labels, and to the global sink
+	used := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		tenant := Label{"tenant", fmt.Sprintf("t%d", i)}
+		shard := s.Shard([]Label{tenant})
+		used[shard] = true
+		for _, labels := range [][]Label{
+			{tenant},
+			{{"host", "a"}, tenant},
+			{tenant, {"host", "b"}},
+		} {
+			before := len(shards[shard].keys)
+			s.IncrCounterWithLabels([]string{"requests"}, 1, labels)
+			s.AddSampleWithLabels([]string{"latency"}, 1, labels)
+			s.SetGaugeWithLabels([]string{"queue"}, 1, labels)
+			if len(shards[shard].keys) != before+3 {
+				t.Fatalf("emissions of %v not routed to shard %d", labels, shard)
+			}
+		}
+	}
+	if len(used) < 2 {
+		t.Fatalf("expected tenants to spread over shards: %v", used)
+	}
+	total := 0
+	for _, shard := range shards {
+		total += len(shard.keys)
+	}
+	if total != 180 || len(global.keys) != 180 {
+		t.Fatalf("bad emissions: %d shards, %d global", total, len(global.keys))
+	}
+
+	// Emissions without the label share a shard with EmitKey
+	shard := s.Shard(nil)
+	if s.Shard([]Label{{"host", "a"}}) != shard || s.Shard([]Label{{"tenant", ""}}) != shard {
+		t.Fatalf("expected a missing label to hash like an empty value")
+	}
+	before := len(shards[shard].keys)
+	s.EmitKey([]string{"kv"}, 1)
+	if len(shards[shard].keys) != before+1 {
+		t.Fatalf("key not routed to shard %d", shard)
+	}
+}
+
+func TestShardedSink_AllLabels(t *testing.T) {
+	sinks := make([]MetricSink, 8)
+	for i := range sinks {
+		sinks[i] = &MockSink{}
+	}
+	s, err := NewShardedSink(sinks, ShardOpts{Hash: crc32.ChecksumIEEE})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Without shard labels, the whole label set counts, in any order
+	a := []Label{{"region", "west"}, {"tenant", "t1"}}
+	b := []Label{{"tenant", "t1"}, {"region", "west"}}
+	if s.Shard(a) != s.Shard(b) {
+		t.Fatalf("label order changed the shard")
+	}
+	if !reflect.DeepEqual(a, []Label{{"region", "west"}, {"tenant", "t1"}}) {
+		t.Fatalf("labels were modified: %v", a)
+	}
+	shards := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		shards[s.Shard([]Label{{"region", "west"}, {"tenant", fmt.Sprintf("t%d", i)}})] = true
+	}
+	if len(shards) < 2 {
+		t.Fatalf("expected label sets to spread over shards: %v", shards)
+	}
+}
+
+func TestShardedSink_Optional(t *testing.T) {
+	ints := []*intMockSink{{}, {}}
+	inms := []*InmemSink{NewInmemSink(time.Hour, time.Hour), NewInmemSink(time.Hour, time.Hour)}
+	s, err := NewShardedSink([]MetricSink{FanoutSink{ints[0], inms[0]}, FanoutSink{ints[1], inms[1]}}, ShardOpts{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	labels := []Label{{"tenant", "t1"}}
+	shard := s.Shard(labels)
+
+	// Integers and buckets reach the shard as they are
+	s.IncrCounterIntWithLabels([]string{"c"}, 4, labels)
+	s.SetGaugeIntWithLabels([]string{"g"}, 5, labels)
+	if !reflect.DeepEqual(ints[shard].intVals, []int64{4, 5}) || len(ints[shard].vals) != 0 {
+		t.Fatalf("bad values: %v %v", ints[shard].intVals, ints[shard].vals)
+	}
+	counts := map[float64]uint64{1: 2, math.Inf(1): 1}
+	s.ObserveBuckets([]string{"h"}, counts, labels)
+	if sample := inms[shard].Data()[0].Samples["h;tenant=t1"]; !reflect.DeepEqual(sample.Buckets, counts) {
+		t.Fatalf("bad buckets: %v", sample.Buckets)
+	}
+	if other := ints[1-shard]; len(other.intVals) != 0 || len(other.vals) != 0 {
+		t.Fatalf("emissions reached the other shard: %v %v", other.intVals, other.vals)
+	}
+}
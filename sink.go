@@ -2,7 +2,11 @@ package metrics
 
 import (
 	"fmt"
+	"math"
 	"net/url"
+	"reflect"
+	"sync"
+	"time"
 )
 
 // The MetricSink interface is used to transmit metrics information
@@ -24,6 +28,175 @@ type MetricSink interface {
 	AddSampleWithLabels(key []string, val float32, labels []Label)
 }
 
+// BucketSink is implemented by sinks that can ingest histogram observations
+// which were already bucketed upstream, e.g. by another aggregator.
+type BucketSink interface {
+	// ObserveBuckets adds counts to the histogram of key. Each entry of
+	// counts maps the upper bound of a bucket to the number of observations
+	// in that bucket alone, not including lower buckets. The bound
+	// math.Inf(1) holds observations above every other bound.
+	ObserveBuckets(key []string, counts map[float64]uint64, labels []Label)
+}
+
+// observeBuckets passes bucketed observations to sink. Sinks that do not
+// implement BucketSink get an approximate sample stream instead, of one
+// sample per observation at the upper bound of its bucket. Observations
+// above every finite bound are emitted at the largest finite bound.
+func observeBuckets(sink MetricSink, key []string, counts map[float64]uint64, labels []Label) {
+	if bs, ok := sink.(BucketSink); ok {
+		bs.ObserveBuckets(key, counts, labels)
+		return
+	}
+
+	maxBound := math.Inf(-1)
+	for bound := range counts {
+		if !math.IsInf(bound, 0) && bound > maxBound {
+			maxBound = bound
+		}
+	}
+	for bound, count := range counts {
+		if math.IsNaN(bound) || math.IsInf(bound, -1) {
+			continue
+		}
+		if math.IsInf(bound, 1) {
+			if math.IsInf(maxBound, -1) {
+				continue
+			}
+			bound = maxBound
+		}
+		for n := uint64(0); n < count; n++ {
+			sink.AddSampleWithLabels(key, float32(bound), labels)
+		}
+	}
+}
+
+// IntegerSink is implemented by sinks that can emit integral values without
+// a fractional part, e.g. "requests:4|c" rather than "requests:4.000000|c".
+type IntegerSink interface {
+	SetGaugeIntWithLabels(key []string, val int64, labels []Label)
+	IncrCounterIntWithLabels(key []string, val int64, labels []Label)
+}
+
+// setGaugeInt passes an integer gauge to sink, converting it to a float32
+// for sinks that do not implement IntegerSink.
+func setGaugeInt(sink MetricSink, key []string, val int64, labels []Label) {
+	if is, ok := sink.(IntegerSink); ok {
+		is.SetGaugeIntWithLabels(key, val, labels)
+		return
+	}
+	sink.SetGaugeWithLabels(key, float32(val), labels)
+}
+
+// incrCounterInt passes an integer counter increment to sink, converting it
+// to a float32 for sinks that do not implement IntegerSink.
+func incrCounterInt(sink MetricSink, key []string, val int64, labels []Label) {
+	if is, ok := sink.(IntegerSink); ok {
+		is.IncrCounterIntWithLabels(key, val, labels)
+		return
+	}
+	sink.IncrCounterWithLabels(key, float32(val), labels)
+}
+
+// TimingSink is implemented by sinks that emit the durations measured with
+// MeasureSince apart from other samples, e.g. a StatsdSink with the timer
+// type "ms" while its other samples are histograms.
+type TimingSink interface {
+	// AddTimingSample adds a duration of val times unit to the samples of
+	// key
+	AddTimingSample(key []string, val float32, unit time.Duration, labels []Label)
+}
+
+// addTiming passes a duration of val times unit to sink. Sinks that do not
+// implement TimingSink receive val as a sample.
+func addTiming(sink MetricSink, key []string, val float32, unit time.Duration, labels []Label) {
+	if ts, ok := sink.(TimingSink); ok {
+		ts.AddTimingSample(key, val, unit, labels)
+		return
+	}
+	sink.AddSampleWithLabels(key, val, labels)
+}
+
+// CounterResetSink is implemented by sinks that track the cumulative value of
+// counters, so they can be told when a counter was reset at its source, e.g.
+// after the counted resource was recreated.
+type CounterResetSink interface {
+	ResetCounter(key []string, labels []Label)
+}
+
+// resetCounter passes a counter reset to sink. Sinks that do not implement
+// CounterResetSink only ever see deltas and ignore it.
+func resetCounter(sink MetricSink, key []string, labels []Label) {
+	if rs, ok := sink.(CounterResetSink); ok {
+		rs.ResetCounter(key, labels)
+	}
+}
+
+// Temporality is the aggregation temporality of a counter, telling backends
+// such as OTLP receivers whether its exported values are changes or running
+// totals. Getting it wrong corrupts the rates computed downstream.
+type Temporality int
+
+const (
+	// TemporalityDelta exports the increments of a counter as changes since
+	// the previous export, matching how counters are emitted
+	TemporalityDelta Temporality = iota
+
+	// TemporalityCumulative exports the running total of the increments of a
+	// counter since it started, or was last reset with ResetCounter
+	TemporalityCumulative
+)
+
+// TemporalitySink is implemented by sinks that export the aggregation
+// temporality of counters, such as OTLP exporters. Counters are
+// TemporalityDelta unless set otherwise.
+type TemporalitySink interface {
+	// SetCounterTemporality sets the temporality the counter key is
+	// exported with, for all of its label sets
+	SetCounterTemporality(key []string, temporality Temporality)
+}
+
+// setCounterTemporality passes the temporality of a counter to sink. Sinks
+// that do not implement TemporalitySink ignore it.
+func setCounterTemporality(sink MetricSink, key []string, temporality Temporality) {
+	if ts, ok := sink.(TemporalitySink); ok {
+		ts.SetCounterTemporality(key, temporality)
+	}
+}
+
+// ResourceLabelSink is implemented by sinks that place resource labels, which
+// describe the source of metrics such as its host or region, apart from the
+// dimensions of a measurement such as its endpoint or status, e.g. as OTLP
+// resource attributes or Cloud Monitoring resource labels.
+type ResourceLabelSink interface {
+	// SetResourceLabels marks the labels with the given names as resource
+	// labels in later emissions. Labels with other names are dimensions.
+	SetResourceLabels(names []string)
+}
+
+// setResourceLabels passes the names of resource labels to sink. Sinks that
+// do not implement ResourceLabelSink treat every label as a dimension.
+func setResourceLabels(sink MetricSink, names []string) {
+	if rs, ok := sink.(ResourceLabelSink); ok {
+		rs.SetResourceLabels(names)
+	}
+}
+
+// TimestampSink is implemented by sinks that send the time of emissions
+// along with them, such as rows or points with a timestamp.
+type TimestampSink interface {
+	// SetTimestampOffset adds offset to the timestamps of later emissions,
+	// correcting the clock skew of the host
+	SetTimestampOffset(offset time.Duration)
+}
+
+// setTimestampOffset passes a timestamp offset to sink. Sinks that do not
+// implement TimestampSink leave timing to the receiving end.
+func setTimestampOffset(sink MetricSink, offset time.Duration) {
+	if ts, ok := sink.(TimestampSink); ok {
+		ts.SetTimestampOffset(offset)
+	}
+}
+
 // BlackholeSink is used to just blackhole messages
 type BlackholeSink struct{}
 
@@ -35,6 +208,10 @@ func (*BlackholeSink) IncrCounterWithLabels(key []string, val float32, labels []
 func (*BlackholeSink) AddSample(key []string, val float32)                             {}
 func (*BlackholeSink) AddSampleWithLabels(key []string, val float32, labels []Label)   {}
 
+func (*BlackholeSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {}
+func (*BlackholeSink) AddTimingSample(key []string, val float32, unit time.Duration, labels []Label) {
+}
+
 // FanoutSink is used to sink to fanout values to multiple sinks
 type FanoutSink []MetricSink
 
@@ -74,6 +251,233 @@ func (fh FanoutSink) AddSampleWithLabels(key []string, val float32, labels []Lab
 	}
 }
 
+func (fh FanoutSink) AddTimingSample(key []string, val float32, unit time.Duration, labels []Label) {
+	for _, s := range fh {
+		addTiming(s, key, val, unit, labels)
+	}
+}
+
+func (fh FanoutSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	for _, s := range fh {
+		observeBuckets(s, key, counts, labels)
+	}
+}
+
+func (fh FanoutSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	for _, s := range fh {
+		setGaugeInt(s, key, val, labels)
+	}
+}
+
+func (fh FanoutSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	for _, s := range fh {
+		incrCounterInt(s, key, val, labels)
+	}
+}
+
+func (fh FanoutSink) ResetCounter(key []string, labels []Label) {
+	for _, s := range fh {
+		resetCounter(s, key, labels)
+	}
+}
+
+func (fh FanoutSink) SetCounterTemporality(key []string, temporality Temporality) {
+	for _, s := range fh {
+		setCounterTemporality(s, key, temporality)
+	}
+}
+
+func (fh FanoutSink) SetResourceLabels(names []string) {
+	for _, s := range fh {
+		setResourceLabels(s, names)
+	}
+}
+
+func (fh FanoutSink) SetTimestampOffset(offset time.Duration) {
+	for _, s := range fh {
+		setTimestampOffset(s, offset)
+	}
+}
+
+// LabelRoute directs emissions whose labels satisfy Match to Sinks
+type LabelRoute struct {
+	Match func(labels []Label) bool
+	Sinks []MetricSink
+}
+
+// LabelEquals returns a LabelRoute matcher that matches emissions carrying a
+// label with the given name and value
+func LabelEquals(name, value string) func([]Label) bool {
+	return func(labels []Label) bool {
+		for _, label := range labels {
+			if label.Name == name && label.Value == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RoutingFanoutSink is used to sink values to the subset of sinks selected
+// by the labels of each emission. The emission goes to the union of the
+// sinks of every route whose Match returns true, so a sink listed in several
+// matching routes receives it once. Emissions matching no route go to
+// Default. EmitKey carries no labels and is routed as an unlabeled emission.
+type RoutingFanoutSink struct {
+	Routes  []LabelRoute
+	Default []MetricSink
+}
+
+func (r *RoutingFanoutSink) SetGauge(key []string, val float32) {
+	r.SetGaugeWithLabels(key, val, nil)
+}
+
+func (r *RoutingFanoutSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	r.route(labels, func(s MetricSink) { s.SetGaugeWithLabels(key, val, labels) })
+}
+
+func (r *RoutingFanoutSink) EmitKey(key []string, val float32) {
+	r.route(nil, func(s MetricSink) { s.EmitKey(key, val) })
+}
+
+func (r *RoutingFanoutSink) IncrCounter(key []string, val float32) {
+	r.IncrCounterWithLabels(key, val, nil)
+}
+
+func (r *RoutingFanoutSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	r.route(labels, func(s MetricSink) { s.IncrCounterWithLabels(key, val, labels) })
+}
+
+func (r *RoutingFanoutSink) AddSample(key []string, val float32) {
+	r.AddSampleWithLabels(key, val, nil)
+}
+
+func (r *RoutingFanoutSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	r.route(labels, func(s MetricSink) { s.AddSampleWithLabels(key, val, labels) })
+}
+
+func (r *RoutingFanoutSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	r.route(labels, func(s MetricSink) { setGaugeInt(s, key, val, labels) })
+}
+
+func (r *RoutingFanoutSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	r.route(labels, func(s MetricSink) { incrCounterInt(s, key, val, labels) })
+}
+
+func (r *RoutingFanoutSink) ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	r.route(labels, func(s MetricSink) { observeBuckets(s, key, counts, labels) })
+}
+
+func (r *RoutingFanoutSink) AddTimingSample(key []string, val float32, unit time.Duration, labels []Label) {
+	r.route(labels, func(s MetricSink) { addTiming(s, key, val, unit, labels) })
+}
+
+func (r *RoutingFanoutSink) ResetCounter(key []string, labels []Label) {
+	r.route(labels, func(s MetricSink) { resetCounter(s, key, labels) })
+}
+
+// SetCounterTemporality passes the temporality to every sink of every route,
+// and to the default sinks, as the counter may carry any labels
+func (r *RoutingFanoutSink) SetCounterTemporality(key []string, temporality Temporality) {
+	for _, route := range r.Routes {
+		for _, s := range route.Sinks {
+			setCounterTemporality(s, key, temporality)
+		}
+	}
+	for _, s := range r.Default {
+		setCounterTemporality(s, key, temporality)
+	}
+}
+
+// SetResourceLabels passes the names to every sink of every route, and to
+// the default sinks
+func (r *RoutingFanoutSink) SetResourceLabels(names []string) {
+	for _, route := range r.Routes {
+		for _, s := range route.Sinks {
+			setResourceLabels(s, names)
+		}
+	}
+	for _, s := range r.Default {
+		setResourceLabels(s, names)
+	}
+}
+
+// SetTimestampOffset passes the offset to every sink of every route, and to
+// the default sinks
+func (r *RoutingFanoutSink) SetTimestampOffset(offset time.Duration) {
+	for _, route := range r.Routes {
+		for _, s := range route.Sinks {
+			setTimestampOffset(s, offset)
+		}
+	}
+	for _, s := range r.Default {
+		setTimestampOffset(s, offset)
+	}
+}
+
+// route calls emit for every sink selected by labels
+func (r *RoutingFanoutSink) route(labels []Label, emit func(MetricSink)) {
+	var matched []MetricSink
+	routes := 0
+	for _, route := range r.Routes {
+		if !route.Match(labels) {
+			continue
+		}
+		routes++
+		if routes == 1 {
+			matched = route.Sinks
+			continue
+		}
+		if routes == 2 {
+			// Copy before appending, so the sinks of the first route stay
+			// untouched
+			matched = append([]MetricSink(nil), matched...)
+		}
+		for _, s := range route.Sinks {
+			if !containsSink(matched, s) {
+				matched = append(matched, s)
+			}
+		}
+	}
+	if routes == 0 {
+		matched = r.Default
+	}
+	for _, s := range matched {
+		emit(s)
+	}
+}
+
+// containsSink returns whether sinks holds sink
+func containsSink(sinks []MetricSink, sink MetricSink) bool {
+	for _, s := range sinks {
+		if sameSink(s, sink) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameSink returns whether a and b are the same sink. Sinks of types which
+// can't be compared, such as a FanoutSink, are the same if they share their
+// backing array and length.
+func sameSink(a, b MetricSink) bool {
+	ta := reflect.TypeOf(a)
+	if ta != reflect.TypeOf(b) {
+		return false
+	}
+	if ta == nil || ta.Comparable() {
+		return a == b
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	switch va.Kind() {
+	case reflect.Slice:
+		return va.Pointer() == vb.Pointer() && va.Len() == vb.Len()
+	case reflect.Map, reflect.Func:
+		return va.Pointer() == vb.Pointer()
+	}
+	return false
+}
+
 // sinkURLFactoryFunc is an generic interface around the *SinkFromURL() function provided
 // by each sink type
 type sinkURLFactoryFunc func(*url.URL) (MetricSink, error)
@@ -81,9 +485,30 @@ type sinkURLFactoryFunc func(*url.URL) (MetricSink, error)
 // sinkRegistry supports the generic NewMetricSink function by mapping URL
 // schemes to metric sink factory functions
 var sinkRegistry = map[string]sinkURLFactoryFunc{
-	"statsd":   NewStatsdSinkFromURL,
-	"statsite": NewStatsiteSinkFromURL,
-	"inmem":    NewInmemSinkFromURL,
+	"statsd":         NewStatsdSinkFromURL,
+	statsdUnixScheme: NewStatsdSinkFromURL,
+	"statsite":       NewStatsiteSinkFromURL,
+	"inmem":          NewInmemSinkFromURL,
+}
+
+// sinkRegistryLock guards sinkRegistry against concurrent registration
+var sinkRegistryLock sync.RWMutex
+
+// RegisterSinkScheme makes a sink constructor available to
+// NewMetricSinkFromURL and NewSinkFromURL under the given URL scheme. It is
+// meant to be called from the init function of packages providing sinks. It
+// panics if ctor is nil or the scheme is already registered.
+func RegisterSinkScheme(scheme string, ctor func(*url.URL) (MetricSink, error)) {
+	sinkRegistryLock.Lock()
+	defer sinkRegistryLock.Unlock()
+
+	if ctor == nil {
+		panic("metrics: RegisterSinkScheme constructor is nil")
+	}
+	if _, dup := sinkRegistry[scheme]; dup {
+		panic(fmt.Sprintf("metrics: RegisterSinkScheme called twice for scheme %q", scheme))
+	}
+	sinkRegistry[scheme] = ctor
 }
 
 // NewMetricSinkFromURL allows a generic URL input to configure any of the
@@ -93,19 +518,31 @@ var sinkRegistry = map[string]sinkURLFactoryFunc{
 // "statsd://" - Initializes a StatsdSink. The host and port are passed through
 // as the "addr" of the sink
 //
+// "statsd+unix://" - Initializes a StatsdSink sending to the Unix datagram
+// socket at the path of the URL, e.g. "statsd+unix:///var/run/statsd.sock"
+//
 // "statsite://" - Initializes a StatsiteSink. The host and port become the
 // "addr" of the sink
 //
 // "inmem://" - Initializes an InmemSink. The host and port are ignored. The
 // "interval" and "duration" query parameters must be specified with valid
 // durations, see NewInmemSink for details.
+//
+// Additional schemes can be added with RegisterSinkScheme.
 func NewMetricSinkFromURL(urlStr string) (MetricSink, error) {
 	u, err := url.Parse(urlStr)
 	if err != nil {
 		return nil, err
 	}
+	return NewSinkFromURL(u)
+}
 
+// NewSinkFromURL is the same as NewMetricSinkFromURL, but takes an already
+// parsed URL.
+func NewSinkFromURL(u *url.URL) (MetricSink, error) {
+	sinkRegistryLock.RLock()
 	sinkURLFactoryFunc := sinkRegistry[u.Scheme]
+	sinkRegistryLock.RUnlock()
 	if sinkURLFactoryFunc == nil {
 		return nil, fmt.Errorf(
 			"cannot create metric sink, unrecognized sink name: %q", u.Scheme)
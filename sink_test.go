@@ -1,10 +1,13 @@
 package metrics
 
 import (
+	"math"
+	"net/url"
 	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 type MockSink struct {
@@ -246,6 +249,283 @@ func TestFanoutSink_Sample_Labels(t *testing.T) {
 	}
 }
 
+func TestFanoutSink_ObserveBuckets(t *testing.T) {
+	m := &MockSink{}
+	i := NewInmemSink(time.Hour, time.Hour)
+	fh := &FanoutSink{m, i}
+
+	k := []string{"test"}
+	l := []Label{{"a", "b"}}
+	fh.ObserveBuckets(k, map[float64]uint64{1: 2, 5: 1, math.Inf(1): 1}, l)
+
+	// The mock sink gets one sample per observation, at the bucket bound
+	// and at the largest finite bound for the overflow bucket.
+	counts := make(map[float32]int)
+	for idx, v := range m.vals {
+		if !reflect.DeepEqual(m.keys[idx], k) {
+			t.Fatalf("key not equal")
+		}
+		if !reflect.DeepEqual(m.labels[idx], l) {
+			t.Fatalf("labels not equal")
+		}
+		counts[v]++
+	}
+	if !reflect.DeepEqual(counts, map[float32]int{1: 2, 5: 2}) {
+		t.Fatalf("bad samples: %v", counts)
+	}
+
+	// The inmem sink gets the buckets as they are
+	sample := i.Data()[0].Samples["test;a=b"]
+	want := map[float64]uint64{1: 2, 5: 1, math.Inf(1): 1}
+	if !reflect.DeepEqual(sample.Buckets, want) {
+		t.Fatalf("bad buckets: %v", sample.Buckets)
+	}
+}
+
+func TestFanoutSink_Integers(t *testing.T) {
+	m := &MockSink{}
+	im := &intMockSink{}
+	fh := FanoutSink{m, im}
+
+	fh.IncrCounterIntWithLabels([]string{"c"}, 3, nil)
+	fh.SetGaugeIntWithLabels([]string{"g"}, 5, nil)
+	if !reflect.DeepEqual(m.vals, []float32{3, 5}) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+	if !reflect.DeepEqual(im.intVals, []int64{3, 5}) {
+		t.Fatalf("bad int vals: %v", im.intVals)
+	}
+}
+
+func TestFanoutSink_ResetCounter(t *testing.T) {
+	m := &MockSink{}
+	rm := &resetMockSink{}
+	fh := FanoutSink{m, rm}
+
+	fh.ResetCounter([]string{"c"}, []Label{{"a", "b"}})
+	if len(m.keys) != 0 {
+		t.Fatalf("bad keys: %v", m.keys)
+	}
+	if !reflect.DeepEqual(rm.resets, [][]string{{"c"}}) {
+		t.Fatalf("bad resets: %v", rm.resets)
+	}
+}
+
+// resourceMockSink is a ResourceLabelSink recording the resource and
+// dimension labels of every emission separately
+type resourceMockSink struct {
+	MockSink
+	resourceNames map[string]bool
+	resources     [][]Label
+	dimensions    [][]Label
+}
+
+func (m *resourceMockSink) SetResourceLabels(names []string) {
+	if m.resourceNames == nil {
+		m.resourceNames = make(map[string]bool)
+	}
+	for _, name := range names {
+		m.resourceNames[name] = true
+	}
+}
+
+func (m *resourceMockSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	m.MockSink.SetGaugeWithLabels(key, val, labels)
+	var resource, dimensions []Label
+	for _, label := range labels {
+		if m.resourceNames[label.Name] {
+			resource = append(resource, label)
+		} else {
+			dimensions = append(dimensions, label)
+		}
+	}
+	m.resources = append(m.resources, resource)
+	m.dimensions = append(m.dimensions, dimensions)
+}
+
+func TestFanoutSink_ResourceLabels(t *testing.T) {
+	m := &MockSink{}
+	rm := &resourceMockSink{}
+	rm2 := &resourceMockSink{}
+	fh := FanoutSink{m, rm, &RoutingFanoutSink{
+		Routes: []LabelRoute{{Match: LabelEquals("a", "b"), Sinks: []MetricSink{rm2}}},
+	}}
+
+	fh.SetResourceLabels([]string{"region"})
+	if !rm.resourceNames["region"] || !rm2.resourceNames["region"] {
+		t.Fatalf("bad names: %v %v", rm.resourceNames, rm2.resourceNames)
+	}
+}
+
+func TestWrapperSinks_ResourceLabels(t *testing.T) {
+	wrappers := map[string]func(MetricSink) MetricSink{
+		"LabelFilterSink": func(s MetricSink) MetricSink { return NewLabelFilterSink(s, nil, nil) },
+		"SampledSink":     func(s MetricSink) MetricSink { return NewSampledSink(s, Label{"debug", "true"}, nil) },
+		"GaugeRoundingSink": func(s MetricSink) MetricSink {
+			return NewGaugeRoundingSink(s, 3)
+		},
+		"CircuitBreakerSink": func(s MetricSink) MetricSink { return &CircuitBreakerSink{sink: s} },
+	}
+	for name, wrap := range wrappers {
+		rm := &resourceMockSink{}
+		setResourceLabels(wrap(rm), []string{"region"})
+		if !rm.resourceNames["region"] {
+			t.Fatalf("%s did not pass the names on", name)
+		}
+	}
+}
+
+// offsetMockSink is a TimestampSink recording its offset
+type offsetMockSink struct {
+	MockSink
+	offset time.Duration
+}
+
+func (m *offsetMockSink) SetTimestampOffset(offset time.Duration) {
+	m.offset = offset
+}
+
+func TestWrapperSinks_TimestampOffset(t *testing.T) {
+	om := &offsetMockSink{}
+	om2 := &offsetMockSink{}
+	wrapped := FanoutSink{
+		NewLabelFilterSink(om, nil, nil),
+		&RoutingFanoutSink{Default: []MetricSink{
+			NewSampledSink(NewGaugeRoundingSink(&CircuitBreakerSink{sink: om2}, 3), Label{"debug", "true"}, nil),
+		}},
+		&MockSink{},
+	}
+
+	setTimestampOffset(wrapped, -2*time.Second)
+	if om.offset != -2*time.Second || om2.offset != -2*time.Second {
+		t.Fatalf("bad offsets: %v %v", om.offset, om2.offset)
+	}
+}
+
+// temporalityMockSink records the temporalities of counters
+type temporalityMockSink struct {
+	MockSink
+	temporalities map[string]Temporality
+}
+
+func (m *temporalityMockSink) SetCounterTemporality(key []string, temporality Temporality) {
+	if m.temporalities == nil {
+		m.temporalities = make(map[string]Temporality)
+	}
+	m.temporalities[strings.Join(key, ".")] = temporality
+}
+
+func TestWrapperSinks_CounterTemporality(t *testing.T) {
+	tm := &temporalityMockSink{}
+	tm2 := &temporalityMockSink{}
+	wrapped := FanoutSink{
+		NewLabelFilterSink(tm, nil, nil),
+		&RoutingFanoutSink{Default: []MetricSink{
+			NewSampledSink(NewGaugeRoundingSink(&CircuitBreakerSink{sink: tm2}, 3), Label{"debug", "true"}, nil),
+		}},
+		&MockSink{},
+	}
+
+	setCounterTemporality(wrapped, []string{"requests"}, TemporalityCumulative)
+	expect := map[string]Temporality{"requests": TemporalityCumulative}
+	if !reflect.DeepEqual(tm.temporalities, expect) || !reflect.DeepEqual(tm2.temporalities, expect) {
+		t.Fatalf("bad temporalities: %v %v", tm.temporalities, tm2.temporalities)
+	}
+}
+
+func TestObserveBuckets_OnlyOverflow(t *testing.T) {
+	m := &MockSink{}
+	observeBuckets(m, []string{"test"}, map[float64]uint64{math.Inf(1): 3}, nil)
+	if len(m.vals) != 0 {
+		t.Fatalf("unexpected samples: %v", m.vals)
+	}
+}
+
+func TestRoutingFanoutSink(t *testing.T) {
+	internal := &MockSink{}
+	audit := &MockSink{}
+	external := &MockSink{}
+	shared := &MockSink{}
+	fanned := &MockSink{}
+	fanout := FanoutSink{fanned}
+	r := &RoutingFanoutSink{
+		Routes: []LabelRoute{
+			{Match: LabelEquals("sensitive", "true"), Sinks: []MetricSink{internal, shared, fanout}},
+			{Match: LabelEquals("audit", "true"), Sinks: []MetricSink{audit, shared, fanout}},
+		},
+		Default: []MetricSink{external},
+	}
+
+	k := []string{"test"}
+	sensitive := []Label{{"sensitive", "true"}}
+	both := []Label{{"sensitive", "true"}, {"audit", "true"}}
+
+	// Match
+	r.SetGaugeWithLabels(k, 1, sensitive)
+	// No match goes to the default sinks
+	r.IncrCounterWithLabels(k, 2, []Label{{"sensitive", "false"}})
+	r.AddSample(k, 3)
+	r.EmitKey(k, 4)
+	// Multiple matches go to the sinks of every matching route, once each
+	r.AddSampleWithLabels(k, 5, both)
+
+	if !reflect.DeepEqual(internal.vals, []float32{1, 5}) {
+		t.Fatalf("bad internal vals: %v", internal.vals)
+	}
+	if !reflect.DeepEqual(internal.labels, [][]Label{sensitive, both}) {
+		t.Fatalf("bad internal labels: %v", internal.labels)
+	}
+	if !reflect.DeepEqual(audit.vals, []float32{5}) {
+		t.Fatalf("bad audit vals: %v", audit.vals)
+	}
+	if !reflect.DeepEqual(shared.vals, []float32{1, 5}) || !reflect.DeepEqual(fanned.vals, []float32{1, 5}) {
+		t.Fatalf("bad shared vals: %v %v", shared.vals, fanned.vals)
+	}
+	if !reflect.DeepEqual(external.vals, []float32{2, 3, 4}) {
+		t.Fatalf("bad external vals: %v", external.vals)
+	}
+}
+
+func TestRoutingFanoutSink_ObserveBuckets(t *testing.T) {
+	routed := NewInmemSink(time.Hour, time.Hour)
+	external := NewInmemSink(time.Hour, time.Hour)
+	r := &RoutingFanoutSink{
+		Routes:  []LabelRoute{{Match: LabelEquals("sensitive", "true"), Sinks: []MetricSink{routed}}},
+		Default: []MetricSink{external},
+	}
+
+	// Buckets are routed by labels and reach the sinks as they are
+	counts := map[float64]uint64{1: 2, 5: 1, math.Inf(1): 1}
+	r.ObserveBuckets([]string{"test"}, counts, []Label{{"sensitive", "true"}})
+	if sample := routed.Data()[0].Samples["test;sensitive=true"]; !reflect.DeepEqual(sample.Buckets, counts) {
+		t.Fatalf("bad buckets: %v", sample.Buckets)
+	}
+	if samples := external.Data()[0].Samples; len(samples) != 0 {
+		t.Fatalf("bad samples: %v", samples)
+	}
+}
+
+func TestRoutingFanoutSink_Integers(t *testing.T) {
+	routed := &intMockSink{}
+	external := &intMockSink{}
+	r := &RoutingFanoutSink{
+		Routes:  []LabelRoute{{Match: LabelEquals("sensitive", "true"), Sinks: []MetricSink{routed}}},
+		Default: []MetricSink{external},
+	}
+
+	// Integers are routed by labels and reach the sinks as integers
+	sensitive := []Label{{"sensitive", "true"}}
+	r.IncrCounterIntWithLabels([]string{"c"}, 4, sensitive)
+	r.SetGaugeIntWithLabels([]string{"g"}, 5, sensitive)
+	r.IncrCounterIntWithLabels([]string{"c"}, 6, nil)
+	if !reflect.DeepEqual(routed.intVals, []int64{4, 5}) || len(routed.vals) != 0 {
+		t.Fatalf("bad routed values: %v %v", routed.intVals, routed.vals)
+	}
+	if !reflect.DeepEqual(external.intVals, []int64{6}) || len(external.vals) != 0 {
+		t.Fatalf("bad external values: %v %v", external.intVals, external.vals)
+	}
+}
+
 func TestNewMetricSinkFromURL(t *testing.T) {
 	for _, tc := range []struct {
 		desc      string
@@ -292,3 +572,42 @@ func TestNewMetricSinkFromURL(t *testing.T) {
 		})
 	}
 }
+
+func TestRegisterSinkScheme(t *testing.T) {
+	var got *url.URL
+	mock := &MockSink{}
+	RegisterSinkScheme("mock", func(u *url.URL) (MetricSink, error) {
+		got = u
+		return mock, nil
+	})
+	defer func() {
+		sinkRegistryLock.Lock()
+		delete(sinkRegistry, "mock")
+		sinkRegistryLock.Unlock()
+	}()
+
+	ms, err := NewMetricSinkFromURL("mock://collector:1234?flush=10s")
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if ms != mock {
+		t.Fatalf("expected the registered sink, got: %v", ms)
+	}
+	if got.Host != "collector:1234" || got.Query().Get("flush") != "10s" {
+		t.Fatalf("bad URL passed to constructor: %v", got)
+	}
+
+	u, _ := url.Parse("mock://other")
+	if ms, err := NewSinkFromURL(u); err != nil || ms != mock {
+		t.Fatalf("unexpected result: %v, %v", ms, err)
+	}
+}
+
+func TestRegisterSinkScheme_Duplicate(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("expected a panic registering a duplicate scheme")
+		}
+	}()
+	RegisterSinkScheme("statsd", NewStatsdSinkFromURL)
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SinkStats holds the delivery health counters of a sink. Both counts are
+// totals since the sink was created.
+type SinkStats struct {
+	Dropped uint64 // Metrics discarded without being delivered
+	Errors  uint64 // Failed connections, writes or requests
+}
+
+// SinkStatsReporter is implemented by sinks which track delivery failures
+type SinkStatsReporter interface {
+	SinkStats() SinkStats
+}
+
+// sinkStatsEntry is a registered SinkStatsReporter along with the stats it
+// reported when they were last emitted
+type sinkStatsEntry struct {
+	name     string
+	reporter SinkStatsReporter
+	last     SinkStats
+}
+
+// RegisterSinkStats adds a sink whose SinkStats are emitted by
+// EmitSinkStats, labelled with sink=name. Registering a name again replaces
+// the sink registered under it.
+func (m *Metrics) RegisterSinkStats(name string, reporter SinkStatsReporter) {
+	m.sinkStatsLock.Lock()
+	defer m.sinkStatsLock.Unlock()
+
+	entry := &sinkStatsEntry{name: name, reporter: reporter, last: reporter.SinkStats()}
+	for i, e := range m.sinkStats {
+		if e.name == name {
+			m.sinkStats[i] = entry
+			return
+		}
+	}
+	m.sinkStats = append(m.sinkStats, entry)
+}
+
+// Periodically emits the stats of the registered sinks
+func (m *Metrics) collectSinkStats() {
+	for {
+		time.Sleep(m.ProfileInterval)
+		m.EmitSinkStats()
+	}
+}
+
+// EmitSinkStats emits the metrics dropped and errors seen by every
+// registered sink since the last call, as the counters metrics.sink.dropped
+// and metrics.sink.errors. They are emitted through the regular pipeline, so
+// they reach the reporting sinks themselves. A call made while emitting,
+// e.g. by a sink reacting to the emitted counters, returns immediately so
+// the stats can not feed back into themselves.
+func (m *Metrics) EmitSinkStats() {
+	if !atomic.CompareAndSwapInt32(&m.emittingSinkStats, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&m.emittingSinkStats, 0)
+
+	type delta struct {
+		name            string
+		dropped, errors uint64
+	}
+	m.sinkStatsLock.Lock()
+	deltas := make([]delta, 0, len(m.sinkStats))
+	for _, e := range m.sinkStats {
+		stats := e.reporter.SinkStats()
+		deltas = append(deltas, delta{
+			name:    e.name,
+			dropped: stats.Dropped - e.last.Dropped,
+			errors:  stats.Errors - e.last.Errors,
+		})
+		e.last = stats
+	}
+	m.sinkStatsLock.Unlock()
+
+	for _, d := range deltas {
+		labels := []Label{{"sink", d.name}}
+		if d.dropped > 0 {
+			m.IncrCounterWithLabels([]string{"metrics", "sink", "dropped"}, float32(d.dropped), labels)
+		}
+		if d.errors > 0 {
+			m.IncrCounterWithLabels([]string{"metrics", "sink", "errors"}, float32(d.errors), labels)
+		}
+	}
+}
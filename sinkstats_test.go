@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeStatsReporter reports stats set by the test
+type fakeStatsReporter struct {
+	lock  sync.Mutex
+	stats SinkStats
+}
+
+func (f *fakeStatsReporter) SinkStats() SinkStats {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.stats
+}
+
+func (f *fakeStatsReporter) add(dropped, errors uint64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.stats.Dropped += dropped
+	f.stats.Errors += errors
+}
+
+func TestMetrics_EmitSinkStats(t *testing.T) {
+	m, met := mockMetric()
+
+	a, b := &fakeStatsReporter{}, &fakeStatsReporter{}
+	a.add(10, 10) // Counted before registration, not emitted
+	met.RegisterSinkStats("a", a)
+	met.RegisterSinkStats("b", b)
+
+	a.add(3, 1)
+	b.add(0, 2)
+	met.EmitSinkStats()
+
+	want := []struct {
+		key   []string
+		val   float32
+		label string
+	}{
+		{[]string{"metrics", "sink", "dropped"}, 3, "a"},
+		{[]string{"metrics", "sink", "errors"}, 1, "a"},
+		{[]string{"metrics", "sink", "errors"}, 2, "b"},
+	}
+	if len(m.getKeys()) != len(want) {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+	for i, w := range want {
+		if !reflect.DeepEqual(m.keys[i], w.key) || m.vals[i] != w.val {
+			t.Fatalf("bad metric %d: %v %v", i, m.keys[i], m.vals[i])
+		}
+		if !reflect.DeepEqual(m.labels[i], []Label{{"sink", w.label}}) {
+			t.Fatalf("bad labels %d: %v", i, m.labels[i])
+		}
+	}
+
+	// Nothing changed, nothing is emitted
+	met.EmitSinkStats()
+	if len(m.getKeys()) != len(want) {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+}
+
+func TestMetrics_RegisterSinkStats_Replace(t *testing.T) {
+	m, met := mockMetric()
+
+	met.RegisterSinkStats("a", &fakeStatsReporter{})
+	r := &fakeStatsReporter{}
+	met.RegisterSinkStats("a", r)
+	r.add(1, 0)
+	met.EmitSinkStats()
+
+	if len(m.getKeys()) != 1 || m.vals[0] != 1 {
+		t.Fatalf("bad metrics: %v %v", m.getKeys(), m.vals)
+	}
+}
+
+// reentrantSink fails every counter it receives, then calls EmitSinkStats
+type reentrantSink struct {
+	MockSink
+	met      *Metrics
+	reporter *fakeStatsReporter
+}
+
+func (r *reentrantSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	r.MockSink.IncrCounterWithLabels(key, val, labels)
+	r.reporter.add(0, 1)
+	r.met.EmitSinkStats()
+}
+
+func TestMetrics_EmitSinkStats_NoLoop(t *testing.T) {
+	r := &fakeStatsReporter{}
+	sink := &reentrantSink{reporter: r}
+	met := &Metrics{Config: Config{FilterDefault: true}, sink: sink}
+	sink.met = met
+	met.RegisterSinkStats("a", r)
+
+	r.add(1, 1)
+	met.EmitSinkStats()
+	if len(sink.getKeys()) != 2 {
+		t.Fatalf("bad keys: %v", sink.getKeys())
+	}
+
+	// The errors caused by the emission itself show up in the next one
+	met.EmitSinkStats()
+	if len(sink.getKeys()) != 3 || sink.vals[2] != 2 {
+		t.Fatalf("bad metrics: %v %v", sink.getKeys(), sink.vals)
+	}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"context"
+)
+
+// SpanLabeler supplies the labels of the span carried by a context, e.g. its
+// attributes, to add to the metrics emitted within the span, so metrics and
+// traces share their dimensions. Tracing libraries plug in with an adapter
+// implementing it, which keeps them out of the dependencies of the package.
+// It is called for every Scope created by WithContext, from many goroutines
+// at once.
+type SpanLabeler interface {
+	// SpanLabels returns the labels of the span of ctx, or nil if ctx
+	// carries no span
+	SpanLabels(ctx context.Context) []Label
+}
+
+// SpanLabelerFunc is an adapter to use a function as a SpanLabeler
+type SpanLabelerFunc func(ctx context.Context) []Label
+
+func (f SpanLabelerFunc) SpanLabels(ctx context.Context) []Label {
+	return f(ctx)
+}
+
+// WithContext returns a Scope adding the labels the SpanLabeler of the config
+// supplies for the span of ctx to the metrics emitted through it, e.g.
+// m.WithContext(ctx).IncrCounter(key, 1) in a request handler. The labels are
+// read once, when the scope is created. Without a SpanLabeler, or if ctx
+// carries no span, the scope adds no labels.
+func (m *Metrics) WithContext(ctx context.Context) *Scope {
+	return &Scope{m: m, labels: mergeLabels(nil, m.spanLabels(ctx))}
+}
+
+// WithContext returns a child Scope with the labels of the span of ctx merged
+// on top of the labels of s, as Metrics.WithContext does
+func (s *Scope) WithContext(ctx context.Context) *Scope {
+	labels := s.m.spanLabels(ctx)
+	if len(labels) == 0 {
+		return s
+	}
+	return s.Scoped(labels)
+}
+
+// spanLabels returns the labels of the span of ctx, if any
+func (m *Metrics) spanLabels(ctx context.Context) []Label {
+	if m.SpanLabeler == nil || ctx == nil {
+		return nil
+	}
+	return m.SpanLabeler.SpanLabels(ctx)
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// fakeSpan is the span of a fake tracing library
+type fakeSpan struct {
+	attributes map[string]string
+}
+
+type fakeSpanKey struct{}
+
+// fakeSpanLabeler supplies the attributes of fake spans, sorted by name
+type fakeSpanLabeler struct{}
+
+func (fakeSpanLabeler) SpanLabels(ctx context.Context) []Label {
+	span, ok := ctx.Value(fakeSpanKey{}).(*fakeSpan)
+	if !ok {
+		return nil
+	}
+	var labels []Label
+	for _, name := range []string{"operation", "tenant"} {
+		if value, ok := span.attributes[name]; ok {
+			labels = append(labels, Label{name, value})
+		}
+	}
+	return labels
+}
+
+func TestMetrics_WithContext(t *testing.T) {
+	m, met := mockMetric()
+	met.SpanLabeler = fakeSpanLabeler{}
+	span := &fakeSpan{attributes: map[string]string{"operation": "checkout", "tenant": "acme"}}
+	ctx := context.WithValue(context.Background(), fakeSpanKey{}, span)
+
+	// Emissions within the span inherit its labels, which labels given at
+	// the call site override
+	met.WithContext(ctx).IncrCounter([]string{"orders"}, 1)
+	met.WithContext(ctx).AddSampleWithLabels([]string{"latency"}, 5, []Label{{"tenant", "other"}})
+	expect := [][]Label{
+		{{"operation", "checkout"}, {"tenant", "acme"}},
+		{{"operation", "checkout"}, {"tenant", "other"}},
+	}
+	if !reflect.DeepEqual(m.labels, expect) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+
+	// Span labels take precedence over those of a parent scope
+	m.labels = nil
+	met.Scoped([]Label{{"tenant", "fallback"}, {"region", "eu"}}).WithContext(ctx).SetGauge([]string{"cart"}, 3)
+	expect = [][]Label{{{"operation", "checkout"}, {"region", "eu"}, {"tenant", "acme"}}}
+	if !reflect.DeepEqual(m.labels, expect) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+
+	// Contexts without a span add nothing
+	m.labels = nil
+	met.WithContext(context.Background()).IncrCounter([]string{"orders"}, 1)
+	if len(m.labels) != 1 || len(m.labels[0]) != 0 {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+}
+
+func TestMetrics_WithContextNoLabeler(t *testing.T) {
+	m, met := mockMetric()
+	span := &fakeSpan{attributes: map[string]string{"tenant": "acme"}}
+	ctx := context.WithValue(context.Background(), fakeSpanKey{}, span)
+	met.WithContext(ctx).IncrCounter([]string{"orders"}, 1)
+	if len(m.labels) != 1 || len(m.labels[0]) != 0 {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+
+	// Functions can supply the labels too
+	met.SpanLabeler = SpanLabelerFunc(func(ctx context.Context) []Label {
+		return []Label{{"traced", "true"}}
+	})
+	met.WithContext(ctx).IncrCounter([]string{"orders"}, 1)
+	if !reflect.DeepEqual(m.labels[1], []Label{{"traced", "true"}}) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// StackTagLabel is the name of the label holding the stack fingerprint of
+// samples tagged as set by Config.StackTagRate
+const StackTagLabel = "stack"
+
+// stackTagDepth is the number of frames a stack fingerprint covers
+const stackTagDepth = 8
+
+// packageDir is the directory of the files of this package, whose frames are
+// left out of stack fingerprints
+var packageDir = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return path.Dir(file)
+}()
+
+// tagStack returns labels with the stack fingerprint of the caller appended,
+// for the fraction of calls set by StackTagRate
+func (m *Metrics) tagStack(labels []Label) []Label {
+	if m.StackTagRate <= 0 || rand.Float64() >= m.StackTagRate {
+		return labels
+	}
+	return append(labels, Label{StackTagLabel, stackFingerprint()})
+}
+
+// stackFingerprint returns a short hash of the functions and lines of the
+// innermost frames calling into this package. Since it doesn't depend on the
+// addresses of the frames, it is the same for a code path across processes
+// running the same build.
+func stackFingerprint() string {
+	pcs := make([]uintptr, stackTagDepth+16)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	h := fnv.New32a()
+	depth := 0
+	for depth < stackTagDepth {
+		frame, more := frames.Next()
+		if !isPackageFrame(frame) {
+			fmt.Fprintf(h, "%s:%d;", frame.Function, frame.Line)
+			depth++
+		}
+		if !more {
+			break
+		}
+	}
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// isPackageFrame returns whether frame is in a non-test file of this package,
+// or a wrapper generated by the compiler, such as for a method value
+func isPackageFrame(frame runtime.Frame) bool {
+	if frame.File == "<autogenerated>" {
+		return true
+	}
+	return path.Dir(frame.File) == packageDir && !strings.HasSuffix(frame.File, "_test.go")
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+// stackTags returns the stack labels of the samples of m
+func stackTags(m *MockSink) []string {
+	var tags []string
+	for _, labels := range m.labels {
+		for _, label := range labels {
+			if label.Name == StackTagLabel {
+				tags = append(tags, label.Value)
+			}
+		}
+	}
+	return tags
+}
+
+func TestMetrics_StackTagRate(t *testing.T) {
+	// Disabled by default
+	m, met := mockMetric()
+	for i := 0; i < 100; i++ {
+		met.AddSample([]string{"key"}, 1)
+	}
+	if tags := stackTags(m); len(tags) != 0 {
+		t.Fatalf("unexpected tags: %v", tags)
+	}
+
+	// Every sample and timer is tagged at a rate of 1, other metrics never
+	m, met = mockMetric()
+	met.StackTagRate = 1
+	met.TimerGranularity = time.Millisecond
+	labels := []Label{{"a", "b"}}
+	met.AddSampleWithLabels([]string{"key"}, 1, labels)
+	met.MeasureSince([]string{"timer"}, time.Now())
+	met.IncrCounter([]string{"counter"}, 1)
+	met.SetGauge([]string{"gauge"}, 1)
+	if tags := stackTags(m); len(tags) != 2 || len(tags[0]) != 8 {
+		t.Fatalf("bad tags: %v", tags)
+	}
+	if m.labels[0][0] != labels[0] {
+		t.Fatalf("bad labels: %v", m.labels[0])
+	}
+
+	// Only a fraction is tagged otherwise
+	m, met = mockMetric()
+	met.StackTagRate = 0.05
+	for i := 0; i < 10000; i++ {
+		met.AddSample([]string{"key"}, 1)
+	}
+	if n := len(stackTags(m)); n < 250 || n > 750 {
+		t.Fatalf("bad number of tags: %d", n)
+	}
+
+	// The tag label can be filtered like any other
+	m, met = mockMetric()
+	met.StackTagRate = 1
+	met.UpdateFilterAndLabels(nil, nil, nil, []string{StackTagLabel})
+	met.AddSample([]string{"key"}, 1)
+	if tags := stackTags(m); len(tags) != 0 || len(m.keys) != 1 {
+		t.Fatalf("unexpected tags: %v", tags)
+	}
+}
+
+func TestMetrics_StackTagFingerprint(t *testing.T) {
+	m, met := mockMetric()
+	met.StackTagRate = 1
+	scope := met.Scoped(nil)
+
+	// The same code path always gets the same fingerprint, whatever the
+	// entry point into the package
+	for _, add := range []func([]string, float32){met.AddSample, met.AddSample, scope.AddSample} {
+		add([]string{"key"}, 1)
+	}
+	// Another path gets another fingerprint
+	met.AddSample([]string{"key"}, 1)
+
+	tags := stackTags(m)
+	if len(tags) != 4 {
+		t.Fatalf("bad tags: %v", tags)
+	}
+	if tags[0] != tags[1] || tags[1] != tags[2] {
+		t.Fatalf("fingerprint not stable: %v", tags)
+	}
+	if tags[0] == tags[3] {
+		t.Fatalf("distinct paths share a fingerprint: %v", tags)
+	}
+}
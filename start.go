@@ -17,27 +17,241 @@ type Config struct {
 	EnableHostnameLabel  bool          // Enable adding hostname to labels
 	EnableServiceLabel   bool          // Enable adding service to labels
 	EnableRuntimeMetrics bool          // Enables profiling of runtime metrics (GC, Goroutines, Memory)
+	EnableSinkStats      bool          // Enables emitting dropped and error counts of sinks added with RegisterSinkStats
+	EnableStartTimeGauge bool          // Enables a gauge with the process start time in Unix seconds, refreshed every ProfileInterval
+	EnableGoroutineGauge bool          // Enables the gauge metrics.goroutines with the goroutines started by the package and its sinks, refreshed every ProfileInterval
+	EnableSelfTest       bool          // Enables running RunSelfTest every SelfTestInterval, exposing the health of the pipeline as the gauge metrics.pipeline_healthy
 	EnableTypePrefix     bool          // Prefixes key with a type ("counter", "gauge", "timer")
 	TimerGranularity     time.Duration // Granularity of timers.
+	TimerCountSuffix     string        // Key suffix of the counters of MeasureSinceWithCount, "count" if empty
+	StartTimeGaugeName   string        // Key of the start time gauge with '.' as the separator, "process.start_time_seconds" if empty
 	ProfileInterval      time.Duration // Interval to profile runtime metrics
+	SelfTestInterval     time.Duration // Interval of the self-test, ProfileInterval if zero
+	SelfTestCanaryName   string        // Key of the canary gauge of the self-test with '.' as the separator, "metrics.canary" if empty
+
+	EmptyKeySegments  EmptySegmentPolicy // Handling of metrics whose key has empty segments, kept as-is by default
+	MixedTypeKeys     TypeConflictPolicy // Handling of keys emitted as more than one metric type, not checked by default
+	TimerPrecision    TimerPrecision     // Precision of the values of timers, full by default
+	LabelKeyCase      LabelKeyCase       // Normalization of label names before they are filtered, kept as-is by default
+	LabelOrder        LabelOrder         // Order of the labels passed to the sinks, sorted by name without duplicates by default
+	HostnamePlacement HostnamePlacement  // Where the hostname is added, as each of EnableHostname and EnableHostnameLabel does by default
+	MaxKeyDepth       int                // Maximum number of segments of keys, including the prefixes added by Metrics, unlimited if zero
+	KeyDepth          KeyDepthPolicy     // Handling of metrics whose key has more than MaxKeyDepth segments, dropped by default
+
+	TrimLabelValues      bool // Trims the whitespace around label values before they are filtered
+	LowercaseLabelValues bool // Lowercases label values before they are filtered
 
 	AllowedPrefixes []string // A list of metric prefixes to allow, with '.' as the separator
 	BlockedPrefixes []string // A list of metric prefixes to block, with '.' as the separator
 	AllowedLabels   []string // A list of metric labels to allow, with '.' as the separator
 	BlockedLabels   []string // A list of metric labels to block, with '.' as the separator
 	FilterDefault   bool     // Whether to allow metrics by default
+
+	// RuntimeMetricNames renames the runtime metrics, mapping their keys,
+	// e.g. "runtime.alloc_bytes", to the keys to emit them under instead,
+	// e.g. "process.memory.allocated_bytes", both with '.' as the separator.
+	// Runtime metrics which are not mapped keep their keys.
+	RuntimeMetricNames map[string]string
+
+	ResourceLabels []string // Names of labels passed to sinks implementing ResourceLabelSink as resource labels rather than dimensions
+
+	TimestampOffset time.Duration // Added to the timestamps of sinks implementing TimestampSink, to correct a known clock skew of the host
+
+	RuntimeBackoff *RuntimeBackoff // Backs off runtime metrics collection while GC pauses are long, disabled if nil
+
+	// ValueMultiplier, if set, scales every counter increment and sample
+	// value before it is emitted, e.g. 0.1 to report real rates while
+	// replaying traffic at 10x in a load test. It changes the emitted values
+	// themselves, including those of the runtime and sink stats, so it
+	// should only be set in such tests. Gauges, timers and bucket
+	// observations are not scaled.
+	ValueMultiplier float64
+
+	// StackTagRate, if set, is the fraction of samples and timers labelled
+	// with a fingerprint of the code path emitting them, under
+	// StackTagLabel, to correlate slow samples with the code paths behind
+	// them. Capturing the stack is costly, so it should be rare, e.g. 0.001.
+	// Every distinct path adds series to the tagged metrics.
+	StackTagRate float64
+
+	// ThresholdLabels attach labels to the gauges, samples and timers whose
+	// value crosses a threshold, e.g. slow=true to slow requests. Every
+	// matching rule adds its label.
+	ThresholdLabels []ThresholdLabel
+
+	// SpanLabeler, if set, supplies the labels of the spans of contexts,
+	// which the scopes returned by WithContext add to their emissions
+	SpanLabeler SpanLabeler
+
+	// Middlewares transform or drop every emission, in order, after it is
+	// filtered and before it reaches the sink, e.g. ClampValues or
+	// RedactLabels
+	Middlewares []Middleware
+
+	// SelfLatencySink, if set, receives the time spent in the emit calls of
+	// Metrics as the sample metrics.emit.latency, in microseconds, labelled
+	// with the type of the call, to quantify the overhead of the
+	// instrumentation. It should be a sink which doesn't emit through the
+	// same Metrics, e.g. a separate InmemSink. SelfLatencyRate is the
+	// fraction of the calls measured, e.g. 0.01, as measuring has a cost of
+	// its own. Nothing is measured if it is zero.
+	SelfLatencySink MetricSink
+	SelfLatencyRate float64
 }
 
+// EmptySegmentPolicy selects how metrics whose key has empty segments, e.g.
+// []string{"", "foo"}, are handled. Such keys flatten to malformed names like
+// ".foo", and usually come from a variable key segment which is accidentally
+// empty.
+type EmptySegmentPolicy int
+
+const (
+	// EmptySegmentsKeep emits keys with empty segments as they are
+	EmptySegmentsKeep EmptySegmentPolicy = iota
+
+	// EmptySegmentsDrop drops metrics whose key has an empty segment,
+	// counting them in Metrics.EmptyKeyDrops
+	EmptySegmentsDrop
+
+	// EmptySegmentsCollapse removes the empty segments from keys. Metrics
+	// whose key has only empty segments are dropped and counted.
+	EmptySegmentsCollapse
+)
+
+// KeyDepthPolicy selects how metrics whose key has more segments than
+// Config.MaxKeyDepth are handled, e.g. for backends rejecting names with too
+// many dotted segments. The depth counts the prefixes added by Metrics, such
+// as the service name and hostname, but not the changes of Middlewares.
+type KeyDepthPolicy int
+
+const (
+	// KeyDepthDrop drops metrics whose key is too deep, counting them in
+	// Metrics.DeepKeys
+	KeyDepthDrop KeyDepthPolicy = iota
+
+	// KeyDepthTruncate emits metrics whose key is too deep under its first
+	// MaxKeyDepth segments, counting them in Metrics.DeepKeys. Keys differing
+	// only past the depth are merged.
+	KeyDepthTruncate
+)
+
+// TypeConflictPolicy selects how keys which are emitted as more than one
+// metric type are handled, e.g. "jobs" set as a gauge in one place and
+// incremented as a counter in another. Backends usually keep a single type
+// per name, so such conflicts corrupt or drop data in subtle ways.
+//
+// Checking records the first type emitted under every key, on top of the
+// prefixes added by Metrics, for the lifetime of the Metrics instance. It
+// costs a lookup per emission and memory per key, so it is meant for
+// debugging and tests. Timers count as samples.
+type TypeConflictPolicy int
+
+const (
+	// TypeConflictsIgnore doesn't check keys for type conflicts
+	TypeConflictsIgnore TypeConflictPolicy = iota
+
+	// TypeConflictsWarn logs the first conflict of every key and type, and
+	// still emits the metric. Conflicts are counted in
+	// Metrics.TypeConflicts.
+	TypeConflictsWarn
+
+	// TypeConflictsDrop drops metrics of a different type than the first
+	// one emitted under their key, counting them in Metrics.TypeConflicts
+	TypeConflictsDrop
+)
+
+// TimerPrecision selects the precision of the values of timers, which
+// MeasureSince computes as the elapsed time divided by TimerGranularity.
+//
+// Sinks format the values on their own, which bounds the precision they
+// send: statsd and statsite use "%f", keeping 6 decimal places, i.e. down to
+// a nanosecond for millisecond timers, and every value is a float32, keeping
+// about 7 significant digits.
+type TimerPrecision int
+
+const (
+	// TimerPrecisionFull keeps the fraction of a unit of TimerGranularity,
+	// e.g. 0.25 for 250µs with millisecond timers
+	TimerPrecisionFull TimerPrecision = iota
+
+	// TimerPrecisionTruncate truncates the values to whole units of
+	// TimerGranularity, e.g. 0 for 250µs with millisecond timers
+	TimerPrecisionTruncate
+)
+
+// HostnamePlacement selects where the hostname is added to the metrics when
+// EnableHostname or EnableHostnameLabel is set, e.g. as a key segment for
+// hierarchical backends like Graphite, or as a label for backends with
+// dimensions. Keys emitted with EmitKey never get the hostname.
+type HostnamePlacement int
+
+const (
+	// HostnameByFlag adds the hostname as the host label of every metric if
+	// EnableHostnameLabel is set, or else as the leading key segment of
+	// gauges only if EnableHostname is set
+	HostnameByFlag HostnamePlacement = iota
+
+	// HostnameKeySegment adds the hostname as the leading key segment of
+	// every metric, after the prefixes of the service and type
+	HostnameKeySegment
+
+	// HostnameLabel adds the hostname as the host label of every metric
+	HostnameLabel
+)
+
 // Metrics represents an instance of a metrics sink that can
 // be used to emit
 type Metrics struct {
+	// timerAnomalies counts timings that measured negative. It is accessed
+	// atomically and kept first to guarantee 64-bit alignment.
+	timerAnomalies uint64
+
+	// emptyKeyDrops counts metrics dropped for empty key segments. It is
+	// accessed atomically and kept first to guarantee 64-bit alignment.
+	emptyKeyDrops uint64
+
+	// typeConflicts counts emissions conflicting with the first type of
+	// their key. It is accessed atomically and kept first to guarantee
+	// 64-bit alignment.
+	typeConflicts uint64
+
+	// deepKeys counts metrics whose key exceeded MaxKeyDepth. It is
+	// accessed atomically and kept first to guarantee 64-bit alignment.
+	deepKeys uint64
+
 	Config
+	clock         Clock
 	lastNumGC     uint32
 	sink          MetricSink
 	filter        *iradix.Tree
 	allowedLabels map[string]bool
 	blockedLabels map[string]bool
 	filterLock    sync.RWMutex // Lock filters and allowedLabels/blockedLabels access
+
+	runtimeLock    sync.Mutex // Serializes runtime stats collection
+	lastPauseTotal uint64     // PauseTotalNs at the last collection, guarded by runtimeLock
+	lastPauses     gcPauses   // GC pauses seen by the last collection, guarded by runtimeLock
+
+	// keyTypes maps keys to the first MetricType emitted under them, and
+	// warnedTypes holds the conflicts logged so far, when MixedTypeKeys is
+	// set
+	keyTypes    sync.Map
+	warnedTypes sync.Map
+
+	sinkStats         []*sinkStatsEntry
+	sinkStatsLock     sync.Mutex
+	emittingSinkStats int32
+
+	// recordingSelfLatency is set while a sample is recorded to
+	// SelfLatencySink
+	recordingSelfLatency int32
+
+	// selfTestLock serializes self-tests and guards canarySeq, the value of
+	// the last canary, and selfTestStats, the stats of the registered sinks
+	// at the last self-test
+	selfTestLock  sync.Mutex
+	canarySeq     uint32
+	selfTestStats map[string]SinkStats
 }
 
 // Shared global metrics instance
@@ -72,16 +286,179 @@ func DefaultConfig(serviceName string) *Config {
 	return c
 }
 
+// Merge returns a copy of c with the non-zero fields of override applied on
+// top, for layering e.g. environment specific settings over a base Config.
+// Strings, numbers, durations and policies are replaced when set in override. Booleans can only
+// be turned on, as false can't be told apart from unset; to turn one off, set
+// it on the result. The prefix and label lists are appended, in order and
+// without duplicates, so override adds rules to the ones of c. An empty but
+// non-nil AllowedLabels in override still enables label allow listing. The
+// RuntimeMetricNames of override are added to those of c, replacing the
+// names of the same keys. The ThresholdLabels of override are appended to
+// those of c, and so are its Middlewares. Neither c nor override is
+// modified.
+func (c Config) Merge(override Config) Config {
+	merged := c
+
+	if override.ServiceName != "" {
+		merged.ServiceName = override.ServiceName
+	}
+	if override.HostName != "" {
+		merged.HostName = override.HostName
+	}
+	if override.TimerGranularity != 0 {
+		merged.TimerGranularity = override.TimerGranularity
+	}
+	if override.TimerCountSuffix != "" {
+		merged.TimerCountSuffix = override.TimerCountSuffix
+	}
+	if override.StartTimeGaugeName != "" {
+		merged.StartTimeGaugeName = override.StartTimeGaugeName
+	}
+	if override.ProfileInterval != 0 {
+		merged.ProfileInterval = override.ProfileInterval
+	}
+	if override.SelfTestInterval != 0 {
+		merged.SelfTestInterval = override.SelfTestInterval
+	}
+	if override.SelfTestCanaryName != "" {
+		merged.SelfTestCanaryName = override.SelfTestCanaryName
+	}
+	if override.EmptyKeySegments != EmptySegmentsKeep {
+		merged.EmptyKeySegments = override.EmptyKeySegments
+	}
+	if override.TimerPrecision != TimerPrecisionFull {
+		merged.TimerPrecision = override.TimerPrecision
+	}
+	if override.MixedTypeKeys != TypeConflictsIgnore {
+		merged.MixedTypeKeys = override.MixedTypeKeys
+	}
+	if override.LabelKeyCase != LabelKeyCaseKeep {
+		merged.LabelKeyCase = override.LabelKeyCase
+	}
+	if override.LabelOrder != LabelOrderSorted {
+		merged.LabelOrder = override.LabelOrder
+	}
+	if override.HostnamePlacement != HostnameByFlag {
+		merged.HostnamePlacement = override.HostnamePlacement
+	}
+	if override.MaxKeyDepth != 0 {
+		merged.MaxKeyDepth = override.MaxKeyDepth
+	}
+	if override.KeyDepth != KeyDepthDrop {
+		merged.KeyDepth = override.KeyDepth
+	}
+	if override.RuntimeBackoff != nil {
+		merged.RuntimeBackoff = override.RuntimeBackoff
+	}
+	if override.TimestampOffset != 0 {
+		merged.TimestampOffset = override.TimestampOffset
+	}
+	if override.ValueMultiplier != 0 {
+		merged.ValueMultiplier = override.ValueMultiplier
+	}
+	if override.StackTagRate != 0 {
+		merged.StackTagRate = override.StackTagRate
+	}
+	if override.SpanLabeler != nil {
+		merged.SpanLabeler = override.SpanLabeler
+	}
+	if override.SelfLatencySink != nil {
+		merged.SelfLatencySink = override.SelfLatencySink
+	}
+	if override.SelfLatencyRate != 0 {
+		merged.SelfLatencyRate = override.SelfLatencyRate
+	}
+
+	merged.EnableHostname = c.EnableHostname || override.EnableHostname
+	merged.EnableHostnameLabel = c.EnableHostnameLabel || override.EnableHostnameLabel
+	merged.EnableServiceLabel = c.EnableServiceLabel || override.EnableServiceLabel
+	merged.EnableRuntimeMetrics = c.EnableRuntimeMetrics || override.EnableRuntimeMetrics
+	merged.EnableSinkStats = c.EnableSinkStats || override.EnableSinkStats
+	merged.EnableStartTimeGauge = c.EnableStartTimeGauge || override.EnableStartTimeGauge
+	merged.EnableGoroutineGauge = c.EnableGoroutineGauge || override.EnableGoroutineGauge
+	merged.EnableSelfTest = c.EnableSelfTest || override.EnableSelfTest
+	merged.EnableTypePrefix = c.EnableTypePrefix || override.EnableTypePrefix
+	merged.FilterDefault = c.FilterDefault || override.FilterDefault
+	merged.TrimLabelValues = c.TrimLabelValues || override.TrimLabelValues
+	merged.LowercaseLabelValues = c.LowercaseLabelValues || override.LowercaseLabelValues
+
+	merged.AllowedPrefixes = mergeLists(c.AllowedPrefixes, override.AllowedPrefixes)
+	merged.BlockedPrefixes = mergeLists(c.BlockedPrefixes, override.BlockedPrefixes)
+	merged.AllowedLabels = mergeLists(c.AllowedLabels, override.AllowedLabels)
+	merged.BlockedLabels = mergeLists(c.BlockedLabels, override.BlockedLabels)
+	merged.ResourceLabels = mergeLists(c.ResourceLabels, override.ResourceLabels)
+
+	if len(override.ThresholdLabels) > 0 {
+		merged.ThresholdLabels = append(c.ThresholdLabels[:len(c.ThresholdLabels):len(c.ThresholdLabels)], override.ThresholdLabels...)
+	}
+	if len(override.Middlewares) > 0 {
+		merged.Middlewares = append(c.Middlewares[:len(c.Middlewares):len(c.Middlewares)], override.Middlewares...)
+	}
+	if len(override.RuntimeMetricNames) > 0 {
+		merged.RuntimeMetricNames = make(map[string]string, len(c.RuntimeMetricNames)+len(override.RuntimeMetricNames))
+		for _, names := range []map[string]string{c.RuntimeMetricNames, override.RuntimeMetricNames} {
+			for key, name := range names {
+				merged.RuntimeMetricNames[key] = name
+			}
+		}
+	}
+	return merged
+}
+
+// mergeLists returns a new slice holding base followed by the entries of
+// override not in base. It is nil only if both are.
+func mergeLists(base, override []string) []string {
+	if base == nil && override == nil {
+		return nil
+	}
+	merged := make([]string, 0, len(base)+len(override))
+	seen := make(map[string]bool, len(base)+len(override))
+	for _, list := range [][]string{base, override} {
+		for _, v := range list {
+			if !seen[v] {
+				seen[v] = true
+				merged = append(merged, v)
+			}
+		}
+	}
+	return merged
+}
+
 // New is used to create a new instance of Metrics
 func New(conf *Config, sink MetricSink) (*Metrics, error) {
 	met := &Metrics{}
 	met.Config = *conf
 	met.sink = sink
 	met.UpdateFilterAndLabels(conf.AllowedPrefixes, conf.BlockedPrefixes, conf.AllowedLabels, conf.BlockedLabels)
+	if len(conf.ResourceLabels) > 0 {
+		names := make([]string, len(conf.ResourceLabels))
+		for i, name := range conf.ResourceLabels {
+			names[i] = conf.LabelKeyCase.normalizeLabelName(name)
+		}
+		setResourceLabels(sink, names)
+	}
+	if conf.TimestampOffset != 0 {
+		setTimestampOffset(sink, conf.TimestampOffset)
+	}
 
 	// Start the runtime collector
 	if conf.EnableRuntimeMetrics {
-		go met.collectStats()
+		goCounted(met.collectStats)
+	}
+	if conf.EnableSinkStats {
+		goCounted(met.collectSinkStats)
+	}
+	if conf.EnableStartTimeGauge {
+		met.EmitStartTime()
+		goCounted(met.collectStartTime)
+	}
+	if conf.EnableGoroutineGauge {
+		met.EmitGoroutines()
+		goCounted(met.collectGoroutines)
+	}
+	if conf.EnableSelfTest {
+		goCounted(met.collectSelfTest)
 	}
 	return met, nil
 }
@@ -105,6 +482,26 @@ func SetGaugeWithLabels(key []string, val float32, labels []Label) {
 	globalMetrics.Load().(*Metrics).SetGaugeWithLabels(key, val, labels)
 }
 
+func SetGaugeGroup(key []string, gauges map[string]float32, labels []Label) {
+	globalMetrics.Load().(*Metrics).SetGaugeGroup(key, gauges, labels)
+}
+
+func SetState(key []string, state bool, labels []Label) {
+	globalMetrics.Load().(*Metrics).SetState(key, state, labels)
+}
+
+func SetEnum(key []string, state string, states []string, labels []Label) {
+	globalMetrics.Load().(*Metrics).SetEnum(key, state, states, labels)
+}
+
+func SetGaugeInt(key []string, val int64) {
+	globalMetrics.Load().(*Metrics).SetGaugeInt(key, val)
+}
+
+func SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	globalMetrics.Load().(*Metrics).SetGaugeIntWithLabels(key, val, labels)
+}
+
 func EmitKey(key []string, val float32) {
 	globalMetrics.Load().(*Metrics).EmitKey(key, val)
 }
@@ -117,6 +514,22 @@ func IncrCounterWithLabels(key []string, val float32, labels []Label) {
 	globalMetrics.Load().(*Metrics).IncrCounterWithLabels(key, val, labels)
 }
 
+func ResetCounter(key []string, labels []Label) {
+	globalMetrics.Load().(*Metrics).ResetCounter(key, labels)
+}
+
+func SetCounterTemporality(key []string, temporality Temporality) {
+	globalMetrics.Load().(*Metrics).SetCounterTemporality(key, temporality)
+}
+
+func IncrCounterInt(key []string, val int64) {
+	globalMetrics.Load().(*Metrics).IncrCounterInt(key, val)
+}
+
+func IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	globalMetrics.Load().(*Metrics).IncrCounterIntWithLabels(key, val, labels)
+}
+
 func AddSample(key []string, val float32) {
 	globalMetrics.Load().(*Metrics).AddSample(key, val)
 }
@@ -125,6 +538,14 @@ func AddSampleWithLabels(key []string, val float32, labels []Label) {
 	globalMetrics.Load().(*Metrics).AddSampleWithLabels(key, val, labels)
 }
 
+func AddSampleFields(key []string, fields map[string]float32, labels []Label) {
+	globalMetrics.Load().(*Metrics).AddSampleFields(key, fields, labels)
+}
+
+func ObserveBuckets(key []string, counts map[float64]uint64, labels []Label) {
+	globalMetrics.Load().(*Metrics).ObserveBuckets(key, counts, labels)
+}
+
 func MeasureSince(key []string, start time.Time) {
 	globalMetrics.Load().(*Metrics).MeasureSince(key, start)
 }
@@ -133,6 +554,10 @@ func MeasureSinceWithLabels(key []string, start time.Time, labels []Label) {
 	globalMetrics.Load().(*Metrics).MeasureSinceWithLabels(key, start, labels)
 }
 
+func MeasureSinceWithCount(key []string, start time.Time, labels []Label) {
+	globalMetrics.Load().(*Metrics).MeasureSinceWithCount(key, start, labels)
+}
+
 func UpdateFilter(allow, block []string) {
 	globalMetrics.Load().(*Metrics).UpdateFilter(allow, block)
 }
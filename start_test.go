@@ -31,6 +31,119 @@ func TestDefaultConfig(t *testing.T) {
 	}
 }
 
+func TestConfig_Merge(t *testing.T) {
+	selfSink := NewInmemSink(time.Second, time.Minute)
+	base := Config{
+		ServiceName:          "api",
+		HostName:             "host1",
+		EnableHostname:       true,
+		EnableRuntimeMetrics: true,
+		TimerGranularity:     time.Millisecond,
+		ProfileInterval:      time.Second,
+		AllowedPrefixes:      []string{"api.", "http."},
+		BlockedLabels:        []string{"user"},
+		FilterDefault:        true,
+		LowercaseLabelValues: true,
+		ResourceLabels:       []string{"host"},
+		RuntimeMetricNames:   map[string]string{"runtime.sys_bytes": "sys", "runtime.num_goroutines": "app.goroutines"},
+		ThresholdLabels:      []ThresholdLabel{{Key: "http.request", Threshold: 500, Label: Label{"slow", "true"}}},
+	}
+	override := Config{
+		ServiceName:      "api-staging",
+		EnableTypePrefix: true,
+		ProfileInterval:  10 * time.Second,
+		AllowedPrefixes:  []string{"http.", "debug."},
+		BlockedPrefixes:  []string{"debug.noisy"},
+		AllowedLabels:    []string{},
+
+		EnableStartTimeGauge: true,
+		EnableGoroutineGauge: true,
+		StartTimeGaugeName:   "app.started",
+		MixedTypeKeys:        TypeConflictsWarn,
+		LabelKeyCase:         LabelKeyCaseSnake,
+		LabelOrder:           LabelOrderPreserved,
+		HostnamePlacement:    HostnameKeySegment,
+		TimerPrecision:       TimerPrecisionTruncate,
+		ResourceLabels:       []string{"region"},
+		RuntimeBackoff:       &RuntimeBackoff{PauseThreshold: time.Millisecond},
+		ValueMultiplier:      0.1,
+		TimestampOffset:      -time.Second,
+		RuntimeMetricNames:   map[string]string{"runtime.sys_bytes": "app.sys", "runtime.alloc_bytes": "app.heap"},
+		StackTagRate:         0.001,
+		ThresholdLabels:      []ThresholdLabel{{Key: "http.request", Threshold: 2000, Label: Label{"very_slow", "true"}}},
+		SelfLatencySink:      selfSink,
+		SelfLatencyRate:      0.01,
+		SpanLabeler:          fakeSpanLabeler{},
+		EnableSelfTest:       true,
+		TrimLabelValues:      true,
+		SelfTestInterval:     time.Minute,
+		SelfTestCanaryName:   "app.canary",
+		MaxKeyDepth:          6,
+		KeyDepth:             KeyDepthTruncate,
+	}
+
+	merged := base.Merge(override)
+	expect := Config{
+		ServiceName:          "api-staging",
+		HostName:             "host1",
+		EnableHostname:       true,
+		EnableRuntimeMetrics: true,
+		EnableTypePrefix:     true,
+		TimerGranularity:     time.Millisecond,
+		ProfileInterval:      10 * time.Second,
+		AllowedPrefixes:      []string{"api.", "http.", "debug."},
+		BlockedPrefixes:      []string{"debug.noisy"},
+		AllowedLabels:        []string{},
+		BlockedLabels:        []string{"user"},
+		FilterDefault:        true,
+		LowercaseLabelValues: true,
+		EnableStartTimeGauge: true,
+		EnableGoroutineGauge: true,
+		StartTimeGaugeName:   "app.started",
+		MixedTypeKeys:        TypeConflictsWarn,
+		LabelKeyCase:         LabelKeyCaseSnake,
+		LabelOrder:           LabelOrderPreserved,
+		HostnamePlacement:    HostnameKeySegment,
+		TimerPrecision:       TimerPrecisionTruncate,
+		ResourceLabels:       []string{"host", "region"},
+		RuntimeBackoff:       &RuntimeBackoff{PauseThreshold: time.Millisecond},
+		ValueMultiplier:      0.1,
+		TimestampOffset:      -time.Second,
+		RuntimeMetricNames:   map[string]string{"runtime.sys_bytes": "app.sys", "runtime.alloc_bytes": "app.heap", "runtime.num_goroutines": "app.goroutines"},
+		StackTagRate:         0.001,
+		ThresholdLabels: []ThresholdLabel{
+			{Key: "http.request", Threshold: 500, Label: Label{"slow", "true"}},
+			{Key: "http.request", Threshold: 2000, Label: Label{"very_slow", "true"}},
+		},
+		SelfLatencySink:    selfSink,
+		SelfLatencyRate:    0.01,
+		SpanLabeler:        fakeSpanLabeler{},
+		EnableSelfTest:     true,
+		TrimLabelValues:    true,
+		SelfTestInterval:   time.Minute,
+		SelfTestCanaryName: "app.canary",
+		MaxKeyDepth:        6,
+		KeyDepth:           KeyDepthTruncate,
+	}
+	if !reflect.DeepEqual(merged, expect) {
+		t.Fatalf("bad merge:\n%#v\nexpected:\n%#v", merged, expect)
+	}
+
+	// Lists which are nil in both stay nil
+	if merged := base.Merge(Config{}); merged.BlockedPrefixes != nil || merged.AllowedLabels != nil {
+		t.Fatalf("expected nil lists, got %#v", merged)
+	}
+
+	// The merged lists don't share storage with the inputs
+	merged.AllowedPrefixes[0] = "changed."
+	if base.AllowedPrefixes[0] != "api." {
+		t.Fatalf("base was modified: %v", base.AllowedPrefixes)
+	}
+	if !reflect.DeepEqual(override.AllowedPrefixes, []string{"http.", "debug."}) {
+		t.Fatalf("override was modified: %v", override.AllowedPrefixes)
+	}
+}
+
 func Test_GlobalMetrics(t *testing.T) {
 	var tests = []struct {
 		desc string
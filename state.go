@@ -0,0 +1,41 @@
+package metrics
+
+// StateLabel is the name of the label holding the state of the gauges
+// emitted by SetEnum
+const StateLabel = "state"
+
+// SetState sets a gauge to 1 if state is true and 0 otherwise, for binary
+// states such as whether the process is the leader or healthy
+func (m *Metrics) SetState(key []string, state bool, labels []Label) {
+	m.setGaugeFor(key, stateValue(state), labels, m.ServiceName)
+}
+
+// SetEnum sets the state of a multi-state value, such as the role of a node,
+// as one gauge per possible state under key, labelled with the state under
+// StateLabel. The gauge of the current state is 1 and the others are 0, so
+// dashboards always find every state and can show the current one. A state
+// not among states is emitted after them, so it is not lost. Like
+// SetGaugeGroup, the gauges are emitted under a single acquisition of the
+// filter lock, in the order of states.
+func (m *Metrics) SetEnum(key []string, state string, states []string, labels []Label) {
+	defer m.recordSelfLatency(MetricTypeGauge, m.startSelfLatency())
+	m.filterLock.RLock()
+	defer m.filterLock.RUnlock()
+
+	known := false
+	for _, s := range states {
+		known = known || s == state
+		m.setGaugeLocked(key, stateValue(s == state), append(labels[:len(labels):len(labels)], Label{StateLabel, s}))
+	}
+	if !known {
+		m.setGaugeLocked(key, 1, append(labels[:len(labels):len(labels)], Label{StateLabel, state}))
+	}
+}
+
+// stateValue returns the gauge value of a boolean state
+func stateValue(state bool) float32 {
+	if state {
+		return 1
+	}
+	return 0
+}
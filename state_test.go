@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMetrics_SetState(t *testing.T) {
+	m, met := mockMetric()
+	labels := []Label{{"node", "a"}}
+	met.SetState([]string{"leader"}, true, labels)
+	met.SetState([]string{"leader"}, false, labels)
+
+	if !reflect.DeepEqual(m.vals, []float32{1, 0}) {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+	if !reflect.DeepEqual(m.keys[0], []string{"leader"}) || !reflect.DeepEqual(m.labels[1], labels) {
+		t.Fatalf("bad emissions: %v %v", m.keys, m.labels)
+	}
+}
+
+func TestMetrics_SetEnum(t *testing.T) {
+	m, met := mockMetric()
+	states := []string{"leader", "follower", "candidate"}
+	labels := make([]Label, 1, 4)
+	labels[0] = Label{"node", "a"}
+	met.SetEnum([]string{"raft", "role"}, "follower", states, labels)
+
+	// One gauge per state, with only the current one set
+	expect := [][]Label{
+		{{"node", "a"}, {StateLabel, "leader"}},
+		{{"node", "a"}, {StateLabel, "follower"}},
+		{{"node", "a"}, {StateLabel, "candidate"}},
+	}
+	if !reflect.DeepEqual(m.labels, expect) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+	if !reflect.DeepEqual(m.vals, []float32{0, 1, 0}) {
+		t.Fatalf("bad values: %v", m.vals)
+	}
+	for _, key := range m.keys {
+		if !reflect.DeepEqual(key, []string{"raft", "role"}) {
+			t.Fatalf("bad key: %v", key)
+		}
+	}
+
+	// A state not among the states is emitted as well
+	m, met = mockMetric()
+	met.SetEnum([]string{"raft", "role"}, "shutdown", states, nil)
+	if !reflect.DeepEqual(m.vals, []float32{0, 0, 0, 1}) || m.labels[3][0] != (Label{StateLabel, "shutdown"}) {
+		t.Fatalf("bad emissions: %v %v", m.vals, m.labels)
+	}
+
+	// Labels added by Metrics follow the state label
+	m, met = mockMetric()
+	met.ServiceName = "service"
+	met.EnableServiceLabel = true
+	met.LabelOrder = LabelOrderPreserved
+	met.SetEnum([]string{"raft", "role"}, "leader", states[:1], nil)
+	if !reflect.DeepEqual(m.labels[0], []Label{{StateLabel, "leader"}, {"service", "service"}}) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+}
@@ -3,10 +3,12 @@ package metrics
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,127 +16,666 @@ const (
 	// statsdMaxLen is the maximum size of a packet
 	// to send to statsd
 	statsdMaxLen = 1400
+
+	// DefaultStatsdQueueSize is the number of metrics buffered by a
+	// StatsdSink before new metrics are dropped
+	DefaultStatsdQueueSize = 4096
+
+	// statsdUnixScheme is the URL scheme of statsd over a Unix datagram
+	// socket, and statsdUnixPrefix marks such socket paths in addresses
+	statsdUnixScheme = "statsd+unix"
+	statsdUnixPrefix = "unix://"
+)
+
+var (
+	// DefaultStatsdOpts is the default set of options used when creating a
+	// StatsdSink.
+	DefaultStatsdOpts = StatsdOpts{}
+
+	// DefaultStatsdTypeSuffixes are the standard statsd type suffixes
+	DefaultStatsdTypeSuffixes = StatsdTypeSuffixes{
+		Gauge:    "g",
+		Counter:  "c",
+		Timer:    "ms",
+		KeyValue: "kv",
+		Set:      "s",
+	}
 )
 
+// StatsdTypeSuffixes are the type codes a StatsdSink appends to its lines,
+// e.g. the "c" of "requests:1.000000|c", for statsd dialects which use
+// non-standard codes. An empty suffix emits lines of that type without one.
+type StatsdTypeSuffixes struct {
+	Gauge   string
+	Counter string
+	// Timer is used for AddTiming and MeasureSince, and for AddSample unless
+	// HistogramSamples is set
+	Timer    string
+	KeyValue string
+	Set      string
+}
+
+// StatsdOpts is used to configure the StatsdSink
+type StatsdOpts struct {
+	// HistogramSamples emits AddSample values with the generic histogram
+	// type "h" instead of the timer type "ms". Durations recorded with
+	// AddTiming, or with MeasureSince through a Metrics, are always emitted
+	// as "ms".
+	HistogramSamples bool
+
+	// ErrorLog is used to log connection and write errors. Defaults to a
+	// FailureLogger from NewFailureLogger.
+	ErrorLog *FailureLogger
+
+	// QueueSize is the number of metrics buffered while waiting to be
+	// flushed. Metrics emitted while the queue is full are handled as set by
+	// QueueOverflow. Defaults to DefaultStatsdQueueSize.
+	QueueSize int
+
+	// ZeroGaugeEpsilon, if set, is emitted in place of gauges set to exactly
+	// zero. Gauges set to zero are always emitted, but some servers treat a
+	// zero gauge as missing data. Note the value itself is then reported
+	// instead of zero, so it should be far below any meaningful value, yet
+	// at least 0.000001 as values are formatted with six decimals.
+	ZeroGaugeEpsilon float32
+
+	// WriteBuffer, if set, is the size in bytes of the socket send buffer
+	// (SO_SNDBUF) requested after connecting. The OS may adjust the value,
+	// e.g. Linux doubles it and clamps it to net.core.wmem_max, so the
+	// effective size should be read back with getsockopt(SO_SNDBUF) when it
+	// matters. An error setting it is logged and the default buffer is kept.
+	WriteBuffer int
+
+	// NameCacheSize, if set, enables an LRU cache of this many flattened
+	// metric names, so emitting the same metric repeatedly skips building
+	// its name. Its effectiveness can be checked with NameCacheStats.
+	NameCacheSize int
+
+	// EmitQueueDepth, if set, adds a "statsd.queue_depth" gauge with the
+	// number of metrics waiting in the queue to every flush, so backpressure
+	// shows before metrics are dropped. It is written by the flush loop
+	// directly, bypassing the queue and any Metrics prefixes and filters.
+	EmitQueueDepth bool
+
+	// QueuePriority, if set, drops the emissions of less important types
+	// first while the queue is filling up, rather than dropping whatever is
+	// emitted once it is full. DefaultQueuePriority drops samples first.
+	// Priority drops are counted as dropped metrics.
+	QueuePriority *QueuePriority
+
+	// QueueOverflow selects what is done with metrics emitted while the
+	// queue is full, dropping them by default. QueueBlockTimeout bounds the
+	// wait of OverflowBlock, defaulting to DefaultQueueBlockTimeout.
+	QueueOverflow     OverflowPolicy
+	QueueBlockTimeout time.Duration
+
+	// TypeSuffixes, if set, replaces the standard type suffixes given in
+	// DefaultStatsdTypeSuffixes.
+	TypeSuffixes *StatsdTypeSuffixes
+
+	// AggregateCounters, if set, sums counter increments in the sink and
+	// sends a single line per series and flush, which cuts the traffic of
+	// hot counters. Series are aggregated by name and full label set. The
+	// sums bypass the queue, so they are neither subject to QueuePriority
+	// nor dropped while the queue is full, and they keep accumulating while
+	// the sink reconnects to statsd. The sums flushed in a write which fails
+	// are lost though, like the queued lines written along with them.
+	AggregateCounters bool
+
+	// ConnectRetry, if set, makes NewStatsdSinkFrom connect before returning,
+	// retrying within the given budget, and fail if it can't. As statsd is
+	// sent over UDP, connecting only fails while the address can't be
+	// resolved or reached, such as a collector whose DNS name isn't up yet.
+	// By default the sink connects in the background and keeps retrying.
+	ConnectRetry ConnectRetry
+
+	// LabelSanitizer, if set, sanitizes label values before they are
+	// flattened into the metric name, detecting distinct values sanitized
+	// to the same name. Its mapping should be StatsdSanitize, or replace a
+	// superset of its runes.
+	LabelSanitizer *LabelSanitizer
+
+	// DrainTimeout, if set, makes Shutdown wait for the queued metrics to be
+	// sent, for up to this long, after which the rest are discarded. By
+	// default Shutdown returns right away and the queued metrics are lost.
+	DrainTimeout time.Duration
+
+	// FlushAlignment, if set, flushes at the multiples of this duration
+	// since the Unix epoch rather than every 100ms from the start of the
+	// sink, so the instances of a fleet with synchronized clocks send their
+	// batches at the same moments. FlushJitter, which must be below it,
+	// delays the flushes of each sink by a random offset chosen below it
+	// when the sink is created, to spread the load on statsd.
+	FlushAlignment time.Duration
+	FlushJitter    time.Duration
+
+	// AdaptiveSampling, if set, samples the counters and samples of each
+	// series emitted faster than its MaxRate, annotating the lines with
+	// their sample rate
+	AdaptiveSampling *AdaptiveSampling
+}
+
 // StatsdSink provides a MetricSink that can be used
 // with a statsite or statsd metrics server. It uses
 // only UDP packets, while StatsiteSink uses TCP.
 type StatsdSink struct {
+	// dropped and errors are accessed atomically and kept first to
+	// guarantee 64-bit alignment
+	dropped uint64
+	errors  uint64
+
 	addr        string
 	metricQueue chan string
+	sampleType  string
+	zeroGauge   float32
+	writeBuffer int
+	names       *nameCache
+	errLog      *FailureLogger
+	queueDepth  bool
+	limits      *queueLimits
+	overflow    queueOverflow
+	sanitizer   *LabelSanitizer
+	drain       *queueDrain
+	flushes     *flushSchedule
+
+	// suffixes are the type suffixes, DefaultStatsdTypeSuffixes if nil
+	suffixes *StatsdTypeSuffixes
+
+	// counters sums counter increments if AggregateCounters is set
+	counters *counterAggregator
+
+	// sampler samples counters and samples if AdaptiveSampling is set
+	sampler *adaptiveSampler
+
+	// closeLock guards closed against concurrent pushes, so Shutdown never
+	// closes metricQueue while a metric is being pushed to it
+	closeLock sync.RWMutex
+	closed    bool
+
+	// stopCh is closed by Shutdown, ready once connected for the first time
+	stopCh    chan struct{}
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// reconnectWait is the wait before reconnecting after an error
+	reconnectWait time.Duration
+
+	// initialConn is the connection made by the constructor with
+	// ConnectRetry, taken over by the flush loop
+	initialConn net.Conn
 }
 
 // NewStatsdSinkFromURL creates an StatsdSink from a URL. It is used
-// (and tested) from NewMetricSinkFromURL.
+// (and tested) from NewMetricSinkFromURL. The optional 'queue' param sets
+// the queue size, e.g. statsd://localhost:8125?queue=8192. URLs with the
+// statsd+unix scheme name the path of a Unix datagram socket instead, e.g.
+// statsd+unix:///var/run/statsd.sock.
 func NewStatsdSinkFromURL(u *url.URL) (MetricSink, error) {
-	return NewStatsdSink(u.Host)
+	opts := DefaultStatsdOpts
+	if queue := u.Query().Get("queue"); queue != "" {
+		size, err := strconv.Atoi(queue)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("Bad 'queue' param: %q is not a positive integer", queue)
+		}
+		opts.QueueSize = size
+	}
+	addr := u.Host
+	if u.Scheme == statsdUnixScheme {
+		addr = u.Host + u.Path
+		if !strings.Contains(addr, "/") {
+			addr = statsdUnixPrefix + addr
+		}
+	}
+	return NewStatsdSinkFrom(addr, opts)
 }
 
-// NewStatsdSink is used to create a new StatsdSink
+// NewStatsdSink is used to create a new StatsdSink using the default options.
+// The addr is either a UDP host:port, or the path of a Unix datagram socket,
+// which must contain a '/' or be prefixed with "unix://", e.g.
+// "/var/run/statsd.sock". Batching and flushing are the same for both.
 func NewStatsdSink(addr string) (*StatsdSink, error) {
+	return NewStatsdSinkFrom(addr, DefaultStatsdOpts)
+}
+
+// NewStatsdSinkFrom is used to create a new StatsdSink using the passed options.
+func NewStatsdSinkFrom(addr string, opts StatsdOpts) (*StatsdSink, error) {
+	if opts.QueueSize < 0 {
+		return nil, fmt.Errorf("invalid queue size %d", opts.QueueSize)
+	}
+	if opts.NameCacheSize < 0 {
+		return nil, fmt.Errorf("invalid name cache size %d", opts.NameCacheSize)
+	}
+	if opts.WriteBuffer < 0 {
+		return nil, fmt.Errorf("invalid write buffer size %d", opts.WriteBuffer)
+	}
+	if opts.QueueSize == 0 {
+		opts.QueueSize = DefaultStatsdQueueSize
+	}
 	s := &StatsdSink{
-		addr:        addr,
-		metricQueue: make(chan string, 4096),
+		addr:          addr,
+		metricQueue:   make(chan string, opts.QueueSize),
+		writeBuffer:   opts.WriteBuffer,
+		errLog:        opts.ErrorLog,
+		queueDepth:    opts.EmitQueueDepth,
+		stopCh:        make(chan struct{}),
+		ready:         make(chan struct{}),
+		reconnectWait: reconnectInterval,
+	}
+	if s.errLog == nil {
+		s.errLog = NewFailureLogger()
+	}
+	overflow, err := newQueueOverflow(opts.QueueOverflow, opts.QueueBlockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	s.overflow = overflow
+	if s.drain, err = newQueueDrain(opts.DrainTimeout); err != nil {
+		return nil, err
+	}
+	if s.flushes, err = newFlushSchedule(opts.FlushAlignment, opts.FlushJitter); err != nil {
+		return nil, err
+	}
+	if opts.QueuePriority != nil {
+		limits, err := newQueueLimits(*opts.QueuePriority, opts.QueueSize)
+		if err != nil {
+			return nil, err
+		}
+		s.limits = limits
+	}
+	s.applyFormat(opts)
+	if opts.AggregateCounters {
+		s.counters = newCounterAggregator()
+	}
+	if opts.AdaptiveSampling != nil {
+		if s.sampler, err = newAdaptiveSampler(*opts.AdaptiveSampling); err != nil {
+			return nil, err
+		}
+	}
+	if opts.ConnectRetry.Attempts > 0 {
+		err := opts.ConnectRetry.Do(func() (err error) {
+			s.initialConn, err = s.dial()
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to statsd: %s", err)
+		}
+	}
+	if err := GoSink(s.flushMetrics); err != nil {
+		if s.initialConn != nil {
+			s.initialConn.Close()
+		}
+		return nil, err
 	}
-	go s.flushMetrics()
 	return s, nil
 }
 
-// Close is used to stop flushing to statsd
+// applyFormat applies the options of opts affecting the lines of the sink
+func (s *StatsdSink) applyFormat(opts StatsdOpts) {
+	s.sampleType = "ms"
+	s.zeroGauge = opts.ZeroGaugeEpsilon
+	s.sanitizer = opts.LabelSanitizer
+	if opts.NameCacheSize > 0 {
+		s.names = newNameCache(opts.NameCacheSize)
+	}
+	if opts.TypeSuffixes != nil {
+		suffixes := *opts.TypeSuffixes
+		s.suffixes = &suffixes
+		s.sampleType = suffixes.Timer
+	}
+	if opts.HistogramSamples {
+		s.sampleType = "h"
+	}
+}
+
+// Shutdown is used to stop flushing to statsd. Metrics emitted concurrently
+// with or after Shutdown are dropped, and calling it again has no effect.
+// With a DrainTimeout, it first waits for the queued metrics to be sent.
 func (s *StatsdSink) Shutdown() {
+	s.closeLock.Lock()
+	if s.closed {
+		s.closeLock.Unlock()
+		return
+	}
+	s.closed = true
 	close(s.metricQueue)
+	close(s.stopCh)
+	s.closeLock.Unlock()
+
+	s.drain.wait()
+}
+
+// QueueLen returns the number of metrics waiting to be flushed
+func (s *StatsdSink) QueueLen() int {
+	return len(s.metricQueue)
+}
+
+// QueueCap returns the number of metrics which can wait to be flushed before
+// new ones are dropped
+func (s *StatsdSink) QueueCap() int {
+	return cap(s.metricQueue)
+}
+
+// Ready returns a channel which is closed once the sink has connected to
+// statsd for the first time. Metrics emitted before that are queued, not
+// dropped, even if connecting fails, so a short outage at startup does not
+// lose them. They are delayed until the connection is up though, and once
+// the queue is full further metrics are dropped. Waiting for Ready is
+// optional and only needed to make sure startup metrics fit in the queue.
+func (s *StatsdSink) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// IsReady returns whether the sink has connected to statsd at least once
+func (s *StatsdSink) IsReady() bool {
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
 }
 
 func (s *StatsdSink) SetGauge(key []string, val float32) {
-	flatKey := s.flattenKey(key)
-	s.pushMetric(fmt.Sprintf("%s:%f|g\n", flatKey, val))
+	s.SetGaugeWithLabels(key, val, nil)
 }
 
 func (s *StatsdSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
-	flatKey := s.flattenKeyLabels(key, labels)
-	s.pushMetric(fmt.Sprintf("%s:%f|g\n", flatKey, val))
+	s.push(MetricTypeGauge, key, val, labels)
+}
+
+// SetGaugeIntWithLabels emits an integer gauge without a fractional part
+func (s *StatsdSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	if !s.admit(MetricTypeGauge, key, labels) {
+		return
+	}
+	if val == 0 && s.zeroGauge != 0 {
+		s.SetGaugeWithLabels(key, 0, labels)
+		return
+	}
+	flatKey := s.metricName(key, labels)
+	s.pushMetric(fmt.Sprintf("%s:%d%s\n", flatKey, val, statsdSuffix(s.typeSuffixes().Gauge)))
+}
+
+// gaugeValue returns the value emitted for a gauge set to val
+func (s *StatsdSink) gaugeValue(val float32) float32 {
+	if val == 0 {
+		return s.zeroGauge
+	}
+	return val
 }
 
 func (s *StatsdSink) EmitKey(key []string, val float32) {
-	flatKey := s.flattenKey(key)
-	s.pushMetric(fmt.Sprintf("%s:%f|kv\n", flatKey, val))
+	s.push(MetricTypeKey, key, val, nil)
 }
 
 func (s *StatsdSink) IncrCounter(key []string, val float32) {
-	flatKey := s.flattenKey(key)
-	s.pushMetric(fmt.Sprintf("%s:%f|c\n", flatKey, val))
+	s.IncrCounterWithLabels(key, val, nil)
 }
 
 func (s *StatsdSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
-	flatKey := s.flattenKeyLabels(key, labels)
-	s.pushMetric(fmt.Sprintf("%s:%f|c\n", flatKey, val))
+	if s.counters != nil {
+		s.aggregateCounter(key, labels, float64(val), false)
+		return
+	}
+	s.push(MetricTypeCounter, key, val, labels)
+}
+
+// IncrCounterIntWithLabels emits an integer counter increment without a
+// fractional part
+func (s *StatsdSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	if s.counters != nil {
+		s.aggregateCounter(key, labels, float64(val), true)
+		return
+	}
+	line, ok := s.sampled(MetricTypeCounter, key, labels, func() string {
+		return fmt.Sprintf("%s:%d%s\n", s.metricName(key, labels), val, statsdSuffix(s.typeSuffixes().Counter))
+	})
+	if !ok || !s.admit(MetricTypeCounter, key, labels) {
+		return
+	}
+	s.pushMetric(line)
+}
+
+// aggregateCounter adds an increment to the sum of its series
+func (s *StatsdSink) aggregateCounter(key []string, labels []Label, val float64, integer bool) {
+	s.counters.add(key, labels, val, integer, func() string {
+		return s.metricName(key, labels)
+	})
 }
 
 func (s *StatsdSink) AddSample(key []string, val float32) {
-	flatKey := s.flattenKey(key)
-	s.pushMetric(fmt.Sprintf("%s:%f|ms\n", flatKey, val))
+	s.AddSampleWithLabels(key, val, nil)
 }
 
 func (s *StatsdSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
-	flatKey := s.flattenKeyLabels(key, labels)
-	s.pushMetric(fmt.Sprintf("%s:%f|ms\n", flatKey, val))
+	s.push(MetricTypeSample, key, val, labels)
+}
+
+// push queues the line of an emission with a float value, as encoded by the
+// statsd Serializer
+func (s *StatsdSink) push(typ MetricType, key []string, val float32, labels []Label) {
+	line, ok := s.sampled(typ, key, labels, func() string {
+		e := Emission{Type: typ, Key: key, Value: val, Labels: labels}
+		return string(statsdSerializer{s}.AppendEmission(nil, &e))
+	})
+	if !ok || !s.admit(typ, key, labels) {
+		return
+	}
+	s.pushMetric(line)
+}
+
+// AddTiming emits a duration in milliseconds with the statsd timer type,
+// regardless of how generic samples are configured to be emitted.
+func (s *StatsdSink) AddTiming(key []string, d time.Duration) {
+	s.AddTimingWithLabels(key, d, nil)
+}
+
+// AddTimingWithLabels emits a duration in milliseconds with the statsd timer
+// type, regardless of how generic samples are configured to be emitted.
+func (s *StatsdSink) AddTimingWithLabels(key []string, d time.Duration, labels []Label) {
+	s.addTiming(key, float64(d)/float64(time.Millisecond), labels)
+}
+
+// AddTimingSample emits a duration of val times unit like
+// AddTimingWithLabels, for the timings of MeasureSince, as described by
+// TimingSink
+func (s *StatsdSink) AddTimingSample(key []string, val float32, unit time.Duration, labels []Label) {
+	s.addTiming(key, float64(val)*float64(unit)/float64(time.Millisecond), labels)
+}
+
+// addTiming emits a duration of ms milliseconds with the statsd timer type
+func (s *StatsdSink) addTiming(key []string, ms float64, labels []Label) {
+	line, ok := s.sampled(MetricTypeSample, key, labels, func() string {
+		return fmt.Sprintf("%s:%f%s\n", s.metricName(key, labels), ms, statsdSuffix(s.typeSuffixes().Timer))
+	})
+	if !ok || !s.admit(MetricTypeSample, key, labels) {
+		return
+	}
+	s.pushMetric(line)
+}
+
+// AddSetMember adds member to the statsd set of key, which counts the
+// unique members seen per flush interval of the server. The member must not
+// contain '|' or newlines.
+func (s *StatsdSink) AddSetMember(key []string, member string, labels []Label) {
+	if !s.admit(MetricTypeCounter, key, labels) {
+		return
+	}
+	flatKey := s.metricName(key, labels)
+	s.pushMetric(fmt.Sprintf("%s:%s%s\n", flatKey, member, statsdSuffix(s.typeSuffixes().Set)))
+}
+
+// typeSuffixes returns the configured type suffixes
+func (s *StatsdSink) typeSuffixes() *StatsdTypeSuffixes {
+	if s.suffixes == nil {
+		return &DefaultStatsdTypeSuffixes
+	}
+	return s.suffixes
+}
+
+// statsdSuffix returns the type suffix of a line, including its separator
+func statsdSuffix(suffix string) string {
+	if suffix == "" {
+		return ""
+	}
+	return "|" + suffix
+}
+
+// NameCacheStats returns the hits and misses of the metric name cache. They
+// are zero unless NameCacheSize is set.
+func (s *StatsdSink) NameCacheStats() NameCacheStats {
+	if s.names == nil {
+		return NameCacheStats{}
+	}
+	return s.names.getStats()
+}
+
+// metricName returns the flattened name of a metric, from the name cache
+// if it is enabled
+func (s *StatsdSink) metricName(key []string, labels []Label) string {
+	if s.names == nil {
+		return s.flattenKeyLabels(key, labels)
+	}
+	return s.names.get(key, labels, s.flattenKeyLabels)
+}
+
+// StatsdSanitize replaces the runes statsd and statsite reserve in metric
+// names with underscores. It is the mapping the sinks apply to flattened
+// names, for use by a LabelSanitizer.
+func StatsdSanitize(r rune) rune {
+	switch r {
+	case ':':
+		fallthrough
+	case ' ':
+		return '_'
+	default:
+		return r
+	}
 }
 
 // Flattens the key for formatting, removes spaces
 func (s *StatsdSink) flattenKey(parts []string) string {
 	joined := strings.Join(parts, ".")
-	return strings.Map(func(r rune) rune {
-		switch r {
-		case ':':
-			fallthrough
-		case ' ':
-			return '_'
-		default:
-			return r
-		}
-	}, joined)
+	return strings.Map(StatsdSanitize, joined)
 }
 
 // Flattens the key along with labels for formatting, removes spaces
 func (s *StatsdSink) flattenKeyLabels(parts []string, labels []Label) string {
 	for _, label := range labels {
-		parts = append(parts, label.Value)
+		value := label.Value
+		if s.sanitizer != nil {
+			value = s.sanitizer.Sanitize(value)
+		}
+		parts = append(parts, value)
 	}
 	return s.flattenKey(parts)
 }
 
-// Does a non-blocking push to the metrics queue
+// SinkStats returns the number of metrics dropped because the queue was
+// full, and the number of connection and write errors.
+func (s *StatsdSink) SinkStats() SinkStats {
+	return SinkStats{
+		Dropped: atomic.LoadUint64(&s.dropped),
+		Errors:  atomic.LoadUint64(&s.errors),
+	}
+}
+
+// admit returns whether an emission of typ may be queued under the queue
+// priority, counting it as dropped otherwise
+func (s *StatsdSink) admit(typ MetricType, key []string, labels []Label) bool {
+	if s.limits.admits(typ, len(s.metricQueue)) {
+		return true
+	}
+	atomic.AddUint64(&s.dropped, 1)
+	notifyDrop(key, labels, DropQueueFull)
+	return false
+}
+
+// Pushes to the metrics queue following the overflow policy, dropping the
+// metric if the sink is shut down
 func (s *StatsdSink) pushMetric(m string) {
-	select {
-	case s.metricQueue <- m:
-	default:
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+	if s.closed {
+		atomic.AddUint64(&s.dropped, 1)
+		notifyDropLine(m, DropShutdown)
+		return
+	}
+	if dropped := s.overflow.push(s.metricQueue, m); dropped > 0 {
+		atomic.AddUint64(&s.dropped, dropped)
 	}
 }
 
+// logError counts and logs a connection or write error
+func (s *StatsdSink) logError(format string, err error) {
+	atomic.AddUint64(&s.errors, 1)
+	s.errLog.Printf(format, err)
+}
+
+// dial connects to statsd and applies the configured write buffer size
+func (s *StatsdSink) dial() (net.Conn, error) {
+	network, addr := statsdNetwork(s.addr)
+	sock, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.writeBuffer > 0 {
+		// Both UDP and Unix datagram sockets can size their send buffer
+		buffered := sock.(interface{ SetWriteBuffer(int) error })
+		if err := buffered.SetWriteBuffer(s.writeBuffer); err != nil {
+			s.logError("[ERR] Error setting statsd write buffer size! Err: %s", err)
+		}
+	}
+	return sock, nil
+}
+
+// statsdNetwork returns the network and address to dial for addr. Addresses
+// holding a '/' or starting with "unix://" are paths of Unix datagram
+// sockets, others UDP host:port addresses.
+func statsdNetwork(addr string) (string, string) {
+	if strings.HasPrefix(addr, statsdUnixPrefix) {
+		return "unixgram", strings.TrimPrefix(addr, statsdUnixPrefix)
+	}
+	if strings.Contains(addr, "/") {
+		return "unixgram", addr
+	}
+	return "udp", addr
+}
+
 // Flushes metrics
 func (s *StatsdSink) flushMetrics() {
 	var sock net.Conn
 	var err error
 	var wait <-chan time.Time
-	ticker := time.NewTicker(flushInterval)
+	ticker := s.flushes.ticker()
 	defer ticker.Stop()
+	defer s.drain.exit()
 
 CONNECT:
 	// Create a buffer
 	buf := bytes.NewBuffer(nil)
 
-	// Attempt to connect
-	sock, err = net.Dial("udp", s.addr)
+	// Attempt to connect, unless the constructor already did
+	if s.initialConn != nil {
+		sock, s.initialConn = s.initialConn, nil
+	} else {
+		sock, err = s.dial()
+	}
 	if err != nil {
-		log.Printf("[ERR] Error connecting to statsd! Err: %s", err)
+		s.logError("[ERR] Error connecting to statsd! Err: %s", err)
 		goto WAIT
 	}
+	s.drain.setConn(sock)
+	s.readyOnce.Do(func() { close(s.ready) })
 
 	for {
 		select {
 		case metric, ok := <-s.metricQueue:
 			// Get a metric from the queue
 			if !ok {
+				if s.drain.enabled() {
+					s.flushRemaining(sock, buf)
+				}
 				goto QUIT
 			}
 
@@ -143,7 +684,7 @@ CONNECT:
 				_, err := sock.Write(buf.Bytes())
 				buf.Reset()
 				if err != nil {
-					log.Printf("[ERR] Error writing to statsd! Err: %s", err)
+					s.logError("[ERR] Error writing to statsd! Err: %s", err)
 					goto WAIT
 				}
 			}
@@ -152,22 +693,64 @@ CONNECT:
 			buf.WriteString(metric)
 
 		case <-ticker.C:
+			ticker.fired()
+			if s.counters != nil {
+				for _, line := range s.counters.flush(statsdSuffix(s.typeSuffixes().Counter)) {
+					if len(line)+buf.Len() > statsdMaxLen {
+						_, err := sock.Write(buf.Bytes())
+						buf.Reset()
+						if err != nil {
+							s.logError("[ERR] Error writing to statsd! Err: %s", err)
+							goto WAIT
+						}
+					}
+					buf.WriteString(line)
+				}
+			}
 			if buf.Len() == 0 {
 				continue
 			}
 
+			if s.queueDepth {
+				depth := fmt.Sprintf("statsd.queue_depth:%d%s\n", len(s.metricQueue), statsdSuffix(s.typeSuffixes().Gauge))
+				if len(depth)+buf.Len() > statsdMaxLen {
+					_, err := sock.Write(buf.Bytes())
+					buf.Reset()
+					if err != nil {
+						s.logError("[ERR] Error writing to statsd! Err: %s", err)
+						goto WAIT
+					}
+				}
+				buf.WriteString(depth)
+			}
+
 			_, err := sock.Write(buf.Bytes())
 			buf.Reset()
 			if err != nil {
-				log.Printf("[ERR] Error flushing to statsd! Err: %s", err)
+				s.logError("[ERR] Error flushing to statsd! Err: %s", err)
 				goto WAIT
 			}
 		}
 	}
 
 WAIT:
-	// Wait for a while
-	wait = time.After(time.Duration(5) * time.Second)
+	// Release the failed socket, and wait for a while
+	s.drain.setConn(nil)
+	if sock != nil {
+		sock.Close()
+		sock = nil
+	}
+	wait = time.After(s.reconnectWait)
+	if !s.IsReady() {
+		// Never connected yet, keep the early metrics queued for the first
+		// connection instead of dropping them
+		select {
+		case <-wait:
+			goto CONNECT
+		case <-s.stopCh:
+			goto QUIT
+		}
+	}
 	for {
 		select {
 		// Dequeue the messages to avoid backlog
@@ -180,5 +763,31 @@ WAIT:
 		}
 	}
 QUIT:
-	s.metricQueue = nil
+	if sock != nil {
+		sock.Close()
+	}
+}
+
+// flushRemaining sends the buffered metrics and aggregated counters left at
+// Shutdown
+func (s *StatsdSink) flushRemaining(sock net.Conn, buf *bytes.Buffer) {
+	if s.counters != nil {
+		for _, line := range s.counters.flush(statsdSuffix(s.typeSuffixes().Counter)) {
+			if len(line)+buf.Len() > statsdMaxLen {
+				_, err := sock.Write(buf.Bytes())
+				buf.Reset()
+				if err != nil {
+					s.logError("[ERR] Error writing to statsd! Err: %s", err)
+					return
+				}
+			}
+			buf.WriteString(line)
+		}
+	}
+	if buf.Len() == 0 {
+		return
+	}
+	if _, err := sock.Write(buf.Bytes()); err != nil {
+		s.logError("[ERR] Error flushing to statsd! Err: %s", err)
+	}
 }
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// counterAggregator sums counter increments between flushes, so a statsd
+// sink sends a single line per series and flush instead of one per
+// increment. Series are told apart by name and full label set, so counters
+// sharing a name but not their labels are never collapsed.
+type counterAggregator struct {
+	lock     sync.Mutex
+	counters map[string]*aggregatedCounter
+	order    []string
+}
+
+// aggregatedCounter is the sum of the increments of a series since the last
+// flush
+type aggregatedCounter struct {
+	// name is the flattened statsd name of the series
+	name string
+	val  float64
+	// integer is set while every increment was an integer, so the sum is
+	// emitted without a fractional part
+	integer bool
+}
+
+func newCounterAggregator() *counterAggregator {
+	return &counterAggregator{counters: make(map[string]*aggregatedCounter)}
+}
+
+// add adds val to the series of key and labels. name returns the flattened
+// name of the series, and is only called for series new since the last
+// flush.
+func (c *counterAggregator) add(key []string, labels []Label, val float64, integer bool, name func() string) {
+	series := seriesKey(key, labels)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	counter, ok := c.counters[series]
+	if !ok {
+		counter = &aggregatedCounter{name: name(), integer: true}
+		c.counters[series] = counter
+		c.order = append(c.order, series)
+	}
+	counter.val += val
+	counter.integer = counter.integer && integer
+}
+
+// flush returns a line per series with the sum of its increments since the
+// last flush, in the order the series were first incremented, and starts
+// over
+func (c *counterAggregator) flush(suffix string) []string {
+	c.lock.Lock()
+	counters, order := c.counters, c.order
+	c.counters = make(map[string]*aggregatedCounter, len(counters))
+	c.order = nil
+	c.lock.Unlock()
+
+	lines := make([]string, 0, len(order))
+	for _, series := range order {
+		counter := counters[series]
+		if counter.integer {
+			lines = append(lines, fmt.Sprintf("%s:%d%s\n", counter.name, int64(counter.val), suffix))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s:%f%s\n", counter.name, counter.val, suffix))
+		}
+	}
+	return lines
+}
+
+// seriesKey identifies the series of key and labels, independent of the
+// order the labels are given in
+func seriesKey(key []string, labels []Label) string {
+	sorted := make([]Label, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+
+	var b strings.Builder
+	b.WriteString(strings.Join(key, "."))
+	for _, label := range sorted {
+		fmt.Fprintf(&b, ";%q=%q", label.Name, label.Value)
+	}
+	return b.String()
+}
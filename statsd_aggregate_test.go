@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounterAggregator(t *testing.T) {
+	c := newCounterAggregator()
+	name := func(n string) func() string { return func() string { return n } }
+
+	key := []string{"http", "requests"}
+	get := []Label{{"method", "GET"}, {"code", "200"}}
+	post := []Label{{"method", "POST"}, {"code", "200"}}
+	c.add(key, get, 1, true, name("http.requests.GET.200"))
+	c.add(key, post, 1, true, name("http.requests.POST.200"))
+	c.add(key, nil, 2, true, name("http.requests"))
+
+	// The label order doesn't make a separate series
+	c.add(key, []Label{{"code", "200"}, {"method", "GET"}}, 2, true, name("unused"))
+	c.add(key, post, 0.5, false, name("unused"))
+
+	expect := []string{
+		"http.requests.GET.200:3|c\n",
+		"http.requests.POST.200:1.500000|c\n",
+		"http.requests:2|c\n",
+	}
+	if lines := c.flush("|c"); !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("bad lines: %q", lines)
+	}
+
+	// Sums start over after a flush
+	if lines := c.flush("|c"); len(lines) != 0 {
+		t.Fatalf("bad lines: %q", lines)
+	}
+	c.add(key, get, 1, true, name("http.requests.GET.200"))
+	if lines := c.flush("|c"); !reflect.DeepEqual(lines, []string{"http.requests.GET.200:1|c\n"}) {
+		t.Fatalf("bad lines: %q", lines)
+	}
+}
+
+func TestSeriesKey(t *testing.T) {
+	a := seriesKey([]string{"k"}, []Label{{"a", "1"}, {"b", "2"}})
+	b := seriesKey([]string{"k"}, []Label{{"b", "2"}, {"a", "1"}})
+	if a != b {
+		t.Fatalf("label order should not matter: %q %q", a, b)
+	}
+
+	// Label names and values can't be confused with the separators
+	for _, pair := range [][2][]Label{
+		{{{"a", "1;b=2"}}, {{"a", "1"}, {"b", "2"}}},
+		{{{"a", "1"}}, {{"b", "1"}}},
+		{nil, {{"a", ""}}},
+	} {
+		if seriesKey([]string{"k"}, pair[0]) == seriesKey([]string{"k"}, pair[1]) {
+			t.Fatalf("expected separate series for %v and %v", pair[0], pair[1])
+		}
+	}
+}
+
+func TestStatsd_AggregateCounters(t *testing.T) {
+	list, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer list.Close()
+
+	s, err := NewStatsdSinkFrom(list.LocalAddr().String(), StatsdOpts{AggregateCounters: true})
+	if err != nil {
+		t.Fatalf("bad error")
+	}
+	defer s.Shutdown()
+
+	// The same counter name with different labels aggregates separately
+	for i := 0; i < 3; i++ {
+		s.IncrCounterWithLabels([]string{"jobs"}, 1, []Label{{"queue", "fast"}})
+		s.IncrCounterIntWithLabels([]string{"jobs"}, 2, []Label{{"queue", "slow"}})
+	}
+	s.IncrCounter([]string{"jobs"}, 1.5)
+	s.SetGauge([]string{"depth"}, 4)
+
+	list.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := list.Read(buf)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	// Other types are still queued as emitted, ahead of the sums
+	lines := strings.SplitAfter(string(buf[:n]), "\n")
+	expect := []string{
+		"depth:4.000000|g\n",
+		"jobs.fast:3.000000|c\n",
+		"jobs.slow:6|c\n",
+		"jobs:1.500000|c\n",
+		"",
+	}
+	if !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("bad packet %q", lines)
+	}
+}
@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultSamplingWindow is the period over which AdaptiveSampling measures
+// the rate of each series by default
+const DefaultSamplingWindow = time.Second
+
+// AdaptiveSampling configures a StatsdSink to sample the counters and
+// samples of each series at a rate adapting to how often it is emitted,
+// sending up to about MaxRate lines per second per series. A series emitted
+// below MaxRate is sent in full; above it, each emission is sent with the
+// probability MaxRate divided by its rate, annotated with that rate, e.g.
+// "requests:1.000000|c|@0.1", so statsd scales the sampled lines back up.
+// The rate of a series is the highest of its emissions in the previous and
+// the current window, so sampling tightens within the window a burst
+// starts, and is lifted one window after the traffic drops.
+//
+// Gauges and keys are never sampled, and neither are counters aggregated
+// with AggregateCounters, which are already sent once per flush. Emissions
+// left out by sampling are not counted as dropped.
+type AdaptiveSampling struct {
+	// MaxRate is the target maximum of lines sent per second per series.
+	// Required.
+	MaxRate float64
+
+	// Window is the period over which the rate of each series is measured.
+	// Defaults to DefaultSamplingWindow.
+	Window time.Duration
+
+	// Clock is the source of the current time, mostly for testing. Defaults
+	// to the system clock.
+	Clock Clock
+}
+
+// adaptiveSampler samples the emissions of each series by its rate
+type adaptiveSampler struct {
+	// budget is the number of lines sent per window and series
+	budget float64
+	window time.Duration
+	clock  Clock
+
+	lock   sync.Mutex
+	rand   *rand.Rand
+	series map[string]*sampledSeries
+	pruned time.Time
+}
+
+// sampledSeries counts the emissions of a series in its current and previous
+// windows
+type sampledSeries struct {
+	start time.Time
+	count float64
+	prev  float64
+}
+
+func newAdaptiveSampler(opts AdaptiveSampling) (*adaptiveSampler, error) {
+	if !(opts.MaxRate > 0) || math.IsInf(opts.MaxRate, 0) {
+		return nil, fmt.Errorf("invalid max sampling rate %v", opts.MaxRate)
+	}
+	if opts.Window < 0 {
+		return nil, fmt.Errorf("invalid sampling window %v", opts.Window)
+	}
+	if opts.Window == 0 {
+		opts.Window = DefaultSamplingWindow
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	return &adaptiveSampler{
+		budget: opts.MaxRate * opts.Window.Seconds(),
+		window: opts.Window,
+		clock:  opts.Clock,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		series: make(map[string]*sampledSeries),
+		pruned: opts.Clock.Now(),
+	}, nil
+}
+
+// sample counts an emission of the series of key and labels, returning its
+// sample rate and whether it is sent
+func (a *adaptiveSampler) sample(key []string, labels []Label) (float64, bool) {
+	k := seriesKey(key, labels)
+	now := a.clock.Now()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if now.Sub(a.pruned) >= a.window {
+		a.prune(now)
+	}
+	s, ok := a.series[k]
+	if !ok {
+		s = &sampledSeries{start: now}
+		a.series[k] = s
+	}
+	if elapsed := now.Sub(s.start); elapsed >= 2*a.window {
+		s.start, s.count, s.prev = now, 0, 0
+	} else if elapsed >= a.window {
+		s.start, s.count, s.prev = s.start.Add(a.window), 0, s.count
+	}
+	s.count++
+
+	n := math.Max(s.count, s.prev)
+	if n <= a.budget {
+		return 1, true
+	}
+	// Round, so the annotated rate is the probability the line was sent with
+	rate, _ := strconv.ParseFloat(strconv.FormatFloat(a.budget/n, 'g', 4, 64), 64)
+	return rate, a.rand.Float64() < rate
+}
+
+// prune forgets the series idle for two windows, which would restart from a
+// rate of zero anyway. The caller must hold lock.
+func (a *adaptiveSampler) prune(now time.Time) {
+	for k, s := range a.series {
+		if now.Sub(s.start) >= 2*a.window {
+			delete(a.series, k)
+		}
+	}
+	a.pruned = now
+}
+
+// sampled returns whether an emission of typ is sent, and the line to send
+// it as, annotated with its sample rate if below one. format is only called
+// if it is sent.
+func (s *StatsdSink) sampled(typ MetricType, key []string, labels []Label, format func() string) (string, bool) {
+	if s.sampler == nil || (typ != MetricTypeCounter && typ != MetricTypeSample) {
+		return format(), true
+	}
+	rate, ok := s.sampler.sample(key, labels)
+	if !ok {
+		return "", false
+	}
+	line := format()
+	if rate < 1 && len(line) > 0 {
+		line = line[:len(line)-1] + "|@" + strconv.FormatFloat(rate, 'g', -1, 64) + "\n"
+	}
+	return line, true
+}
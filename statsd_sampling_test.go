@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSampler(t *testing.T, clock Clock) *adaptiveSampler {
+	a, err := newAdaptiveSampler(AdaptiveSampling{MaxRate: 100, Clock: clock})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a.rand = rand.New(rand.NewSource(1))
+	return a
+}
+
+// sampleSecond emits n samples spread over a second, returning the number
+// sent and their estimate of n, which is the sum of the inverse rates
+func sampleSecond(a *adaptiveSampler, clock *FakeClock, n int, labels []Label) (int, float64) {
+	sent, estimate := 0, 0.0
+	for i := 0; i < n; i++ {
+		if rate, ok := a.sample([]string{"s"}, labels); ok {
+			sent++
+			estimate += 1 / rate
+		}
+		clock.Advance(time.Second / time.Duration(n))
+	}
+	return sent, estimate
+}
+
+func TestAdaptiveSampler_VaryingRate(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	a := testSampler(t, clock)
+
+	// Below the max rate everything is sent
+	for second := 0; second < 3; second++ {
+		if sent, _ := sampleSecond(a, clock, 50, nil); sent != 50 {
+			t.Fatalf("second %d: sent %d of 50", second, sent)
+		}
+	}
+
+	// A burst is sampled within its first second, and bounded to about the
+	// max rate from the next one on, while the estimates stay close
+	sent, estimate := sampleSecond(a, clock, 10000, nil)
+	if sent > 600 || estimate < 9000 || estimate > 11000 {
+		t.Fatalf("burst: sent %d, estimate %v", sent, estimate)
+	}
+	for _, n := range []int{10000, 10000, 5000, 20000} {
+		sent, estimate := sampleSecond(a, clock, n, nil)
+		bound := 130.0
+		if n > 10000 {
+			// Sampling catches up with a rising rate within the second,
+			// sending up to about the max rate times 1 + ln of the rise
+			bound *= 1 + math.Log(float64(n)/5000)
+		}
+		if float64(sent) > bound {
+			t.Fatalf("%d/s: sent %d", n, sent)
+		}
+		if estimate < 0.8*float64(n) || estimate > 1.2*float64(n) {
+			t.Fatalf("%d/s: estimate %v", n, estimate)
+		}
+	}
+
+	// Sampling is lifted one second after the traffic drops
+	if sent, _ := sampleSecond(a, clock, 50, nil); sent == 50 {
+		t.Fatalf("expected the previous second to still sample")
+	}
+	if sent, _ := sampleSecond(a, clock, 50, nil); sent != 50 {
+		t.Fatalf("sent %d of 50", sent)
+	}
+}
+
+func TestAdaptiveSampler_Series(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	a := testSampler(t, clock)
+
+	// Series are sampled by their own rate, regardless of label order
+	for i := 0; i < 1000; i++ {
+		a.sample([]string{"s"}, []Label{{"a", "1"}, {"b", "2"}})
+	}
+	if rate, _ := a.sample([]string{"s"}, []Label{{"b", "2"}, {"a", "1"}}); rate >= 1 {
+		t.Fatalf("bad rate %v", rate)
+	}
+	if rate, ok := a.sample([]string{"s"}, nil); rate != 1 || !ok {
+		t.Fatalf("bad rate %v", rate)
+	}
+
+	// Idle series are forgotten
+	clock.Advance(2 * time.Second)
+	a.sample([]string{"other"}, nil)
+	if len(a.series) != 1 {
+		t.Fatalf("bad series %d", len(a.series))
+	}
+
+	for _, opts := range []AdaptiveSampling{
+		{},
+		{MaxRate: -1},
+		{MaxRate: 1, Window: -time.Second},
+	} {
+		if _, err := newAdaptiveSampler(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
+
+func TestStatsd_AdaptiveSampling(t *testing.T) {
+	list, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s, err := NewStatsdSinkFrom(list.LocalAddr().String(), StatsdOpts{
+		QueueSize:        100000,
+		DrainTimeout:     time.Second,
+		AdaptiveSampling: &AdaptiveSampling{MaxRate: 10, Clock: clock},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.sampler.rand = rand.New(rand.NewSource(1))
+
+	// The first series is sampled from a second of 1000 emissions, while the
+	// gauge and the slow series are sent in full
+	for i := 0; i < 1000; i++ {
+		s.IncrCounter([]string{"fast"}, 1)
+	}
+	clock.Advance(time.Second)
+	for i := 0; i < 1000; i++ {
+		s.IncrCounter([]string{"fast"}, 1)
+		s.SetGauge([]string{"gauge"}, 1)
+	}
+	s.AddTiming([]string{"slow"}, time.Millisecond)
+	s.Shutdown()
+
+	counts := make(map[string]int)
+	var last string
+	buf := make([]byte, statsdMaxLen)
+	for {
+		list.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := list.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n") {
+			name := line[:strings.IndexByte(line, ':')]
+			counts[name]++
+			if name == "fast" {
+				last = line
+			}
+			if name != "fast" && strings.Contains(line, "|@") {
+				t.Fatalf("unexpected sample rate: %q", line)
+			}
+		}
+	}
+
+	if counts["gauge"] != 1000 || counts["slow"] != 1 {
+		t.Fatalf("bad counts %v", counts)
+	}
+	if counts["fast"] > 100 {
+		t.Fatalf("sent %d fast lines", counts["fast"])
+	}
+	i := strings.Index(last, "|c|@")
+	if i < 0 {
+		t.Fatalf("missing sample rate: %q", last)
+	}
+	if rate, err := strconv.ParseFloat(last[i+4:], 64); err != nil || rate != 0.01 {
+		t.Fatalf("bad sample rate %q", last)
+	}
+
+	if _, err := NewStatsdSinkFrom(list.LocalAddr().String(), StatsdOpts{AdaptiveSampling: &AdaptiveSampling{}}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
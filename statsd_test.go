@@ -3,9 +3,14 @@ package metrics
 import (
 	"bufio"
 	"bytes"
+	"io/ioutil"
 	"net"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -35,6 +40,430 @@ func TestStatsd_PushFullQueue(t *testing.T) {
 		t.Fatalf("bad val %v", v)
 	default:
 	}
+
+	if stats := s.SinkStats(); stats.Dropped != 1 || stats.Errors != 0 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+}
+
+func TestStatsd_QueuePriority(t *testing.T) {
+	limits, err := newQueueLimits(DefaultQueuePriority, 8)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s := &StatsdSink{metricQueue: make(chan string, 8), sampleType: "ms", limits: limits}
+
+	// Samples fit until the queue is 75% full
+	for i := 0; i < 6; i++ {
+		s.AddSample([]string{"sample"}, 1)
+	}
+	s.AddSample([]string{"sample"}, 1)
+	s.AddTiming([]string{"timing"}, time.Millisecond)
+	if s.QueueLen() != 6 || s.SinkStats().Dropped != 2 {
+		t.Fatalf("expected samples to be dropped: %d queued, %+v", s.QueueLen(), s.SinkStats())
+	}
+
+	// Gauges and counters use the remaining room
+	s.SetGauge([]string{"gauge"}, 1)
+	s.IncrCounter([]string{"counter"}, 1)
+	s.IncrCounter([]string{"counter"}, 1)
+	if s.QueueLen() != 8 || s.SinkStats().Dropped != 3 {
+		t.Fatalf("bad queue: %d queued, %+v", s.QueueLen(), s.SinkStats())
+	}
+
+	// Once there's room again samples are queued
+	for i := 0; i < 3; i++ {
+		<-s.metricQueue
+	}
+	s.AddSample([]string{"sample"}, 1)
+	if s.QueueLen() != 6 {
+		t.Fatalf("expected sample to be queued: %d", s.QueueLen())
+	}
+
+	if _, err := NewStatsdSinkFrom("127.0.0.1:7524", StatsdOpts{
+		QueuePriority: &QueuePriority{Pressure: 2},
+	}); err == nil {
+		t.Fatalf("expected error for bad priority")
+	}
+}
+
+func TestStatsd_QueueOverflow(t *testing.T) {
+	s := &StatsdSink{metricQueue: make(chan string, 2), overflow: queueOverflow{policy: OverflowDropOldest}}
+	for _, key := range []string{"a", "b", "c"} {
+		s.IncrCounter([]string{key}, 1)
+	}
+	if stats := s.SinkStats(); stats.Dropped != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+	if m := <-s.metricQueue; m != "b:1.000000|c\n" {
+		t.Fatalf("expected the oldest metric to be dropped, got %q", m)
+	}
+
+	sink, err := NewStatsdSinkFrom("127.0.0.1:7524", StatsdOpts{QueueOverflow: OverflowBlock})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sink.Shutdown()
+	if sink.overflow.policy != OverflowBlock || sink.overflow.timeout != DefaultQueueBlockTimeout {
+		t.Fatalf("bad overflow: %+v", sink.overflow)
+	}
+	if _, err := NewStatsdSinkFrom("127.0.0.1:7524", StatsdOpts{QueueOverflow: OverflowPolicy(7)}); err == nil {
+		t.Fatalf("expected error for bad overflow policy")
+	}
+}
+
+func TestStatsd_ShutdownDuringEmission(t *testing.T) {
+	s, err := NewStatsdSink("127.0.0.1:7524")
+	if err != nil {
+		t.Fatalf("bad error")
+	}
+
+	// Emitters racing with Shutdown drop their metrics instead of panicking
+	// on the closed queue
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for i := 0; i < 1000; i++ {
+				s.IncrCounter([]string{"counter"}, 1)
+				s.SetGaugeWithLabels([]string{"gauge"}, 1, []Label{{"a", "b"}})
+				s.AddSample([]string{"sample"}, 1)
+				s.QueueLen()
+			}
+		}()
+	}
+	close(start)
+	s.Shutdown()
+	wg.Wait()
+
+	// Calling it again is a no-op, and later metrics are dropped
+	s.Shutdown()
+	before := s.SinkStats().Dropped
+	s.IncrCounter([]string{"counter"}, 1)
+	if dropped := s.SinkStats().Dropped; dropped != before+1 {
+		t.Fatalf("expected a drop, got %d after %d", dropped, before)
+	}
+}
+
+func TestStatsd_QueueLen(t *testing.T) {
+	s := &StatsdSink{metricQueue: make(chan string, 4)}
+	if s.QueueLen() != 0 || s.QueueCap() != 4 {
+		t.Fatalf("bad queue: %d/%d", s.QueueLen(), s.QueueCap())
+	}
+
+	s.IncrCounter([]string{"a"}, 1)
+	s.IncrCounter([]string{"b"}, 1)
+	s.IncrCounter([]string{"c"}, 1)
+	if s.QueueLen() != 3 {
+		t.Fatalf("expected 3 queued metrics, got %d", s.QueueLen())
+	}
+
+	<-s.metricQueue
+	if s.QueueLen() != 2 {
+		t.Fatalf("expected 2 queued metrics, got %d", s.QueueLen())
+	}
+}
+
+func TestStatsd_EmitQueueDepth(t *testing.T) {
+	list, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer list.Close()
+
+	s, err := NewStatsdSinkFrom(list.LocalAddr().String(), StatsdOpts{EmitQueueDepth: true})
+	if err != nil {
+		t.Fatalf("bad error")
+	}
+	defer s.Shutdown()
+	s.IncrCounter([]string{"counter", "me"}, float32(1))
+
+	list.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := list.Read(buf)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if out := string(buf[:n]); out != "counter.me:1.000000|c\nstatsd.queue_depth:0|g\n" {
+		t.Fatalf("bad packet %q", out)
+	}
+}
+
+func TestStatsd_SampleTypes(t *testing.T) {
+	for _, tc := range []struct {
+		desc         string
+		opts         StatsdOpts
+		expectSample string
+	}{
+		{
+			desc:         "samples default to the timer type",
+			opts:         DefaultStatsdOpts,
+			expectSample: "sample.size:6.000000|ms\n",
+		},
+		{
+			desc:         "samples can use the histogram type",
+			opts:         StatsdOpts{HistogramSamples: true},
+			expectSample: "sample.size:6.000000|h\n",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			sink, err := NewStatsdSinkFrom("127.0.0.1:7524", tc.opts)
+			if err != nil {
+				t.Fatalf("bad error")
+			}
+			sink.Shutdown()
+
+			q := make(chan string, 2)
+			s := &StatsdSink{metricQueue: q, sampleType: sink.sampleType}
+			s.AddSample([]string{"sample", "size"}, float32(6))
+			s.AddTimingWithLabels([]string{"timing", "req"}, 1500*time.Microsecond, []Label{{"a", "label"}})
+
+			if out := <-q; out != tc.expectSample {
+				t.Fatalf("bad line %s", out)
+			}
+			if out := <-q; out != "timing.req.label:1.500000|ms\n" {
+				t.Fatalf("bad line %s", out)
+			}
+		})
+	}
+}
+
+func TestStatsd_MeasureSinceTimer(t *testing.T) {
+	q := make(chan string, 2)
+	s := &StatsdSink{metricQueue: q, sampleType: "h"}
+	conf := DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	m, err := New(conf, FanoutSink{s})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Timings keep the timer type through a Metrics and fanout, while other
+	// samples are histograms
+	m.MeasureSince([]string{"timing", "req"}, time.Now().Add(-time.Second))
+	m.AddSample([]string{"sample", "size"}, 6)
+	if out := <-q; !strings.HasPrefix(out, "timing.req:1") || !strings.HasSuffix(out, "|ms\n") {
+		t.Fatalf("bad line %q", out)
+	}
+	if out := <-q; out != "sample.size:6.000000|h\n" {
+		t.Fatalf("bad line %q", out)
+	}
+}
+
+func TestStatsd_TypeSuffixes(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		opts   StatsdOpts
+		expect []string
+	}{
+		{
+			desc: "standard suffixes by default",
+			opts: DefaultStatsdOpts,
+			expect: []string{
+				"gauge:1.000000|g\n",
+				"gauge.int:2|g\n",
+				"counter:3.000000|c\n",
+				"counter.int:4|c\n",
+				"sample:5.000000|ms\n",
+				"timing:6.000000|ms\n",
+				"key:7.000000|kv\n",
+				"users:alice|s\n",
+			},
+		},
+		{
+			desc: "custom suffixes",
+			opts: StatsdOpts{TypeSuffixes: &StatsdTypeSuffixes{
+				Gauge:   "G",
+				Counter: "C",
+				Timer:   "h",
+				Set:     "S",
+			}},
+			expect: []string{
+				"gauge:1.000000|G\n",
+				"gauge.int:2|G\n",
+				"counter:3.000000|C\n",
+				"counter.int:4|C\n",
+				"sample:5.000000|h\n",
+				"timing:6.000000|h\n",
+				"key:7.000000\n",
+				"users:alice|S\n",
+			},
+		},
+		{
+			desc: "histogram samples override the timer suffix",
+			opts: StatsdOpts{
+				HistogramSamples: true,
+				TypeSuffixes:     &StatsdTypeSuffixes{Timer: "t"},
+			},
+			expect: []string{
+				"gauge:1.000000\n",
+				"gauge.int:2\n",
+				"counter:3.000000\n",
+				"counter.int:4\n",
+				"sample:5.000000|h\n",
+				"timing:6.000000|t\n",
+				"key:7.000000\n",
+				"users:alice\n",
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			sink, err := NewStatsdSinkFrom("127.0.0.1:7524", tc.opts)
+			if err != nil {
+				t.Fatalf("bad error")
+			}
+			sink.Shutdown()
+
+			q := make(chan string, len(tc.expect))
+			s := &StatsdSink{metricQueue: q, sampleType: sink.sampleType, suffixes: sink.suffixes}
+			s.SetGauge([]string{"gauge"}, 1)
+			s.SetGaugeIntWithLabels([]string{"gauge", "int"}, 2, nil)
+			s.IncrCounter([]string{"counter"}, 3)
+			s.IncrCounterIntWithLabels([]string{"counter", "int"}, 4, nil)
+			s.AddSample([]string{"sample"}, 5)
+			s.AddTiming([]string{"timing"}, 6*time.Millisecond)
+			s.EmitKey([]string{"key"}, 7)
+			s.AddSetMember([]string{"users"}, "alice", nil)
+
+			for _, expect := range tc.expect {
+				if out := <-q; out != expect {
+					t.Fatalf("expected %q, got %q", expect, out)
+				}
+			}
+		})
+	}
+
+	// The options are copied
+	suffixes := StatsdTypeSuffixes{Counter: "C"}
+	sink, err := NewStatsdSinkFrom("127.0.0.1:7524", StatsdOpts{TypeSuffixes: &suffixes})
+	if err != nil {
+		t.Fatalf("bad error")
+	}
+	sink.Shutdown()
+	suffixes.Counter = "changed"
+	if sink.typeSuffixes().Counter != "C" {
+		t.Fatalf("bad suffixes: %v", sink.typeSuffixes())
+	}
+}
+
+func TestStatsd_ZeroGauge(t *testing.T) {
+	for _, tc := range []struct {
+		desc        string
+		opts        StatsdOpts
+		expectGauge string
+	}{
+		{
+			desc:        "zero gauges are emitted as zero",
+			opts:        DefaultStatsdOpts,
+			expectGauge: "gauge.idle:0.000000|g\n",
+		},
+		{
+			desc:        "zero gauges can be emitted as an epsilon",
+			opts:        StatsdOpts{ZeroGaugeEpsilon: 0.000001},
+			expectGauge: "gauge.idle:0.000001|g\n",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			sink, err := NewStatsdSinkFrom("127.0.0.1:7524", tc.opts)
+			if err != nil {
+				t.Fatalf("bad error")
+			}
+			sink.Shutdown()
+
+			q := make(chan string, 3)
+			s := &StatsdSink{metricQueue: q, zeroGauge: sink.zeroGauge}
+			s.SetGauge([]string{"gauge", "idle"}, 0)
+			s.SetGaugeWithLabels([]string{"gauge", "idle"}, 0, []Label{{"a", "label"}})
+			s.SetGauge([]string{"gauge", "busy"}, 2)
+
+			if out := <-q; out != tc.expectGauge {
+				t.Fatalf("bad line %s", out)
+			}
+			withLabel := strings.Replace(tc.expectGauge, "idle", "idle.label", 1)
+			if out := <-q; out != withLabel {
+				t.Fatalf("bad line %s", out)
+			}
+			if out := <-q; out != "gauge.busy:2.000000|g\n" {
+				t.Fatalf("bad line %s", out)
+			}
+		})
+	}
+}
+
+func TestStatsd_IntegerTyping(t *testing.T) {
+	q := make(chan string, 5)
+	s := &StatsdSink{metricQueue: q}
+	s.IncrCounterIntWithLabels([]string{"req", "count"}, 4, nil)
+	s.IncrCounterIntWithLabels([]string{"req", "count"}, -2, []Label{{"a", "label"}})
+	s.SetGaugeIntWithLabels([]string{"conns"}, 1234567890123, nil)
+	s.SetGaugeIntWithLabels([]string{"conns"}, 0, nil)
+
+	s.zeroGauge = 0.000001
+	s.SetGaugeIntWithLabels([]string{"conns"}, 0, nil)
+
+	for _, expect := range []string{
+		"req.count:4|c\n",
+		"req.count.label:-2|c\n",
+		"conns:1234567890123|g\n",
+		"conns:0|g\n",
+		"conns:0.000001|g\n",
+	} {
+		if out := <-q; out != expect {
+			t.Fatalf("bad line %q, expected %q", out, expect)
+		}
+	}
+}
+
+func TestStatsd_NameCache(t *testing.T) {
+	sink, err := NewStatsdSinkFrom("127.0.0.1:7524", StatsdOpts{NameCacheSize: 16})
+	if err != nil {
+		t.Fatalf("bad error")
+	}
+	sink.Shutdown()
+
+	q := make(chan string, 3)
+	s := &StatsdSink{metricQueue: q, names: sink.names}
+	s.IncrCounterWithLabels([]string{"req", "count"}, 1, []Label{{"a", "label"}})
+	s.IncrCounterWithLabels([]string{"req", "count"}, 2, []Label{{"a", "label"}})
+	s.IncrCounter([]string{"req", "count"}, 3)
+
+	for _, expect := range []string{
+		"req.count.label:1.000000|c\n",
+		"req.count.label:2.000000|c\n",
+		"req.count:3.000000|c\n",
+	} {
+		if out := <-q; out != expect {
+			t.Fatalf("bad line %q, expected %q", out, expect)
+		}
+	}
+	if stats := s.NameCacheStats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+}
+
+func TestStatsd_LabelSanitizer(t *testing.T) {
+	sanitizer, err := NewLabelSanitizer(StatsdSanitize, CollisionSuffix, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	q := make(chan string, 2)
+	s := &StatsdSink{metricQueue: q, sanitizer: sanitizer}
+	s.IncrCounterWithLabels([]string{"req"}, 1, []Label{{"path", "a b"}})
+	s.IncrCounterWithLabels([]string{"req"}, 1, []Label{{"path", "a:b"}})
+
+	if out := <-q; out != "req.a_b:1.000000|c\n" {
+		t.Fatalf("bad line %q", out)
+	}
+	if out := <-q; out != "req.a_b_"+shortHash("a:b")+":1.000000|c\n" {
+		t.Fatalf("bad line %q", out)
+	}
+	if c := sanitizer.Collisions(); c != 1 {
+		t.Fatalf("bad collisions: %d", c)
+	}
 }
 
 func TestStatsd_Conn(t *testing.T) {
@@ -133,22 +562,190 @@ func TestStatsd_Conn(t *testing.T) {
 	}
 }
 
+func TestStatsd_UnixConn(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unixgram sockets on windows")
+	}
+	dir, err := ioutil.TempDir("", "metrics-statsd")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.sock")
+
+	list, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+
+	s, err := NewStatsdSink(path)
+	if err != nil {
+		t.Fatalf("bad error")
+	}
+	s.SetGauge([]string{"gauge", "val"}, float32(1))
+	s.SetGaugeWithLabels([]string{"gauge_labels", "val"}, float32(2), []Label{{"a", "label"}})
+	s.EmitKey([]string{"key", "other"}, float32(3))
+	s.IncrCounter([]string{"counter", "me"}, float32(4))
+	s.AddSampleWithLabels([]string{"sample_labels", "slow thingy"}, float32(7), []Label{{"a", "label"}})
+
+	list.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := list.Read(buf)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	expect := "gauge.val:1.000000|g\n" +
+		"gauge_labels.val.label:2.000000|g\n" +
+		"key.other:3.000000|kv\n" +
+		"counter.me:4.000000|c\n" +
+		"sample_labels.slow_thingy.label:7.000000|ms\n"
+	if got := string(buf[:n]); got != expect {
+		t.Fatalf("bad packet %q", got)
+	}
+	s.Shutdown()
+}
+
+func TestStatsdNetwork(t *testing.T) {
+	for addr, expect := range map[string][2]string{
+		"127.0.0.1:8125":       {"udp", "127.0.0.1:8125"},
+		"[::1]:8125":           {"udp", "[::1]:8125"},
+		"/var/run/statsd.sock": {"unixgram", "/var/run/statsd.sock"},
+		"./statsd.sock":        {"unixgram", "./statsd.sock"},
+		"unix://statsd.sock":   {"unixgram", "statsd.sock"},
+	} {
+		if network, address := statsdNetwork(addr); network != expect[0] || address != expect[1] {
+			t.Fatalf("bad network of %q: %s %s", addr, network, address)
+		}
+	}
+}
+
+func TestStatsd_Ready(t *testing.T) {
+	s, err := NewStatsdSink("127.0.0.1:7524")
+	if err != nil {
+		t.Fatalf("bad error")
+	}
+	defer s.Shutdown()
+
+	select {
+	case <-s.Ready():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout waiting for ready")
+	}
+	if !s.IsReady() {
+		t.Fatalf("should be ready")
+	}
+}
+
+func TestStatsd_QueuesUntilReady(t *testing.T) {
+	s := &StatsdSink{
+		addr:          "127.0.0.1:-1",
+		metricQueue:   make(chan string, 4),
+		sampleType:    "ms",
+		errLog:        NewFailureLogger(),
+		stopCh:        make(chan struct{}),
+		ready:         make(chan struct{}),
+		reconnectWait: 10 * time.Millisecond,
+	}
+	done := make(chan struct{})
+	go func() {
+		s.flushMetrics()
+		close(done)
+	}()
+
+	s.SetGauge([]string{"gauge", "val"}, float32(1))
+	s.IncrCounter([]string{"counter", "me"}, float32(2))
+
+	// Let a few connection attempts fail
+	time.Sleep(50 * time.Millisecond)
+	if s.IsReady() {
+		t.Fatalf("should not be ready")
+	}
+	if n := len(s.metricQueue); n != 2 {
+		t.Fatalf("expected queued metrics to be kept, got %d", n)
+	}
+	if stats := s.SinkStats(); stats.Errors == 0 {
+		t.Fatalf("expected connection errors, got %+v", stats)
+	}
+
+	s.Shutdown()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("flush loop did not exit")
+	}
+}
+
+func TestStatsd_ConnectRetry(t *testing.T) {
+	opts := StatsdOpts{ConnectRetry: ConnectRetry{Attempts: 3, Delay: 10 * time.Millisecond}}
+	s, err := NewStatsdSinkFrom("127.0.0.1:7524", opts)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	select {
+	case <-s.Ready():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout waiting for ready")
+	}
+
+	// An address which can't be dialed fails once the budget is used up
+	start := time.Now()
+	if _, err := NewStatsdSinkFrom("127.0.0.1:-1", opts); err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Fatalf("expected error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("expected retries, returned after %v", elapsed)
+	}
+}
+
 func TestNewStatsdSinkFromURL(t *testing.T) {
 	for _, tc := range []struct {
-		desc       string
-		input      string
-		expectErr  string
-		expectAddr string
+		desc        string
+		input       string
+		expectErr   string
+		expectAddr  string
+		expectQueue int
 	}{
 		{
-			desc:       "address is populated",
-			input:      "statsd://statsd.service.consul",
-			expectAddr: "statsd.service.consul",
+			desc:        "address is populated",
+			input:       "statsd://statsd.service.consul",
+			expectAddr:  "statsd.service.consul",
+			expectQueue: DefaultStatsdQueueSize,
+		},
+		{
+			desc:        "address includes port",
+			input:       "statsd://statsd.service.consul:1234",
+			expectAddr:  "statsd.service.consul:1234",
+			expectQueue: DefaultStatsdQueueSize,
+		},
+		{
+			desc:        "queue size is set",
+			input:       "statsd://statsd.service.consul:1234?queue=8192",
+			expectAddr:  "statsd.service.consul:1234",
+			expectQueue: 8192,
 		},
 		{
-			desc:       "address includes port",
-			input:      "statsd://statsd.service.consul:1234",
-			expectAddr: "statsd.service.consul:1234",
+			desc:        "unix socket path",
+			input:       "statsd+unix:///var/run/statsd.sock?queue=16",
+			expectAddr:  "/var/run/statsd.sock",
+			expectQueue: 16,
+		},
+		{
+			desc:        "relative unix socket path",
+			input:       "statsd+unix://statsd.sock",
+			expectAddr:  "unix://statsd.sock",
+			expectQueue: DefaultStatsdQueueSize,
+		},
+		{
+			desc:      "queue size is not a number",
+			input:     "statsd://statsd.service.consul:1234?queue=big",
+			expectErr: "Bad 'queue' param",
+		},
+		{
+			desc:      "queue size is not positive",
+			input:     "statsd://statsd.service.consul:1234?queue=0",
+			expectErr: "Bad 'queue' param",
 		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -169,7 +766,48 @@ func TestNewStatsdSinkFromURL(t *testing.T) {
 				if is.addr != tc.expectAddr {
 					t.Fatalf("expected addr %s, got: %s", tc.expectAddr, is.addr)
 				}
+				if cap(is.metricQueue) != tc.expectQueue {
+					t.Fatalf("expected queue size %d, got: %d", tc.expectQueue, cap(is.metricQueue))
+				}
+				is.Shutdown()
 			}
 		})
 	}
 }
+
+func TestStatsd_DrainOnShutdown(t *testing.T) {
+	list, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+
+	s, err := NewStatsdSinkFrom(list.LocalAddr().String(), StatsdOpts{
+		DrainTimeout:      time.Second,
+		AggregateCounters: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.SetGauge([]string{"gauge"}, 1)
+	s.IncrCounter([]string{"counter"}, 2)
+	s.IncrCounter([]string{"counter"}, 3)
+
+	// The buffered gauge and the aggregated counter are sent before Shutdown
+	// returns, without waiting for the flush interval
+	s.Shutdown()
+
+	buf := make([]byte, statsdMaxLen)
+	list.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := list.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got := string(buf[:n]); got != "gauge:1.000000|g\ncounter:5.000000|c\n" {
+		t.Fatalf("bad packet: %q", got)
+	}
+
+	if _, err := NewStatsdSinkFrom(list.LocalAddr().String(), StatsdOpts{DrainTimeout: -time.Second}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,71 @@
+//go:build !windows
+// +build !windows
+
+package metrics
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// sendBufferSize returns the effective SO_SNDBUF of a UDP connection
+func sendBufferSize(t *testing.T, sock net.Conn) int {
+	raw, err := sock.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var size int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sockErr != nil {
+		t.Fatalf("err: %v", sockErr)
+	}
+	return size
+}
+
+func TestStatsd_WriteBuffer(t *testing.T) {
+	s := &StatsdSink{addr: "127.0.0.1:7524", errLog: NewFailureLogger()}
+	sock, err := s.dial()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defaultSize := sendBufferSize(t, sock)
+	sock.Close()
+
+	// Ask for a buffer well apart from the default. The OS may adjust
+	// it, Linux doubles it for instance, so only check it was changed in
+	// the requested direction.
+	want := defaultSize / 4
+	if want < 8192 {
+		want = 2 * defaultSize
+	}
+	s.writeBuffer = want
+	sock, err = s.dial()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sock.Close()
+
+	size := sendBufferSize(t, sock)
+	if size == defaultSize {
+		t.Skipf("send buffer size unchanged at %d, the OS may ignore the setting", size)
+	}
+	if (want < defaultSize) != (size < defaultSize) {
+		t.Fatalf("bad send buffer size %d, requested %d from default %d", size, want, defaultSize)
+	}
+	if s.SinkStats().Errors != 0 {
+		t.Fatalf("unexpected errors")
+	}
+}
+
+func TestNewStatsdSinkFrom_BadWriteBuffer(t *testing.T) {
+	if _, err := NewStatsdSinkFrom("127.0.0.1:7524", StatsdOpts{WriteBuffer: -1}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
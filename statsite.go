@@ -3,10 +3,11 @@ package metrics
 import (
 	"bufio"
 	"fmt"
-	"log"
 	"net"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +16,10 @@ const (
 	// inactivity. Prevents stats from getting stuck in a buffer
 	// forever.
 	flushInterval = 100 * time.Millisecond
+
+	// reconnectInterval is the wait before reconnecting after a connection
+	// or write error
+	reconnectInterval = 5 * time.Second
 )
 
 // NewStatsiteSinkFromURL creates an StatsiteSink from a URL. It is used
@@ -23,59 +28,275 @@ func NewStatsiteSinkFromURL(u *url.URL) (MetricSink, error) {
 	return NewStatsiteSink(u.Host)
 }
 
+var (
+	// DefaultStatsiteOpts is the default set of options used when creating a
+	// StatsiteSink.
+	DefaultStatsiteOpts = StatsiteOpts{}
+)
+
+// StatsiteOpts is used to configure the StatsiteSink
+type StatsiteOpts struct {
+	// ErrorLog is used to log connection and write errors. Defaults to a
+	// FailureLogger from NewFailureLogger.
+	ErrorLog *FailureLogger
+
+	// EmitQueueDepth, if set, adds a "statsite.queue_depth" gauge with the
+	// number of metrics waiting in the queue to every flush, so backpressure
+	// shows before metrics are dropped. It is written by the flush loop
+	// directly, bypassing the queue and any Metrics prefixes and filters.
+	EmitQueueDepth bool
+
+	// QueuePriority, if set, drops the emissions of less important types
+	// first while the queue is filling up, rather than dropping whatever is
+	// emitted once it is full. DefaultQueuePriority drops samples first.
+	// Priority drops are counted as dropped metrics.
+	QueuePriority *QueuePriority
+
+	// QueueOverflow selects what is done with metrics emitted while the
+	// queue is full, dropping them by default. QueueBlockTimeout bounds the
+	// wait of OverflowBlock, defaulting to DefaultQueueBlockTimeout.
+	QueueOverflow     OverflowPolicy
+	QueueBlockTimeout time.Duration
+
+	// ConnectRetry, if set, makes NewStatsiteSinkFrom connect before
+	// returning, retrying within the given budget, and fail if it can't. By
+	// default the sink connects in the background and keeps retrying.
+	ConnectRetry ConnectRetry
+
+	// LabelSanitizer, if set, sanitizes label values before they are
+	// flattened into the metric name, detecting distinct values sanitized
+	// to the same name. Its mapping should be StatsdSanitize, or replace a
+	// superset of its runes.
+	LabelSanitizer *LabelSanitizer
+
+	// DrainTimeout, if set, makes Shutdown wait for the queued metrics to be
+	// sent, for up to this long, after which the rest are discarded. By
+	// default Shutdown returns right away and the queued metrics are lost.
+	DrainTimeout time.Duration
+
+	// FlushAlignment, if set, flushes at the multiples of this duration
+	// since the Unix epoch rather than every 100ms from the start of the
+	// sink, so the instances of a fleet with synchronized clocks send their
+	// batches at the same moments. FlushJitter, which must be below it,
+	// delays the flushes of each sink by a random offset chosen below it
+	// when the sink is created, to spread the load on statsite.
+	FlushAlignment time.Duration
+	FlushJitter    time.Duration
+}
+
 // StatsiteSink provides a MetricSink that can be used with a
 // statsite metrics server
 type StatsiteSink struct {
+	// dropped and errors are accessed atomically and kept first to
+	// guarantee 64-bit alignment
+	dropped uint64
+	errors  uint64
+
 	addr        string
 	metricQueue chan string
+	errLog      *FailureLogger
+	queueDepth  bool
+	limits      *queueLimits
+	overflow    queueOverflow
+	sanitizer   *LabelSanitizer
+	drain       *queueDrain
+	flushes     *flushSchedule
+
+	// closeLock guards closed against concurrent pushes, so Shutdown never
+	// closes metricQueue while a metric is being pushed to it
+	closeLock sync.RWMutex
+	closed    bool
+
+	// stopCh is closed by Shutdown, ready once connected for the first time
+	stopCh    chan struct{}
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// reconnectWait is the wait before reconnecting after an error
+	reconnectWait time.Duration
+
+	// initialConn is the connection made by the constructor with
+	// ConnectRetry, taken over by the flush loop
+	initialConn net.Conn
 }
 
-// NewStatsiteSink is used to create a new StatsiteSink
+// NewStatsiteSink is used to create a new StatsiteSink using the default
+// options.
 func NewStatsiteSink(addr string) (*StatsiteSink, error) {
+	return NewStatsiteSinkFrom(addr, DefaultStatsiteOpts)
+}
+
+// NewStatsiteSinkFrom is used to create a new StatsiteSink using the passed
+// options.
+func NewStatsiteSinkFrom(addr string, opts StatsiteOpts) (*StatsiteSink, error) {
 	s := &StatsiteSink{
-		addr:        addr,
-		metricQueue: make(chan string, 4096),
+		addr:          addr,
+		metricQueue:   make(chan string, 4096),
+		errLog:        opts.ErrorLog,
+		queueDepth:    opts.EmitQueueDepth,
+		sanitizer:     opts.LabelSanitizer,
+		stopCh:        make(chan struct{}),
+		ready:         make(chan struct{}),
+		reconnectWait: reconnectInterval,
+	}
+	if s.errLog == nil {
+		s.errLog = NewFailureLogger()
+	}
+	overflow, err := newQueueOverflow(opts.QueueOverflow, opts.QueueBlockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	s.overflow = overflow
+	if s.drain, err = newQueueDrain(opts.DrainTimeout); err != nil {
+		return nil, err
+	}
+	if s.flushes, err = newFlushSchedule(opts.FlushAlignment, opts.FlushJitter); err != nil {
+		return nil, err
+	}
+	if opts.QueuePriority != nil {
+		limits, err := newQueueLimits(*opts.QueuePriority, cap(s.metricQueue))
+		if err != nil {
+			return nil, err
+		}
+		s.limits = limits
+	}
+	if opts.ConnectRetry.Attempts > 0 {
+		err := opts.ConnectRetry.Do(func() (err error) {
+			s.initialConn, err = net.Dial("tcp", s.addr)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to statsite: %s", err)
+		}
+	}
+	if err := GoSink(s.flushMetrics); err != nil {
+		if s.initialConn != nil {
+			s.initialConn.Close()
+		}
+		return nil, err
 	}
-	go s.flushMetrics()
 	return s, nil
 }
 
-// Close is used to stop flushing to statsite
+// Shutdown is used to stop flushing to statsite. Metrics emitted concurrently
+// with or after Shutdown are dropped, and calling it again has no effect.
+// With a DrainTimeout, it first waits for the queued metrics to be sent.
 func (s *StatsiteSink) Shutdown() {
+	s.closeLock.Lock()
+	if s.closed {
+		s.closeLock.Unlock()
+		return
+	}
+	s.closed = true
 	close(s.metricQueue)
+	close(s.stopCh)
+	s.closeLock.Unlock()
+
+	s.drain.wait()
+}
+
+// QueueLen returns the number of metrics waiting to be flushed
+func (s *StatsiteSink) QueueLen() int {
+	return len(s.metricQueue)
+}
+
+// QueueCap returns the number of metrics which can wait to be flushed before
+// new ones are dropped
+func (s *StatsiteSink) QueueCap() int {
+	return cap(s.metricQueue)
+}
+
+// Ready returns a channel which is closed once the sink has connected to
+// statsite for the first time. Metrics emitted before that are queued, not
+// dropped, even if connecting fails, so a short outage at startup does not
+// lose them. They are delayed until the connection is up though, and once
+// the queue is full further metrics are dropped. Waiting for Ready is
+// optional and only needed to make sure startup metrics fit in the queue.
+func (s *StatsiteSink) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// IsReady returns whether the sink has connected to statsite at least once
+func (s *StatsiteSink) IsReady() bool {
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
 }
 
 func (s *StatsiteSink) SetGauge(key []string, val float32) {
+	if !s.admit(MetricTypeGauge, key, nil) {
+		return
+	}
 	flatKey := s.flattenKey(key)
 	s.pushMetric(fmt.Sprintf("%s:%f|g\n", flatKey, val))
 }
 
 func (s *StatsiteSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	if !s.admit(MetricTypeGauge, key, labels) {
+		return
+	}
 	flatKey := s.flattenKeyLabels(key, labels)
 	s.pushMetric(fmt.Sprintf("%s:%f|g\n", flatKey, val))
 }
 
 func (s *StatsiteSink) EmitKey(key []string, val float32) {
+	if !s.admit(MetricTypeKey, key, nil) {
+		return
+	}
 	flatKey := s.flattenKey(key)
 	s.pushMetric(fmt.Sprintf("%s:%f|kv\n", flatKey, val))
 }
 
 func (s *StatsiteSink) IncrCounter(key []string, val float32) {
+	if !s.admit(MetricTypeCounter, key, nil) {
+		return
+	}
 	flatKey := s.flattenKey(key)
 	s.pushMetric(fmt.Sprintf("%s:%f|c\n", flatKey, val))
 }
 
 func (s *StatsiteSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	if !s.admit(MetricTypeCounter, key, labels) {
+		return
+	}
 	flatKey := s.flattenKeyLabels(key, labels)
 	s.pushMetric(fmt.Sprintf("%s:%f|c\n", flatKey, val))
 }
 
+// SetGaugeIntWithLabels emits an integer gauge without a fractional part
+func (s *StatsiteSink) SetGaugeIntWithLabels(key []string, val int64, labels []Label) {
+	if !s.admit(MetricTypeGauge, key, labels) {
+		return
+	}
+	flatKey := s.flattenKeyLabels(key, labels)
+	s.pushMetric(fmt.Sprintf("%s:%d|g\n", flatKey, val))
+}
+
+// IncrCounterIntWithLabels emits an integer counter increment without a
+// fractional part
+func (s *StatsiteSink) IncrCounterIntWithLabels(key []string, val int64, labels []Label) {
+	if !s.admit(MetricTypeCounter, key, labels) {
+		return
+	}
+	flatKey := s.flattenKeyLabels(key, labels)
+	s.pushMetric(fmt.Sprintf("%s:%d|c\n", flatKey, val))
+}
+
 func (s *StatsiteSink) AddSample(key []string, val float32) {
+	if !s.admit(MetricTypeSample, key, nil) {
+		return
+	}
 	flatKey := s.flattenKey(key)
 	s.pushMetric(fmt.Sprintf("%s:%f|ms\n", flatKey, val))
 }
 
 func (s *StatsiteSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	if !s.admit(MetricTypeSample, key, labels) {
+		return
+	}
 	flatKey := s.flattenKeyLabels(key, labels)
 	s.pushMetric(fmt.Sprintf("%s:%f|ms\n", flatKey, val))
 }
@@ -83,71 +304,120 @@ func (s *StatsiteSink) AddSampleWithLabels(key []string, val float32, labels []L
 // Flattens the key for formatting, removes spaces
 func (s *StatsiteSink) flattenKey(parts []string) string {
 	joined := strings.Join(parts, ".")
-	return strings.Map(func(r rune) rune {
-		switch r {
-		case ':':
-			fallthrough
-		case ' ':
-			return '_'
-		default:
-			return r
-		}
-	}, joined)
+	return strings.Map(StatsdSanitize, joined)
 }
 
 // Flattens the key along with labels for formatting, removes spaces
 func (s *StatsiteSink) flattenKeyLabels(parts []string, labels []Label) string {
 	for _, label := range labels {
-		parts = append(parts, label.Value)
+		value := label.Value
+		if s.sanitizer != nil {
+			value = s.sanitizer.Sanitize(value)
+		}
+		parts = append(parts, value)
 	}
 	return s.flattenKey(parts)
 }
 
-// Does a non-blocking push to the metrics queue
+// SinkStats returns the number of metrics dropped because the queue was
+// full, and the number of connection and write errors.
+func (s *StatsiteSink) SinkStats() SinkStats {
+	return SinkStats{
+		Dropped: atomic.LoadUint64(&s.dropped),
+		Errors:  atomic.LoadUint64(&s.errors),
+	}
+}
+
+// admit returns whether an emission of typ may be queued under the queue
+// priority, counting it as dropped otherwise
+func (s *StatsiteSink) admit(typ MetricType, key []string, labels []Label) bool {
+	if s.limits.admits(typ, len(s.metricQueue)) {
+		return true
+	}
+	atomic.AddUint64(&s.dropped, 1)
+	notifyDrop(key, labels, DropQueueFull)
+	return false
+}
+
+// Pushes to the metrics queue following the overflow policy, dropping the
+// metric if the sink is shut down
 func (s *StatsiteSink) pushMetric(m string) {
-	select {
-	case s.metricQueue <- m:
-	default:
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+	if s.closed {
+		atomic.AddUint64(&s.dropped, 1)
+		notifyDropLine(m, DropShutdown)
+		return
+	}
+	if dropped := s.overflow.push(s.metricQueue, m); dropped > 0 {
+		atomic.AddUint64(&s.dropped, dropped)
 	}
 }
 
+// logError counts and logs a connection or write error
+func (s *StatsiteSink) logError(format string, err error) {
+	atomic.AddUint64(&s.errors, 1)
+	s.errLog.Printf(format, err)
+}
+
 // Flushes metrics
 func (s *StatsiteSink) flushMetrics() {
 	var sock net.Conn
 	var err error
 	var wait <-chan time.Time
 	var buffered *bufio.Writer
-	ticker := time.NewTicker(flushInterval)
+	ticker := s.flushes.ticker()
 	defer ticker.Stop()
+	defer s.drain.exit()
 
 CONNECT:
-	// Attempt to connect
-	sock, err = net.Dial("tcp", s.addr)
+	// Attempt to connect, unless the constructor already did
+	if s.initialConn != nil {
+		sock, s.initialConn = s.initialConn, nil
+	} else {
+		sock, err = net.Dial("tcp", s.addr)
+	}
 	if err != nil {
-		log.Printf("[ERR] Error connecting to statsite! Err: %s", err)
+		s.logError("[ERR] Error connecting to statsite! Err: %s", err)
 		goto WAIT
 	}
 
 	// Create a buffered writer
 	buffered = bufio.NewWriter(sock)
+	s.drain.setConn(sock)
+	s.readyOnce.Do(func() { close(s.ready) })
 
 	for {
 		select {
 		case metric, ok := <-s.metricQueue:
 			// Get a metric from the queue
 			if !ok {
+				if s.drain.enabled() {
+					if err := buffered.Flush(); err != nil {
+						s.logError("[ERR] Error flushing to statsite! Err: %s", err)
+					}
+					sock.Close()
+				}
 				goto QUIT
 			}
 
 			// Try to send to statsite
 			_, err := buffered.Write([]byte(metric))
 			if err != nil {
-				log.Printf("[ERR] Error writing to statsite! Err: %s", err)
+				s.logError("[ERR] Error writing to statsite! Err: %s", err)
 				goto WAIT
 			}
 		case <-ticker.C:
+			ticker.fired()
+			if s.queueDepth && buffered.Buffered() > 0 {
+				depth := fmt.Sprintf("statsite.queue_depth:%d|g\n", len(s.metricQueue))
+				if _, err := buffered.WriteString(depth); err != nil {
+					s.logError("[ERR] Error writing to statsite! Err: %s", err)
+					goto WAIT
+				}
+			}
 			if err := buffered.Flush(); err != nil {
-				log.Printf("[ERR] Error flushing to statsite! Err: %s", err)
+				s.logError("[ERR] Error flushing to statsite! Err: %s", err)
 				goto WAIT
 			}
 		}
@@ -155,7 +425,18 @@ CONNECT:
 
 WAIT:
 	// Wait for a while
-	wait = time.After(time.Duration(5) * time.Second)
+	s.drain.setConn(nil)
+	wait = time.After(s.reconnectWait)
+	if !s.IsReady() {
+		// Never connected yet, keep the early metrics queued for the first
+		// connection instead of dropping them
+		select {
+		case <-wait:
+			goto CONNECT
+		case <-s.stopCh:
+			goto QUIT
+		}
+	}
 	for {
 		select {
 		// Dequeue the messages to avoid backlog
@@ -168,5 +449,5 @@ WAIT:
 		}
 	}
 QUIT:
-	s.metricQueue = nil
+	return
 }
@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"net"
 	"net/url"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -17,6 +19,22 @@ func TestStatsite_Flatten(t *testing.T) {
 	}
 }
 
+func TestStatsite_LabelSanitizer(t *testing.T) {
+	sanitizer, err := NewLabelSanitizer(StatsdSanitize, CollisionCount, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s := &StatsiteSink{sanitizer: sanitizer}
+	first := s.flattenKeyLabels([]string{"req"}, []Label{{"path", "a b"}})
+	second := s.flattenKeyLabels([]string{"req"}, []Label{{"path", "a_b"}})
+	if first != "req.a_b" || second != first {
+		t.Fatalf("bad flat: %q %q", first, second)
+	}
+	if c := sanitizer.Collisions(); c != 1 {
+		t.Fatalf("bad collisions: %d", c)
+	}
+}
+
 func TestStatsite_PushFullQueue(t *testing.T) {
 	q := make(chan string, 1)
 	q <- "full"
@@ -34,6 +52,180 @@ func TestStatsite_PushFullQueue(t *testing.T) {
 		t.Fatalf("bad val %v", v)
 	default:
 	}
+
+	if stats := s.SinkStats(); stats.Dropped != 1 || stats.Errors != 0 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+}
+
+func TestStatsite_QueueOverflow(t *testing.T) {
+	q := make(chan string, 1)
+	q <- "full"
+
+	// Blocking waits for the queue to drain
+	s := &StatsiteSink{metricQueue: q, overflow: queueOverflow{policy: OverflowBlock, timeout: time.Second}}
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		<-q
+	}()
+	s.pushMetric("kept")
+	if out := <-q; out != "kept" {
+		t.Fatalf("bad val %v", out)
+	}
+	if stats := s.SinkStats(); stats.Dropped != 0 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+
+	// And drops the metric once it times out
+	q <- "full"
+	s.overflow.timeout = time.Millisecond
+	s.pushMetric("omit")
+	if out := <-q; out != "full" {
+		t.Fatalf("bad val %v", out)
+	}
+	if stats := s.SinkStats(); stats.Dropped != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+
+	if _, err := NewStatsiteSinkFrom("127.0.0.1:7523", StatsiteOpts{QueueBlockTimeout: -time.Second}); err == nil {
+		t.Fatalf("expected error for bad block timeout")
+	}
+}
+
+func TestStatsite_IntegerTyping(t *testing.T) {
+	q := make(chan string, 2)
+	s := &StatsiteSink{metricQueue: q}
+	s.IncrCounterIntWithLabels([]string{"req", "count"}, 4, []Label{{"a", "label"}})
+	s.SetGaugeIntWithLabels([]string{"conns"}, 12, nil)
+
+	for _, expect := range []string{"req.count.label:4|c\n", "conns:12|g\n"} {
+		if out := <-q; out != expect {
+			t.Fatalf("bad line %q, expected %q", out, expect)
+		}
+	}
+}
+
+func TestStatsite_ShutdownDuringEmission(t *testing.T) {
+	s, err := NewStatsiteSink("127.0.0.1:7524")
+	if err != nil {
+		t.Fatalf("bad error")
+	}
+
+	// Emitters racing with Shutdown drop their metrics instead of panicking
+	// on the closed queue
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for i := 0; i < 1000; i++ {
+				s.IncrCounter([]string{"counter"}, 1)
+				s.SetGaugeWithLabels([]string{"gauge"}, 1, []Label{{"a", "b"}})
+				s.AddSample([]string{"sample"}, 1)
+				s.QueueLen()
+			}
+		}()
+	}
+	close(start)
+	s.Shutdown()
+	wg.Wait()
+
+	// Calling it again is a no-op, and later metrics are dropped
+	s.Shutdown()
+	before := s.SinkStats().Dropped
+	s.IncrCounter([]string{"counter"}, 1)
+	if dropped := s.SinkStats().Dropped; dropped != before+1 {
+		t.Fatalf("expected a drop, got %d after %d", dropped, before)
+	}
+}
+
+func TestStatsite_QueueLen(t *testing.T) {
+	s := &StatsiteSink{metricQueue: make(chan string, 4)}
+	if s.QueueLen() != 0 || s.QueueCap() != 4 {
+		t.Fatalf("bad queue: %d/%d", s.QueueLen(), s.QueueCap())
+	}
+
+	s.IncrCounter([]string{"a"}, 1)
+	s.IncrCounter([]string{"b"}, 1)
+	s.IncrCounter([]string{"c"}, 1)
+	if s.QueueLen() != 3 {
+		t.Fatalf("expected 3 queued metrics, got %d", s.QueueLen())
+	}
+
+	<-s.metricQueue
+	if s.QueueLen() != 2 {
+		t.Fatalf("expected 2 queued metrics, got %d", s.QueueLen())
+	}
+}
+
+func TestStatsite_QueuePriority(t *testing.T) {
+	limits, err := newQueueLimits(QueuePriority{
+		DropOrder: []MetricType{MetricTypeKey, MetricTypeSample},
+		Pressure:  0.5,
+	}, 4)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s := &StatsiteSink{metricQueue: make(chan string, 4), limits: limits}
+
+	// Keys are dropped first, then samples
+	s.EmitKey([]string{"key"}, 1)
+	s.EmitKey([]string{"key"}, 1)
+	s.EmitKey([]string{"key"}, 1)
+	s.AddSample([]string{"sample"}, 1)
+	s.AddSample([]string{"sample"}, 1)
+	s.SetGauge([]string{"gauge"}, 1)
+	s.IncrCounter([]string{"counter"}, 1)
+
+	var lines []string
+	for len(s.metricQueue) > 0 {
+		lines = append(lines, <-s.metricQueue)
+	}
+	expect := []string{"key:1.000000|kv\n", "key:1.000000|kv\n", "sample:1.000000|ms\n", "gauge:1.000000|g\n"}
+	if !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("bad lines: %q", lines)
+	}
+	if dropped := s.SinkStats().Dropped; dropped != 3 {
+		t.Fatalf("bad dropped: %d", dropped)
+	}
+}
+
+func TestStatsite_EmitQueueDepth(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer ln.Close()
+
+	s, err := NewStatsiteSinkFrom(ln.Addr().String(), StatsiteOpts{EmitQueueDepth: true})
+	if err != nil {
+		t.Fatalf("bad error")
+	}
+	defer s.Shutdown()
+	s.IncrCounter([]string{"counter", "me"}, float32(1))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	for _, expect := range []string{
+		"counter.me:1.000000|c\n",
+		"statsite.queue_depth:0|g\n",
+	} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		if line != expect {
+			t.Fatalf("bad line %q, expected %q", line, expect)
+		}
+	}
 }
 
 func TestStatsite_Conn(t *testing.T) {
@@ -130,6 +322,162 @@ func TestStatsite_Conn(t *testing.T) {
 	}
 }
 
+func TestStatsite_QueuesUntilReady(t *testing.T) {
+	addr := "localhost:7525"
+	s := &StatsiteSink{
+		addr:          addr,
+		metricQueue:   make(chan string, 4),
+		errLog:        NewFailureLogger(),
+		stopCh:        make(chan struct{}),
+		ready:         make(chan struct{}),
+		reconnectWait: 10 * time.Millisecond,
+	}
+	go s.flushMetrics()
+	defer s.Shutdown()
+
+	s.SetGauge([]string{"gauge", "val"}, float32(1))
+	s.IncrCounter([]string{"counter", "me"}, float32(2))
+
+	// Let a few connection attempts fail while nothing listens
+	time.Sleep(50 * time.Millisecond)
+	if s.IsReady() {
+		t.Fatalf("should not be ready")
+	}
+	if n := len(s.metricQueue); n != 2 {
+		t.Fatalf("expected queued metrics to be kept, got %d", n)
+	}
+	if stats := s.SinkStats(); stats.Errors == 0 {
+		t.Fatalf("expected connection errors, got %+v", stats)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer ln.Close()
+
+	select {
+	case <-s.Ready():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout waiting for ready")
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	for _, expect := range []string{
+		"gauge.val:1.000000|g\n",
+		"counter.me:2.000000|c\n",
+	} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		if line != expect {
+			t.Fatalf("bad line %q, expected %q", line, expect)
+		}
+	}
+}
+
+func TestStatsite_ShutdownBeforeReady(t *testing.T) {
+	s := &StatsiteSink{
+		addr:          "localhost:7525",
+		metricQueue:   make(chan string, 4),
+		errLog:        NewFailureLogger(),
+		stopCh:        make(chan struct{}),
+		ready:         make(chan struct{}),
+		reconnectWait: time.Hour,
+	}
+	done := make(chan struct{})
+	go func() {
+		s.flushMetrics()
+		close(done)
+	}()
+
+	s.SetGauge([]string{"gauge", "val"}, float32(1))
+	s.Shutdown()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("flush loop did not exit")
+	}
+}
+
+func TestStatsite_ConnectRetry(t *testing.T) {
+	// Reserve a port, and only listen on it after a delay
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	listening := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Errorf("unexpected err %s", err)
+			ln = nil
+		}
+		listening <- ln
+	}()
+
+	opts := StatsiteOpts{ConnectRetry: ConnectRetry{Attempts: 100, Delay: 10 * time.Millisecond}}
+	s, err := NewStatsiteSinkFrom(addr, opts)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	ln = <-listening
+	if ln == nil {
+		return
+	}
+	defer ln.Close()
+
+	select {
+	case <-s.Ready():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout waiting for ready")
+	}
+	s.SetGauge([]string{"gauge", "val"}, float32(1))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "gauge.val:1.000000|g\n" {
+		t.Fatalf("bad line %q: %v", line, err)
+	}
+}
+
+func TestStatsite_ConnectRetryExhausted(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	start := time.Now()
+	opts := StatsiteOpts{ConnectRetry: ConnectRetry{Attempts: 3, Delay: 10 * time.Millisecond}}
+	if _, err := NewStatsiteSinkFrom(addr, opts); err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Fatalf("expected error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("expected retries, returned after %v", elapsed)
+	}
+}
+
 func TestNewStatsiteSinkFromURL(t *testing.T) {
 	for _, tc := range []struct {
 		desc       string
@@ -170,3 +518,82 @@ func TestNewStatsiteSinkFromURL(t *testing.T) {
 		})
 	}
 }
+
+func TestStatsite_DrainOnShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ln.Close()
+	lines := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var got []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			got = append(got, scanner.Text())
+		}
+		lines <- got
+	}()
+
+	s, err := NewStatsiteSinkFrom(ln.Addr().String(), StatsiteOpts{DrainTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		s.IncrCounter([]string{"counter"}, 1)
+	}
+
+	// Every queued metric is written, and the connection closed, before
+	// Shutdown returns
+	s.Shutdown()
+	select {
+	case got := <-lines:
+		if len(got) != 1000 || got[999] != "counter:1.000000|c" {
+			t.Fatalf("bad lines: %d", len(got))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestStatsite_DrainTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ln.Close()
+	// The backend accepts the connection but never reads from it
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	s, err := NewStatsiteSinkFrom(ln.Addr().String(), StatsiteOpts{DrainTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer func() {
+		if conn := <-accepted; conn != nil {
+			conn.Close()
+		}
+	}()
+	value := strings.Repeat("x", 1<<20)
+	for i := 0; i < 64; i++ {
+		s.EmitKey([]string{value}, 1)
+	}
+
+	// Shutdown gives up on the blocked writes once the timeout has passed
+	start := time.Now()
+	s.Shutdown()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("shutdown took %s", elapsed)
+	}
+}
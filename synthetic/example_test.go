@@ -0,0 +1,41 @@
+package synthetic_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/synthetic"
+)
+
+func ExampleGenerator() {
+	// Send the traffic to the sink backing the dashboard, e.g. a statsd sink
+	sink := metrics.NewInmemSink(10*time.Second, time.Hour)
+
+	g, err := synthetic.NewGenerator(sink, time.Second, 1,
+		synthetic.Series{
+			Key:   []string{"api", "requests"},
+			Type:  metrics.MetricTypeCounter,
+			Shape: synthetic.Sine{Base: 100, Amplitude: 50, Period: 10 * time.Minute, Noise: 5},
+		},
+		synthetic.Series{
+			Key:     []string{"api", "latency"},
+			Labels:  []metrics.Label{{Name: "route", Value: "/users"}},
+			Type:    metrics.MetricTypeSample,
+			Shape:   synthetic.Spikes{Base: 20, Height: 500, Probability: 0.01},
+			Samples: 50,
+		},
+		synthetic.Series{
+			Key:   []string{"queue", "depth"},
+			Type:  metrics.MetricTypeGauge,
+			Shape: &synthetic.RandomWalk{Start: 10, Step: 2, Min: 0, Max: 100},
+		},
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	g.Run(ctx)
+}
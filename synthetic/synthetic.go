@@ -0,0 +1,198 @@
+// Package synthetic generates synthetic metric traffic, such as sine waves,
+// random walks and spikes, through any MetricSink. It is meant for building
+// and validating dashboards without a real workload, and is not used by the
+// metrics package itself.
+package synthetic
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// Shape generates the values of a synthetic series
+type Shape interface {
+	// Value returns the value of the series elapsed after the generator
+	// started. Shapes are only called by a single goroutine, and may keep
+	// state between calls.
+	Value(elapsed time.Duration, rnd *rand.Rand) float64
+}
+
+// Constant is a Shape which always has the same value
+type Constant float64
+
+func (c Constant) Value(time.Duration, *rand.Rand) float64 {
+	return float64(c)
+}
+
+// Sine is a Shape oscillating around Base, such as a daily traffic pattern
+type Sine struct {
+	Base      float64
+	Amplitude float64
+	Period    time.Duration
+
+	// Phase shifts the wave forward, so series with the same period don't
+	// peak together
+	Phase time.Duration
+
+	// Noise is the standard deviation of the normally distributed noise
+	// added to every value
+	Noise float64
+}
+
+func (s Sine) Value(elapsed time.Duration, rnd *rand.Rand) float64 {
+	v := s.Base
+	if s.Period > 0 {
+		v += s.Amplitude * math.Sin(2*math.Pi*float64(elapsed+s.Phase)/float64(s.Period))
+	}
+	if s.Noise > 0 {
+		v += rnd.NormFloat64() * s.Noise
+	}
+	return v
+}
+
+// RandomWalk is a Shape starting at Start and moving by a uniformly random
+// step of at most Step every value, kept between Min and Max unless both are
+// zero. A RandomWalk keeps its position, so each series needs its own.
+type RandomWalk struct {
+	Start    float64
+	Step     float64
+	Min, Max float64
+
+	started bool
+	current float64
+}
+
+func (w *RandomWalk) Value(_ time.Duration, rnd *rand.Rand) float64 {
+	if !w.started {
+		w.started = true
+		w.current = w.Start
+		return w.current
+	}
+	w.current += (rnd.Float64()*2 - 1) * w.Step
+	if w.Min != 0 || w.Max != 0 {
+		w.current = math.Max(w.Min, math.Min(w.Max, w.current))
+	}
+	return w.current
+}
+
+// Spikes is a Shape holding Base, with each value spiking to Base+Height
+// with the given Probability, such as an occasional latency outlier
+type Spikes struct {
+	Base        float64
+	Height      float64
+	Probability float64
+}
+
+func (s Spikes) Value(_ time.Duration, rnd *rand.Rand) float64 {
+	if rnd.Float64() < s.Probability {
+		return s.Base + s.Height
+	}
+	return s.Base
+}
+
+// Series describes a synthetic series
+type Series struct {
+	Key    []string
+	Labels []metrics.Label
+
+	// Type selects how values are emitted: gauges are set to the value,
+	// counters incremented by it, samples added and keys emitted
+	Type metrics.MetricType
+
+	Shape Shape
+
+	// Samples is the number of values emitted per tick for samples and
+	// counters, defaulting to one, so aggregates such as quantiles have
+	// something to work with
+	Samples int
+}
+
+// Generator emits the values of synthetic series to a sink every interval
+type Generator struct {
+	sink     metrics.MetricSink
+	interval time.Duration
+	series   []Series
+
+	lock sync.Mutex
+	rnd  *rand.Rand
+}
+
+// NewGenerator creates a Generator emitting series to sink every interval,
+// with values drawn from a random source seeded with seed, so runs with the
+// same seed are repeatable.
+func NewGenerator(sink metrics.MetricSink, interval time.Duration, seed int64, series ...Series) (*Generator, error) {
+	if sink == nil {
+		return nil, fmt.Errorf("sink is required")
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive")
+	}
+	for _, s := range series {
+		if len(s.Key) == 0 || s.Shape == nil {
+			return nil, fmt.Errorf("series %v requires a key and a shape", s.Key)
+		}
+		switch s.Type {
+		case metrics.MetricTypeGauge, metrics.MetricTypeCounter, metrics.MetricTypeSample, metrics.MetricTypeKey:
+		default:
+			return nil, fmt.Errorf("series %v has unknown type %v", s.Key, s.Type)
+		}
+	}
+	return &Generator{
+		sink:     sink,
+		interval: interval,
+		series:   series,
+		rnd:      rand.New(rand.NewSource(seed)),
+	}, nil
+}
+
+// Emit emits a value of every series, generated for elapsed since the
+// generator started. Run calls it every interval; tests may call it
+// directly to step through time.
+func (g *Generator) Emit(elapsed time.Duration) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, s := range g.series {
+		n := 1
+		if s.Samples > 1 && (s.Type == metrics.MetricTypeSample || s.Type == metrics.MetricTypeCounter) {
+			n = s.Samples
+		}
+		for j := 0; j < n; j++ {
+			val := float32(s.Shape.Value(elapsed, g.rnd))
+			switch s.Type {
+			case metrics.MetricTypeGauge:
+				g.sink.SetGaugeWithLabels(s.Key, val, s.Labels)
+			case metrics.MetricTypeCounter:
+				g.sink.IncrCounterWithLabels(s.Key, val, s.Labels)
+			case metrics.MetricTypeSample:
+				g.sink.AddSampleWithLabels(s.Key, val, s.Labels)
+			case metrics.MetricTypeKey:
+				g.sink.EmitKey(s.Key, val)
+			}
+		}
+	}
+}
+
+// Run emits the series right away and then every interval, until ctx is
+// done
+func (g *Generator) Run(ctx context.Context) {
+	start := time.Now()
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	g.Emit(0)
+	for {
+		select {
+		case now := <-ticker.C:
+			g.Emit(now.Sub(start))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
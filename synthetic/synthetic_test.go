@@ -0,0 +1,158 @@
+package synthetic
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+func TestNewGenerator_Validation(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Hour, time.Hour)
+	for _, args := range []struct {
+		sink     metrics.MetricSink
+		interval time.Duration
+		series   Series
+	}{
+		{nil, time.Second, Series{Key: []string{"a"}, Shape: Constant(1)}},
+		{sink, 0, Series{Key: []string{"a"}, Shape: Constant(1)}},
+		{sink, time.Second, Series{Shape: Constant(1)}},
+		{sink, time.Second, Series{Key: []string{"a"}}},
+		{sink, time.Second, Series{Key: []string{"a"}, Shape: Constant(1), Type: 42}},
+	} {
+		if _, err := NewGenerator(args.sink, args.interval, 1, args.series); err == nil {
+			t.Fatalf("expected error for %+v", args)
+		}
+	}
+}
+
+func TestSine(t *testing.T) {
+	s := Sine{Base: 10, Amplitude: 5, Period: 4 * time.Minute}
+	for elapsed, expect := range map[time.Duration]float64{
+		0:               10,
+		time.Minute:     15,
+		2 * time.Minute: 10,
+		3 * time.Minute: 5,
+	} {
+		if got := s.Value(elapsed, nil); math.Abs(got-expect) > 1e-9 {
+			t.Fatalf("bad value at %v: %v", elapsed, got)
+		}
+	}
+
+	s.Phase = time.Minute
+	if got := s.Value(0, nil); math.Abs(got-15) > 1e-9 {
+		t.Fatalf("bad shifted value: %v", got)
+	}
+	s.Noise = 1
+	if got := s.Value(0, rand.New(rand.NewSource(1))); got == 15 {
+		t.Fatalf("expected noise")
+	}
+}
+
+func TestRandomWalk(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	w := &RandomWalk{Start: 50, Step: 10, Min: 0, Max: 60}
+	if got := w.Value(0, rnd); got != 50 {
+		t.Fatalf("bad start: %v", got)
+	}
+	prev := 50.0
+	for j := 0; j < 1000; j++ {
+		v := w.Value(0, rnd)
+		if math.Abs(v-prev) > 10 || v < 0 || v > 60 {
+			t.Fatalf("bad step from %v to %v", prev, v)
+		}
+		prev = v
+	}
+}
+
+func TestSpikes(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	s := Spikes{Base: 1, Height: 99, Probability: 0.1}
+	spikes := 0
+	for j := 0; j < 10000; j++ {
+		switch s.Value(0, rnd) {
+		case 100:
+			spikes++
+		case 1:
+		default:
+			t.Fatalf("bad value")
+		}
+	}
+	if spikes < 800 || spikes > 1200 {
+		t.Fatalf("bad spike count: %d", spikes)
+	}
+}
+
+func TestGenerator_Emit(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Hour, time.Hour)
+	labels := []metrics.Label{{Name: "route", Value: "/"}}
+	g, err := NewGenerator(sink, time.Second, 1,
+		Series{Key: []string{"load"}, Type: metrics.MetricTypeGauge, Shape: Constant(3), Labels: labels},
+		Series{Key: []string{"requests"}, Type: metrics.MetricTypeCounter, Shape: Constant(2), Samples: 5},
+		Series{Key: []string{"latency"}, Type: metrics.MetricTypeSample, Shape: Spikes{Base: 10, Height: 90, Probability: 0.5}, Samples: 100},
+		Series{Key: []string{"key"}, Type: metrics.MetricTypeKey, Shape: Constant(1)},
+	)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	g.Emit(0)
+	g.Emit(time.Second)
+
+	intv := sink.Data()[0]
+	if gauge := intv.Gauges["load;route=/"]; gauge.Value != 3 {
+		t.Fatalf("bad gauge: %v", intv.Gauges)
+	}
+	if c := intv.Counters["requests"]; c.Count != 10 || c.Sum != 20 {
+		t.Fatalf("bad counter: %v", intv.Counters)
+	}
+	s := intv.Samples["latency"]
+	if s.Count != 200 || s.Min != 10 || s.Max != 100 {
+		t.Fatalf("bad sample: %v", intv.Samples)
+	}
+	if len(intv.Points["key"]) != 2 {
+		t.Fatalf("bad points: %v", intv.Points)
+	}
+}
+
+func TestGenerator_Repeatable(t *testing.T) {
+	values := func() []float32 {
+		sink := metrics.NewInmemSink(time.Hour, time.Hour)
+		g, _ := NewGenerator(sink, time.Second, 42,
+			Series{Key: []string{"walk"}, Type: metrics.MetricTypeKey, Shape: &RandomWalk{Start: 1, Step: 1}})
+		for j := 0; j < 10; j++ {
+			g.Emit(time.Duration(j) * time.Second)
+		}
+		return sink.Data()[0].Points["walk"]
+	}
+	a, b := values(), values()
+	for j := range a {
+		if a[j] != b[j] {
+			t.Fatalf("runs differ: %v %v", a, b)
+		}
+	}
+}
+
+func TestGenerator_Run(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Hour, time.Hour)
+	g, _ := NewGenerator(sink, time.Millisecond, 1,
+		Series{Key: []string{"ticks"}, Type: metrics.MetricTypeCounter, Shape: Constant(1)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.Run(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for sink.Data()[0].Counters["ticks"].AggregateSample == nil || sink.Data()[0].Counters["ticks"].Count < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected ticks")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tailTimeFormat is the timestamp layout at the start of each TailSink line
+const tailTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// ANSI color codes used by TailSink, keyed by the metric type letter
+var tailColors = map[string]string{
+	"G": "\x1b[32m", // green
+	"P": "\x1b[35m", // magenta
+	"C": "\x1b[36m", // cyan
+	"S": "\x1b[33m", // yellow
+}
+
+const tailColorReset = "\x1b[0m"
+
+// TailSink provides a MetricSink that writes every emission as a single
+// human-readable line, for watching metrics in a terminal during local
+// development. Lines have the form:
+//
+//	2014-01-28T14:57:33.040-08:00 [C] service.requests 1.000 method=GET
+//
+// The type letters match the InmemSignal output: G for gauges, P for
+// key/value points, C for counters and S for samples.
+type TailSink struct {
+	w     io.Writer
+	color bool
+	lock  sync.Mutex
+}
+
+// NewTailSink creates a TailSink writing to w. When color is set, the type
+// of each line is highlighted with ANSI escape codes; leave it unset when w
+// is not a terminal.
+func NewTailSink(w io.Writer, color bool) *TailSink {
+	return &TailSink{w: w, color: color}
+}
+
+// DefaultTailSink returns a TailSink that writes uncolored lines to stdout
+func DefaultTailSink() *TailSink {
+	return NewTailSink(os.Stdout, false)
+}
+
+func (t *TailSink) SetGauge(key []string, val float32) {
+	t.SetGaugeWithLabels(key, val, nil)
+}
+
+func (t *TailSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	t.writeLine("G", key, val, labels)
+}
+
+func (t *TailSink) EmitKey(key []string, val float32) {
+	t.writeLine("P", key, val, nil)
+}
+
+func (t *TailSink) IncrCounter(key []string, val float32) {
+	t.IncrCounterWithLabels(key, val, nil)
+}
+
+func (t *TailSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	t.writeLine("C", key, val, labels)
+}
+
+func (t *TailSink) AddSample(key []string, val float32) {
+	t.AddSampleWithLabels(key, val, nil)
+}
+
+func (t *TailSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	t.writeLine("S", key, val, labels)
+}
+
+// writeLine formats a single emission and writes it out
+func (t *TailSink) writeLine(typ string, key []string, val float32, labels []Label) {
+	buf := bytes.NewBufferString(time.Now().Format(tailTimeFormat))
+	buf.WriteByte(' ')
+	if t.color {
+		buf.WriteString(tailColors[typ])
+	}
+	fmt.Fprintf(buf, "[%s]", typ)
+	if t.color {
+		buf.WriteString(tailColorReset)
+	}
+	buf.WriteByte(' ')
+	spaceReplacer.WriteString(buf, strings.Join(key, "."))
+	fmt.Fprintf(buf, " %0.3f", val)
+	for _, label := range labels {
+		buf.WriteByte(' ')
+		spaceReplacer.WriteString(buf, label.Name)
+		buf.WriteByte('=')
+		spaceReplacer.WriteString(buf, label.Value)
+	}
+	buf.WriteByte('\n')
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.w.Write(buf.Bytes())
+}
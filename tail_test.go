@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTailSink(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	s := NewTailSink(buf, false)
+
+	s.SetGauge([]string{"foo", "bar"}, 42)
+	s.SetGaugeWithLabels([]string{"foo", "bar"}, 23, []Label{{"a", "b"}})
+	s.EmitKey([]string{"foo", "bar"}, 42)
+	s.IncrCounterWithLabels([]string{"foo", "bar"}, 20, []Label{{"a", "b"}, {"c", "d e"}})
+	s.AddSample([]string{"slow thingy"}, 1.5)
+
+	expected := []string{
+		"[G] foo.bar 42.000",
+		"[G] foo.bar 23.000 a=b",
+		"[P] foo.bar 42.000",
+		"[C] foo.bar 20.000 a=b c=d_e",
+		"[S] slow_thingy 1.500",
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("bad output: %q", buf.String())
+	}
+	for i, line := range lines {
+		parts := strings.SplitN(line, " ", 2)
+		if _, err := time.Parse(tailTimeFormat, parts[0]); err != nil {
+			t.Fatalf("bad timestamp %q: %v", parts[0], err)
+		}
+		if parts[1] != expected[i] {
+			t.Fatalf("expected %q, got %q", expected[i], parts[1])
+		}
+	}
+}
+
+func TestTailSink_Color(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	s := NewTailSink(buf, true)
+	s.IncrCounter([]string{"foo"}, 1)
+
+	if !strings.Contains(buf.String(), "\x1b[36m[C]\x1b[0m foo 1.000\n") {
+		t.Fatalf("bad output: %q", buf.String())
+	}
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import "strings"
+
+// ThresholdLabel attaches a label to the gauges, samples and timers of a key
+// whose value is above a threshold, e.g. slow=true to timers above 500ms, so
+// dashboards can split them from the others without a separate metric.
+type ThresholdLabel struct {
+	// Key is the key of the metrics to label, with '.' as the separator,
+	// before any prefix is added
+	Key string
+
+	// Threshold is the value above which the label is attached, in the
+	// units of the metric, e.g. of TimerGranularity for timers
+	Threshold float32
+
+	// Inclusive also attaches the label to values equal to Threshold
+	Inclusive bool
+
+	// Label is attached to the metrics crossing the threshold
+	Label Label
+}
+
+// matches returns whether val of the metric with key crosses the threshold
+func (t ThresholdLabel) matches(key string, val float32) bool {
+	if key != t.Key {
+		return false
+	}
+	if t.Inclusive {
+		return val >= t.Threshold
+	}
+	return val > t.Threshold
+}
+
+// thresholdLabels returns labels with the labels of the ThresholdLabels
+// crossed by val of the metric with key appended
+func (m *Metrics) thresholdLabels(key []string, val float32, labels []Label) []Label {
+	if len(m.ThresholdLabels) == 0 {
+		return labels
+	}
+	name := strings.Join(key, ".")
+	for _, t := range m.ThresholdLabels {
+		if t.matches(name, val) {
+			labels = append(labels, t.Label)
+		}
+	}
+	return labels
+}
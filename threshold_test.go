@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetrics_ThresholdLabels(t *testing.T) {
+	slow := Label{"slow", "true"}
+	cases := []struct {
+		desc      string
+		val       float32
+		inclusive bool
+		labelled  bool
+	}{
+		{"below", 499, false, false},
+		{"at exclusive", 500, false, false},
+		{"at inclusive", 500, true, true},
+		{"above", 501, false, true},
+		{"above inclusive", 501, true, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			m, met := mockMetric()
+			met.ThresholdLabels = []ThresholdLabel{
+				{Key: "http.request", Threshold: 500, Inclusive: tc.inclusive, Label: slow},
+			}
+			labels := []Label{{"method", "GET"}}
+			met.AddSampleWithLabels([]string{"http", "request"}, tc.val, labels)
+			met.SetGaugeWithLabels([]string{"http", "request"}, tc.val, labels)
+
+			expect := labels
+			if tc.labelled {
+				expect = []Label{labels[0], slow}
+			}
+			for i := range m.keys {
+				if !reflect.DeepEqual(m.labels[i], expect) {
+					t.Fatalf("bad labels: %v", m.labels[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMetrics_ThresholdLabelsKeys(t *testing.T) {
+	m, met := mockMetric()
+	met.HostName = "host"
+	met.EnableHostnameLabel = true
+	met.EnableTypePrefix = true
+	met.TimerGranularity = time.Millisecond
+	met.ThresholdLabels = []ThresholdLabel{
+		{Key: "api.call", Threshold: 10, Label: Label{"slow", "true"}},
+		{Key: "api.call", Threshold: 100, Label: Label{"very_slow", "true"}},
+		{Key: "pool.usage", Threshold: 0.9, Inclusive: true, Label: Label{"full", "true"}},
+	}
+
+	// Keys are matched before prefixes are added, and every crossed
+	// threshold adds its label
+	met.MeasureSince([]string{"api", "call"}, time.Now().Add(-time.Second))
+	met.AddSample([]string{"api", "other"}, 1000)
+	met.SetGaugeGroup([]string{"pool"}, map[string]float32{"size": 1, "usage": 0.9}, nil)
+	met.IncrCounter([]string{"api", "call"}, 1000)
+
+	expect := [][]Label{
+		{{"host", "host"}, {"slow", "true"}, {"very_slow", "true"}},
+		{{"host", "host"}},
+		{{"host", "host"}},
+		{{"full", "true"}, {"host", "host"}},
+		{{"host", "host"}},
+	}
+	if !reflect.DeepEqual(m.labels, expect) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+
+	// The labels can be filtered like any other
+	m, met = mockMetric()
+	met.ThresholdLabels = []ThresholdLabel{{Key: "key", Threshold: 0, Label: Label{"slow", "true"}}}
+	met.UpdateFilterAndLabels(nil, nil, nil, []string{"slow"})
+	met.AddSample([]string{"key"}, 1)
+	if len(m.keys) != 1 || len(m.labels[0]) != 0 {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+}
@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DefaultTopNOtherValue is the label value of the series the label sets
+// outside the top N of a TopNRule are collapsed into
+const DefaultTopNOtherValue = "other"
+
+// TopNRank selects the aggregate value the label sets of a TopNRule are
+// ranked by. Gauges are always ranked by their value.
+type TopNRank int
+
+const (
+	// TopNBySum ranks by the sum of the values of the interval
+	TopNBySum TopNRank = iota
+
+	// TopNByCount ranks by the number of values of the interval
+	TopNByCount
+
+	// TopNByMean ranks by the mean of the values of the interval
+	TopNByMean
+
+	// TopNByMax ranks by the largest value of the interval
+	TopNByMax
+)
+
+// TopNRule limits the label sets an InmemSink keeps for a high cardinality
+// metric to the N with the highest aggregate value, e.g. the 10 slowest
+// endpoints, at the end of every interval. The counters, samples and gauges
+// with the Key and any other label set are collapsed into a single series:
+// counters and samples are merged, and gauges summed. The other series has
+// every label name of the collapsed label sets, each with the Other value.
+type TopNRule struct {
+	Key    []string // Key of the metric whose label sets are limited
+	N      int      // Number of label sets kept
+	RankBy TopNRank
+
+	// Other is the label value of the collapsed series, defaulting to
+	// DefaultTopNOtherValue
+	Other string
+}
+
+// AddTopN registers a rule applied to every interval that ends after the
+// call. The interval in progress still holds every label set, so it is only
+// bounded once it ends.
+func (i *InmemSink) AddTopN(rule TopNRule) error {
+	if len(rule.Key) == 0 {
+		return fmt.Errorf("top N rule requires a key")
+	}
+	if rule.N <= 0 {
+		return fmt.Errorf("top N rule for %q: N must be positive", i.flattenKey(rule.Key))
+	}
+	if rule.Other == "" {
+		rule.Other = DefaultTopNOtherValue
+	}
+
+	i.intervalLock.Lock()
+	i.topNRules = append(i.topNRules, rule)
+	i.intervalLock.Unlock()
+
+	for _, g := range i.granularitySinks() {
+		g.AddTopN(rule)
+	}
+	return nil
+}
+
+// limitTopN applies the top N rules to a finished interval. The caller must
+// hold intervalLock.
+func (i *InmemSink) limitTopN(intv *IntervalMetrics) {
+	intv.Lock()
+	defer intv.Unlock()
+
+	for _, rule := range i.topNRules {
+		name := i.flattenKey(rule.Key)
+		i.limitSampled(intv.Counters, name, rule, intv.rateDenom)
+		i.limitSampled(intv.Samples, name, rule, intv.rateDenom)
+		i.limitGauges(intv.Gauges, name, rule)
+	}
+}
+
+// limitSampled collapses the counters or samples with the given name
+// outside the top N of the rule
+func (i *InmemSink) limitSampled(values map[string]SampledValue, name string, rule TopNRule, rateDenom float64) {
+	var keys []string
+	for k, v := range values {
+		if v.Name == name {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) <= rule.N {
+		return
+	}
+	sortTopN(keys, func(k string) float64 {
+		return topNValue(values[k].AggregateSample, rule.RankBy)
+	})
+
+	other := &AggregateSample{}
+	var labels [][]Label
+	for _, k := range keys[rule.N:] {
+		v := values[k]
+		other.merge(v.AggregateSample)
+		labels = append(labels, v.Labels)
+		delete(values, k)
+	}
+	if rateDenom > 0 {
+		other.Rate = other.Sum / rateDenom
+	}
+
+	otherLabels := topNOtherLabels(labels, rule.Other)
+	k, _ := i.flattenKeyLabels(rule.Key, otherLabels)
+	if existing, ok := values[k]; ok {
+		// An emitted label set equal to the other labels made the top N
+		other.merge(existing.AggregateSample)
+	}
+	values[k] = SampledValue{Name: name, AggregateSample: other, Labels: otherLabels}
+}
+
+// limitGauges collapses the gauges with the given name outside the top N of
+// the rule into their sum
+func (i *InmemSink) limitGauges(gauges map[string]GaugeValue, name string, rule TopNRule) {
+	var keys []string
+	for k, g := range gauges {
+		if g.Name == name {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) <= rule.N {
+		return
+	}
+	sortTopN(keys, func(k string) float64 { return float64(gauges[k].Value) })
+
+	var sum float32
+	var labels [][]Label
+	for _, k := range keys[rule.N:] {
+		sum += gauges[k].Value
+		labels = append(labels, gauges[k].Labels)
+		delete(gauges, k)
+	}
+
+	otherLabels := topNOtherLabels(labels, rule.Other)
+	k, _ := i.flattenKeyLabels(rule.Key, otherLabels)
+	sum += gauges[k].Value
+	gauges[k] = GaugeValue{Name: name, Value: sum, Labels: otherLabels}
+}
+
+// sortTopN sorts keys by decreasing value, and by key between equal values
+// so the selection is deterministic
+func sortTopN(keys []string, value func(string) float64) {
+	sort.Slice(keys, func(a, b int) bool {
+		va, vb := value(keys[a]), value(keys[b])
+		if va != vb {
+			return va > vb
+		}
+		return keys[a] < keys[b]
+	})
+}
+
+// topNValue returns the value agg is ranked by
+func topNValue(agg *AggregateSample, rank TopNRank) float64 {
+	switch rank {
+	case TopNByCount:
+		return float64(agg.Count)
+	case TopNByMean:
+		return agg.Mean()
+	case TopNByMax:
+		return agg.Max
+	default:
+		return agg.Sum
+	}
+}
+
+// topNOtherLabels returns the sorted label names of the label sets, each
+// with the other value
+func topNOtherLabels(labelSets [][]Label, other string) []Label {
+	seen := make(map[string]bool)
+	var names []string
+	for _, labels := range labelSets {
+		for _, label := range labels {
+			if !seen[label.Name] {
+				seen[label.Name] = true
+				names = append(names, label.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	labels := make([]Label, len(names))
+	for j, name := range names {
+		labels[j] = Label{Name: name, Value: other}
+	}
+	return labels
+}
@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInmemSink_TopN(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 24*time.Hour)
+	if err := inm.AddTopN(TopNRule{Key: []string{"http", "latency"}}); err == nil {
+		t.Fatalf("expected error for N")
+	}
+	if err := inm.AddTopN(TopNRule{N: 2}); err == nil {
+		t.Fatalf("expected error for key")
+	}
+	if err := inm.AddTopN(TopNRule{Key: []string{"http", "latency"}, N: 2, RankBy: TopNByMean}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	intv := finishedInterval(inm)
+	for path, vals := range map[string][]float64{
+		"/a": {1, 1, 1, 1},
+		"/b": {50},
+		"/c": {20, 40},
+		"/d": {2, 4},
+	} {
+		labels := []Label{{"path", path}}
+		agg := &AggregateSample{}
+		for _, v := range vals {
+			agg.Ingest(v, intv.rateDenom)
+		}
+		k, _ := inm.flattenKeyLabels([]string{"http", "latency"}, labels)
+		intv.Samples[k] = SampledValue{Name: "http.latency", AggregateSample: agg, Labels: labels}
+	}
+	ingestCounter(intv, "http.requests;path=/a", []Label{{"path", "/a"}}, 1)
+
+	data := inm.Data()
+	samples := data[0].Samples
+	if len(samples) != 3 {
+		t.Fatalf("bad samples: %v", samples)
+	}
+	if samples["http.latency;path=/b"].AggregateSample.Mean() != 50 || samples["http.latency;path=/c"].AggregateSample.Mean() != 30 {
+		t.Fatalf("bad top samples: %v", samples)
+	}
+	other, ok := samples["http.latency;path=other"]
+	if !ok || other.Name != "http.latency" || !reflect.DeepEqual(other.Labels, []Label{{"path", "other"}}) {
+		t.Fatalf("bad other sample: %v", samples)
+	}
+	if other.Count != 6 || other.Sum != 10 || other.Min != 1 || other.Max != 4 {
+		t.Fatalf("bad other sample: %v", other.AggregateSample)
+	}
+
+	// Other metrics are left alone, as is the interval in progress
+	if _, ok := data[0].Counters["http.requests;path=/a"]; !ok {
+		t.Fatalf("missing counter: %v", data[0].Counters)
+	}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		inm.AddSampleWithLabels([]string{"http", "latency"}, 1, []Label{{"path", path}})
+	}
+	if data := inm.Data(); len(data[1].Samples) != 3 {
+		t.Fatalf("bad current samples: %v", data[1].Samples)
+	}
+}
+
+func TestInmemSink_TopNCounters(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 24*time.Hour)
+	inm.AddTopN(TopNRule{Key: []string{"requests"}, N: 1, Other: "rest"})
+	intv := finishedInterval(inm)
+	for _, c := range []struct {
+		labels []Label
+		vals   []float64
+	}{
+		{[]Label{{"code", "200"}}, []float64{5, 5}},
+		{[]Label{{"code", "500"}}, []float64{1, 1, 1}},
+		{[]Label{{"code", "404"}, {"path", "/x"}}, []float64{2}},
+		{nil, []float64{3}},
+	} {
+		k, _ := inm.flattenKeyLabels([]string{"requests"}, c.labels)
+		ingestCounter(intv, k, c.labels, c.vals...)
+		agg := intv.Counters[k]
+		agg.Name = "requests"
+		intv.Counters[k] = agg
+	}
+
+	counters := inm.Data()[0].Counters
+	if len(counters) != 2 || counters["requests;code=200"].Sum != 10 {
+		t.Fatalf("bad counters: %v", counters)
+	}
+
+	// The other series has every label name of the collapsed label sets
+	other := counters["requests;code=rest;path=rest"]
+	if other.AggregateSample == nil || other.Sum != 8 || other.Count != 5 {
+		t.Fatalf("bad other counter: %v", counters)
+	}
+	if other.Rate != 8/intv.rateDenom {
+		t.Fatalf("bad rate: %v", other.Rate)
+	}
+}
+
+func TestInmemSink_TopNRankBy(t *testing.T) {
+	agg := &AggregateSample{}
+	for _, v := range []float64{1, 2, 9} {
+		agg.Ingest(v, 1)
+	}
+	for rank, expect := range map[TopNRank]float64{
+		TopNBySum:   12,
+		TopNByCount: 3,
+		TopNByMean:  4,
+		TopNByMax:   9,
+	} {
+		if got := topNValue(agg, rank); got != expect {
+			t.Fatalf("bad value for %d: %v", rank, got)
+		}
+	}
+}
+
+func TestInmemSink_TopNGauges(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 24*time.Hour)
+	inm.AddTopN(TopNRule{Key: []string{"queue", "depth"}, N: 2})
+	intv := finishedInterval(inm)
+	for queue, depth := range map[string]float32{"a": 5, "b": 1, "c": 7, "d": 2, "other": 1} {
+		labels := []Label{{"queue", queue}}
+		k, _ := inm.flattenKeyLabels([]string{"queue", "depth"}, labels)
+		intv.Gauges[k] = GaugeValue{Name: "queue.depth", Value: depth, Labels: labels}
+	}
+
+	gauges := inm.Data()[0].Gauges
+	if len(gauges) != 3 || gauges["queue.depth;queue=c"].Value != 7 || gauges["queue.depth;queue=a"].Value != 5 {
+		t.Fatalf("bad gauges: %v", gauges)
+	}
+	if g := gauges["queue.depth;queue=other"]; g.Value != 4 || g.Name != "queue.depth" {
+		t.Fatalf("bad other gauge: %v", g)
+	}
+}
+
+func TestInmemSink_TopNGranularity(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 24*time.Hour)
+	inm.AddTopN(TopNRule{Key: []string{"foo"}, N: 1})
+	if err := inm.AddGranularity("daily", 24*time.Hour, 48*time.Hour); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rules := inm.granularity("daily").topNRules; len(rules) != 1 || rules[0].Other != DefaultTopNOtherValue {
+		t.Fatalf("bad rules: %v", rules)
+	}
+}
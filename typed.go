@@ -0,0 +1,114 @@
+//go:build go1.18
+// +build go1.18
+
+package metrics
+
+import (
+	"time"
+)
+
+// Number is the set of value types accepted by the typed metric descriptors
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 |
+		~float32 | ~float64
+}
+
+// Counter describes a counter metric with a fixed key and labels. It is
+// meant to be declared once as a package level variable, so the key is
+// spelled out in a single place:
+//
+//	var requests = metrics.NewCounter[int]([]string{"http", "requests"})
+//
+//	requests.Inc(metrics.Default(), 1)
+type Counter[V Number] struct {
+	key    []string
+	labels []Label
+}
+
+// NewCounter creates a Counter descriptor
+func NewCounter[V Number](key []string, labels ...Label) Counter[V] {
+	return Counter[V]{key: key, labels: labels}
+}
+
+// Inc increments the counter by v
+func (c Counter[V]) Inc(m *Metrics, v V) {
+	m.IncrCounterWithLabels(c.key, float32(v), fixedLabels(c.labels))
+}
+
+// IncWith increments the counter by v, adding labels to the labels of the
+// descriptor. Labels given here take precedence over descriptor labels with
+// the same name.
+func (c Counter[V]) IncWith(m *Metrics, v V, labels ...Label) {
+	m.IncrCounterWithLabels(c.key, float32(v), mergeLabels(c.labels, labels))
+}
+
+// Gauge describes a gauge metric with a fixed key and labels
+type Gauge[V Number] struct {
+	key    []string
+	labels []Label
+}
+
+// NewGauge creates a Gauge descriptor
+func NewGauge[V Number](key []string, labels ...Label) Gauge[V] {
+	return Gauge[V]{key: key, labels: labels}
+}
+
+// Set sets the gauge to v
+func (g Gauge[V]) Set(m *Metrics, v V) {
+	m.SetGaugeWithLabels(g.key, float32(v), fixedLabels(g.labels))
+}
+
+// SetWith sets the gauge to v, adding labels to the labels of the
+// descriptor. Labels given here take precedence over descriptor labels with
+// the same name.
+func (g Gauge[V]) SetWith(m *Metrics, v V, labels ...Label) {
+	m.SetGaugeWithLabels(g.key, float32(v), mergeLabels(g.labels, labels))
+}
+
+// Sample describes a sample metric with a fixed key and labels
+type Sample[V Number] struct {
+	key    []string
+	labels []Label
+}
+
+// NewSample creates a Sample descriptor
+func NewSample[V Number](key []string, labels ...Label) Sample[V] {
+	return Sample[V]{key: key, labels: labels}
+}
+
+// Add records v
+func (s Sample[V]) Add(m *Metrics, v V) {
+	m.AddSampleWithLabels(s.key, float32(v), fixedLabels(s.labels))
+}
+
+// AddWith records v, adding labels to the labels of the descriptor. Labels
+// given here take precedence over descriptor labels with the same name.
+func (s Sample[V]) AddWith(m *Metrics, v V, labels ...Label) {
+	m.AddSampleWithLabels(s.key, float32(v), mergeLabels(s.labels, labels))
+}
+
+// Timer describes a timer metric with a fixed key and labels
+type Timer struct {
+	key    []string
+	labels []Label
+}
+
+// NewTimer creates a Timer descriptor
+func NewTimer(key []string, labels ...Label) Timer {
+	return Timer{key: key, labels: labels}
+}
+
+// MeasureSince records the time elapsed since start
+//
+//	defer handlerLatency.MeasureSince(metrics.Default(), time.Now())
+func (t Timer) MeasureSince(m *Metrics, start time.Time) {
+	m.MeasureSinceWithLabels(t.key, start, fixedLabels(t.labels))
+}
+
+// MeasureSinceWith records the time elapsed since start, adding labels to
+// the labels of the descriptor. Labels given here take precedence over
+// descriptor labels with the same name.
+func (t Timer) MeasureSinceWith(m *Metrics, start time.Time, labels ...Label) {
+	m.MeasureSinceWithLabels(t.key, start, mergeLabels(t.labels, labels))
+}
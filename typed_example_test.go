@@ -0,0 +1,29 @@
+//go:build go1.18
+// +build go1.18
+
+package metrics_test
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+var (
+	jobsProcessed = metrics.NewCounter[int]([]string{"worker", "jobs_processed"})
+	jobsPending   = metrics.NewGauge[int]([]string{"worker", "jobs_pending"})
+	jobDuration   = metrics.NewTimer([]string{"worker", "job_duration"})
+)
+
+func ExampleCounter() {
+	m := metrics.Default()
+	pending := []string{"a", "b", "c"}
+
+	for range pending {
+		start := time.Now()
+		// do the work...
+		jobDuration.MeasureSince(m, start)
+		jobsProcessed.IncWith(m, 1, metrics.Label{Name: "queue", Value: "default"})
+	}
+	jobsPending.Set(m, 0)
+}
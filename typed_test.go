@@ -0,0 +1,63 @@
+//go:build go1.18
+// +build go1.18
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	testRequests = NewCounter[int]([]string{"http", "requests"}, Label{"proto", "h2"})
+	testQueueLen = NewGauge[uint64]([]string{"queue", "length"})
+	testBodySize = NewSample[int64]([]string{"http", "body_bytes"})
+	testLatency  = NewTimer([]string{"http", "latency"})
+)
+
+func TestTyped_Emit(t *testing.T) {
+	m, met := mockMetric()
+
+	testRequests.Inc(met, 2)
+	testRequests.IncWith(met, 1, Label{"code", "200"}, Label{"proto", "h1"})
+	testQueueLen.Set(met, 7)
+	testBodySize.AddWith(met, 512, Label{"route", "/"})
+	testLatency.MeasureSince(met, time.Now())
+
+	expectKeys := [][]string{
+		{"http", "requests"},
+		{"http", "requests"},
+		{"queue", "length"},
+		{"http", "body_bytes"},
+		{"http", "latency"},
+	}
+	if !reflect.DeepEqual(m.getKeys(), expectKeys) {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+	if !reflect.DeepEqual(m.vals[:4], []float32{2, 1, 7, 512}) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+	expectLabels := [][]Label{
+		{{"proto", "h2"}},
+		{{"code", "200"}, {"proto", "h1"}},
+		nil,
+		{{"route", "/"}},
+		nil,
+	}
+	if !reflect.DeepEqual(m.labels, expectLabels) {
+		t.Fatalf("bad labels: %v", m.labels)
+	}
+}
+
+func TestTyped_DescriptorLabelsNotModified(t *testing.T) {
+	_, met := mockMetric()
+	met.HostName = "host1"
+	met.EnableHostnameLabel = true
+
+	testRequests.Inc(met, 1)
+	testRequests.Inc(met, 1)
+	if !reflect.DeepEqual(testRequests.labels, []Label{{"proto", "h2"}}) {
+		t.Fatalf("descriptor labels modified: %v", testRequests.labels)
+	}
+}
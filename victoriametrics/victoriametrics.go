@@ -0,0 +1,336 @@
+// Package victoriametrics provides a MetricSink which sends metrics to
+// VictoriaMetrics in its JSON line import format.
+package victoriametrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	// DefaultFlushInterval is how often aggregated metrics are sent
+	DefaultFlushInterval = 10 * time.Second
+
+	// DefaultMaxBatchSize is the maximum number of lines sent per request
+	DefaultMaxBatchSize = 1000
+)
+
+// VictoriaMetricsOpts is used to configure the VictoriaMetricsSink
+type VictoriaMetricsOpts struct {
+	// Endpoint is the URL of the JSON line import API lines are posted to,
+	// e.g. http://localhost:8428/api/v1/import. Required.
+	Endpoint string
+
+	// ExtraLabels are added to every series, e.g. to identify the instance.
+	// A label of a metric with the same name takes precedence.
+	ExtraLabels []metrics.Label
+
+	// FlushInterval is how often aggregated metrics are sent. Defaults to
+	// DefaultFlushInterval.
+	FlushInterval time.Duration
+
+	// MaxBatchSize bounds the number of lines sent in a single request.
+	// Defaults to DefaultMaxBatchSize.
+	MaxBatchSize int
+
+	// Client is the HTTP client used to send requests. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	// ErrorLog is used to log failed flushes. Defaults to a FailureLogger
+	// from metrics.NewFailureLogger.
+	ErrorLog *metrics.FailureLogger
+}
+
+// VictoriaMetricsSink provides a MetricSink that aggregates metrics in memory
+// and periodically posts them to the VictoriaMetrics import API, one line
+// per series. Keys are joined with underscores and labels are sent as tags.
+// Gauges are sent with their last value for the flush intervals they are set
+// in. Counters are sent as running totals and samples as running "_count"
+// and "_sum" series, as Prometheus counters and summaries are, for the flush
+// intervals they are updated in, so a lost request is made up for by the
+// next update. Lines of a failed request are dropped.
+type VictoriaMetricsSink struct {
+	// dropped, errors and offset are accessed atomically and kept first to
+	// guarantee 64-bit alignment
+	dropped uint64
+	errors  uint64
+	offset  int64 // time.Duration added to timestamps
+
+	opts VictoriaMetricsOpts
+
+	lock   sync.Mutex
+	series map[string]*series
+
+	stopChan chan struct{}
+	doneChan chan struct{}
+	stopOnce sync.Once
+}
+
+// series holds the value of one metric
+type series struct {
+	name    string
+	typ     string
+	labels  map[string]string
+	value   float64
+	count   uint64
+	updated bool
+}
+
+// line is a series of the JSON line import format
+type line struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// NewVictoriaMetricsSink creates a VictoriaMetricsSink and starts flushing it
+// every opts.FlushInterval. Call Shutdown to flush the remaining metrics and
+// stop.
+func NewVictoriaMetricsSink(opts VictoriaMetricsOpts) (*VictoriaMetricsSink, error) {
+	if opts.Endpoint == "" {
+		return nil, fmt.Errorf("endpoint is required")
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = DefaultMaxBatchSize
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.ErrorLog == nil {
+		opts.ErrorLog = metrics.NewFailureLogger()
+	}
+
+	s := &VictoriaMetricsSink{
+		opts:     opts,
+		series:   make(map[string]*series),
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+	if err := metrics.GoSink(s.flushMetrics); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Shutdown stops the periodic flush and sends the remaining metrics. It is
+// safe to call more than once.
+func (s *VictoriaMetricsSink) Shutdown() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	<-s.doneChan
+	if err := s.Flush(); err != nil {
+		s.opts.ErrorLog.Printf("[ERR] Error flushing to VictoriaMetrics! Err: %s", err)
+	}
+}
+
+// Flush sends the series updated since the last flush, timestamped with the
+// current time
+func (s *VictoriaMetricsSink) Flush() error {
+	ts := time.Now().Add(time.Duration(atomic.LoadInt64(&s.offset))).UnixNano() / int64(time.Millisecond)
+
+	var lines []line
+	s.lock.Lock()
+	for hash, ser := range s.series {
+		if !ser.updated {
+			continue
+		}
+		lines = append(lines, ser.lines(ts)...)
+		ser.updated = false
+		if ser.typ == "gauge" {
+			delete(s.series, hash)
+		}
+	}
+	s.lock.Unlock()
+
+	var firstErr error
+	for len(lines) > 0 {
+		n := len(lines)
+		if n > s.opts.MaxBatchSize {
+			n = s.opts.MaxBatchSize
+		}
+		if err := s.send(lines[:n]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		lines = lines[n:]
+	}
+	return firstErr
+}
+
+// SetTimestampOffset adds offset to the timestamps of later flushes, as
+// described by metrics.TimestampSink
+func (s *VictoriaMetricsSink) SetTimestampOffset(offset time.Duration) {
+	atomic.StoreInt64(&s.offset, int64(offset))
+}
+
+// SinkStats returns the number of lines dropped because their request
+// failed, and the number of failed requests.
+func (s *VictoriaMetricsSink) SinkStats() metrics.SinkStats {
+	return metrics.SinkStats{
+		Dropped: atomic.LoadUint64(&s.dropped),
+		Errors:  atomic.LoadUint64(&s.errors),
+	}
+}
+
+func (s *VictoriaMetricsSink) flushMetrics() {
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+	defer close(s.doneChan)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				s.opts.ErrorLog.Printf("[ERR] Error flushing to VictoriaMetrics! Err: %s", err)
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// send posts a batch of lines
+func (s *VictoriaMetricsSink) send(batch []line) error {
+	err := s.post(batch)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		atomic.AddUint64(&s.dropped, uint64(len(batch)))
+	}
+	return err
+}
+
+func (s *VictoriaMetricsSink) post(batch []line) error {
+	body := &bytes.Buffer{}
+	enc := json.NewEncoder(body)
+	for _, l := range batch {
+		if err := enc.Encode(l); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("POST", s.opts.Endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// lines returns the import lines of the series at ts
+func (ser *series) lines(ts int64) []line {
+	newLine := func(name string, value float64) line {
+		metric := make(map[string]string, len(ser.labels)+1)
+		for k, v := range ser.labels {
+			metric[k] = v
+		}
+		metric["__name__"] = name
+		return line{Metric: metric, Values: []float64{value}, Timestamps: []int64{ts}}
+	}
+	if ser.typ == "summary" {
+		return []line{
+			newLine(ser.name+"_count", float64(ser.count)),
+			newLine(ser.name+"_sum", ser.value),
+		}
+	}
+	return []line{newLine(ser.name, ser.value)}
+}
+
+// forbiddenChars are replaced in metric and label names by underscores
+var forbiddenChars = regexp.MustCompile("[^a-zA-Z0-9_:]")
+
+// getSeries returns the series of a metric, creating it if needed. The
+// caller must hold lock.
+func (s *VictoriaMetricsSink) getSeries(key []string, labels []metrics.Label, typ string) *series {
+	name := forbiddenChars.ReplaceAllString(strings.Join(key, "_"), "_")
+	tags := make(map[string]string, len(s.opts.ExtraLabels)+len(labels))
+	for _, label := range s.opts.ExtraLabels {
+		tags[forbiddenChars.ReplaceAllString(label.Name, "_")] = label.Value
+	}
+	for _, label := range labels {
+		tags[forbiddenChars.ReplaceAllString(label.Name, "_")] = label.Value
+	}
+
+	names := make([]string, 0, len(tags))
+	for k := range tags {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	hash := typ + ":" + name
+	for _, k := range names {
+		hash += fmt.Sprintf(";%s=%s", k, tags[k])
+	}
+
+	ser, ok := s.series[hash]
+	if !ok {
+		ser = &series{name: name, typ: typ, labels: tags}
+		s.series[hash] = ser
+	}
+	ser.updated = true
+	return ser
+}
+
+// Implementation of methods in the MetricSink interface
+
+func (s *VictoriaMetricsSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *VictoriaMetricsSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ser := s.getSeries(key, labels, "gauge")
+	ser.value = float64(val)
+}
+
+// EmitKey is not implemented since VictoriaMetrics does not provide a metric
+// type for arbitrary key/value pairs
+func (s *VictoriaMetricsSink) EmitKey(key []string, val float32) {
+}
+
+func (s *VictoriaMetricsSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *VictoriaMetricsSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ser := s.getSeries(key, labels, "counter")
+	ser.value += float64(val)
+}
+
+func (s *VictoriaMetricsSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *VictoriaMetricsSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ser := s.getSeries(key, labels, "summary")
+	ser.count++
+	ser.value += float64(val)
+}
@@ -0,0 +1,226 @@
+package victoriametrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// fakeEndpoint is an import endpoint recording the lines it receives. The
+// first failures requests are answered with status.
+type fakeEndpoint struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests int
+	failures int
+	status   int
+	received []line
+}
+
+func newFakeEndpoint(t *testing.T) *fakeEndpoint {
+	f := &fakeEndpoint{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		f.requests++
+		if f.failures > 0 {
+			f.failures--
+			w.WriteHeader(f.status)
+			return
+		}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var l line
+			if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+				t.Errorf("bad line %q: %v", scanner.Text(), err)
+			}
+			f.received = append(f.received, l)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return f
+}
+
+// take returns and forgets the lines received, sorted by name
+func (f *fakeEndpoint) take() []line {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	lines := f.received
+	f.received = nil
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i].Metric["__name__"] < lines[j].Metric["__name__"]
+	})
+	return lines
+}
+
+func (f *fakeEndpoint) getRequests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+func testSink(t *testing.T, opts VictoriaMetricsOpts) *VictoriaMetricsSink {
+	opts.FlushInterval = time.Hour
+	sink, err := NewVictoriaMetricsSink(opts)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return sink
+}
+
+func TestNewVictoriaMetricsSink_RequiresEndpoint(t *testing.T) {
+	if _, err := NewVictoriaMetricsSink(VictoriaMetricsOpts{}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestVictoriaMetricsSink_Payload(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, VictoriaMetricsOpts{
+		Endpoint:    f.URL,
+		ExtraLabels: []metrics.Label{{Name: "instance", Value: "a"}, {Name: "region", Value: "east"}},
+	})
+	defer sink.Shutdown()
+
+	labels := []metrics.Label{{Name: "region", Value: "west"}}
+	sink.SetGauge([]string{"a", "gauge"}, 1)
+	sink.SetGauge([]string{"a", "gauge"}, 2)
+	sink.IncrCounterWithLabels([]string{"b", "count"}, 3, labels)
+	sink.IncrCounterWithLabels([]string{"b", "count"}, 4, labels)
+	sink.AddSample([]string{"c", "time-ms"}, 1)
+	sink.AddSample([]string{"c", "time-ms"}, 3)
+	sink.EmitKey([]string{"d", "kv"}, 1)
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	after := time.Now().UnixNano() / int64(time.Millisecond)
+
+	lines := f.take()
+	for i, l := range lines {
+		if len(l.Timestamps) != 1 || l.Timestamps[0] < before || l.Timestamps[0] > after {
+			t.Fatalf("bad timestamps: %v", l.Timestamps)
+		}
+		lines[i].Timestamps = nil
+	}
+	expect := []line{
+		{Metric: map[string]string{"__name__": "a_gauge", "instance": "a", "region": "east"}, Values: []float64{2}},
+		{Metric: map[string]string{"__name__": "b_count", "instance": "a", "region": "west"}, Values: []float64{7}},
+		{Metric: map[string]string{"__name__": "c_time_ms_count", "instance": "a", "region": "east"}, Values: []float64{2}},
+		{Metric: map[string]string{"__name__": "c_time_ms_sum", "instance": "a", "region": "east"}, Values: []float64{4}},
+	}
+	if !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("bad lines:\n%+v\nexpected:\n%+v", lines, expect)
+	}
+
+	// Nothing is sent when there is nothing new
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if f.getRequests() != 1 {
+		t.Fatalf("bad requests: %d", f.getRequests())
+	}
+
+	// Counters and samples keep their running totals
+	sink.IncrCounterWithLabels([]string{"b", "count"}, 1, labels)
+	sink.AddSample([]string{"c", "time-ms"}, 2)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	lines = f.take()
+	if len(lines) != 3 || lines[0].Values[0] != 8 || lines[1].Values[0] != 3 || lines[2].Values[0] != 6 {
+		t.Fatalf("bad lines: %+v", lines)
+	}
+}
+
+func TestVictoriaMetricsSink_Batches(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, VictoriaMetricsOpts{Endpoint: f.URL, MaxBatchSize: 2})
+	defer sink.Shutdown()
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		sink.IncrCounter([]string{k}, 1)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if f.getRequests() != 3 || len(f.take()) != 5 {
+		t.Fatalf("bad requests: %d", f.getRequests())
+	}
+}
+
+func TestVictoriaMetricsSink_Failure(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	f.failures, f.status = 1, http.StatusBadRequest
+	sink := testSink(t, VictoriaMetricsOpts{Endpoint: f.URL})
+	defer sink.Shutdown()
+
+	sink.IncrCounter([]string{"a"}, 1)
+	sink.AddSample([]string{"b"}, 1)
+	if err := sink.Flush(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if stats := sink.SinkStats(); stats.Errors != 1 || stats.Dropped != 3 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+
+	// The next update sends the totals
+	sink.IncrCounter([]string{"a"}, 1)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if lines := f.take(); len(lines) != 1 || lines[0].Values[0] != 2 {
+		t.Fatalf("bad lines: %+v", lines)
+	}
+}
+
+func TestVictoriaMetricsSink_TimestampOffset(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, VictoriaMetricsOpts{Endpoint: f.URL})
+	defer sink.Shutdown()
+
+	var _ metrics.TimestampSink = sink
+	sink.SetTimestampOffset(time.Hour)
+	sink.SetGauge([]string{"a"}, 1)
+	before := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if lines := f.take(); len(lines) != 1 || lines[0].Timestamps[0] < before {
+		t.Fatalf("bad lines: %+v", lines)
+	}
+}
+
+func TestVictoriaMetricsSink_ShutdownFlushes(t *testing.T) {
+	f := newFakeEndpoint(t)
+	defer f.Close()
+	sink := testSink(t, VictoriaMetricsOpts{Endpoint: f.URL})
+
+	sink.IncrCounter([]string{"a"}, 1)
+	sink.Shutdown()
+	if lines := f.take(); len(lines) != 1 {
+		t.Fatalf("bad lines: %+v", lines)
+	}
+
+	// Shutting down again sends nothing more
+	sink.Shutdown()
+	if lines := f.take(); len(lines) != 0 {
+		t.Fatalf("bad lines: %+v", lines)
+	}
+}
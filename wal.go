@@ -0,0 +1,384 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// walSegmentExt is the file extension of WAL segment files
+	walSegmentExt = ".wal"
+
+	// defaultWALSegmentSize is the size after which a WAL segment is rotated
+	defaultWALSegmentSize = 4 * 1024 * 1024
+
+	// defaultWALSegments is the maximum number of WAL segments kept
+	defaultWALSegments = 4
+)
+
+// WALOpts is used to configure the WALSink
+type WALOpts struct {
+	// Dir is the directory holding the WAL segment files. It is created if
+	// it does not exist.
+	Dir string
+
+	// MaxSegmentSize is the size in bytes after which the active segment is
+	// rotated. Defaults to 4MiB.
+	MaxSegmentSize int64
+
+	// MaxSegments bounds the number of segments kept on disk, which bounds
+	// the WAL to roughly MaxSegments * MaxSegmentSize bytes. When exceeded,
+	// the oldest segment is deleted and its records are lost. Defaults to 4.
+	MaxSegments int
+
+	// Prefixes restricts logging to metrics whose key, joined with '.',
+	// starts with one of the prefixes. All metrics are passed on to the
+	// wrapped sink regardless. If empty, every metric is logged.
+	Prefixes []string
+
+	// Format is the encoding of new segments, WALFormatJSON by default.
+	// Replay reads segments in either format, so it can be changed between
+	// runs.
+	Format WALFormat
+}
+
+// walRecord is a single emission as stored in the WAL. JSON segments hold one
+// encoded record per line, binary segments are described in wal_binary.go.
+type walRecord struct {
+	Type   string   `json:"type"` // "gauge", "kv", "counter" or "sample"
+	Key    []string `json:"key"`
+	Value  float32  `json:"value"`
+	Labels []Label  `json:"labels,omitempty"`
+}
+
+// WALSink is a MetricSink that appends emissions to a size-bounded
+// write-ahead log on disk before passing them to a wrapped sink. Records
+// survive a crash of the process and can be replayed into the wrapped sink
+// on restart, which gives at-least-once delivery for the logged metrics.
+//
+// Records are written without fsync, so they survive a process crash but
+// not necessarily a crash of the host. Call Checkpoint once the wrapped sink
+// has delivered everything emitted so far to discard the logged records.
+//
+// On restart the procedure is:
+//
+//	sink, err := NewWALSink(inner, opts) // finds segments left by the previous run
+//	n, err := sink.Replay()               // re-emits them into inner, then deletes them
+type WALSink struct {
+	sink MetricSink
+	opts WALOpts
+
+	lock     sync.Mutex
+	file     *os.File
+	size     int64 // bytes of records in the active segment
+	buf      []byte
+	seq      int
+	segments []string // segments written by this sink, oldest first
+	pending  []string // segments left by a previous run, oldest first
+}
+
+// NewWALSink creates a WALSink logging to opts.Dir and passing emissions on
+// to sink. Segments found in opts.Dir are left in place for Replay.
+func NewWALSink(sink MetricSink, opts WALOpts) (*WALSink, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("WAL directory is required")
+	}
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = defaultWALSegmentSize
+	}
+	if opts.MaxSegments <= 0 {
+		opts.MaxSegments = defaultWALSegments
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	pending, seq, err := listWALSegments(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WALSink{
+		sink:    sink,
+		opts:    opts,
+		seq:     seq,
+		pending: pending,
+	}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Replay re-emits the records of the segments left by a previous run into
+// the wrapped sink and deletes them. It returns the number of replayed
+// records. A truncated last record, as left by a crash mid-write, is
+// skipped.
+func (w *WALSink) Replay() (int, error) {
+	w.lock.Lock()
+	pending := w.pending
+	w.pending = nil
+	w.lock.Unlock()
+
+	total := 0
+	for _, path := range pending {
+		n, err := replayWALSegment(path, w.sink)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if err := os.Remove(path); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Checkpoint discards every record logged so far. It should be called once
+// the wrapped sink has delivered all metrics emitted before the call.
+func (w *WALSink) Checkpoint() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	for _, path := range w.segments {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	w.segments = nil
+	return w.rotate()
+}
+
+// Close closes the active segment. Logged records are kept on disk.
+func (w *WALSink) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.file.Close()
+}
+
+func (w *WALSink) SetGauge(key []string, val float32) {
+	w.SetGaugeWithLabels(key, val, nil)
+}
+
+func (w *WALSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	w.append("gauge", key, val, labels)
+	w.sink.SetGaugeWithLabels(key, val, labels)
+}
+
+func (w *WALSink) EmitKey(key []string, val float32) {
+	w.append("kv", key, val, nil)
+	w.sink.EmitKey(key, val)
+}
+
+func (w *WALSink) IncrCounter(key []string, val float32) {
+	w.IncrCounterWithLabels(key, val, nil)
+}
+
+func (w *WALSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	w.append("counter", key, val, labels)
+	w.sink.IncrCounterWithLabels(key, val, labels)
+}
+
+func (w *WALSink) AddSample(key []string, val float32) {
+	w.AddSampleWithLabels(key, val, nil)
+}
+
+func (w *WALSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	w.append("sample", key, val, labels)
+	w.sink.AddSampleWithLabels(key, val, labels)
+}
+
+// append logs a single emission if its key is selected by the prefixes
+func (w *WALSink) append(typ string, key []string, val float32, labels []Label) {
+	if !w.logged(key) {
+		return
+	}
+	rec := walRecord{Type: typ, Key: key, Value: val, Labels: labels}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var line []byte
+	var err error
+	if w.opts.Format == WALFormatBinary {
+		// Binary records are encoded into a buffer reused across appends
+		w.buf, err = appendWALBinaryRecord(w.buf[:0], rec)
+		line = w.buf
+	} else {
+		line, err = json.Marshal(rec)
+		line = append(line, '\n')
+	}
+	if err != nil {
+		log.Printf("[ERR] Error encoding WAL record! Err: %s", err)
+		return
+	}
+
+	if w.size > 0 && w.size+int64(len(line)) > w.opts.MaxSegmentSize {
+		if err := w.rotate(); err != nil {
+			log.Printf("[ERR] Error rotating WAL segment! Err: %s", err)
+			return
+		}
+	}
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		log.Printf("[ERR] Error writing to WAL! Err: %s", err)
+	}
+}
+
+// logged returns whether emissions for key are written to the WAL
+func (w *WALSink) logged(key []string) bool {
+	if len(w.opts.Prefixes) == 0 {
+		return true
+	}
+	joined := strings.Join(key, ".")
+	for _, prefix := range w.opts.Prefixes {
+		if strings.HasPrefix(joined, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// rotate closes the active segment, if any, and opens a new one, deleting
+// the oldest segments beyond MaxSegments. The caller must hold lock.
+func (w *WALSink) rotate() error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+	}
+
+	w.seq++
+	path := filepath.Join(w.opts.Dir, fmt.Sprintf("%08d%s", w.seq, walSegmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if w.opts.Format == WALFormatBinary {
+		if _, err := f.WriteString(walBinaryMagic); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	w.file = f
+	w.size = 0
+	w.segments = append(w.segments, path)
+
+	for len(w.segments) > w.opts.MaxSegments {
+		if err := os.Remove(w.segments[0]); err != nil {
+			return err
+		}
+		w.segments = w.segments[1:]
+	}
+	return nil
+}
+
+// listWALSegments returns the segment files in dir, oldest first, along
+// with the highest sequence number in use.
+func listWALSegments(dir string) ([]string, int, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var segments []string
+	maxSeq := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walSegmentExt) {
+			continue
+		}
+		var seq int
+		if _, err := fmt.Sscanf(name, "%d"+walSegmentExt, &seq); err != nil {
+			continue
+		}
+		if seq > maxSeq {
+			maxSeq = seq
+		}
+		segments = append(segments, filepath.Join(dir, name))
+	}
+	// Names are zero padded, so lexical order is sequence order
+	sort.Strings(segments)
+	return segments, maxSeq, nil
+}
+
+// replayWALSegment emits every record of the segment at path into sink
+func replayWALSegment(path string, sink MetricSink) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if magic, _ := r.Peek(len(walBinaryMagic)); bytes.Equal(magic, []byte(walBinaryMagic)) {
+		r.Discard(len(walBinaryMagic))
+		return replayWALBinary(r, sink)
+	}
+
+	n := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var rec walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A partially written record, skip it
+			continue
+		}
+		if replayWALRecord(rec, sink) {
+			n++
+		}
+	}
+	return n, scanner.Err()
+}
+
+// replayWALBinary emits every record of a binary segment read from r into
+// sink. As records are length-prefixed, replay stops at a truncated record.
+func replayWALBinary(r *bufio.Reader, sink MetricSink) (int, error) {
+	n := 0
+	for {
+		rec, err := readWALBinaryRecord(r)
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			// The end of the segment, or a partially written last record
+			return n, nil
+		case err != nil:
+			// A malformed record, skip it
+			continue
+		}
+		if replayWALRecord(rec, sink) {
+			n++
+		}
+	}
+}
+
+// replayWALRecord emits rec into sink, returning false for unknown types
+func replayWALRecord(rec walRecord, sink MetricSink) bool {
+	switch rec.Type {
+	case "gauge":
+		sink.SetGaugeWithLabels(rec.Key, rec.Value, rec.Labels)
+	case "kv":
+		sink.EmitKey(rec.Key, rec.Value)
+	case "counter":
+		sink.IncrCounterWithLabels(rec.Key, rec.Value, rec.Labels)
+	case "sample":
+		sink.AddSampleWithLabels(rec.Key, rec.Value, rec.Labels)
+	default:
+		return false
+	}
+	return true
+}
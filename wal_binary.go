@@ -0,0 +1,246 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// WALFormat selects the encoding of the records in WAL segments
+type WALFormat int
+
+const (
+	// WALFormatJSON stores one JSON encoded record per line. It is the
+	// default, and easy to inspect with standard tools.
+	WALFormatJSON WALFormat = iota
+
+	// WALFormatBinary stores length-prefixed binary records, which are
+	// typically less than half the size of JSON ones and several times
+	// cheaper to encode and parse.
+	WALFormatBinary
+)
+
+// walBinaryMagic starts every binary segment, so Replay can tell the formats
+// apart. JSON segments always start with '{'.
+const walBinaryMagic = "\x00MWAL\x01"
+
+// maxWALRecordSize bounds the length of a binary record accepted by Replay,
+// so a corrupted length prefix does not cause a huge allocation
+const maxWALRecordSize = 1 << 20
+
+// Binary record type codes
+const (
+	walTypeGauge byte = iota + 1
+	walTypeKV
+	walTypeCounter
+	walTypeSample
+)
+
+// A binary segment is walBinaryMagic followed by records. Each record is a
+// uvarint length followed by that many bytes of body:
+//
+//	type     1 byte, one of the walType codes
+//	value    4 bytes, little endian IEEE 754 float32 bits
+//	key      uvarint part count, then each part as a string
+//	labels   uvarint label count, then each name and value as a string
+//
+// with strings encoded as a uvarint length followed by the bytes.
+
+// appendWALBinaryRecord appends the length-prefixed binary encoding of rec
+// to buf
+func appendWALBinaryRecord(buf []byte, rec walRecord) ([]byte, error) {
+	var typ byte
+	switch rec.Type {
+	case "gauge":
+		typ = walTypeGauge
+	case "kv":
+		typ = walTypeKV
+	case "counter":
+		typ = walTypeCounter
+	case "sample":
+		typ = walTypeSample
+	default:
+		return buf, fmt.Errorf("unknown record type %q", rec.Type)
+	}
+
+	size := 1 + 4 + uvarintLen(uint64(len(rec.Key))) + uvarintLen(uint64(len(rec.Labels)))
+	for _, part := range rec.Key {
+		size += walStringLen(part)
+	}
+	for _, label := range rec.Labels {
+		size += walStringLen(label.Name) + walStringLen(label.Value)
+	}
+
+	buf = appendUvarint(buf, uint64(size))
+	buf = append(buf, typ)
+	var bits [4]byte
+	binary.LittleEndian.PutUint32(bits[:], math.Float32bits(rec.Value))
+	buf = append(buf, bits[:]...)
+	buf = appendUvarint(buf, uint64(len(rec.Key)))
+	for _, part := range rec.Key {
+		buf = appendWALString(buf, part)
+	}
+	buf = appendUvarint(buf, uint64(len(rec.Labels)))
+	for _, label := range rec.Labels {
+		buf = appendWALString(buf, label.Name)
+		buf = appendWALString(buf, label.Value)
+	}
+	return buf, nil
+}
+
+// readWALBinaryRecord reads the next binary record from r. It returns io.EOF
+// at the end of the segment, and io.ErrUnexpectedEOF when the rest of the
+// segment can't be read, e.g. for a record truncated by a crash mid-write.
+// Other errors are for a malformed record which can be skipped.
+func readWALBinaryRecord(r *bufio.Reader) (walRecord, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		if err == io.EOF {
+			return walRecord{}, io.EOF
+		}
+		return walRecord{}, io.ErrUnexpectedEOF
+	}
+	if size > maxWALRecordSize {
+		// A corrupted length, the following records can't be found
+		return walRecord{}, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return walRecord{}, io.ErrUnexpectedEOF
+	}
+	return decodeWALBinaryRecord(body)
+}
+
+// decodeWALBinaryRecord decodes the body of a binary record
+func decodeWALBinaryRecord(body []byte) (walRecord, error) {
+	var rec walRecord
+	d := walDecoder{buf: body}
+
+	switch d.readByte() {
+	case walTypeGauge:
+		rec.Type = "gauge"
+	case walTypeKV:
+		rec.Type = "kv"
+	case walTypeCounter:
+		rec.Type = "counter"
+	case walTypeSample:
+		rec.Type = "sample"
+	default:
+		return rec, fmt.Errorf("bad WAL record type")
+	}
+	rec.Value = math.Float32frombits(d.readUint32())
+
+	if n := d.readCount(); n > 0 {
+		rec.Key = make([]string, n)
+		for i := range rec.Key {
+			rec.Key[i] = d.readString()
+		}
+	}
+	if n := d.readCount(); n > 0 {
+		rec.Labels = make([]Label, n)
+		for i := range rec.Labels {
+			rec.Labels[i].Name = d.readString()
+			rec.Labels[i].Value = d.readString()
+		}
+	}
+
+	if d.err || len(d.buf) != 0 {
+		return walRecord{}, fmt.Errorf("malformed WAL record")
+	}
+	return rec, nil
+}
+
+// walDecoder consumes fields from a binary record body. Reading past the end
+// sets err and yields zero values.
+type walDecoder struct {
+	buf []byte
+	err bool
+}
+
+func (d *walDecoder) readByte() byte {
+	if len(d.buf) < 1 {
+		d.err = true
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *walDecoder) readUint32() uint32 {
+	if len(d.buf) < 4 {
+		d.err = true
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(d.buf)
+	d.buf = d.buf[4:]
+	return v
+}
+
+func (d *walDecoder) readUint64() uint64 {
+	if len(d.buf) < 8 {
+		d.err = true
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(d.buf)
+	d.buf = d.buf[8:]
+	return v
+}
+
+func (d *walDecoder) readUvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = true
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// readCount reads an element count, which can't exceed the remaining bytes as
+// every element takes at least one
+func (d *walDecoder) readCount() int {
+	n := d.readUvarint()
+	if n > uint64(len(d.buf)) {
+		d.err = true
+		return 0
+	}
+	return int(n)
+}
+
+func (d *walDecoder) readString() string {
+	n := d.readUvarint()
+	if n > uint64(len(d.buf)) {
+		d.err = true
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendWALString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func walStringLen(s string) int {
+	return uvarintLen(uint64(len(s))) + len(s)
+}
+
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
@@ -0,0 +1,217 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWALBinary_RoundTrip(t *testing.T) {
+	records := []walRecord{
+		{Type: "gauge", Key: []string{"gauge", "val"}, Value: 1.5, Labels: []Label{{"a", "b"}, {"c", ""}}},
+		{Type: "kv", Key: []string{"kv"}, Value: -2},
+		{Type: "counter", Key: []string{"counter", "with spaces and ünicode"}, Value: 3},
+		{Type: "sample", Key: []string{"sample"}, Value: 0.000001},
+		{Type: "sample", Value: 5},
+	}
+
+	var buf []byte
+	for _, rec := range records {
+		var err error
+		buf, err = appendWALBinaryRecord(buf, rec)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	r := bufio.NewReader(bytes.NewReader(buf))
+	for _, expect := range records {
+		rec, err := readWALBinaryRecord(r)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reflect.DeepEqual(rec, expect) {
+			t.Fatalf("bad record: %#v, expected %#v", rec, expect)
+		}
+	}
+	if _, err := readWALBinaryRecord(r); err != io.EOF {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+}
+
+func TestWALBinary_UnknownType(t *testing.T) {
+	if _, err := appendWALBinaryRecord(nil, walRecord{Type: "bogus"}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestWALBinary_Malformed(t *testing.T) {
+	rec := walRecord{Type: "counter", Key: []string{"counter"}, Value: 3, Labels: []Label{{"a", "b"}}}
+	valid, err := appendWALBinaryRecord(nil, rec)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Every truncation of a record is detected
+	for i := 1; i < len(valid); i++ {
+		r := bufio.NewReader(bytes.NewReader(valid[:i]))
+		if _, err := readWALBinaryRecord(r); err != io.ErrUnexpectedEOF {
+			t.Fatalf("truncated at %d: expected unexpected EOF, got: %v", i, err)
+		}
+	}
+
+	// A body whose fields don't add up to its length is rejected
+	body := append([]byte(nil), valid[1:]...)
+	body[len(body)-1] = 'x'
+	body = append(body, 'y')
+	if _, err := decodeWALBinaryRecord(body); err == nil {
+		t.Fatalf("expected error for trailing bytes")
+	}
+	bad := append([]byte(nil), valid[1:]...)
+	bad[0] = 0xff
+	if _, err := decodeWALBinaryRecord(bad); err == nil {
+		t.Fatalf("expected error for bad type")
+	}
+
+	// A corrupted length ends the segment
+	huge := appendUvarint(nil, maxWALRecordSize+1)
+	if _, err := readWALBinaryRecord(bufio.NewReader(bytes.NewReader(huge))); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF, got: %v", err)
+	}
+}
+
+func TestWALSink_BinaryReplay(t *testing.T) {
+	dir := tempWALDir(t)
+	defer os.RemoveAll(dir)
+
+	// A JSON segment from an older run is replayed along with binary ones
+	w, err := NewWALSink(&BlackholeSink{}, WALOpts{Dir: dir})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	w.SetGauge([]string{"json"}, 1)
+	w.Close()
+
+	w, err = NewWALSink(&BlackholeSink{}, WALOpts{Dir: dir, Format: WALFormatBinary})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	w.SetGaugeWithLabels([]string{"gauge"}, 2, []Label{{"a", "b"}})
+	w.EmitKey([]string{"kv"}, 3)
+	w.IncrCounter([]string{"counter"}, 4)
+	w.AddSample([]string{"sample"}, 5)
+	w.Close()
+
+	path := filepath.Join(dir, "00000002.wal")
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.HasPrefix(raw, []byte(walBinaryMagic)) {
+		t.Fatalf("missing binary header: %q", raw)
+	}
+
+	// Simulate a crash mid-write of the last record
+	partial, _ := appendWALBinaryRecord(nil, walRecord{Type: "counter", Key: []string{"lost"}, Value: 6})
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f.Write(partial[:len(partial)-2])
+	f.Close()
+
+	inner := &MockSink{}
+	w, err = NewWALSink(inner, WALOpts{Dir: dir, Format: WALFormatBinary})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer w.Close()
+
+	n, err := w.Replay()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 5 {
+		t.Fatalf("bad replay count: %d", n)
+	}
+	if !reflect.DeepEqual(inner.keys, [][]string{{"json"}, {"gauge"}, {"kv"}, {"counter"}, {"sample"}}) {
+		t.Fatalf("bad keys: %v", inner.keys)
+	}
+	if !reflect.DeepEqual(inner.vals, []float32{1, 2, 3, 4, 5}) {
+		t.Fatalf("bad vals: %v", inner.vals)
+	}
+	if !reflect.DeepEqual(inner.labels[1], []Label{{"a", "b"}}) {
+		t.Fatalf("bad labels: %v", inner.labels)
+	}
+}
+
+func TestWALSink_BinaryRotation(t *testing.T) {
+	dir := tempWALDir(t)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWALSink(&BlackholeSink{}, WALOpts{Dir: dir, MaxSegmentSize: 40, Format: WALFormatBinary})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer w.Close()
+
+	// Each record is 18 bytes, so segments hold two records
+	for i := 0; i < 5; i++ {
+		w.IncrCounter([]string{"counter", "a"}, 1)
+	}
+	segments, _, _ := listWALSegments(dir)
+	if len(segments) != 3 {
+		t.Fatalf("bad segments: %v", segments)
+	}
+	for _, path := range segments {
+		raw, _ := ioutil.ReadFile(path)
+		if !bytes.HasPrefix(raw, []byte(walBinaryMagic)) {
+			t.Fatalf("missing binary header in %s", path)
+		}
+	}
+}
+
+func BenchmarkWAL_Format(b *testing.B) {
+	rec := walRecord{
+		Type:   "sample",
+		Key:    []string{"service", "http", "request", "duration"},
+		Value:  12.5,
+		Labels: []Label{{"method", "GET"}, {"status", "200"}},
+	}
+
+	b.Run("json", func(b *testing.B) {
+		var size int
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			line, _ := json.Marshal(rec)
+			size = len(line) + 1
+			var out walRecord
+			if err := json.Unmarshal(line, &out); err != nil {
+				b.Fatalf("err: %v", err)
+			}
+		}
+		b.ReportMetric(float64(size), "bytes/record")
+	})
+
+	b.Run("binary", func(b *testing.B) {
+		var buf []byte
+		src := bytes.NewReader(nil)
+		r := bufio.NewReader(src)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf, _ = appendWALBinaryRecord(buf[:0], rec)
+			src.Reset(buf)
+			r.Reset(src)
+			if _, err := readWALBinaryRecord(r); err != nil {
+				b.Fatalf("err: %v", err)
+			}
+		}
+		b.ReportMetric(float64(len(buf)), "bytes/record")
+	})
+}
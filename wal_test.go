@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func tempWALDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "metrics-wal")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return dir
+}
+
+func TestWALSink_Append(t *testing.T) {
+	dir := tempWALDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &MockSink{}
+	w, err := NewWALSink(inner, WALOpts{Dir: dir, Prefixes: []string{"billing."}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer w.Close()
+
+	w.IncrCounterWithLabels([]string{"billing", "charges"}, 3, []Label{{"a", "b"}})
+	w.SetGauge([]string{"other"}, 1)
+
+	// Everything reaches the wrapped sink
+	if len(inner.keys) != 2 {
+		t.Fatalf("bad keys: %v", inner.keys)
+	}
+
+	// Only selected metrics are logged
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "00000001.wal"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := `{"type":"counter","key":["billing","charges"],"value":3,"labels":[{"Name":"a","Value":"b"}]}` + "\n"
+	if string(raw) != expected {
+		t.Fatalf("bad WAL contents: %s", raw)
+	}
+}
+
+func TestWALSink_Rotation(t *testing.T) {
+	dir := tempWALDir(t)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWALSink(&BlackholeSink{}, WALOpts{Dir: dir, MaxSegmentSize: 100, MaxSegments: 3})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer w.Close()
+
+	// Each record is ~45 bytes, so segments hold two records
+	for j := 0; j < 20; j++ {
+		w.IncrCounter([]string{"foo"}, float32(j))
+	}
+
+	segments, _, err := listWALSegments(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(segments) != 3 {
+		t.Fatalf("expected segments to be bounded, got: %v", segments)
+	}
+	for _, path := range segments {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if info.Size() > 100 {
+			t.Fatalf("segment %s too large: %d", path, info.Size())
+		}
+	}
+	if filepath.Base(segments[2]) != "00000010.wal" {
+		t.Fatalf("bad newest segment: %v", segments)
+	}
+}
+
+func TestWALSink_Replay(t *testing.T) {
+	dir := tempWALDir(t)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWALSink(&BlackholeSink{}, WALOpts{Dir: dir})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	w.SetGaugeWithLabels([]string{"gauge"}, 1, []Label{{"a", "b"}})
+	w.EmitKey([]string{"kv"}, 2)
+	w.IncrCounter([]string{"counter"}, 3)
+	w.AddSample([]string{"sample"}, 4)
+	w.Close()
+
+	// Simulate a crash mid-write of the last record
+	f, err := os.OpenFile(filepath.Join(dir, "00000001.wal"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f.WriteString(`{"type":"cou`)
+	f.Close()
+
+	// Restart and replay into the real sink
+	inner := &MockSink{}
+	w, err = NewWALSink(inner, WALOpts{Dir: dir})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer w.Close()
+
+	n, err := w.Replay()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("bad replay count: %d", n)
+	}
+	if !reflect.DeepEqual(inner.keys, [][]string{{"gauge"}, {"kv"}, {"counter"}, {"sample"}}) {
+		t.Fatalf("bad keys: %v", inner.keys)
+	}
+	if !reflect.DeepEqual(inner.vals, []float32{1, 2, 3, 4}) {
+		t.Fatalf("bad vals: %v", inner.vals)
+	}
+	if !reflect.DeepEqual(inner.labels[0], []Label{{"a", "b"}}) {
+		t.Fatalf("bad labels: %v", inner.labels)
+	}
+
+	// Replayed segments are removed, the new active segment remains
+	segments, _, _ := listWALSegments(dir)
+	if len(segments) != 1 || !strings.HasSuffix(segments[0], "00000002.wal") {
+		t.Fatalf("bad segments: %v", segments)
+	}
+	if n, _ := w.Replay(); n != 0 {
+		t.Fatalf("expected nothing left to replay, got: %d", n)
+	}
+}
+
+func TestWALSink_Checkpoint(t *testing.T) {
+	dir := tempWALDir(t)
+	defer os.RemoveAll(dir)
+
+	w, err := NewWALSink(&BlackholeSink{}, WALOpts{Dir: dir, MaxSegmentSize: 100})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for j := 0; j < 5; j++ {
+		w.IncrCounter([]string{"foo"}, 1)
+	}
+	if err := w.Checkpoint(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	w.IncrCounter([]string{"bar"}, 1)
+	w.Close()
+
+	inner := &MockSink{}
+	w, err = NewWALSink(inner, WALOpts{Dir: dir})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer w.Close()
+	if _, err := w.Replay(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(inner.keys, [][]string{{"bar"}}) {
+		t.Fatalf("expected only records after the checkpoint, got: %v", inner.keys)
+	}
+}
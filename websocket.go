@@ -0,0 +1,541 @@
+package metrics
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultWebSocketBuffer is the number of frames buffered per client of
+	// a WebSocketSink by default
+	DefaultWebSocketBuffer = 256
+
+	// DefaultWebSocketWriteTimeout is how long a WebSocketSink waits for a
+	// frame to be written to a client by default
+	DefaultWebSocketWriteTimeout = 10 * time.Second
+)
+
+const (
+	// websocketGUID is appended to the key of a handshake to compute the
+	// accept header, see RFC 6455
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// maxWebSocketFrame bounds the payload of the frames read from clients,
+	// which are only expected to send control frames
+	maxWebSocketFrame = 64 * 1024
+
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xa
+)
+
+// wsGoingAway is the payload of the close frame sent on Shutdown, status
+// 1001
+var wsGoingAway = []byte{0x03, 0xe9}
+
+// errWebSocketClosed is returned for writes after the close frame was sent
+var errWebSocketClosed = errors.New("websocket closed")
+
+// WebSocketMode selects what a WebSocketSink streams to its clients
+type WebSocketMode int
+
+const (
+	// WebSocketEmissions streams each emission as a WebSocketEmission
+	WebSocketEmissions WebSocketMode = iota
+
+	// WebSocketIntervals aggregates the emissions into intervals of
+	// WebSocketOpts.Interval and streams the MetricsSummary of each, as
+	// served by InmemSink.DisplayMetrics, once it ends
+	WebSocketIntervals
+)
+
+// WebSocketOpts is used to configure a WebSocketSink
+type WebSocketOpts struct {
+	// Mode selects whether emissions or interval summaries are streamed.
+	// Defaults to WebSocketEmissions.
+	Mode WebSocketMode
+
+	// Interval is the length of the intervals summarized with
+	// WebSocketIntervals. Required in that mode.
+	Interval time.Duration
+
+	// Buffer is the number of frames buffered per client. Frames for a
+	// client whose buffer is full are dropped. Defaults to
+	// DefaultWebSocketBuffer.
+	Buffer int
+
+	// WriteTimeout is how long writing a frame to a client may take before
+	// the client is disconnected. Defaults to DefaultWebSocketWriteTimeout.
+	WriteTimeout time.Duration
+
+	// Clock is the source of the current time, mostly for testing. Defaults
+	// to the system clock.
+	Clock Clock
+}
+
+// WebSocketEmission is the JSON frame streamed for each emission with
+// WebSocketEmissions
+type WebSocketEmission struct {
+	Time   time.Time
+	Type   string
+	Name   string
+	Value  float32
+	Labels map[string]string `json:",omitempty"`
+}
+
+// WebSocketSink is a MetricSink and an http.Handler streaming the metrics to
+// the WebSocket clients connected to it as JSON text frames, for live
+// dashboards without polling. Depending on its mode, each emission is sent
+// as it is made, or the summary of each interval once it ends. Clients only
+// receive what is emitted while they are connected.
+//
+// Every client has its own buffer of frames, so a slow client never holds up
+// the emitters or the other clients: frames for a client whose buffer is
+// full are dropped and counted by SinkStats, and the client receives the
+// later ones once it catches up. Frames sent by clients are only read to
+// answer pings and close frames.
+type WebSocketSink struct {
+	// dropped and errors are accessed atomically and kept first to
+	// guarantee 64-bit alignment
+	dropped uint64
+	errors  uint64
+
+	buffer       int
+	writeTimeout time.Duration
+	clock        Clock
+
+	// inmem aggregates the intervals with WebSocketIntervals, and is nil
+	// otherwise
+	inmem *InmemSink
+
+	lock    sync.RWMutex
+	clients map[*wsClient]struct{}
+	stopped bool
+	wg      sync.WaitGroup
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// wsClient is a client connected to a WebSocketSink
+type wsClient struct {
+	conn    net.Conn
+	timeout time.Duration
+	frames  chan []byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// writeLock serializes the frames written by the sink and the replies
+	// to the control frames of the client
+	writeLock sync.Mutex
+	closeSent bool
+}
+
+// NewWebSocketSink creates a WebSocketSink, which is served to clients as an
+// http.Handler
+func NewWebSocketSink(opts WebSocketOpts) (*WebSocketSink, error) {
+	if opts.Mode != WebSocketEmissions && opts.Mode != WebSocketIntervals {
+		return nil, fmt.Errorf("invalid websocket mode %d", opts.Mode)
+	}
+	if opts.Mode == WebSocketIntervals && opts.Interval <= 0 {
+		return nil, fmt.Errorf("invalid websocket interval %v", opts.Interval)
+	}
+	if opts.Buffer < 0 {
+		return nil, fmt.Errorf("invalid websocket buffer %d", opts.Buffer)
+	}
+	if opts.WriteTimeout < 0 {
+		return nil, fmt.Errorf("invalid websocket write timeout %v", opts.WriteTimeout)
+	}
+	if opts.Buffer == 0 {
+		opts.Buffer = DefaultWebSocketBuffer
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = DefaultWebSocketWriteTimeout
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+
+	s := &WebSocketSink{
+		buffer:       opts.Buffer,
+		writeTimeout: opts.WriteTimeout,
+		clock:        opts.Clock,
+		clients:      make(map[*wsClient]struct{}),
+		stopCh:       make(chan struct{}),
+		doneCh:       make(chan struct{}),
+	}
+	if opts.Mode == WebSocketIntervals {
+		s.inmem = NewInmemSinkWithClock(opts.Interval, opts.Interval, opts.Clock)
+		interval := s.inmem.getInterval()
+		if err := GoSink(func() { s.streamIntervals(interval) }); err != nil {
+			return nil, err
+		}
+	} else {
+		close(s.doneCh)
+	}
+	return s, nil
+}
+
+// Shutdown sends a close frame to the connected clients and disconnects
+// them, and stops streaming. Later connections are refused.
+func (s *WebSocketSink) Shutdown() {
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		return
+	}
+	s.stopped = true
+	s.lock.Unlock()
+
+	close(s.stopCh)
+	s.wg.Wait()
+	<-s.doneCh
+}
+
+// Clients returns the number of connected clients
+func (s *WebSocketSink) Clients() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.clients)
+}
+
+// SinkStats returns the number of frames dropped for clients with a full
+// buffer, and the number of failed writes
+func (s *WebSocketSink) SinkStats() SinkStats {
+	return SinkStats{
+		Dropped: atomic.LoadUint64(&s.dropped),
+		Errors:  atomic.LoadUint64(&s.errors),
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and streams the
+// metrics to it until the client disconnects or the sink is shut down
+func (s *WebSocketSink) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	accept, ok := websocketAccept(req)
+	if !ok {
+		resp.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(resp, "websocket handshake expected", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		http.Error(resp, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	s.lock.RLock()
+	stopped := s.stopped
+	s.lock.RUnlock()
+	if stopped {
+		http.Error(resp, "metrics stream shut down", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return
+	}
+	defer conn.Close()
+	c := &wsClient{
+		conn:    conn,
+		timeout: s.writeTimeout,
+		frames:  make(chan []byte, s.buffer),
+		closed:  make(chan struct{}),
+	}
+	handshake := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+	if err := c.writeFrame([]byte(handshake), false); err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return
+	}
+
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		c.writeFrame(appendWebSocketFrame(nil, wsOpClose, wsGoingAway), true)
+		return
+	}
+	s.clients[c] = struct{}{}
+	s.wg.Add(1)
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.clients, c)
+		s.lock.Unlock()
+		s.wg.Done()
+	}()
+
+	goCounted(func() { c.readLoop(rw.Reader) })
+	for {
+		select {
+		case frame := <-c.frames:
+			if err := c.writeFrame(frame, false); err != nil {
+				if err != errWebSocketClosed {
+					atomic.AddUint64(&s.errors, 1)
+				}
+				return
+			}
+		case <-c.closed:
+			return
+		case <-s.stopCh:
+			c.writeFrame(appendWebSocketFrame(nil, wsOpClose, wsGoingAway), true)
+			return
+		}
+	}
+}
+
+// streamIntervals broadcasts the summary of each interval of inmem once it
+// ends, starting with interval
+func (s *WebSocketSink) streamIntervals(interval *IntervalMetrics) {
+	defer close(s.doneCh)
+	for {
+		select {
+		case <-interval.done:
+			summary := newMetricSummaryFromInterval(interval, s.inmem.interval)
+			if payload, err := json.Marshal(summary); err != nil {
+				atomic.AddUint64(&s.errors, 1)
+			} else {
+				s.broadcast(appendWebSocketFrame(nil, wsOpText, payload), nil, nil)
+			}
+			interval = s.inmem.getInterval()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// emit broadcasts an emission with WebSocketEmissions
+func (s *WebSocketSink) emit(typ MetricType, key []string, val float32, labels []Label) {
+	if s.Clients() == 0 {
+		return
+	}
+	e := WebSocketEmission{
+		Time:  s.clock.Now(),
+		Type:  typ.String(),
+		Name:  strings.Join(key, "."),
+		Value: val,
+	}
+	if len(labels) > 0 {
+		e.Labels = make(map[string]string, len(labels))
+		for _, label := range labels {
+			e.Labels[label.Name] = label.Value
+		}
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return
+	}
+	s.broadcast(appendWebSocketFrame(nil, wsOpText, payload), key, labels)
+}
+
+// broadcast queues frame for every client, dropping it for those whose
+// buffer is full
+func (s *WebSocketSink) broadcast(frame []byte, key []string, labels []Label) {
+	dropped := 0
+	s.lock.RLock()
+	for c := range s.clients {
+		select {
+		case c.frames <- frame:
+		default:
+			dropped++
+		}
+	}
+	s.lock.RUnlock()
+
+	for n := 0; n < dropped; n++ {
+		atomic.AddUint64(&s.dropped, 1)
+		notifyDrop(key, labels, DropQueueFull)
+	}
+}
+
+// writeFrame writes raw bytes to the client, refusing to once the close
+// frame was sent, and marks close frames as sent if closing
+func (c *wsClient) writeFrame(frame []byte, closing bool) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.closeSent {
+		return errWebSocketClosed
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(frame)
+	c.closeSent = closing
+	return err
+}
+
+// readLoop reads the frames of the client, answering its pings and its close
+// frame, until the connection fails or closes
+func (c *wsClient) readLoop(r *bufio.Reader) {
+	defer c.closeOnce.Do(func() { close(c.closed) })
+	for {
+		opcode, payload, err := readWebSocketFrame(r)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsOpClose:
+			// Echo the status code, completing the closing handshake
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(appendWebSocketFrame(nil, wsOpClose, payload), true)
+			return
+		case wsOpPing:
+			if c.writeFrame(appendWebSocketFrame(nil, wsOpPong, payload), false) != nil {
+				return
+			}
+		}
+	}
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept header answering req, and
+// whether req is a valid WebSocket handshake
+func websocketAccept(req *http.Request) (string, bool) {
+	if req.Method != "GET" ||
+		!headerHasToken(req.Header, "Connection", "upgrade") ||
+		!headerHasToken(req.Header, "Upgrade", "websocket") ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return "", false
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return "", false
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:]), true
+}
+
+// headerHasToken returns whether the comma separated values of the header
+// name include token, ignoring case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// appendWebSocketFrame appends an unmasked, unfragmented frame, as sent by
+// servers, to buf
+func appendWebSocketFrame(buf []byte, opcode byte, payload []byte) []byte {
+	buf = append(buf, 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, byte(n))
+	case n <= 0xffff:
+		var ext [2]byte
+		binary.BigEndian.PutUint16(ext[:], uint16(n))
+		buf = append(append(buf, 126), ext[:]...)
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		buf = append(append(buf, 127), ext[:]...)
+	}
+	return append(buf, payload...)
+}
+
+// readWebSocketFrame reads a frame sent by a client, which must be masked,
+// returning its opcode and unmasked payload
+func readWebSocketFrame(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	if head[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("unmasked websocket frame")
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > maxWebSocketFrame {
+		return 0, nil, fmt.Errorf("websocket frame of %d bytes too large", n)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return head[0] & 0x0f, payload, nil
+}
+
+func (s *WebSocketSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *WebSocketSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	if s.inmem != nil {
+		s.inmem.SetGaugeWithLabels(key, val, labels)
+		return
+	}
+	s.emit(MetricTypeGauge, key, val, labels)
+}
+
+func (s *WebSocketSink) EmitKey(key []string, val float32) {
+	if s.inmem != nil {
+		s.inmem.EmitKey(key, val)
+		return
+	}
+	s.emit(MetricTypeKey, key, val, nil)
+}
+
+func (s *WebSocketSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *WebSocketSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	if s.inmem != nil {
+		s.inmem.IncrCounterWithLabels(key, val, labels)
+		return
+	}
+	s.emit(MetricTypeCounter, key, val, labels)
+}
+
+func (s *WebSocketSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *WebSocketSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	if s.inmem != nil {
+		s.inmem.AddSampleWithLabels(key, val, labels)
+		return
+	}
+	s.emit(MetricTypeSample, key, val, labels)
+}
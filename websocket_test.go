@@ -0,0 +1,272 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialWebSocket connects a client to srv, checking the handshake with the
+// example key of RFC 6455
+func dialWebSocket(t *testing.T, srv *httptest.Server) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fmt.Fprintf(conn, "GET /stream HTTP/1.1\r\nHost: localhost\r\n"+
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("bad handshake %d %v", resp.StatusCode, resp.Header)
+	}
+	return conn, r
+}
+
+// readServerFrame reads an unmasked frame sent by the server
+func readServerFrame(t *testing.T, conn net.Conn, r *bufio.Reader) (byte, []byte) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	n := uint64(head[1])
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+// writeClientFrame writes a masked frame, as sent by clients
+func writeClientFrame(conn net.Conn, opcode byte, payload []byte) {
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	conn.Write(frame)
+}
+
+func waitForClients(t *testing.T, s *WebSocketSink, n int) {
+	deadline := time.Now().Add(time.Second)
+	for s.Clients() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d clients, got %d", n, s.Clients())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebSocketSink_Emissions(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s, err := NewWebSocketSink(WebSocketOpts{Clock: clock})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s.Shutdown()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// Emissions without clients are not streamed later
+	s.SetGauge([]string{"before"}, 1)
+	conn, r := dialWebSocket(t, srv)
+	defer conn.Close()
+	waitForClients(t, s, 1)
+
+	long := strings.Repeat("x", 200)
+	s.SetGaugeWithLabels([]string{"api", "inflight"}, 3, []Label{{"method", "GET"}})
+	s.IncrCounter([]string{"api", "requests"}, 1)
+	s.AddSample([]string{long}, 2.5)
+	s.EmitKey([]string{"key"}, 4)
+
+	expect := []WebSocketEmission{
+		{Time: clock.Now(), Type: "gauge", Name: "api.inflight", Value: 3, Labels: map[string]string{"method": "GET"}},
+		{Time: clock.Now(), Type: "counter", Name: "api.requests", Value: 1},
+		{Time: clock.Now(), Type: "sample", Name: long, Value: 2.5},
+		{Time: clock.Now(), Type: "key", Name: "key", Value: 4},
+	}
+	for _, e := range expect {
+		opcode, payload := readServerFrame(t, conn, r)
+		var got WebSocketEmission
+		if err := json.Unmarshal(payload, &got); err != nil || opcode != wsOpText {
+			t.Fatalf("bad frame %d %q: %v", opcode, payload, err)
+		}
+		if !got.Time.Equal(e.Time) {
+			t.Fatalf("bad time %v", got.Time)
+		}
+		got.Time = e.Time
+		if !reflect.DeepEqual(got, e) {
+			t.Fatalf("bad emission %+v, expected %+v", got, e)
+		}
+	}
+}
+
+func TestWebSocketSink_Intervals(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s, err := NewWebSocketSink(WebSocketOpts{Mode: WebSocketIntervals, Interval: 10 * time.Second, Clock: clock})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s.Shutdown()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	conn, r := dialWebSocket(t, srv)
+	defer conn.Close()
+	waitForClients(t, s, 1)
+
+	// Each interval is streamed once it ends
+	for n := 1; n <= 2; n++ {
+		s.SetGauge([]string{"g"}, float32(n))
+		s.IncrCounter([]string{"c"}, 1)
+		s.IncrCounter([]string{"c"}, 1)
+		s.inmem.ForceRollover()
+
+		_, payload := readServerFrame(t, conn, r)
+		var summary MetricsSummary
+		if err := json.Unmarshal(payload, &summary); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(summary.Gauges) != 1 || summary.Gauges[0].Name != "g" || summary.Gauges[0].Value != float32(n) {
+			t.Fatalf("bad gauges %+v", summary.Gauges)
+		}
+		if len(summary.Counters) != 1 || summary.Counters[0].Count != 2 {
+			t.Fatalf("bad counters %+v", summary.Counters)
+		}
+	}
+}
+
+func TestWebSocketSink_SlowClient(t *testing.T) {
+	s, err := NewWebSocketSink(WebSocketOpts{Buffer: 2})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s.Shutdown()
+
+	var drops []string
+	SetOnDrop(func(key []string, labels []Label, reason string) {
+		drops = append(drops, strings.Join(key, ".")+" "+reason)
+	})
+	defer SetOnDrop(nil)
+
+	// A client not reading gets the frames which fit its buffer, without
+	// holding up the others
+	slow := &wsClient{frames: make(chan []byte, 2)}
+	fast := &wsClient{frames: make(chan []byte, 8)}
+	s.clients[slow] = struct{}{}
+	s.clients[fast] = struct{}{}
+	for n := 0; n < 4; n++ {
+		s.IncrCounter([]string{"c"}, float32(n))
+	}
+	if len(slow.frames) != 2 || len(fast.frames) != 4 {
+		t.Fatalf("bad buffers %d %d", len(slow.frames), len(fast.frames))
+	}
+	if stats := s.SinkStats(); stats.Dropped != 2 {
+		t.Fatalf("bad stats %+v", stats)
+	}
+	if !reflect.DeepEqual(drops, []string{"c queue_full", "c queue_full"}) {
+		t.Fatalf("bad drops %v", drops)
+	}
+	delete(s.clients, slow)
+	delete(s.clients, fast)
+}
+
+func TestWebSocketSink_Close(t *testing.T) {
+	s, err := NewWebSocketSink(WebSocketOpts{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// Pings are answered, and a close from the client is echoed
+	conn, r := dialWebSocket(t, srv)
+	defer conn.Close()
+	waitForClients(t, s, 1)
+	writeClientFrame(conn, wsOpPing, []byte("hello"))
+	if opcode, payload := readServerFrame(t, conn, r); opcode != wsOpPong || string(payload) != "hello" {
+		t.Fatalf("bad pong %d %q", opcode, payload)
+	}
+	writeClientFrame(conn, wsOpClose, []byte{0x03, 0xe8, 'b', 'y', 'e'})
+	if opcode, payload := readServerFrame(t, conn, r); opcode != wsOpClose || !reflect.DeepEqual(payload, []byte{0x03, 0xe8}) {
+		t.Fatalf("bad close %d %q", opcode, payload)
+	}
+	waitForClients(t, s, 0)
+
+	// Shutdown closes the connections and refuses new ones
+	conn, r = dialWebSocket(t, srv)
+	defer conn.Close()
+	waitForClients(t, s, 1)
+	s.Shutdown()
+	if opcode, payload := readServerFrame(t, conn, r); opcode != wsOpClose || !reflect.DeepEqual(payload, wsGoingAway) {
+		t.Fatalf("bad close %d %q", opcode, payload)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("bad status %d", resp.StatusCode)
+	}
+	if stats := s.SinkStats(); stats != (SinkStats{}) {
+		t.Fatalf("bad stats %+v", stats)
+	}
+}
+
+func TestWebSocketSink_Errors(t *testing.T) {
+	s, err := NewWebSocketSink(WebSocketOpts{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s.Shutdown()
+
+	// Requests which aren't WebSocket handshakes are refused
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/stream", nil))
+	if rec.Code != http.StatusBadRequest || rec.Header().Get("Sec-WebSocket-Version") != "13" {
+		t.Fatalf("bad response %d %v", rec.Code, rec.Header())
+	}
+
+	for _, opts := range []WebSocketOpts{
+		{Mode: 7},
+		{Mode: WebSocketIntervals},
+		{Buffer: -1},
+		{WriteTimeout: -time.Second},
+	} {
+		if _, err := NewWebSocketSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}